@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Access windows: a course with AccessDays > 0 sells time-limited access
+// (e.g. 365 days). The window starts when a student gets a seat, either at
+// enrollment or on promotion from the waitlist, and can be extended with a
+// renewal. Expired students keep their enrollment record, so renewing does
+// not make them queue for a seat again.
+
+// Reminders go out once per expiry date, this long before it.
+const (
+	expiryReminderWindow   = 7 * 24 * time.Hour
+	expiryReminderInterval = time.Hour
+)
+
+// Access states reported to clients.
+const (
+	accessActive     = "active"
+	accessExpired    = "expired"
+	accessWaitlisted = "waitlisted"
+)
+
+// accessExpiry returns when access to c granted at start ends, or nil for
+// lifetime access.
+func accessExpiry(c course, start time.Time) *time.Time {
+	if c.AccessDays <= 0 {
+		return nil
+	}
+	t := start.AddDate(0, 0, c.AccessDays)
+	return &t
+}
+
+func (en enrollment) accessState(now time.Time) string {
+	switch {
+	case en.Status == "waitlisted":
+		return accessWaitlisted
+	case en.ExpiresAt != nil && !now.Before(*en.ExpiresAt):
+		return accessExpired
+	}
+	return accessActive
+}
+
+// findEnrollment returns the enrollment of student in course id. The caller
+// must hold courseMu.
+func findEnrollment(id int, student string) (*enrollment, bool) {
+	roster := enrollments[id]
+	if roster == nil {
+		return nil, false
+	}
+	student = studentKey(student)
+	for _, list := range [][]enrollment{roster.enrolled, roster.waitlist} {
+		for i := range list {
+			if list[i].Student == student {
+				return &list[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// courseAccess is the answer to "may this student open the course now?".
+type courseAccess struct {
+	CourseId  int        `json:"course_id"`
+	Student   string     `json:"student"`
+	Access    string     `json:"access"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// courseAccessHandler serves GET /courses/{id}/enrollments/{student}/access.
+// Content endpoints, and services that serve course content, use it as the
+// gate: 200 means the student may proceed, 403 means the window has ended
+// or the student has no seat yet. It answers the student and those who may
+// manage the course's enrollments.
+func courseAccessHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	student := studentKey(r.PathValue("student"))
+
+	courseMu.RLock()
+	var a courseAccess
+	i := findCourseIndex(id)
+	en, ok := findEnrollment(id, student)
+	if !ok || i < 0 || !tenantOwns(r, CourseList[i]) {
+		courseMu.RUnlock()
+		writeError(w, r, "Enrollment not found", http.StatusNotFound)
+		return
+	}
+	if !allowEnrollmentAccess(w, r, CourseList[i], student, true) {
+		courseMu.RUnlock()
+		return
+	}
+	a = courseAccess{CourseId: id, Student: student, Access: en.accessState(time.Now()), ExpiresAt: en.ExpiresAt}
+	courseMu.RUnlock()
+
+	switch a.Access {
+	case accessExpired:
+		writeError(w, r, "Access expired on "+a.ExpiresAt.Format(time.DateOnly)+"; renew to continue", http.StatusForbidden)
+	case accessWaitlisted:
+		writeError(w, r, "Student is on the waitlist", http.StatusForbidden)
+	default:
+		w.Header().Set("Cache-Control", "no-store")
+		writeValue(w, r, http.StatusOK, a)
+	}
+}
+
+// courseRenewHandler serves POST /courses/{id}/enrollments/{student}/renew.
+// A renewal adds one access window, counted from the current expiry if it
+// is still in the future and from now otherwise, so renewing early never
+// loses days. A renewal grants access without an order, so only admins and
+// the course's owners may renew, with course-write credentials.
+func courseRenewHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	student := studentKey(r.PathValue("student"))
+
+	courseMu.Lock()
+	defer courseMu.Unlock()
+
+	i := findCourseIndex(id)
+	en, ok := findEnrollment(id, student)
+	if i < 0 || !ok || !tenantOwns(r, CourseList[i]) {
+		writeError(w, r, "Enrollment not found", http.StatusNotFound)
+		return
+	}
+	if !allowEnrollmentAccess(w, r, CourseList[i], student, false) {
+		return
+	}
+	if en.Status != "enrolled" {
+		writeError(w, r, "Waitlisted enrollments cannot be renewed", http.StatusConflict)
+		return
+	}
+	if en.ExpiresAt == nil {
+		writeError(w, r, "Enrollment has lifetime access", http.StatusConflict)
+		return
+	}
+	start := time.Now().UTC()
+	if en.ExpiresAt.After(start) {
+		start = *en.ExpiresAt
+	}
+	// A course switched to lifetime access since enrollment makes
+	// accessExpiry return nil, which is the right outcome for a renewal too.
+	en.ExpiresAt = accessExpiry(CourseList[i], start)
+	en.reminded = false
+	requestLogger(r).Info("Renewed access", "student", student, "course_id", id)
+	writeValue(w, r, http.StatusOK, *en)
+}
+
+// dashboardEntry is one row of a student's dashboard.
+type dashboardEntry struct {
+	CourseId      int        `json:"course_id"`
+	CourseName    string     `json:"course_name"`
+	Status        string     `json:"status"`
+	Access        string     `json:"access"`
+	EnrolledAt    time.Time  `json:"enrolled_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	DaysRemaining *int       `json:"days_remaining,omitempty"`
+}
+
+// studentEnrollmentsHandler serves GET /students/{student}/enrollments, the
+// data behind the student dashboard: every course of the request's tenant
+// the student is in, with how long access lasts. Only the student and
+// admins may read it.
+func studentEnrollmentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	student := studentKey(r.PathValue("student"))
+	if !allowStudentAccess(w, r, student, "only the student and admins can read a student's enrollments") {
+		return
+	}
+	now := time.Now()
+
+	courseMu.RLock()
+	entries := []dashboardEntry{}
+	for _, c := range CourseList {
+		en, ok := findEnrollment(c.CourseId, student)
+		if !ok || !tenantOwns(r, c) {
+			continue
+		}
+		e := dashboardEntry{
+			CourseId:   c.CourseId,
+			CourseName: c.CourseName,
+			Status:     en.Status,
+			Access:     en.accessState(now),
+			EnrolledAt: en.EnrolledAt,
+			ExpiresAt:  en.ExpiresAt,
+		}
+		if en.ExpiresAt != nil {
+			days := max(int(en.ExpiresAt.Sub(now).Hours()/24), 0)
+			e.DaysRemaining = &days
+		}
+		entries = append(entries, e)
+	}
+	courseMu.RUnlock()
+
+	writeValue(w, r, http.StatusOK, entries)
+}
+
+// expiryReminder is sent when a student's access is about to end.
+type expiryReminder struct {
+	CourseId   int       `json:"course_id"`
+	CourseName string    `json:"course_name"`
+	Student    string    `json:"student"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// notifyExpiry delivers a reminder. There is no mail integration yet, so
+// reminders are logged; replace this to send them somewhere. A reminder
+// it fails to send is dead-lettered (deadletters.go).
+var notifyExpiry = func(rem expiryReminder) error {
+	slog.Info("Access expires", "student", rem.Student, "course", rem.CourseName, "expires_at", rem.ExpiresAt)
+	return nil
+}
+
+func (rem expiryReminder) jobID() string {
+	return fmt.Sprintf("%d/%s/%d", rem.CourseId, rem.Student, rem.ExpiresAt.Unix())
+}
+
+// sendExpiryReminder sends rem as a tracked job.
+func sendExpiryReminder(rem expiryReminder) error {
+	j := trackJob(jobExpiryReminder, rem.jobID())
+	j.attempt()
+	err := notifyExpiry(rem)
+	j.done(err)
+	return err
+}
+
+// runExpiryReminders checks for expiring access every interval until the
+// process exits.
+func runExpiryReminders(interval time.Duration) {
+	for range time.Tick(interval) {
+		sendExpiryReminders(time.Now())
+	}
+}
+
+// sendExpiryReminders notifies every student whose access ends within
+// expiryReminderWindow of now and who has not been reminded yet.
+func sendExpiryReminders(now time.Time) {
+	var due []expiryReminder
+	courseMu.Lock()
+	for _, c := range CourseList {
+		roster := enrollments[c.CourseId]
+		if roster == nil {
+			continue
+		}
+		for i := range roster.enrolled {
+			en := &roster.enrolled[i]
+			if en.ExpiresAt == nil || en.reminded || en.accessState(now) != accessActive {
+				continue
+			}
+			if en.ExpiresAt.Sub(now) <= expiryReminderWindow {
+				en.reminded = true
+				due = append(due, expiryReminder{c.CourseId, c.CourseName, en.Student, *en.ExpiresAt})
+			}
+		}
+	}
+	courseMu.Unlock()
+
+	// Deliver outside the lock so a slow notifier cannot stall requests.
+	for _, rem := range due {
+		if err := sendExpiryReminder(rem); err != nil {
+			payload, _ := json.Marshal(rem)
+			addDeadLetter(&deadLetter{
+				Kind:     jobExpiryReminder,
+				Job:      rem.jobID(),
+				Error:    err.Error(),
+				Payload:  payload,
+				Attempts: []deadLetterAttempt{{At: time.Now().UTC(), Error: err.Error()}},
+				retry:    func() error { return sendExpiryReminder(rem) },
+			})
+		}
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: อายุการเข้าถึงคอร์ส (Access Expiry / License Window)
+
+	1. course กำหนด `access_days` ได้ เช่น 365 = เรียนได้ 12 เดือน (0 หรือไม่ระบุ = เรียนได้ตลอดชีพ)
+	   - วันหมดอายุ (`expires_at`) คำนวณตอนได้ที่นั่ง ถ้าเข้า waitlist ก่อน จะเริ่มนับตอนถูกเลื่อนขึ้นมา
+	2. `GET /courses/{id}/enrollments/{student}/access` ใช้เป็นด่านตรวจก่อนเปิดเนื้อหา: 200 = เข้าได้, 403 = หมดอายุหรือยังอยู่ใน waitlist
+	3. `POST /courses/{id}/enrollments/{student}/renew` ต่ออายุอีกหนึ่งรอบ โดยนับต่อจากวันหมดอายุเดิม (ถ้ายังไม่หมด) ต่ออายุก่อนจึงไม่เสียวัน
+	4. `GET /students/{student}/enrollments` คือข้อมูลหน้า dashboard ของผู้เรียน บอกสถานะและจำนวนวันที่เหลือ
+	5. มี goroutine ตรวจทุกชั่วโมง แจ้งเตือนผู้ที่จะหมดอายุภายใน 7 วัน (ครั้งเดียวต่อวันหมดอายุ) ผ่าน `notifyExpiry`
+*/
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// With ACCESS_LOG set, every request gets one line on standard output
+// when it finishes, apart from the application log on standard error:
+//
+//   - common: Common Log Format with the request ID and the latency in
+//     seconds appended,
+//     127.0.0.1 - - [14/Oct/2026:07:34:35 +0000] "GET /courses HTTP/1.1" 200 512 3f2a9c1d0b4e5f60 0.002140
+//   - json: one object per line with the same values.
+//
+// Paths are logged without their query, which can carry credentials such
+// as a signed download link's signature. The remote address is the
+// client's, through TRUSTED_PROXIES. ACCESS_LOG_SKIP_HEALTH=true leaves out
+// /healthz, /readyz and the server's own warm-up and probe requests, which
+// are made far more often than anybody reads them.
+
+const (
+	accessLogCommon = "common"
+	accessLogJSON   = "json"
+)
+
+var (
+	accessLogFormat     string // "" for no access log
+	accessLogSkipHealth = os.Getenv("ACCESS_LOG_SKIP_HEALTH") == "true"
+)
+
+func init() {
+	switch v := os.Getenv("ACCESS_LOG"); v {
+	case "", accessLogCommon, accessLogJSON:
+		accessLogFormat = v
+	default:
+		log.Fatalf("Invalid ACCESS_LOG %q: use common or json", v)
+	}
+}
+
+// accessRecord is one access log line.
+type accessRecord struct {
+	Time       time.Time `json:"time"`
+	RemoteIP   string    `json:"remote_ip"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+	RequestID  string    `json:"request_id"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+}
+
+// writeAccessLog logs r, which was answered with status and the given
+// number of body bytes, if the access log is on.
+func writeAccessLog(r *http.Request, id string, status int, bytes int64, start time.Time) {
+	if accessLogFormat == "" || accessLogSkipHealth && isHealthCheck(r) {
+		return
+	}
+	rec := accessRecord{
+		Time:       start.UTC(),
+		RemoteIP:   "-",
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Proto:      r.Proto,
+		Status:     status,
+		Bytes:      bytes,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		RequestID:  id,
+		UserAgent:  r.UserAgent(),
+	}
+	if addr := clientIP(r); addr.IsValid() {
+		rec.RemoteIP = addr.String()
+	}
+	var line []byte
+	if accessLogFormat == accessLogJSON {
+		line, _ = json.Marshal(rec)
+	} else {
+		line = fmt.Appendf(nil, "%s - - [%s] %q %d %s %s %s",
+			rec.RemoteIP, rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			rec.Method+" "+rec.Path+" "+rec.Proto, rec.Status, commonLogBytes(rec.Bytes),
+			rec.RequestID, strconv.FormatFloat(rec.DurationMS/1000, 'f', 6, 64))
+	}
+	// One write per line, so lines from concurrent requests do not mix.
+	os.Stdout.Write(append(line, '\n'))
+}
+
+// commonLogBytes is the size field of Common Log Format, "-" for none.
+func commonLogBytes(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// isHealthCheck reports whether r is a health check, or a warm-up or probe
+// request. Warm-up requests are told by their User-Agent, so only those
+// from the loopback address count.
+func isHealthCheck(r *http.Request) bool {
+	switch {
+	case r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || isProbeRequest(r):
+		return true
+	case r.UserAgent() == warmUpUserAgent:
+		return clientIP(r).IsLoopback()
+	}
+	return false
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: access log บรรทัดละ request ออก stdout แยกจาก log ของแอป (stderr)
+
+	1. `ACCESS_LOG=common` ได้ Common Log Format ต่อท้ายด้วย request ID และเวลาที่ใช้ (วินาที), `ACCESS_LOG=json` ได้ object ละบรรทัด
+	   - มี method, path, status, bytes, latency, IP ของ client (ตาม `TRUSTED_PROXIES`) และ request ID
+	   - ไม่บันทึก query string เพราะอาจมีความลับ เช่น signature ของลิงก์ดาวน์โหลด
+	2. `ACCESS_LOG_SKIP_HEALTH=true` ตัด `/healthz`, `/readyz`, request warm-up (จาก loopback) และ synthetic probe ออก ไม่ให้ log รก
+	3. ไม่ตั้ง `ACCESS_LOG` = ไม่มี access log เหมือนเดิม
+*/
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With ACME_CACHE_DIR set, the server gets its own certificates from an
+// ACME certificate authority (RFC 8555), Let's Encrypt unless
+// ACME_DIRECTORY_URL names another, for the tenants' domains and
+// TLS_DOMAINS. The first handshake for such a name orders its
+// certificate, and certificates are renewed in the background once they
+// are within 30 days of expiring. The cache directory keeps the account
+// key and a <domain>.crt and <domain>.key per name, as in TLS_CERT_DIR, so
+// a restart does not order again. ACME_EMAIL, if set, is given to the
+// authority for expiry notices.
+//
+// Domains are proven with the http-01 challenge, which the plain
+// listener answers at /.well-known/acme-challenge/, so port 80 of every
+// domain must reach it. That is the only challenge type implemented, and
+// the client speaks just enough of the protocol to order and download a
+// certificate.
+
+const (
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	acmeRenewBefore   = 30 * 24 * time.Hour
+	acmeRenewInterval = 12 * time.Hour
+	// acmeRetryDelay keeps a failing name from using up the authority's
+	// rate limits, which are a few failed orders per hour.
+	acmeRetryDelay  = 15 * time.Minute
+	acmePollDelay   = 2 * time.Second
+	acmePollTimeout = 2 * time.Minute
+)
+
+var (
+	acmeCacheDir     = os.Getenv("ACME_CACHE_DIR")
+	acmeDirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+	acmeEmail        = os.Getenv("ACME_EMAIL")
+	acmeClient       = &http.Client{Timeout: 30 * time.Second}
+	// acme is nil unless ACME_CACHE_DIR is set.
+	acme *acmeManager
+)
+
+func init() {
+	if s := os.Getenv("ACME_DIRECTORY_URL"); s != "" {
+		acmeDirectoryURL = s
+	}
+	if acmeCacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(acmeCacheDir, 0o700); err != nil {
+		log.Fatalf("Invalid ACME_CACHE_DIR: %v", err)
+	}
+	key, err := loadACMEAccountKey(filepath.Join(acmeCacheDir, "account.key"))
+	if err != nil {
+		log.Fatalf("Invalid ACME_CACHE_DIR: %v", err)
+	}
+	acme = newACMEManager(key)
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type  string `json:"type"`
+		URL   string `json:"url"`
+		Token string `json:"token"`
+		Error *struct {
+			Detail string `json:"detail"`
+		} `json:"error"`
+	} `json:"challenges"`
+}
+
+type acmeManager struct {
+	key        *ecdsa.PrivateKey
+	jwk        map[string]string
+	thumbprint string
+
+	// orderMu lets one order run at a time; it protects dir, account and
+	// nonce.
+	orderMu sync.Mutex
+	dir     *acmeDirectory
+	account string // the account URL, which signs every request after the first
+	nonce   string
+
+	mu       sync.Mutex
+	tokens   map[string]string // key authorizations of the open challenges, by token
+	certs    map[string]*tls.Certificate
+	failed   map[string]time.Time // by name, when its last order failed
+	renewing map[string]bool
+}
+
+func newACMEManager(key *ecdsa.PrivateKey) *acmeManager {
+	pub, _ := key.PublicKey.Bytes() // 0x04, X, Y
+	enc := base64.RawURLEncoding
+	jwk := map[string]string{"crv": "P-256", "kty": "EC", "x": enc.EncodeToString(pub[1:33]), "y": enc.EncodeToString(pub[33:])}
+	// The thumbprint hashes the members in lexical order (RFC 7638),
+	// which is how encoding/json writes a map.
+	b, _ := json.Marshal(jwk)
+	sum := sha256.Sum256(b)
+	return &acmeManager{
+		key:        key,
+		jwk:        jwk,
+		thumbprint: enc.EncodeToString(sum[:]),
+		tokens:     map[string]string{},
+		certs:      map[string]*tls.Certificate{},
+		failed:     map[string]time.Time{},
+		renewing:   map[string]bool{},
+	}
+}
+
+// loadACMEAccountKey reads the account key at path, creating it the first
+// time.
+func loadACMEAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, writeACMEFile(filepath.Base(path), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM key", path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// writeACMEFile replaces name in ACME_CACHE_DIR with data, readable only
+// by the server.
+func writeACMEFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(acmeCacheDir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(acmeCacheDir, name))
+}
+
+// certificate returns the certificate for name, ordering it if there is
+// none that is still valid and starting a renewal if it is due.
+func (m *acmeManager) certificate(name string) (*tls.Certificate, error) {
+	if c := m.cached(name); c != nil {
+		if time.Until(c.Leaf.NotAfter) < acmeRenewBefore {
+			m.mu.Lock()
+			if !m.renewing[name] {
+				m.renewing[name] = true
+				go m.renew(name)
+			}
+			m.mu.Unlock()
+		}
+		return c, nil
+	}
+	m.orderMu.Lock()
+	defer m.orderMu.Unlock()
+	// Another handshake may have ordered it while this one waited.
+	if c := m.cached(name); c != nil {
+		return c, nil
+	}
+	return m.order(name)
+}
+
+// cached returns the certificate for name, from memory or the cache
+// directory, or nil if there is none or it has expired.
+func (m *acmeManager) cached(name string) *tls.Certificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.certs[name]
+	if c == nil {
+		loaded, err := tls.LoadX509KeyPair(filepath.Join(acmeCacheDir, name+".crt"), filepath.Join(acmeCacheDir, name+".key"))
+		if err != nil {
+			return nil
+		}
+		c = &loaded
+		m.certs[name] = c
+	}
+	if time.Now().After(c.Leaf.NotAfter) {
+		return nil
+	}
+	return c
+}
+
+// renew orders a new certificate for name unless that is no longer due.
+// The old certificate stays in use if it fails.
+func (m *acmeManager) renew(name string) {
+	m.orderMu.Lock()
+	defer m.orderMu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.renewing, name)
+		m.mu.Unlock()
+	}()
+	if c := m.cached(name); c != nil && time.Until(c.Leaf.NotAfter) >= acmeRenewBefore {
+		return
+	}
+	m.order(name)
+}
+
+// runACMERenewals renews the certificates in use that are due every
+// interval, so quiet domains do not wait for a handshake to renew.
+func runACMERenewals(interval time.Duration) {
+	for range time.Tick(interval) {
+		acme.mu.Lock()
+		var due []string
+		for name, c := range acme.certs {
+			if time.Until(c.Leaf.NotAfter) < acmeRenewBefore {
+				due = append(due, name)
+			}
+		}
+		acme.mu.Unlock()
+		for _, name := range due {
+			acme.renew(name)
+		}
+	}
+}
+
+// order gets a new certificate for name and caches it, unless an order
+// for name failed within acmeRetryDelay. Callers must hold orderMu.
+func (m *acmeManager) order(name string) (*tls.Certificate, error) {
+	m.mu.Lock()
+	failed := m.failed[name]
+	m.mu.Unlock()
+	if time.Since(failed) < acmeRetryDelay {
+		return nil, fmt.Errorf("the last certificate order for %s failed; retrying after %s", name, failed.Add(acmeRetryDelay).Format(time.RFC3339))
+	}
+	slog.Info("Ordering a certificate", "name", name, "directory", acmeDirectoryURL)
+	cert, err := m.obtain(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		slog.Error("Cannot get a certificate", "name", name, "err", err)
+		m.failed[name] = time.Now()
+		return nil, err
+	}
+	slog.Info("Got a certificate", "name", name, "not_after", cert.Leaf.NotAfter)
+	delete(m.failed, name)
+	m.certs[name] = cert
+	return cert, nil
+}
+
+// obtain runs an order for name and saves the certificate and its key to
+// the cache directory.
+func (m *acmeManager) obtain(name string) (*tls.Certificate, error) {
+	if err := m.register(); err != nil {
+		return nil, fmt.Errorf("account: %w", err)
+	}
+	var o acmeOrder
+	h, err := m.postJSON(m.dir.NewOrder, map[string]any{"identifiers": []any{map[string]string{"type": "dns", "value": name}}}, &o)
+	if err != nil {
+		return nil, err
+	}
+	orderURL := h.Get("Location")
+	for _, url := range o.Authorizations {
+		if err := m.authorize(url); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: name}, DNSNames: []string{name}}, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.postJSON(o.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, &o); err != nil {
+		return nil, err
+	}
+	if o.Status != "valid" {
+		if err := m.poll(orderURL, &o, &o.Status); err != nil {
+			return nil, err
+		}
+	}
+	_, chain, err := m.post(o.Certificate, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("the authority sent an unusable certificate: %w", err)
+	}
+	if err := writeACMEFile(name+".key", keyPEM); err != nil {
+		return nil, err
+	}
+	if err := writeACMEFile(name+".crt", chain); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// register fetches the directory and creates the account, or finds the
+// existing one for the key, the first time it is called.
+func (m *acmeManager) register() error {
+	if m.account != "" {
+		return nil
+	}
+	if m.dir == nil {
+		resp, err := acmeClient.Get(acmeDirectoryURL)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("directory %s: %s", acmeDirectoryURL, resp.Status)
+		}
+		var dir acmeDirectory
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&dir); err != nil {
+			return fmt.Errorf("directory %s: %w", acmeDirectoryURL, err)
+		}
+		m.dir = &dir
+	}
+	req := map[string]any{"termsOfServiceAgreed": true}
+	if acmeEmail != "" {
+		req["contact"] = []string{"mailto:" + acmeEmail}
+	}
+	h, _, err := m.post(m.dir.NewAccount, req)
+	if err != nil {
+		return err
+	}
+	if m.account = h.Get("Location"); m.account == "" {
+		return errors.New("the authority did not return an account URL")
+	}
+	return nil
+}
+
+// authorize answers the http-01 challenge of the authorization at url and
+// waits for the authority to check it.
+func (m *acmeManager) authorize(url string) error {
+	var a acmeAuthorization
+	if _, err := m.postJSON(url, nil, &a); err != nil {
+		return err
+	}
+	if a.Status == "valid" {
+		return nil
+	}
+	i := 0
+	for i < len(a.Challenges) && a.Challenges[i].Type != "http-01" {
+		i++
+	}
+	if i == len(a.Challenges) {
+		return fmt.Errorf("%s: the authority offers no http-01 challenge", a.Identifier.Value)
+	}
+	token, challengeURL := a.Challenges[i].Token, a.Challenges[i].URL
+	m.mu.Lock()
+	m.tokens[token] = token + "." + m.thumbprint
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.tokens, token)
+		m.mu.Unlock()
+	}()
+
+	if _, err := m.postJSON(challengeURL, struct{}{}, nil); err != nil {
+		return err
+	}
+	if err := m.poll(url, &a, &a.Status); err != nil {
+		for _, c := range a.Challenges {
+			if c.Error != nil {
+				return fmt.Errorf("%s: %s", a.Identifier.Value, c.Error.Detail)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// poll fetches url into v until *status is valid or invalid, or
+// acmePollTimeout passes.
+func (m *acmeManager) poll(url string, v any, status *string) error {
+	deadline := time.Now().Add(acmePollTimeout)
+	for {
+		time.Sleep(acmePollDelay)
+		if _, err := m.postJSON(url, nil, v); err != nil {
+			return err
+		}
+		switch *status {
+		case "valid":
+			return nil
+		case "invalid":
+			return fmt.Errorf("%s is invalid", url)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s is still %s after %s", url, *status, acmePollTimeout)
+		}
+	}
+}
+
+// postJSON is post with the response decoded into out, if it is not nil.
+func (m *acmeManager) postJSON(url string, payload, out any) (http.Header, error) {
+	h, body, err := m.post(url, payload)
+	if err == nil && out != nil {
+		if err = json.Unmarshal(body, out); err != nil {
+			err = fmt.Errorf("%s: %w", url, err)
+		}
+	}
+	return h, err
+}
+
+// post sends payload to url signed by the account key, or a POST-as-GET
+// if payload is nil. A rejected nonce is retried once with a fresh one.
+func (m *acmeManager) post(url string, payload any) (http.Header, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		jws, err := m.sign(url, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := acmeClient.Post(url, "application/jose+json", bytes.NewReader(jws))
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		m.nonce = resp.Header.Get("Replay-Nonce")
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode >= 400 {
+			var problem struct{ Type, Detail string }
+			json.Unmarshal(body, &problem)
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+				continue
+			}
+			return nil, nil, fmt.Errorf("%s: %s: %s", url, resp.Status, problem.Detail)
+		}
+		return resp.Header, body, nil
+	}
+}
+
+// sign returns the flattened JWS of payload for url (RFC 8555 §6.2), with
+// the account key as a JWK until there is an account URL.
+func (m *acmeManager) sign(url string, payload any) ([]byte, error) {
+	if m.nonce == "" {
+		resp, err := acmeClient.Head(m.dir.NewNonce)
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		if m.nonce = resp.Header.Get("Replay-Nonce"); m.nonce == "" {
+			return nil, errors.New("the authority did not return a nonce")
+		}
+	}
+	protected := map[string]any{"alg": "ES256", "nonce": m.nonce, "url": url}
+	m.nonce = ""
+	if m.account == "" {
+		protected["jwk"] = m.jwk
+	} else {
+		protected["kid"] = m.account
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, m.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return json.Marshal(map[string]string{
+		"protected": enc.EncodeToString(header),
+		"payload":   enc.EncodeToString(body),
+		"signature": enc.EncodeToString(sig),
+	})
+}
+
+// acmeChallengeHandler answers the authority's http-01 requests on the
+// plain listener, ahead of any HTTPS redirect, and passes the rest to
+// next.
+func acmeChallengeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, acmeChallengePath)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		acme.mu.Lock()
+		keyAuth := acme.tokens[token]
+		acme.mu.Unlock()
+		if keyAuth == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, keyAuth)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: server ขอและต่ออายุ certificate เองผ่าน ACME (Let's Encrypt) ไม่ต้องพึ่ง certbot
+
+	1. ตั้ง `ACME_CACHE_DIR` เพื่อเปิดใช้ ใช้ได้เฉพาะชื่อใน allowlist: domain ของ tenant และ `TLS_DOMAINS` (ชื่ออื่นขอไม่ได้ กันคนยิง SNI มั่ว ๆ ให้ไปขอ cert)
+	   - `ACME_DIRECTORY_URL` เปลี่ยน CA ได้ (เช่น staging ของ Let's Encrypt) และ `ACME_EMAIL` ไว้รับแจ้งเตือน
+	2. handshake แรกของชื่อที่ยังไม่มี cert จะสั่งขอทันที ยืนยันความเป็นเจ้าของด้วย http-01 ที่ `/.well-known/acme-challenge/` บน port HTTP
+	   - port 80 ของทุก domain ต้องวิ่งมาถึง listener HTTP ของ server
+	3. เก็บ account key และ `<domain>.crt`/`.key` ใน cache dir (รูปแบบเดียวกับ `TLS_CERT_DIR`) restart แล้วไม่ต้องขอใหม่
+	4. ต่ออายุเบื้องหลังเมื่อเหลือไม่ถึง 30 วัน (ตอน handshake และรอบตรวจทุก 12 ชั่วโมง) ขอไม่สำเร็จยังใช้ cert เดิมต่อ
+	   - ชื่อที่ขอพลาดจะรอ 15 นาทีก่อนลองใหม่ ไม่ให้ชน rate limit ของ CA
+	5. เขียนโปรโตคอล ACME (RFC 8555) เองด้วย stdlib เฉพาะส่วนที่ต้องใช้ เพราะ repo ไม่มี go.mod ใช้ autocert ไม่ได้
+*/
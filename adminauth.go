@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Everything under /admin, from the admin UI to import, webhooks and
+// payouts, can be put behind HTTP Basic auth by setting ADMIN_USERNAME and
+// ADMIN_PASSWORD, and behind a Google or GitHub login (oauth.go). Either
+// gets in when both are set, as does any admin session (sessions.go) or
+// client certificate mapped to the admin role (mtls.go). With neither
+// the admin routes stay open, as before, and a warning is logged at
+// startup. Course writes have their own credentials (see auth.go).
+
+var (
+	adminUsername = os.Getenv("ADMIN_USERNAME")
+	adminPassword = os.Getenv("ADMIN_PASSWORD")
+)
+
+func init() {
+	if (adminUsername == "") != (adminPassword == "") {
+		log.Fatal("Set both ADMIN_USERNAME and ADMIN_PASSWORD, or neither")
+	}
+	if !adminAuthEnabled() {
+		slog.Warn("Neither ADMIN_USERNAME/ADMIN_PASSWORD nor an OAuth login is set up; /admin is open to anyone")
+	}
+}
+
+func adminAuthEnabled() bool {
+	return adminUsername != "" || oauthEnabled()
+}
+
+func isAdminPath(path string) bool {
+	return path == "/admin" || strings.HasPrefix(path, "/admin/")
+}
+
+// checkAdminCredentials reports whether user and password are the admin
+// ones. Both are hashed before the constant-time comparison so that
+// neither their contents nor their lengths show in the timing.
+func checkAdminCredentials(user, password string) bool {
+	u1, u2 := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(adminUsername))
+	p1, p2 := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(adminPassword))
+	// Both comparisons always run, so a wrong username takes as long as a
+	// wrong password.
+	userOK := subtle.ConstantTimeCompare(u1[:], u2[:])
+	passwordOK := subtle.ConstantTimeCompare(p1[:], p2[:])
+	return userOK&passwordOK == 1
+}
+
+// adminAuthHandler asks for the admin credentials on /admin routes. It runs
+// before the concurrency limiter, so requests without them never take a
+// slot.
+func adminAuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s, ok := requestSession(r); ok && s.Role == roleAdmin || !adminAuthEnabled() || !isAdminPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if user, password, ok := r.BasicAuth(); ok && adminUsername != "" && checkAdminCredentials(user, password) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if c, ok := requestClientCert(r); ok && c.Role == roleAdmin {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// A browser opening the admin UI is sent to sign in.
+		if oauthEnabled() && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+		if adminUsername != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+		}
+		writeError(w, r, "Unauthorized: admin credentials required", http.StatusUnauthorized)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ป้องกันทุก route ใต้ `/admin` ด้วย HTTP Basic auth
+
+	1. ตั้ง `ADMIN_USERNAME` และ `ADMIN_PASSWORD` แล้วทุก request ไป `/admin/...` ต้องส่ง `Authorization: Basic ...` มาด้วย
+	   - ไม่ส่งหรือส่งผิดได้ 401 พร้อม `WWW-Authenticate` ให้ browser เด้งหน้าต่าง login ของหน้า admin UI
+	   - ถ้าไม่ได้ตั้งทั้งคู่ admin เปิดเหมือนเดิม แต่ log เตือนตอน start; ตั้งแค่ตัวเดียวจะ start ไม่ขึ้น
+	2. เทียบ username/password แบบ constant-time (`crypto/subtle`) หลัง hash ด้วย SHA-256 ก่อน เวลาที่ใช้จึงไม่บอกว่าผิดตัวไหนหรือยาวเท่าไร
+	3. login ด้วย Google/GitHub (`oauth.go`) ก็เข้าได้ browser ที่ยังไม่ login จะถูกพาไป `/auth/login`
+	4. ตรวจก่อน concurrency limiter request ที่ไม่มีสิทธิ์จึงไม่กินโควตา
+	5. dual-write ส่ง credential นี้ไปยัง instance ปลายทางได้ผ่าน `DUAL_WRITE_AUTHORIZATION`
+*/
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// POST /admin/query runs a read-only query for support investigations,
+// written in a small subset of SQL:
+//
+//	SELECT id, name FROM courses WHERE price >= 100 AND NOT private ORDER BY price DESC LIMIT 20
+//	SELECT COUNT(*) FROM enrollments WHERE status = 'waitlisted'
+//
+// The tables are the ones of the warehouse export (courses, enrollments,
+// orders) with the same columns, and the query runs on a snapshot taken
+// when it starts, never on the live data. WHERE takes comparisons (=, !=,
+// <>, <, <=, >, >=, LIKE with % and _), IS [NOT] NULL, AND, OR, NOT and
+// parentheses; values compare as numbers when both sides are numbers.
+// Empty columns are NULL. Results stop at QUERY_MAX_ROWS (default 1000)
+// rows and the query at QUERY_TIMEOUT (default 2s). Every query is logged.
+
+var (
+	queryMaxRows = 1000
+	queryTimeout = 2 * time.Second
+)
+
+func init() {
+	if v := os.Getenv("QUERY_MAX_ROWS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid QUERY_MAX_ROWS %q: must be a positive number", v)
+		}
+		queryMaxRows = n
+	}
+	if v := os.Getenv("QUERY_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid QUERY_TIMEOUT %q: must be a positive duration", v)
+		}
+		queryTimeout = d
+	}
+}
+
+type queryToken struct {
+	kind string // "ident", "string", "number", "op" or "eof"
+	text string
+	pos  int
+}
+
+func lexQuery(src string) ([]queryToken, error) {
+	var toks []queryToken
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for {
+				if j >= len(src) {
+					return nil, fmt.Errorf("unterminated string at %d", i+1)
+				}
+				if src[j] == '\'' {
+					if j+1 < len(src) && src[j+1] == '\'' {
+						sb.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(src[j])
+				j++
+			}
+			toks = append(toks, queryToken{"string", sb.String(), i})
+			i = j + 1
+		case unicode.IsDigit(c) || c == '-' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1])):
+			j := i + 1
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			toks = append(toks, queryToken{"number", src[i:j], i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			toks = append(toks, queryToken{"ident", src[i:j], i})
+			i = j
+		default:
+			op := src[i : i+1]
+			if i+1 < len(src) && slices.Contains([]string{"!=", "<>", "<=", ">="}, src[i:i+2]) {
+				op = src[i : i+2]
+			}
+			if !strings.Contains("=<>!(),*;", op[:1]) || op == "!" {
+				return nil, fmt.Errorf("unexpected %q at %d", op, i+1)
+			}
+			toks = append(toks, queryToken{"op", op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, queryToken{"eof", "", len(src)}), nil
+}
+
+// queryExpr is a WHERE condition or one side of a comparison.
+type queryExpr struct {
+	op          string // "and", "or", "not", a comparison, "isnull", "notnull", "col" or "lit"
+	left, right *queryExpr
+	column      int    // for "col"
+	value       string // for "lit"
+	null        bool   // a NULL literal
+	like        *regexp.Regexp
+}
+
+type queryOrder struct {
+	column int
+	desc   bool
+}
+
+type parsedQuery struct {
+	table   exportTable
+	columns []int // nil with COUNT(*)
+	count   bool
+	where   *queryExpr
+	order   []queryOrder
+	limit   int
+	capped  bool // limit is QUERY_MAX_ROWS rather than the query's own
+}
+
+type queryParser struct {
+	toks []queryToken
+	i    int
+	q    parsedQuery
+}
+
+func (p *queryParser) peek() queryToken { return p.toks[p.i] }
+
+func (p *queryParser) next() queryToken {
+	t := p.toks[p.i]
+	if t.kind != "eof" {
+		p.i++
+	}
+	return t
+}
+
+func (p *queryParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == "ident" && strings.EqualFold(t.text, kw) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) op(op string) bool {
+	if t := p.peek(); t.kind == "op" && t.text == op {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) errorf(format string, args ...any) error {
+	t := p.peek()
+	near := t.text
+	if t.kind == "eof" {
+		near = "end of query"
+	}
+	return fmt.Errorf("%s near %q at %d", fmt.Sprintf(format, args...), near, t.pos+1)
+}
+
+func (p *queryParser) column() (int, error) {
+	t := p.peek()
+	if t.kind != "ident" {
+		return 0, p.errorf("expected a column")
+	}
+	p.i++
+	i := slices.Index(p.q.table.columns, strings.ToLower(t.text))
+	if i < 0 {
+		return 0, fmt.Errorf("no column %q in %s; columns are %s", t.text, p.q.table.name, strings.Join(p.q.table.columns, ", "))
+	}
+	return i, nil
+}
+
+// parseQuery parses a query against the export tables.
+func parseQuery(src string) (parsedQuery, error) {
+	toks, err := lexQuery(src)
+	if err != nil {
+		return parsedQuery{}, err
+	}
+	p := &queryParser{toks: toks}
+	if !p.keyword("SELECT") {
+		return parsedQuery{}, errors.New("only SELECT queries are allowed")
+	}
+	// The select list names columns of a table not read yet, so skip it
+	// and come back.
+	start := p.i
+	for p.peek().kind != "eof" && !(p.peek().kind == "ident" && strings.EqualFold(p.peek().text, "FROM")) {
+		p.i++
+	}
+	if !p.keyword("FROM") {
+		return parsedQuery{}, p.errorf("expected FROM")
+	}
+	name := p.next()
+	found := false
+	for _, t := range exportTables {
+		if strings.EqualFold(t.name, name.text) {
+			p.q.table, found = t, true
+		}
+	}
+	if name.kind != "ident" || !found {
+		return parsedQuery{}, fmt.Errorf("unknown table %q; tables are courses, enrollments and orders", name.text)
+	}
+	rest := p.i
+
+	p.i = start
+	switch {
+	case p.op("*"):
+		for i := range p.q.table.columns {
+			p.q.columns = append(p.q.columns, i)
+		}
+	case p.keyword("COUNT"):
+		if !p.op("(") || !p.op("*") || !p.op(")") {
+			return parsedQuery{}, p.errorf("expected COUNT(*)")
+		}
+		p.q.count = true
+	default:
+		for {
+			c, err := p.column()
+			if err != nil {
+				return parsedQuery{}, err
+			}
+			p.q.columns = append(p.q.columns, c)
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+	if !p.keyword("FROM") {
+		return parsedQuery{}, p.errorf("expected FROM")
+	}
+
+	p.i = rest
+	if p.keyword("WHERE") {
+		if p.q.where, err = p.or(); err != nil {
+			return parsedQuery{}, err
+		}
+	}
+	if p.keyword("ORDER") {
+		if !p.keyword("BY") {
+			return parsedQuery{}, p.errorf("expected BY")
+		}
+		for {
+			c, err := p.column()
+			if err != nil {
+				return parsedQuery{}, err
+			}
+			o := queryOrder{column: c}
+			if p.keyword("DESC") {
+				o.desc = true
+			} else {
+				p.keyword("ASC")
+			}
+			p.q.order = append(p.q.order, o)
+			if !p.op(",") {
+				break
+			}
+		}
+	}
+	p.q.limit, p.q.capped = queryMaxRows, true
+	if p.keyword("LIMIT") {
+		t := p.peek()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != "number" || err != nil || n < 0 {
+			return parsedQuery{}, p.errorf("expected a row count")
+		}
+		p.i++
+		p.q.limit, p.q.capped = min(n, queryMaxRows), n > queryMaxRows
+	}
+	p.op(";")
+	if p.peek().kind != "eof" {
+		return parsedQuery{}, p.errorf("unexpected input")
+	}
+	return p.q, nil
+}
+
+func (p *queryParser) or() (*queryExpr, error) {
+	left, err := p.and()
+	for err == nil && p.keyword("OR") {
+		var right *queryExpr
+		if right, err = p.and(); err == nil {
+			left = &queryExpr{op: "or", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *queryParser) and() (*queryExpr, error) {
+	left, err := p.not()
+	for err == nil && p.keyword("AND") {
+		var right *queryExpr
+		if right, err = p.not(); err == nil {
+			left = &queryExpr{op: "and", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *queryParser) not() (*queryExpr, error) {
+	if p.keyword("NOT") {
+		e, err := p.not()
+		return &queryExpr{op: "not", left: e}, err
+	}
+	return p.comparison()
+}
+
+var queryComparisons = []string{"=", "!=", "<>", "<", "<=", ">", ">="}
+
+func (p *queryParser) comparison() (*queryExpr, error) {
+	if p.op("(") {
+		e, err := p.or()
+		if err == nil && !p.op(")") {
+			err = p.errorf("expected )")
+		}
+		return e, err
+	}
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if p.keyword("IS") {
+		op := "isnull"
+		if p.keyword("NOT") {
+			op = "notnull"
+		}
+		if !p.keyword("NULL") {
+			return nil, p.errorf("expected NULL")
+		}
+		return &queryExpr{op: op, left: left}, nil
+	}
+	t := p.peek()
+	switch {
+	case t.kind == "op" && slices.Contains(queryComparisons, t.text):
+		p.i++
+	case t.kind == "ident" && strings.EqualFold(t.text, "LIKE"):
+		p.i++
+		t.text = "like"
+	default:
+		// A bare column is true when it holds "true", as with
+		// "WHERE private".
+		return &queryExpr{op: "=", left: left, right: &queryExpr{op: "lit", value: "true"}}, nil
+	}
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return &queryExpr{op: t.text, left: left, right: right}, nil
+}
+
+func (p *queryParser) operand() (*queryExpr, error) {
+	t := p.peek()
+	switch {
+	case t.kind == "string" || t.kind == "number":
+		p.i++
+		return &queryExpr{op: "lit", value: t.text}, nil
+	case t.kind == "ident" && (strings.EqualFold(t.text, "TRUE") || strings.EqualFold(t.text, "FALSE")):
+		p.i++
+		return &queryExpr{op: "lit", value: strings.ToLower(t.text)}, nil
+	case t.kind == "ident" && strings.EqualFold(t.text, "NULL"):
+		p.i++
+		return &queryExpr{op: "lit", null: true}, nil
+	}
+	c, err := p.column()
+	if err != nil {
+		return nil, err
+	}
+	return &queryExpr{op: "col", column: c}, nil
+}
+
+// eval returns what e stands for in row, and false for NULL.
+func (e *queryExpr) eval(row []string) (string, bool) {
+	if e.op == "col" {
+		return row[e.column], row[e.column] != ""
+	}
+	return e.value, !e.null
+}
+
+func compareQueryValues(a, b string) int {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// likePattern turns a LIKE pattern into a case-insensitive regexp.
+func likePattern(like string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("(?is)^")
+	for _, c := range like {
+		switch c {
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteByte('.')
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteByte('$')
+	return regexp.MustCompile(sb.String())
+}
+
+func (e *queryExpr) match(row []string) bool {
+	switch e.op {
+	case "and":
+		return e.left.match(row) && e.right.match(row)
+	case "or":
+		return e.left.match(row) || e.right.match(row)
+	case "not":
+		return !e.left.match(row)
+	case "isnull":
+		_, ok := e.left.eval(row)
+		return !ok
+	case "notnull":
+		_, ok := e.left.eval(row)
+		return ok
+	}
+	a, okA := e.left.eval(row)
+	b, okB := e.right.eval(row)
+	if !okA || !okB {
+		return false // comparisons with NULL are never true
+	}
+	if e.op == "like" {
+		if e.like == nil {
+			e.like = likePattern(b)
+		}
+		return e.like.MatchString(a)
+	}
+	c := compareQueryValues(a, b)
+	switch e.op {
+	case "=":
+		return c == 0
+	case "!=", "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+var errQueryTimeout = errors.New("query took too long")
+
+type queryResult struct {
+	Columns   []string `json:"columns"`
+	Rows      [][]any  `json:"rows"`
+	Truncated bool     `json:"truncated"`
+	ElapsedMS int64    `json:"elapsed_ms"`
+}
+
+// run evaluates q on a snapshot of its table.
+func (q parsedQuery) run(ctx context.Context) (queryResult, error) {
+	start := time.Now()
+	rows := q.table.snapshot()
+	var matched [][]string
+	for i, row := range rows {
+		if i%1000 == 0 && ctx.Err() != nil {
+			return queryResult{}, errQueryTimeout
+		}
+		if q.where == nil || q.where.match(row) {
+			matched = append(matched, row)
+		}
+	}
+	if q.count {
+		return queryResult{Columns: []string{"count"}, Rows: [][]any{{len(matched)}}, ElapsedMS: time.Since(start).Milliseconds()}, nil
+	}
+	if len(q.order) > 0 {
+		slices.SortStableFunc(matched, func(a, b []string) int {
+			for _, o := range q.order {
+				c := compareQueryValues(a[o.column], b[o.column])
+				if o.desc {
+					c = -c
+				}
+				if c != 0 {
+					return c
+				}
+			}
+			return 0
+		})
+		if ctx.Err() != nil {
+			return queryResult{}, errQueryTimeout
+		}
+	}
+	res := queryResult{Rows: [][]any{}}
+	for _, c := range q.columns {
+		res.Columns = append(res.Columns, q.table.columns[c])
+	}
+	res.Truncated = q.capped && len(matched) > q.limit
+	for _, row := range matched[:min(len(matched), q.limit)] {
+		out := make([]any, len(q.columns))
+		for i, c := range q.columns {
+			if row[c] != "" {
+				out[i] = row[c]
+			}
+		}
+		res.Rows = append(res.Rows, out)
+	}
+	res.ElapsedMS = time.Since(start).Milliseconds()
+	return res, nil
+}
+
+// adminQueryHandler serves POST /admin/query with {"query": "SELECT ..."}.
+func adminQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Query string `json:"query"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	q, err := parseQuery(req.Query)
+	if err != nil {
+		writeError(w, r, "Invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	requestLogger(r).Info("Admin query", "remote_addr", r.RemoteAddr, "query", strings.Join(strings.Fields(req.Query), " "))
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+	res, err := q.run(ctx)
+	if err != nil {
+		writeError(w, r, err.Error()+"; narrow it down", http.StatusServiceUnavailable)
+		return
+	}
+	writeValue(w, r, http.StatusOK, res)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ให้ทีม support ค้นข้อมูลเองด้วย SQL แบบอ่านอย่างเดียว โดยไม่ต้องเข้าถึงข้อมูลจริงโดยตรง
+
+	1. `POST /admin/query` รับ `{"query": "SELECT ..."}` รองรับแค่ SELECT (ไม่มี INSERT/UPDATE/DELETE ให้เขียนได้ตั้งแต่แรก)
+	   - คอลัมน์ / `*` / `COUNT(*)`, `WHERE` (เปรียบเทียบ, LIKE, IS NULL, AND/OR/NOT, วงเล็บ), `ORDER BY`, `LIMIT`
+	   - ตาราง courses, enrollments, orders ใช้คอลัมน์ชุดเดียวกับ warehouse export
+	2. รันบน snapshot ที่ถ่ายตอนเริ่ม query ไม่แตะข้อมูลจริง และไม่ถือ lock ระหว่างกรอง/เรียง
+	3. จำกัดผล `QUERY_MAX_ROWS` (ค่าเริ่มต้น 1000) และเวลา `QUERY_TIMEOUT` (ค่าเริ่มต้น 2s) ถ้าถูกตัดจะมี `truncated: true`
+	4. ทุก query ถูก log ไว้ตรวจย้อนหลัง
+*/
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	q, err := parseQuery("select id, name from Courses where price >= 100 and not private order by price desc, id limit 20;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.table.name != "courses" || !reflect.DeepEqual(q.columns, []int{0, 1}) {
+		t.Errorf("table %s, columns %v, want courses, [0 1]", q.table.name, q.columns)
+	}
+	if want := []queryOrder{{column: 2, desc: true}, {column: 0}}; !reflect.DeepEqual(q.order, want) {
+		t.Errorf("order = %v, want %v", q.order, want)
+	}
+	if q.limit != 20 || q.capped {
+		t.Errorf("limit %d, capped %v, want 20, false", q.limit, q.capped)
+	}
+
+	q, err = parseQuery("SELECT COUNT(*) FROM enrollments LIMIT 1000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.count || q.limit != queryMaxRows || !q.capped {
+		t.Errorf("count %v, limit %d, capped %v, want true, %d, true", q.count, q.limit, q.capped, queryMaxRows)
+	}
+}
+
+func TestQueryWhere(t *testing.T) {
+	// id, name, price, instructor, seats, access_days, private, price_book, metadata
+	row := []string{"1", "Go Basics", "150", "O'Neil", "0", "", "true", "", ""}
+	for _, tt := range []struct {
+		where string
+		want  bool
+	}{
+		{"price >= 100", true},
+		{"price > 1000", false},
+		{"price = '150'", true},
+		{"price < 20", false}, // numbers, not "150" < "20"
+		{"name LIKE 'go%'", true},
+		{"name LIKE 'Go_Basic'", false},
+		{"instructor = 'O''Neil'", true},
+		{"instructor <> 'O''Neil' OR id = 1", true},
+		{"private", true},
+		{"NOT private", false},
+		{"private = TRUE AND seats != 1", true},
+		{"access_days IS NULL", true},
+		{"access_days IS NOT NULL", false},
+		{"access_days = NULL", false},
+		{"NOT (price < 100 OR id = 2)", true},
+		{"id = -1", false},
+	} {
+		q, err := parseQuery("SELECT * FROM courses WHERE " + tt.where)
+		if err != nil {
+			t.Errorf("WHERE %s: %v", tt.where, err)
+			continue
+		}
+		if got := q.where.match(row); got != tt.want {
+			t.Errorf("WHERE %s = %v, want %v", tt.where, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryMalformed(t *testing.T) {
+	for _, tt := range []struct{ name, in, err string }{
+		{"empty", "", "only SELECT"},
+		{"update", "UPDATE courses SET price = 0", "only SELECT"},
+		{"no FROM", "SELECT id", "expected FROM"},
+		{"no table", "SELECT id FROM", "unknown table"},
+		{"unknown table", "SELECT id FROM users", "unknown table"},
+		{"unknown column", "SELECT password FROM courses", "column"},
+		{"bad COUNT", "SELECT COUNT(id) FROM courses", "COUNT(*)"},
+		{"trailing comma", "SELECT id, FROM courses", ""},
+		{"unterminated string", "SELECT id FROM courses WHERE name = 'Go", "unterminated string"},
+		{"stray character", "SELECT id FROM courses WHERE price > 1 | 2", `unexpected "|"`},
+		{"lone bang", "SELECT id FROM courses WHERE price ! 1", `unexpected "!"`},
+		{"missing operand", "SELECT id FROM courses WHERE price >", ""},
+		{"unclosed paren", "SELECT id FROM courses WHERE (price > 1", "expected )"},
+		{"IS without NULL", "SELECT id FROM courses WHERE price IS 1", "expected NULL"},
+		{"ORDER without BY", "SELECT id FROM courses ORDER price", "expected BY"},
+		{"bad LIMIT", "SELECT id FROM courses LIMIT x", "row count"},
+		{"negative LIMIT", "SELECT id FROM courses LIMIT -1", "row count"},
+		{"two statements", "SELECT id FROM courses; SELECT id FROM orders", "unexpected input"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseQuery(tt.in)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseQuery(%q) = %v, want an error containing %q", tt.in, err, tt.err)
+			}
+		})
+	}
+}
+
+func FuzzParseQuery(f *testing.F) {
+	for _, s := range []string{
+		"SELECT id, name FROM courses WHERE price >= 100 AND NOT private ORDER BY price DESC LIMIT 20",
+		"SELECT COUNT(*) FROM enrollments WHERE status = 'waitlisted'",
+		"SELECT * FROM orders WHERE (amount > -1.5 OR refunded_at IS NOT NULL) AND id LIKE '1_%'",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		q, err := parseQuery(s)
+		if err == nil && q.where != nil {
+			q.where.match(make([]string, len(q.table.columns)))
+		}
+	})
+}
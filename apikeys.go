@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API keys give machine clients limited access without a JWT issuer. An
+// admin creates a key with scopes at /admin/api-keys; the client sends it
+// as X-API-Key. Only a hash of each key is kept, so the key itself is shown
+// once, when it is created. Revoking a key keeps its record for the audit
+// trail but stops it working at once.
+//
+// Once any key has been created, writes need credentials (see
+// authRequired), exactly as when JWTs are configured.
+
+const apiKeyHeader = "X-API-Key"
+
+// Scopes a key can be granted.
+const (
+	// scopeCoursesWrite allows creating, changing and deleting courses.
+	scopeCoursesWrite = "courses:write"
+	// scopeCoursesPrivate allows reading private courses without an
+	// invite, for integrations such as an LMS sync.
+	scopeCoursesPrivate = "courses:read_private"
+)
+
+var apiKeyScopes = []string{scopeCoursesWrite, scopeCoursesPrivate}
+
+type apiKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // first characters of the key, to tell keys apart
+	Scopes     []string   `json:"scopes"`
+	Role       string     `json:"role"`                 // see rbac.go
+	Instructor string     `json:"instructor,omitempty"` // for the instructor role
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Key        string     `json:"key,omitempty"` // only in the create response
+
+	hash string
+}
+
+func (k *apiKey) hasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+var (
+	// apiKeyMu protects apiKeys and nextAPIKeyID.
+	apiKeyMu     sync.Mutex
+	apiKeys      []*apiKey
+	nextAPIKeyID = 1
+)
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeysInUse reports whether a key has ever been created.
+func apiKeysInUse() bool {
+	apiKeyMu.Lock()
+	defer apiKeyMu.Unlock()
+	return len(apiKeys) > 0
+}
+
+var (
+	errInvalidAPIKey = errors.New("invalid or revoked API key")
+	errMissingScope  = errors.New("API key lacks the required scope")
+)
+
+type apiKeyContextKey struct{}
+
+// requestAPIKey returns the key r was authenticated with, if any.
+func requestAPIKey(r *http.Request) (apiKey, bool) {
+	k, ok := r.Context().Value(apiKeyContextKey{}).(apiKey)
+	return k, ok
+}
+
+// withAPIKey checks the X-API-Key header of r, if any, and returns r with
+// the key in its context.
+func withAPIKey(r *http.Request) (*http.Request, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return r, nil
+	}
+	hash := hashAPIKey(key)
+	apiKeyMu.Lock()
+	var found *apiKey
+	for _, k := range apiKeys {
+		if k.hash == hash && k.RevokedAt == nil {
+			found = k
+			now := time.Now().UTC()
+			k.LastUsedAt = &now
+		}
+	}
+	var view apiKey
+	if found != nil {
+		view = found.view()
+	}
+	apiKeyMu.Unlock()
+	if found == nil {
+		return r, errInvalidAPIKey
+	}
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, view)), nil
+}
+
+// apiKeyHandler authenticates requests that carry an API key. A bad key is
+// rejected on every route, like a bad bearer token.
+func apiKeyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, err := withAPIKey(r)
+		if err != nil {
+			writeError(w, r, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// view is k without its hash, safe to return. Callers hold apiKeyMu.
+func (k *apiKey) view() apiKey {
+	v := *k
+	v.Scopes = slices.Clone(k.Scopes)
+	v.hash = ""
+	return v
+}
+
+func findAPIKey(id int) *apiKey {
+	for _, k := range apiKeys {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// adminAPIKeysHandler serves GET /admin/api-keys (every key, revoked ones
+// included) and POST /admin/api-keys with {"name": ..., "scopes": [...]}.
+// The response to POST is the only one that includes the key. "role"
+// defaults to admin; an instructor key needs "instructor", the name it
+// acts as.
+func adminAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		apiKeyMu.Lock()
+		list := []apiKey{}
+		for _, k := range apiKeys {
+			list = append(list, k.view())
+		}
+		apiKeyMu.Unlock()
+		writeValue(w, r, http.StatusOK, list)
+
+	case http.MethodPost:
+		var req struct {
+			Name       string   `json:"name"`
+			Scopes     []string `json:"scopes"`
+			Role       string   `json:"role"`
+			Instructor string   `json:"instructor"`
+		}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			writeError(w, r, "name is required", http.StatusBadRequest)
+			return
+		}
+		scopes := []string{}
+		for _, s := range req.Scopes {
+			if !slices.Contains(apiKeyScopes, s) {
+				writeError(w, r, "Unknown scope "+strconv.Quote(s)+"; use "+strings.Join(apiKeyScopes, " or "), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+		if len(scopes) == 0 {
+			writeError(w, r, "At least one scope is required", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = roleAdmin
+		}
+		req.Instructor = strings.TrimSpace(req.Instructor)
+		if msg := checkRole(req.Role, req.Instructor); msg != "" {
+			writeError(w, r, msg, http.StatusBadRequest)
+			return
+		}
+
+		secret := "ck_" + randomHex(24)
+		apiKeyMu.Lock()
+		k := &apiKey{
+			ID:         nextAPIKeyID,
+			Name:       strings.TrimSpace(req.Name),
+			Prefix:     secret[:7],
+			Scopes:     scopes,
+			Role:       req.Role,
+			Instructor: req.Instructor,
+			CreatedAt:  time.Now().UTC(),
+			hash:       hashAPIKey(secret),
+		}
+		nextAPIKeyID++
+		apiKeys = append(apiKeys, k)
+		created := k.view()
+		apiKeyMu.Unlock()
+
+		created.Key = secret
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Location", "/admin/api-keys/"+strconv.Itoa(k.ID))
+		writeValue(w, r, http.StatusCreated, created)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminAPIKeyHandler serves GET /admin/api-keys/{id} and DELETE, which
+// revokes the key.
+func adminAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+	apiKeyMu.Lock()
+	defer apiKeyMu.Unlock()
+	k := findAPIKey(id)
+	if k == nil {
+		writeError(w, r, "API key not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeValue(w, r, http.StatusOK, k.view())
+	case http.MethodDelete:
+		if k.RevokedAt == nil {
+			now := time.Now().UTC()
+			k.RevokedAt = &now
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: API key สำหรับ client ที่เป็นเครื่อง (machine client)
+
+	1. admin สร้าง key ที่ `POST /admin/api-keys` พร้อม scope แล้ว client ส่ง key มาใน header `X-API-Key`
+	   - `courses:write` สร้าง/แก้/ลบ course ได้
+	   - `courses:read_private` อ่าน course แบบ private ได้โดยไม่ต้องมี invite
+	2. เก็บแค่ hash (SHA-256) ของ key key จริงแสดงครั้งเดียวตอนสร้าง ถ้าหายต้องสร้างใหม่
+	3. `DELETE /admin/api-keys/{id}` เพิกถอน key ทันที แต่ยังเก็บประวัติ (`revoked_at`, `last_used_at`) ไว้ตรวจย้อนหลัง
+	4. เมื่อมี key ถูกสร้างแล้วแม้แต่ตัวเดียว การเขียนข้อมูล course ต้องมี JWT หรือ API key เสมอ
+*/
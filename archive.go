@@ -0,0 +1,274 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A course package is a zip archive that moves one course between
+// deployments or backs it up on its own:
+//
+//	manifest.json  format, version, checksums of the other files
+//	course.json    the course, as served by GET /courses/{id}
+//
+// The manifest also lists the course's lessons and assets. Courses do not
+// have any yet, so those lists are always empty; they are part of the
+// format so packages from a server that has them are recognized as such
+// instead of being imported with content missing.
+
+const (
+	coursePackageFormat  = "course-package"
+	coursePackageVersion = 1
+
+	maxPackageEntryBytes = 1 << 20
+)
+
+type packageManifest struct {
+	Format         string        `json:"format"`
+	Version        int           `json:"version"`
+	ExportedAt     time.Time     `json:"exported_at"`
+	SourceCourseID int           `json:"source_course_id"`
+	Files          []packageFile `json:"files"`
+	Lessons        []packageFile `json:"lessons"`
+	Assets         []packageFile `json:"assets"`
+}
+
+type packageFile struct {
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func newPackageFile(path string, data []byte) packageFile {
+	sum := sha256.Sum256(data)
+	return packageFile{Path: path, Size: len(data), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// exportCoursePackage builds the package of c.
+func exportCoursePackage(c course) ([]byte, error) {
+	courseJSON, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := json.MarshalIndent(packageManifest{
+		Format:         coursePackageFormat,
+		Version:        coursePackageVersion,
+		ExportedAt:     time.Now().UTC(),
+		SourceCourseID: c.CourseId,
+		Files:          []packageFile{newPackageFile("course.json", courseJSON)},
+		Lessons:        []packageFile{},
+		Assets:         []packageFile{},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{"manifest.json", manifest}, {"course.json", courseJSON}} {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readPackageEntry returns the contents of the named entry.
+func readPackageEntry(zr *zip.Reader, name string) ([]byte, error) {
+	f, err := zr.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("package has no %s", name)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxPackageEntryBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", name, err)
+	}
+	if len(data) > maxPackageEntryBytes {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, maxPackageEntryBytes)
+	}
+	return data, nil
+}
+
+var errPackageContent = errors.New("package has lessons or assets, which this server cannot store")
+
+// importCoursePackage reads the course out of a package, checking it
+// against its manifest. The course comes back without an ID.
+func importCoursePackage(data []byte) (course, error) {
+	var c course
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return c, errors.New("not a zip archive")
+	}
+	raw, err := readPackageEntry(zr, "manifest.json")
+	if err != nil {
+		return c, err
+	}
+	var m packageManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return c, errors.New("invalid manifest.json")
+	}
+	if m.Format != coursePackageFormat {
+		return c, fmt.Errorf("not a course package (format %q)", m.Format)
+	}
+	if m.Version < 1 || m.Version > coursePackageVersion {
+		return c, fmt.Errorf("unsupported package version %d", m.Version)
+	}
+	if len(m.Lessons) > 0 || len(m.Assets) > 0 {
+		return c, errPackageContent
+	}
+	for _, f := range m.Files {
+		raw, err := readPackageEntry(zr, f.Path)
+		if err != nil {
+			return c, err
+		}
+		if got := newPackageFile(f.Path, raw); got.SHA256 != f.SHA256 || got.Size != f.Size {
+			return c, fmt.Errorf("%s does not match its checksum", f.Path)
+		}
+	}
+
+	raw, err = readPackageEntry(zr, "course.json")
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return c, errors.New("invalid course.json")
+	}
+	c.CourseId = 0
+	c.Metadata = compactMetadata(c.Metadata)
+	return c, nil
+}
+
+// adminCourseExportHandler serves GET /admin/courses/{id}/export, the
+// course's package as a download.
+func adminCourseExportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	courseMu.RLock()
+	i := findCourseIndex(id)
+	var c course
+	if i >= 0 {
+		c = cloneCourse(CourseList[i])
+	}
+	courseMu.RUnlock()
+	if i < 0 {
+		writeError(w, r, "Course not found", http.StatusNotFound)
+		return
+	}
+
+	pkg, err := exportCoursePackage(c)
+	if clientGone(r) {
+		// Nobody to send it to; the request log records the outcome.
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error exporting course", "course_id", id, "err", err)
+		writeError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="course-%d.zip"`, id))
+	w.Header().Set("Cache-Control", privateCacheControl)
+	w.Header().Set("Content-Length", strconv.Itoa(len(pkg)))
+	w.Write(pkg)
+}
+
+// adminCourseImportHandler serves POST /admin/courses/import. The body is a
+// course package; the course is created under a new ID, like a POST to
+// /courses, and must pass this deployment's validation rules.
+func adminCourseImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// bodyLimitHandler caps the package at the route's body limit.
+	data, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case clientGone(r) || errors.Is(err, io.ErrUnexpectedEOF):
+		// The upload broke off. Nothing has been stored yet, and nothing
+		// will be: a package is only imported once it has fully arrived.
+		markClientGone(w)
+		requestLogger(r).Info("Course import abandoned: client disconnected", "bytes", len(data))
+		return
+	case errors.As(err, &tooLarge):
+		writeError(w, r, fmt.Sprintf("Package is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		writeError(w, r, "Cannot read request body", http.StatusBadRequest)
+		return
+	}
+	c, err := importCoursePackage(data)
+	switch {
+	case errors.Is(err, errPackageContent):
+		writeError(w, r, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		writeError(w, r, "Invalid course package: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Last chance to back out: once created, the course is imported even
+	// if the client never sees the response.
+	if clientGone(r) {
+		markClientGone(w)
+		requestLogger(r).Info("Course import abandoned: client disconnected before commit")
+		return
+	}
+	who := systemPrincipal
+	who.trace = requestTrace(r)
+	c, err = createCourse(who, c)
+	var invalid *invalidCourseError
+	switch {
+	case errors.As(err, &invalid):
+		writeError(w, r, invalid.msg, http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		writeCourseServiceError(w, r, err)
+		return
+	}
+
+	requestLogger(r).Info("Imported course package", "course_id", c.CourseId)
+	w.Header().Set("Location", "/courses/"+strconv.Itoa(c.CourseId))
+	w.Header().Set("ETag", courseETag(c))
+	writeCourse(w, r, http.StatusCreated, c)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Export / Import คอร์สเป็นไฟล์ zip
+
+	1. `GET /admin/courses/{id}/export` ดาวน์โหลดคอร์สเป็น `course-<id>.zip` ภายในมี
+	   - `manifest.json` บอกรูปแบบ (`course-package` เวอร์ชัน 1) และ sha256 ของทุกไฟล์
+	   - `course.json` ข้อมูลคอร์ส
+	2. `POST /admin/courses/import` ส่ง zip เข้ามาเพื่อสร้างคอร์สใหม่ (ได้ ID ใหม่เสมอ) ใช้ย้ายคอร์สข้าม server หรือกู้คืนจาก backup
+	   - ตรวจ checksum ทุกไฟล์ก่อน และต้องผ่านกฎของ server ปลายทาง (เช่น `METADATA_FIELDS`) ไม่งั้นตอบ 422
+	3. manifest มีช่อง `lessons` และ `assets` เผื่ออนาคต ตอนนี้คอร์สยังไม่มีบทเรียน/ไฟล์ประกอบ จึงว่างเสมอ
+	   - ถ้า package มีของเหล่านี้ จะปฏิเสธแทนการนำเข้าแบบข้อมูลไม่ครบ
+*/
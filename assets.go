@@ -0,0 +1,83 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// HTML pages are rendered from templates/, and the admin UI and API
+// explorer are served from static/ and docs/. All three are embedded in
+// the binary. With -dev they are read from those directories under the
+// working directory instead, on every request, so an edit shows on the
+// next reload without a rebuild. Dev mode also skips the precompressed
+// variants of static files, which would be stale, and marks everything
+// no-store.
+
+//go:embed templates
+var templateFiles embed.FS
+
+// devMode is set by the -dev flag before any handler is built.
+var devMode bool
+
+// assetFS returns directory dir of embedded, or the directory on disk in
+// dev mode.
+func assetFS(embedded embed.FS, dir string) fs.FS {
+	if devMode {
+		return os.DirFS(dir)
+	}
+	root, err := fs.Sub(embedded, dir)
+	if err != nil {
+		panic(err)
+	}
+	return root
+}
+
+var embeddedTemplates = sync.OnceValue(func() *template.Template {
+	return template.Must(template.ParseFS(assetFS(templateFiles, "templates"), "*.html"))
+})
+
+// executeTemplate renders the template file name, such as "login.html",
+// for r, with the branding of r's tenant.
+func executeTemplate(w io.Writer, r *http.Request, name string, data map[string]any) error {
+	return renderTemplate(w, requestBrand(r), name, data)
+}
+
+// renderTemplate renders the template file name with b as .Brand. In dev
+// mode the templates are parsed again each time, so a syntax error shows
+// as the error instead of stopping the server.
+func renderTemplate(w io.Writer, b brand, name string, data map[string]any) error {
+	data["Brand"] = b
+	if !devMode {
+		return embeddedTemplates().ExecuteTemplate(w, name, data)
+	}
+	t, err := template.ParseFS(assetFS(templateFiles, "templates"), "*.html")
+	if err != nil {
+		return err
+	}
+	return t.ExecuteTemplate(w, name, data)
+}
+
+// noStore keeps browsers from caching what next serves, so a reload
+// always fetches the file from disk.
+func noStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: โหมด dev (`-dev`) แก้ HTML แล้ว refresh เห็นผลทันที ไม่ต้อง build ใหม่
+
+	1. ปกติ template (`templates/`), หน้า admin (`static/`) และหน้า API explorer (`docs/`) ฝังอยู่ใน binary ด้วย `//go:embed`
+	2. เปิด `-dev` แล้วทั้งหมดอ่านจากดิสก์ (ตาม working directory) ทุก request และ parse template ใหม่ทุกครั้ง
+	   - template ที่เขียนผิดจะได้ error ใน response แทนที่ server จะล้ม
+	3. โหมด dev ไม่ใช้ไฟล์ `.gz`/`.br` ที่บีบอัดไว้ก่อน (จะเป็นของเก่า) และตอบ `Cache-Control: no-store` ให้ browser ไม่ cache
+*/
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The audit log records who changed what and when: every create, update
+// and delete, whichever way it was made. Course writes are recorded by the
+// course service (service.go) with the fields they changed, before and
+// after, so REST, GraphQL, gRPC and imports are all covered. Any other
+// POST, PUT, PATCH or DELETE that succeeds, such as an admin creating a
+// user or revoking a key, is recorded by auditHandler with its method and
+// path but no diff, since those handlers keep no before state to compare
+// and their bodies can hold passwords.
+//
+// Entries are only ever appended. The last AUDIT_RETAIN (default 10000)
+// are kept in memory for GET /admin/audit; with AUDIT_LOG_FILE set every
+// entry is also appended to that file as a JSON line, which is read back
+// at start, so the log outlives a restart.
+//
+// Sign-ins and token grants are not audited here (see securityevents.go),
+// and neither are the synthetic probe's writes.
+
+var (
+	auditLogFile = os.Getenv("AUDIT_LOG_FILE")
+	auditRetain  = 10000
+)
+
+// auditSkipPrefixes are mutating routes that auditHandler records no
+// entry for, as they change nothing worth one: sign-ins and tokens, the GraphQL endpoint (its mutations are
+// recorded by the service, its queries are POSTs too), the email event
+// receiver and read-only admin queries.
+var auditSkipPrefixes = []string{"/auth/", "/graphql", "/email/events", "/admin/query"}
+
+type auditChange struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+type auditEntry struct {
+	ID        int64         `json:"id"`
+	Time      time.Time     `json:"time"`
+	Subject   string        `json:"subject"`
+	Role      string        `json:"role,omitempty"`
+	Actor     string        `json:"actor,omitempty"`  // the impersonating admin
+	Action    string        `json:"action"`           // create, update or delete
+	Resource  string        `json:"resource"`         // e.g. /courses/4
+	Method    string        `json:"method,omitempty"` // of the request, "" outside HTTP
+	Path      string        `json:"path,omitempty"`
+	Status    int           `json:"status,omitempty"` // for entries auditHandler made
+	Changes   []auditChange `json:"changes,omitempty"`
+	RequestID string        `json:"request_id,omitempty"`
+	TraceID   string        `json:"trace_id,omitempty"`
+}
+
+var (
+	// auditMu protects auditLog, nextAuditID and writes to auditLogFile.
+	auditMu     sync.Mutex
+	auditLog    []auditEntry
+	nextAuditID int64 = 1
+)
+
+func init() {
+	if s := os.Getenv("AUDIT_RETAIN"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid AUDIT_RETAIN %q: must be a positive number", s)
+		}
+		auditRetain = n
+	}
+	if auditLogFile != "" {
+		if err := loadAuditLog(); err != nil {
+			log.Fatalf("Cannot read AUDIT_LOG_FILE: %v", err)
+		}
+	}
+}
+
+// loadAuditLog reads back the entries auditLogFile holds.
+func loadAuditLog() error {
+	f, err := os.Open(auditLogFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return errors.New(auditLogFile + ":" + strconv.Itoa(line) + ": " + err.Error())
+		}
+		auditLog = append(auditLog, e)
+		nextAuditID = max(nextAuditID, e.ID+1)
+	}
+	if len(auditLog) > auditRetain {
+		auditLog = slices.Clone(auditLog[len(auditLog)-auditRetain:])
+	}
+	return sc.Err()
+}
+
+// appendAudit gives e the next ID and stores it.
+func appendAudit(e auditEntry) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	e.ID = nextAuditID
+	nextAuditID++
+	if auditLogFile != "" {
+		if err := appendAuditFile(e); err != nil {
+			slog.Error("Cannot write audit entry", "id", e.ID, "file", auditLogFile, "err", err)
+		}
+	}
+	auditLog = append(auditLog, e)
+	if len(auditLog) > auditRetain {
+		auditLog = slices.Delete(auditLog, 0, len(auditLog)-auditRetain)
+	}
+}
+
+func appendAuditFile(e auditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// auditScope is the request a write is made in, for the entries the
+// service records to name it, and for auditHandler to know that one did.
+type auditScope struct {
+	who       principal
+	method    string
+	path      string
+	requestID string
+	recorded  atomic.Bool
+}
+
+type auditScopeContextKey struct{}
+
+// requestAuditScope returns the scope auditHandler gave r, nil outside it.
+func requestAuditScope(r *http.Request) *auditScope {
+	s, _ := r.Context().Value(auditScopeContextKey{}).(*auditScope)
+	return s
+}
+
+// recordAudit records action on resource by who, with the fields that
+// differ between before and after, either of which may be nil.
+func recordAudit(who principal, action, resource string, before, after any) {
+	if who.probe {
+		return
+	}
+	e := auditEntry{
+		Time:     time.Now().UTC(),
+		Subject:  who.Subject,
+		Role:     who.Role,
+		Actor:    who.Actor,
+		Action:   action,
+		Resource: resource,
+		Changes:  auditDiff(before, after),
+		TraceID:  who.trace.TraceID,
+	}
+	if s := who.audit; s != nil {
+		s.recorded.Store(true)
+		if who.Subject == systemPrincipal.Subject {
+			// Admin routes write as the system; name the operator instead.
+			e.Subject, e.Role, e.Actor = s.who.Subject, s.who.Role, s.who.Actor
+		}
+		e.Method, e.Path, e.RequestID = s.method, s.path, s.requestID
+	}
+	appendAudit(e)
+}
+
+// auditDiff returns the top-level JSON fields of before and after that
+// differ, in order. Nested values, such as a price book, are compared and
+// reported whole.
+func auditDiff(before, after any) []auditChange {
+	b, a := auditFields(before), auditFields(after)
+	keys := slices.Collect(maps.Keys(b))
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	var changes []auditChange
+	for _, k := range keys {
+		if string(b[k]) != string(a[k]) {
+			changes = append(changes, auditChange{Field: k, Before: b[k], After: a[k]})
+		}
+	}
+	return changes
+}
+
+func auditFields(v any) map[string]json.RawMessage {
+	fields := map[string]json.RawMessage{}
+	if v == nil {
+		return fields
+	}
+	if raw, err := json.Marshal(v); err == nil {
+		json.Unmarshal(raw, &fields)
+	}
+	return fields
+}
+
+// auditActions maps the methods that change something to their action.
+var auditActions = map[string]string{
+	http.MethodPost:   "create",
+	http.MethodPut:    "update",
+	http.MethodPatch:  "update",
+	http.MethodDelete: "delete",
+}
+
+// auditHandler gives every mutating request an audit scope, and records
+// the ones that succeed without the service having recorded them.
+func auditHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action, mutating := auditActions[r.Method]
+		if !mutating || isProbeRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s := &auditScope{who: operatorPrincipal(r), method: r.Method, path: r.URL.Path, requestID: requestID(r)}
+		r = r.WithContext(context.WithValue(r.Context(), auditScopeContextKey{}, s))
+		sw := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		skip := slices.ContainsFunc(auditSkipPrefixes, func(p string) bool { return strings.HasPrefix(r.URL.Path, p) })
+		if sw.status >= 300 || s.recorded.Load() || skip {
+			return
+		}
+		appendAudit(auditEntry{
+			Time:      time.Now().UTC(),
+			Subject:   s.who.Subject,
+			Role:      s.who.Role,
+			Actor:     s.who.Actor,
+			Action:    action,
+			Resource:  r.URL.Path,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    sw.status,
+			RequestID: s.requestID,
+			TraceID:   requestTrace(r).TraceID,
+		})
+	})
+}
+
+// adminAuditHandler serves GET /admin/audit, newest first. Filters:
+// ?subject=, ?action=, ?resource= (a prefix, e.g. /courses/4), ?since=
+// (RFC 3339) and ?before=<id> to page back; ?limit= defaults to 100, up
+// to 1000.
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	limit := 100
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > 1000 {
+			writeError(w, r, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if s := q.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeError(w, r, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	var before int64
+	if s := q.Get("before"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			writeError(w, r, "before must be an entry ID", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+	subject, action, resource := q.Get("subject"), q.Get("action"), q.Get("resource")
+
+	auditMu.Lock()
+	list := []auditEntry{}
+	for _, e := range slices.Backward(auditLog) {
+		if len(list) == limit || e.Time.Before(since) {
+			break
+		}
+		if before > 0 && e.ID >= before ||
+			subject != "" && e.Subject != subject ||
+			action != "" && e.Action != action ||
+			resource != "" && !strings.HasPrefix(e.Resource, resource) {
+			continue
+		}
+		list = append(list, e)
+	}
+	auditMu.Unlock()
+	writeValue(w, r, http.StatusOK, list)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: audit log แบบเขียนต่อท้ายอย่างเดียว บันทึกว่าใครแก้อะไรเมื่อไร สำหรับทุกการสร้าง แก้ และลบ
+
+	1. การเขียน course บันทึกจาก service layer (`recordAudit`) พร้อม diff ราย field ก่อน/หลัง จึงครอบคลุม REST, GraphQL, gRPC และ import
+	2. POST/PUT/PATCH/DELETE อื่นที่สำเร็จ (เช่น admin สร้าง user หรือเพิกถอน key) บันทึกโดย `auditHandler` มีแค่ method, path, status ไม่มี diff
+	   - ไม่เก็บ body เพราะอาจมีรหัสผ่าน
+	   - ข้าม `/auth/`, `/graphql`, `/email/events`, `/admin/query` และ synthetic probe
+	3. ระบุตัวตนด้วย principal ของ request (subject, role, ผู้ impersonate) ถ้า service เขียนในนาม system จะใช้ชื่อ operator ที่ส่ง request มาแทน
+	4. เก็บในหน่วยความจำ `AUDIT_RETAIN` รายการล่าสุด (ค่าเริ่มต้น 10000) ถ้าตั้ง `AUDIT_LOG_FILE` จะต่อท้ายไฟล์เป็น JSON ทีละบรรทัดและอ่านกลับตอน start
+	5. `GET /admin/audit` ใหม่สุดก่อน กรองด้วย `subject`, `action`, `resource` (prefix), `since`, `before` (แบ่งหน้า) และ `limit`
+*/
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Handlers read request bodies whole, so without a cap one huge body can
+// run the server out of memory. Every body is therefore limited to
+// MAX_BODY_BYTES (default 1M), and a request over the limit is answered
+// 413. ROUTE_BODY_LIMITS sets other limits by mux pattern, with the same
+// trailing-* prefixes as ROUTE_WEIGHTS: "/admin/courses/import=50M". Sizes
+// are bytes, or a number with K, M or G (powers of 1024).
+
+var defaultRouteBodyLimits = "/admin/courses/import=10M,/courses/import=50M,/admin/tenants/{id}/theme/logo=256K"
+
+var (
+	maxBodyBytes    int64 = 1 << 20
+	routeBodyLimits map[string]int64
+)
+
+func init() {
+	if s := os.Getenv("MAX_BODY_BYTES"); s != "" {
+		n, err := parseByteSize(s)
+		if err != nil {
+			log.Fatalf("Invalid MAX_BODY_BYTES %q: %v", s, err)
+		}
+		maxBodyBytes = n
+	}
+	limits, err := parseRouteBodyLimits(defaultRouteBodyLimits)
+	if err != nil {
+		panic(err)
+	}
+	if spec := os.Getenv("ROUTE_BODY_LIMITS"); spec != "" {
+		extra, err := parseRouteBodyLimits(spec)
+		if err != nil {
+			log.Fatalf("Invalid ROUTE_BODY_LIMITS: %v", err)
+		}
+		for route, n := range extra {
+			limits[route] = n
+		}
+	}
+	routeBodyLimits = limits
+}
+
+// parseByteSize parses "512", "64K", "10M" or "1G".
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	shift := 0
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift = 10
+	case strings.HasSuffix(s, "M"):
+		shift = 20
+	case strings.HasSuffix(s, "G"):
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)>>shift {
+		return 0, errors.New("want a positive size in bytes, optionally with K, M or G")
+	}
+	return n << shift, nil
+}
+
+func parseRouteBodyLimits(s string) (map[string]int64, error) {
+	limits := map[string]int64{}
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		route, size, ok := strings.Cut(part, "=")
+		route = strings.TrimSpace(route)
+		n, err := parseByteSize(size)
+		if !ok || route == "" || err != nil {
+			return nil, fmt.Errorf("invalid limit %q; want route=size", part)
+		}
+		limits[route] = n
+	}
+	return limits, nil
+}
+
+// routeBodyLimit returns the body limit of a mux pattern: its own entry,
+// else the longest matching prefix entry, else MAX_BODY_BYTES.
+func routeBodyLimit(pattern string) int64 {
+	if n, ok := routeBodyLimits[pattern]; ok {
+		return n
+	}
+	best, limit := -1, maxBodyBytes
+	for route, n := range routeBodyLimits {
+		prefix, ok := strings.CutSuffix(route, "*")
+		if ok && len(prefix) > best && strings.HasPrefix(pattern, prefix) {
+			best, limit = len(prefix), n
+		}
+	}
+	return limit
+}
+
+// bodyLimitHandler caps the body of each request at the limit of the mux
+// pattern it will be routed to. A body that says up front it is too large
+// is refused before it is read.
+func bodyLimitHandler(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		limit := routeBodyLimit(pattern)
+		if r.ContentLength > limit {
+			writeError(w, r, fmt.Sprintf("Request body is larger than %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeBodyError answers a request whose body could not be read: 413 if
+// it went over its limit, 400 otherwise.
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	writeError(w, r, "Cannot read request body", http.StatusBadRequest)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: จำกัดขนาด request body กัน body ยักษ์ทำ server memory หมด (handler อ่าน body ทั้งก้อนด้วย `io.ReadAll`)
+
+	1. ทุก route จำกัดที่ `MAX_BODY_BYTES` (ค่าเริ่มต้น 1M) เกินได้ 413 Request Entity Too Large
+	   - ถ้า `Content-Length` บอกมาตั้งแต่แรกว่าเกิน ตอบ 413 เลยโดยไม่อ่าน body
+	   - ไม่บอกขนาด (chunked) ก็ตัดด้วย `http.MaxBytesReader` ตอนอ่านถึงขีดจำกัด
+	2. ปรับราย route ด้วย `ROUTE_BODY_LIMITS=/admin/courses/import=50M,/graphql=64K` (pattern ของ mux, ลงท้าย `*` ครอบทั้ง prefix แบบ `ROUTE_WEIGHTS`)
+	   - import course package ค่าเริ่มต้น 10M, อัปโหลดโลโก้ของ theme 256K
+	3. ขนาดเขียนเป็น byte หรือมี K/M/G (ฐาน 1024)
+	4. handler ที่อ่าน body ไม่ได้เรียก `writeBodyError` ให้ตอบ 413 หรือ 400 ตามสาเหตุ
+*/
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// changeRecord tracks the sequence numbers of the last changes to a course.
+// Deleted courses keep their record as a tombstone so clients syncing later
+// still learn about the deletion.
+type changeRecord struct {
+	createdSeq int64
+	updatedSeq int64
+	deleted    bool
+	private    bool
+	// tenant is the course's tenant, kept for its tombstone.
+	tenant string
+}
+
+var (
+	// changeSeq is the sequence number of the latest mutation. It only ever
+	// grows. Protected by courseMu, like the records below.
+	changeSeq     int64
+	changeRecords = make(map[int]*changeRecord)
+	// lastChangeAt is when changeSeq last grew.
+	lastChangeAt time.Time
+)
+
+// recordChange assigns the next sequence number to a mutation of course id.
+// Callers must hold courseMu for writing.
+// It also saves the catalog with STORE=file (config.go), updates the
+// metadata index, publishes the change to live subscribers, queues
+// webhook deliveries and, in dual-write mode, queues the course for
+// copying to the secondary. The webhook deliveries join
+// trace, the trace of the request that made the change, if any.
+func recordChange(id int, deleted bool, trace traceContext) {
+	changeSeq++
+	lastChangeAt = time.Now()
+	ev := courseChange{Seq: changeSeq, ID: id, Op: "updated", trace: trace}
+	rec, ok := changeRecords[id]
+	wasPrivate := ok && rec.private
+	if !ok || (rec.deleted && !deleted) {
+		// IDs of deleted courses can be handed out again; that is a new course.
+		rec = &changeRecord{createdSeq: changeSeq}
+		changeRecords[id] = rec
+		ev.Op = "created"
+	}
+	rec.updatedSeq = changeSeq
+	rec.deleted = deleted
+	saveCourses()
+	reindexMetadata(id)
+	enqueueDualWrite(id)
+
+	if deleted {
+		ev.Op = "deleted"
+	} else if i := findCourseIndex(id); i >= 0 {
+		c := CourseList[i]
+		ev.Course = &c
+		rec.private, rec.tenant = c.Private, c.Tenant
+	}
+	ev.tenant = rec.tenant
+	// Webhooks are registered by admins and see private courses too.
+	dispatchWebhooks(ev)
+	if ev.Course != nil && ev.Course.Private {
+		// Live feeds are public; private courses only change quietly, bar
+		// the one change that takes a course out of the public catalog.
+		if hidden, ok := ev.hidden(); ok && !wasPrivate {
+			courseEvents.publish(hidden)
+		}
+		return
+	}
+	courseEvents.publish(ev)
+}
+
+type courseChange struct {
+	Seq    int64   `json:"seq"`
+	Op     string  `json:"op"` // "created", "updated" or "deleted"
+	ID     int     `json:"id"`
+	Course *course `json:"course,omitempty"`
+
+	trace  traceContext
+	tenant string
+}
+
+// viewedBy is ch with its course as p may see it.
+func (ch courseChange) viewedBy(p principal) courseChange {
+	if ch.Course != nil {
+		c := courseView(p, *ch.Course)
+		ch.Course = &c
+	}
+	return ch
+}
+
+// hidden is ch for a client that may not see its course: nothing if the
+// course is new since the client last synced, and otherwise a deletion,
+// since the client may hold the course from before it went private.
+func (ch courseChange) hidden() (courseChange, bool) {
+	if ch.Op == "created" {
+		return courseChange{}, false
+	}
+	return courseChange{Seq: ch.Seq, Op: "deleted", ID: ch.ID, trace: ch.trace, tenant: ch.tenant}, true
+}
+
+// ownedBy reports whether ch is about a course of t's catalog, as
+// catalogOwns decides; deletions included.
+func (ch courseChange) ownedBy(t *tenant) bool {
+	return catalogOwns(t, course{Tenant: ch.tenant})
+}
+
+// courseChangesHandler serves GET /courses/changes?since=<seq>: every course
+// created, updated or deleted after seq, once each with its latest state,
+// plus the sequence to pass as since on the next call. Courses of other
+// tenants are left out, and those the caller may not see (canViewCourse)
+// too, or reported deleted.
+func courseChangesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, r, "Invalid since", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
+	courseMu.RLock()
+	changes := []courseChange{}
+	for _, ch := range changesSince(since) {
+		if !ch.ownedBy(requestTenant(r)) {
+			continue
+		}
+		if ch.Course != nil && !canViewCourse(r, *ch.Course) {
+			var ok bool
+			if ch, ok = ch.hidden(); !ok {
+				continue
+			}
+		}
+		changes = append(changes, ch)
+	}
+	next := changeSeq
+	courseMu.RUnlock()
+
+	who := viewer(w, r)
+	for i := range changes {
+		changes[i] = changes[i].viewedBy(who)
+	}
+	writeValue(w, r, http.StatusOK, map[string]any{
+		"changes":    changes,
+		"next_since": next,
+	})
+}
+
+// changesSince returns every course changed after seq, once each with its
+// latest state, ordered by sequence. Callers must hold courseMu.
+func changesSince(since int64) []courseChange {
+	changes := []courseChange{}
+	for id, rec := range changeRecords {
+		if rec.updatedSeq <= since {
+			continue
+		}
+		ch := courseChange{Seq: rec.updatedSeq, ID: id, tenant: rec.tenant}
+		switch {
+		case rec.deleted:
+			ch.Op = "deleted"
+		case rec.createdSeq > since:
+			ch.Op = "created"
+		default:
+			ch.Op = "updated"
+		}
+		if !rec.deleted {
+			if i := findCourseIndex(id); i >= 0 {
+				c := CourseList[i]
+				ch.Course = &c
+			}
+		}
+		changes = append(changes, ch)
+	}
+	slices.SortFunc(changes, func(a, b courseChange) int { return int(a.Seq - b.Seq) })
+	return changes
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Delta Sync ด้วย Sequence Number
+
+	1. ทุกครั้งที่มีการสร้าง/แก้ไข/ลบ course จะได้ sequence number ใหม่ที่เพิ่มขึ้นเสมอ (`changeSeq`)
+	2. client จำ `next_since` ที่ได้รับครั้งล่าสุดไว้ แล้วเรียก `GET /courses/changes?since=<seq>` เพื่อรับเฉพาะสิ่งที่เปลี่ยนไป
+	   - course ที่ถูกลบจะยังเก็บ record ไว้ (tombstone) เพื่อให้ client รู้ว่าต้องลบออกจากข้อมูลในเครื่องด้วย
+	3. การบันทึก sequence ต้องทำภายใต้ lock เดียวกับการแก้ไข `CourseList` ลำดับของ change จึงถูกต้องเสมอ
+*/
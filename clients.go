@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Internal services get tokens with the OAuth 2.0 client credentials grant
+// (RFC 6749 section 4.4) rather than sharing a long-lived API key. An admin
+// registers a client at /admin/clients with the scopes it may have, and
+// the service trades its ID and secret for an access token:
+//
+//	curl -u svc_...:cs_... -d grant_type=client_credentials -d scope=courses:write \
+//	  http://localhost:8080/auth/token
+//
+// The token is a JWT signed like the other access tokens (tokens.go). Its
+// subject is client:<id>, it names the client in "client_id" and the
+// granted scopes in "scope" (RFC 9068), and it lasts CLIENT_TOKEN_TTL
+// (default 5m). There is no refresh token; the client asks again. Other
+// JWTs may do whatever their role allows, but a client token may only do
+// what its scopes say, with the same scopes as API keys.
+//
+// Like API keys, only a hash of each secret is kept, so the secret is
+// shown once, when the client is created or its secret replaced.
+// Revoking a client stops its tokens at once.
+
+var clientTokenTTL = 5 * time.Minute
+
+func init() {
+	if s := os.Getenv("CLIENT_TOKEN_TTL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid CLIENT_TOKEN_TTL %q: must be a positive duration", s)
+		}
+		clientTokenTTL = d
+	}
+}
+
+type serviceClient struct {
+	ID          string     `json:"client_id"`
+	Name        string     `json:"name"`
+	Scopes      []string   `json:"scopes"`
+	Role        string     `json:"role"`                 // see rbac.go
+	Instructor  string     `json:"instructor,omitempty"` // for the instructor role
+	CreatedAt   time.Time  `json:"created_at"`
+	LastTokenAt *time.Time `json:"last_token_at,omitempty"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+	Secret      string     `json:"client_secret,omitempty"` // only when created or replaced
+
+	hash string
+}
+
+var (
+	// clientMu protects serviceClients.
+	clientMu       sync.Mutex
+	serviceClients []*serviceClient
+)
+
+var (
+	errClientRevoked     = errors.New("client revoked or unknown")
+	errTokenMissingScope = errors.New("token lacks the required scope")
+)
+
+// view is c without its hash, safe to return. Callers hold clientMu.
+func (c *serviceClient) view() serviceClient {
+	v := *c
+	v.Scopes = slices.Clone(c.Scopes)
+	v.hash = ""
+	return v
+}
+
+// findClient returns the client with id, revoked or not. Callers hold
+// clientMu.
+func findClient(id string) *serviceClient {
+	for _, c := range serviceClients {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// clientTokenOf returns the client ID and scopes of a token issued by
+// clientCredentialsGrant, or ok false for any other token.
+func clientTokenOf(c jwtClaims) (id string, scopes []string, ok bool) {
+	id, _ = c.Raw["client_id"].(string)
+	if id == "" || c.Subject != "client:"+id {
+		return "", nil, false
+	}
+	scope, _ := c.Raw["scope"].(string)
+	return id, strings.Fields(scope), true
+}
+
+// checkClientToken refuses a client token whose client has been revoked;
+// other tokens pass.
+func checkClientToken(c jwtClaims) error {
+	id, _, ok := clientTokenOf(c)
+	if !ok {
+		return nil
+	}
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	if sc := findClient(id); sc == nil || sc.RevokedAt != nil {
+		return errClientRevoked
+	}
+	return nil
+}
+
+// tokenScopeAllows reports whether the bearer token of r may use scope:
+// any token but a client token may, and a client token needs the scope.
+func tokenScopeAllows(r *http.Request, scope string) bool {
+	c, ok := requestClaims(r)
+	if !ok {
+		return false
+	}
+	_, scopes, isClient := clientTokenOf(c)
+	return !isClient || slices.Contains(scopes, scope)
+}
+
+// isClientToken reports whether r carries a client token.
+func isClientToken(r *http.Request) bool {
+	c, ok := requestClaims(r)
+	if !ok {
+		return false
+	}
+	_, _, isClient := clientTokenOf(c)
+	return isClient
+}
+
+type clientTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"` // seconds
+	Scope       string `json:"scope"`
+}
+
+// writeOAuthError answers a failed grant with the JSON error body of RFC
+// 6749 section 5.2, whatever the client accepts, since OAuth libraries
+// parse nothing else.
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="clients"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// clientCredentialsGrant serves POST /auth/token with a form body, which
+// is how OAuth clients ask. The client authenticates with Basic or with
+// client_id and client_secret in the form; scope, if given, must be a
+// subset of the client's scopes, and defaults to all of them.
+func clientCredentialsGrant(w http.ResponseWriter, r *http.Request) {
+	if grant := r.PostFormValue("grant_type"); grant != "client_credentials" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "only client_credentials is supported here")
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if id == "" || secret == "" {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication required")
+		return
+	}
+
+	now := time.Now().UTC()
+	hash := hashAPIKey(secret)
+	clientMu.Lock()
+	sc := findClient(id)
+	if sc == nil || sc.RevokedAt != nil || subtle.ConstantTimeCompare([]byte(sc.hash), []byte(hash)) != 1 {
+		clientMu.Unlock()
+		requestLogger(r).Warn("Client authentication failed", "client_id", id)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+	scopes := slices.Clone(sc.Scopes)
+	if requested := strings.Fields(r.PostFormValue("scope")); len(requested) > 0 {
+		for _, s := range requested {
+			if !slices.Contains(sc.Scopes, s) {
+				clientMu.Unlock()
+				writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "scope "+strconv.Quote(s)+" is not granted to this client")
+				return
+			}
+		}
+		scopes = slices.Compact(slices.Sorted(slices.Values(requested)))
+	}
+	sc.LastTokenAt = &now
+	who := principal{Subject: "client:" + sc.ID, Role: sc.Role, Instructor: sc.Instructor}
+	clientMu.Unlock()
+
+	claims := map[string]any{
+		"sub":       who.Subject,
+		"role":      who.Role,
+		"client_id": id,
+		"scope":     strings.Join(scopes, " "),
+		"iat":       now.Unix(),
+		"exp":       now.Add(clientTokenTTL).Unix(),
+		"jti":       randomHex(8),
+	}
+	if who.Instructor != "" {
+		claims["name"] = who.Instructor
+	}
+	token, err := signClaims(claims)
+	if err != nil {
+		requestLogger(r).Error("Cannot sign client token", "client_id", id, "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "cannot issue tokens")
+		return
+	}
+	requestLogger(r).Info("Client token issued", "client_id", id, "scope", claims["scope"])
+	w.Header().Set("Cache-Control", "no-store")
+	writeValue(w, r, http.StatusOK, clientTokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(clientTokenTTL / time.Second),
+		Scope:       strings.Join(scopes, " "),
+	})
+}
+
+// adminClientsHandler serves GET /admin/clients (every client, revoked
+// ones included) and POST /admin/clients with {"name": ..., "scopes":
+// [...]}, which takes "role" and "instructor" like an API key. The
+// response to POST is the only one that includes the secret.
+func adminClientsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		clientMu.Lock()
+		list := []serviceClient{}
+		for _, c := range serviceClients {
+			list = append(list, c.view())
+		}
+		clientMu.Unlock()
+		writeValue(w, r, http.StatusOK, list)
+
+	case http.MethodPost:
+		var req struct {
+			Name       string   `json:"name"`
+			Scopes     []string `json:"scopes"`
+			Role       string   `json:"role"`
+			Instructor string   `json:"instructor"`
+		}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		if strings.TrimSpace(req.Name) == "" {
+			writeError(w, r, "name is required", http.StatusBadRequest)
+			return
+		}
+		scopes := []string{}
+		for _, s := range req.Scopes {
+			if !slices.Contains(apiKeyScopes, s) {
+				writeError(w, r, "Unknown scope "+strconv.Quote(s)+"; use "+strings.Join(apiKeyScopes, " or "), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+		if len(scopes) == 0 {
+			writeError(w, r, "At least one scope is required", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = roleAdmin
+		}
+		req.Instructor = strings.TrimSpace(req.Instructor)
+		if msg := checkRole(req.Role, req.Instructor); msg != "" {
+			writeError(w, r, msg, http.StatusBadRequest)
+			return
+		}
+
+		secret := "cs_" + randomHex(24)
+		clientMu.Lock()
+		c := &serviceClient{
+			ID:         "svc_" + randomHex(8),
+			Name:       strings.TrimSpace(req.Name),
+			Scopes:     scopes,
+			Role:       req.Role,
+			Instructor: req.Instructor,
+			CreatedAt:  time.Now().UTC(),
+			hash:       hashAPIKey(secret),
+		}
+		serviceClients = append(serviceClients, c)
+		created := c.view()
+		clientMu.Unlock()
+
+		created.Secret = secret
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Location", "/admin/clients/"+c.ID)
+		writeValue(w, r, http.StatusCreated, created)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminClientHandler serves GET /admin/clients/{id} and DELETE, which
+// revokes the client and every token it holds.
+func adminClientHandler(w http.ResponseWriter, r *http.Request) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	c := findClient(r.PathValue("id"))
+	if c == nil {
+		writeError(w, r, "Client not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeValue(w, r, http.StatusOK, c.view())
+	case http.MethodDelete:
+		if c.RevokedAt == nil {
+			now := time.Now().UTC()
+			c.RevokedAt = &now
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminClientSecretHandler serves POST /admin/clients/{id}/secret, which
+// replaces the client's secret. The old one stops working at once, but
+// tokens already issued with it last until they expire.
+func adminClientSecretHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	clientMu.Lock()
+	c := findClient(r.PathValue("id"))
+	if c == nil || c.RevokedAt != nil {
+		clientMu.Unlock()
+		writeError(w, r, "Client not found", http.StatusNotFound)
+		return
+	}
+	secret := "cs_" + randomHex(24)
+	c.hash = hashAPIKey(secret)
+	v := c.view()
+	clientMu.Unlock()
+
+	v.Secret = secret
+	w.Header().Set("Cache-Control", "no-store")
+	writeValue(w, r, http.StatusOK, v)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ให้ service ภายในขอ token แบบ OAuth2 client credentials แทนการแชร์ API key อายุยาว
+
+	1. admin ลงทะเบียน client ที่ `POST /admin/clients` พร้อม scope ได้ `client_id` กับ `client_secret` (secret เห็นครั้งเดียว เก็บไว้แค่ hash)
+	2. service ส่ง `grant_type=client_credentials` แบบ form ไปที่ `POST /auth/token`
+	   - ยืนยันตัวด้วย Basic หรือ `client_id`/`client_secret` ใน form
+	   - ขอ `scope` ได้เฉพาะที่ client มี ไม่ระบุได้ทั้งหมด
+	   - ได้ JWT อายุสั้นตาม `CLIENT_TOKEN_TTL` (ค่าเริ่มต้น 5 นาที) ไม่มี refresh token
+	   - error ตอบตามรูปแบบ RFC 6749 (`invalid_client`, `invalid_scope`, `unsupported_grant_type`)
+	3. token ของ client ทำได้แค่ตาม scope ต่างจาก JWT อื่นที่ทำได้ตาม role
+	4. `DELETE /admin/clients/{id}` เพิกถอน client และ token ที่ออกไปแล้วใช้ไม่ได้ทันที; `POST /admin/clients/{id}/secret` เปลี่ยน secret
+*/
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Compact JSON is an opt-in encoding for bandwidth-sensitive partners. A
+// client that asks for JSON with the compact profile (RFC 6906),
+//
+//	Accept: application/json; profile="https://courses.example.com/.well-known/compact-json"
+//
+// gets the same documents with short field names: "name" becomes "n",
+// "instructor" "in", "_links" "_l" and so on. The mapping is published at
+// GET /.well-known/compact-json, so client libraries can expand the names
+// back; any host may be named in the profile, only the path is checked.
+// It is applied by the codec layer (render.go), so every JSON response
+// has it: the catalog list, /courses/changes and the rest. The sync stream
+// takes it from the same profile on its own media type:
+//
+//	Accept: application/vnd.courses-sync; profile="/.well-known/compact-json"
+//
+// Response Content-Types carry the profile back. Keys inside "metadata"
+// are deployment-specific (metadata.go) and kept as they are. Request
+// bodies are read with the full names; the profile only shortens
+// responses. Compression (compress.go) still applies on top.
+
+const compactProfilePath = "/.well-known/compact-json"
+
+// compactProfileVersion changes whenever an alias does; clients should
+// refetch the mapping when it differs from the one they hold.
+const compactProfileVersion = 1
+
+// compactAliases maps field names to their compact names. No alias may be
+// a field name too, so a compact document reads back one way only.
+var compactAliases = map[string]string{
+	"id":               "i",
+	"name":             "n",
+	"price":            "p",
+	"instructor":       "in",
+	"seats":            "st",
+	"access_days":      "ad",
+	"price_book":       "pb",
+	"private":          "pv",
+	"tenant":           "tn",
+	"owner":            "ow",
+	"metadata":         "md",
+	"currency":         "cu",
+	"amount":           "am",
+	"source":           "so",
+	"resolution_order": "ro",
+	"_pricing":         "_p",
+	"_links":           "_l",
+	"href":             "h",
+	"method":           "m",
+	"changes":          "ch",
+	"next_since":       "ns",
+	"seq":              "sq",
+	"op":               "o",
+	"course":           "c",
+	"type":             "ty",
+	"cursor":           "cr",
+}
+
+// compactOpaque are the fields whose values are copied without aliasing.
+var compactOpaque = map[string]bool{"metadata": true}
+
+// compactProfileDoc is the body of GET /.well-known/compact-json.
+type compactProfileDoc struct {
+	Profile string            `json:"profile"`
+	Version int               `json:"version"`
+	Aliases map[string]string `json:"aliases"` // field name to compact name
+	Opaque  []string          `json:"opaque"`  // fields whose contents keep their names
+}
+
+// compactProfileHandler serves GET /.well-known/compact-json.
+func compactProfileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	writeValue(w, r, http.StatusOK, compactProfileDoc{
+		Profile: compactProfilePath,
+		Version: compactProfileVersion,
+		Aliases: compactAliases,
+		Opaque:  []string{"metadata"},
+	})
+}
+
+// compactProfile returns the profile of params, a media range's
+// parameters, if it names the compact profile. A profile may be a
+// space-separated list of URIs.
+func compactProfile(params map[string]string) (string, bool) {
+	for _, p := range strings.Fields(params["profile"]) {
+		if u, err := url.Parse(p); err == nil && u.Path == compactProfilePath {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// acceptsCompact returns the compact profile r asks for with mediaType,
+// if it does.
+func acceptsCompact(r *http.Request, mediaType string) (string, bool) {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mt != mediaType || params["q"] == "0" {
+			continue
+		}
+		if profile, ok := compactProfile(params); ok {
+			return profile, true
+		}
+	}
+	return "", false
+}
+
+// compactCodec is jsonCodec with compact names, labelled with profile.
+func compactCodec(profile string) *codec {
+	return &codec{
+		mediaType:   mediaTypeJSON,
+		contentType: mime.FormatMediaType(mediaTypeJSON, map[string]string{"profile": profile}),
+		encodeCourse: func(r *http.Request, c course) ([]byte, error) {
+			return compactJSON(jsonCodec.encodeCourse(r, c))
+		},
+		encodeCourses: func(r *http.Request, courses []course) ([]byte, error) {
+			return compactJSON(jsonCodec.encodeCourses(r, courses))
+		},
+		decodeCourse: jsonCodec.decodeCourse,
+		encodeValue: func(v any) ([]byte, error) {
+			return compactJSON(json.Marshal(v))
+		},
+		decodeValue: jsonCodec.decodeValue,
+	}
+}
+
+// compactJSON rewrites body, a JSON document, with compact names. It
+// takes an encoder's results, so that it can wrap one directly.
+func compactJSON(body []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var out bytes.Buffer
+	out.Grow(len(body))
+	if err := copyCompact(dec, &out, false); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// copyCompact copies the next value of dec to out in document order,
+// aliasing the keys of its objects unless opaque.
+func copyCompact(dec *json.Decoder, out *bytes.Buffer, opaque bool) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		b, err := json.Marshal(tok)
+		out.Write(b)
+		return err
+	}
+	if delim == '[' {
+		out.WriteByte('[')
+		for i := 0; dec.More(); i++ {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := copyCompact(dec, out, opaque); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+		_, err := dec.Token()
+		return err
+	}
+	out.WriteByte('{')
+	for i := 0; dec.More(); i++ {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		name := key
+		if alias, ok := compactAliases[key]; ok && !opaque {
+			name = alias
+		}
+		b, _ := json.Marshal(name)
+		out.Write(b)
+		out.WriteByte(':')
+		if err := copyCompact(dec, out, opaque || compactOpaque[key]); err != nil {
+			return err
+		}
+	}
+	out.WriteByte('}')
+	_, err = dec.Token()
+	return err
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: โหมด JSON แบบย่อชื่อ field สำหรับ partner ที่ต้องประหยัด bandwidth เลือกใช้ผ่าน profile ใน `Accept`
+
+	1. ส่ง `Accept: application/json; profile=".../.well-known/compact-json"` แล้วทุก response JSON จะใช้ชื่อสั้น เช่น `name` → `n`, `_links` → `_l`
+	   - ทำที่ชั้น codec (`render.go`) จึงได้ทั้ง `/courses`, `/courses/changes` และ endpoint อื่น
+	   - `/courses/sync` ใช้ profile เดียวกันบน media type `application/vnd.courses-sync`
+	   - `Content-Type` ของ response บอก profile กลับไป
+	2. ตารางแปลงชื่อเผยแพร่ที่ `GET /.well-known/compact-json` พร้อม `version` ให้ client แปลงกลับได้ (เช็คแค่ path ของ profile ไม่สน host)
+	3. key ข้างใน `metadata` ไม่ถูกย่อเพราะเป็น field เฉพาะ deployment
+	4. เขียน JSON ใหม่แบบไล่ token ตามลำดับเดิม; body ของ request ยังใช้ชื่อเต็ม และ gzip/br ยังบีบซ้อนได้ตามปกติ
+*/
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// GET /courses/compare?ids=1,2,3 puts two to maxComparedCourses courses
+// side by side for the comparison widget, in the order asked for. Each
+// comes with what a student weighs up:
+//
+//   - the price, in ?currency= if given (pricing.go), otherwise the
+//     default currency;
+//   - access_days, null for lifetime access, and the seats, seats left,
+//     enrolled and waitlisted from the roster (enrollments.go);
+//   - duration_hours, level, rating and curriculum, from the course's
+//     metadata keys of those names (metadata.go), null when a course has
+//     none or one of the wrong type. The curriculum is cut to a summary of
+//     maxCurriculumSummary characters.
+//
+// "differences" names the fields whose values are not the same for every
+// course, so the widget can highlight them. Courses are as the caller may
+// see them: a private course the caller cannot see, like one that does
+// not exist, makes the whole comparison 404, and fields hidden from the
+// caller (fieldperms.go) are null.
+
+const (
+	maxComparedCourses   = 10
+	maxCurriculumSummary = 280
+)
+
+// comparedCourse is one column of a comparison.
+type comparedCourse struct {
+	ID            int             `json:"id"`
+	Name          string          `json:"name"`
+	Instructor    string          `json:"instructor"`
+	Price         effectivePrice  `json:"price"`
+	AccessDays    *int            `json:"access_days"` // null for lifetime access
+	DurationHours *float64        `json:"duration_hours"`
+	Level         *string         `json:"level"`
+	Rating        *float64        `json:"rating"`
+	Curriculum    *string         `json:"curriculum"`
+	Seats         *int            `json:"seats"`      // null for unlimited
+	SeatsLeft     *int            `json:"seats_left"` // null for unlimited
+	Enrolled      int             `json:"enrolled"`
+	Waitlist      int             `json:"waitlist"`
+	Links         map[string]link `json:"_links"`
+}
+
+// courseComparison is the body of GET /courses/compare.
+type courseComparison struct {
+	Courses     []comparedCourse `json:"courses"`
+	Differences []string         `json:"differences"`
+}
+
+// comparedFields are the fields of comparedCourse that differences can
+// name, in the order the widget shows them.
+var comparedFields = []string{
+	"name", "instructor", "price", "access_days", "duration_hours", "level",
+	"rating", "curriculum", "seats", "seats_left", "enrolled", "waitlist",
+}
+
+// parseCompareIDs reads ?ids=, a comma-separated list of course IDs.
+func parseCompareIDs(s string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid course ID %q in ids", part)
+		}
+		if slices.Contains(ids, id) {
+			return nil, fmt.Errorf("course %d is in ids twice", id)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) < 2 || len(ids) > maxComparedCourses {
+		return nil, fmt.Errorf("ids must name 2 to %d courses", maxComparedCourses)
+	}
+	return ids, nil
+}
+
+// compareCourse assembles the column of c, as who may see it. Callers
+// hold courseMu.
+func compareCourse(who principal, c course, currency string) comparedCourse {
+	v := courseView(who, c)
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	cc := comparedCourse{
+		ID:         v.CourseId,
+		Name:       v.CourseName,
+		Instructor: v.Instructor,
+		Price:      resolvePrice(v, currency),
+		Links:      map[string]link{"self": {Href: fmt.Sprintf("/courses/%d", v.CourseId)}},
+	}
+	if v.AccessDays > 0 {
+		cc.AccessDays = &v.AccessDays
+	}
+	if roster := enrollments[c.CourseId]; roster != nil {
+		cc.Enrolled, cc.Waitlist = len(roster.enrolled), len(roster.waitlist)
+	}
+	if v.Seats > 0 {
+		left := max(v.Seats-cc.Enrolled, 0)
+		cc.Seats, cc.SeatsLeft = &v.Seats, &left
+	}
+	if n, ok := v.Metadata["duration_hours"].(float64); ok {
+		cc.DurationHours = &n
+	}
+	if s, ok := v.Metadata["level"].(string); ok {
+		cc.Level = &s
+	}
+	if n, ok := v.Metadata["rating"].(float64); ok {
+		cc.Rating = &n
+	}
+	if s, ok := v.Metadata["curriculum"].(string); ok {
+		summary := curriculumSummary(s)
+		cc.Curriculum = &summary
+	}
+	return cc
+}
+
+// curriculumSummary cuts s to maxCurriculumSummary characters, at a word
+// boundary where there is one.
+func curriculumSummary(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	runes := []rune(s)
+	if len(runes) <= maxCurriculumSummary {
+		return s
+	}
+	cut := string(runes[:maxCurriculumSummary])
+	if i := strings.LastIndexByte(cut, ' '); i > 0 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// comparisonDifferences returns the fields of comparedFields whose values
+// differ between the courses.
+func comparisonDifferences(courses []comparedCourse) []string {
+	values := make([]map[string]json.RawMessage, len(courses))
+	for i, c := range courses {
+		b, _ := json.Marshal(c)
+		json.Unmarshal(b, &values[i])
+	}
+	differences := []string{}
+	for _, field := range comparedFields {
+		for _, v := range values[1:] {
+			if string(v[field]) != string(values[0][field]) {
+				differences = append(differences, field)
+				break
+			}
+		}
+	}
+	return differences
+}
+
+// courseCompareHandler serves GET /courses/compare.
+func courseCompareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ids, err := parseCompareIDs(r.URL.Query().Get("ids"))
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	currency, err := requestedCurrency(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Cache-Control", catalogCacheControl)
+	who := viewer(w, r)
+	resp := courseComparison{}
+	private := false
+	courseMu.RLock()
+	for _, id := range ids {
+		i := findCourseIndex(id)
+		if i < 0 || !canViewCourse(r, CourseList[i]) {
+			courseMu.RUnlock()
+			writeError(w, r, fmt.Sprintf("Course %d not found", id), http.StatusNotFound)
+			return
+		}
+		private = private || CourseList[i].Private
+		resp.Courses = append(resp.Courses, compareCourse(who, CourseList[i], currency))
+	}
+	courseMu.RUnlock()
+	if private {
+		w.Header().Set("Cache-Control", privateCacheControl)
+	}
+	resp.Differences = comparisonDifferences(resp.Courses)
+	writeValue(w, r, http.StatusOK, resp)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: `GET /courses/compare?ids=1,2,3` เทียบ course 2–10 ตัวแบบวางคู่กันให้ widget หน้าเว็บ
+
+	1. แต่ละ course ได้ข้อมูลที่ใช้ตัดสินใจ ประกอบจากข้อมูลที่มีอยู่แล้ว
+	   - ราคาตาม `?currency=` (หรือสกุลหลัก) จาก `pricing.go`
+	   - `access_days` (null = ตลอดชีพ), ที่นั่ง / ที่เหลือ / คนลงทะเบียน / waitlist จาก roster
+	   - `duration_hours`, `level`, `rating`, `curriculum` จาก metadata key ชื่อเดียวกัน (ไม่มีหรือชนิดผิดเป็น null) โดย curriculum ตัดเหลือสรุปไม่เกิน 280 ตัวอักษร
+	2. `differences` บอกชื่อ field ที่ค่าไม่เท่ากันทุก course ให้ widget ไฮไลต์
+	3. ids ผิดรูปแบบ, ซ้ำ หรือจำนวนไม่อยู่ใน 2–10 ได้ 400; course ที่ไม่มีหรือ private ที่ผู้เรียกดูไม่ได้ได้ 404 ทั้งชุด
+	4. เคารพ field permission ของผู้เรียก และ private course ทำให้ response ไม่ถูก cache ร่วม
+*/
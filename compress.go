@@ -0,0 +1,220 @@
+package main
+
+import (
+	"compress/gzip"
+	"embed"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// staticFiles holds the admin UI. Next to an asset, a precompressed variant
+// may be embedded as <name>.br or <name>.gz; it is served as-is to clients
+// that accept that encoding instead of compressing on every request.
+//
+//go:embed static
+var staticFiles embed.FS
+
+// responseEncoders are the encodings compressHandler can apply on the fly,
+// in order of preference. The standard library has no Brotli writer, so
+// Brotli is only served for precompressed static assets, and none ships
+// yet; registering an encoder here under "br" enables it for API responses
+// too.
+var responseEncoders = []struct {
+	name   string
+	writer func(io.Writer) io.WriteCloser
+}{
+	{"gzip", func(w io.Writer) io.WriteCloser { return getGzipWriter(w) }},
+}
+
+// precompressedEncodings are the file suffixes looked up for static assets,
+// in order of preference.
+var precompressedEncodings = []struct {
+	name   string
+	suffix string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+var gzipWriterPool = sync.Pool{
+	New: func() any { return gzip.NewWriter(io.Discard) },
+}
+
+type pooledGzipWriter struct{ *gzip.Writer }
+
+func getGzipWriter(w io.Writer) io.WriteCloser {
+	gz := gzipWriterPool.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return pooledGzipWriter{gz}
+}
+
+func (p pooledGzipWriter) Close() error {
+	err := p.Writer.Close()
+	gzipWriterPool.Put(p.Writer)
+	return err
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header allows coding,
+// treating q=0 as a refusal.
+func acceptsEncoding(header, coding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), coding) && strings.TrimSpace(name) != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressibleType reports whether a response of this Content-Type is worth
+// compressing. Images and archives are already compressed.
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml") ||
+		strings.HasSuffix(mediaType, "yaml") ||
+		mediaType == "application/javascript"
+}
+
+// compressHandler compresses responses from next using the best encoding
+// the client accepts.
+func compressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		accept := r.Header.Get("Accept-Encoding")
+		for _, enc := range responseEncoders {
+			if acceptsEncoding(accept, enc.name) {
+				cw := &compressResponseWriter{ResponseWriter: w, encoding: enc.name, newWriter: enc.writer, head: r.Method == http.MethodHead}
+				defer cw.Close()
+				next.ServeHTTP(cw, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// compressResponseWriter decides on the first WriteHeader whether to
+// compress, based on the status and headers the handler has set.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding    string
+	newWriter   func(io.Writer) io.WriteCloser
+	head        bool
+	wroteHeader bool
+	w           io.WriteCloser
+}
+
+func (c *compressResponseWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	h := c.Header()
+	if !c.head && status != http.StatusNoContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && compressibleType(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		c.w = c.newWriter(c.ResponseWriter)
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *compressResponseWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		if c.Header().Get("Content-Type") == "" {
+			c.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.w != nil {
+		return c.w.Write(p)
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *compressResponseWriter) Flush() {
+	if f, ok := c.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// hijack the connection for a WebSocket upgrade.
+func (c *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *compressResponseWriter) Close() error {
+	if c.w != nil {
+		return c.w.Close()
+	}
+	return nil
+}
+
+// staticHandler serves the embedded admin UI, picking a precompressed
+// variant of the requested file when the client accepts its encoding. In
+// dev mode it serves static/ from disk as it is (see assets.go).
+func staticHandler() http.Handler {
+	root := assetFS(staticFiles, "static")
+	files := http.FileServerFS(root)
+	if devMode {
+		return noStore(files)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name == "" || strings.HasSuffix(r.URL.Path, "/") {
+			name = path.Join(name, "index.html")
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		contentType := mime.TypeByExtension(path.Ext(name))
+		accept := r.Header.Get("Accept-Encoding")
+		for _, enc := range precompressedEncodings {
+			if !acceptsEncoding(accept, enc.name) {
+				continue
+			}
+			f, err := root.Open(name + enc.suffix)
+			if err != nil {
+				continue
+			}
+			defer f.Close()
+			if contentType != "" {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.Header().Set("Content-Encoding", enc.name)
+			http.ServeContent(w, r, name, time.Time{}, f.(io.ReadSeeker))
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: การบีบอัด response เพื่อลด bandwidth
+
+	1. `compressHandler` เป็น middleware ที่ดู header `Accept-Encoding` ของ client แล้วบีบอัด response แบบ on-the-fly (ตอนนี้มี gzip จาก standard library)
+	   - บีบอัดเฉพาะ content type ที่คุ้มค่า (JSON, text, XML) และไม่ยุ่งกับ 204/304 หรือ HEAD
+	   - ใช้ `sync.Pool` เก็บ gzip.Writer ไว้ใช้ซ้ำ เพราะการสร้างใหม่ทุก request มีต้นทุนสูง
+	2. Precompressed Assets: ไฟล์ใน `static/` สามารถมีไฟล์ `.br` / `.gz` ที่บีบอัดไว้ล่วงหน้าวางคู่กันได้
+	   - `staticHandler` จะเลือกไฟล์ที่ client รองรับ (br ก่อน gzip) แล้วส่งไปตรงๆ โดยไม่ต้องบีบอัดใหม่
+	   - ตอนนี้มีแค่ `index.html.gz` ส่วน Brotli สำหรับ API ยังไม่ทำ เพราะ standard library ไม่มี encoder และไม่มี go.mod ให้เพิ่ม library
+	3. อย่าลืม `Vary: Accept-Encoding` เพื่อให้ cache/CDN แยกเก็บ response ตาม encoding
+*/
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The server is configured from its environment. The basics, with the
+// command-line flags that override them:
+//
+//	PORT        -addr       port to serve plain HTTP on (default 8080; 0 picks a free one)
+//	BIND_ADDR   -addr       address to listen on, an IP or host name (default all interfaces)
+//	LOG_LEVEL               debug, info, warn or error (logger.go)
+//	STORE       -store      where courses are kept: memory (the default) or file
+//	STORE_DSN   -store-dsn  for STORE=file, the JSON file, as a path or a file: URL
+//	SEED_FILE   -seed       a JSON array of courses to start from instead of the built-in seed
+//
+// These may also be set in CONFIG_FILE (configfile.go); a flag wins over
+// the environment, which wins over the file. -addr is host:port, so
+// -addr :9090 listens on every interface. Every other feature reads its
+// own variables in its file's init, next to the code it configures.
+// Each is checked as it is read, here once the flags are parsed, and a
+// value that does not parse stops the process before it listens, with
+// the flag or variable named, rather than leaving a half-configured
+// instance in rotation.
+//
+// With STORE=memory the catalog starts from the seed courses and is lost
+// on exit. With STORE=file it is read from STORE_DSN at start, seeded if
+// the file does not exist yet, and written back, by renaming a new file
+// into place, after every change. Only courses are kept there; users,
+// audit entries and the rest have their own *_FILE variables.
+
+const (
+	storeMemory = "memory"
+	storeFile   = "file"
+)
+
+var (
+	listenPort = 8080
+	bindAddr   string
+	storeType  = storeMemory
+	// courseFile is the file of STORE=file.
+	courseFile string
+	// courseFileReady is set once the catalog is loaded, so loading and
+	// seeding do not write the file once per course.
+	courseFileReady bool
+	// seedFile is the file of SEED_FILE, or -seed as seedName says.
+	seedFile, seedName string
+)
+
+// serverFlags are the command-line flags of the settings above.
+type serverFlags struct {
+	addr, store, storeDSN, seed *string
+}
+
+func defineServerFlags() serverFlags {
+	return serverFlags{
+		addr:     flag.String("addr", "", "serve plain HTTP on this host:port; overrides PORT and BIND_ADDR"),
+		store:    flag.String("store", "", "keep courses in memory or in a file; overrides STORE"),
+		storeDSN: flag.String("store-dsn", "", "the file of -store file; overrides STORE_DSN"),
+		seed:     flag.String("seed", "", "start from the courses in this JSON file instead of the built-in ones; overrides SEED_FILE"),
+	}
+}
+
+// setting returns the flag's value if it was given, or else the setting
+// of env, with the name to report a bad value under.
+func setting(flagName, flagValue, env string) (string, string) {
+	if flagValue != "" {
+		return flagValue, "-" + flagName
+	}
+	return configSetting(env), env
+}
+
+// configureServer settles the settings above from f, the environment and
+// CONFIG_FILE, in that order, and checks them. main calls it once the
+// flags are parsed.
+func configureServer(f serverFlags) {
+	if *f.addr != "" {
+		host, port, err := net.SplitHostPort(*f.addr)
+		if err != nil {
+			log.Fatalf("Invalid -addr %q: want host:port, such as :8080", *f.addr)
+		}
+		if err := checkBindAddr(host); err != nil {
+			log.Fatalf("Invalid -addr %q: %v", *f.addr, err)
+		}
+		if listenPort, err = parsePort(port); err != nil {
+			log.Fatalf("Invalid -addr %q: %v", *f.addr, err)
+		}
+		bindAddr = host
+	} else {
+		if s := configSetting("PORT"); s != "" {
+			n, err := parsePort(s)
+			if err != nil {
+				log.Fatalf("Invalid PORT %q: %v", s, err)
+			}
+			listenPort = n
+		}
+		if s := configSetting("BIND_ADDR"); s != "" {
+			if err := checkBindAddr(s); err != nil {
+				log.Fatalf("Invalid BIND_ADDR %q: %v", s, err)
+			}
+			bindAddr = strings.Trim(s, "[]")
+		}
+	}
+
+	typ, typName := setting("store", *f.store, "STORE")
+	if typ != "" {
+		storeType = typ
+	}
+	dsn, dsnName := setting("store-dsn", *f.storeDSN, "STORE_DSN")
+	switch storeType {
+	case storeMemory:
+		if dsn != "" {
+			log.Fatalf("%s is only used with a file store", dsnName)
+		}
+	case storeFile:
+		name, err := storeFilePath(dsn)
+		if err != nil {
+			log.Fatalf("Invalid %s %q: %v", dsnName, dsn, err)
+		}
+		courseFile = name
+	default:
+		log.Fatalf("Invalid %s %q: use memory or file", typName, storeType)
+	}
+	seedFile, seedName = setting("seed", *f.seed, "SEED_FILE")
+}
+
+func parsePort(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 65535 {
+		return 0, errors.New("must be a port number, 0 to 65535")
+	}
+	return n, nil
+}
+
+// checkBindAddr returns what is wrong with s as BIND_ADDR, if anything.
+func checkBindAddr(s string) error {
+	host := strings.Trim(s, "[]")
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if strings.ContainsAny(host, ":/ ") {
+		return errors.New("must be an IP address or host name, without a port; set PORT for that")
+	}
+	return nil
+}
+
+// listenAddress is the address the plain HTTP server listens on.
+func listenAddress() string {
+	return net.JoinHostPort(bindAddr, strconv.Itoa(listenPort))
+}
+
+// sharesPort reports whether listening on a and b would collide: the same
+// port, on the same host or on every interface.
+func sharesPort(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB || portA == "0" {
+		return false
+	}
+	return hostA == hostB || hostA == "" || hostB == ""
+}
+
+// storeFilePath returns the file named by dsn, a path or a file: URL.
+func storeFilePath(dsn string) (string, error) {
+	if dsn == "" {
+		return "", errors.New("STORE=file needs the file to keep courses in")
+	}
+	if !strings.HasPrefix(dsn, "file:") {
+		return dsn, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file URLs must be local, not on %q", u.Host)
+	}
+	if name := u.Opaque + u.Path; name != "" {
+		return name, nil
+	}
+	return "", errors.New("the URL names no file")
+}
+
+// loadCourseFile reads the catalog from courseFile. It returns false if
+// there is no such file yet, so the seed catalog should be used.
+func loadCourseFile() (bool, error) {
+	courses, err := readCourses(courseFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	CourseList = courses
+	return true, nil
+}
+
+// readCourses reads a JSON array of courses, as a course file or a seed
+// file holds them, and checks their IDs and fields.
+func readCourses(name string) ([]course, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var courses []course
+	if err := json.Unmarshal(data, &courses); err != nil {
+		return nil, err
+	}
+	seen := map[int]bool{}
+	for i := range courses {
+		id := courses[i].CourseId
+		if id <= 0 || seen[id] {
+			return nil, fmt.Errorf("course ID %d is not positive or not unique", id)
+		}
+		seen[id] = true
+		if err := checkCourse(&courses[i]); err != nil {
+			return nil, fmt.Errorf("course %d: %v", id, err)
+		}
+	}
+	return courses, nil
+}
+
+// writeCourseFile writes the catalog to courseFile, renaming the new file
+// into place. Callers hold courseMu.
+func writeCourseFile() error {
+	data, err := json.MarshalIndent(CourseList, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := courseFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, courseFile)
+}
+
+// saveCourses writes the catalog to the file of STORE=file, if that is
+// the store. Callers hold courseMu for writing.
+func saveCourses() {
+	if storeType != storeFile || !courseFileReady {
+		return
+	}
+	if err := writeCourseFile(); err != nil {
+		slog.Error("Error saving courses", "file", courseFile, "err", err)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ตั้งค่าพื้นฐานของ server จาก flag, environment หรือ config file แทนการ hardcode `:8080` และตรวจค่าตั้งแต่ตอน start
+
+	1. `PORT` (ค่าเริ่มต้น 8080, 0 = ให้ระบบเลือก port ว่าง) และ `BIND_ADDR` (IP หรือชื่อ host ไม่ใส่ port; ค่าเริ่มต้นฟังทุก interface)
+	2. `LOG_LEVEL` อ่านใน `logger.go` เหมือนเดิม
+	3. `STORE` เลือกที่เก็บ course
+	   - `memory` (ค่าเริ่มต้น) เริ่มจาก seed แล้วหายเมื่อปิด process
+	   - `file` ต้องมี `STORE_DSN` เป็น path หรือ `file:` URL; อ่านตอน start ถ้ายังไม่มีไฟล์ก็ seed แล้วเขียนไฟล์ใหม่ทุกครั้งที่ course เปลี่ยน (เขียนไฟล์ชั่วคราวแล้ว rename)
+	4. ค่าผิดรูปแบบ, `STORE` ที่ไม่รู้จัก, `STORE_DSN` ที่ใช้คู่กับ memory หรือไฟล์ที่อ่าน/เขียนไม่ได้ ทำให้ process ไม่ start พร้อมบอกชื่อตัวแปร
+	5. `SEED_FILE` (หรือ `-seed`) ให้เริ่มจาก course ในไฟล์ JSON แทน seed ในโค้ด; ถ้า STORE=file มีไฟล์อยู่แล้วจะไม่ seed ซ้ำ
+	6. ลำดับความสำคัญ: flag > env > `CONFIG_FILE` > ค่าเริ่มต้น; `-addr host:port` แทนทั้ง `PORT` และ `BIND_ADDR` และ `main` เรียก `configureServer` หลัง `flag.Parse` เพราะ flag พร้อมใช้ตอนนั้น
+	7. ไม่มี store แบบ sqlite (ไม่มี driver ใน stdlib) `-store sqlite` จึง start ไม่ขึ้นพร้อมบอกให้ใช้ memory หรือ file
+	8. feature อื่น ๆ ยังอ่าน env ของตัวเองใน `init` ของไฟล์นั้น ๆ
+*/
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// CONFIG_FILE names a YAML file (yaml.go) holding the settings of
+// config.go, the log level and the rate limits, under the lower-cased
+// names of their variables:
+//
+//	port: 8080
+//	store: file
+//	store_dsn: /var/lib/courses/courses.json
+//	log_level: info
+//	rate_limit: 10/m
+//	rate_limit_burst: 20
+//	rate_limit_routes:
+//	  - POST /courses
+//	  - PUT /courses/{id}
+//
+// A variable set in the environment wins over the file, and a flag
+// (config.go) over both. The file is read
+// and checked at startup, where an unknown key or a bad value stops the
+// process like a bad variable does. It is read again on SIGHUP, and when
+// it changes, checked every few seconds. A reload applies the log level
+// and the rate limits; the listen address and the store are fixed once
+// the server runs, so changing them only logs that a restart is needed.
+// A file that no longer parses, or holds a bad value, is logged and the
+// running settings are kept.
+
+// configCheckInterval is how often CONFIG_FILE is checked for changes.
+const configCheckInterval = 5 * time.Second
+
+var configFile = os.Getenv("CONFIG_FILE")
+
+// configKeys are the settings CONFIG_FILE may hold, with whether a reload
+// applies them.
+var configKeys = map[string]bool{
+	"port":              false,
+	"bind_addr":         false,
+	"store":             false,
+	"store_dsn":         false,
+	"seed_file":         false,
+	"log_level":         true,
+	"rate_limit":        true,
+	"rate_limit_burst":  true,
+	"rate_limit_routes": true,
+}
+
+var (
+	// configMu protects fileSettings, the settings last read from
+	// CONFIG_FILE, and configModTime, the file's time then.
+	configMu      sync.Mutex
+	fileSettings  map[string]string
+	configModTime time.Time
+	configOnce    sync.Once
+)
+
+// configSetting returns the setting of variable env: its value in the
+// environment if it is set there, or else in CONFIG_FILE.
+func configSetting(env string) string {
+	configOnce.Do(loadConfigFile)
+	if v := os.Getenv(env); v != "" {
+		return v
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	return fileSettings[strings.ToLower(env)]
+}
+
+// loadConfigFile reads CONFIG_FILE at startup. The logger is set up
+// before any file can be read, so it takes the file's log level here.
+func loadConfigFile() {
+	if configFile == "" {
+		return
+	}
+	settings, modTime, err := readConfigFile(configFile)
+	if err != nil {
+		log.Fatalf("Invalid CONFIG_FILE %s: %v", configFile, err)
+	}
+	configMu.Lock()
+	fileSettings, configModTime = settings, modTime
+	configMu.Unlock()
+	if os.Getenv("LOG_LEVEL") == "" && settings["log_level"] != "" {
+		level, err := parseLogLevel(settings["log_level"])
+		if err != nil {
+			log.Fatalf("Invalid log_level in CONFIG_FILE %s: %v", configFile, err)
+		}
+		logLevel.Set(level)
+	}
+}
+
+// readConfigFile reads the settings of the YAML file name, as strings. A
+// reload runs in the watcher goroutine, so a panic in the YAML reader is
+// returned as an error too, rather than taking the server down over a
+// bad edit.
+func readConfigFile(name string) (_ map[string]string, _ time.Time, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("cannot parse the file: %v", p)
+		}
+	}()
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var raw map[string]any
+	if err := unmarshalYAML(data, &raw); err != nil {
+		return nil, time.Time{}, err
+	}
+	settings := map[string]string{}
+	for key, v := range raw {
+		if _, ok := configKeys[key]; !ok {
+			return nil, time.Time{}, fmt.Errorf("unknown setting %q; known: %s", key, strings.Join(slices.Sorted(maps.Keys(configKeys)), ", "))
+		}
+		s, err := configValue(v)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("%s: %v", key, err)
+		}
+		settings[key] = s
+	}
+	return settings, fi.ModTime(), nil
+}
+
+// configValue returns v, a YAML value, as the variable for it would be
+// written: lists joined with commas.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []any:
+		var parts []string
+		for _, item := range v {
+			if _, isList := item.([]any); isList {
+				return "", fmt.Errorf("lists cannot be nested")
+			}
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("want a value or a list of values, not a mapping")
+}
+
+// watchConfigFile reloads CONFIG_FILE on SIGHUP and when it changes.
+func watchConfigFile(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	tick := time.NewTicker(interval)
+	for {
+		select {
+		case <-hup:
+			reloadConfigFile("SIGHUP")
+		case <-tick.C:
+			fi, err := os.Stat(configFile)
+			configMu.Lock()
+			changed := err == nil && !fi.ModTime().Equal(configModTime)
+			configMu.Unlock()
+			if changed {
+				reloadConfigFile("file changed")
+			}
+		}
+	}
+}
+
+// reloadConfigFile reads CONFIG_FILE again and applies what may change
+// while the server runs, all of it or, if any of it is bad, none.
+func reloadConfigFile(why string) {
+	settings, modTime, err := readConfigFile(configFile)
+	configMu.Lock()
+	old := fileSettings
+	if err == nil {
+		configModTime = modTime
+	} else if fi, statErr := os.Stat(configFile); statErr == nil {
+		// Not again until it changes once more.
+		configModTime = fi.ModTime()
+	}
+	configMu.Unlock()
+	if err != nil {
+		slog.Error("Keeping the previous settings", "file", configFile, "reason", why, "err", err)
+		return
+	}
+	// What the file now says, with what the environment overrides.
+	effective := func(key string) string {
+		if v := os.Getenv(strings.ToUpper(key)); v != "" {
+			return v
+		}
+		return settings[key]
+	}
+	var changed, restart []string
+	for _, key := range slices.Sorted(maps.Keys(configKeys)) {
+		if settings[key] == old[key] {
+			continue
+		}
+		if os.Getenv(strings.ToUpper(key)) != "" {
+			continue
+		}
+		if configKeys[key] {
+			changed = append(changed, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+
+	level := slog.LevelInfo
+	if s := effective("log_level"); s != "" {
+		if level, err = parseLogLevel(s); err != nil {
+			slog.Error("Keeping the previous settings", "file", configFile, "reason", why, "err", fmt.Errorf("log_level: %v", err))
+			return
+		}
+	}
+	limits, err := newRateLimits(effective("rate_limit"), effective("rate_limit_burst"), effective("rate_limit_routes"))
+	if err != nil {
+		slog.Error("Keeping the previous settings", "file", configFile, "reason", why, "err", err)
+		return
+	}
+
+	configMu.Lock()
+	fileSettings = settings
+	configMu.Unlock()
+	logLevel.Set(level)
+	if slices.ContainsFunc(changed, func(key string) bool { return strings.HasPrefix(key, "rate_limit") }) {
+		rateLimits.Store(limits)
+	}
+	if len(restart) > 0 {
+		slog.Warn("Restart to apply the changed settings", "file", configFile, "settings", strings.Join(restart, ","))
+	}
+	slog.Info("Reloaded the config file", "file", configFile, "reason", why, "changed", strings.Join(changed, ","))
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: อ่านค่าตั้งจากไฟล์ YAML (`CONFIG_FILE`) และ reload ได้โดยไม่ต้อง restart
+
+	1. key ในไฟล์คือชื่อตัวแปร env ตัวพิมพ์เล็ก: `port`, `bind_addr`, `store`, `store_dsn`, `seed_file`, `log_level`, `rate_limit`, `rate_limit_burst`, `rate_limit_routes` (เป็น list ได้)
+	2. env ที่ตั้งไว้ชนะค่าในไฟล์เสมอ และ flag (`-addr`, `-store`, `-store-dsn`, `-seed`) ชนะทั้งสองอย่าง
+	3. ตอน start ไฟล์ที่ parse ไม่ได้, key ที่ไม่รู้จัก หรือค่าผิด ทำให้ process ไม่ start เหมือนตั้ง env ผิด
+	4. reload เมื่อได้ SIGHUP หรือเวลาแก้ไขไฟล์เปลี่ยน (เช็คทุก 5 วินาที)
+	   - ใช้ค่าใหม่ของ log level และ rate limit ทันที
+	   - address ที่ฟังและ store เปลี่ยนไม่ได้ขณะรัน จะ log เตือนให้ restart
+	   - ไฟล์ใหม่ผิดรูปแบบหรือค่าผิด log error แล้วใช้ค่าเดิมต่อทั้งหมด
+	5. ไม่รองรับ TOML เพราะ stdlib ไม่มี parser ใช้ YAML subset ของ `yaml.go`
+*/
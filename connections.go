@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keep-alive connections that live for hours pin clients to whichever
+// instances were up when they connected, so after a deploy or a scale-out
+// the new instances sit idle. With HTTP_MAX_CONNECTION_AGE set, a
+// connection older than that, give or take 10% so they do not all go at
+// once, is retired:
+//
+//   - the next response on it says Connection: close, which for HTTP/1.1
+//     closes it after the response and for HTTP/2 sends GOAWAY, so the
+//     client finishes its streams and reconnects, through the load
+//     balancer, for the next request;
+//   - if it is idle it is closed, by a sweep every few seconds;
+//   - with HTTP_MAX_CONNECTION_AGE_GRACE set, it is closed that long
+//     after it was due, whatever is still running on it, so a stream
+//     such as /events cannot keep it forever.
+//
+// Either way clients see what they see at an idle timeout, which every
+// HTTP client recovers from. Leave it unset to keep connections for as
+// long as HTTP_IDLE_TIMEOUT (httpserver.go) allows.
+//
+// /metrics has the ages connections reach, how many requests each serves
+// and how many requests reuse a connection, for all listeners together:
+//
+//   - http_connections_open and http_connection_oldest_age_seconds;
+//   - http_connections_opened_total and http_connections_closed_total by
+//     reason: max_age, culled, grace, hijacked (WebSockets) or other
+//     (the client, an idle timeout or an error);
+//   - http_connection_age_seconds and http_connection_requests,
+//     histograms taken as connections close;
+//   - http_connection_reused_requests_total, requests that were not the
+//     first on their connection; divided by http_requests_total it is the
+//     reuse rate.
+
+var (
+	maxConnectionAge      time.Duration
+	maxConnectionAgeGrace time.Duration
+)
+
+// connSweepInterval is how often retired idle connections are closed.
+const connSweepInterval = 5 * time.Second
+
+func init() {
+	for _, v := range []struct {
+		env string
+		d   *time.Duration
+	}{{"HTTP_MAX_CONNECTION_AGE", &maxConnectionAge}, {"HTTP_MAX_CONNECTION_AGE_GRACE", &maxConnectionAgeGrace}} {
+		if s := os.Getenv(v.env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				log.Fatalf("Invalid %s %q: must be a duration, 0 for none", v.env, s)
+			}
+			*v.d = d
+		}
+	}
+	if maxConnectionAgeGrace > 0 && maxConnectionAge == 0 {
+		log.Fatal("HTTP_MAX_CONNECTION_AGE_GRACE needs HTTP_MAX_CONNECTION_AGE")
+	}
+}
+
+// Why connections close, for http_connections_closed_total.
+const (
+	connClosedMaxAge   = "max_age"
+	connClosedCulled   = "culled"
+	connClosedGrace    = "grace"
+	connClosedHijacked = "hijacked"
+	connClosedOther    = "other"
+)
+
+var connCloseReasons = []string{connClosedMaxAge, connClosedCulled, connClosedGrace, connClosedHijacked, connClosedOther}
+
+type trackedConn struct {
+	conn     net.Conn
+	opened   time.Time
+	due      time.Time // zero without a maximum age
+	requests atomic.Int64
+	state    atomic.Int32 // http.ConnState
+	reason   atomic.Value // string, set when the server retires it
+}
+
+// connAgeBuckets and connRequestBuckets are the upper bounds of the
+// connection histograms.
+var (
+	connAgeBuckets     = []float64{1, 10, 60, 300, 900, 1800, 3600, 7200, 21600, 86400}
+	connRequestBuckets = []float64{1, 2, 5, 10, 50, 100, 500, 1000}
+)
+
+var (
+	// connMu protects conns and the histograms below.
+	connMu          sync.Mutex
+	conns           = map[net.Conn]*trackedConn{}
+	connAgeHist     = make([]uint64, len(connAgeBuckets))
+	connAgeSum      float64
+	connRequestHist = make([]uint64, len(connRequestBuckets))
+	connRequestSum  int64
+	connsClosed     = map[string]uint64{}
+
+	connsOpened    atomic.Uint64
+	reusedRequests atomic.Uint64
+	connSweepOnce  sync.Once
+)
+
+type connContextKey struct{}
+
+// trackConnections has srv count and retire its connections.
+func trackConnections(srv *http.Server) {
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		tc := &trackedConn{conn: c, opened: time.Now()}
+		if maxConnectionAge > 0 {
+			jitter := time.Duration((rand.Float64()*0.2 - 0.1) * float64(maxConnectionAge))
+			tc.due = tc.opened.Add(maxConnectionAge + jitter)
+		}
+		connMu.Lock()
+		conns[c] = tc
+		connMu.Unlock()
+		connsOpened.Add(1)
+		return context.WithValue(ctx, connContextKey{}, tc)
+	}
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		connMu.Lock()
+		defer connMu.Unlock()
+		tc := conns[c]
+		if tc == nil {
+			return
+		}
+		tc.state.Store(int32(state))
+		switch state {
+		case http.StateClosed:
+			reason, _ := tc.reason.Load().(string)
+			if reason == "" {
+				reason = connClosedOther
+			}
+			closeTrackedConn(tc, reason)
+		case http.StateHijacked:
+			closeTrackedConn(tc, connClosedHijacked)
+		}
+	}
+	srv.Handler = connectionHandler(srv.Handler)
+	if maxConnectionAge > 0 {
+		connSweepOnce.Do(func() { go sweepConnections(connSweepInterval) })
+	}
+}
+
+// closeTrackedConn stops tracking tc and records its age and requests.
+// Callers hold connMu.
+func closeTrackedConn(tc *trackedConn, reason string) {
+	delete(conns, tc.conn)
+	age := time.Since(tc.opened).Seconds()
+	requests := tc.requests.Load()
+	connsClosed[reason]++
+	connAgeSum += age
+	connRequestSum += requests
+	for i, le := range connAgeBuckets {
+		if age <= le {
+			connAgeHist[i]++
+		}
+	}
+	for i, le := range connRequestBuckets {
+		if float64(requests) <= le {
+			connRequestHist[i]++
+		}
+	}
+}
+
+// connectionHandler counts each request against its connection, and
+// retires the connection with the response once it is due.
+func connectionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tc, ok := r.Context().Value(connContextKey{}).(*trackedConn); ok {
+			if tc.requests.Add(1) > 1 {
+				reusedRequests.Add(1)
+			}
+			if !tc.due.IsZero() && time.Now().After(tc.due) {
+				tc.reason.CompareAndSwap(nil, connClosedMaxAge)
+				w.Header().Set("Connection", "close")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sweepConnections closes, every interval, the idle connections that are
+// due and, with a grace period, those past it.
+func sweepConnections(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		var closing []*trackedConn
+		connMu.Lock()
+		for _, tc := range conns {
+			switch {
+			case tc.due.IsZero() || now.Before(tc.due):
+			case maxConnectionAgeGrace > 0 && now.After(tc.due.Add(maxConnectionAgeGrace)):
+				tc.reason.CompareAndSwap(nil, connClosedGrace)
+				closing = append(closing, tc)
+			case http.ConnState(tc.state.Load()) == http.StateIdle:
+				tc.reason.CompareAndSwap(nil, connClosedCulled)
+				closing = append(closing, tc)
+			}
+		}
+		connMu.Unlock()
+		// Closing runs the StateClosed hook, which takes connMu.
+		for _, tc := range closing {
+			tc.conn.Close()
+		}
+	}
+}
+
+func writeConnectionMetrics(b *strings.Builder) {
+	connMu.Lock()
+	defer connMu.Unlock()
+	var oldest float64
+	for _, tc := range conns {
+		oldest = max(oldest, time.Since(tc.opened).Seconds())
+	}
+	closed := uint64(0)
+	for _, n := range connsClosed {
+		closed += n
+	}
+	fmt.Fprintf(b, "# HELP http_connections_open Client connections open now.\n# TYPE http_connections_open gauge\nhttp_connections_open %d\n", len(conns))
+	fmt.Fprintf(b, "# HELP http_connection_oldest_age_seconds Age of the oldest open connection.\n# TYPE http_connection_oldest_age_seconds gauge\nhttp_connection_oldest_age_seconds %s\n", strconv.FormatFloat(oldest, 'f', 3, 64))
+	fmt.Fprintf(b, "# HELP http_connections_opened_total Client connections accepted.\n# TYPE http_connections_opened_total counter\nhttp_connections_opened_total %d\n", connsOpened.Load())
+	fmt.Fprint(b, "# HELP http_connections_closed_total Client connections closed, by reason.\n# TYPE http_connections_closed_total counter\n")
+	for _, reason := range connCloseReasons {
+		fmt.Fprintf(b, "http_connections_closed_total{reason=%q} %d\n", reason, connsClosed[reason])
+	}
+	writeHistogram(b, "http_connection_age_seconds", "Age of connections when they closed.", connAgeBuckets, connAgeHist, strconv.FormatFloat(connAgeSum, 'g', -1, 64), closed)
+	writeHistogram(b, "http_connection_requests", "Requests served on connections when they closed.", connRequestBuckets, connRequestHist, strconv.FormatInt(connRequestSum, 10), closed)
+	fmt.Fprintf(b, "# HELP http_connection_reused_requests_total Requests that were not the first on their connection.\n# TYPE http_connection_reused_requests_total counter\nhttp_connection_reused_requests_total %d\n", reusedRequests.Load())
+}
+
+// writeHistogram writes an unlabelled histogram whose cumulative bucket
+// counts are hist.
+func writeHistogram(b *strings.Builder, name, help string, buckets []float64, hist []uint64, sum string, count uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, le := range buckets {
+		fmt.Fprintf(b, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), hist[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, count, name, sum, name, count)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: จำกัดอายุ connection เพื่อให้ load balancer กระจาย traffic ใหม่ได้หลัง deploy พร้อม metric ของ connection
+
+	1. ตั้ง `HTTP_MAX_CONNECTION_AGE` แล้ว connection ที่อายุเกิน (บวกลบ 10% กันหลุดพร้อมกัน) จะถูกปลด
+	   - response ถัดไปบน connection นั้นมี `Connection: close` HTTP/1.1 ปิดหลังตอบ ส่วน HTTP/2 ส่ง GOAWAY ให้ client ต่อใหม่
+	   - ถ้า connection ว่างอยู่ ตัว sweep (ทุก 5 วินาที) ปิดให้เลย
+	   - `HTTP_MAX_CONNECTION_AGE_GRACE` ปิดทิ้งเมื่อเลยกำหนดไปเท่านี้ แม้ยังมี stream ค้างอยู่ (เช่น `/events`)
+	2. ไม่ตั้งก็ยังนับ metric ตามปกติ และ connection อยู่ได้ตาม `HTTP_IDLE_TIMEOUT`
+	3. metric ที่ `/metrics`: จำนวนที่เปิดอยู่, อายุตัวที่เก่าสุด, จำนวนที่เปิด/ปิด (แยกเหตุผล), histogram อายุและจำนวน request ต่อ connection, จำนวน request ที่ใช้ connection ซ้ำ
+	4. ผูกกับทุก server ผ่าน `withServerLimits` (`ConnContext`, `ConnState` และ handler ที่นับ request)
+*/
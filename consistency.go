@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The catalog in CourseList is the primary store; everything else about
+// courses is derived from it as it changes, by recordChange and the
+// course service. A bug or a write that failed halfway can leave one of
+// them behind, so the consistency check compares each with the catalog:
+//
+//	search_index   the metadata index (search.go) holds exactly each course's metadata
+//	change_feed    every course, and no deleted one, is live in the change records (changes.go)
+//	rosters        rosters and invites belong to courses, and no seat is free while someone waits
+//	course_file    with STORE=file, the file (config.go) holds the catalog as it is
+//	catalog_cache  with -cache, no response was cached before the latest change (proxy.go)
+//
+// It runs in the background at startup and whenever an admin asks:
+//
+//	GET  /admin/consistency  the last reports, newest first
+//	POST /admin/consistency  start a check now; 202, or 409 while one runs
+//
+// A check first looks with the catalog locked for reading, so requests
+// keep being served, and only if something differs takes the write lock
+// and rebuilds the parts that still differ. Each report says how many
+// parts were checked, found divergent and repaired, with examples, and
+// /metrics has the same numbers. A proxy in front of -upstream holds no
+// data of its own and does not check.
+
+// consistencyCheck compares one derived piece with the catalog. run
+// returns how many parts it looked at and which differ; with repair, it
+// rebuilds those. Callers hold courseMu, for writing when repairing.
+type consistencyCheck struct {
+	name string
+	run  func(repair bool) (checked int, divergent []string)
+}
+
+// consistencyChecks are the checks that apply to this instance.
+func consistencyChecks() []consistencyCheck {
+	checks := []consistencyCheck{
+		{"search_index", checkSearchIndex},
+		{"change_feed", checkChangeFeed},
+		{"rosters", checkRosters},
+	}
+	if storeType == storeFile {
+		checks = append(checks, consistencyCheck{"course_file", checkCourseFile})
+	}
+	if activeCatalogCache != nil {
+		checks = append(checks, consistencyCheck{"catalog_cache", checkCatalogCache})
+	}
+	return checks
+}
+
+const (
+	maxConsistencyReports  = 20
+	maxConsistencyExamples = 20
+)
+
+type consistencyResult struct {
+	Check     string   `json:"check"`
+	Checked   int      `json:"checked"`
+	Divergent int      `json:"divergent"`
+	Repaired  int      `json:"repaired"`
+	Examples  []string `json:"examples,omitempty"` // some of the divergent parts
+}
+
+type consistencyReport struct {
+	ID         int                 `json:"id"`
+	Trigger    string              `json:"trigger"` // "startup", or the admin who asked
+	StartedAt  time.Time           `json:"started_at"`
+	FinishedAt time.Time           `json:"finished_at"`
+	Consistent bool                `json:"consistent"` // nothing was divergent
+	Results    []consistencyResult `json:"results"`
+}
+
+var (
+	// consistencyMu protects the reports, newest last, and the totals.
+	consistencyMu         sync.Mutex
+	consistencyReports    []consistencyReport
+	nextConsistencyReport = 1
+	consistencyRunning    bool
+	consistencyDivergent  = map[string]uint64{}
+	consistencyRepaired   = map[string]uint64{}
+
+	// consistencyEnabled is set when the instance owns its data.
+	consistencyEnabled bool
+)
+
+// startConsistencyCheck runs a check in the background for trigger. It
+// returns false if one is running already.
+func startConsistencyCheck(trigger string) bool {
+	consistencyMu.Lock()
+	defer consistencyMu.Unlock()
+	if consistencyRunning {
+		return false
+	}
+	consistencyRunning = true
+	go runConsistencyCheck(trigger)
+	return true
+}
+
+func runConsistencyCheck(trigger string) {
+	report := consistencyReport{Trigger: trigger, StartedAt: time.Now().UTC(), Consistent: true}
+	for _, check := range consistencyChecks() {
+		courseMu.RLock()
+		checked, divergent := check.run(false)
+		courseMu.RUnlock()
+		res := consistencyResult{Check: check.name, Checked: checked, Divergent: len(divergent)}
+		if len(divergent) > 0 {
+			res.Examples = divergent[:min(len(divergent), maxConsistencyExamples)]
+			// What differed may have been put right by a write meanwhile;
+			// the second pass repairs what still differs.
+			courseMu.Lock()
+			_, repaired := check.run(true)
+			courseMu.Unlock()
+			res.Repaired = len(repaired)
+			report.Consistent = false
+			slog.Warn("Consistency check found divergent data", "check", check.name, "divergent", res.Divergent, "repaired", res.Repaired, "examples", strings.Join(res.Examples, ", "))
+		}
+		report.Results = append(report.Results, res)
+	}
+	report.FinishedAt = time.Now().UTC()
+
+	consistencyMu.Lock()
+	defer consistencyMu.Unlock()
+	report.ID = nextConsistencyReport
+	nextConsistencyReport++
+	consistencyReports = append(consistencyReports, report)
+	if len(consistencyReports) > maxConsistencyReports {
+		consistencyReports = consistencyReports[1:]
+	}
+	for _, res := range report.Results {
+		consistencyDivergent[res.Check] += uint64(res.Divergent)
+		consistencyRepaired[res.Check] += uint64(res.Repaired)
+	}
+	consistencyRunning = false
+	slog.Info("Consistency check done", "trigger", trigger, "consistent", report.Consistent, "took", report.FinishedAt.Sub(report.StartedAt))
+}
+
+// checkSearchIndex compares the metadata index with each course's
+// metadata, in both directions, and reindexes the courses that differ.
+func checkSearchIndex(repair bool) (int, []string) {
+	divergent := map[int]bool{}
+	live := map[int]bool{}
+	for _, c := range CourseList {
+		live[c.CourseId] = true
+		want := make(map[string]string, len(c.Metadata))
+		for k, v := range c.Metadata {
+			want[k] = metadataIndexValue(v)
+		}
+		if !maps.Equal(want, indexedMetadata[c.CourseId]) {
+			divergent[c.CourseId] = true
+			continue
+		}
+		for k, v := range want {
+			if !metadataIndex[k][v][c.CourseId] {
+				divergent[c.CourseId] = true
+			}
+		}
+	}
+	for id := range indexedMetadata {
+		if !live[id] {
+			divergent[id] = true
+		}
+	}
+	for k, values := range metadataIndex {
+		for v, ids := range values {
+			for id := range ids {
+				if got, ok := indexedMetadata[id][k]; !ok || got != v {
+					divergent[id] = true
+				}
+			}
+		}
+	}
+	if repair {
+		for id := range divergent {
+			dropIndexPostings(id)
+			reindexMetadata(id)
+		}
+	}
+	return len(CourseList), courseParts(divergent)
+}
+
+// dropIndexPostings takes course id out of the metadata index wherever it
+// is, whatever indexedMetadata says it contributed.
+func dropIndexPostings(id int) {
+	for k, values := range metadataIndex {
+		for v, ids := range values {
+			delete(ids, id)
+			if len(ids) == 0 {
+				delete(values, v)
+			}
+		}
+		if len(values) == 0 {
+			delete(metadataIndex, k)
+		}
+	}
+	delete(indexedMetadata, id)
+}
+
+// checkChangeFeed finds courses the change records have as deleted or
+// not at all, and deleted courses they have as live, and records the
+// missing change, which also tells the live feeds and webhooks.
+func checkChangeFeed(repair bool) (int, []string) {
+	divergent := map[int]bool{}
+	live := map[int]bool{}
+	for _, c := range CourseList {
+		live[c.CourseId] = true
+		if rec := changeRecords[c.CourseId]; rec == nil || rec.deleted {
+			divergent[c.CourseId] = true
+		}
+	}
+	for id, rec := range changeRecords {
+		if !rec.deleted && !live[id] {
+			divergent[id] = true
+		}
+	}
+	if repair {
+		for _, id := range slices.Sorted(maps.Keys(divergent)) {
+			recordChange(id, !live[id], traceContext{})
+		}
+	}
+	return len(CourseList) + len(changeRecords), courseParts(divergent)
+}
+
+// checkRosters finds rosters and invite lists of courses that are gone,
+// and rosters with a waitlist while seats are free, dropping the former
+// and promoting the latter.
+func checkRosters(repair bool) (int, []string) {
+	divergent := map[int]bool{}
+	for id, roster := range enrollments {
+		i := findCourseIndex(id)
+		switch {
+		case i < 0:
+			divergent[id] = true
+		case len(roster.waitlist) > 0 && (CourseList[i].Seats == 0 || len(roster.enrolled) < CourseList[i].Seats):
+			divergent[id] = true
+			if repair {
+				roster.promote(CourseList[i])
+			}
+		}
+	}
+	for id := range courseInvites {
+		if findCourseIndex(id) < 0 {
+			divergent[id] = true
+		}
+	}
+	if repair {
+		for id := range divergent {
+			if findCourseIndex(id) < 0 {
+				delete(enrollments, id)
+				delete(courseInvites, id)
+			}
+		}
+	}
+	return len(enrollments) + len(courseInvites), courseParts(divergent)
+}
+
+// checkCourseFile compares the course file with the catalog, and writes
+// it again if they differ.
+func checkCourseFile(repair bool) (int, []string) {
+	want, _ := json.MarshalIndent(CourseList, "", "  ")
+	if got, err := os.ReadFile(courseFile); err == nil && bytes.Equal(got, want) {
+		return 1, nil
+	}
+	if repair {
+		if err := writeCourseFile(); err != nil {
+			slog.Error("Error saving courses", "file", courseFile, "err", err)
+			return 1, nil
+		}
+	}
+	return 1, []string{courseFile}
+}
+
+// checkCatalogCache drops the cached catalog responses older than the
+// latest change, which a write that did not pass through the cache, by
+// gRPC for one, leaves behind.
+func checkCatalogCache(repair bool) (int, []string) {
+	return activeCatalogCache.storedBefore(lastChangeAt, repair)
+}
+
+// courseParts names the courses of ids in a report, in ID order.
+func courseParts(ids map[int]bool) []string {
+	var parts []string
+	for _, id := range slices.Sorted(maps.Keys(ids)) {
+		parts = append(parts, fmt.Sprintf("course %d", id))
+	}
+	return parts
+}
+
+// adminConsistencyHandler serves GET and POST /admin/consistency.
+func adminConsistencyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		consistencyMu.Lock()
+		reports := slices.Clone(consistencyReports)
+		running := consistencyRunning
+		consistencyMu.Unlock()
+		slices.Reverse(reports)
+		if reports == nil {
+			reports = []consistencyReport{}
+		}
+		writeValue(w, r, http.StatusOK, map[string]any{"running": running, "reports": reports})
+
+	case http.MethodPost:
+		if !consistencyEnabled {
+			writeError(w, r, "This instance proxies another and has no data of its own to check", http.StatusConflict)
+			return
+		}
+		who := operatorPrincipal(r)
+		if !startConsistencyCheck(who.Subject) {
+			writeError(w, r, "A consistency check is already running", http.StatusConflict)
+			return
+		}
+		requestLogger(r).Info("Consistency check started", "subject", who.Subject)
+		writeValue(w, r, http.StatusAccepted, map[string]any{"running": true})
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeConsistencyMetrics(b *strings.Builder) {
+	consistencyMu.Lock()
+	defer consistencyMu.Unlock()
+	var last *consistencyReport
+	if n := len(consistencyReports); n > 0 {
+		last = &consistencyReports[n-1]
+	}
+	fmt.Fprintf(b, "# HELP consistency_checks_total Consistency checks run.\n# TYPE consistency_checks_total counter\nconsistency_checks_total %d\n", nextConsistencyReport-1)
+	if last == nil {
+		return
+	}
+	fmt.Fprintf(b, "# HELP consistency_last_check_timestamp_seconds When the last consistency check finished.\n# TYPE consistency_last_check_timestamp_seconds gauge\nconsistency_last_check_timestamp_seconds %d\n", last.FinishedAt.Unix())
+	fmt.Fprint(b, "# HELP consistency_divergent Parts the last consistency check found divergent, by check.\n# TYPE consistency_divergent gauge\n")
+	for _, res := range last.Results {
+		fmt.Fprintf(b, "consistency_divergent{check=%q} %d\n", res.Check, res.Divergent)
+	}
+	fmt.Fprint(b, "# HELP consistency_divergent_total Parts found divergent, by check.\n# TYPE consistency_divergent_total counter\n")
+	for _, check := range slices.Sorted(maps.Keys(consistencyDivergent)) {
+		fmt.Fprintf(b, "consistency_divergent_total{check=%q} %d\n", check, consistencyDivergent[check])
+	}
+	fmt.Fprint(b, "# HELP consistency_repaired_total Parts rebuilt, by check.\n# TYPE consistency_repaired_total counter\n")
+	for _, check := range slices.Sorted(maps.Keys(consistencyRepaired)) {
+		fmt.Fprintf(b, "consistency_repaired_total{check=%q} %d\n", check, consistencyRepaired[check])
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ตรวจว่าข้อมูลที่สร้างต่อจาก catalog (index, change feed, roster, ไฟล์, cache) ยังตรงกับ store หลัก และซ่อมส่วนที่เพี้ยนใน background
+
+	1. สิ่งที่ตรวจ
+	   - `search_index` index ของ metadata ตรงกับ metadata ของแต่ละ course ทั้งสองทาง
+	   - `change_feed` course ที่มีอยู่ต้องไม่ถูกบันทึกว่าลบแล้ว และ course ที่ลบแล้วต้องไม่ค้างว่ายังอยู่
+	   - `rosters` roster/invite ของ course ที่ไม่มีแล้ว และ waitlist ที่รอทั้งที่ยังมีที่ว่าง
+	   - `course_file` (เฉพาะ `STORE=file`) เนื้อไฟล์ตรงกับ catalog
+	   - `catalog_cache` (เฉพาะ `-cache`) response ที่ cache ไว้ก่อนการเปลี่ยนแปลงล่าสุด
+	2. รันเองตอน start และสั่งได้ที่ `POST /admin/consistency` (202, หรือ 409 ถ้ากำลังรันอยู่); `GET` ดูรายงานล่าสุด 20 ครั้ง
+	3. รอบแรกดูด้วย read lock ไม่บล็อก request; ถ้าเจอส่วนที่เพี้ยนค่อยล็อกเขียนแล้วตรวจซ้ำและซ่อมเฉพาะที่ยังเพี้ยน
+	4. รายงานบอกจำนวนที่ตรวจ / เพี้ยน / ซ่อม พร้อมตัวอย่าง และมี metric `consistency_*` ที่ `/metrics`
+	5. โหมด proxy (`-upstream`) ไม่มีข้อมูลของตัวเองจึงไม่ตรวจ
+*/
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS lets browser apps served from other origins call the API. It is off
+// until CORS_ALLOWED_ORIGINS lists the origins, comma-separated, such as
+// "https://app.example.com,https://*.example.org"; a * in the host covers
+// its subdomains, and "*" alone any origin. The rest have defaults that fit
+// the course API:
+//
+//	CORS_ALLOWED_METHODS  GET, HEAD, POST, PUT, PATCH, DELETE
+//	CORS_ALLOWED_HEADERS  the request headers the handlers read
+//	CORS_EXPOSED_HEADERS  the response headers clients need, such as ETag
+//	CORS_MAX_AGE          how long a browser may cache a preflight (10m)
+//
+// Responses never allow credentials, so a cross-origin app authenticates
+// with a bearer token or an API key, not the session cookie, and the
+// CSRF checks stay as they are.
+
+var (
+	corsOrigins []string // nil when CORS is off
+	corsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	corsHeaders = []string{"Accept", "Authorization", "Content-Type", "If-Match", "If-None-Match",
+		apiKeyHeader, inviteCodeHeader, userEmailHeader, requestIDHeader,
+		traceparentHeader, tracestateHeader}
+	corsExposed = []string{"ETag", "Link", "Location", "Retry-After", "X-Total-Count", requestIDHeader, traceIDHeader,
+		impersonatedByHeader, impersonationExpiresHeader}
+	corsMaxAge = 10 * time.Minute
+)
+
+func init() {
+	corsOrigins = corsList(os.Getenv("CORS_ALLOWED_ORIGINS"))
+	for _, o := range corsOrigins {
+		if o != "*" && !strings.HasPrefix(o, "http://") && !strings.HasPrefix(o, "https://") {
+			log.Fatalf("Invalid CORS_ALLOWED_ORIGINS entry %q: want scheme://host[:port] or *", o)
+		}
+	}
+	if list := corsList(os.Getenv("CORS_ALLOWED_METHODS")); list != nil {
+		for i := range list {
+			list[i] = strings.ToUpper(list[i])
+		}
+		corsMethods = list
+	}
+	if list := corsList(os.Getenv("CORS_ALLOWED_HEADERS")); list != nil {
+		corsHeaders = list
+	}
+	if list := corsList(os.Getenv("CORS_EXPOSED_HEADERS")); list != nil {
+		corsExposed = list
+	}
+	if v := os.Getenv("CORS_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid CORS_MAX_AGE %q: must be a duration", v)
+		}
+		corsMaxAge = d
+	}
+}
+
+func corsList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// corsOriginAllowed reports whether origin is one of corsOrigins.
+func corsOriginAllowed(origin string) bool {
+	for _, o := range corsOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+		// "https://*.example.org" covers "https://a.example.org", not
+		// "https://example.org" or "https://evil-example.org".
+		if scheme, host, ok := strings.Cut(o, "://*."); ok {
+			prefix := scheme + "://"
+			if len(origin) > len(prefix) && strings.EqualFold(origin[:len(prefix)], prefix) &&
+				strings.HasSuffix(strings.ToLower(origin), "."+strings.ToLower(host)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// corsHandler adds the CORS headers for allowed origins and answers
+// preflight requests itself, before they reach authentication.
+func corsHandler(next http.Handler) http.Handler {
+	if corsOrigins == nil {
+		return next
+	}
+	allowAny := slices.Contains(corsOrigins, "*")
+	methods := strings.Join(corsMethods, ", ")
+	exposed := strings.Join(corsExposed, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		if !allowAny {
+			h.Add("Vary", "Origin")
+		}
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" || !corsOriginAllowed(origin) {
+			if preflight {
+				// Without the headers the browser refuses the request.
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allowAny {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if !preflight {
+			if exposed != "" {
+				h.Set("Access-Control-Expose-Headers", exposed)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if !slices.Contains(corsMethods, r.Header.Get("Access-Control-Request-Method")) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		for _, name := range corsList(r.Header.Get("Access-Control-Request-Headers")) {
+			if !slices.ContainsFunc(corsHeaders, func(a string) bool { return strings.EqualFold(a, name) }) {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		h.Set("Access-Control-Allow-Methods", methods)
+		h.Set("Access-Control-Allow-Headers", strings.Join(corsHeaders, ", "))
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: เปิด CORS ให้ SPA ที่อยู่คนละ domain เรียก `/courses` จาก browser ได้ ตั้งค่าผ่าน env
+
+	1. ปิดอยู่จนกว่าจะตั้ง `CORS_ALLOWED_ORIGINS=https://app.example.com,https://*.example.org` (`*` ตัวเดียว = ทุก origin)
+	   - `*.` หน้า host ครอบคลุม subdomain แต่ไม่รวมตัว domain เอง
+	2. preflight (`OPTIONS` + `Access-Control-Request-Method`) ตอบ 204 ทันที ก่อนถึง auth/CSRF/rate limit
+	   - method และ header ที่ขอต้องอยู่ใน `CORS_ALLOWED_METHODS` / `CORS_ALLOWED_HEADERS` ถึงจะได้ header อนุญาต
+	   - `CORS_MAX_AGE` (ค่าเริ่มต้น 10m) บอก browser ว่า cache ผล preflight ได้นานแค่ไหน
+	3. request จริงจาก origin ที่อนุญาตได้ `Access-Control-Allow-Origin` และ `Access-Control-Expose-Headers` (`ETag`, `Link`, ...)
+	4. ไม่ส่ง `Access-Control-Allow-Credentials` → ฝั่ง SPA ใช้ bearer token หรือ API key ไม่ใช่ cookie session
+*/
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Panics in handlers are caught by recoverHandler, which answers 500 and
+// hands the crash to crashReporter. SENTRY_DSN enables the built-in
+// reporter for Sentry and Sentry-compatible services (GlitchTip, Bugsink);
+// CRASH_SAMPLE_RATE (0 to 1, default 1) reports only a share of crashes.
+// RELEASE names the running version; without it the VCS revision the
+// binary was built from is used.
+
+// crashReport is what a reporter gets. The request has already been
+// scrubbed of personal data and secrets.
+type crashReport struct {
+	Time      time.Time
+	Message   string
+	Frames    []runtime.Frame // innermost first
+	Release   string
+	RequestID string
+	TraceID   string
+	Method    string
+	URL       string
+	Route     string
+	Headers   http.Header
+}
+
+// A crashReporter sends reports somewhere. Report is called on its own
+// goroutine, never on the crashing request's.
+type crashReporter interface {
+	Report(crashReport) error
+}
+
+var (
+	// crashReporterImpl is nil when reporting is off.
+	crashReporterImpl crashReporter
+	crashSampleRate   = 1.0
+	release           = os.Getenv("RELEASE")
+)
+
+func init() {
+	if release == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, s := range info.Settings {
+				if s.Key == "vcs.revision" {
+					release = s.Value
+				}
+			}
+		}
+	}
+	if v := os.Getenv("CRASH_SAMPLE_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			log.Fatalf("Invalid CRASH_SAMPLE_RATE %q: must be between 0 and 1", v)
+		}
+		crashSampleRate = rate
+	}
+	if dsn := os.Getenv("SENTRY_DSN"); dsn != "" {
+		r, err := newSentryReporter(dsn)
+		if err != nil {
+			log.Fatalf("Invalid SENTRY_DSN: %v", err)
+		}
+		crashReporterImpl = r
+	}
+}
+
+// recoverHandler turns a panic in next into a 500 and a crash report.
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// A deliberate abort of the response, not a crash.
+				panic(v)
+			}
+			stack := debug.Stack()
+			requestLogger(r).Error("Panic serving request", "method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(v), "stack", string(stack))
+			// Headers the handler set for a successful response, such as a
+			// public Cache-Control, must not go out with the error.
+			for _, h := range []string{"Cache-Control", "ETag", "Link", "Location"} {
+				w.Header().Del(h)
+			}
+			writeError(w, r, "Internal Server Error", http.StatusInternalServerError)
+			reportCrash(r, v)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func reportCrash(r *http.Request, v any) {
+	if crashReporterImpl == nil || rand.Float64() >= crashSampleRate {
+		return
+	}
+	pcs := make([]uintptr, 64)
+	// Skip runtime.Callers, reportCrash, the deferred func and gopanic.
+	n := runtime.Callers(4, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	report := crashReport{
+		Time:      time.Now().UTC(),
+		Message:   fmt.Sprint(v),
+		Release:   release,
+		RequestID: requestID(r),
+		TraceID:   requestTrace(r).TraceID,
+		Method:    r.Method,
+		URL:       scrubURL(r),
+		Route:     r.Pattern,
+		Headers:   scrubHeaders(r.Header),
+	}
+	for {
+		f, more := frames.Next()
+		report.Frames = append(report.Frames, f)
+		if !more {
+			break
+		}
+	}
+	go func() {
+		if err := crashReporterImpl.Report(report); err != nil {
+			requestLogger(r).Error("Crash report failed", "err", err)
+		}
+	}()
+}
+
+// Crash reports leave the deployment, so anything identifying a person or
+// granting access is taken out first.
+var (
+	sensitiveHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization", "X-Api-Key", userEmailHeader, inviteCodeHeader}
+	sensitiveParams  = []string{"invite", "email", "token", "key"}
+	emailPattern     = regexp.MustCompile(`[^/@\s]+@[^/@\s]+`)
+)
+
+const scrubbed = "[Filtered]"
+
+func scrubHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range sensitiveHeaders {
+		if out.Get(name) != "" {
+			out.Set(name, scrubbed)
+		}
+	}
+	return out
+}
+
+// scrubURL returns the absolute URL of r without personal data.
+func scrubURL(r *http.Request) string {
+	c := *r.URL
+	c.Scheme, c.Host = "http", r.Host
+	if r.TLS != nil {
+		c.Scheme = "https"
+	}
+	// Students are addressed by name or email in enrollment paths.
+	c.Path = emailPattern.ReplaceAllString(c.Path, scrubbed)
+	c.RawPath = ""
+	q := c.Query()
+	for _, p := range sensitiveParams {
+		if q.Has(p) {
+			q.Set(p, scrubbed)
+		}
+	}
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// sentryReporter posts events to Sentry's store endpoint, which
+// Sentry-compatible services implement too.
+type sentryReporter struct {
+	endpoint  string
+	publicKey string
+	client    *http.Client
+}
+
+// newSentryReporter parses a DSN: https://<public key>@<host>/<project id>.
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, fmt.Errorf("want https://<key>@<host>/<project>")
+	}
+	path := strings.Trim(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	prefix, project := path[:max(i, 0)], path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("DSN has no project ID")
+	}
+	if prefix != "" {
+		prefix = "/" + prefix
+	}
+	return &sentryReporter{
+		endpoint:  fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project),
+		publicKey: u.User.Username(),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *sentryReporter) Report(c crashReport) error {
+	// Sentry lists frames outermost first.
+	frames := make([]map[string]any, 0, len(c.Frames))
+	for i := len(c.Frames) - 1; i >= 0; i-- {
+		f := c.Frames[i]
+		frames = append(frames, map[string]any{
+			"function": f.Function,
+			"abs_path": f.File,
+			"lineno":   f.Line,
+			"in_app":   strings.HasPrefix(f.Function, "main."),
+		})
+	}
+	headers := map[string]string{}
+	for k := range c.Headers {
+		headers[k] = c.Headers.Get(k)
+	}
+	event := map[string]any{
+		"event_id":  randomHex(16),
+		"timestamp": c.Time.Format(time.RFC3339Nano),
+		"level":     "fatal",
+		"platform":  "go",
+		"logger":    "recoverHandler",
+		"message":   c.Message,
+		"exception": map[string]any{"values": []any{map[string]any{
+			"type":       "panic",
+			"value":      c.Message,
+			"stacktrace": map[string]any{"frames": frames},
+		}}},
+		"request": map[string]any{"method": c.Method, "url": c.URL, "headers": headers},
+		"tags":    map[string]string{"route": c.Route, "request_id": c.RequestID, "trace_id": c.TraceID},
+	}
+	if c.Release != "" {
+		event["release"] = c.Release
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=go-first-web-server/1.0", s.publicKey))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", s.endpoint, resp.Status)
+	}
+	return nil
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: จับ panic และรายงาน crash
+
+	1. `recoverHandler` ครอบทุก request: ถ้า handler panic จะ log stack trace แล้วตอบ 500 แทนการปล่อยให้ connection ถูกตัดเฉย ๆ
+	2. ถ้าตั้ง `SENTRY_DSN` จะส่ง stack trace, ข้อมูล request และเวอร์ชัน (`RELEASE` หรือ git revision ตอน build) ไปยัง Sentry หรือบริการที่ใช้ API เดียวกัน
+	   - ส่งใน goroutine แยก ไม่ทำให้ request ช้า
+	   - `CRASH_SAMPLE_RATE=0.1` ส่งแค่ 10% ของ crash
+	3. ลบข้อมูลส่วนตัวก่อนส่งเสมอ: header อย่าง `Authorization`, `Cookie`, `X-User-Email`, `X-Invite-Code` และ email ใน path/query จะกลายเป็น `[Filtered]`
+	4. `crashReporter` เป็น interface เปลี่ยนไปใช้ระบบอื่นได้โดย implement `Report`
+*/
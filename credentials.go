@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Users with passwords, managed by admins at /admin/users, sign in at
+// /auth/session or /auth/token with HTTP Basic credentials and get the
+// role they were created with. The admin account from ADMIN_USERNAME and
+// ADMIN_PASSWORD keeps working alongside them. Once a user exists, course
+// writes need credentials, as with API keys.
+//
+// Passwords are stored only as PBKDF2-HMAC-SHA256 hashes with a random
+// salt, in the PHC string format:
+//
+//	$pbkdf2-sha256$i=600000$<salt>$<hash>
+//
+// The standard library has neither bcrypt nor Argon2, and PBKDF2 with a
+// high iteration count is the FIPS-approved alternative. The cost is
+// PASSWORD_HASH_ITERATIONS (default 600000). When it changes, each
+// password is rehashed with the new cost the next time its user signs in,
+// since that is the only time the password is at hand. Hashes are never
+// part of an API response.
+//
+// Users are kept in memory, and in USERS_FILE as well when it is set, so
+// they survive restarts.
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 1024 // hashing is slow enough without huge inputs
+	passwordSaltSize  = 16
+	passwordKeySize   = 32
+)
+
+var passwordHashIterations = 600_000
+
+func init() {
+	if v := os.Getenv("PASSWORD_HASH_ITERATIONS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 10_000 {
+			log.Fatalf("Invalid PASSWORD_HASH_ITERATIONS %q: must be an integer of at least 10000", v)
+		}
+		passwordHashIterations = n
+	}
+	if usersFile != "" {
+		if err := loadUsers(); err != nil {
+			log.Fatalf("Invalid USERS_FILE: %v", err)
+		}
+	}
+}
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordHashIterations, passwordKeySize)
+	if err != nil {
+		return "", err
+	}
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", passwordHashIterations, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+var errBadPasswordHash = errors.New("malformed password hash")
+
+// checkPassword reports whether password matches hash, and whether hash
+// was made with other parameters than the current ones.
+func checkPassword(hash, password string) (ok, stale bool, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != "pbkdf2-sha256" || !strings.HasPrefix(parts[2], "i=") {
+		return false, false, errBadPasswordHash
+	}
+	iter, err := strconv.Atoi(strings.TrimPrefix(parts[2], "i="))
+	if err != nil || iter <= 0 {
+		return false, false, errBadPasswordHash
+	}
+	b64 := base64.RawStdEncoding
+	salt, err1 := b64.DecodeString(parts[3])
+	want, err2 := b64.DecodeString(parts[4])
+	if err1 != nil || err2 != nil || len(want) == 0 {
+		return false, false, errBadPasswordHash
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iter, len(want))
+	if err != nil {
+		return false, false, err
+	}
+	stale = iter != passwordHashIterations || len(salt) != passwordSaltSize || len(want) != passwordKeySize
+	return subtle.ConstantTimeCompare(got, want) == 1, stale, nil
+}
+
+// dummyPasswordHash is checked against when there is no such user, so
+// that the answer takes as long as for a wrong password and does not tell
+// which usernames exist.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	h, _ := hashPassword(randomHex(16))
+	return h
+})
+
+type user struct {
+	Username          string    `json:"username"`
+	Role              string    `json:"role"`
+	Instructor        string    `json:"instructor,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	PasswordChangedAt time.Time `json:"password_changed_at"`
+
+	passwordHash string
+}
+
+var (
+	// userMu protects users, which is keyed by lower-cased username.
+	userMu sync.Mutex
+	users  = make(map[string]*user)
+)
+
+// usersFile, if set, is where the users are kept between runs.
+var usersFile = os.Getenv("USERS_FILE")
+
+// storedUser is a user as saved in usersFile, the only place its hash is
+// written out.
+type storedUser struct {
+	user
+	PasswordHash string `json:"password_hash"`
+}
+
+func loadUsers() error {
+	data, err := os.ReadFile(usersFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var stored []storedUser
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	for _, su := range stored {
+		u := su.user
+		u.passwordHash = su.PasswordHash
+		users[strings.ToLower(u.Username)] = &u
+	}
+	return nil
+}
+
+// saveUsers writes the users to usersFile, if set, renaming the new file
+// into place. Callers must hold userMu.
+func saveUsers() {
+	if usersFile == "" {
+		return
+	}
+	stored := []storedUser{}
+	for _, u := range users {
+		stored = append(stored, storedUser{*u, u.passwordHash})
+	}
+	slices.SortFunc(stored, func(a, b storedUser) int { return strings.Compare(a.Username, b.Username) })
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err == nil {
+		tmp := usersFile + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, usersFile)
+		}
+	}
+	if err != nil {
+		slog.Error("Error saving users", "file", usersFile, "err", err)
+	}
+}
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+func usersInUse() bool {
+	userMu.Lock()
+	defer userMu.Unlock()
+	return len(users) > 0
+}
+
+func checkNewPassword(password string) string {
+	switch {
+	case len(password) < minPasswordLength:
+		return fmt.Sprintf("password must be at least %d characters", minPasswordLength)
+	case len(password) > maxPasswordLength:
+		return fmt.Sprintf("password must be at most %d bytes", maxPasswordLength)
+	}
+	return ""
+}
+
+func (u *user) principal() principal {
+	return principal{Subject: "user:" + u.Username, Role: u.Role, Instructor: u.Instructor}
+}
+
+// authenticateUser checks a username and password against the store. A
+// password hashed with old parameters is rehashed on the way.
+func authenticateUser(username, password string) (principal, bool) {
+	key := strings.ToLower(username)
+	userMu.Lock()
+	u := users[key]
+	hash := dummyPasswordHash()
+	if u != nil {
+		hash = u.passwordHash
+	}
+	userMu.Unlock()
+
+	// Hash outside the lock: it takes a noticeable fraction of a second.
+	ok, stale, err := checkPassword(hash, password)
+	if err != nil {
+		slog.Error("Cannot check password", "username", username, "err", err)
+		return principal{}, false
+	}
+	if !ok || u == nil {
+		return principal{}, false
+	}
+	if stale {
+		if rehashed, err := hashPassword(password); err == nil {
+			userMu.Lock()
+			// Unless the password changed meanwhile.
+			if u.passwordHash == hash {
+				u.passwordHash = rehashed
+				saveUsers()
+				slog.Info("Rehashed a password", "username", u.Username, "iterations", passwordHashIterations)
+			}
+			userMu.Unlock()
+		}
+	}
+	userMu.Lock()
+	defer userMu.Unlock()
+	return u.principal(), true
+}
+
+// passwordPrincipal returns who r's Basic credentials belong to: the
+// admin account or a user. Each attempt is a security event
+// (securityevents.go).
+func passwordPrincipal(r *http.Request) (principal, bool) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return principal{}, false
+	}
+	if adminUsername != "" && checkAdminCredentials(name, password) {
+		recordSecurityEvent(r, "admin:"+name, securityEventSignIn, "basic")
+		return principal{Subject: "admin:" + name, Role: roleAdmin}, true
+	}
+	p, ok := authenticateUser(name, password)
+	if ok {
+		recordSecurityEvent(r, p.Subject, securityEventSignIn, "basic")
+	} else if subject := failedSignInSubject(name); subject != "" {
+		recordSecurityEvent(r, subject, securityEventSignInFailed, "basic")
+	}
+	return p, ok
+}
+
+// basicChallenge asks for Basic credentials when any can work.
+func basicChallenge(w http.ResponseWriter) {
+	if adminUsername != "" || usersInUse() {
+		w.Header().Set("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+	}
+}
+
+// adminUsersHandler serves GET and POST /admin/users. POST takes
+// {"username", "password", "role", "instructor"}.
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		userMu.Lock()
+		list := []user{}
+		for _, u := range users {
+			list = append(list, *u)
+		}
+		userMu.Unlock()
+		slices.SortFunc(list, func(a, b user) int { return strings.Compare(a.Username, b.Username) })
+		writeValue(w, r, http.StatusOK, list)
+
+	case http.MethodPost:
+		var req struct {
+			Username   string `json:"username"`
+			Password   string `json:"password"`
+			Role       string `json:"role"`
+			Instructor string `json:"instructor"`
+		}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		if !usernamePattern.MatchString(req.Username) {
+			writeError(w, r, "username must be 1 to 64 letters, digits or ._@-", http.StatusBadRequest)
+			return
+		}
+		if msg := checkNewPassword(req.Password); msg != "" {
+			writeError(w, r, msg, http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = roleStudent
+		}
+		req.Instructor = strings.TrimSpace(req.Instructor)
+		if msg := checkRole(req.Role, req.Instructor); msg != "" {
+			writeError(w, r, msg, http.StatusBadRequest)
+			return
+		}
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			requestLogger(r).Error("Error hashing password", "err", err)
+			writeError(w, r, "Cannot store password", http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now().UTC()
+		u := &user{Username: req.Username, Role: req.Role, Instructor: req.Instructor, CreatedAt: now, PasswordChangedAt: now, passwordHash: hash}
+		userMu.Lock()
+		key := strings.ToLower(u.Username)
+		_, exists := users[key]
+		if !exists {
+			users[key] = u
+			saveUsers()
+		}
+		created := *u
+		userMu.Unlock()
+		if exists {
+			writeError(w, r, "User already exists", http.StatusConflict)
+			return
+		}
+		requestLogger(r).Info("User created", "username", u.Username, "role", u.Role)
+		w.Header().Set("Location", "/admin/users/"+u.Username)
+		writeValue(w, r, http.StatusCreated, created)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminUserHandler serves GET and DELETE /admin/users/{username}. Deleting
+// a user also ends their sessions and refresh tokens.
+func adminUserHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.ToLower(r.PathValue("username"))
+	switch r.Method {
+	case http.MethodGet:
+		userMu.Lock()
+		u := users[key]
+		var view user
+		if u != nil {
+			view = *u
+		}
+		userMu.Unlock()
+		if u == nil {
+			writeError(w, r, "User not found", http.StatusNotFound)
+			return
+		}
+		writeValue(w, r, http.StatusOK, view)
+
+	case http.MethodDelete:
+		userMu.Lock()
+		u := users[key]
+		delete(users, key)
+		saveUsers()
+		userMu.Unlock()
+		if u == nil {
+			writeError(w, r, "User not found", http.StatusNotFound)
+			return
+		}
+		endSessionsOf(u.principal().Subject)
+		revokeTokensOf(u.principal().Subject)
+		requestLogger(r).Info("User deleted", "username", u.Username)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminUserPasswordHandler serves PUT /admin/users/{username}/password
+// with {"password": ...}.
+func adminUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if msg := checkNewPassword(req.Password); msg != "" {
+		writeError(w, r, msg, http.StatusBadRequest)
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		requestLogger(r).Error("Error hashing password", "err", err)
+		writeError(w, r, "Cannot store password", http.StatusInternalServerError)
+		return
+	}
+	userMu.Lock()
+	u := users[strings.ToLower(r.PathValue("username"))]
+	if u != nil {
+		u.passwordHash = hash
+		u.PasswordChangedAt = time.Now().UTC()
+		saveUsers()
+	}
+	userMu.Unlock()
+	if u == nil {
+		writeError(w, r, "User not found", http.StatusNotFound)
+		return
+	}
+	requestLogger(r).Info("Password changed", "username", u.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: เก็บรหัสผ่านของผู้ใช้แบบ hash ที่ปรับความหนักได้
+
+	1. admin สร้างผู้ใช้ที่ `POST /admin/users` (username, password, role) ผู้ใช้ login ด้วย Basic auth ที่ `/auth/session` หรือ `/auth/token`
+	2. เก็บเฉพาะ hash แบบ PBKDF2-HMAC-SHA256 + salt สุ่ม ในรูปแบบ `$pbkdf2-sha256$i=600000$<salt>$<hash>`
+	   - ใช้ PBKDF2 เพราะ standard library ของ Go ไม่มี bcrypt/Argon2 (ต้องพึ่ง x/crypto)
+	   - ความหนักตั้งที่ `PASSWORD_HASH_ITERATIONS` (ค่าเริ่มต้น 600000)
+	3. rehash-on-login: ถ้าเปลี่ยนค่า iterations, hash เก่าจะถูกสร้างใหม่ตอนผู้ใช้ login ครั้งถัดไป (เป็นจังหวะเดียวที่มีรหัสผ่านจริงอยู่)
+	4. hash ไม่เคยออกไปใน response ใดเลย (field ไม่ export) มีแค่ในไฟล์ `USERS_FILE` (ถ้าตั้ง) ที่ใช้เก็บผู้ใช้ข้ามการ restart
+	5. username ที่ไม่มีจริงก็ยัง hash เทียบกับ dummy hash เวลาที่ใช้จึงไม่บอกว่ามี username นี้หรือไม่
+	6. ลบผู้ใช้แล้ว session และ refresh token ของผู้ใช้นั้นถูกยกเลิกทันที
+*/
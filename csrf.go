@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Browsers attach session cookies and cached Basic credentials to every
+// request on their own, so a page on another site could make them change
+// things here. csrfHandler stops that for unsafe methods (anything but
+// GET, HEAD and OPTIONS) carrying either:
+//
+//   - a session cookie: the request must also carry the session's CSRF
+//     token, in the X-CSRF-Token header or, for HTML forms, a csrf_token
+//     form field. The token is in the session returned by /auth/session
+//     and is unguessable by other sites (synchronizer token pattern).
+//   - Basic credentials: there is nothing to hold a token, so the request
+//     must not come from another site by its Origin or Sec-Fetch-Site
+//     header.
+//
+// Bearer tokens and API keys are never sent by the browser on its own and
+// are left alone, as are clients that send neither header, which are not
+// browsers.
+
+const (
+	csrfHeader    = "X-CSRF-Token"
+	csrfFormField = "csrf_token"
+)
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// sameOrigin reports whether r comes from this site, as far as the
+// browser says. A request that says nothing is not a cross-site fetch.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// requestCSRFToken returns the token r was sent with.
+func requestCSRFToken(r *http.Request) string {
+	if t := r.Header.Get(csrfHeader); t != "" {
+		return t
+	}
+	ct := r.Header.Get("Content-Type")
+	if strings.HasPrefix(ct, "application/x-www-form-urlencoded") || strings.HasPrefix(ct, "multipart/form-data") {
+		// Reads and keeps the form, so handlers can still use it.
+		return r.PostFormValue(csrfFormField)
+	}
+	return ""
+}
+
+// csrfHandler rejects forged browser requests; it runs after
+// sessionHandler, which puts the session in the context.
+func csrfHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if safeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s, ok := requestSession(r); ok {
+			t := requestCSRFToken(r)
+			if !sameOrigin(r) || t == "" || subtle.ConstantTimeCompare([]byte(t), []byte(s.CSRFToken)) != 1 {
+				writeError(w, r, "Forbidden: missing or invalid CSRF token", http.StatusForbidden)
+				return
+			}
+		} else if _, _, ok := r.BasicAuth(); ok && !sameOrigin(r) {
+			writeError(w, r, "Forbidden: cross-site request with credentials", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: กัน CSRF (เว็บอื่นหลอกให้ browser ของเราส่งคำสั่งแก้ข้อมูล)
+
+	1. ตรวจเฉพาะ method ที่แก้ข้อมูล (ไม่ใช่ GET/HEAD/OPTIONS) และเฉพาะ credential ที่ browser แนบเองอัตโนมัติ
+	2. ใช้ session cookie: ต้องส่ง CSRF token ของ session มาด้วย ทาง header `X-CSRF-Token` หรือ field `csrf_token` ของ HTML form
+	   - token อยู่ใน session (`GET /auth/session` คืนค่า `csrf_token`) เว็บอื่นอ่านไม่ได้ จึงปลอมไม่ได้ (synchronizer token)
+	3. ใช้ Basic auth: ไม่มีที่ให้ถือ token จึงดู `Origin`/`Sec-Fetch-Site` แทน ถ้ามาจากเว็บอื่นได้ 403
+	4. Bearer token และ API key browser ไม่แนบเอง จึงไม่ต้องตรวจ
+*/
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFHandler(t *testing.T) {
+	h := csrfHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	const token = "0123456789abcdef"
+	for _, tt := range []struct {
+		name    string
+		method  string
+		session bool
+		basic   bool
+		header  map[string]string
+		form    string // a form body with this csrf_token
+		want    int
+	}{
+		{"session read", http.MethodGet, true, false, map[string]string{"Sec-Fetch-Site": "cross-site"}, "", http.StatusNoContent},
+		{"session with token", http.MethodPost, true, false, map[string]string{csrfHeader: token}, "", http.StatusNoContent},
+		{"session with form token", http.MethodPost, true, false, nil, token, http.StatusNoContent},
+		{"session same origin", http.MethodPut, true, false, map[string]string{csrfHeader: token, "Origin": "http://courses.test"}, "", http.StatusNoContent},
+		{"session missing token", http.MethodPost, true, false, nil, "", http.StatusForbidden},
+		{"session wrong token", http.MethodDelete, true, false, map[string]string{csrfHeader: "fedcba9876543210"}, "", http.StatusForbidden},
+		{"session wrong form token", http.MethodPost, true, false, nil, "fedcba9876543210", http.StatusForbidden},
+		{"session token prefix", http.MethodPost, true, false, map[string]string{csrfHeader: token[:8]}, "", http.StatusForbidden},
+		{"session cross-site with token", http.MethodPost, true, false, map[string]string{csrfHeader: token, "Sec-Fetch-Site": "cross-site"}, "", http.StatusForbidden},
+		{"session cross-origin with token", http.MethodPost, true, false, map[string]string{csrfHeader: token, "Origin": "https://evil.example"}, "", http.StatusForbidden},
+
+		{"basic same origin", http.MethodPost, false, true, map[string]string{"Origin": "http://courses.test"}, "", http.StatusNoContent},
+		{"basic same-origin fetch", http.MethodPost, false, true, map[string]string{"Sec-Fetch-Site": "same-origin"}, "", http.StatusNoContent},
+		{"basic not a browser", http.MethodPost, false, true, nil, "", http.StatusNoContent},
+		{"basic cross-origin", http.MethodPost, false, true, map[string]string{"Origin": "https://evil.example"}, "", http.StatusForbidden},
+		{"basic null origin", http.MethodPost, false, true, map[string]string{"Origin": "null"}, "", http.StatusForbidden},
+		{"basic cross-site fetch", http.MethodPatch, false, true, map[string]string{"Sec-Fetch-Site": "cross-site"}, "", http.StatusForbidden},
+		{"basic same-site fetch", http.MethodDelete, false, true, map[string]string{"Sec-Fetch-Site": "same-site"}, "", http.StatusForbidden},
+		{"basic fetch header wins", http.MethodPost, false, true, map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "http://courses.test"}, "", http.StatusForbidden},
+		{"basic cross-site read", http.MethodGet, false, true, map[string]string{"Sec-Fetch-Site": "cross-site"}, "", http.StatusNoContent},
+
+		{"bearer cross-site", http.MethodPost, false, false, map[string]string{"Authorization": "Bearer x", "Sec-Fetch-Site": "cross-site"}, "", http.StatusNoContent},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var body *strings.Reader
+			if tt.form != "" {
+				body = strings.NewReader(url.Values{csrfFormField: {tt.form}}.Encode())
+			} else {
+				body = strings.NewReader("")
+			}
+			r := httptest.NewRequest(tt.method, "http://courses.test/courses", body)
+			if tt.form != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if tt.basic {
+				r.SetBasicAuth("admin", "secret")
+			}
+			if tt.session {
+				r = r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session{CSRFToken: token}))
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("%s = %d, want %d", tt.method, w.Code, tt.want)
+			}
+		})
+	}
+}
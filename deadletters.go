@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Background jobs that fail for good land in the dead-letter store instead
+// of only a log line: a webhook delivery that ran out of attempts, or an
+// access-expiry reminder the notifier could not send. Each dead letter
+// keeps the job's payload, its last error and every attempt, and knows how
+// to run the job again.
+//
+//	GET    /admin/dead-letters?kind=webhook  list, newest first
+//	GET    /admin/dead-letters/{id}          one, with its payload
+//	DELETE /admin/dead-letters/{id}          discard it
+//	POST   /admin/dead-letters/{id}/requeue  run the job again
+//	POST   /admin/dead-letters/requeue       {"ids": [...]} or {"kind": "webhook"}; {} for all
+//	POST   /admin/dead-letters/discard       the same, to discard
+//
+// A requeued job leaves the store; if it fails again it comes back with
+// the new attempts. Only the newest maxDeadLetters are kept.
+
+const maxDeadLetters = 1000
+
+type deadLetter struct {
+	ID       string              `json:"id"`
+	Kind     string              `json:"kind"` // the job type (jobs.go)
+	Job      string              `json:"job"`  // the job's own ID, such as the webhook delivery's
+	Error    string              `json:"error"`
+	Payload  json.RawMessage     `json:"payload,omitempty"`
+	Attempts []deadLetterAttempt `json:"attempts"`
+	FailedAt time.Time           `json:"failed_at"`
+
+	// retry runs the job again. A job that runs in the background returns
+	// once it is scheduled and dead-letters itself again if it fails.
+	retry func() error
+}
+
+type deadLetterAttempt struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+}
+
+var (
+	// deadLetterMu protects deadLetters, oldest first. webhookMu may be
+	// held while taking it, never the other way round.
+	deadLetterMu sync.Mutex
+	deadLetters  []*deadLetter
+)
+
+// addDeadLetter stores dl, replacing any dead letter for the same job.
+func addDeadLetter(dl *deadLetter) {
+	if dl.ID == "" {
+		dl.ID = randomHex(8)
+	}
+	dl.FailedAt = time.Now().UTC()
+	deadLetterMu.Lock()
+	deadLetters = slices.DeleteFunc(deadLetters, func(x *deadLetter) bool { return x.Kind == dl.Kind && x.Job == dl.Job })
+	deadLetters = append(deadLetters, dl)
+	if n := len(deadLetters) - maxDeadLetters; n > 0 {
+		slog.Warn("Dead-letter store is full; dropping the oldest", "dropped", n)
+		deadLetters = slices.Delete(deadLetters, 0, n)
+	}
+	deadLetterMu.Unlock()
+	slog.Error("Dead-lettered a job", "kind", dl.Kind, "job", dl.Job, "err", dl.Error)
+}
+
+// discardDeadLetterJob removes the dead letter of a job that is being run
+// again some other way, if it has one.
+func discardDeadLetterJob(kind, job string) {
+	deadLetterMu.Lock()
+	deadLetters = slices.DeleteFunc(deadLetters, func(x *deadLetter) bool { return x.Kind == kind && x.Job == job })
+	deadLetterMu.Unlock()
+}
+
+func takeDeadLetter(id string) *deadLetter {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	i := slices.IndexFunc(deadLetters, func(x *deadLetter) bool { return x.ID == id })
+	if i < 0 {
+		return nil
+	}
+	dl := deadLetters[i]
+	deadLetters = slices.Delete(deadLetters, i, i+1)
+	return dl
+}
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// requeueDeadLetter runs the job of dead letter id again. It is taken out
+// of the store first, so two requeues cannot both run it; if the job
+// cannot even be started it goes back, under the same ID, with the new
+// attempt.
+func requeueDeadLetter(id string) error {
+	dl := takeDeadLetter(id)
+	if dl == nil {
+		return errDeadLetterNotFound
+	}
+	if err := dl.retry(); err != nil {
+		dl.Error = err.Error()
+		dl.Attempts = append(dl.Attempts, deadLetterAttempt{At: time.Now().UTC(), Error: err.Error()})
+		addDeadLetter(dl)
+		return err
+	}
+	slog.Info("Requeued a dead-lettered job", "kind", dl.Kind, "job", dl.Job)
+	return nil
+}
+
+// selectDeadLetters returns the IDs named by a bulk request: ids if given,
+// else every dead letter of kind, or all of them.
+func selectDeadLetters(ids []string, kind string) []string {
+	if len(ids) > 0 {
+		return ids
+	}
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	selected := []string{}
+	for _, dl := range deadLetters {
+		if kind == "" || dl.Kind == kind {
+			selected = append(selected, dl.ID)
+		}
+	}
+	return selected
+}
+
+type deadLetterFailure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// requeueDeadLetters requeues every dead letter in ids and reports which
+// ones could not be.
+func requeueDeadLetters(ids []string) (requeued []string, failed []deadLetterFailure) {
+	requeued, failed = []string{}, []deadLetterFailure{}
+	for _, id := range ids {
+		if err := requeueDeadLetter(id); err != nil {
+			failed = append(failed, deadLetterFailure{id, err.Error()})
+		} else {
+			requeued = append(requeued, id)
+		}
+	}
+	return requeued, failed
+}
+
+// view is a dead letter as the admin API shows it, safe to read after
+// deadLetterMu is released.
+func (dl *deadLetter) view() deadLetter {
+	v := *dl
+	v.Attempts = slices.Clone(dl.Attempts)
+	v.retry = nil
+	return v
+}
+
+// adminDeadLettersHandler serves GET /admin/dead-letters.
+func adminDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	deadLetterMu.Lock()
+	list := []deadLetter{}
+	for _, dl := range slices.Backward(deadLetters) {
+		if kind == "" || dl.Kind == kind {
+			list = append(list, dl.view())
+		}
+	}
+	deadLetterMu.Unlock()
+	writeValue(w, r, http.StatusOK, list)
+}
+
+// adminDeadLetterHandler serves GET and DELETE /admin/dead-letters/{id}.
+func adminDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	switch r.Method {
+	case http.MethodGet:
+		deadLetterMu.Lock()
+		i := slices.IndexFunc(deadLetters, func(x *deadLetter) bool { return x.ID == id })
+		var dl deadLetter
+		if i >= 0 {
+			dl = deadLetters[i].view()
+		}
+		deadLetterMu.Unlock()
+		if i < 0 {
+			writeError(w, r, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		writeValue(w, r, http.StatusOK, dl)
+
+	case http.MethodDelete:
+		if takeDeadLetter(id) == nil {
+			writeError(w, r, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		requestLogger(r).Info("Discarded a dead letter", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminDeadLetterRequeueHandler serves POST
+// /admin/dead-letters/{id}/requeue.
+func adminDeadLetterRequeueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch err := requeueDeadLetter(r.PathValue("id")); {
+	case errors.Is(err, errDeadLetterNotFound):
+		writeError(w, r, "Dead letter not found", http.StatusNotFound)
+	case err != nil:
+		writeError(w, r, "Cannot requeue: "+err.Error(), http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// adminDeadLettersBulkHandler serves POST /admin/dead-letters/requeue and
+// /admin/dead-letters/discard.
+func adminDeadLettersBulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		IDs  []string `json:"ids"`
+		Kind string   `json:"kind"`
+	}
+	if r.ContentLength != 0 && !decodeBody(w, r, &req) {
+		return
+	}
+	ids := selectDeadLetters(req.IDs, req.Kind)
+	if strings.HasSuffix(r.URL.Path, "/discard") {
+		discarded, missing := []string{}, []deadLetterFailure{}
+		for _, id := range ids {
+			if takeDeadLetter(id) == nil {
+				missing = append(missing, deadLetterFailure{id, errDeadLetterNotFound.Error()})
+			} else {
+				discarded = append(discarded, id)
+			}
+		}
+		requestLogger(r).Info("Discarded dead letters", "count", len(discarded))
+		writeValue(w, r, http.StatusOK, map[string]any{"discarded": discarded, "failed": missing})
+		return
+	}
+	requeued, failed := requeueDeadLetters(ids)
+	writeValue(w, r, http.StatusOK, map[string]any{"requeued": requeued, "failed": failed})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ที่พักงานเบื้องหลังที่ล้มเหลวถาวร (dead-letter queue)
+
+	1. งานที่ลองจนหมดแล้วยังไม่สำเร็จจะมาอยู่ที่นี่ พร้อม error ล่าสุด, payload และประวัติทุกครั้งที่ลอง
+	   - webhook delivery ที่ส่งครบ 6 ครั้งหรือผู้รับปฏิเสธ
+	   - การแจ้งเตือนวันหมดอายุที่ `notifyExpiry` ส่งไม่ได้
+	2. admin ดูได้ที่ `GET /admin/dead-letters` (กรองด้วย `?kind=`) และ `GET /admin/dead-letters/{id}`
+	3. สั่งรันใหม่ (`POST .../{id}/requeue`) หรือทิ้ง (`DELETE .../{id}`) ทีละรายการ หรือทีละหลายรายการผ่าน `POST /admin/dead-letters/requeue|discard`
+	   - requeue แล้วงานออกจาก store ถ้าล้มเหลวอีกจะกลับมาพร้อมประวัติใหม่
+	4. แต่ละ dead letter มีฟังก์ชัน `retry` ของงานนั้นเอง store จึงไม่ต้องรู้จักงานทุกชนิด
+	5. เก็บสูงสุด 1000 รายการ ล้นแล้วทิ้งอันเก่าสุด
+*/
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// `server dev` runs the server for development, so contributors iterate
+// without external tooling. It builds the Go files of the working
+// directory, runs the result with -dev and any other arguments it was
+// given, and watches the Go files and an env file (-env, default .env)
+// of KEY=VALUE lines for the child's environment. When one changes it
+// rebuilds and restarts the server. A failed build is printed and the
+// running server kept, so a typo does not take it down.
+//
+// On top of what -dev already does, a server in dev mode watches
+// templates/, static/ and docs/ itself and injects a script into every
+// HTML page that listens on /dev/reload. The page reloads when an asset
+// changes, or when the server comes back from a restart with a new boot
+// ID.
+
+const devPollInterval = 500 * time.Millisecond
+
+// devBootID tells one run of the server from the next.
+var devBootID = randomHex(8)
+
+// fingerprint sums up the names, sizes and modification times of paths,
+// so two calls differ when any of them was added, removed or changed.
+func fingerprint(paths []string) string {
+	slices.Sort(paths)
+	var b strings.Builder
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", p, fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return b.String()
+}
+
+// watchFiles calls changed each time the fingerprint of list() changes,
+// once it has stayed the same for a poll, so a save that touches several
+// files counts once.
+func watchFiles(ctx context.Context, list func() []string, changed func()) {
+	last, pending := fingerprint(list()), ""
+	tick := time.NewTicker(devPollInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		now := fingerprint(list())
+		switch {
+		case now != last && now != pending:
+			pending = now
+		case now == pending:
+			last, pending = now, ""
+			changed()
+		}
+	}
+}
+
+// runDevServer serves `server dev [-env file] [-- server flags]`.
+func runDevServer(args []string) {
+	fset := flag.NewFlagSet("dev", flag.ExitOnError)
+	envFile := fset.String("env", ".env", "read KEY=VALUE lines for the server's environment from this file, if it exists")
+	fset.Parse(args)
+	serverArgs := append([]string{"-dev"}, fset.Args()...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	dir, err := os.MkdirTemp("", "server-dev")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "server")
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+
+	var child *devChild
+	restart := func() {
+		files, _ := filepath.Glob("*.go")
+		build := exec.Command("go", append([]string{"build", "-o", bin}, files...)...)
+		build.Stdout, build.Stderr = os.Stderr, os.Stderr
+		start := time.Now()
+		if err := build.Run(); err != nil {
+			slog.Error("dev: build failed; keeping the running server", "err", err)
+			return
+		}
+		env, err := readEnvFile(*envFile)
+		if err != nil {
+			slog.Error("dev: keeping the running server", "err", err)
+			return
+		}
+		child.stop()
+		slog.Info("dev: built, starting the server", "duration", time.Since(start).Round(time.Millisecond))
+		child = startDevChild(bin, serverArgs, env)
+	}
+	restart()
+	if child == nil {
+		slog.Info("dev: waiting for a change that builds")
+	}
+	watchFiles(ctx, func() []string {
+		files, _ := filepath.Glob("*.go")
+		return append(files, *envFile)
+	}, restart)
+	child.stop()
+}
+
+// readEnvFile returns the KEY=VALUE lines of name, skipping blank lines
+// and # comments. A missing file is no variables.
+func readEnvFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var env []string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", name, n)
+		}
+		env = append(env, strings.TrimSpace(key)+"="+strings.Trim(strings.TrimSpace(value), `"'`))
+	}
+	return env, sc.Err()
+}
+
+type devChild struct {
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+func startDevChild(bin string, args, env []string) *devChild {
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), env...)
+	if err := cmd.Start(); err != nil {
+		slog.Error("dev: cannot start the server", "err", err)
+		return nil
+	}
+	c := &devChild{cmd: cmd, exited: make(chan struct{})}
+	go func() {
+		err := cmd.Wait()
+		close(c.exited)
+		if cmd.ProcessState.Exited() {
+			slog.Warn("dev: server exited; waiting for a change", "err", err)
+		}
+	}()
+	return c
+}
+
+// stop ends c and waits for it, so the next server can take its port.
+func (c *devChild) stop() {
+	if c == nil {
+		return
+	}
+	select {
+	case <-c.exited:
+		return
+	default:
+	}
+	if c.cmd.Process.Signal(os.Interrupt) != nil {
+		c.cmd.Process.Kill()
+	}
+	select {
+	case <-c.exited:
+	case <-time.After(5 * time.Second):
+		c.cmd.Process.Kill()
+		<-c.exited
+	}
+}
+
+var (
+	// assetsChanged is closed, and replaced, each time an asset changes.
+	assetsMu      sync.Mutex
+	assetsChanged = make(chan struct{})
+)
+
+// watchAssets tells the pages listening on /dev/reload when a file under
+// templates/, static/ or docs/ changes.
+func watchAssets(ctx context.Context) {
+	watchFiles(ctx, func() []string {
+		var files []string
+		for _, dir := range []string{"templates", "static", "docs"} {
+			filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					files = append(files, path)
+				}
+				return nil
+			})
+		}
+		return files
+	}, func() {
+		assetsMu.Lock()
+		close(assetsChanged)
+		assetsChanged = make(chan struct{})
+		assetsMu.Unlock()
+	})
+}
+
+// devReloadHandler serves GET /dev/reload, an event stream that first
+// sends the boot ID, then a reload event for each asset change.
+func devReloadHandler(w http.ResponseWriter, r *http.Request) {
+	current := func() chan struct{} {
+		assetsMu.Lock()
+		defer assetsMu.Unlock()
+		return assetsChanged
+	}
+	changed := current()
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\ndata: %s\n\n", devPollInterval.Milliseconds(), devBootID)
+	for {
+		if rc.Flush() != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+			changed = current()
+			fmt.Fprint(w, "event: reload\ndata: \n\n")
+		}
+	}
+}
+
+// liveReloadScript reloads the page when /dev/reload says so, and after a
+// restart, which the stream survives by reconnecting.
+const liveReloadScript = `<script>(() => {
+	let boot;
+	const events = new EventSource("/dev/reload");
+	events.onmessage = (e) => { if (boot && e.data !== boot) location.reload(); boot = e.data; };
+	events.addEventListener("reload", () => location.reload());
+})();</script>
+`
+
+// liveReloadHandler serves /dev/reload and adds liveReloadScript to the
+// HTML pages next serves. It asks for them uncompressed and whole, since
+// it edits the body.
+func liveReloadHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dev/reload" {
+			devReloadHandler(w, r)
+			return
+		}
+		r.Header.Del("Accept-Encoding")
+		r.Header.Del("Range")
+		iw := &injectWriter{ResponseWriter: w}
+		next.ServeHTTP(iw, r)
+		iw.finish()
+	})
+}
+
+// injectWriter holds back 200 HTML responses to add liveReloadScript
+// before </body>; everything else goes straight through.
+type injectWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	html        bool
+	status      int
+	body        bytes.Buffer
+}
+
+func (w *injectWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if status == http.StatusOK && strings.HasPrefix(h.Get("Content-Type"), "text/html") && h.Get("Content-Encoding") == "" {
+		w.html, w.status = true, status
+		h.Del("Content-Length")
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *injectWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.html {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *injectWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *injectWriter) finish() {
+	if !w.html {
+		return
+	}
+	page := w.body.Bytes()
+	at := bytes.LastIndex(bytes.ToLower(page), []byte("</body>"))
+	if at < 0 {
+		at = len(page)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(page[:at])
+	w.ResponseWriter.Write([]byte(liveReloadScript))
+	w.ResponseWriter.Write(page[at:])
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: `server dev` แก้โค้ดแล้ว server build ใหม่เองและหน้าเว็บ reload เอง ไม่ต้องใช้เครื่องมือภายนอก
+
+	1. `server dev` (หรือ `go run . dev`) build ไฟล์ `*.go` แล้วรันด้วย `-dev` พร้อม flag อื่นที่ส่งตามมา
+	   - เฝ้าดูไฟล์ `*.go` และไฟล์ env (`-env`, ค่าเริ่มต้น `.env` บรรทัดละ `KEY=VALUE`) ทุก 0.5 วินาที
+	   - มีการเปลี่ยนแปลงก็ build ใหม่แล้ว restart; ถ้า build ไม่ผ่าน พิมพ์ error และรันตัวเดิมต่อ
+	2. server โหมด dev เฝ้าดู `templates/`, `static/`, `docs/` เอง (ไฟล์พวกนี้อ่านจากดิสก์อยู่แล้ว ไม่ต้อง restart)
+	3. ทุกหน้า HTML ถูกแทรก script ก่อน `</body>` ที่ฟัง `/dev/reload` (SSE)
+	   - asset เปลี่ยน → server ส่ง event `reload`
+	   - server restart → EventSource ต่อใหม่ได้ boot ID ใหม่ → หน้าเว็บ reload
+	4. ตัวแทรก script ขอ response แบบไม่บีบอัดและเต็มไฟล์ (ลบ `Accept-Encoding`/`Range`) เพราะต้องแก้ body
+*/
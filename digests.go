@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Students choose how often they are emailed with their notification
+// preferences: every email as it happens (immediate, the default), or an
+// hourly or daily digest. A digest collects the emails that would have
+// gone out and sends them as one, rendered with the tenant's "digest"
+// template (emails.go), one period after the first of them. Emails of
+// different tenants go in different digests, since each carries its
+// tenant's branding.
+//
+//	GET /students/{student}/notification-preferences
+//	PUT /students/{student}/notification-preferences  {"digest": "daily"}
+//
+// Switching back to immediate sends what is pending on the next check.
+
+const (
+	digestImmediate = "immediate"
+	digestHourly    = "hourly"
+	digestDaily     = "daily"
+)
+
+var digestPeriods = map[string]time.Duration{
+	digestImmediate: 0,
+	digestHourly:    time.Hour,
+	digestDaily:     24 * time.Hour,
+}
+
+// digestCheckInterval is how often pending digests are looked at.
+const digestCheckInterval = time.Minute
+
+type notificationPreferences struct {
+	// Digest is immediate, hourly or daily.
+	Digest string `json:"digest"`
+}
+
+type digestItem struct {
+	Kind    string
+	Subject string
+	Body    string
+	At      time.Time
+}
+
+// pendingDigest holds the emails waiting for one student of one tenant.
+type pendingDigest struct {
+	tenantID string
+	to       string
+	fromName string
+	since    time.Time // of the first item
+	items    []digestItem
+}
+
+var (
+	// digestMu protects notificationPrefs, by lower-cased address, and
+	// pendingDigests, by tenant ID and address.
+	digestMu          sync.Mutex
+	notificationPrefs = map[string]string{}
+	pendingDigests    = map[string]*pendingDigest{}
+)
+
+// addToDigest holds m for a digest if its recipient wants one, and
+// reports whether it did.
+func addToDigest(tenantID, kind string, m emailMessage) bool {
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	pref := notificationPrefs[strings.ToLower(m.To)]
+	if digestPeriods[pref] == 0 {
+		return false
+	}
+	key := tenantID + "\x00" + strings.ToLower(m.To)
+	d := pendingDigests[key]
+	now := time.Now().UTC()
+	if d == nil {
+		d = &pendingDigest{tenantID: tenantID, to: m.To, since: now}
+		pendingDigests[key] = d
+	}
+	d.fromName = m.FromName
+	d.items = append(d.items, digestItem{Kind: kind, Subject: m.Subject, Body: m.Body, At: now})
+	return true
+}
+
+// runDigests sends the digests that are due every interval
+// until the process exits.
+func runDigests(interval time.Duration) {
+	for range time.Tick(interval) {
+		sendDueDigests(time.Now())
+	}
+}
+
+// sendDueDigests sends each pending digest whose period has passed since
+// its first item, by its recipient's current preference.
+func sendDueDigests(now time.Time) {
+	var due []*pendingDigest
+	digestMu.Lock()
+	for key, d := range pendingDigests {
+		if now.Sub(d.since) >= digestPeriods[notificationPrefs[strings.ToLower(d.to)]] {
+			due = append(due, d)
+			delete(pendingDigests, key)
+		}
+	}
+	digestMu.Unlock()
+
+	for _, d := range due {
+		if emailSuppressed(d.tenantID, d.to) {
+			continue
+		}
+		items := make([]map[string]any, len(d.items))
+		for i, it := range d.items {
+			items[i] = map[string]any{"Kind": it.Kind, "Subject": it.Subject, "Body": it.Body, "At": it.At}
+		}
+		emailMu.Lock()
+		tmpl := currentEmailTemplate(d.tenantID, emailDigest)
+		emailMu.Unlock()
+		unsubscribe := unsubscribeURL(d.tenantID, d.to)
+		data := map[string]any{"Brand": emailBrand(d.tenantID), "Student": d.to, "Count": len(items), "Items": items, "UnsubscribeURL": unsubscribe}
+		subject, body, err := renderEmail(tmpl, data)
+		if err != nil {
+			// Fall back to the built-in text rather than lose the items.
+			slog.Error("Cannot render the digest template", "tenant", d.tenantID, "err", err)
+			if subject, body, err = renderEmail(builtInEmailTemplate(emailDigest), data); err != nil {
+				slog.Error("Cannot render the built-in digest", "err", err)
+				continue
+			}
+		}
+		sendEmailOrDeadLetter(emailMessage{To: d.to, FromName: d.fromName, Subject: subject, Body: body, Unsubscribe: unsubscribe}, emailDigest+"/"+randomHex(8))
+	}
+}
+
+// studentNotificationPreferencesHandler serves GET and PUT
+// /students/{student}/notification-preferences, for the student and admins.
+func studentNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	key := studentKey(r.PathValue("student"))
+	if r.Method == http.MethodGet || r.Method == http.MethodPut {
+		if !allowStudentAccess(w, r, key, "only the student and admins can see or change a student's notification preferences") {
+			return
+		}
+	}
+	switch r.Method {
+	case http.MethodGet:
+		digestMu.Lock()
+		pref := notificationPrefs[key]
+		digestMu.Unlock()
+		if pref == "" {
+			pref = digestImmediate
+		}
+		writeValue(w, r, http.StatusOK, notificationPreferences{Digest: pref})
+	case http.MethodPut:
+		var req notificationPreferences
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		if _, ok := digestPeriods[req.Digest]; !ok {
+			writeError(w, r, "digest must be immediate, hourly or daily", http.StatusBadRequest)
+			return
+		}
+		digestMu.Lock()
+		if req.Digest == digestImmediate {
+			delete(notificationPrefs, key)
+		} else {
+			notificationPrefs[key] = req.Digest
+		}
+		digestMu.Unlock()
+		writeValue(w, r, http.StatusOK, req)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ผู้เรียนเลือกรับอีเมลแบบรวบยอด (digest) รายชั่วโมงหรือรายวัน แทนการได้ทุกฉบับทันที ลดอีเมลรกและปริมาณ SMTP
+
+	1. `PUT /students/{student}/notification-preferences` ด้วย `{"digest": "immediate" | "hourly" | "daily"}` (ค่าเริ่มต้น immediate)
+	   - อ่านหรือเปลี่ยนได้เฉพาะตัวผู้เรียนเองกับ admin เหมือน dashboard (ไม่มี credential ได้ 401, คนอื่นได้ 403)
+	2. อีเมลที่ render แล้วของคนที่เลือก digest ถูกเก็บไว้แทนการส่ง แยกกองตาม tenant (เพราะแต่ละ tenant มี branding ของตัวเอง)
+	3. job ตรวจทุกนาที กองไหนครบหนึ่งรอบ (ชั่วโมง/วัน) นับจากฉบับแรก ก็ส่งรวมเป็นอีเมลฉบับเดียวด้วย template `digest` ของ tenant
+	   - template `digest` แก้ได้เหมือนแบบอื่น ใช้ `{{range .Items}}` วนรายการ (`Subject`, `Body`, `At`, `Kind`)
+	   - template เสีย fallback เป็นข้อความตั้งต้น ไม่ให้รายการหาย
+	4. เปลี่ยนกลับเป็น immediate แล้ว ของที่ค้างอยู่ถูกส่งในรอบตรวจถัดไป
+*/
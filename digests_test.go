@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNotificationPreferencesAccess(t *testing.T) {
+	h := newTestServer(t, nil)
+	bob, eve := testToken(t, "bob@example.com", roleStudent), testToken(t, "eve@example.com", roleStudent)
+	instructor, admin := testToken(t, "ann", roleInstructor), testToken(t, "root", roleAdmin)
+
+	for _, tt := range []struct {
+		name, method, token, body string
+		want                      int
+	}{
+		{"anonymous read", http.MethodGet, "", "", http.StatusUnauthorized},
+		{"anonymous change", http.MethodPut, "", `{"digest": "daily"}`, http.StatusUnauthorized},
+		{"another student reads", http.MethodGet, eve, "", http.StatusForbidden},
+		{"another student changes", http.MethodPut, eve, `{"digest": "daily"}`, http.StatusForbidden},
+		{"instructor changes", http.MethodPut, instructor, `{"digest": "daily"}`, http.StatusForbidden},
+		{"student changes", http.MethodPut, bob, `{"digest": "hourly"}`, http.StatusOK},
+		{"student reads", http.MethodGet, bob, "", http.StatusOK},
+		{"admin changes", http.MethodPut, admin, `{"digest": "daily"}`, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(h, tt.method, "example.com", "/students/Bob@Example.com/notification-preferences", tt.token, tt.body)
+			if w.Code != tt.want {
+				t.Errorf("%s = %d %s, want %d", tt.method, w.Code, w.Body, tt.want)
+			}
+		})
+	}
+	digestMu.Lock()
+	defer digestMu.Unlock()
+	if got := notificationPrefs["bob@example.com"]; got != "daily" {
+		t.Errorf("preference = %q, want daily", got)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The availability TTL lets browsers and CDNs absorb bursts of polling
+// during a launch while keeping the numbers close to live. It is sent both
+// as Cache-Control and in the body for clients that poll.
+const (
+	availabilityTTL          = 2 * time.Second
+	availabilityCacheControl = "public, max-age=2"
+)
+
+type enrollment struct {
+	Student    string    `json:"student"`
+	Status     string    `json:"status"` // "enrolled" or "waitlisted"
+	EnrolledAt time.Time `json:"enrolled_at"`
+	// ExpiresAt is when access ends; nil for waitlisted students and for
+	// courses with lifetime access.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	reminded bool // an expiry reminder was sent for the current ExpiresAt
+}
+
+// courseEnrollments holds the roster of one course. Seats come from the
+// course itself; anyone past capacity waits in FIFO order.
+type courseEnrollments struct {
+	enrolled []enrollment
+	waitlist []enrollment
+}
+
+// enrollments is keyed by course ID and protected by courseMu, so seat
+// counts always agree with the course's capacity at the time of the change.
+var enrollments = make(map[int]*courseEnrollments)
+
+// studentKey is how rosters name a student: trimmed and lower-cased, so
+// that "Ann" and "ann", whom isStudent takes for the same caller, hold one
+// seat between them.
+func studentKey(student string) string {
+	return strings.ToLower(strings.TrimSpace(student))
+}
+
+func (e *courseEnrollments) has(student string) bool {
+	student = studentKey(student)
+	match := func(en enrollment) bool { return en.Student == student }
+	return slices.ContainsFunc(e.enrolled, match) || slices.ContainsFunc(e.waitlist, match)
+}
+
+// promote fills free seats of c from the head of the waitlist. The access
+// window of a promoted student starts when they get the seat.
+func (e *courseEnrollments) promote(c course) {
+	now := time.Now().UTC()
+	for len(e.waitlist) > 0 && (c.Seats == 0 || len(e.enrolled) < c.Seats) {
+		next := e.waitlist[0]
+		e.waitlist = e.waitlist[1:]
+		next.Status = "enrolled"
+		next.ExpiresAt = accessExpiry(c, now)
+		e.enrolled = append(e.enrolled, next)
+		queueEnrollmentEmail(c, next)
+	}
+}
+
+// queueEnrollmentEmail tells en's student that they are enrolled in or
+// waitlisted for c.
+func queueEnrollmentEmail(c course, en enrollment) {
+	queueEmail(c.Tenant, emailEnrollmentConfirmation, en.Student, map[string]any{
+		"Student":    en.Student,
+		"CourseID":   c.CourseId,
+		"CourseName": c.CourseName,
+		"Status":     en.Status,
+		"EnrolledAt": en.EnrolledAt,
+		"ExpiresAt":  en.ExpiresAt,
+	})
+}
+
+// isStudent reports whether the caller behind r, who, is student, by
+// subject or by the email of their credentials.
+func isStudent(r *http.Request, who principal, student string) bool {
+	return student != "" && (strings.EqualFold(who.Subject, student) || strings.EqualFold(viewerEmail(r), student))
+}
+
+// allowEnrollmentAccess reports whether the caller behind r may act on
+// student's enrollment in c, and answers r if not. Admins and c's owners
+// may act on anyone's; with self, students may act on their own. Callers
+// hold courseMu.
+func allowEnrollmentAccess(w http.ResponseWriter, r *http.Request, c course, student string, self bool) bool {
+	who := requestPrincipal(r)
+	if self && isStudent(r, who, student) {
+		return true
+	}
+	err := who.mayManageEnrollments(c)
+	switch {
+	case err == nil:
+		return true
+	case who.Role == "":
+		writeUnauthorized(w, r, errNoToken)
+	default:
+		writeError(w, r, "Forbidden: "+err.Error(), http.StatusForbidden)
+	}
+	return false
+}
+
+// allowStudentAccess reports whether the caller behind r is student or an
+// admin, and answers r if not. forbidden ends the 403 message.
+func allowStudentAccess(w http.ResponseWriter, r *http.Request, student, forbidden string) bool {
+	who := requestPrincipal(r)
+	switch {
+	case isStudent(r, who, student) || who.Role == roleAdmin:
+		return true
+	case who.Role == "":
+		writeUnauthorized(w, r, errNoToken)
+	default:
+		writeError(w, r, "Forbidden: "+forbidden, http.StatusForbidden)
+	}
+	return false
+}
+
+type availability struct {
+	CourseId   int  `json:"course_id"`
+	Seats      int  `json:"seats"`
+	Enrolled   int  `json:"enrolled"`
+	Remaining  *int `json:"remaining"` // null when the course has no seat limit
+	Waitlist   int  `json:"waitlist"`
+	TTLSeconds int  `json:"ttl_seconds"`
+}
+
+// courseEnrollmentsHandler serves POST /courses/{id}/enrollments. The
+// student gets a seat if one is free and is waitlisted otherwise. Students
+// enroll themselves; admins and the course's owners may enroll anyone.
+func courseEnrollmentsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Student    string `json:"student"`
+		InviteCode string `json:"invite_code"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	req.Student = studentKey(req.Student)
+	if req.Student == "" {
+		writeError(w, r, "student is required", http.StatusBadRequest)
+		return
+	}
+
+	courseMu.Lock()
+	defer courseMu.Unlock()
+
+	i := findCourseIndex(id)
+	if i < 0 || !tenantOwns(r, CourseList[i]) {
+		writeError(w, r, "Course not found", http.StatusNotFound)
+		return
+	}
+	if !allowEnrollmentAccess(w, r, CourseList[i], req.Student, true) {
+		return
+	}
+	roster := enrollments[id]
+	if roster == nil {
+		roster = &courseEnrollments{}
+		enrollments[id] = roster
+	}
+	if roster.has(req.Student) {
+		writeError(w, r, "Student is already enrolled or waitlisted", http.StatusConflict)
+		return
+	}
+
+	c := CourseList[i]
+	if req.InviteCode == "" {
+		req.InviteCode = requestInviteCode(r)
+	}
+	// A rejected student is told the course is private rather than missing,
+	// since they evidently know its ID.
+	if !admitStudent(c, req.Student, req.InviteCode) {
+		writeError(w, r, "This course is private; a valid invite code is required", http.StatusForbidden)
+		return
+	}
+	en := enrollment{Student: req.Student, Status: "enrolled", EnrolledAt: time.Now().UTC()}
+	if c.Seats > 0 && len(roster.enrolled) >= c.Seats {
+		en.Status = "waitlisted"
+		roster.waitlist = append(roster.waitlist, en)
+	} else {
+		en.ExpiresAt = accessExpiry(c, en.EnrolledAt)
+		roster.enrolled = append(roster.enrolled, en)
+	}
+	queueEnrollmentEmail(c, en)
+	writeValue(w, r, http.StatusCreated, en)
+}
+
+// courseEnrollmentHandler serves DELETE /courses/{id}/enrollments/{student},
+// for the student or the course's admins and owners. A freed seat goes to
+// the first student on the waitlist.
+func courseEnrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	student := studentKey(r.PathValue("student"))
+
+	courseMu.Lock()
+	defer courseMu.Unlock()
+
+	i := findCourseIndex(id)
+	roster := enrollments[id]
+	if i < 0 || !tenantOwns(r, CourseList[i]) || roster == nil || !roster.has(student) {
+		writeError(w, r, "Enrollment not found", http.StatusNotFound)
+		return
+	}
+	if !allowEnrollmentAccess(w, r, CourseList[i], student, true) {
+		return
+	}
+	match := func(en enrollment) bool { return en.Student == student }
+	roster.enrolled = slices.DeleteFunc(roster.enrolled, match)
+	roster.waitlist = slices.DeleteFunc(roster.waitlist, match)
+	roster.promote(CourseList[i])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// courseAvailabilityHandler serves GET /courses/{id}/availability. It only
+// reads counts, so it is cheap enough to poll, and says how long the answer
+// may be cached.
+func courseAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	courseMu.RLock()
+	i := findCourseIndex(id)
+	// Private courses look missing to anyone without access, as on
+	// GET /courses/{id}.
+	if i < 0 || !canViewCourse(r, CourseList[i]) {
+		courseMu.RUnlock()
+		writeError(w, r, "Course not found", http.StatusNotFound)
+		return
+	}
+	private := CourseList[i].Private
+	a := availability{CourseId: id, Seats: CourseList[i].Seats, TTLSeconds: int(availabilityTTL.Seconds())}
+	if roster := enrollments[id]; roster != nil {
+		a.Enrolled, a.Waitlist = len(roster.enrolled), len(roster.waitlist)
+	}
+	courseMu.RUnlock()
+	if a.Seats > 0 {
+		remaining := max(a.Seats-a.Enrolled, 0)
+		a.Remaining = &remaining
+	}
+
+	if private {
+		w.Header().Set("Cache-Control", privateCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", availabilityCacheControl)
+	}
+	writeValue(w, r, http.StatusOK, a)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: การลงทะเบียนเรียนและการดูที่นั่งว่าง
+
+	1. course มี `seats` กำหนดจำนวนที่นั่ง (0 = ไม่จำกัด) ถ้าเต็มแล้ว `POST /courses/{id}/enrollments` จะนำผู้เรียนไปต่อคิว waitlist
+	2. เมื่อมีคนยกเลิก (`DELETE /courses/{id}/enrollments/{student}`) ที่นั่งว่างจะถูกมอบให้คนแรกใน waitlist (FIFO)
+	3. `GET /courses/{id}/availability` คืนค่าที่นั่งคงเหลือ, จำนวนคนใน waitlist และ `ttl_seconds`
+	   - ส่ง `Cache-Control: max-age=2` ไปด้วย ทำให้ browser/CDN ช่วยรับภาระตอนมีคนกดดูพร้อมกันจำนวนมาก
+	   - course private ที่ผู้เรียกไม่มีสิทธิ์ดูได้ 404 เหมือน `GET /courses/{id}` ส่วนคนที่ดูได้ได้ `Cache-Control: private, no-store`
+	4. ชื่อผู้เรียนถูกเก็บเป็นตัวพิมพ์เล็กที่ตัดช่องว่างแล้ว (`studentKey`) `Ann` กับ `ann` จึงเป็นคนเดียวกันและได้ที่นั่งเดียว
+	5. ข้อมูลการลงทะเบียนถูกป้องกันด้วย `courseMu` ตัวเดียวกับ `CourseList` การนับที่นั่งจึงถูกต้องเสมอ (transactional)
+*/
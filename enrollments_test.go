@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestEnrollmentStudentKeys(t *testing.T) {
+	h := newTestServer(t, []course{{CourseId: 1, CourseName: "Go", CoursePrice: 100, Instructor: "Ann"}})
+	student := testToken(t, "Bob@Example.com", roleStudent)
+
+	if w := serve(h, http.MethodPost, "example.com", "/courses/1/enrollments", student, `{"student": "Bob@Example.com"}`); w.Code != http.StatusCreated {
+		t.Fatalf("enroll = %d %s, want 201", w.Code, w.Body)
+	}
+	for _, name := range []string{"bob@example.com", " BOB@EXAMPLE.COM "} {
+		if w := serve(h, http.MethodPost, "example.com", "/courses/1/enrollments", student, `{"student": "`+name+`"}`); w.Code != http.StatusConflict {
+			t.Errorf("enroll %q again = %d %s, want 409", name, w.Code, w.Body)
+		}
+	}
+	if w := serve(h, http.MethodDelete, "example.com", "/courses/1/enrollments/bob@EXAMPLE.com", student, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("unenroll = %d %s, want 204", w.Code, w.Body)
+	}
+	courseMu.RLock()
+	defer courseMu.RUnlock()
+	if roster := enrollments[1]; roster != nil && roster.has("bob@example.com") {
+		t.Errorf("roster still has the student: %+v", roster)
+	}
+}
+
+func TestCourseAvailabilityVisibility(t *testing.T) {
+	h := newTestServer(t, []course{
+		{CourseId: 1, CourseName: "Main", CoursePrice: 100, Instructor: "Ann", Seats: 10},
+		{CourseId: 2, CourseName: "Acme", CoursePrice: 100, Instructor: "Ann", Tenant: "acme"},
+		{CourseId: 3, CourseName: "Private", CoursePrice: 100, Instructor: "Ann", Private: true},
+	})
+	courseInvites[3] = &courseAccessList{allowlist: []string{"bob@example.com"}}
+	bob, eve := testToken(t, "bob@example.com", roleStudent), testToken(t, "eve@example.com", roleStudent)
+
+	for _, tt := range []struct {
+		name, host, target, token string
+		want                      int
+		cacheControl              string
+	}{
+		{"public course", "example.com", "/courses/1/availability", "", http.StatusOK, availabilityCacheControl},
+		{"tenant's course on the main site", "example.com", "/courses/2/availability", "", http.StatusOK, availabilityCacheControl},
+		{"tenant's own course", "acme.test", "/courses/2/availability", "", http.StatusOK, availabilityCacheControl},
+		{"another tenant's course", "acme.test", "/courses/1/availability", "", http.StatusNotFound, ""},
+		{"missing course", "example.com", "/courses/9/availability", "", http.StatusNotFound, ""},
+		{"private course, anonymous", "example.com", "/courses/3/availability", "", http.StatusNotFound, ""},
+		{"private course, not allowed", "example.com", "/courses/3/availability", eve, http.StatusNotFound, ""},
+		{"private course, allowlisted", "example.com", "/courses/3/availability", bob, http.StatusOK, privateCacheControl},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(h, http.MethodGet, tt.host, tt.target, tt.token, "")
+			if w.Code != tt.want {
+				t.Fatalf("GET %s on %s = %d %s, want %d", tt.target, tt.host, w.Code, w.Body, tt.want)
+			}
+			if cc := w.Header().Get("Cache-Control"); tt.cacheControl != "" && cc != tt.cacheControl {
+				t.Errorf("Cache-Control = %q, want %q", cc, tt.cacheControl)
+			}
+		})
+	}
+}
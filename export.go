@@ -0,0 +1,443 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The warehouse export lets analytics load courses, enrollments, orders and
+// the status page's history (status.go) without calling the API. With
+// EXPORT_DIR set, every EXPORT_INTERVAL (default 1h) the rows that changed
+// since the previous run are written as gzipped CSV, one file per table,
+// and listed in manifest.json. Files are never rewritten, so a loader can
+// copy whatever batches it has not seen yet.
+//
+// Each row starts with the batch number and an op, "upsert" or "delete";
+// the latest row for a key wins. The first run after a start exports every
+// row, since what was exported before is not remembered; loading it again
+// is harmless for the same reason.
+//
+// EXPORT_DIR is a local directory; point it at a mounted bucket, or sync
+// it to one, to publish the files.
+
+const exportManifestName = "manifest.json"
+
+var (
+	exportDir      = os.Getenv("EXPORT_DIR")
+	exportInterval = time.Hour
+)
+
+func init() {
+	if v := os.Getenv("EXPORT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid EXPORT_INTERVAL %q: must be a positive duration", v)
+		}
+		exportInterval = d
+	}
+}
+
+// exportTable describes one exported table. The first keyColumns columns
+// identify a row.
+type exportTable struct {
+	name       string
+	columns    []string
+	keyColumns int
+	snapshot   func() [][]string
+}
+
+var exportTables = []exportTable{
+	{
+		name:       "courses",
+		columns:    []string{"id", "name", "price", "instructor", "seats", "access_days", "private", "price_book", "metadata"},
+		keyColumns: 1,
+		snapshot:   exportCourses,
+	},
+	{
+		name:       "enrollments",
+		columns:    []string{"course_id", "student", "status", "enrolled_at", "expires_at"},
+		keyColumns: 2,
+		snapshot:   exportEnrollments,
+	},
+	{
+		name:       "orders",
+		columns:    []string{"id", "course_id", "instructor", "amount", "currency", "paid_at", "refunded_at"},
+		keyColumns: 1,
+		snapshot:   exportOrders,
+	},
+	{
+		name:       "health_checks",
+		columns:    []string{"component", "hour", "checks", "failures"},
+		keyColumns: 2,
+		snapshot:   exportHealthChecks,
+	},
+	{
+		name:       "incidents",
+		columns:    []string{"id", "title", "status", "components", "updates", "created_at", "resolved_at"},
+		keyColumns: 1,
+		snapshot:   exportIncidents,
+	},
+}
+
+func exportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func exportJSON(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return ""
+	}
+	return string(b)
+}
+
+func exportCourses() [][]string {
+	courseMu.RLock()
+	defer courseMu.RUnlock()
+	rows := make([][]string, 0, len(CourseList))
+	for _, c := range CourseList {
+		if c.Tenant == probeTenantID {
+			continue
+		}
+		rows = append(rows, exportCourseRow(c))
+	}
+	return rows
+}
+
+// exportCourseRow is c in the courses table's columns.
+func exportCourseRow(c course) []string {
+	return []string{
+		strconv.Itoa(c.CourseId), c.CourseName, strconv.Itoa(c.CoursePrice), c.Instructor,
+		strconv.Itoa(c.Seats), strconv.Itoa(c.AccessDays), strconv.FormatBool(c.Private),
+		exportJSON(c.PriceBook), exportJSON(c.Metadata),
+	}
+}
+
+func exportEnrollments() [][]string {
+	courseMu.RLock()
+	defer courseMu.RUnlock()
+	var rows [][]string
+	for _, c := range CourseList {
+		roster := enrollments[c.CourseId]
+		if roster == nil {
+			continue
+		}
+		for _, en := range slices.Concat(roster.enrolled, roster.waitlist) {
+			rows = append(rows, []string{strconv.Itoa(c.CourseId), en.Student, en.Status, exportTime(&en.EnrolledAt), exportTime(en.ExpiresAt)})
+		}
+	}
+	return rows
+}
+
+func exportOrders() [][]string {
+	payoutMu.Lock()
+	defer payoutMu.Unlock()
+	rows := make([][]string, 0, len(orders))
+	for _, o := range orders {
+		rows = append(rows, []string{
+			strconv.Itoa(o.ID), strconv.Itoa(o.CourseID), o.Instructor, strconv.Itoa(o.Amount), o.Currency,
+			exportTime(&o.PaidAt), exportTime(o.RefundedAt),
+		})
+	}
+	return rows
+}
+
+type exportFile struct {
+	Table   string   `json:"table"`
+	Key     string   `json:"key"` // path relative to EXPORT_DIR
+	Columns []string `json:"columns"`
+	Rows    int      `json:"rows"`
+	Bytes   int64    `json:"bytes"`
+	SHA256  string   `json:"sha256"`
+}
+
+type exportBatch struct {
+	Batch      int          `json:"batch"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Files      []exportFile `json:"files"`
+}
+
+type exportManifest struct {
+	Format  string        `json:"format"`
+	Batches []exportBatch `json:"batches"`
+}
+
+// warehouseExporter writes batches to dir. mu serializes runs.
+type warehouseExporter struct {
+	dir string
+
+	mu       sync.Mutex
+	manifest exportManifest
+	// exported holds, per table, a fingerprint of each row as last
+	// exported, keyed by its key columns.
+	exported map[string]map[string]string
+	lastRun  time.Time
+	lastErr  error
+}
+
+// activeExporter is nil unless EXPORT_DIR is set.
+var activeExporter *warehouseExporter
+
+// newWarehouseExporter opens dir, picking up the batch numbering of an
+// existing manifest.
+func newWarehouseExporter(dir string) (*warehouseExporter, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	e := &warehouseExporter{dir: dir, manifest: exportManifest{Format: "csv.gz", Batches: []exportBatch{}}, exported: map[string]map[string]string{}}
+	data, err := os.ReadFile(filepath.Join(dir, exportManifestName))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &e.manifest); err != nil {
+			return nil, fmt.Errorf("%s: %v", exportManifestName, err)
+		}
+	}
+	return e, nil
+}
+
+func (e *warehouseExporter) nextBatch() int {
+	if n := len(e.manifest.Batches); n > 0 {
+		return e.manifest.Batches[n-1].Batch + 1
+	}
+	return 1
+}
+
+// run exports what changed since the last run as a tracked job. It
+// returns nil if nothing did.
+func (e *warehouseExporter) run(now time.Time) (*exportBatch, error) {
+	j := trackJob(jobWarehouseExport, now.UTC().Format(time.RFC3339))
+	j.attempt()
+	batch, err := e.export(now)
+	j.done(err)
+	return batch, err
+}
+
+func (e *warehouseExporter) export(now time.Time) (*exportBatch, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastRun = now
+	batch := exportBatch{Batch: e.nextBatch(), ExportedAt: now.UTC()}
+	seen := map[string]map[string]string{}
+	for _, t := range exportTables {
+		rows, fingerprints := e.changedRows(t, batch.Batch)
+		seen[t.name] = fingerprints
+		if len(rows) == 0 {
+			continue
+		}
+		f, err := e.writeFile(t, batch, rows)
+		if err != nil {
+			e.lastErr = err
+			return nil, err
+		}
+		batch.Files = append(batch.Files, f)
+	}
+	if len(batch.Files) == 0 {
+		e.lastErr = nil
+		return nil, nil
+	}
+	e.manifest.Batches = append(e.manifest.Batches, batch)
+	if err := e.writeManifest(); err != nil {
+		// The batch files are orphans until a later manifest lists them;
+		// forget the batch so the next run exports those rows again.
+		e.manifest.Batches = e.manifest.Batches[:len(e.manifest.Batches)-1]
+		e.lastErr = err
+		return nil, err
+	}
+	e.exported = seen
+	e.lastErr = nil
+	return &batch, nil
+}
+
+// changedRows returns the CSV rows of t that differ from the last export,
+// deletions included, and the fingerprints of the current rows.
+func (e *warehouseExporter) changedRows(t exportTable, batch int) ([][]string, map[string]string) {
+	prefix := []string{strconv.Itoa(batch)}
+	previous := e.exported[t.name]
+	current := map[string]string{}
+	var out [][]string
+	for _, row := range t.snapshot() {
+		key := strings.Join(row[:t.keyColumns], "\x1f")
+		sum := sha256.Sum256([]byte(strings.Join(row, "\x1f")))
+		fp := hex.EncodeToString(sum[:])
+		current[key] = fp
+		if previous[key] != fp {
+			out = append(out, slices.Concat(prefix, []string{"upsert"}, row))
+		}
+	}
+	var gone []string
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			gone = append(gone, key)
+		}
+	}
+	slices.Sort(gone)
+	for _, key := range gone {
+		row := make([]string, len(t.columns))
+		copy(row, strings.Split(key, "\x1f"))
+		out = append(out, slices.Concat(prefix, []string{"delete"}, row))
+	}
+	return out, current
+}
+
+// writeFile writes rows as <table>/<batch>-<time>.csv.gz. The file is
+// renamed into place once complete, so a half-written file never shows.
+func (e *warehouseExporter) writeFile(t exportTable, batch exportBatch, rows [][]string) (exportFile, error) {
+	key := fmt.Sprintf("%s/%06d-%s.csv.gz", t.name, batch.Batch, batch.ExportedAt.Format("20060102T150405Z"))
+	path := filepath.Join(e.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return exportFile{}, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".export-*")
+	if err != nil {
+		return exportFile{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(tmp, hash))
+	cw := csv.NewWriter(gz)
+	columns := slices.Concat([]string{"batch", "op"}, t.columns)
+	cw.Write(columns)
+	cw.WriteAll(rows)
+	if err := cw.Error(); err != nil {
+		tmp.Close()
+		return exportFile{}, err
+	}
+	if err := gz.Close(); err != nil {
+		tmp.Close()
+		return exportFile{}, err
+	}
+	size, _ := tmp.Seek(0, io.SeekCurrent)
+	if err := tmp.Close(); err != nil {
+		return exportFile{}, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return exportFile{}, err
+	}
+	return exportFile{Table: t.name, Key: key, Columns: columns, Rows: len(rows), Bytes: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func (e *warehouseExporter) writeManifest() error {
+	data, err := json.MarshalIndent(e.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(e.dir, ".manifest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(e.dir, exportManifestName))
+}
+
+// runWarehouseExports exports every interval until the process exits,
+// starting with a full export.
+func runWarehouseExports(e *warehouseExporter, interval time.Duration) {
+	for {
+		batch, err := e.run(time.Now())
+		switch {
+		case err != nil:
+			slog.Error("Warehouse export failed", "err", err)
+		case batch != nil:
+			rows := 0
+			for _, f := range batch.Files {
+				rows += f.Rows
+			}
+			slog.Info("Warehouse export", "batch", batch.Batch, "rows", rows, "files", len(batch.Files))
+		}
+		time.Sleep(interval)
+	}
+}
+
+// adminExportsHandler serves GET /admin/exports, the manifest and the state
+// of the last run, and POST /admin/exports, which runs an export now. POST
+// answers 201 with the new batch, or 204 if nothing changed.
+func adminExportsHandler(w http.ResponseWriter, r *http.Request) {
+	e := activeExporter
+	if e == nil {
+		if r.Method == http.MethodGet {
+			writeValue(w, r, http.StatusOK, map[string]any{"enabled": false})
+			return
+		}
+		writeError(w, r, "Exports are not enabled; set EXPORT_DIR", http.StatusConflict)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		e.mu.Lock()
+		resp := map[string]any{
+			"enabled":  true,
+			"dir":      e.dir,
+			"interval": exportInterval.String(),
+			"manifest": e.manifest,
+		}
+		if !e.lastRun.IsZero() {
+			resp["last_run"] = e.lastRun.UTC()
+		}
+		if e.lastErr != nil {
+			resp["last_error"] = e.lastErr.Error()
+		}
+		writeValue(w, r, http.StatusOK, resp)
+		e.mu.Unlock()
+
+	case http.MethodPost:
+		batch, err := e.run(time.Now())
+		if err != nil {
+			requestLogger(r).Error("Warehouse export failed", "err", err)
+			writeError(w, r, "Export failed", http.StatusInternalServerError)
+			return
+		}
+		if batch == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeValue(w, r, http.StatusCreated, batch)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ส่งออกข้อมูลให้ทีม analytics โหลดเข้า data warehouse โดยไม่ต้องยิง API
+
+	1. ตั้ง `EXPORT_DIR` แล้วทุก `EXPORT_INTERVAL` (ค่าเริ่มต้น 1 ชั่วโมง) จะเขียนไฟล์ CSV บีบอัด gzip ของ courses, enrollments และ orders
+	   - เขียนเฉพาะแถวที่เปลี่ยนตั้งแต่รอบก่อน (เทียบ fingerprint ของแต่ละแถว) แถวที่หายไปออกเป็น `op=delete`
+	   - ไฟล์ไม่ถูกเขียนทับ (append-only) ตั้งชื่อ `<table>/<batch>-<เวลา>.csv.gz`
+	2. `manifest.json` บอกทุก batch: ไฟล์, จำนวนแถว, ขนาด และ SHA-256 ให้ loader รู้ว่ายังไม่ได้โหลดอะไร
+	   - เขียนไฟล์ข้อมูลให้เสร็จก่อนแล้วค่อย rename manifest ผู้อ่านจึงไม่เห็นไฟล์ที่เขียนไม่ครบ
+	3. รอบแรกหลัง restart ส่งออกทั้งหมด เพราะไม่ได้จำว่าเคยส่งอะไรไป ฝั่ง warehouse ใช้แถวล่าสุดของแต่ละ key จึงไม่เสียหาย
+	4. ดูสถานะที่ `GET /admin/exports` และสั่งรันทันทีด้วย `POST /admin/exports`
+*/
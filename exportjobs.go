@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /courses pages a catalog; an export hands over all of it as one file
+// without holding a request open while the file is written. POST /exports
+// takes the filters GET /courses does (meta.* and sort) and a format, json
+// or csv, and answers 202 with the export's ID at once. A single worker
+// writes the file in the background into EXPORT_ARTIFACT_DIR, and GET
+// /exports/{id} reports progress and, once the export is ready, a
+// download_url. Webhooks that ask for the "export" event are sent
+// export.ready or export.failed, so nobody has to poll.
+//
+// The file is gzipped, one gzip member per exportBatchSize courses, which
+// any gunzip reads as one stream. After each member is flushed to disk the
+// export checkpoints how far it got; when a write fails the next attempt
+// truncates the file back to the checkpoint and carries on from there
+// rather than starting again.
+//
+// The download URL is signed with EXPORT_LINK_SECRET and stops working
+// after EXPORT_LINK_TTL (default 1h), so it can be handed to a browser or
+// a loader without credentials; GET /exports/{id} signs a fresh one each
+// time. Downloads support Range, so an interrupted one can be resumed.
+// The file itself is deleted EXPORT_ARTIFACT_TTL (default 24h) after it is
+// written. EXPORT_ARTIFACT_DIR is a local directory; as with EXPORT_DIR
+// (export.go), mount a bucket there to keep the files off the server's
+// disk.
+
+const (
+	maxQueuedExports    = 10
+	maxKeptExports      = 100
+	exportBatchSize     = 500
+	exportMaxAttempts   = 3
+	exportSweepInterval = time.Minute
+)
+
+// Export statuses.
+const (
+	exportQueued  = "queued"
+	exportRunning = "running"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+	exportExpired = "expired" // the file has been deleted
+)
+
+var (
+	exportArtifactDir = os.Getenv("EXPORT_ARTIFACT_DIR")
+	exportArtifactTTL = 24 * time.Hour
+	exportLinkTTL     = time.Hour
+	exportLinkSecret  = []byte(os.Getenv("EXPORT_LINK_SECRET"))
+)
+
+func init() {
+	if exportArtifactDir == "" {
+		exportArtifactDir = filepath.Join(os.TempDir(), "go-first-web-server-exports")
+	}
+	if v := os.Getenv("EXPORT_ARTIFACT_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			log.Fatalf("Invalid EXPORT_ARTIFACT_TTL %q: must be a duration of at least 1m", v)
+		}
+		exportArtifactTTL = d
+	}
+	if v := os.Getenv("EXPORT_LINK_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid EXPORT_LINK_TTL %q: must be a positive duration", v)
+		}
+		exportLinkTTL = d
+	}
+	if len(exportLinkSecret) == 0 {
+		exportLinkSecret = make([]byte, 32)
+		rand.Read(exportLinkSecret)
+	}
+}
+
+// courseExport is one export and its progress.
+type courseExport struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Format      string     `json:"format"`          // json or csv, gzipped
+	Query       string     `json:"query,omitempty"` // the filters, as GET /courses takes them
+	Total       int        `json:"total"`
+	Written     int        `json:"written"`
+	Size        int64      `json:"size,omitempty"` // bytes, once ready
+	Attempts    int        `json:"attempts"`
+	Error       string     `json:"error,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"` // when the file is deleted
+
+	who      principal
+	tenant   *tenant
+	filters  map[string][]string
+	sortKeys []courseSortKey
+	trace    traceContext
+	// offset is the size of the file up to the last checkpoint.
+	offset  int64
+	deleted bool
+}
+
+var (
+	// exportMu protects courseExports and every export in it.
+	exportMu      sync.Mutex
+	courseExports []*courseExport // oldest first
+	exportQueue   = make(chan *courseExport, maxQueuedExports)
+)
+
+var errExportDeleted = errors.New("the export was deleted")
+
+// view is a copy of ex for a response, with a fresh download link when it
+// is ready. Callers must hold exportMu.
+func (ex *courseExport) view() courseExport {
+	v := *ex
+	if ex.Status == exportReady {
+		v.DownloadURL = exportDownloadURL(ex, time.Now())
+	}
+	return v
+}
+
+func (ex *courseExport) finished() bool {
+	return ex.FinishedAt != nil
+}
+
+// path is where ex's file is, and partial where it is while being written.
+func (ex *courseExport) path() string {
+	return filepath.Join(exportArtifactDir, ex.ID+"."+ex.Format+".gz")
+}
+
+func (ex *courseExport) partial() string {
+	return ex.path() + ".part"
+}
+
+func (ex *courseExport) removeFiles() {
+	os.Remove(ex.partial())
+	os.Remove(ex.path())
+}
+
+// exportLinkSignature signs a download link for export id that works until
+// expires, in Unix seconds.
+func exportLinkSignature(id string, expires int64) string {
+	mac := hmac.New(sha256.New, exportLinkSecret)
+	mac.Write([]byte(id + "." + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// exportDownloadURL is a signed link to ex's file, valid for exportLinkTTL
+// but never past the file's deletion. It is absolute on a tenant's domain
+// or with PUBLIC_URL set, and relative to the server otherwise.
+func exportDownloadURL(ex *courseExport, now time.Time) string {
+	expires := now.Add(exportLinkTTL)
+	if ex.ExpiresAt != nil && ex.ExpiresAt.Before(expires) {
+		expires = *ex.ExpiresAt
+	}
+	base := publicURL
+	if ex.tenant != nil {
+		base = "https://" + ex.tenant.Domains[0]
+	}
+	q := url.Values{
+		"expires":   {strconv.FormatInt(expires.Unix(), 10)},
+		"signature": {exportLinkSignature(ex.ID, expires.Unix())},
+	}
+	return base + "/exports/" + ex.ID + "/download?" + q.Encode()
+}
+
+// exportRecords encodes the courses ex covers, one record each, as they
+// are now and as the export's creator may see them.
+func exportRecords(ex *courseExport) ([][]byte, error) {
+	courseMu.RLock()
+	defer courseMu.RUnlock()
+	// publicCourses returns a copy, so filtering and sorting it in place
+	// leaves CourseList alone.
+	matched := slices.DeleteFunc(publicCourses(CourseList), func(c course) bool { return !catalogOwns(ex.tenant, c) })
+	matched = filterByMetadata(matched, ex.filters)
+	sortCourses(matched, ex.sortKeys)
+	records := make([][]byte, 0, len(matched))
+	for _, c := range coursesView(ex.who, matched) {
+		if ex.Format == "json" {
+			b, err := json.Marshal(c)
+			if err != nil {
+				return nil, fmt.Errorf("course %d: %v", c.CourseId, err)
+			}
+			records = append(records, b)
+			continue
+		}
+		var b bytes.Buffer
+		cw := csv.NewWriter(&b)
+		cw.Write(exportCourseRow(c))
+		cw.Flush()
+		records = append(records, b.Bytes())
+	}
+	return records, nil
+}
+
+// writeExportFile writes records to ex's partial file from the last
+// checkpoint on, a gzip member per batch, checkpointing after each.
+func writeExportFile(ex *courseExport, records [][]byte) error {
+	exportMu.Lock()
+	offset, start := ex.offset, ex.Written
+	exportMu.Unlock()
+
+	f, err := os.OpenFile(ex.partial(), os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Whatever is past the checkpoint is what the failed attempt left.
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	for {
+		end := min(start+exportBatchSize, len(records))
+		var member bytes.Buffer
+		gz := gzip.NewWriter(&member)
+		if start == 0 {
+			if ex.Format == "json" {
+				gz.Write([]byte("[\n"))
+			} else {
+				gz.Write([]byte(strings.Join(exportTables[0].columns, ",") + "\n"))
+			}
+		}
+		for i := start; i < end; i++ {
+			if ex.Format == "json" && i > 0 {
+				gz.Write([]byte(",\n"))
+			}
+			gz.Write(records[i])
+		}
+		if end == len(records) && ex.Format == "json" {
+			gz.Write([]byte("\n]\n"))
+		}
+		gz.Close()
+
+		if _, err := f.Write(member.Bytes()); err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		exportMu.Lock()
+		ex.offset += int64(member.Len())
+		ex.Written = end
+		deleted := ex.deleted
+		exportMu.Unlock()
+		if deleted {
+			return errExportDeleted
+		}
+		if end == len(records) {
+			return nil
+		}
+		start = end
+	}
+}
+
+// runExportJobs works through the queue, one export at a time.
+func runExportJobs() {
+	for ex := range exportQueue {
+		runExportJob(ex)
+	}
+}
+
+// runExportJob writes ex's file, resuming from its checkpoint up to
+// exportMaxAttempts times, and announces the outcome.
+func runExportJob(ex *courseExport) {
+	exportMu.Lock()
+	if ex.deleted {
+		exportMu.Unlock()
+		return
+	}
+	j := trackJob(jobCourseExport, ex.ID)
+	started := time.Now().UTC()
+	ex.Status, ex.StartedAt = exportRunning, &started
+	exportMu.Unlock()
+
+	records, err := exportRecords(ex)
+	exportMu.Lock()
+	ex.Total = len(records)
+	exportMu.Unlock()
+	for n := 1; err == nil; n++ {
+		j.attempt()
+		exportMu.Lock()
+		ex.Attempts = n
+		exportMu.Unlock()
+		err = writeExportFile(ex, records)
+		if err == nil || errors.Is(err, errExportDeleted) || n == exportMaxAttempts {
+			break
+		}
+		j.retrying(err)
+		exportMu.Lock()
+		slog.Warn("Course export stopped, resuming", "export", ex.ID, "written", ex.Written, "total", ex.Total, "err", err)
+		exportMu.Unlock()
+		time.Sleep(time.Second << (n - 1))
+		err = nil
+	}
+	if err == nil {
+		err = os.Rename(ex.partial(), ex.path())
+	}
+
+	exportMu.Lock()
+	now := time.Now().UTC()
+	ex.FinishedAt = &now
+	if ex.deleted {
+		ex.removeFiles()
+		exportMu.Unlock()
+		j.done(nil)
+		return
+	}
+	event := "export.ready"
+	if err != nil {
+		os.Remove(ex.partial())
+		ex.Status, ex.Error = exportFailed, err.Error()
+		event = "export.failed"
+		slog.Error("Course export failed", "export", ex.ID, "err", err)
+	} else {
+		expires := now.Add(exportArtifactTTL)
+		ex.Status, ex.Size, ex.ExpiresAt = exportReady, ex.offset, &expires
+		slog.Info("Course export ready", "export", ex.ID, "courses", ex.Total, "bytes", ex.Size)
+	}
+	view := ex.view()
+	exportMu.Unlock()
+	j.done(err)
+	dispatchExportWebhooks(event, view, ex.trace)
+}
+
+// runExportSweeper deletes expired files every interval.
+func runExportSweeper(interval time.Duration) {
+	sweepExports(time.Now())
+	for range time.Tick(interval) {
+		sweepExports(time.Now())
+	}
+}
+
+// sweepExports deletes the files of exports that have expired, and files
+// of exports this process does not know, such as those a previous run
+// left, once they are older than exportArtifactTTL.
+func sweepExports(now time.Time) {
+	exportMu.Lock()
+	defer exportMu.Unlock()
+	known := map[string]bool{}
+	for _, ex := range courseExports {
+		if ex.Status == exportReady && now.After(*ex.ExpiresAt) {
+			os.Remove(ex.path())
+			ex.Status = exportExpired
+		}
+		known[filepath.Base(ex.path())] = true
+		known[filepath.Base(ex.partial())] = true
+	}
+	entries, err := os.ReadDir(exportArtifactDir)
+	if err != nil {
+		slog.Error("Error listing EXPORT_ARTIFACT_DIR", "err", err)
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if known[name] || !strings.HasSuffix(name, ".gz") && !strings.HasSuffix(name, ".gz.part") {
+			continue
+		}
+		if fi, err := e.Info(); err == nil && now.Sub(fi.ModTime()) > exportArtifactTTL {
+			os.Remove(filepath.Join(exportArtifactDir, name))
+		}
+	}
+}
+
+// exportsHandler serves POST /exports.
+func exportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	switch format {
+	case "":
+		format = "json"
+	case "json", "csv":
+	default:
+		writeError(w, r, "Invalid format "+strconv.Quote(format)+"; use json or csv", http.StatusBadRequest)
+		return
+	}
+	filters, err := metadataFilters(q, tenantMetadataRules(requestTenant(r)))
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sortKeys, err := parseCourseSort(q.Get("sort"), tenantMetadataRules(requestTenant(r)))
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := requestPrincipal(r).checkQueryFields(filters, sortKeys); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.Del("format")
+	ex := &courseExport{
+		ID:        randomHex(8),
+		Status:    exportQueued,
+		Format:    format,
+		Query:     q.Encode(),
+		CreatedAt: time.Now().UTC(),
+		who:       requestPrincipal(r),
+		tenant:    requestTenant(r),
+		filters:   filters,
+		sortKeys:  sortKeys,
+		trace:     requestTrace(r),
+	}
+	exportMu.Lock()
+	select {
+	case exportQueue <- ex:
+	default:
+		exportMu.Unlock()
+		w.Header().Set("Retry-After", "30")
+		writeError(w, r, "Too many exports are waiting; try again later", http.StatusServiceUnavailable)
+		return
+	}
+	courseExports = append(courseExports, ex)
+	finished := 0
+	for _, x := range courseExports {
+		if x.finished() {
+			finished++
+		}
+	}
+	for i := 0; finished > maxKeptExports && i < len(courseExports); {
+		if x := courseExports[i]; x.finished() {
+			x.removeFiles()
+			courseExports = slices.Delete(courseExports, i, i+1)
+			finished--
+		} else {
+			i++
+		}
+	}
+	view := ex.view()
+	exportMu.Unlock()
+
+	w.Header().Set("Location", "/exports/"+ex.ID)
+	writeValue(w, r, http.StatusAccepted, view)
+}
+
+// exportHandler serves GET /exports/{id}, the export's progress and its
+// download link, and DELETE, which cancels it and deletes its file. Either
+// needs the credentials course writes need, and anyone but an admin sees
+// only their own exports.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if err := authorizeCourseWrite(r); err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	who := requestPrincipal(r)
+	exportMu.Lock()
+	defer exportMu.Unlock()
+	i := slices.IndexFunc(courseExports, func(ex *courseExport) bool {
+		return ex.ID == r.PathValue("id") && (who.Role == roleAdmin || ex.who.Subject == who.Subject)
+	})
+	if i < 0 {
+		writeError(w, r, "Export not found", http.StatusNotFound)
+		return
+	}
+	ex := courseExports[i]
+	switch r.Method {
+	case http.MethodGet:
+		writeValue(w, r, http.StatusOK, ex.view())
+	case http.MethodDelete:
+		ex.deleted = true
+		courseExports = slices.Delete(courseExports, i, i+1)
+		// A running export deletes its own file when it next checkpoints.
+		if ex.Status != exportRunning {
+			ex.removeFiles()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// exportDownloadHandler serves GET /exports/{id}/download, the file of a
+// ready export. The signed link is the only credential it needs.
+func exportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, q := r.PathValue("id"), r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(q.Get("signature")), []byte(exportLinkSignature(id, expires))) {
+		writeError(w, r, "Forbidden: invalid download link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		writeError(w, r, "Forbidden: the download link has expired; GET /exports/"+id+" for a new one", http.StatusForbidden)
+		return
+	}
+	exportMu.Lock()
+	i := slices.IndexFunc(courseExports, func(ex *courseExport) bool { return ex.ID == id })
+	if i < 0 || courseExports[i].Status != exportReady {
+		exportMu.Unlock()
+		writeError(w, r, "Export not found", http.StatusNotFound)
+		return
+	}
+	ex := *courseExports[i]
+	// An open file can still be read after the sweeper deletes it.
+	f, err := os.Open(ex.path())
+	exportMu.Unlock()
+	if err != nil {
+		requestLogger(r).Error("Error opening export", "export", id, "err", err)
+		writeError(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="courses-`+id+"."+ex.Format+`.gz"`)
+	w.Header().Set("ETag", `"`+id+`"`)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, "", *ex.FinishedAt, f)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: export course ทั้ง catalog เป็นไฟล์แบบ async แล้วให้ดาวน์โหลดผ่านลิงก์ที่เซ็นไว้ ไฟล์หมดอายุและถูกลบเอง
+
+	1. `POST /exports?format=csv&meta.level=beginner&sort=price` ใช้ filter เดียวกับ GET `/courses` ตอบ 202 พร้อม ID แล้ว worker ตัวเดียวเขียนไฟล์เบื้องหลัง
+	   - คิวเต็ม (รอได้ 10) ตอบ 503 + `Retry-After`; ต้องมีสิทธิ์เขียน course เหมือน import
+	2. ไฟล์เป็น gzip แยก member ทีละ 500 course และ checkpoint หลัง flush ทุกครั้ง
+	   - เขียนพลาด: ตัดไฟล์กลับไปที่ checkpoint แล้วเขียนต่อจากตรงนั้น ลองได้ 3 ครั้ง ไม่เริ่มใหม่ทั้งไฟล์
+	3. `GET /exports/{id}` ดูความคืบหน้า พอเสร็จได้ `download_url` ที่เซ็นด้วย `EXPORT_LINK_SECRET` อายุ `EXPORT_LINK_TTL` (1 ชั่วโมง)
+	   - ดาวน์โหลดไม่ต้องมี credential อื่น รองรับ Range จึงดาวน์โหลดต่อจากที่ค้างได้
+	   - webhook ที่สมัคร event `export` ได้ `export.ready` / `export.failed` ไม่ต้อง poll
+	4. ไฟล์อยู่ใน `EXPORT_ARTIFACT_DIR` และถูกลบหลัง `EXPORT_ARTIFACT_TTL` (24 ชั่วโมง); `DELETE /exports/{id}` ยกเลิกและลบทันที
+*/
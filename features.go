@@ -0,0 +1,266 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feature gates soft-launch API changes: a new endpoint or response field
+// checks featureEnabled and stays off for everyone but the consumers its
+// gate is enabled for, so pilot partners can try it before it ships to
+// all. An admin sets a gate up with
+//
+//	PUT /admin/features/{gate}  {"description": "...", "consumers": ["tenant:acme", "api-key:3"]}
+//
+// A consumer is a tenant, as tenant:<id>, or the subject a request is
+// authenticated as: api-key:<id>, client:<id> (clients.go), cert:<name>
+// or the subject of a JWT or user. "everyone": true turns the gate on for
+// all once the change is launched, until the code stops checking it.
+// A gate nobody has set up is off. GET /me/features tells a consumer
+// which gates are on for it.
+//
+// Gates are kept in memory, like API keys.
+
+var featureGatePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+type featureGate struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Everyone    bool      `json:"everyone"`
+	Consumers   []string  `json:"consumers"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+var (
+	// featureMu protects featureGates, keyed by name.
+	featureMu    sync.Mutex
+	featureGates = map[string]*featureGate{}
+)
+
+// requestConsumers returns who r is made by, as gates name consumers.
+func requestConsumers(r *http.Request) []string {
+	var consumers []string
+	if t := requestTenant(r); t != nil {
+		consumers = append(consumers, "tenant:"+t.ID)
+	}
+	if who := authenticatedPrincipal(r); who.Subject != "" && who.Subject != systemPrincipal.Subject {
+		consumers = append(consumers, who.Subject)
+	}
+	return consumers
+}
+
+// featureEnabled reports whether gate is on for the consumer behind r.
+func featureEnabled(r *http.Request, gate string) bool {
+	featureMu.Lock()
+	defer featureMu.Unlock()
+	g := featureGates[gate]
+	if g == nil {
+		return false
+	}
+	if g.Everyone {
+		return true
+	}
+	return slices.ContainsFunc(requestConsumers(r), func(c string) bool { return slices.Contains(g.Consumers, c) })
+}
+
+// requireFeature answers 404 for next while gate is off for the caller,
+// so a soft-launched endpoint does not exist for anyone else.
+func requireFeature(gate string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !featureEnabled(r, gate) {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// myFeatures is the body of GET /me/features.
+type myFeatures struct {
+	Consumers []string `json:"consumers"` // who the request was taken to be
+	Features  []string `json:"features"`  // the gates on for them
+}
+
+// meFeaturesHandler serves GET /me/features, so a pilot partner can see
+// what is switched on for it.
+func meFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := myFeatures{Consumers: requestConsumers(r), Features: []string{}}
+	if resp.Consumers == nil {
+		resp.Consumers = []string{}
+	}
+	featureMu.Lock()
+	names := slices.Sorted(maps.Keys(featureGates))
+	featureMu.Unlock()
+	for _, name := range names {
+		if featureEnabled(r, name) {
+			resp.Features = append(resp.Features, name)
+		}
+	}
+	w.Header().Set("Cache-Control", "private, no-store")
+	writeValue(w, r, http.StatusOK, resp)
+}
+
+// checkConsumer returns what is wrong with naming c in a gate, or "" if
+// nothing is. Tenants, keys and clients must exist; any other subject is
+// taken as it is, since JWT subjects are not known in advance.
+func checkConsumer(c string) string {
+	kind, id, _ := strings.Cut(c, ":")
+	switch {
+	case strings.TrimSpace(c) == "" || c != strings.TrimSpace(c):
+		return "consumers must be non-empty and not padded"
+	case kind == "tenant" && tenantsByID[id] == nil:
+		return "Unknown tenant " + strconv.Quote(id)
+	case kind == "api-key":
+		n, err := strconv.Atoi(id)
+		apiKeyMu.Lock()
+		defer apiKeyMu.Unlock()
+		if err != nil || findAPIKey(n) == nil {
+			return "Unknown API key " + strconv.Quote(id)
+		}
+	case kind == "client":
+		clientMu.Lock()
+		defer clientMu.Unlock()
+		if findClient(id) == nil {
+			return "Unknown client " + strconv.Quote(id)
+		}
+	}
+	return ""
+}
+
+// view is g with its own consumer list. Callers hold featureMu.
+func (g *featureGate) view() featureGate {
+	v := *g
+	v.Consumers = slices.Clone(g.Consumers)
+	return v
+}
+
+// adminFeaturesHandler serves GET /admin/features: every gate, and for
+// each consumer the gates enabled for it by name. ?consumer= limits both
+// to one consumer.
+func adminFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	only := r.URL.Query().Get("consumer")
+	featureMu.Lock()
+	gates := []featureGate{}
+	consumers := map[string][]string{}
+	for _, name := range slices.Sorted(maps.Keys(featureGates)) {
+		g := featureGates[name]
+		if only != "" && !g.Everyone && !slices.Contains(g.Consumers, only) {
+			continue
+		}
+		gates = append(gates, g.view())
+		for _, c := range g.Consumers {
+			if only == "" || c == only {
+				consumers[c] = append(consumers[c], name)
+			}
+		}
+	}
+	featureMu.Unlock()
+	writeValue(w, r, http.StatusOK, map[string]any{"gates": gates, "consumers": consumers})
+}
+
+// adminFeatureHandler serves GET, PUT and DELETE /admin/features/{gate}.
+// PUT creates the gate or replaces its description, consumers and
+// everyone switch.
+func adminFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("gate")
+	switch r.Method {
+	case http.MethodGet:
+		featureMu.Lock()
+		g := featureGates[name]
+		var v featureGate
+		if g != nil {
+			v = g.view()
+		}
+		featureMu.Unlock()
+		if g == nil {
+			writeError(w, r, "Feature gate not found", http.StatusNotFound)
+			return
+		}
+		writeValue(w, r, http.StatusOK, v)
+
+	case http.MethodPut:
+		if !featureGatePattern.MatchString(name) {
+			writeError(w, r, "Gate names are lower-case letters, digits and dashes", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Description string   `json:"description"`
+			Everyone    bool     `json:"everyone"`
+			Consumers   []string `json:"consumers"`
+		}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		consumers := []string{}
+		for _, c := range req.Consumers {
+			if msg := checkConsumer(c); msg != "" {
+				writeError(w, r, msg, http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(consumers, c) {
+				consumers = append(consumers, c)
+			}
+		}
+		g := &featureGate{
+			Name:        name,
+			Description: strings.TrimSpace(req.Description),
+			Everyone:    req.Everyone,
+			Consumers:   consumers,
+			UpdatedAt:   time.Now().UTC(),
+		}
+		featureMu.Lock()
+		_, existed := featureGates[name]
+		featureGates[name] = g
+		v := g.view()
+		featureMu.Unlock()
+		requestLogger(r).Info("Feature gate set", "gate", name, "everyone", g.Everyone, "consumers", strings.Join(consumers, ","))
+		status := http.StatusOK
+		if !existed {
+			status = http.StatusCreated
+		}
+		writeValue(w, r, status, v)
+
+	case http.MethodDelete:
+		featureMu.Lock()
+		_, ok := featureGates[name]
+		delete(featureGates, name)
+		featureMu.Unlock()
+		if !ok {
+			writeError(w, r, "Feature gate not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: feature gate ผูกกับ API key / client / tenant เพื่อเปิด API ใหม่ให้ partner นำร่องก่อนเปิดให้ทุกคน
+
+	1. โค้ดของ endpoint หรือ field ใหม่เช็ค `featureEnabled(r, "<gate>")` หรือห่อ handler ด้วย `requireFeature` (ปิดอยู่ได้ 404 เหมือนไม่มี route)
+	2. admin ตั้ง gate ที่ `PUT /admin/features/{gate}` ระบุ consumer ที่เปิดให้
+	   - `tenant:<id>` ตาม domain ของ request
+	   - subject ที่ยืนยันตัวมา เช่น `api-key:3`, `client:svc_...`, `cert:<name>` หรือ subject ของ JWT
+	   - `everyone: true` เปิดให้ทุกคนเมื่อ launch แล้ว; gate ที่ยังไม่ได้ตั้งถือว่าปิด
+	3. consumer ดูเองได้ว่าเปิด gate อะไรให้ตัวเองบ้างที่ `GET /me/features`
+	4. `GET /admin/features` แสดงทุก gate พร้อมรายการว่า consumer ไหนเปิด gate อะไรบ้าง กรองด้วย `?consumer=` ได้
+	5. เก็บในหน่วยความจำเหมือน API key restart แล้วต้องตั้งใหม่
+*/
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Roles decide which courses a principal may change (rbac.go); field
+// permissions narrow that down to single fields. FIELD_PERMISSIONS_FILE is
+// a JSON array of rules:
+//
+//	[{"field": "metadata.cost", "visible_to": ["admin"]},
+//	 {"field": "price", "editable_by": ["admin"]}]
+//
+// A field with visible_to is left out of every course sent to anyone
+// without one of those roles, requests without credentials included; a
+// field with editable_by can only be set or changed by those roles. A
+// hidden field cannot be changed either. Fields without a rule are
+// governed by the role rules alone.
+//
+// Both are enforced in one place each: courseView maps every course a
+// transport sends (REST in every format, gRPC, GraphQL, the change feeds),
+// and the course service checks every write against the rules, so the
+// transports cannot disagree. A PUT that leaves out the fields its sender
+// cannot see keeps their values rather than clearing them.
+//
+// Only fields that every format can leave out can be hidden: seats,
+// access_days, price_book and metadata.<key>. name, price, instructor and
+// private can still be made read-only.
+
+// fieldRule is one entry of FIELD_PERMISSIONS_FILE.
+type fieldRule struct {
+	Field      string   `json:"field"`
+	VisibleTo  []string `json:"visible_to,omitempty"`
+	EditableBy []string `json:"editable_by,omitempty"`
+}
+
+var (
+	editableFields = []string{"name", "price", "instructor", "seats", "access_days", "price_book", "private"}
+	hideableFields = []string{"seats", "access_days", "price_book"}
+)
+
+// fieldRules are the rules by field; nil when none are configured.
+var fieldRules map[string]fieldRule
+
+func init() {
+	if name := os.Getenv("FIELD_PERMISSIONS_FILE"); name != "" {
+		rules, err := loadFieldRules(name)
+		if err != nil {
+			log.Fatalf("Invalid FIELD_PERMISSIONS_FILE: %v", err)
+		}
+		fieldRules = rules
+	}
+}
+
+func loadFieldRules(name string) (map[string]fieldRule, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var list []fieldRule
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	rules := map[string]fieldRule{}
+	for _, rule := range list {
+		key, isMeta := strings.CutPrefix(rule.Field, "metadata.")
+		switch {
+		case isMeta && !metadataKeyPattern.MatchString(key):
+			return nil, fmt.Errorf("invalid metadata key %q", key)
+		case !isMeta && !slices.Contains(editableFields, rule.Field):
+			return nil, fmt.Errorf("unknown field %q; use %s or metadata.<key>", rule.Field, strings.Join(editableFields, ", "))
+		case !isMeta && rule.VisibleTo != nil && !slices.Contains(hideableFields, rule.Field):
+			return nil, fmt.Errorf("field %q is in every course and cannot be hidden, only made read-only", rule.Field)
+		case rule.VisibleTo == nil && rule.EditableBy == nil:
+			return nil, fmt.Errorf("field %q needs visible_to, editable_by or both", rule.Field)
+		}
+		if _, dup := rules[rule.Field]; dup {
+			return nil, fmt.Errorf("field %q has more than one rule", rule.Field)
+		}
+		for _, role := range slices.Concat(rule.VisibleTo, rule.EditableBy) {
+			if !slices.Contains(roles, role) {
+				return nil, fmt.Errorf("field %q: unknown role %q; use %s", rule.Field, role, strings.Join(roles, ", "))
+			}
+		}
+		rules[rule.Field] = rule
+	}
+	return rules, nil
+}
+
+// fieldVisible reports whether p may see field.
+func (p principal) fieldVisible(field string) bool {
+	rule, ok := fieldRules[field]
+	return !ok || rule.VisibleTo == nil || slices.Contains(rule.VisibleTo, p.Role)
+}
+
+// fieldEditable reports whether p may set or change field, as far as the
+// field rules go.
+func (p principal) fieldEditable(field string) bool {
+	rule := fieldRules[field]
+	return p.fieldVisible(field) && (rule.EditableBy == nil || slices.Contains(rule.EditableBy, p.Role))
+}
+
+// seesHiddenFields reports whether p sees a field that a request without
+// credentials does not, so what p is sent must not be cached for others.
+func (p principal) seesHiddenFields() bool {
+	for field := range fieldRules {
+		if p.fieldVisible(field) && !(principal{}).fieldVisible(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// courseView is c as p may see it, with the fields hidden from p removed.
+// c's own maps are left alone.
+func courseView(p principal, c course) course {
+	cloned := false
+	for field := range fieldRules {
+		if p.fieldVisible(field) {
+			continue
+		}
+		switch field {
+		case "seats":
+			c.Seats = 0
+		case "access_days":
+			c.AccessDays = 0
+		case "price_book":
+			c.PriceBook = nil
+		default:
+			key := strings.TrimPrefix(field, "metadata.")
+			if _, ok := c.Metadata[key]; !ok {
+				continue
+			}
+			if !cloned {
+				c.Metadata, cloned = maps.Clone(c.Metadata), true
+			}
+			delete(c.Metadata, key)
+		}
+	}
+	if cloned && len(c.Metadata) == 0 {
+		c.Metadata = nil
+	}
+	return c
+}
+
+func coursesView(p principal, courses []course) []course {
+	if fieldRules == nil {
+		return courses
+	}
+	out := make([]course, len(courses))
+	for i, c := range courses {
+		out[i] = courseView(p, c)
+	}
+	return out
+}
+
+// keepHiddenFields gives updated current's values of the fields hidden
+// from p, which p could not have sent back.
+func keepHiddenFields(p principal, current course, updated *course) {
+	for field := range fieldRules {
+		if !p.fieldVisible(field) {
+			copyField(updated, current, field)
+		}
+	}
+}
+
+// mayChangeFields checks a write from current to updated, course{} for a
+// new course, against the field rules.
+func (p principal) mayChangeFields(current, updated course, verb string) error {
+	for _, field := range slices.Sorted(maps.Keys(fieldRules)) {
+		if fieldChanged(current, updated, field) && !p.fieldEditable(field) {
+			return &forbiddenError{msg: fmt.Sprintf("%ss cannot %s %s", p.Role, verb, field)}
+		}
+	}
+	return nil
+}
+
+func fieldChanged(a, b course, field string) bool {
+	switch field {
+	case "name":
+		return a.CourseName != b.CourseName
+	case "price":
+		return a.CoursePrice != b.CoursePrice
+	case "instructor":
+		return a.Instructor != b.Instructor
+	case "seats":
+		return a.Seats != b.Seats
+	case "access_days":
+		return a.AccessDays != b.AccessDays
+	case "price_book":
+		return !slices.Equal(a.PriceBook, b.PriceBook)
+	case "private":
+		return a.Private != b.Private
+	}
+	// Metadata values are scalars, so they compare with !=.
+	key := strings.TrimPrefix(field, "metadata.")
+	av, aok := a.Metadata[key]
+	bv, bok := b.Metadata[key]
+	return aok != bok || av != bv
+}
+
+// copyField sets dst's field to src's. Only hideable fields are copied.
+func copyField(dst *course, src course, field string) {
+	switch field {
+	case "seats":
+		dst.Seats = src.Seats
+	case "access_days":
+		dst.AccessDays = src.AccessDays
+	case "price_book":
+		dst.PriceBook = slices.Clone(src.PriceBook)
+	default:
+		key := strings.TrimPrefix(field, "metadata.")
+		v, ok := src.Metadata[key]
+		switch {
+		case ok && dst.Metadata == nil:
+			dst.Metadata = map[string]any{key: v}
+		case ok:
+			dst.Metadata[key] = v
+		default:
+			delete(dst.Metadata, key)
+		}
+	}
+}
+
+// checkQueryFields refuses metadata filters and sort keys on fields hidden
+// from p, whose values the order or selection of results would give away.
+func (p principal) checkQueryFields(filters map[string][]string, sortKeys []courseSortKey) error {
+	for key := range filters {
+		if !p.fieldVisible("metadata." + key) {
+			return fmt.Errorf("cannot filter by metadata key %q", key)
+		}
+	}
+	for _, k := range sortKeys {
+		if k.meta && !p.fieldVisible("metadata."+k.field) {
+			return fmt.Errorf("cannot sort by %q", metaParamPrefix+k.field)
+		}
+	}
+	return nil
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: กำหนดสิทธิ์ราย field ตามบทบาท ซ่อน field หรือทำให้แก้ไม่ได้ โดยบังคับที่จุดเดียวให้ทุก transport
+
+	1. `FIELD_PERMISSIONS_FILE` เป็น JSON array ของ rule `{"field", "visible_to", "editable_by"}`
+	   - `visible_to`: เฉพาะบทบาทที่ระบุเห็น field นี้ คนที่ไม่มี credentials ก็ไม่เห็น; ซ่อนได้เฉพาะ seats, access_days, price_book และ `metadata.<key>`
+	   - `editable_by`: เฉพาะบทบาทที่ระบุตั้งค่าหรือแก้ field นี้ได้ (เช่น instructor แก้ price ไม่ได้) field ที่มองไม่เห็นก็แก้ไม่ได้
+	   - rule ผิด (field/role ไม่รู้จัก, ซ้ำ, ซ่อน field ที่ทุก format ต้องมี) = start ไม่ขึ้น
+	2. ขาออก: `courseView` ตัด field ที่ซ่อนออกจาก course ก่อนส่งทาง REST ทุก format, gRPC, GraphQL และ change feed
+	3. ขาเข้า: service layer ตรวจด้วย `mayChangeFields` ผิดได้ 403 / PERMISSION_DENIED
+	   - PUT ที่ไม่ได้ส่ง field ที่ผู้ส่งมองไม่เห็น ค่าเดิมยังอยู่ไม่ถูกล้าง (`keepHiddenFields`)
+	4. กรองหรือ sort ด้วย metadata ที่ซ่อนไม่ได้ (400) ลำดับผลลัพธ์จะได้ไม่เผยค่า
+*/
@@ -0,0 +1,1360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// This file is a small GraphQL server for the course catalog. There is no
+// GraphQL package in the standard library, so it contains its own parser
+// and executor for the parts of the language clients actually send:
+// queries and mutations with variables, aliases, named and inline
+// fragments, and @skip/@include. Subscriptions and introspection beyond
+// __typename are not supported; graphQLSchema below is the contract.
+
+// graphQLSchema documents what /graphql serves. Like the REST catalog,
+// queries only see public courses; private ones are reached by invite
+// through REST. It is not parsed; the
+// types in graphQLTypes implement it and must be kept in step.
+const graphQLSchema = `
+# JSON is an object of string, number and boolean values.
+scalar JSON
+
+type Query {
+  courses(first: Int, offset: Int): [Course!]!
+  course(id: ID!): Course
+}
+
+type Mutation {
+  createCourse(input: CourseInput!): Course!
+  updateCourse(id: ID!, input: CourseInput!): Course!
+  deleteCourse(id: ID!): Boolean!
+}
+
+type Course {
+  id: ID!
+  name: String!
+  price: Int!
+  instructor: String!
+  # seats, accessDays and priceBook are null when field permissions
+  # hide them from the requester.
+  seats: Int
+  accessDays: Int
+  priceBook: [PriceEntry!]
+  pricing(currency: String!): Pricing!
+  private: Boolean!
+  metadata: JSON
+}
+
+type PriceEntry {
+  currency: String!
+  amount: Int!
+}
+
+type Pricing {
+  currency: String!
+  amount: Int!
+  source: String!
+}
+
+input CourseInput {
+  name: String
+  price: Int
+  instructor: String
+  seats: Int
+  accessDays: Int
+  priceBook: [PriceEntryInput!]
+  private: Boolean
+  # Keys set to null are removed; other keys are kept.
+  metadata: JSON
+}
+
+input PriceEntryInput {
+  currency: String!
+  amount: Int!
+}
+`
+
+// ---- Lexer ----
+
+const (
+	gqlTokEOF = iota
+	gqlTokName
+	gqlTokInt
+	gqlTokFloat
+	gqlTokString
+	gqlTokPunct
+)
+
+type gqlToken struct {
+	kind int
+	val  string
+	pos  int
+}
+
+type gqlSyntaxError struct {
+	msg string
+	pos int
+}
+
+func (e *gqlSyntaxError) Error() string { return "Syntax Error: " + e.msg }
+
+func gqlLex(src string) ([]gqlToken, error) {
+	var toks []gqlToken
+	isName := func(c byte) bool {
+		return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	}
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			// Commas are insignificant in GraphQL.
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.IndexByte("!$()&:=@[]{}|", c) >= 0:
+			toks = append(toks, gqlToken{gqlTokPunct, string(c), i})
+			i++
+		case c == '.':
+			if !strings.HasPrefix(src[i:], "...") {
+				return nil, &gqlSyntaxError{`unexpected "."`, i}
+			}
+			toks = append(toks, gqlToken{gqlTokPunct, "...", i})
+			i += 3
+		case c == '"':
+			s, n, err := gqlLexString(src[i:])
+			if err != nil {
+				return nil, &gqlSyntaxError{err.Error(), i}
+			}
+			toks = append(toks, gqlToken{gqlTokString, s, i})
+			i += n
+		case c == '-' || c >= '0' && c <= '9':
+			start, kind := i, gqlTokInt
+			i++
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || strings.IndexByte(".eE+-", src[i]) >= 0) {
+				if strings.IndexByte(".eE", src[i]) >= 0 {
+					kind = gqlTokFloat
+				}
+				i++
+			}
+			toks = append(toks, gqlToken{kind, src[start:i], start})
+		case isName(c):
+			start := i
+			for i < len(src) && isName(src[i]) {
+				i++
+			}
+			toks = append(toks, gqlToken{gqlTokName, src[start:i], start})
+		default:
+			return nil, &gqlSyntaxError{fmt.Sprintf("unexpected character %q", c), i}
+		}
+	}
+	return append(toks, gqlToken{kind: gqlTokEOF, pos: len(src)}), nil
+}
+
+// gqlLexString reads a quoted string at the start of s and returns its value
+// and length. Block strings (""") are not supported.
+func gqlLexString(s string) (string, int, error) {
+	if strings.HasPrefix(s, `"""`) {
+		return "", 0, errors.New("block strings are not supported")
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '\n':
+			return "", 0, errors.New("unterminated string")
+		case '"':
+			// GraphQL escapes are a subset of JSON's.
+			var v string
+			if err := json.Unmarshal([]byte(s[:i+1]), &v); err != nil {
+				return "", 0, errors.New("invalid string")
+			}
+			return v, i + 1, nil
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+// ---- Parser ----
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind string // "query" or "mutation"
+	name string
+	vars []gqlVarDef
+	sel  []gqlSelection
+}
+
+type gqlVarDef struct {
+	name    string
+	typ     string
+	def     any
+	hasDef  bool
+	nonNull bool
+}
+
+type gqlFragment struct {
+	typeCond string
+	sel      []gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (spread set) or an inline
+// fragment (inline set).
+type gqlSelection struct {
+	field      *gqlField
+	spread     string
+	inline     *gqlFragment
+	directives []gqlDirective
+}
+
+type gqlField struct {
+	alias string
+	name  string
+	args  []gqlArg
+	sel   []gqlSelection
+	pos   int
+}
+
+type gqlArg struct {
+	name  string
+	value any
+}
+
+type gqlDirective struct {
+	name string
+	args []gqlArg
+}
+
+// gqlVariable and gqlEnum are the value literals that have no Go
+// equivalent; the rest parse to int64, float64, string, bool, nil, []any
+// and map[string]any.
+type (
+	gqlVariable string
+	gqlEnum     string
+)
+
+type gqlParser struct {
+	toks []gqlToken
+	pos  int
+}
+
+func (p *gqlParser) peek() gqlToken { return p.toks[p.pos] }
+
+func (p *gqlParser) next() gqlToken {
+	t := p.toks[p.pos]
+	if t.kind != gqlTokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *gqlParser) is(punct string) bool {
+	t := p.peek()
+	return t.kind == gqlTokPunct && t.val == punct
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if t := p.next(); t.kind != gqlTokPunct || t.val != punct {
+		return p.unexpected(t, fmt.Sprintf("expected %q", punct))
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	t := p.next()
+	if t.kind != gqlTokName {
+		return "", p.unexpected(t, "expected a name")
+	}
+	return t.val, nil
+}
+
+func (p *gqlParser) unexpected(t gqlToken, want string) error {
+	if t.kind == gqlTokEOF {
+		return &gqlSyntaxError{want + ", found end of document", t.pos}
+	}
+	return &gqlSyntaxError{fmt.Sprintf("%s, found %q", want, t.val), t.pos}
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	toks, err := gqlLex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{toks: toks}
+	doc := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	for p.peek().kind != gqlTokEOF {
+		t := p.peek()
+		switch {
+		case t.kind == gqlTokPunct && t.val == "{":
+			// Query shorthand.
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", sel: sel})
+		case t.kind == gqlTokName && (t.val == "query" || t.val == "mutation"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case t.kind == gqlTokName && t.val == "fragment":
+			p.next()
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			// Only inline fragments can leave out the type condition.
+			if t := p.peek(); t.kind != gqlTokName || t.val != "on" {
+				return nil, p.unexpected(t, `expected "on"`)
+			}
+			frag, err := p.fragmentBody()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[name]; dup {
+				return nil, &gqlSyntaxError{fmt.Sprintf("duplicate fragment %q", name), t.pos}
+			}
+			doc.fragments[name] = frag
+		case t.kind == gqlTokName && t.val == "subscription":
+			return nil, &gqlSyntaxError{"subscriptions are not supported", t.pos}
+		default:
+			return nil, p.unexpected(t, "expected an operation or fragment")
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, &gqlSyntaxError{"document has no operations", 0}
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.next().val}
+	if p.peek().kind == gqlTokName {
+		op.name = p.next().val
+	}
+	if p.is("(") {
+		p.next()
+		for !p.is(")") {
+			v, err := p.varDef()
+			if err != nil {
+				return nil, err
+			}
+			op.vars = append(op.vars, v)
+		}
+		p.next()
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.sel = sel
+	return op, nil
+}
+
+func (p *gqlParser) varDef() (gqlVarDef, error) {
+	var v gqlVarDef
+	if err := p.expect("$"); err != nil {
+		return v, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return v, err
+	}
+	v.name = name
+	if err := p.expect(":"); err != nil {
+		return v, err
+	}
+	if v.typ, err = p.typeRef(); err != nil {
+		return v, err
+	}
+	v.nonNull = strings.HasSuffix(v.typ, "!")
+	if p.is("=") {
+		p.next()
+		if v.def, err = p.value(true); err != nil {
+			return v, err
+		}
+		v.hasDef = true
+	}
+	return v, nil
+}
+
+func (p *gqlParser) typeRef() (string, error) {
+	var typ string
+	if p.is("[") {
+		p.next()
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err := p.expect("]"); err != nil {
+			return "", err
+		}
+		typ = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		typ = name
+	}
+	if p.is("!") {
+		p.next()
+		typ += "!"
+	}
+	return typ, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	if p.is("}") {
+		return nil, p.unexpected(p.peek(), "expected a field or fragment")
+	}
+	var sel []gqlSelection
+	for !p.is("}") {
+		if p.peek().kind == gqlTokEOF {
+			return nil, p.unexpected(p.peek(), `expected "}"`)
+		}
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, s)
+	}
+	p.next()
+	return sel, nil
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var s gqlSelection
+	var err error
+	if p.is("...") {
+		p.next()
+		if t := p.peek(); t.kind == gqlTokName && t.val != "on" {
+			s.spread = p.next().val
+			s.directives, err = p.directives()
+			return s, err
+		}
+		if s.inline, err = p.fragmentBody(); err != nil {
+			return s, err
+		}
+		return s, nil
+	}
+
+	f := &gqlField{pos: p.peek().pos}
+	if f.name, err = p.name(); err != nil {
+		return s, err
+	}
+	if p.is(":") {
+		p.next()
+		f.alias = f.name
+		if f.name, err = p.name(); err != nil {
+			return s, err
+		}
+	}
+	if f.args, err = p.arguments(); err != nil {
+		return s, err
+	}
+	if s.directives, err = p.directives(); err != nil {
+		return s, err
+	}
+	if p.is("{") {
+		if f.sel, err = p.selectionSet(); err != nil {
+			return s, err
+		}
+	}
+	s.field = f
+	return s, nil
+}
+
+// fragmentBody parses "on Type @directives { ... }" of a fragment
+// definition or inline fragment; the type condition is optional inline.
+func (p *gqlParser) fragmentBody() (*gqlFragment, error) {
+	frag := &gqlFragment{}
+	if t := p.peek(); t.kind == gqlTokName && t.val == "on" {
+		p.next()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		frag.typeCond = name
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	frag.sel = sel
+	return frag, nil
+}
+
+func (p *gqlParser) arguments() ([]gqlArg, error) {
+	if !p.is("(") {
+		return nil, nil
+	}
+	p.next()
+	var args []gqlArg
+	for !p.is(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value(false)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, gqlArg{name, v})
+	}
+	p.next()
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var ds []gqlDirective
+	for p.is("@") {
+		p.next()
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, gqlDirective{name, args})
+	}
+	return ds, nil
+}
+
+// value parses a value literal. Variables are not allowed in constant
+// positions such as variable defaults.
+func (p *gqlParser) value(constant bool) (any, error) {
+	t := p.next()
+	switch t.kind {
+	case gqlTokInt:
+		n, err := strconv.ParseInt(t.val, 10, 64)
+		if err != nil {
+			return nil, &gqlSyntaxError{fmt.Sprintf("invalid number %q", t.val), t.pos}
+		}
+		return n, nil
+	case gqlTokFloat:
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, &gqlSyntaxError{fmt.Sprintf("invalid number %q", t.val), t.pos}
+		}
+		return f, nil
+	case gqlTokString:
+		return t.val, nil
+	case gqlTokName:
+		switch t.val {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return gqlEnum(t.val), nil
+	case gqlTokPunct:
+		switch t.val {
+		case "$":
+			if constant {
+				break
+			}
+			name, err := p.name()
+			return gqlVariable(name), err
+		case "[":
+			list := []any{}
+			for !p.is("]") {
+				v, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			p.next()
+			return list, nil
+		case "{":
+			obj := map[string]any{}
+			for !p.is("}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if obj[name], err = p.value(constant); err != nil {
+					return nil, err
+				}
+			}
+			p.next()
+			return obj, nil
+		}
+	}
+	return nil, p.unexpected(t, "expected a value")
+}
+
+// ---- Schema ----
+
+// gqlType is an object type. Field resolvers get the parent value (nil for
+// the root types) and the coerced arguments; list fields return []any.
+type gqlType struct {
+	name   string
+	fields map[string]gqlFieldDef
+}
+
+type gqlFieldDef struct {
+	typ      string // object type name; empty for scalars
+	args     map[string]bool
+	required []string
+	resolve  func(src any, args map[string]any) (any, error)
+}
+
+var graphQLTypes map[string]*gqlType
+
+func init() {
+	graphQLTypes = map[string]*gqlType{
+		"Query":      gqlQueryType,
+		"Mutation":   gqlMutationType,
+		"Course":     gqlCourseType,
+		"PriceEntry": gqlPriceEntryType,
+		"Pricing":    gqlPricingType,
+	}
+}
+
+func gqlArgs(names ...string) map[string]bool {
+	m := map[string]bool{}
+	for _, n := range names {
+		m[n] = true
+	}
+	return m
+}
+
+var gqlQueryType = &gqlType{name: "Query", fields: map[string]gqlFieldDef{
+	"courses": {typ: "Course", args: gqlArgs("first", "offset"), resolve: func(src any, args map[string]any) (any, error) {
+		offset, err := gqlIntArg(args, "offset", 0)
+		if err != nil {
+			return nil, err
+		}
+		first, err := gqlIntArg(args, "first", -1)
+		if err != nil {
+			return nil, err
+		}
+		if offset < 0 {
+			return nil, errors.New("offset must not be negative")
+		}
+		courseMu.RLock()
+		defer courseMu.RUnlock()
+		t := src.(principal).tenant
+		courses := slices.DeleteFunc(publicCourses(CourseList), func(c course) bool { return !catalogOwns(t, c) })
+		courses = courses[min(offset, len(courses)):]
+		if first >= 0 {
+			courses = courses[:min(first, len(courses))]
+		}
+		list := make([]any, len(courses))
+		for i, c := range courses {
+			list[i] = c
+		}
+		return list, nil
+	}},
+	"course": {typ: "Course", args: gqlArgs("id"), required: []string{"id"}, resolve: func(src any, args map[string]any) (any, error) {
+		id, err := gqlIDArg(args, "id")
+		if err != nil {
+			return nil, err
+		}
+		courseMu.RLock()
+		defer courseMu.RUnlock()
+		if i := findCourseIndex(id); i >= 0 && !CourseList[i].Private && catalogOwns(src.(principal).tenant, CourseList[i]) {
+			return CourseList[i], nil
+		}
+		return nil, nil
+	}},
+}}
+
+var gqlMutationType = &gqlType{name: "Mutation", fields: map[string]gqlFieldDef{
+	"createCourse": {typ: "Course", args: gqlArgs("input"), required: []string{"input"}, resolve: func(src any, args map[string]any) (any, error) {
+		var c course
+		if err := applyCourseInput(&c, args["input"]); err != nil {
+			return nil, err
+		}
+		if t := src.(principal).tenant; t != nil {
+			c.Tenant = t.ID
+		}
+		return createCourse(src.(principal), c)
+	}},
+	"updateCourse": {typ: "Course", args: gqlArgs("id", "input"), required: []string{"id", "input"}, resolve: func(src any, args map[string]any) (any, error) {
+		id, err := gqlIDArg(args, "id")
+		if err != nil {
+			return nil, err
+		}
+		t := src.(principal).tenant
+		updated, err := updateCourse(src.(principal), id, "", func(c *course) error {
+			// As over REST, a tenant's domain can neither see other
+			// catalogs' courses nor move its own out.
+			if !catalogOwns(t, *c) {
+				return errCourseNotFound
+			}
+			owner := c.Tenant
+			if err := applyCourseInput(c, args["input"]); err != nil {
+				return err
+			}
+			if t != nil {
+				c.Tenant = owner
+			}
+			return nil
+		})
+		if errors.Is(err, errCourseNotFound) {
+			return nil, fmt.Errorf("course %d not found", id)
+		}
+		return updated, err
+	}},
+	"deleteCourse": {args: gqlArgs("id"), required: []string{"id"}, resolve: func(src any, args map[string]any) (any, error) {
+		id, err := gqlIDArg(args, "id")
+		if err != nil {
+			return nil, err
+		}
+		courseMu.RLock()
+		i := findCourseIndex(id)
+		foreign := i >= 0 && !catalogOwns(src.(principal).tenant, CourseList[i])
+		courseMu.RUnlock()
+		if foreign {
+			return false, nil
+		}
+		switch err := deleteCourse(src.(principal), id, ""); {
+		case errors.Is(err, errCourseNotFound):
+			return false, nil
+		case err != nil:
+			return nil, err
+		}
+		return true, nil
+	}},
+}}
+
+// gqlScalar returns a scalar field definition that reads from a value of
+// type T.
+func gqlScalar[T any](get func(T) any) gqlFieldDef {
+	return gqlFieldDef{resolve: func(src any, _ map[string]any) (any, error) { return get(src.(T)), nil }}
+}
+
+var gqlCourseType = &gqlType{name: "Course", fields: map[string]gqlFieldDef{
+	"id":         gqlScalar(func(c course) any { return strconv.Itoa(c.CourseId) }),
+	"name":       gqlScalar(func(c course) any { return c.CourseName }),
+	"price":      gqlScalar(func(c course) any { return c.CoursePrice }),
+	"instructor": gqlScalar(func(c course) any { return c.Instructor }),
+	"seats":      gqlScalar(func(c course) any { return c.Seats }),
+	"accessDays": gqlScalar(func(c course) any { return c.AccessDays }),
+	"private":    gqlScalar(func(c course) any { return c.Private }),
+	"metadata":   gqlScalar(func(c course) any { return c.Metadata }),
+	"priceBook": {typ: "PriceEntry", resolve: func(src any, _ map[string]any) (any, error) {
+		book := src.(course).PriceBook
+		list := make([]any, len(book))
+		for i, e := range book {
+			list[i] = e
+		}
+		return list, nil
+	}},
+	"pricing": {typ: "Pricing", args: gqlArgs("currency"), required: []string{"currency"}, resolve: func(src any, args map[string]any) (any, error) {
+		code, _ := args["currency"].(string)
+		code = strings.ToUpper(code)
+		if !validCurrency(code) {
+			return nil, fmt.Errorf("invalid currency %q", code)
+		}
+		return resolvePrice(src.(course), code), nil
+	}},
+}}
+
+// gqlCourseFields names the Course fields that field permissions can hide
+// as FIELD_PERMISSIONS_FILE names them.
+var gqlCourseFields = map[string]string{"seats": "seats", "accessDays": "access_days", "priceBook": "price_book"}
+
+var gqlPriceEntryType = &gqlType{name: "PriceEntry", fields: map[string]gqlFieldDef{
+	"currency": gqlScalar(func(e priceEntry) any { return e.Currency }),
+	"amount":   gqlScalar(func(e priceEntry) any { return e.Amount }),
+}}
+
+var gqlPricingType = &gqlType{name: "Pricing", fields: map[string]gqlFieldDef{
+	"currency": gqlScalar(func(p effectivePrice) any { return p.Currency }),
+	"amount":   gqlScalar(func(p effectivePrice) any { return p.Amount }),
+	"source":   gqlScalar(func(p effectivePrice) any { return p.Source }),
+}}
+
+// gqlInt converts an argument value to an int. Values from JSON variables
+// arrive as float64.
+func gqlInt(v any) (int, bool) {
+	switch v := v.(type) {
+	case int64:
+		return int(v), true
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= math.MaxInt32 {
+			return int(v), true
+		}
+	}
+	return 0, false
+}
+
+func gqlIntArg(args map[string]any, name string, def int) (int, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		return def, nil
+	}
+	n, ok := gqlInt(v)
+	if !ok {
+		return 0, fmt.Errorf("argument %q must be an Int", name)
+	}
+	return n, nil
+}
+
+// gqlIDArg reads an ID argument, which may be sent as a string or a number.
+func gqlIDArg(args map[string]any, name string) (int, error) {
+	switch v := args[name].(type) {
+	case string:
+		if id, err := strconv.Atoi(v); err == nil {
+			return id, nil
+		}
+	default:
+		if id, ok := gqlInt(v); ok {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q must be a course ID", name)
+}
+
+// applyCourseInput sets the fields present in a CourseInput object on dst,
+// leaving the others unchanged.
+func applyCourseInput(dst *course, input any) error {
+	in, ok := input.(map[string]any)
+	if !ok {
+		return errors.New("input must be a CourseInput object")
+	}
+	for key, v := range in {
+		var err error
+		switch key {
+		case "name":
+			dst.CourseName, err = gqlStringField(key, v)
+		case "instructor":
+			dst.Instructor, err = gqlStringField(key, v)
+		case "price":
+			dst.CoursePrice, err = gqlIntField(key, v)
+		case "seats":
+			dst.Seats, err = gqlIntField(key, v)
+		case "accessDays":
+			dst.AccessDays, err = gqlIntField(key, v)
+		case "priceBook":
+			dst.PriceBook, err = gqlPriceBookField(v)
+		case "metadata":
+			patch, ok := v.(map[string]any)
+			if !ok {
+				err = errors.New("metadata must be an object")
+				break
+			}
+			if dst.Metadata == nil {
+				dst.Metadata = map[string]any{}
+			}
+			maps.Copy(dst.Metadata, patch)
+			dst.Metadata = compactMetadata(dst.Metadata)
+		case "private":
+			var ok bool
+			if dst.Private, ok = v.(bool); !ok {
+				err = errors.New("private must be a Boolean")
+			}
+		default:
+			err = fmt.Errorf("unknown CourseInput field %q", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func gqlStringField(name string, v any) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a String", name)
+	}
+	return s, nil
+}
+
+func gqlIntField(name string, v any) (int, error) {
+	n, ok := gqlInt(v)
+	if !ok {
+		return 0, fmt.Errorf("%s must be an Int", name)
+	}
+	return n, nil
+}
+
+func gqlPriceBookField(v any) ([]priceEntry, error) {
+	if v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]any)
+	if !ok {
+		// Input coercion turns a single item into a one-element list.
+		list = []any{v}
+	}
+	book := make([]priceEntry, 0, len(list))
+	for _, item := range list {
+		obj, ok := item.(map[string]any)
+		if !ok {
+			return nil, errors.New("priceBook entries must be PriceEntryInput objects")
+		}
+		currency, err := gqlStringField("currency", obj["currency"])
+		if err != nil {
+			return nil, err
+		}
+		amount, err := gqlIntField("amount", obj["amount"])
+		if err != nil {
+			return nil, err
+		}
+		book = append(book, priceEntry{Currency: currency, Amount: amount})
+	}
+	return book, nil
+}
+
+// ---- Execution ----
+
+type gqlError struct {
+	Message   string        `json:"message"`
+	Locations []gqlLocation `json:"locations,omitempty"`
+	Path      []any         `json:"path,omitempty"`
+}
+
+type gqlLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// gqlObject is a result object. GraphQL responses list fields in selection
+// order, which encoding/json does not do for maps.
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value any
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, e := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(e.key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type gqlExecutor struct {
+	src    string
+	doc    *gqlDocument
+	op     *gqlOperation
+	vars   map[string]any
+	errors []gqlError
+	// who the courses in the result are mapped for.
+	who principal
+}
+
+func (ex *gqlExecutor) location(pos int) []gqlLocation {
+	line, col := 1, 1
+	for _, c := range ex.src[:min(pos, len(ex.src))] {
+		if c == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return []gqlLocation{{line, col}}
+}
+
+// value resolves variables inside an argument value.
+func (ex *gqlExecutor) value(v any) any {
+	switch v := v.(type) {
+	case gqlVariable:
+		return ex.vars[string(v)]
+	case gqlEnum:
+		return string(v)
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = ex.value(item)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, item := range v {
+			out[k] = ex.value(item)
+		}
+		return out
+	}
+	return v
+}
+
+// included applies @skip and @include.
+func (ex *gqlExecutor) included(ds []gqlDirective) bool {
+	for _, d := range ds {
+		for _, a := range d.args {
+			if a.name != "if" {
+				continue
+			}
+			cond, _ := ex.value(a.value).(bool)
+			if d.name == "skip" && cond || d.name == "include" && !cond {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// collectFields flattens fragments into the fields selected on type t.
+func (ex *gqlExecutor) collectFields(t *gqlType, sel []gqlSelection, out []*gqlField) []*gqlField {
+	for _, s := range sel {
+		if !ex.included(s.directives) {
+			continue
+		}
+		switch {
+		case s.field != nil:
+			out = append(out, s.field)
+		case s.spread != "":
+			if frag := ex.doc.fragments[s.spread]; frag.typeCond == "" || frag.typeCond == t.name {
+				out = ex.collectFields(t, frag.sel, out)
+			}
+		case s.inline != nil:
+			if s.inline.typeCond == "" || s.inline.typeCond == t.name {
+				out = ex.collectFields(t, s.inline.sel, out)
+			}
+		}
+	}
+	return out
+}
+
+func (ex *gqlExecutor) selectFields(t *gqlType, src any, sel []gqlSelection, path []any) gqlObject {
+	if t == gqlCourseType {
+		src = courseView(ex.who, src.(course))
+	}
+	obj := gqlObject{}
+	for _, f := range ex.collectFields(t, sel, nil) {
+		key := f.name
+		if f.alias != "" {
+			key = f.alias
+		}
+		if f.name == "__typename" {
+			obj = append(obj, gqlEntry{key, t.name})
+			continue
+		}
+		if field, ok := gqlCourseFields[f.name]; ok && t == gqlCourseType && !ex.who.fieldVisible(field) {
+			// Hidden from the requester, which null says better than a
+			// zero value would.
+			obj = append(obj, gqlEntry{key, nil})
+			continue
+		}
+		def := t.fields[f.name]
+		args := map[string]any{}
+		for _, a := range f.args {
+			args[a.name] = ex.value(a.value)
+		}
+		fieldPath := append(append([]any(nil), path...), key)
+		v, err := def.resolve(src, args)
+		if err != nil {
+			ex.errors = append(ex.errors, gqlError{Message: err.Error(), Locations: ex.location(f.pos), Path: fieldPath})
+			v = nil
+		}
+		obj = append(obj, gqlEntry{key, ex.complete(def, v, f, fieldPath)})
+	}
+	return obj
+}
+
+func (ex *gqlExecutor) complete(def gqlFieldDef, v any, f *gqlField, path []any) any {
+	if v == nil || def.typ == "" {
+		return v
+	}
+	t := graphQLTypes[def.typ]
+	if list, ok := v.([]any); ok {
+		out := make([]any, len(list))
+		for i, item := range list {
+			out[i] = ex.selectFields(t, item, f.sel, append(append([]any(nil), path...), i))
+		}
+		return out
+	}
+	return ex.selectFields(t, v, f.sel, path)
+}
+
+// ---- Validation ----
+
+// validate checks the selections of an operation against the schema before
+// anything runs, so a bad query never half-executes a mutation.
+func (ex *gqlExecutor) validate(t *gqlType, sel []gqlSelection, visiting map[string]bool) {
+	for _, s := range sel {
+		switch {
+		case s.spread != "":
+			frag, ok := ex.doc.fragments[s.spread]
+			if !ok {
+				ex.errors = append(ex.errors, gqlError{Message: fmt.Sprintf("Unknown fragment %q.", s.spread)})
+				continue
+			}
+			if visiting[s.spread] {
+				ex.errors = append(ex.errors, gqlError{Message: fmt.Sprintf("Cannot spread fragment %q within itself.", s.spread)})
+				continue
+			}
+			visiting[s.spread] = true
+			ex.validateFragment(t, frag, visiting)
+			delete(visiting, s.spread)
+		case s.inline != nil:
+			ex.validateFragment(t, s.inline, visiting)
+		default:
+			ex.validateField(t, s.field, visiting)
+		}
+	}
+}
+
+func (ex *gqlExecutor) validateFragment(t *gqlType, frag *gqlFragment, visiting map[string]bool) {
+	if frag.typeCond != "" && graphQLTypes[frag.typeCond] == nil {
+		ex.errors = append(ex.errors, gqlError{Message: fmt.Sprintf("Unknown type %q.", frag.typeCond)})
+		return
+	}
+	if frag.typeCond == "" || frag.typeCond == t.name {
+		ex.validate(t, frag.sel, visiting)
+	}
+}
+
+func (ex *gqlExecutor) validateField(t *gqlType, f *gqlField, visiting map[string]bool) {
+	fail := func(format string, args ...any) {
+		ex.errors = append(ex.errors, gqlError{Message: fmt.Sprintf(format, args...), Locations: ex.location(f.pos)})
+	}
+	if f.name == "__typename" {
+		if len(f.sel) > 0 {
+			fail(`Field "__typename" must not have a selection since type "String!" has no subfields.`)
+		}
+		return
+	}
+	def, ok := t.fields[f.name]
+	if !ok {
+		fail("Cannot query field %q on type %q.", f.name, t.name)
+		return
+	}
+	given := map[string]bool{}
+	for _, a := range f.args {
+		if !def.args[a.name] {
+			fail("Unknown argument %q on field %q.", a.name, t.name+"."+f.name)
+		}
+		if v, isVar := a.value.(gqlVariable); isVar && !ex.declared(string(v)) {
+			fail("Variable \"$%s\" is not defined.", v)
+		}
+		given[a.name] = true
+	}
+	for _, name := range def.required {
+		if !given[name] {
+			fail("Field %q argument %q is required, but it was not provided.", f.name, name)
+		}
+	}
+	switch {
+	case def.typ == "" && len(f.sel) > 0:
+		fail("Field %q must not have a selection since it is a scalar.", f.name)
+	case def.typ != "" && len(f.sel) == 0:
+		fail("Field %q of type %q must have a selection of subfields.", f.name, def.typ)
+	case def.typ != "":
+		ex.validate(graphQLTypes[def.typ], f.sel, visiting)
+	}
+}
+
+func (ex *gqlExecutor) declared(name string) bool {
+	for _, v := range ex.op.vars {
+		if v.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ---- HTTP ----
+
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+type graphQLResponse struct {
+	Data   any        `json:"data,omitempty"`
+	Errors []gqlError `json:"errors,omitempty"`
+	// Extensions holds the request's ID when there are errors.
+	Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+// executeGraphQL runs one request. Errors in the query itself are returned
+// without data; errors raised by resolvers null the field and are listed
+// next to the data, as the GraphQL spec describes. A non-empty
+// mutationDenied refuses mutations with that message. The root value is
+// who, so mutations are made on their behalf.
+func executeGraphQL(req graphQLRequest, mutationDenied string, who principal) graphQLResponse {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		var se *gqlSyntaxError
+		ex := &gqlExecutor{src: req.Query}
+		resp := graphQLResponse{Errors: []gqlError{{Message: err.Error()}}}
+		if errors.As(err, &se) {
+			resp.Errors[0].Locations = ex.location(se.pos)
+		}
+		return resp
+	}
+
+	var op *gqlOperation
+	for _, o := range doc.operations {
+		if req.OperationName == "" && len(doc.operations) == 1 || o.name == req.OperationName {
+			op = o
+		}
+	}
+	if op == nil {
+		msg := "Must provide operation name if query contains multiple operations."
+		if req.OperationName != "" {
+			msg = fmt.Sprintf("Unknown operation named %q.", req.OperationName)
+		}
+		return graphQLResponse{Errors: []gqlError{{Message: msg}}}
+	}
+	if op.kind == "mutation" && mutationDenied != "" {
+		return graphQLResponse{Errors: []gqlError{{Message: mutationDenied}}}
+	}
+
+	ex := &gqlExecutor{src: req.Query, doc: doc, op: op, vars: map[string]any{}, who: who}
+	for _, v := range op.vars {
+		val, ok := req.Variables[v.name]
+		switch {
+		case ok:
+			ex.vars[v.name] = val
+		case v.hasDef:
+			ex.vars[v.name] = ex.value(v.def)
+		case v.nonNull:
+			ex.errors = append(ex.errors, gqlError{Message: fmt.Sprintf("Variable \"$%s\" of required type %q was not provided.", v.name, v.typ)})
+		default:
+			ex.vars[v.name] = nil
+		}
+	}
+	root := gqlQueryType
+	if op.kind == "mutation" {
+		root = gqlMutationType
+	}
+	ex.validate(root, op.sel, map[string]bool{})
+	if len(ex.errors) > 0 {
+		return graphQLResponse{Errors: ex.errors}
+	}
+	data := ex.selectFields(root, who, op.sel, nil)
+	return graphQLResponse{Data: data, Errors: ex.errors}
+}
+
+// graphQLHandler serves /graphql. Queries can be sent with GET
+// (?query=...&variables=...) or POST; mutations only with POST. The body is
+// either the usual JSON envelope or, with Content-Type application/graphql,
+// the bare query.
+func graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeError(w, r, "Invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		body, err := io.ReadAll(r.Body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			writeError(w, r, "Cannot read request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/graphql" {
+			req.Query = string(body)
+		} else if err := json.Unmarshal(body, &req); err != nil {
+			writeError(w, r, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		writeError(w, r, "query is required", http.StatusBadRequest)
+		return
+	}
+
+	mutationDenied := ""
+	if r.Method != http.MethodPost {
+		mutationDenied = "Mutations must be sent with POST."
+	} else if err := authorizeCourseWrite(r); err != nil {
+		mutationDenied = "Mutations require credentials: " + err.Error() + "."
+	}
+	resp := executeGraphQL(req, mutationDenied, requestPrincipal(r))
+	if len(resp.Errors) > 0 {
+		requestLogger(r).Warn("GraphQL request finished with errors", "errors", len(resp.Errors), "first", resp.Errors[0].Message)
+		resp.Extensions = map[string]any{"request_id": requestID(r)}
+	}
+	body, err := json.Marshal(resp)
+	writeBody(w, http.StatusOK, jsonCodec, body, err)
+}
+
+// graphQLSchemaHandler serves GET /graphql/schema, the SDL front-end tools
+// use for code generation and editor completion.
+func graphQLSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, strings.TrimPrefix(graphQLSchema, "\n"))
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: GraphQL (`/graphql`)
+
+	1. client เลือก field ที่ต้องการเองในคำขอเดียว เช่น `{ courses { id name pricing(currency: "USD") { amount } } }`
+	   ต่างจาก REST ที่ server เป็นคนกำหนดรูปร่างของ response
+	2. เขียน parser และ executor เอง (ไม่มี library ใน standard library) รองรับ variables, alias, fragment และ `@skip`/`@include`
+	   - ตรวจ query กับ schema (validation) ก่อนรันเสมอ mutation จึงไม่ทำงานไปครึ่งทางเมื่อ query ผิด
+	   - error จาก resolver จะทำให้ field นั้นเป็น `null` พร้อม `errors` ที่บอก `path` ส่วน field อื่นยังได้ข้อมูลตามปกติ
+	3. query ส่งด้วย GET หรือ POST ก็ได้ แต่ mutation ต้องเป็น POST เท่านั้น (กันการแก้ข้อมูลผ่านลิงก์)
+	4. ใช้ `CourseList` และ `courseMu` ชุดเดียวกับ REST และ gRPC และ `GET /graphql/schema` คืน schema (SDL) สำหรับเครื่องมือฝั่ง front-end
+*/
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := parseGraphQL(`
+		# A comment.
+		query Course($id: ID!, $n: Int = 2) {
+			course(id: $id) { name ...Price @include(if: true) }
+			top: courses(first: $n, filter: {tags: ["a", "b"], min: -1.5, on: null}) { id }
+		}
+		fragment Price on Course { price priceBook { currency } }
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.operations) != 1 {
+		t.Fatalf("got %d operations, want 1", len(doc.operations))
+	}
+	op := doc.operations[0]
+	if op.kind != "query" || op.name != "Course" {
+		t.Errorf("operation = %s %s, want query Course", op.kind, op.name)
+	}
+	if len(op.vars) != 2 || op.vars[0].name != "id" || !op.vars[0].nonNull || op.vars[1].def != int64(2) {
+		t.Errorf("vars = %#v", op.vars)
+	}
+	if len(op.sel) != 2 || op.sel[1].field.alias != "top" || op.sel[1].field.name != "courses" {
+		t.Fatalf("selection = %#v", op.sel)
+	}
+	want := map[string]any{"tags": []any{"a", "b"}, "min": -1.5, "on": nil}
+	if got := op.sel[1].field.args[1].value; !reflect.DeepEqual(got, want) {
+		t.Errorf("filter = %#v, want %#v", got, want)
+	}
+	if f := doc.fragments["Price"]; f == nil || f.typeCond != "Course" || len(f.sel) != 2 {
+		t.Errorf("fragment Price = %#v", f)
+	}
+}
+
+func TestParseGraphQLMalformed(t *testing.T) {
+	for _, tt := range []struct{ name, in string }{
+		{"empty", ""},
+		{"only a comment", "# nothing\n"},
+		{"unclosed selection", "{ course"},
+		{"unclosed arguments", "{ course(id: 1 { name } }"},
+		{"missing argument value", "{ course(id:) { name } }"},
+		{"unterminated string", `{ course(name: "Go) { id } }`},
+		{"bad escape", `{ course(name: "\q") { id } }`},
+		{"unterminated block string", `{ course(name: """Go) { id } }`},
+		{"unclosed list", "{ courses(ids: [1, 2) { id } }"},
+		{"unclosed object", "{ courses(filter: {a: 1) { id } }"},
+		{"variable in a default", "query ($a: Int = $b) { courses { id } }"},
+		{"missing variable type", "query ($a: ) { courses { id } }"},
+		{"unclosed list type", "query ($a: [Int) { courses { id } }"},
+		{"extra brace", "{ courses { id } } }"},
+		{"empty selection", "{ }"},
+		{"bare directive", "{ courses @ { id } }"},
+		{"spread without a name", "{ courses { ... } }"},
+		{"subscription", "subscription { courses { id } }"},
+		{"duplicate fragment", "{ courses { ...F } } fragment F on Course { id } fragment F on Course { name }"},
+		{"fragment without a type", "{ courses { ...F } } fragment F { id }"},
+		{"stray character", "{ courses { id % } }"},
+		{"schema definition", "type Course { id: ID }"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGraphQL(tt.in)
+			var se *gqlSyntaxError
+			if !errors.As(err, &se) {
+				t.Errorf("parseGraphQL(%q) = %v, want a syntax error", tt.in, err)
+			}
+		})
+	}
+}
+
+func FuzzParseGraphQL(f *testing.F) {
+	for _, s := range []string{
+		"{ courses { id name } }",
+		`query Q($id: ID!) { course(id: $id) { ...F @skip(if: false) } } fragment F on Course { price }`,
+		`mutation { createCourse(input: {name: "aé", priceBook: [{currency: "USD", amount: 1}]}) { id } }`,
+		`{ a(s: """block "quoted" string""") }`,
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		parseGraphQL(s)
+	})
+}
+
+func TestGraphQLWritesStayInTenant(t *testing.T) {
+	h := newTestServer(t, []course{
+		{CourseId: 1, CourseName: "Main", CoursePrice: 100, Instructor: "Ann"},
+		{CourseId: 2, CourseName: "Acme", CoursePrice: 100, Instructor: "Ann", Tenant: "acme"},
+	})
+	admin := testToken(t, "root", roleAdmin)
+	mutate := func(query string) map[string]any {
+		t.Helper()
+		body, _ := json.Marshal(map[string]string{"query": query})
+		w := serve(h, http.MethodPost, "acme.test", "/graphql", admin, string(body))
+		var resp map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %d %s", query, w.Code, w.Body)
+		}
+		return resp
+	}
+
+	if resp := mutate(`mutation { updateCourse(id: 1, input: {name: "Taken"}) { id } }`); resp["errors"] == nil {
+		t.Errorf("updating another tenant's course = %v, want an error", resp)
+	}
+	if resp := mutate(`mutation { deleteCourse(id: 1) }`); resp["data"].(map[string]any)["deleteCourse"] != false {
+		t.Errorf("deleting another tenant's course = %v, want false", resp)
+	}
+	if resp := mutate(`mutation { updateCourse(id: 2, input: {name: "Renamed"}) { name } }`); resp["errors"] != nil {
+		t.Errorf("updating the tenant's own course = %v", resp)
+	}
+	resp := mutate(`mutation { createCourse(input: {name: "New", price: 1, instructor: "Ann"}) { id } }`)
+	if resp["errors"] != nil {
+		t.Fatalf("createCourse = %v", resp)
+	}
+
+	courseMu.RLock()
+	defer courseMu.RUnlock()
+	if len(CourseList) != 3 || CourseList[0].CourseName != "Main" || CourseList[1].CourseName != "Renamed" {
+		t.Errorf("catalog = %+v", CourseList)
+	}
+	if n := len(CourseList); n > 0 && CourseList[n-1].Tenant != "acme" {
+		t.Errorf("created course's tenant = %q, want acme", CourseList[n-1].Tenant)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This is a gRPC server for CourseService in course.proto, built on
+// net/http's unencrypted HTTP/2 support and the hand-written protobuf codec,
+// so it needs no generated code. Only unary calls and uncompressed
+// messages are supported, which is all CourseService uses.
+
+const grpcServicePrefix = "/courses.v1.CourseService/"
+
+// gRPC status codes (https://grpc.github.io/grpc/core/md_doc_statuscodes.html).
+const (
+	grpcOK                 = 0
+	grpcInvalidArgument    = 3
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// Field numbers of the request messages; see course.proto.
+const (
+	pbRequestID     = 1
+	pbRequestCourse = 1
+)
+
+// grpcError is a call failure with its gRPC status code.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string { return e.message }
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// grpcMethods maps a method name to its implementation, which takes the
+// call, its caller and request message and returns the response message.
+var grpcMethods = map[string]func(r *http.Request, who principal, req []byte) ([]byte, error){
+	"ListCourses":  grpcListCourses,
+	"GetCourse":    grpcGetCourse,
+	"CreateCourse": grpcCreateCourse,
+	"UpdateCourse": grpcUpdateCourse,
+	"DeleteCourse": grpcDeleteCourse,
+}
+
+// grpcWriteMethods change the catalog and need the same credentials as
+// REST writes, sent as "authorization" or "x-api-key" metadata. Reads take
+// the same metadata, which decides the fields and private courses they see.
+var grpcWriteMethods = map[string]bool{"CreateCourse": true, "UpdateCourse": true, "DeleteCourse": true}
+
+// newGRPCServer returns a server for CourseService on addr. It speaks
+// HTTP/2 without TLS (h2c), as gRPC clients do with insecure credentials.
+// Like REST, a call's :authority picks the tenant whose catalog it reads.
+func newGRPCServer(addr string) *http.Server {
+	srv := withServerLimits(&http.Server{Addr: addr, Handler: tenantHandler(http.HandlerFunc(grpcHandler))})
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	return srv
+}
+
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		writeError(w, r, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+
+	// gRPC is served apart from requestLogHandler, so it joins the
+	// caller's trace here.
+	tc := startTrace(r)
+	r = withTrace(r, tc)
+	w.Header().Set(traceIDHeader, tc.TraceID)
+	start := time.Now()
+	resp, err := serveGRPC(r)
+	recordGRPCSpan(r, err, start)
+	if err != nil {
+		// A failed call has no message, so the status goes in the headers
+		// ("Trailers-Only" response).
+		writeGRPCStatus(w, err)
+		return
+	}
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	frame := make([]byte, 5, 5+len(resp))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(resp)))
+	w.Write(append(frame, resp...))
+	writeGRPCStatus(w, nil)
+}
+
+func serveGRPC(r *http.Request) ([]byte, error) {
+	name, ok := strings.CutPrefix(r.URL.Path, grpcServicePrefix)
+	method := grpcMethods[name]
+	if !ok || method == nil {
+		return nil, grpcErrorf(grpcUnimplemented, "unknown method %s", r.URL.Path)
+	}
+	// Reads and writes are made as the caller, by the same credentials as
+	// REST; a call without any reads as anonymous.
+	r, err := authenticate(r)
+	if err == nil && grpcWriteMethods[name] {
+		err = authorizeCourseWrite(r)
+	}
+	switch {
+	case errors.Is(err, errMissingScope), errors.Is(err, errTokenMissingScope):
+		return nil, grpcErrorf(grpcPermissionDenied, "%v %s", err, scopeCoursesWrite)
+	case err != nil:
+		return nil, grpcErrorf(grpcUnauthenticated, "%v", err)
+	}
+	who := requestPrincipal(r)
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return method(r, who, req)
+}
+
+// readGRPCMessage reads the single length-prefixed message of a unary call.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "missing request message")
+	}
+	if prefix[0] != 0 {
+		return nil, grpcErrorf(grpcUnimplemented, "compressed messages are not supported")
+	}
+	// The length is the client's word, so check it before allocating.
+	length := binary.BigEndian.Uint32(prefix[1:])
+	if int64(length) > maxBodyBytes {
+		return nil, grpcErrorf(grpcInvalidArgument, "request message is larger than %d bytes", maxBodyBytes)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, grpcErrorf(grpcInvalidArgument, "truncated request message")
+	}
+	return msg, nil
+}
+
+func writeGRPCStatus(w http.ResponseWriter, err error) {
+	code, message := grpcOK, ""
+	if err != nil {
+		var ge *grpcError
+		if errors.As(err, &ge) {
+			code, message = ge.code, ge.message
+		} else {
+			slog.Error("gRPC call failed", "err", err)
+			code, message = grpcInternal, "internal error"
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", encodeGRPCMessage(message))
+	}
+}
+
+// encodeGRPCMessage percent-encodes message as the gRPC over HTTP/2 spec
+// requires: printable ASCII except '%' is sent as is, everything else as
+// %XX of its UTF-8 bytes.
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= 0x20 && c <= 0x7e && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// decodeIDRequest reads the id field of GetCourseRequest and
+// DeleteCourseRequest.
+func decodeIDRequest(req []byte) (int, error) {
+	var id int
+	err := eachProtoField(req, func(f protoField) error {
+		if f.number == pbRequestID {
+			if err := expectWireType(f, wireVarint); err != nil {
+				return err
+			}
+			id = int(int64(f.value))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	return id, nil
+}
+
+// decodeCourseRequest decodes the course field of CreateCourseRequest and
+// UpdateCourseRequest onto dst.
+func decodeCourseRequest(req []byte, dst *course) error {
+	err := eachProtoField(req, func(f protoField) error {
+		if f.number == pbRequestCourse {
+			if err := expectWireType(f, wireBytes); err != nil {
+				return err
+			}
+			return unmarshalCourseProto(f.data, dst)
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	return nil
+}
+
+func grpcListCourses(r *http.Request, who principal, req []byte) ([]byte, error) {
+	courseMu.RLock()
+	defer courseMu.RUnlock()
+	visible := slices.DeleteFunc(slices.Clone(CourseList), func(c course) bool { return !canViewCourse(r, c) })
+	return marshalCourseListProto(coursesView(who, visible)), nil
+}
+
+// grpcServiceError maps a course service error to a gRPC status. Errors
+// that already carry one, from decoding the request, pass through.
+func grpcServiceError(err error, id int) error {
+	var invalid *invalidCourseError
+	var forbidden *forbiddenError
+	switch {
+	case errors.Is(err, errCourseNotFound):
+		return grpcErrorf(grpcNotFound, "course %d not found", id)
+	case errors.As(err, &forbidden):
+		return grpcErrorf(grpcPermissionDenied, "%s", forbidden.msg)
+	case errors.As(err, &invalid):
+		return grpcErrorf(grpcInvalidArgument, "%s", invalid.msg)
+	case errors.Is(err, errPolicyUnavailable):
+		return grpcErrorf(grpcUnavailable, "%s", errPolicyUnavailable)
+	}
+	return err
+}
+
+func grpcGetCourse(r *http.Request, who principal, req []byte) ([]byte, error) {
+	id, err := decodeIDRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	courseMu.RLock()
+	defer courseMu.RUnlock()
+	i := findCourseIndex(id)
+	if i < 0 || !canViewCourse(r, CourseList[i]) {
+		return nil, grpcErrorf(grpcNotFound, "course %d not found", id)
+	}
+	return marshalCourseProto(courseView(who, CourseList[i])), nil
+}
+
+func grpcCreateCourse(r *http.Request, who principal, req []byte) ([]byte, error) {
+	var c course
+	if err := decodeCourseRequest(req, &c); err != nil {
+		return nil, err
+	}
+	if t := requestTenant(r); t != nil {
+		c.Tenant = t.ID
+	}
+	c, err := createCourse(who, c)
+	if err != nil {
+		return nil, grpcServiceError(err, 0)
+	}
+	return marshalCourseProto(courseView(who, c)), nil
+}
+
+func grpcUpdateCourse(r *http.Request, who principal, req []byte) ([]byte, error) {
+	// The id is needed before merging, so read it from a scratch decode.
+	var target course
+	if err := decodeCourseRequest(req, &target); err != nil {
+		return nil, err
+	}
+	if target.CourseId == 0 {
+		return nil, grpcErrorf(grpcInvalidArgument, "course.id is required")
+	}
+	updated, err := updateCourse(who, target.CourseId, "", func(c *course) error {
+		// As over REST, a tenant's authority can neither see other
+		// catalogs' courses nor move its own out.
+		if !tenantOwns(r, *c) {
+			return errCourseNotFound
+		}
+		owner := c.Tenant
+		if err := decodeCourseRequest(req, c); err != nil {
+			return err
+		}
+		if requestTenant(r) != nil {
+			c.Tenant = owner
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, grpcServiceError(err, target.CourseId)
+	}
+	return marshalCourseProto(courseView(who, updated)), nil
+}
+
+func grpcDeleteCourse(r *http.Request, who principal, req []byte) ([]byte, error) {
+	id, err := decodeIDRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	courseMu.RLock()
+	i := findCourseIndex(id)
+	foreign := i >= 0 && !tenantOwns(r, CourseList[i])
+	courseMu.RUnlock()
+	if foreign {
+		return nil, grpcServiceError(errCourseNotFound, id)
+	}
+	if err := deleteCourse(who, id, ""); err != nil {
+		return nil, grpcServiceError(err, id)
+	}
+	// DeleteCourseResponse has no fields.
+	return nil, nil
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: gRPC โดยไม่ใช้ library ภายนอก
+
+	1. gRPC คือ protobuf ที่ส่งผ่าน HTTP/2: ทุก call เป็น `POST /courses.v1.CourseService/<Method>`
+	   - body = 1 byte (บีบอัดหรือไม่) + 4 byte ความยาว + ข้อความ protobuf
+	   - ผลลัพธ์ (สำเร็จ/ผิดพลาด) ส่งใน HTTP trailer `grpc-status` และ `grpc-message` ไม่ใช่ HTTP status code
+	2. ตั้งแต่ Go 1.24 `http.Server` รองรับ HTTP/2 แบบไม่เข้ารหัส (h2c) ผ่าน `Protocols.SetUnencryptedHTTP2` จึงเปิด port ที่สอง (`-grpc :9090`) ได้เลย
+	3. ใช้ `CourseList` และ `courseMu` ชุดเดียวกับ HTTP API ข้อมูลที่เปลี่ยนผ่าน gRPC จึงเห็นใน `/courses` และ change feed ทันที
+	4. ทดสอบได้ด้วย `grpcurl -plaintext -proto course.proto localhost:9090 courses.v1.CourseService/ListCourses`
+*/
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReadGRPCMessage(t *testing.T) {
+	got, err := readGRPCMessage(bytes.NewReader([]byte{0, 0, 0, 0, 2, 0x08, 0x01}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{0x08, 0x01}) {
+		t.Errorf("readGRPCMessage = % x, want 08 01", got)
+	}
+	got, err = readGRPCMessage(bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+	if err != nil || len(got) != 0 {
+		t.Errorf("readGRPCMessage of an empty message = % x, %v", got, err)
+	}
+}
+
+func TestReadGRPCMessageMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   []byte
+		code int
+	}{
+		{"empty", nil, grpcInvalidArgument},
+		{"short prefix", []byte{0, 0, 0}, grpcInvalidArgument},
+		{"compressed", []byte{1, 0, 0, 0, 1, 0}, grpcUnimplemented},
+		{"too large", []byte{0, 0xff, 0xff, 0xff, 0xff}, grpcInvalidArgument},
+		{"short message", []byte{0, 0, 0, 0, 3, 0x08}, grpcInvalidArgument},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readGRPCMessage(bytes.NewReader(tt.in))
+			var ge *grpcError
+			if !errors.As(err, &ge) || ge.code != tt.code {
+				t.Errorf("readGRPCMessage(% x) = %v, want code %d", tt.in, err, tt.code)
+			}
+		})
+	}
+}
+
+func TestDecodeGRPCRequests(t *testing.T) {
+	if id, err := decodeIDRequest([]byte{0x08, 0x2a}); err != nil || id != 42 {
+		t.Errorf("decodeIDRequest = %d, %v, want 42", id, err)
+	}
+	var c course
+	if err := decodeCourseRequest([]byte{0x0a, 0x04, 0x12, 0x02, 'G', 'o'}, &c); err != nil || c.CourseName != "Go" {
+		t.Errorf("decodeCourseRequest = %#v, %v, want name Go", c, err)
+	}
+	for _, in := range [][]byte{{0x08}, {0x0a, 0x00}, {0x0b}} {
+		_, err := decodeIDRequest(in)
+		var ge *grpcError
+		if !errors.As(err, &ge) || ge.code != grpcInvalidArgument {
+			t.Errorf("decodeIDRequest(% x) = %v, want INVALID_ARGUMENT", in, err)
+		}
+	}
+	for _, in := range [][]byte{{0x0a}, {0x08, 0x01, 0x0a}, {0x0a, 0x05, 0x12}, {0x0a, 0x02, 0x10, 0x80}, {0x0a, 0x02, 0x10, 0x01}} {
+		err := decodeCourseRequest(in, &course{})
+		var ge *grpcError
+		if !errors.As(err, &ge) || ge.code != grpcInvalidArgument {
+			t.Errorf("decodeCourseRequest(% x) = %v, want INVALID_ARGUMENT", in, err)
+		}
+	}
+}
+
+func FuzzReadGRPCMessage(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 2, 0x08, 0x01})
+	f.Add([]byte{0, 0, 0, 0, 6, 0x0a, 0x04, 0x12, 0x02, 'G', 'o'})
+	f.Add([]byte{1, 0, 0, 0, 1, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, err := readGRPCMessage(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		decodeIDRequest(msg)
+		decodeCourseRequest(msg, &course{})
+	})
+}
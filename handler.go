@@ -24,19 +24,19 @@ func (h *CounterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	count := h.counter
 	h.mu.Unlock()
 
+	// Prometheus ที่มา scrape ได้ค่าเดียวกันในรูปแบบ text exposition แทนประโยคข้างล่าง
+	// (ตัวเลขรวมของทุก route อยู่ที่ /metrics ดู metrics.go)
+	if wantsPrometheus(r) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprintf(w, "# HELP count_calls_total Calls to /count.\n# TYPE count_calls_total counter\ncount_calls_total %d\n", count)
+		return
+	}
 	fmt.Fprintf(w, "This endpoint was called %d times\n", count)
 }
 
-func main() {
-	// สร้าง instance ของ handler ขึ้นมาเพียงครั้งเดียว
-	// state ของ handler (counter) จะถูกแชร์ระหว่างทุกๆ request ที่เข้ามา
-	handler := &CounterHandler{}
-	http.Handle("/count", handler)
-
-	fmt.Println("Server is listening on :8080")
-	fmt.Println("Try accessing http://localhost:8080/count")
-	http.ListenAndServe(":8080", nil)
-}
+// CounterHandler ถูก mount ไว้ที่ /count ใน main() ของ workwithrequest.go
+// instance ถูกสร้างขึ้นเพียงครั้งเดียว state ของ handler (counter)
+// จึงถูกแชร์ระหว่างทุกๆ request ที่เข้ามา
 
 /*
 	summary
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// The probes, for Kubernetes or a load balancer, both answer JSON:
+//
+//	GET /healthz  liveness: 200 for as long as the process can answer at all
+//	GET /readyz   readiness: 200 when every check passes, 503 otherwise
+//
+// Readiness checks that warm-up is done (warmup.go), that the seed catalog
+// was loaded and that the course store can be read within a second, so a
+// write stuck holding it takes the instance out of rotation instead of
+// letting requests pile up behind it. A seed that does not parse, like an
+// unreadable USERS_FILE, stops the process before it listens, so "seed"
+// reports what was loaded rather than ever failing on its own. Neither
+// probe looks at outside services: an SMTP server or origin being down
+// should not restart or unroute every instance at once; /status reports
+// those.
+
+// seededCourses is how many courses the seed catalog held at start.
+var seededCourses int
+
+var processStart = time.Now()
+
+// healthCheckResult is how one readiness check went.
+type healthCheckResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthReport is the body of /healthz and /readyz.
+type healthReport struct {
+	Status    string              `json:"status"` // ok, ready or not_ready
+	StartedAt time.Time           `json:"started_at"`
+	Uptime    string              `json:"uptime"`
+	Checks    []healthCheckResult `json:"checks,omitempty"`
+}
+
+// readinessChecks are the checks /readyz runs, in order.
+var readinessChecks = []struct {
+	name  string
+	check func() (ok bool, detail string)
+}{
+	{"warmup", func() (bool, string) {
+		if !serverReady.Load() {
+			return false, "warming up"
+		}
+		return true, ""
+	}},
+	{"seed", func() (bool, string) {
+		if seededCourses == 0 {
+			return false, "no seed catalog was loaded"
+		}
+		return true, fmt.Sprintf("%d courses loaded at start", seededCourses)
+	}},
+	{"store", func() (bool, string) {
+		if !courseStoreAnswers(time.Second) {
+			return false, "the course store did not answer within 1s"
+		}
+		return true, ""
+	}},
+}
+
+// healthHandler answers /healthz and /readyz ahead of everything else, so
+// neither the concurrency limiter nor a caching proxy in front of another
+// instance gets in the way of a probe.
+func healthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Header().Set("Cache-Control", "no-store")
+			writeValue(w, r, http.StatusOK, newHealthReport("ok"))
+		case "/readyz":
+			report, status := newHealthReport("ready"), http.StatusOK
+			for _, c := range readinessChecks {
+				ok, detail := c.check()
+				report.Checks = append(report.Checks, healthCheckResult{Name: c.name, OK: ok, Detail: detail})
+			}
+			if slices.ContainsFunc(report.Checks, func(c healthCheckResult) bool { return !c.OK }) {
+				report.Status, status = "not_ready", http.StatusServiceUnavailable
+			}
+			w.Header().Set("Cache-Control", "no-store")
+			writeValue(w, r, status, report)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func newHealthReport(status string) healthReport {
+	return healthReport{
+		Status:    status,
+		StartedAt: processStart.UTC(),
+		Uptime:    time.Since(processStart).Round(time.Second).String(),
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: probe สำหรับ Kubernetes สองตัว ตอบเป็น JSON พร้อมรายละเอียด
+
+	1. `GET /healthz` (liveness) ตอบ 200 เสมอตราบใดที่ process ยังตอบได้ พร้อมเวลาเริ่มและ uptime
+	2. `GET /readyz` (readiness) รันทุก check ตามลำดับ ผ่านหมดได้ 200 `ready` ไม่ผ่านสักตัวได้ 503 `not_ready`
+	   - `warmup` warm-up เสร็จแล้ว
+	   - `seed` โหลด catalog ตั้งต้นได้ (seed เสียจะ start ไม่ขึ้นตั้งแต่แรก จึงรายงานจำนวนที่โหลด)
+	   - `store` อ่าน course store ได้ภายใน 1 วินาที ถ้ามี write ค้างอยู่ instance จะถูกถอดออกจาก rotation
+	3. ไม่เช็คบริการภายนอก (SMTP, origin) เพื่อไม่ให้ทุก instance ถูก restart หรือถอดพร้อมกัน ดูสิ่งเหล่านั้นที่ `/status`
+	4. ทั้งสองตัวอยู่หน้าสุดของ middleware ไม่ติด concurrency limit และไม่ผ่าน caching proxy
+*/
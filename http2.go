@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+)
+
+// HTTPS connections negotiate HTTP/2 by ALPN, falling back to HTTP/1.1 for
+// clients without it; HTTP2=false turns HTTP/2 off. The plain listener
+// speaks HTTP/1.1 only unless H2C=true, which adds cleartext HTTP/2 for
+// internal deployments whose load balancer or service mesh ends TLS and
+// speaks HTTP/2 to the server. h2c is prior knowledge only: the client
+// opens with the HTTP/2 preface, as gRPC clients and curl
+// --http2-prior-knowledge do, and an HTTP/1.1 "Upgrade: h2c" is ignored.
+//
+// TLS 1.2 connections already use only the cipher suites HTTP/2 permits
+// (tls.go). WebSockets stay on HTTP/1.1; browsers open a separate
+// connection for them.
+
+var (
+	http2Enabled = true
+	h2cEnabled   bool
+)
+
+func init() {
+	switch v := os.Getenv("HTTP2"); v {
+	case "", "true":
+	case "false":
+		http2Enabled = false
+	default:
+		log.Fatalf("Invalid HTTP2 %q: use true or false", v)
+	}
+	switch v := os.Getenv("H2C"); v {
+	case "", "false":
+	case "true":
+		h2cEnabled = true
+	default:
+		log.Fatalf("Invalid H2C %q: use true or false", v)
+	}
+}
+
+// tlsProtocols are the protocols of the HTTPS listener.
+func tlsProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(http2Enabled)
+	return p
+}
+
+// plainProtocols are the protocols of the plain listener.
+func plainProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(h2cEnabled)
+	return p
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: เปิด HTTP/2 ทั้งบน HTTPS และแบบไม่เข้ารหัส (h2c) สำหรับระบบภายใน ปรับได้ด้วย env
+
+	1. HTTPS เลือก HTTP/2 ผ่าน ALPN อัตโนมัติ client เก่าใช้ HTTP/1.1 ต่อได้; ปิดด้วย `HTTP2=false`
+	2. `H2C=true` ให้ port HTTP ธรรมดารับ HTTP/2 แบบไม่เข้ารหัสด้วย (สำหรับ load balancer/service mesh ที่จบ TLS ไปก่อนแล้ว)
+	   - แบบ prior knowledge เท่านั้น (client เริ่มด้วย preface ของ HTTP/2 เลย) ไม่รองรับ `Upgrade: h2c` ของ HTTP/1.1
+	3. cipher ของ TLS 1.2 ที่เราเปิดไว้ (tls.go) เป็นชุดที่ HTTP/2 อนุญาตอยู่แล้ว
+	4. WebSocket ยังใช้ HTTP/1.1 browser เปิด connection แยกเอง
+*/
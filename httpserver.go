@@ -0,0 +1,101 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Every listener, plain, HTTPS and gRPC, gets the same connection limits,
+// so a client that opens a connection and trickles bytes into it
+// (slowloris) cannot hold it forever:
+//
+//	HTTP_READ_HEADER_TIMEOUT  to read the request headers (default 10s)
+//	HTTP_READ_TIMEOUT         to read the whole request, body included (default none)
+//	HTTP_WRITE_TIMEOUT        from the end of the headers to the end of the response (default none)
+//	HTTP_IDLE_TIMEOUT         a keep-alive connection may wait for its next request (default 120s)
+//	HTTP_MAX_HEADER_BYTES     of request line and headers (default 1MB; net/http allows 4KB more)
+//
+// "0" turns a timeout off. The read and write timeouts are off by default
+// because a large import upload or a slow export download can outlast any
+// sensible value; set them when the body limits (bodylimit.go) keep
+// requests small. The streams, /events, /ws/courses, /courses/sync and
+// /admin/logs/stream, lift both deadlines for themselves with
+// keepStreamOpen, so they run as long as the client stays. A CPU profile
+// or trace must be shorter than HTTP_WRITE_TIMEOUT; net/http/pprof refuses
+// longer ones.
+
+var (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       = 120 * time.Second
+	maxHeaderBytes    = http.DefaultMaxHeaderBytes
+)
+
+func init() {
+	for _, v := range []struct {
+		env string
+		d   *time.Duration
+	}{
+		{"HTTP_READ_HEADER_TIMEOUT", &readHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", &readTimeout},
+		{"HTTP_WRITE_TIMEOUT", &writeTimeout},
+		{"HTTP_IDLE_TIMEOUT", &idleTimeout},
+	} {
+		if s := os.Getenv(v.env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d < 0 {
+				log.Fatalf("Invalid %s %q: must be a duration, 0 for none", v.env, s)
+			}
+			*v.d = d
+		}
+	}
+	if s := os.Getenv("HTTP_MAX_HEADER_BYTES"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 4096 {
+			log.Fatalf("Invalid HTTP_MAX_HEADER_BYTES %q: must be a number of bytes, at least 4096", s)
+		}
+		maxHeaderBytes = n
+	}
+	if readTimeout > 0 && readHeaderTimeout > readTimeout {
+		log.Fatalf("HTTP_READ_HEADER_TIMEOUT %v is longer than HTTP_READ_TIMEOUT %v", readHeaderTimeout, readTimeout)
+	}
+}
+
+// withServerLimits sets the timeouts and header limit above on srv, and
+// the connection tracking of connections.go.
+func withServerLimits(srv *http.Server) *http.Server {
+	srv.ReadHeaderTimeout = readHeaderTimeout
+	srv.ReadTimeout = readTimeout
+	srv.WriteTimeout = writeTimeout
+	srv.IdleTimeout = idleTimeout
+	srv.MaxHeaderBytes = maxHeaderBytes
+	trackConnections(srv)
+	return srv
+}
+
+// keepStreamOpen lifts the read and write deadlines of w's connection, for
+// a handler that streams for as long as its client listens.
+func keepStreamOpen(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ตั้ง timeout และขนาด header ของ `http.Server` ได้จาก env กัน client แบบ slowloris ที่เปิด connection ค้างไว้
+
+	1. ใช้กับทุก listener (HTTP, HTTPS, gRPC) ผ่าน `withServerLimits`
+	   - `HTTP_READ_HEADER_TIMEOUT` อ่าน header (ค่าเริ่มต้น 10s)
+	   - `HTTP_READ_TIMEOUT` อ่านทั้ง request รวม body และ `HTTP_WRITE_TIMEOUT` เขียน response (ค่าเริ่มต้นปิด เพราะ upload/download ใหญ่ ๆ อาจนานเกินค่าใด ๆ)
+	   - `HTTP_IDLE_TIMEOUT` connection keep-alive รอ request ถัดไป (ค่าเริ่มต้น 120s)
+	   - `HTTP_MAX_HEADER_BYTES` ขนาด header สูงสุด (ค่าเริ่มต้น 1MB ขั้นต่ำ 4096)
+	2. ตั้ง `0` เพื่อปิด timeout นั้น; ค่าผิดรูปแบบ start ไม่ขึ้น
+	3. stream ที่เปิดยาว (`/events`, `/ws/courses`, `/courses/sync`, `/admin/logs/stream`) เรียก `keepStreamOpen` ยกเลิก deadline ของตัวเอง จึงไม่ถูกตัดกลางทาง
+	4. CPU profile / trace ของ pprof ต้องสั้นกว่า `HTTP_WRITE_TIMEOUT` ไม่อย่างนั้น pprof จะปฏิเสธเอง
+*/
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+)
+
+// courseHub fans course change events out to live subscribers (WebSocket
+// clients). Publishing never blocks: a subscriber whose buffer is full is
+// dropped, and is expected to reconnect and catch up from
+// /courses/changes?since=<last seq it saw>.
+type courseHub struct {
+	mu   sync.Mutex
+	subs map[*hubSubscriber]struct{}
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind by.
+const subscriberBuffer = 64
+
+type hubSubscriber struct {
+	events  chan courseChange // closed when the subscriber is dropped
+	courses map[int]bool      // nil means every course
+	tenant  *tenant           // whose catalog it follows; nil for the main site
+}
+
+var courseEvents = &courseHub{subs: make(map[*hubSubscriber]struct{})}
+
+// subscribe registers a subscriber to the given courses of t's catalog, or
+// to all of them when ids is empty.
+func (h *courseHub) subscribe(ids []int, t *tenant) *hubSubscriber {
+	s := &hubSubscriber{events: make(chan courseChange, subscriberBuffer), tenant: t}
+	if len(ids) > 0 {
+		s.courses = make(map[int]bool, len(ids))
+		for _, id := range ids {
+			s.courses[id] = true
+		}
+	}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+func (h *courseHub) unsubscribe(s *hubSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.events)
+	}
+}
+
+// publish delivers ev to every interested subscriber. It is called from
+// recordChange with courseMu held, so it must stay cheap.
+func (h *courseHub) publish(ev courseChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if (s.courses != nil && !s.courses[ev.ID]) || !ev.ownedBy(s.tenant) {
+			continue
+		}
+		select {
+		case s.events <- ev:
+		default:
+			delete(h.subs, s)
+			close(s.events)
+		}
+	}
+}
+
+func (h *courseHub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Hub กระจาย event แบบ Publish/Subscribe
+
+	1. ทุกการเปลี่ยนแปลง course (ไม่ว่ามาจาก REST, gRPC หรือ GraphQL) ผ่าน `recordChange` ซึ่งส่ง event เข้า hub นี้
+	2. subscriber แต่ละรายมี buffer ของตัวเอง (channel ขนาด 64) ส่งแบบไม่รอ (non-blocking) client ที่ช้าจะไม่ทำให้ server ค้าง
+	   - ถ้า buffer เต็ม subscriber จะถูกตัดออก แล้วให้ client ต่อใหม่และตามข้อมูลที่พลาดไปจาก `/courses/changes?since=`
+	3. subscribe เฉพาะบาง course ได้ (`courses`) hub จะส่งเฉพาะ event ของ course เหล่านั้น
+	4. subscriber ผูกกับ tenant ของ domain ที่ต่อเข้ามา จึงได้ event เฉพาะ course ของ tenant นั้น (รวมการลบ)
+*/
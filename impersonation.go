@@ -0,0 +1,412 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Support staff can see the service as a user sees it by impersonating
+// them. An admin starts an impersonation and gets an access token for the
+// user:
+//
+//	POST   /admin/impersonations       {"user": "ann", "reason": "ticket 4711"}
+//	GET    /admin/impersonations       every impersonation, newest first
+//	GET    /admin/impersonations/{id}  one, with what was done under it
+//	DELETE /admin/impersonations/{id}  ends it early
+//	DELETE /auth/impersonation         ends the caller's own, with its token
+//
+// The target is a user (credentials.go) by username, or any subject with
+// a role and, for instructors, an instructor name, for users who sign in
+// with an outside JWT. Admins cannot be impersonated, and an
+// impersonation token cannot start another impersonation or be traded for
+// a session or a token pair at /auth, so it never outlives its expiry:
+// the ttl asked for, at most IMPERSONATION_TTL (default 30m).
+//
+// The token is an HS256 JWT like an access token, with the admin in an
+// RFC 8693 "act" claim. Every request made with it is answered with
+// X-Impersonated-By naming the admin and X-Impersonation-Expires, for a
+// UI to show a banner, and is recorded in the impersonation's trail with
+// its method, path and status; its log lines and policy decisions name
+// both the user and the admin. Impersonations are kept in memory only, so
+// a restart ends them all: a token whose impersonation the server does
+// not know is refused.
+
+const (
+	impersonatedByHeader       = "X-Impersonated-By"
+	impersonationExpiresHeader = "X-Impersonation-Expires"
+	// maxImpersonations is how many impersonations are kept; the oldest
+	// ended ones go first.
+	maxImpersonations = 200
+	// maxImpersonatedActions is how many requests an impersonation's trail
+	// keeps; later ones are only counted.
+	maxImpersonatedActions = 500
+)
+
+var impersonationTTL = 30 * time.Minute
+
+var (
+	errImpersonationUnknown = errors.New("impersonation is not known here; start a new one")
+	errImpersonationEnded   = errors.New("impersonation has ended")
+)
+
+func init() {
+	if v := os.Getenv("IMPERSONATION_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid IMPERSONATION_TTL %q: must be a positive duration", v)
+		}
+		impersonationTTL = d
+	}
+}
+
+type impersonation struct {
+	ID             string               `json:"id"`
+	Actor          string               `json:"actor"`
+	Subject        string               `json:"subject"`
+	Role           string               `json:"role"`
+	Instructor     string               `json:"instructor,omitempty"`
+	Reason         string               `json:"reason"`
+	StartedAt      time.Time            `json:"started_at"`
+	ExpiresAt      time.Time            `json:"expires_at"`
+	EndedAt        *time.Time           `json:"ended_at,omitempty"`
+	EndedBy        string               `json:"ended_by,omitempty"`
+	Active         bool                 `json:"active"`
+	Actions        []impersonatedAction `json:"actions"`
+	DroppedActions int                  `json:"dropped_actions,omitempty"`
+}
+
+// impersonatedAction is a request made under an impersonation.
+type impersonatedAction struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	RequestID string    `json:"request_id"`
+}
+
+var (
+	// impersonationMu protects impersonations, oldest first.
+	impersonationMu sync.Mutex
+	impersonations  []*impersonation
+)
+
+func (imp *impersonation) active(now time.Time) bool {
+	return imp.EndedAt == nil && now.Before(imp.ExpiresAt)
+}
+
+// view is a copy of imp to send, with Active filled in.
+func (imp *impersonation) view(now time.Time) impersonation {
+	v := *imp
+	v.Active = imp.active(now)
+	v.Actions = slices.Clone(imp.Actions)
+	if v.Actions == nil {
+		v.Actions = []impersonatedAction{}
+	}
+	return v
+}
+
+// findImpersonation returns impersonation id. Callers must hold
+// impersonationMu.
+func findImpersonation(id string) *impersonation {
+	for _, imp := range impersonations {
+		if imp.ID == id {
+			return imp
+		}
+	}
+	return nil
+}
+
+// impersonationOf returns the impersonation ID and the admin of claims,
+// or "" for a token that is not an impersonation token.
+func impersonationOf(c jwtClaims) (id, actor string) {
+	id, _ = c.Raw["imp"].(string)
+	if act, ok := c.Raw["act"].(map[string]any); ok && id != "" {
+		actor, _ = act["sub"].(string)
+	}
+	if actor == "" {
+		return "", ""
+	}
+	return id, actor
+}
+
+// checkImpersonation refuses an impersonation token whose impersonation
+// has ended or is not known; other tokens pass.
+func checkImpersonation(c jwtClaims, now time.Time) error {
+	id, _ := impersonationOf(c)
+	if id == "" {
+		return nil
+	}
+	impersonationMu.Lock()
+	defer impersonationMu.Unlock()
+	switch imp := findImpersonation(id); {
+	case imp == nil:
+		return errImpersonationUnknown
+	case !imp.active(now):
+		return errImpersonationEnded
+	}
+	return nil
+}
+
+// serveImpersonated serves r, made with an impersonation token, with the
+// banner headers, and records it in the impersonation's trail.
+func serveImpersonated(w http.ResponseWriter, r *http.Request, c jwtClaims, next http.Handler) {
+	id, actor := impersonationOf(c)
+	w.Header().Set(impersonatedByHeader, actor)
+	w.Header().Set(impersonationExpiresHeader, c.Expires.UTC().Format(time.RFC3339))
+	logger := requestLogger(r).With("subject", c.Subject, "actor", actor, "impersonation", id)
+	r = withLogger(r, logger)
+	start := time.Now().UTC()
+	sw := &statusRecorder{ResponseWriter: w}
+	next.ServeHTTP(sw, r)
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	logger.Info("Impersonated request", "method", r.Method, "path", r.URL.Path, "status", status)
+
+	impersonationMu.Lock()
+	defer impersonationMu.Unlock()
+	imp := findImpersonation(id)
+	switch {
+	case imp == nil:
+	case len(imp.Actions) >= maxImpersonatedActions:
+		imp.DroppedActions++
+	default:
+		imp.Actions = append(imp.Actions, impersonatedAction{
+			Time: start, Method: r.Method, Path: r.URL.Path, Status: status, RequestID: requestID(r),
+		})
+	}
+}
+
+// signImpersonationToken returns the token of imp.
+func signImpersonationToken(imp *impersonation) (string, error) {
+	claims := map[string]any{
+		"sub":  imp.Subject,
+		"role": imp.Role,
+		"iat":  imp.StartedAt.Unix(),
+		"exp":  imp.ExpiresAt.Unix(),
+		"jti":  randomHex(8),
+		"act":  map[string]any{"sub": imp.Actor},
+		"imp":  imp.ID,
+	}
+	if imp.Instructor != "" {
+		claims["name"] = imp.Instructor
+	}
+	return signClaims(claims)
+}
+
+// impersonationTarget returns who req asks to impersonate, or what is
+// wrong with it.
+func impersonationTarget(req impersonationRequest) (principal, string) {
+	if req.User != "" {
+		if req.Subject != "" || req.Role != "" || req.Instructor != "" {
+			return principal{}, "give either user or subject, role and instructor"
+		}
+		userMu.Lock()
+		defer userMu.Unlock()
+		u := users[strings.ToLower(req.User)]
+		if u == nil {
+			return principal{}, "unknown user " + req.User
+		}
+		return u.principal(), ""
+	}
+	if strings.TrimSpace(req.Subject) == "" {
+		return principal{}, "user or subject is required"
+	}
+	if msg := checkRole(req.Role, req.Instructor); msg != "" {
+		return principal{}, msg
+	}
+	return principal{Subject: req.Subject, Role: req.Role, Instructor: req.Instructor}, ""
+}
+
+type impersonationRequest struct {
+	User       string `json:"user"`
+	Subject    string `json:"subject"`
+	Role       string `json:"role"`
+	Instructor string `json:"instructor"`
+	Reason     string `json:"reason"`
+	TTL        string `json:"ttl"`
+}
+
+// impersonationResponse is a started impersonation with its token.
+type impersonationResponse struct {
+	impersonation
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"` // seconds
+}
+
+// adminImpersonationsHandler serves /admin/impersonations: GET lists the
+// impersonations, POST starts one.
+func adminImpersonationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		impersonationMu.Lock()
+		list := make([]impersonation, 0, len(impersonations))
+		for _, imp := range slices.Backward(impersonations) {
+			list = append(list, imp.view(now))
+		}
+		impersonationMu.Unlock()
+		writeValue(w, r, http.StatusOK, list)
+
+	case http.MethodPost:
+		if !tokenSigningEnabled() {
+			writeError(w, r, "Impersonation is not enabled; set JWT_SIGNING_KEYS_FILE or JWT_HMAC_SECRET", http.StatusConflict)
+			return
+		}
+		op := operatorPrincipal(r)
+		switch {
+		case op.Actor != "":
+			writeError(w, r, "Forbidden: cannot impersonate while impersonating", http.StatusForbidden)
+			return
+		case op.Role != roleAdmin:
+			writeError(w, r, "Forbidden: only admins can impersonate", http.StatusForbidden)
+			return
+		}
+		var req impersonationRequest
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		who, msg := impersonationTarget(req)
+		ttl := impersonationTTL
+		if msg == "" && req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil || d <= 0 || d > impersonationTTL {
+				msg = "ttl must be a positive duration of at most " + impersonationTTL.String()
+			}
+			ttl = d
+		}
+		switch {
+		case msg != "":
+		case strings.TrimSpace(req.Reason) == "":
+			msg = "reason is required"
+		case who.Role == roleAdmin:
+			msg = "admins cannot be impersonated"
+		case who.Subject == op.Subject:
+			msg = "cannot impersonate yourself"
+		}
+		if msg != "" {
+			writeError(w, r, msg, http.StatusBadRequest)
+			return
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		imp := &impersonation{
+			ID: randomHex(8), Actor: op.Subject, Subject: who.Subject, Role: who.Role, Instructor: who.Instructor,
+			Reason: req.Reason, StartedAt: now, ExpiresAt: now.Add(ttl),
+		}
+		token, err := signImpersonationToken(imp)
+		if err != nil {
+			requestLogger(r).Error("Error signing impersonation token", "err", err)
+			writeError(w, r, "Cannot issue an impersonation token", http.StatusInternalServerError)
+			return
+		}
+		impersonationMu.Lock()
+		impersonations = append(impersonations, imp)
+		for i := 0; len(impersonations) > maxImpersonations && i < len(impersonations); {
+			if impersonations[i].active(now) {
+				i++
+				continue
+			}
+			impersonations = slices.Delete(impersonations, i, i+1)
+		}
+		view := imp.view(now)
+		impersonationMu.Unlock()
+		requestLogger(r).Warn("Impersonation started", "impersonation", imp.ID, "actor", imp.Actor, "subject", imp.Subject,
+			"role", imp.Role, "reason", imp.Reason, "expires_at", imp.ExpiresAt)
+		w.Header().Set("Location", "/admin/impersonations/"+imp.ID)
+		w.Header().Set("Cache-Control", "no-store")
+		writeValue(w, r, http.StatusCreated, impersonationResponse{
+			impersonation: view, AccessToken: token, TokenType: "Bearer", ExpiresIn: int(ttl.Seconds()),
+		})
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminImpersonationHandler serves /admin/impersonations/{id}: GET shows
+// it, DELETE ends it.
+func adminImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	now := time.Now()
+	impersonationMu.Lock()
+	imp := findImpersonation(id)
+	if imp == nil {
+		impersonationMu.Unlock()
+		writeError(w, r, "Impersonation not found", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodGet {
+		view := imp.view(now)
+		impersonationMu.Unlock()
+		writeValue(w, r, http.StatusOK, view)
+		return
+	}
+	ended := endImpersonation(imp, operatorPrincipal(r).Subject, now)
+	impersonationMu.Unlock()
+	if ended {
+		requestLogger(r).Warn("Impersonation ended", "impersonation", id, "actor", imp.Actor, "subject", imp.Subject, "ended_by", imp.EndedBy)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authImpersonationHandler serves DELETE /auth/impersonation, which ends
+// the impersonation of the request's own token, for the banner's "stop"
+// button.
+func authImpersonationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c, _ := requestClaims(r)
+	id, actor := impersonationOf(c)
+	if id == "" {
+		writeError(w, r, "Not impersonating", http.StatusNotFound)
+		return
+	}
+	impersonationMu.Lock()
+	imp := findImpersonation(id)
+	if imp != nil {
+		endImpersonation(imp, actor, time.Now())
+	}
+	impersonationMu.Unlock()
+	// The request's logger names the impersonation already.
+	requestLogger(r).Warn("Impersonation ended", "ended_by", actor)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// endImpersonation ends imp on behalf of by, unless it is over already.
+// Callers must hold impersonationMu.
+func endImpersonation(imp *impersonation, by string, now time.Time) bool {
+	if !imp.active(now) {
+		return false
+	}
+	at := now.UTC()
+	imp.EndedAt, imp.EndedBy = &at, by
+	return true
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ให้ admin สวมรอยเป็นผู้ใช้ (impersonation) เพื่อช่วยแก้ปัญหา โดยมีเวลาจำกัดและบันทึกทุกการกระทำ
+
+	1. `POST /admin/impersonations` ระบุ `user` (ผู้ใช้ใน credentials.go) หรือ `subject` + `role` (+ `instructor`) และ `reason` (บังคับ)
+	   - ได้ access token (JWT HS256) ของผู้ใช้นั้น มี claim `act` = admin ตาม RFC 8693 อายุ `ttl` ที่ขอ ไม่เกิน `IMPERSONATION_TTL` (30 นาที)
+	   - สวมรอย admin ไม่ได้, สวมรอยซ้อนไม่ได้, เอา token ไปแลก session หรือ refresh token ไม่ได้ จึงไม่มีทางอยู่เกินเวลา
+	2. ทุก response ของ request ที่ใช้ token นี้มี `X-Impersonated-By` และ `X-Impersonation-Expires` ไว้ให้ UI แสดง banner
+	3. ทุก request ถูกบันทึกเป็น action ของ impersonation นั้น (method, path, status, request ID) และ log / policy decision มีทั้ง subject และ actor
+	4. จบก่อนเวลาได้ด้วย `DELETE /admin/impersonations/{id}` หรือ `DELETE /auth/impersonation` (ใช้ token นั้นเอง)
+	5. เก็บในหน่วยความจำเท่านั้น restart แล้ว token เดิมใช้ไม่ได้ทันที
+*/
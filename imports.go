@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// POST /courses/import creates many courses from one file without holding
+// the request open while they are stored. The file is parsed into rows
+// and answered 202 with the import's ID at once; a single worker then
+// creates the rows in the background, IMPORT_BATCH_SIZE (default 100) at
+// a time and no faster than IMPORT_RATE rows a second (default 200), so a
+// large import leaves room on courseMu for everyone else. GET
+// /imports/{id} reports progress and the error of every row that failed,
+// and DELETE cancels what has not been created yet.
+//
+// The file is a JSON array of courses, as POSTed to /courses, or CSV
+// (Content-Type: text/csv) with a header row naming some of name, price,
+// instructor, seats, access_days and private. Rows are checked like any
+// other create, as the caller; one that fails does not stop the rest.
+//
+// At most maxQueuedImports wait behind the one running. When the queue is
+// full an import is refused with 503 and Retry-After rather than piling
+// up. Only the newest maxKeptImports finished imports are kept.
+
+const (
+	maxQueuedImports = 10
+	maxKeptImports   = 100
+	// maxImportErrors caps the row errors kept for one import.
+	maxImportErrors = 1000
+)
+
+// Import statuses.
+const (
+	importQueued    = "queued"
+	importRunning   = "running"
+	importSucceeded = "succeeded" // every row processed, some may have failed
+	importCancelled = "cancelled"
+)
+
+var (
+	importBatchSize = 100
+	importRate      = 200.0 // rows a second
+)
+
+func init() {
+	if v := os.Getenv("IMPORT_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid IMPORT_BATCH_SIZE %q: must be a positive integer", v)
+		}
+		importBatchSize = n
+	}
+	if v := os.Getenv("IMPORT_RATE"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 {
+			log.Fatalf("Invalid IMPORT_RATE %q: must be a positive number of rows a second", v)
+		}
+		importRate = f
+	}
+}
+
+type importRowError struct {
+	Row   int    `json:"row"` // 1-based, not counting a CSV header
+	Error string `json:"error"`
+}
+
+// courseImport is one import and its progress.
+type courseImport struct {
+	ID         string           `json:"id"`
+	Status     string           `json:"status"`
+	Total      int              `json:"total"`
+	Processed  int              `json:"processed"`
+	Created    int              `json:"created"`
+	Failed     int              `json:"failed"`
+	Errors     []importRowError `json:"errors"`
+	CreatedAt  time.Time        `json:"created_at"`
+	StartedAt  *time.Time       `json:"started_at,omitempty"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+
+	who       principal
+	rows      []importRow
+	cancelled bool
+}
+
+// importRow is a parsed row, or why it could not be parsed.
+type importRow struct {
+	course course
+	err    error
+}
+
+var (
+	// importMu protects courseImports and every import in it.
+	importMu      sync.Mutex
+	courseImports []*courseImport // oldest first
+	importQueue   = make(chan *courseImport, maxQueuedImports)
+)
+
+// view is a copy of im for a response. Callers must hold importMu.
+func (im *courseImport) view() courseImport {
+	v := *im
+	v.Errors = slices.Clone(im.Errors)
+	v.rows = nil
+	return v
+}
+
+func (im *courseImport) finished() bool {
+	return im.FinishedAt != nil
+}
+
+// parseImportFile splits an import file into rows by its content type.
+func parseImportFile(contentType string, data []byte) ([]importRow, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "text/csv" {
+		return parseImportCSV(data)
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.New("the file is not a JSON array of courses")
+	}
+	rows := make([]importRow, len(raw))
+	for i, m := range raw {
+		if err := json.Unmarshal(m, &rows[i].course); err != nil {
+			rows[i].err = errors.New("invalid course JSON")
+		}
+	}
+	return rows, nil
+}
+
+var importCSVColumns = []string{"name", "price", "instructor", "seats", "access_days", "private"}
+
+func parseImportCSV(data []byte) ([]importRow, error) {
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, errors.New("the CSV file has no header row")
+	}
+	for _, col := range header {
+		if !slices.Contains(importCSVColumns, col) {
+			return nil, fmt.Errorf("unknown CSV column %q; use %s", col, strings.Join(importCSVColumns, ", "))
+		}
+	}
+	var rows []importRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %v", err)
+		}
+		var row importRow
+		if len(record) != len(header) {
+			row.err = fmt.Errorf("%d fields; the header has %d", len(record), len(header))
+		}
+		for i := 0; i < len(record) && row.err == nil; i++ {
+			c, v := &row.course, strings.TrimSpace(record[i])
+			switch header[i] {
+			case "name":
+				c.CourseName = v
+			case "instructor":
+				c.Instructor = v
+			case "private":
+				if v != "" {
+					c.Private, err = strconv.ParseBool(v)
+				}
+			default:
+				var n int
+				if v != "" {
+					n, err = strconv.Atoi(v)
+				}
+				switch header[i] {
+				case "price":
+					c.CoursePrice = n
+				case "seats":
+					c.Seats = n
+				case "access_days":
+					c.AccessDays = n
+				}
+			}
+			if err != nil {
+				row.err = fmt.Errorf("invalid %s %q", header[i], v)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// runImports works through the queue, one import at a time.
+func runImports() {
+	for im := range importQueue {
+		runImport(im)
+	}
+}
+
+// runImport creates im's rows in batches, pacing them at importRate.
+func runImport(im *courseImport) {
+	importMu.Lock()
+	if im.cancelled {
+		importMu.Unlock()
+		return
+	}
+	j := trackJob(jobImport, im.ID)
+	j.attempt()
+	started := time.Now().UTC()
+	im.Status, im.StartedAt = importRunning, &started
+	rows, who := im.rows, im.who
+	importMu.Unlock()
+
+	perBatch := time.Duration(float64(time.Second) * float64(importBatchSize) / importRate)
+	for start := 0; start < len(rows); start += importBatchSize {
+		batchStart := time.Now()
+		for i, row := range rows[start:min(start+importBatchSize, len(rows))] {
+			err := row.err
+			if err == nil {
+				_, err = createCourse(who, row.course)
+			}
+			importMu.Lock()
+			im.Processed++
+			if err != nil {
+				im.Failed++
+				if len(im.Errors) < maxImportErrors {
+					im.Errors = append(im.Errors, importRowError{Row: start + i + 1, Error: err.Error()})
+				}
+			} else {
+				im.Created++
+			}
+			importMu.Unlock()
+		}
+		importMu.Lock()
+		cancelled := im.cancelled
+		importMu.Unlock()
+		if cancelled {
+			break
+		}
+		if start+importBatchSize < len(rows) {
+			time.Sleep(perBatch - time.Since(batchStart))
+		}
+	}
+
+	importMu.Lock()
+	now := time.Now().UTC()
+	im.FinishedAt = &now
+	im.rows = nil
+	im.Status = importSucceeded
+	if im.cancelled {
+		im.Status = importCancelled
+	}
+	slog.Info("Course import finished", "import", im.ID, "status", im.Status, "created", im.Created, "failed", im.Failed, "total", im.Total)
+	importMu.Unlock()
+	j.done(nil)
+}
+
+// courseImportHandler serves POST /courses/import.
+func courseImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	rows, err := parseImportFile(r.Header.Get("Content-Type"), data)
+	if err != nil {
+		writeError(w, r, "Invalid import file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rows) == 0 {
+		writeError(w, r, "The import file has no courses", http.StatusBadRequest)
+		return
+	}
+	if t := requestTenant(r); t != nil {
+		for i := range rows {
+			rows[i].course.Tenant = t.ID
+		}
+	}
+	im := &courseImport{
+		ID:        randomHex(8),
+		Status:    importQueued,
+		Total:     len(rows),
+		Errors:    []importRowError{},
+		CreatedAt: time.Now().UTC(),
+		who:       requestPrincipal(r),
+		rows:      rows,
+	}
+	importMu.Lock()
+	select {
+	case importQueue <- im:
+	default:
+		importMu.Unlock()
+		w.Header().Set("Retry-After", "30")
+		writeError(w, r, "Too many imports are waiting; try again later", http.StatusServiceUnavailable)
+		return
+	}
+	courseImports = append(courseImports, im)
+	finished := 0
+	for _, x := range courseImports {
+		if x.finished() {
+			finished++
+		}
+	}
+	for i := 0; finished > maxKeptImports && i < len(courseImports); {
+		if courseImports[i].finished() {
+			courseImports = slices.Delete(courseImports, i, i+1)
+			finished--
+		} else {
+			i++
+		}
+	}
+	view := im.view()
+	importMu.Unlock()
+
+	w.Header().Set("Location", "/imports/"+im.ID)
+	writeValue(w, r, http.StatusAccepted, view)
+}
+
+// importHandler serves GET /imports/{id}, the import's progress, and
+// DELETE, which cancels it. Courses already created stay. Either needs
+// the credentials course writes need, and anyone but an admin sees only
+// their own imports.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if err := authorizeCourseWrite(r); err != nil {
+		writeAuthError(w, r, err)
+		return
+	}
+	who := requestPrincipal(r)
+	importMu.Lock()
+	defer importMu.Unlock()
+	i := slices.IndexFunc(courseImports, func(im *courseImport) bool {
+		return im.ID == r.PathValue("id") && (who.Role == roleAdmin || im.who.Subject == who.Subject)
+	})
+	if i < 0 {
+		writeError(w, r, "Import not found", http.StatusNotFound)
+		return
+	}
+	im := courseImports[i]
+	switch r.Method {
+	case http.MethodGet:
+		writeValue(w, r, http.StatusOK, im.view())
+	case http.MethodDelete:
+		if im.finished() {
+			writeError(w, r, "The import is already "+im.Status, http.StatusConflict)
+			return
+		}
+		im.cancelled = true
+		if im.Status == importQueued {
+			// The worker skips it when its turn comes.
+			now := time.Now().UTC()
+			im.Status, im.FinishedAt, im.rows = importCancelled, &now, nil
+		}
+		writeValue(w, r, http.StatusAccepted, im.view())
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: import course ทีละมากๆ แบบ async ไม่ให้ request เดียวค้างนาน และไม่แย่ง store จนคนอื่นช้า
+
+	1. `POST /courses/import` รับไฟล์ JSON array หรือ CSV (`text/csv` มี header) ตอบ 202 พร้อม ID ทันที แล้วทำเบื้องหลัง
+	   - ไฟล์ผิดรูปแบบทั้งไฟล์ได้ 400 ทันที แถวที่ผิดแค่บางแถวบันทึกเป็น error ของแถวนั้น แถวอื่นทำต่อ
+	   - แต่ละแถวสร้างด้วยสิทธิ์ของผู้ส่ง ผ่านกฎเดียวกับ POST `/courses`
+	2. ทำทีละ `IMPORT_BATCH_SIZE` แถว (ค่าเริ่มต้น 100) ไม่เกิน `IMPORT_RATE` แถวต่อวินาที (200) ทีละ import เดียว
+	   - คิวเต็ม (รอได้ 10) ตอบ 503 + `Retry-After` แทนการรับไว้จนล้น
+	3. `GET /imports/{id}` ดูความคืบหน้าและ error รายแถว, `DELETE` ยกเลิก (course ที่สร้างแล้วยังอยู่)
+	   - ต้องมีสิทธิ์เขียน course และเห็นเฉพาะ import ของตัวเอง ยกเว้น admin
+*/
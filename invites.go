@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"net/http"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Private courses (course.Private) are left out of the public catalog and
+// can only be viewed or joined by allowlisted students or with an invite
+// code. The viewer's email comes from their credentials: the "email" claim
+// of a JWT, or a subject that is an email address, as Google sign-ins are.
+// Only a deployment with no credentials or sign-in set up takes it from
+// the X-User-Email header, set by a front end's own auth layer; anywhere
+// else a caller could claim any address with it.
+const (
+	inviteCodeHeader = "X-Invite-Code"
+	userEmailHeader  = "X-User-Email"
+
+	// privateCacheControl keeps responses about private courses out of
+	// shared caches, which key on the URL alone.
+	privateCacheControl = "private, no-store"
+)
+
+type courseInvite struct {
+	Code        string             `json:"code"`
+	MaxUses     int                `json:"max_uses,omitempty"` // 0 means unlimited
+	Uses        int                `json:"uses"`
+	Revoked     bool               `json:"revoked"`
+	CreatedAt   time.Time          `json:"created_at"`
+	Redemptions []inviteRedemption `json:"redemptions"`
+}
+
+type inviteRedemption struct {
+	Student    string    `json:"student"`
+	RedeemedAt time.Time `json:"redeemed_at"`
+}
+
+func (inv *courseInvite) usable() bool {
+	return !inv.Revoked && (inv.MaxUses == 0 || inv.Uses < inv.MaxUses)
+}
+
+// courseAccessList holds who may see a private course.
+type courseAccessList struct {
+	invites   []*courseInvite
+	allowlist []string // lower-cased emails
+}
+
+// courseInvites is keyed by course ID and protected by courseMu.
+var courseInvites = make(map[int]*courseAccessList)
+
+func accessListFor(id int) *courseAccessList {
+	l := courseInvites[id]
+	if l == nil {
+		l = &courseAccessList{}
+		courseInvites[id] = l
+	}
+	return l
+}
+
+func (l *courseAccessList) invite(code string) *courseInvite {
+	for _, inv := range l.invites {
+		if strings.EqualFold(inv.Code, code) {
+			return inv
+		}
+	}
+	return nil
+}
+
+func (l *courseAccessList) allows(email string) bool {
+	return email != "" && slices.Contains(l.allowlist, strings.ToLower(email))
+}
+
+// requestInviteCode returns the invite code sent with r, as a header or as
+// the ?invite= query parameter for shareable links.
+func requestInviteCode(r *http.Request) string {
+	if code := r.Header.Get(inviteCodeHeader); code != "" {
+		return strings.TrimSpace(code)
+	}
+	return strings.TrimSpace(r.URL.Query().Get("invite"))
+}
+
+// canViewCourse reports whether the client behind r may see c. Callers must
+// hold courseMu.
+func canViewCourse(r *http.Request, c course) bool {
+	if !tenantOwns(r, c) {
+		return false
+	}
+	if !c.Private {
+		return true
+	}
+	if k, ok := requestAPIKey(r); ok && k.hasScope(scopeCoursesPrivate) {
+		return true
+	}
+	if isClientToken(r) && tokenScopeAllows(r, scopeCoursesPrivate) {
+		return true
+	}
+	l := courseInvites[c.CourseId]
+	if l == nil {
+		return false
+	}
+	email := viewerEmail(r)
+	if l.allows(email) {
+		return true
+	}
+	// Students who already redeemed a code keep seeing the course after the
+	// code is used up or revoked.
+	if _, enrolled := findEnrollment(c.CourseId, email); email != "" && enrolled {
+		return true
+	}
+	inv := l.invite(requestInviteCode(r))
+	return inv != nil && inv.usable()
+}
+
+// viewerEmail returns the email of the caller behind r, or "" if it is
+// not known.
+func viewerEmail(r *http.Request) string {
+	if c, ok := requestClaims(r); ok {
+		if email, _ := c.Raw["email"].(string); email != "" {
+			return email
+		}
+		return subjectEmail(c.Subject)
+	}
+	if s, ok := requestSession(r); ok {
+		return subjectEmail(s.Subject)
+	}
+	if authRequired() || oauthEnabled() {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(userEmailHeader))
+}
+
+// subjectEmail returns subject if it is a bare email address.
+func subjectEmail(subject string) string {
+	if a, err := mail.ParseAddress(subject); err == nil && a.Address == subject {
+		return subject
+	}
+	return ""
+}
+
+// admitStudent reports whether student may join c, and records the invite
+// redemption if a code was needed. Public courses admit everyone. Callers
+// must hold courseMu for writing.
+func admitStudent(c course, student, code string) bool {
+	if !c.Private {
+		return true
+	}
+	l := courseInvites[c.CourseId]
+	if l == nil {
+		return false
+	}
+	if l.allows(student) {
+		return true
+	}
+	inv := l.invite(code)
+	if inv == nil || !inv.usable() {
+		return false
+	}
+	inv.Uses++
+	inv.Redemptions = append(inv.Redemptions, inviteRedemption{Student: student, RedeemedAt: time.Now().UTC()})
+	return true
+}
+
+// publicCourses returns the courses listed in the public catalog.
+func publicCourses(courses []course) []course {
+	return slices.DeleteFunc(slices.Clone(courses), func(c course) bool { return c.Private })
+}
+
+func newInviteCode() string {
+	b := make([]byte, 5)
+	rand.Read(b)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+}
+
+// adminInvitesHandler serves GET and POST /admin/courses/{id}/invites. POST
+// generates a new code, optionally limited to max_uses redemptions.
+func adminInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		courseMu.RLock()
+		defer courseMu.RUnlock()
+		if findCourseIndex(id) < 0 {
+			writeError(w, r, "Course not found", http.StatusNotFound)
+			return
+		}
+		invites := []*courseInvite{}
+		if l := courseInvites[id]; l != nil {
+			invites = l.invites
+		}
+		writeValue(w, r, http.StatusOK, invites)
+
+	case http.MethodPost:
+		var req struct {
+			MaxUses int `json:"max_uses"`
+		}
+		if r.ContentLength != 0 && !decodeBody(w, r, &req) {
+			return
+		}
+		if req.MaxUses < 0 {
+			writeError(w, r, "max_uses must not be negative", http.StatusBadRequest)
+			return
+		}
+		courseMu.Lock()
+		defer courseMu.Unlock()
+		if findCourseIndex(id) < 0 {
+			writeError(w, r, "Course not found", http.StatusNotFound)
+			return
+		}
+		l := accessListFor(id)
+		inv := &courseInvite{MaxUses: req.MaxUses, CreatedAt: time.Now().UTC(), Redemptions: []inviteRedemption{}}
+		for inv.Code == "" || l.invite(inv.Code) != nil {
+			inv.Code = newInviteCode()
+		}
+		l.invites = append(l.invites, inv)
+		writeValue(w, r, http.StatusCreated, inv)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminInviteHandler serves DELETE /admin/courses/{id}/invites/{code}. A
+// revoked code stops working but stays listed with its redemptions.
+func adminInviteHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	courseMu.Lock()
+	defer courseMu.Unlock()
+	var inv *courseInvite
+	if l := courseInvites[id]; l != nil {
+		inv = l.invite(r.PathValue("code"))
+	}
+	if inv == nil {
+		writeError(w, r, "Invite not found", http.StatusNotFound)
+		return
+	}
+	inv.Revoked = true
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminAllowlistHandler serves GET and PUT /admin/courses/{id}/allowlist.
+// PUT replaces the list of emails admitted without a code.
+func adminAllowlistHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+	type allowlist struct {
+		Emails []string `json:"emails"`
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		courseMu.RLock()
+		defer courseMu.RUnlock()
+		if findCourseIndex(id) < 0 {
+			writeError(w, r, "Course not found", http.StatusNotFound)
+			return
+		}
+		list := allowlist{Emails: []string{}}
+		if l := courseInvites[id]; l != nil {
+			list.Emails = append(list.Emails, l.allowlist...)
+		}
+		writeValue(w, r, http.StatusOK, list)
+
+	case http.MethodPut:
+		var req allowlist
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		emails := []string{}
+		for _, e := range req.Emails {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if !strings.Contains(e, "@") {
+				writeError(w, r, "Invalid email "+strconv.Quote(e), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(emails, e) {
+				emails = append(emails, e)
+			}
+		}
+		courseMu.Lock()
+		defer courseMu.Unlock()
+		if findCourseIndex(id) < 0 {
+			writeError(w, r, "Course not found", http.StatusNotFound)
+			return
+		}
+		accessListFor(id).allowlist = emails
+		writeValue(w, r, http.StatusOK, allowlist{Emails: emails})
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: คอร์สส่วนตัว (Private Beta) และ Invite Code
+
+	1. course ที่ตั้ง `"private": true` จะไม่แสดงใน `GET /courses` และ `GET /courses/{id}` จะตอบ 404 ถ้าไม่มีสิทธิ์ (ไม่บอกด้วยซ้ำว่ามีคอร์สนี้)
+	   - มีสิทธิ์ได้สองทาง: email อยู่ใน allowlist หรือมี invite code (header `X-Invite-Code` หรือ `?invite=`)
+	   - email มาจาก credential ของผู้เรียก (claim `email` ของ JWT หรือ subject ที่เป็น email เช่น session จาก Google) ส่วน header `X-User-Email` ใช้เฉพาะ deployment ที่ยังไม่ตั้ง credential หรือ login ใด ๆ เพราะใครก็ปลอม header ได้
+	   - response ของคอร์สส่วนตัวใช้ `Cache-Control: private, no-store` เพื่อไม่ให้ caching proxy เก็บไปแจกคนอื่น
+	2. การลงทะเบียน (`POST /courses/{id}/enrollments`) ต้องส่ง `invite_code` หรือใช้ชื่อ student ที่อยู่ใน allowlist ทุกครั้งที่ใช้ code จะถูกบันทึก (redemption)
+	3. admin จัดการได้ที่:
+	   - `POST /admin/courses/{id}/invites` สร้าง code ใหม่ (กำหนด `max_uses` ได้), `GET` ดูรายการและจำนวนที่ใช้ไป
+	   - `DELETE /admin/courses/{id}/invites/{code}` ยกเลิก code (ยังเก็บประวัติไว้)
+	   - `GET`/`PUT /admin/courses/{id}/allowlist` ดู/ตั้งรายชื่อ email ที่เข้าได้โดยไม่ต้องมี code
+*/
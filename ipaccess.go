@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// IP_ACCESS_FILE restricts who may reach the server, or parts of it, by
+// client address, before any routing. It is a JSON list of rules, each for
+// the paths under a prefix:
+//
+//	[{"path": "/admin/", "allow": ["10.8.0.0/16", "203.0.113.0/24"]},
+//	 {"path": "/", "deny": ["198.51.100.0/24"]}]
+//
+// A request must pass every rule whose path it is under: its address may
+// not be in deny, and must be in allow if allow is not empty. A bare
+// address is a single host. The client address is the one the rate limiter
+// uses (ratelimit.go), so set TRUSTED_PROXIES behind a load balancer.
+// Health checks and requests from the machine itself, such as the warm-up,
+// always pass.
+//
+// The file is read again when it changes, within ipAccessCheckInterval; a
+// file that no longer parses is logged and the rules already loaded stay.
+
+const ipAccessCheckInterval = 5 * time.Second
+
+type ipAccessRule struct {
+	Path  string   `json:"path"`
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	allow, deny []netip.Prefix
+}
+
+var (
+	ipAccessFile  = os.Getenv("IP_ACCESS_FILE")
+	ipAccessRules atomic.Pointer[[]ipAccessRule]
+)
+
+func init() {
+	if ipAccessFile == "" {
+		return
+	}
+	rules, _, err := loadIPAccessRules(ipAccessFile)
+	if err != nil {
+		log.Fatalf("Invalid IP_ACCESS_FILE: %v", err)
+	}
+	ipAccessRules.Store(&rules)
+}
+
+// loadIPAccessRules reads the rules in name and its modification time.
+func loadIPAccessRules(name string) ([]ipAccessRule, time.Time, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var rules []ipAccessRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s: %v", name, err)
+	}
+	for i := range rules {
+		r := &rules[i]
+		if !strings.HasPrefix(r.Path, "/") {
+			return nil, time.Time{}, fmt.Errorf("%s: path %q must start with /", name, r.Path)
+		}
+		if r.allow, err = parseIPPrefixes(r.Allow); err == nil {
+			r.deny, err = parseIPPrefixes(r.Deny)
+		}
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("%s: %s: %v", name, r.Path, err)
+		}
+	}
+	return rules, fi.ModTime(), nil
+}
+
+// parseIPPrefixes parses CIDRs, taking a bare address as a single host.
+func parseIPPrefixes(list []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if addr, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", s)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// watchIPAccessFile loads IP_ACCESS_FILE again whenever its modification
+// time changes.
+func watchIPAccessFile(interval time.Duration) {
+	var loaded time.Time
+	if fi, err := os.Stat(ipAccessFile); err == nil {
+		loaded = fi.ModTime()
+	}
+	for range time.Tick(interval) {
+		fi, err := os.Stat(ipAccessFile)
+		if err != nil || fi.ModTime().Equal(loaded) {
+			continue
+		}
+		rules, modTime, err := loadIPAccessRules(ipAccessFile)
+		if err != nil {
+			slog.Error("Keeping the previous IP access rules", "err", err)
+			loaded = fi.ModTime()
+			continue
+		}
+		ipAccessRules.Store(&rules)
+		loaded = modTime
+		slog.Info("Loaded IP access rules", "rules", len(rules), "file", ipAccessFile)
+	}
+}
+
+func containsIP(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipAccessHandler answers 403 to requests the rules do not let through.
+func ipAccessHandler(next http.Handler) http.Handler {
+	if ipAccessFile == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := clientIP(r)
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || addr.IsLoopback() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, rule := range *ipAccessRules.Load() {
+			if !strings.HasPrefix(r.URL.Path, rule.Path) {
+				continue
+			}
+			if containsIP(rule.deny, addr) || len(rule.allow) > 0 && !containsIP(rule.allow, addr) {
+				writeError(w, r, "Forbidden: your address may not access this", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: จำกัดว่า IP ไหนเข้าอะไรได้ ด้วย allowlist/denylist แบบ CIDR ก่อนถึง routing เช่นให้ `/admin` เข้าได้เฉพาะออฟฟิศ/VPN
+
+	1. ตั้ง `IP_ACCESS_FILE` เป็นไฟล์ JSON รายการกฎ แต่ละกฎมี `path` (prefix) กับ `allow` และ/หรือ `deny`
+	   - request ต้องผ่านทุกกฎที่ path ตรง: อยู่ใน deny = 403, มี allow แต่ไม่อยู่ในนั้น = 403
+	   - ใส่ IP เดี่ยวได้ (นับเป็น host เดียว) IP ของ client ใช้วิธีเดียวกับ rate limit ต้องตั้ง `TRUSTED_PROXIES` เมื่ออยู่หลัง load balancer
+	   - `/healthz`, `/readyz` และ request จากเครื่องตัวเอง (warm-up) ผ่านเสมอ
+	2. แก้ไฟล์แล้วมีผลเองภายในไม่กี่วินาที (ดูจากเวลาแก้ไขไฟล์) ไม่ต้อง restart
+	   - ไฟล์ใหม่ผิดรูปแบบ: log ไว้แล้วใช้กฎชุดเดิมต่อ; ผิดตั้งแต่ตอน start: start ไม่ขึ้น
+*/
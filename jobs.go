@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Background jobs report to a tracker so that trouble shows up before
+// anyone misses an email. For each job type it keeps the queue depth, how
+// many jobs succeeded, failed and were retried, the latency from being
+// queued to finishing, and the failure rate over the last jobRecentWindow
+// jobs. GET /admin/jobs returns those numbers and the recent jobs, which
+// ?status= and ?type= filter; GET /admin/jobs/metrics has the same numbers
+// in the Prometheus text format, for a scraper.
+//
+// A job is tracked from trackJob until done; attempt and retrying mark
+// the steps in between. Only the newest maxTrackedJobs finished jobs are
+// kept, and unfinished ones are never dropped.
+
+// Job types.
+const (
+	jobWebhook         = "webhook"
+	jobExpiryReminder  = "expiry-reminder"
+	jobWarehouseExport = "warehouse-export"
+	jobDualWrite       = "dual-write"
+	jobEmail           = "email"
+	jobProbe           = "synthetic-probe"
+	jobImport          = "course-import"
+	jobCourseExport    = "course-export"
+	jobKeyRotation     = "key-rotation"
+)
+
+var jobTypes = []string{jobWebhook, jobExpiryReminder, jobWarehouseExport, jobDualWrite, jobEmail, jobProbe, jobImport, jobCourseExport, jobKeyRotation}
+
+// Job statuses.
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobRetrying  = "retrying" // waiting for the next attempt
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+var jobStatuses = []string{jobQueued, jobRunning, jobRetrying, jobSucceeded, jobFailed}
+
+const (
+	maxTrackedJobs  = 500
+	jobRecentWindow = 100
+)
+
+type trackedJob struct {
+	ID         string     `json:"id"` // the job's own ID, such as the webhook delivery's
+	Type       string     `json:"type"`
+	Status     string     `json:"status"`
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error,omitempty"` // of the last attempt
+	QueuedAt   time.Time  `json:"queued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type jobTypeStats struct {
+	Type      string `json:"type"`
+	Queued    int    `json:"queued"` // queued or waiting for a retry
+	Running   int    `json:"running"`
+	Succeeded int64  `json:"succeeded"`
+	Failed    int64  `json:"failed"`
+	Retries   int64  `json:"retries"`
+	// FailureRate and the latencies are over the last jobRecentWindow
+	// finished jobs.
+	FailureRate  float64 `json:"failure_rate"`
+	LatencyP50MS int64   `json:"latency_p50_ms"`
+	LatencyP95MS int64   `json:"latency_p95_ms"`
+
+	latencySum time.Duration // of every finished job
+	recent     []jobOutcome
+}
+
+type jobOutcome struct {
+	latency time.Duration
+	failed  bool
+}
+
+var (
+	// jobsMu protects trackedJobs, oldest first, and jobStats. It is taken
+	// with courseMu or webhookMu held, so it must never be held while
+	// acquiring either.
+	jobsMu      sync.Mutex
+	trackedJobs []*trackedJob
+	jobStats    = make(map[string]*jobTypeStats)
+)
+
+func init() {
+	for _, t := range jobTypes {
+		jobStats[t] = &jobTypeStats{Type: t}
+	}
+}
+
+// trackJob records a job of type typ as queued and returns it.
+func trackJob(typ, id string) *trackedJob {
+	j := &trackedJob{ID: id, Type: typ, Status: jobQueued, QueuedAt: time.Now().UTC()}
+	jobsMu.Lock()
+	trackedJobs = append(trackedJobs, j)
+	finished := 0
+	for _, t := range trackedJobs {
+		if t.FinishedAt != nil {
+			finished++
+		}
+	}
+	for i := 0; finished > maxTrackedJobs && i < len(trackedJobs); {
+		if trackedJobs[i].FinishedAt != nil {
+			trackedJobs = slices.Delete(trackedJobs, i, i+1)
+			finished--
+		} else {
+			i++
+		}
+	}
+	jobsMu.Unlock()
+	return j
+}
+
+// attempt marks j as running another attempt.
+func (j *trackedJob) attempt() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	now := time.Now().UTC()
+	if j.StartedAt == nil {
+		j.StartedAt = &now
+	}
+	j.Attempts++
+	if j.Attempts > 1 {
+		jobStats[j.Type].Retries++
+	}
+	j.Status = jobRunning
+}
+
+// retrying marks j as waiting to be tried again after err.
+func (j *trackedJob) retrying(err error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	j.Status = jobRetrying
+	j.Error = err.Error()
+}
+
+// done marks j as finished, failed if err is not nil.
+func (j *trackedJob) done(err error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	now := time.Now().UTC()
+	j.FinishedAt = &now
+	s := jobStats[j.Type]
+	if err != nil {
+		j.Status = jobFailed
+		j.Error = err.Error()
+		s.Failed++
+	} else {
+		j.Status = jobSucceeded
+		j.Error = ""
+		s.Succeeded++
+	}
+	latency := now.Sub(j.QueuedAt)
+	s.latencySum += latency
+	s.recent = append(s.recent, jobOutcome{latency, err != nil})
+	if n := len(s.recent) - jobRecentWindow; n > 0 {
+		s.recent = slices.Delete(s.recent, 0, n)
+	}
+}
+
+// jobStatsSnapshot returns the stats of every job type. Callers must hold
+// jobsMu.
+func jobStatsSnapshot() []jobTypeStats {
+	list := []jobTypeStats{}
+	for _, t := range jobTypes {
+		s := *jobStats[t]
+		s.Queued, s.Running = 0, 0
+		for _, j := range trackedJobs {
+			switch {
+			case j.Type != t:
+			case j.Status == jobQueued || j.Status == jobRetrying:
+				s.Queued++
+			case j.Status == jobRunning:
+				s.Running++
+			}
+		}
+		if len(s.recent) > 0 {
+			latencies := make([]time.Duration, 0, len(s.recent))
+			failed := 0
+			for _, o := range s.recent {
+				latencies = append(latencies, o.latency)
+				if o.failed {
+					failed++
+				}
+			}
+			slices.Sort(latencies)
+			s.FailureRate = float64(failed) / float64(len(s.recent))
+			s.LatencyP50MS = latencies[len(latencies)*50/100].Milliseconds()
+			s.LatencyP95MS = latencies[len(latencies)*95/100].Milliseconds()
+		}
+		s.recent = nil
+		list = append(list, s)
+	}
+	return list
+}
+
+// adminJobsHandler serves GET /admin/jobs. ?status= and ?type= filter the
+// jobs, newest first, and ?limit= (default 100) caps them.
+func adminJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	status, typ := q.Get("status"), q.Get("type")
+	if status != "" && !slices.Contains(jobStatuses, status) {
+		writeError(w, r, "Unknown status "+strconv.Quote(status)+"; use "+strings.Join(jobStatuses, ", "), http.StatusBadRequest)
+		return
+	}
+	if typ != "" && !slices.Contains(jobTypes, typ) {
+		writeError(w, r, "Unknown job type "+strconv.Quote(typ)+"; use "+strings.Join(jobTypes, ", "), http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	jobsMu.Lock()
+	stats := jobStatsSnapshot()
+	list := []trackedJob{}
+	for _, j := range slices.Backward(trackedJobs) {
+		if len(list) == limit {
+			break
+		}
+		if (status == "" || j.Status == status) && (typ == "" || j.Type == typ) {
+			list = append(list, *j)
+		}
+	}
+	jobsMu.Unlock()
+	writeValue(w, r, http.StatusOK, map[string]any{"queues": stats, "jobs": list})
+}
+
+// adminJobMetricsHandler serves GET /admin/jobs/metrics in the Prometheus
+// text exposition format.
+func adminJobMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobsMu.Lock()
+	stats := jobStatsSnapshot()
+	sums := map[string]time.Duration{}
+	for _, t := range jobTypes {
+		sums[t] = jobStats[t].latencySum
+	}
+	jobsMu.Unlock()
+
+	var b strings.Builder
+	metric := func(name, kind, help string, value func(s jobTypeStats) string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, s := range stats {
+			fmt.Fprintf(&b, "%s{type=%q} %s\n", name, s.Type, value(s))
+		}
+	}
+	metric("jobs_queue_depth", "gauge", "Jobs queued or waiting for a retry.", func(s jobTypeStats) string { return strconv.Itoa(s.Queued) })
+	metric("jobs_running", "gauge", "Jobs being attempted now.", func(s jobTypeStats) string { return strconv.Itoa(s.Running) })
+	fmt.Fprint(&b, "# HELP jobs_processed_total Jobs finished, by outcome.\n# TYPE jobs_processed_total counter\n")
+	for _, s := range stats {
+		fmt.Fprintf(&b, "jobs_processed_total{type=%q,status=%q} %d\n", s.Type, jobSucceeded, s.Succeeded)
+		fmt.Fprintf(&b, "jobs_processed_total{type=%q,status=%q} %d\n", s.Type, jobFailed, s.Failed)
+	}
+	metric("jobs_retries_total", "counter", "Attempts after the first.", func(s jobTypeStats) string { return strconv.FormatInt(s.Retries, 10) })
+	metric("jobs_failure_ratio", "gauge", "Share of the recent finished jobs that failed.", func(s jobTypeStats) string {
+		return strconv.FormatFloat(s.FailureRate, 'g', -1, 64)
+	})
+	fmt.Fprint(&b, "# HELP jobs_latency_seconds Time from being queued to finishing.\n# TYPE jobs_latency_seconds summary\n")
+	for _, s := range stats {
+		fmt.Fprintf(&b, "jobs_latency_seconds_sum{type=%q} %s\n", s.Type, strconv.FormatFloat(sums[s.Type].Seconds(), 'g', -1, 64))
+		fmt.Fprintf(&b, "jobs_latency_seconds_count{type=%q} %d\n", s.Type, s.Succeeded+s.Failed)
+	}
+	writeProbeMetrics(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: มองเห็นสถานะงานเบื้องหลัง (webhook, แจ้งเตือนหมดอายุ, export, dual-write) ก่อนผู้ใช้จะรู้ตัว
+
+	1. งานแต่ละชิ้นรายงานตัวผ่าน `trackJob` → `attempt` → `retrying` → `done` สถานะคือ queued / running / retrying / succeeded / failed
+	2. ต่อประเภทงานมี: จำนวนที่รออยู่ (queue depth), กำลังทำ, สำเร็จ/ล้มเหลวสะสม, จำนวน retry, failure rate และ latency p50/p95 ของ 100 งานล่าสุด
+	   - latency วัดตั้งแต่เข้าคิวจนเสร็จ เพราะเป็นเวลาที่ผู้ใช้รอจริง
+	3. `GET /admin/jobs?status=failed&type=webhook` ได้ตัวเลขรวมกับรายการงานล่าสุด (ใหม่สุดก่อน)
+	4. `GET /admin/jobs/metrics` เป็นรูปแบบ Prometheus ให้ระบบ monitoring มาดึง (ต้องผ่าน gate ของ `/admin`)
+	5. เก็บงานที่เสร็จแล้วแค่ 500 ชิ้นล่าสุด งานที่ยังไม่เสร็จไม่ถูกทิ้ง
+*/
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+const mediaTypeJSONAPI = "application/vnd.api+json"
+
+var jsonAPICodec = &codec{
+	mediaType:   mediaTypeJSONAPI,
+	contentType: mediaTypeJSONAPI,
+	encodeCourse: func(r *http.Request, c course) ([]byte, error) {
+		return json.Marshal(map[string]any{"data": newJSONAPIResource(r, c)})
+	},
+	encodeCourses: func(r *http.Request, courses []course) ([]byte, error) {
+		data := make([]jsonAPIResource, len(courses))
+		for i, c := range courses {
+			data[i] = newJSONAPIResource(r, c)
+		}
+		return json.Marshal(map[string]any{
+			"data":  data,
+			"links": map[string]string{"self": r.URL.RequestURI()},
+		})
+	},
+	decodeCourse: unmarshalJSONAPICourse,
+	encodeError: func(status int, message, requestID string) ([]byte, error) {
+		return json.Marshal(map[string]any{
+			"errors": []jsonAPIError{{
+				ID:     requestID,
+				Status: strconv.Itoa(status),
+				Title:  http.StatusText(status),
+				Detail: message,
+			}},
+		})
+	},
+}
+
+// jsonAPIResource is a JSON:API resource object for a course.
+type jsonAPIResource struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id,omitempty"`
+	Attributes json.RawMessage   `json:"attributes,omitempty"`
+	Links      map[string]string `json:"links,omitempty"`
+	Meta       map[string]any    `json:"meta,omitempty"`
+}
+
+type jsonAPIError struct {
+	ID     string `json:"id,omitempty"` // the request's, which identifies this occurrence
+	Status string `json:"status"`
+	Title  string `json:"title"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// courseAttributes is everything in a course except its ID, which JSON:API
+// carries on the resource object instead.
+type courseAttributes struct {
+	CourseName  string         `json:"name"`
+	CoursePrice int            `json:"price"`
+	Instructor  string         `json:"instructor"`
+	Seats       int            `json:"seats,omitempty"`
+	AccessDays  int            `json:"access_days,omitempty"`
+	PriceBook   []priceEntry   `json:"price_book,omitempty"`
+	Private     bool           `json:"private,omitempty"`
+	Metadata    map[string]any `json:"metadata,omitempty"`
+}
+
+func newJSONAPIResource(r *http.Request, c course) jsonAPIResource {
+	attrs, _ := json.Marshal(courseAttributes{
+		CourseName:  c.CourseName,
+		CoursePrice: c.CoursePrice,
+		Instructor:  c.Instructor,
+		Seats:       c.Seats,
+		AccessDays:  c.AccessDays,
+		PriceBook:   c.PriceBook,
+		Private:     c.Private,
+		Metadata:    c.Metadata,
+	})
+	res := jsonAPIResource{
+		Type:       "courses",
+		ID:         strconv.Itoa(c.CourseId),
+		Attributes: attrs,
+		Links:      map[string]string{"self": newCourseResource(c).Links["self"].Href},
+	}
+	if p := pricingFor(r, c); p != nil {
+		res.Meta = map[string]any{"pricing": p}
+	}
+	return res
+}
+
+// unmarshalJSONAPICourse decodes a JSON:API document whose data is a
+// "courses" resource object onto dst.
+func unmarshalJSONAPICourse(body []byte, dst *course) error {
+	var doc struct {
+		Data *jsonAPIResource `json:"data"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return err
+	}
+	if doc.Data == nil || doc.Data.Type != "courses" {
+		return errors.New(`data must be a resource object of type "courses"`)
+	}
+	if doc.Data.ID != "" {
+		id, err := strconv.Atoi(doc.Data.ID)
+		if err != nil {
+			return errors.New("data.id must be numeric")
+		}
+		dst.CourseId = id
+	}
+	attrs := courseAttributes{dst.CourseName, dst.CoursePrice, dst.Instructor, dst.Seats, dst.AccessDays, dst.PriceBook, dst.Private, dst.Metadata}
+	if len(doc.Data.Attributes) > 0 {
+		if err := json.Unmarshal(doc.Data.Attributes, &attrs); err != nil {
+			return err
+		}
+	}
+	dst.CourseName, dst.CoursePrice, dst.Instructor = attrs.CourseName, attrs.CoursePrice, attrs.Instructor
+	dst.Seats, dst.AccessDays, dst.PriceBook = attrs.Seats, attrs.AccessDays, attrs.PriceBook
+	dst.Private, dst.Metadata = attrs.Private, attrs.Metadata
+	return nil
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: JSON:API (application/vnd.api+json)
+
+	1. resource object มี `type`, `id` (เป็น string), `attributes`, `links` และ `meta` แยกจากกันชัดเจน
+	2. error ถูกส่งเป็น `{"errors": [{"status", "title", "detail"}]}` ตามมาตรฐาน
+	3. request body แบบ JSON:API ก็ decode ได้ โดยอ่านจาก `data.attributes`
+*/
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers SHA-256 for crypto.Hash
+	_ "crypto/sha512" // registers SHA-384 and SHA-512
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Writes to the catalog can require a bearer JWT. JWT_HMAC_SECRET accepts
+// tokens signed with HS256/384/512 and that secret; JWT_RSA_PUBLIC_KEY
+// names a PEM file (public key or certificate) for RS256/384/512. With
+// neither set, tokens are not checked and writes stay open. JWT_ISSUER and
+// JWT_AUDIENCE, when set, must match the iss and aud claims. The server's
+// own managed keys (signingkeys.go) are accepted too, picked by kid.
+//
+// A token sent to any route is verified, and a bad one is rejected with
+// 401 even where none is needed; the claims of a good one are in the
+// request context (requestClaims). Creating, replacing, updating and
+// deleting courses need one or an API key, over REST, GraphQL and gRPC
+// alike; see auth.go.
+
+// jwtLeeway allows for clock skew between the issuer and this server.
+const jwtLeeway = time.Minute
+
+var (
+	jwtHMACSecret []byte
+	jwtRSAKey     *rsa.PublicKey
+	jwtIssuer     = os.Getenv("JWT_ISSUER")
+	jwtAudience   = os.Getenv("JWT_AUDIENCE")
+)
+
+func init() {
+	jwtHMACSecret = []byte(os.Getenv("JWT_HMAC_SECRET"))
+	if path := os.Getenv("JWT_RSA_PUBLIC_KEY"); path != "" {
+		key, err := loadRSAPublicKey(path)
+		if err != nil {
+			log.Fatalf("Invalid JWT_RSA_PUBLIC_KEY: %v", err)
+		}
+		jwtRSAKey = key
+	}
+}
+
+func jwtEnabled() bool {
+	return len(jwtHMACSecret) > 0 || jwtRSAKey != nil || signingKeysEnabled()
+}
+
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM block", path)
+	}
+	var key any
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// jwtClaims are the verified claims of a token. Raw holds all of them,
+// registered or not.
+type jwtClaims struct {
+	Subject  string
+	Issuer   string
+	Audience []string
+	Expires  time.Time
+	Raw      map[string]any
+}
+
+type claimsContextKey struct{}
+
+// requestClaims returns the claims of the token r was sent with, if any.
+func requestClaims(r *http.Request) (jwtClaims, bool) {
+	c, ok := r.Context().Value(claimsContextKey{}).(jwtClaims)
+	return c, ok
+}
+
+var errNoToken = errors.New("no bearer token or API key")
+
+// bearerToken returns the token of an "Authorization: Bearer" header.
+// Other schemes are left to whatever handles them.
+func bearerToken(h http.Header) (string, error) {
+	scheme, token, _ := strings.Cut(h.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", errNoToken
+	}
+	if token = strings.TrimSpace(token); token == "" {
+		return "", errors.New("empty bearer token")
+	}
+	return token, nil
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// verifyJWT checks a compact JWS token's signature and its time, issuer and
+// audience claims. The algorithm comes from the token header but must be
+// one the configured keys are for, so a token cannot pick "none" or use
+// the RSA public key as an HMAC secret.
+func verifyJWT(token string, now time.Time) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, errors.New("token is not a signed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return jwtClaims{}, fmt.Errorf("invalid token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, errors.New("invalid token signature encoding")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	family, bits := header.Alg[:min(2, len(header.Alg))], header.Alg[min(2, len(header.Alg)):]
+	hashFn, ok := jwtHashes[bits]
+	rsaKey := jwtRSAKey
+	if header.Kid != "" && signingKeysEnabled() {
+		if k := verificationKey(header.Kid, now); k != nil {
+			rsaKey = k
+		}
+	}
+	switch {
+	case !ok:
+		return jwtClaims{}, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	case family == "HS" && len(jwtHMACSecret) > 0:
+		mac := hmac.New(hashFn.New, jwtHMACSecret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return jwtClaims{}, errors.New("invalid token signature")
+		}
+	case family == "RS" && rsaKey != nil:
+		h := hashFn.New()
+		h.Write(signed)
+		if rsa.VerifyPKCS1v15(rsaKey, hashFn, h.Sum(nil), sig) != nil {
+			return jwtClaims{}, errors.New("invalid token signature")
+		}
+	default:
+		return jwtClaims{}, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	raw := map[string]any{}
+	if err := decodeJWTPart(parts[1], &raw); err != nil {
+		return jwtClaims{}, fmt.Errorf("invalid token claims: %w", err)
+	}
+	c := jwtClaims{Raw: raw}
+	c.Subject, _ = raw["sub"].(string)
+	c.Issuer, _ = raw["iss"].(string)
+	switch aud := raw["aud"].(type) {
+	case string:
+		c.Audience = []string{aud}
+	case []any:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				c.Audience = append(c.Audience, s)
+			}
+		}
+	}
+	exp, ok := raw["exp"].(float64)
+	if !ok {
+		return jwtClaims{}, errors.New("token has no expiry")
+	}
+	c.Expires = time.Unix(int64(exp), 0)
+	if now.After(c.Expires.Add(jwtLeeway)) {
+		return jwtClaims{}, errors.New("token has expired")
+	}
+	if nbf, ok := raw["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return jwtClaims{}, errors.New("token is not valid yet")
+	}
+	if jwtIssuer != "" && c.Issuer != jwtIssuer {
+		return jwtClaims{}, errors.New("token is from another issuer")
+	}
+	if jwtAudience != "" && !slices.Contains(c.Audience, jwtAudience) {
+		return jwtClaims{}, errors.New("token is for another audience")
+	}
+	return c, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeUnauthorized answers 401 with the RFC 6750 challenge.
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	challenge := `Bearer realm="courses"`
+	if !errors.Is(err, errNoToken) {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, err.Error())
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeError(w, r, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+}
+
+// withJWTClaims verifies the bearer token of r, if any, and returns r with
+// its claims in the context.
+func withJWTClaims(r *http.Request) (*http.Request, error) {
+	if !jwtEnabled() {
+		return r, nil
+	}
+	token, err := bearerToken(r.Header)
+	if errors.Is(err, errNoToken) {
+		return r, nil
+	}
+	var claims jwtClaims
+	if err == nil {
+		claims, err = verifyJWT(token, time.Now())
+	}
+	if err == nil {
+		err = checkImpersonation(claims, time.Now())
+	}
+	if err == nil {
+		err = checkClientToken(claims)
+	}
+	if err != nil {
+		return r, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)), nil
+}
+
+// jwtHandler verifies the bearer token of every request that has one and
+// puts its claims in the request context. Requests made with an
+// impersonation token are served by serveImpersonated.
+func jwtHandler(next http.Handler) http.Handler {
+	if !jwtEnabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, err := withJWTClaims(r)
+		if err != nil {
+			writeUnauthorized(w, r, err)
+			return
+		}
+		if c, ok := requestClaims(r); ok {
+			if id, _ := impersonationOf(c); id != "" {
+				serveImpersonated(w, r, c, next)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ตรวจ JWT ก่อนให้แก้ไข course
+
+	1. เปิดใช้ด้วย `JWT_HMAC_SECRET` (token แบบ HS256/384/512) และ/หรือ `JWT_RSA_PUBLIC_KEY` (ไฟล์ PEM สำหรับ RS256/384/512) ถ้าไม่ตั้งเลยจะไม่ตรวจ token เหมือนเดิม
+	2. ตรวจลายเซ็น, `exp` (บังคับต้องมี), `nbf` เผื่อเวลาคลาดเคลื่อน 1 นาที และ `iss`/`aud` ถ้าตั้ง `JWT_ISSUER`/`JWT_AUDIENCE`
+	   - algorithm ต้องตรงกับ key ที่ตั้งไว้ กันการโจมตีแบบ `alg: none` หรือเอา RSA public key ไปใช้เป็น HMAC secret
+	3. `jwtHandler` ครอบทุก request: token ถูกต้องจะใส่ claims ลง context (อ่านด้วย `requestClaims(r)`) token ผิดตอบ 401 ทันที
+	4. การสร้าง/แก้/ลบ course ต้องมี token ทั้งทาง REST, GraphQL mutation และ gRPC (ดู auth.go) ส่วนการอ่านยังเปิดเหมือนเดิม
+*/
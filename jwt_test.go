@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWT builds a compact token with the given header and claims, signed by
+// sign over "header.claims".
+func testJWT(t *testing.T, header, claims map[string]any, sign func([]byte) []byte) string {
+	t.Helper()
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret []byte) func([]byte) []byte {
+	return func(b []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(b)
+		return mac.Sum(nil)
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("sekrit")
+	oldSecret, oldKey, oldIss, oldAud := jwtHMACSecret, jwtRSAKey, jwtIssuer, jwtAudience
+	jwtHMACSecret, jwtRSAKey, jwtIssuer, jwtAudience = secret, &key.PublicKey, "https://issuer.test", "courses"
+	t.Cleanup(func() { jwtHMACSecret, jwtRSAKey, jwtIssuer, jwtAudience = oldSecret, oldKey, oldIss, oldAud })
+
+	now := time.Unix(1_700_000_000, 0)
+	claims := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{"sub": "ann", "iss": jwtIssuer, "aud": "courses", "exp": now.Add(time.Hour).Unix()}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	rs256 := func(b []byte) []byte {
+		h := sha256.Sum256(b)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	// The RSA public key as an HMAC secret, as in an algorithm confusion attack.
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	none := func([]byte) []byte { return nil }
+
+	hs := map[string]any{"alg": "HS256", "typ": "JWT"}
+	for _, tt := range []struct {
+		name  string
+		token string
+		err   string // "" when the token is good
+	}{
+		{"HS256", testJWT(t, hs, claims(nil), hs256(secret)), ""},
+		{"RS256", testJWT(t, map[string]any{"alg": "RS256"}, claims(nil), rs256), ""},
+		{"audience list", testJWT(t, hs, claims(func(c map[string]any) { c["aud"] = []any{"billing", "courses"} }), hs256(secret)), ""},
+		{"expired within leeway", testJWT(t, hs, claims(func(c map[string]any) { c["exp"] = now.Add(-30 * time.Second).Unix() }), hs256(secret)), ""},
+		{"nbf within leeway", testJWT(t, hs, claims(func(c map[string]any) { c["nbf"] = now.Add(30 * time.Second).Unix() }), hs256(secret)), ""},
+
+		{"bad HMAC signature", testJWT(t, hs, claims(nil), hs256([]byte("other"))), "invalid token signature"},
+		{"bad RSA signature", testJWT(t, map[string]any{"alg": "RS256"}, claims(nil), hs256(secret)), "invalid token signature"},
+		{"tampered claims", func() string {
+			parts := strings.Split(testJWT(t, hs, claims(nil), hs256(secret)), ".")
+			c, _ := json.Marshal(claims(func(c map[string]any) { c["sub"] = "admin" }))
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(c) + "." + parts[2]
+		}(), "invalid token signature"},
+		{"alg none", testJWT(t, map[string]any{"alg": "none"}, claims(nil), none), "unsupported algorithm"},
+		{"alg ES256", testJWT(t, map[string]any{"alg": "ES256"}, claims(nil), hs256(secret)), "unsupported algorithm"},
+		{"alg HS1", testJWT(t, map[string]any{"alg": "HS1"}, claims(nil), hs256(secret)), "unsupported algorithm"},
+		{"public key as HMAC secret", testJWT(t, hs, claims(nil), hs256(publicPEM)), "invalid token signature"},
+		{"missing alg", testJWT(t, map[string]any{}, claims(nil), hs256(secret)), "unsupported algorithm"},
+
+		{"no exp", testJWT(t, hs, claims(func(c map[string]any) { delete(c, "exp") }), hs256(secret)), "no expiry"},
+		{"exp as string", testJWT(t, hs, claims(func(c map[string]any) { c["exp"] = "tomorrow" }), hs256(secret)), "no expiry"},
+		{"expired", testJWT(t, hs, claims(func(c map[string]any) { c["exp"] = now.Add(-2 * time.Minute).Unix() }), hs256(secret)), "expired"},
+		{"not valid yet", testJWT(t, hs, claims(func(c map[string]any) { c["nbf"] = now.Add(2 * time.Minute).Unix() }), hs256(secret)), "not valid yet"},
+		{"other issuer", testJWT(t, hs, claims(func(c map[string]any) { c["iss"] = "https://evil.test" }), hs256(secret)), "another issuer"},
+		{"no issuer", testJWT(t, hs, claims(func(c map[string]any) { delete(c, "iss") }), hs256(secret)), "another issuer"},
+		{"other audience", testJWT(t, hs, claims(func(c map[string]any) { c["aud"] = "billing" }), hs256(secret)), "another audience"},
+		{"no audience", testJWT(t, hs, claims(func(c map[string]any) { delete(c, "aud") }), hs256(secret)), "another audience"},
+
+		{"two parts", "eyJhbGciOiJIUzI1NiJ9.e30", "not a signed JWT"},
+		{"bad header", "!!.e30.AA", "invalid token header"},
+		{"bad signature encoding", strings.Split(testJWT(t, hs, claims(nil), hs256(secret)), ".")[0] + ".e30.!!", "signature encoding"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := verifyJWT(tt.token, now)
+			if tt.err == "" {
+				if err != nil || c.Subject != "ann" {
+					t.Errorf("verifyJWT = %+v, %v, want subject ann", c, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("verifyJWT = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	for _, tt := range []struct{ header, token, err string }{
+		{"Bearer abc", "abc", ""},
+		{"bearer  abc ", "abc", ""},
+		{"", "", errNoToken.Error()},
+		{"Basic YTpi", "", errNoToken.Error()},
+		{"Bearer ", "", "empty bearer token"},
+	} {
+		h := http.Header{}
+		if tt.header != "" {
+			h.Set("Authorization", tt.header)
+		}
+		token, err := bearerToken(h)
+		if token != tt.token || (err == nil) != (tt.err == "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("bearerToken(%q) = %q, %v, want %q, %q", tt.header, token, err, tt.token, tt.err)
+		}
+	}
+}
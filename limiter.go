@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CONCURRENCY_LIMIT caps how many requests are handled at once; unset or 0
+// turns the limiter off. Each route has a weight from 0 to 10, and a
+// request of weight w only starts while fewer than limit*w/10 requests are
+// running. Bulk routes with a low weight therefore stop being admitted
+// well before the server is full, and the slots above them stay free for
+// the admin routes at 10. A request that cannot start waits up to
+// CONCURRENCY_QUEUE_TIMEOUT (default 2s), heaviest first, and is then
+// answered 503. At most CONCURRENCY_QUEUE_LIMIT requests (default the
+// limit) wait; past that a spike is shed with 503 at once, since every
+// waiter holds its goroutine and request in memory. Weight 0 skips the
+// limiter, which is right for streams that stay open for hours and would
+// otherwise hold a slot the whole time.
+//
+// ROUTE_WEIGHTS adds to or overrides the defaults below by mux pattern. A
+// pattern ending in * covers every route it is a prefix of, the longest
+// prefix winning: "/admin/*=10,/admin/courses/{id}/export=2".
+
+const maxRouteWeight = 10
+
+var defaultRouteWeights = "*=5,/admin/*=10,/admin/courses/import=2,/admin/courses/{id}/export=2," +
+	"/courses/sync=2,/events=0,/ws/courses=0,/admin/logs/stream=0"
+
+var (
+	// requestLimiter is nil when CONCURRENCY_LIMIT is unset.
+	requestLimiter *limiter
+	routeWeights   map[string]int
+	queueTimeout   = 2 * time.Second
+)
+
+func init() {
+	weights, err := parseRouteWeights(defaultRouteWeights)
+	if err != nil {
+		panic(err)
+	}
+	if spec := os.Getenv("ROUTE_WEIGHTS"); spec != "" {
+		extra, err := parseRouteWeights(spec)
+		if err != nil {
+			log.Fatalf("Invalid ROUTE_WEIGHTS: %v", err)
+		}
+		for route, w := range extra {
+			weights[route] = w
+		}
+	}
+	routeWeights = weights
+	if v := os.Getenv("CONCURRENCY_QUEUE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid CONCURRENCY_QUEUE_TIMEOUT %q: must be a duration", v)
+		}
+		queueTimeout = d
+	}
+	if v := os.Getenv("CONCURRENCY_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid CONCURRENCY_LIMIT %q: must be a number of requests", v)
+		}
+		if n > 0 {
+			requestLimiter = &limiter{limit: n, queueLimit: n}
+		}
+	}
+	if v := os.Getenv("CONCURRENCY_QUEUE_LIMIT"); v != "" && requestLimiter != nil {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid CONCURRENCY_QUEUE_LIMIT %q: must be a number of requests", v)
+		}
+		requestLimiter.queueLimit = n
+	}
+}
+
+func parseRouteWeights(s string) (map[string]int, error) {
+	weights := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		route, weight, ok := strings.Cut(part, "=")
+		route = strings.TrimSpace(route)
+		w, err := strconv.Atoi(strings.TrimSpace(weight))
+		if !ok || route == "" || err != nil || w < 0 || w > maxRouteWeight {
+			return nil, fmt.Errorf("invalid weight %q; want route=0..%d", part, maxRouteWeight)
+		}
+		weights[route] = w
+	}
+	return weights, nil
+}
+
+// routeWeight returns the weight of a mux pattern: its own entry, else the
+// longest matching prefix entry, else "*".
+func routeWeight(pattern string) int {
+	if w, ok := routeWeights[pattern]; ok {
+		return w
+	}
+	best, weight := -1, routeWeights["*"]
+	for route, w := range routeWeights {
+		prefix, ok := strings.CutSuffix(route, "*")
+		if ok && prefix != "" && len(prefix) > best && strings.HasPrefix(pattern, prefix) {
+			best, weight = len(prefix), w
+		}
+	}
+	return weight
+}
+
+// limiter counts running requests and queues the ones that may not start
+// yet.
+type limiter struct {
+	mu         sync.Mutex
+	limit      int
+	queueLimit int // most requests waiting at once
+	inFlight   int
+	waiting    []*limiterWaiter // in arrival order
+	shed       int64
+}
+
+type limiterWaiter struct {
+	weight  int
+	ready   chan struct{}
+	granted bool
+}
+
+// room is how many requests may be running for one of weight to start.
+func (l *limiter) room(weight int) int {
+	return max(1, l.limit*weight/maxRouteWeight)
+}
+
+// acquire takes a slot for a request of weight, waiting up to queueTimeout.
+// It reports false if the queue is full, no slot came free in time or ctx
+// ended first.
+func (l *limiter) acquire(ctx context.Context, weight int) bool {
+	l.mu.Lock()
+	if l.inFlight < l.room(weight) && !l.heavierWaiting(weight) {
+		l.inFlight++
+		l.mu.Unlock()
+		return true
+	}
+	if len(l.waiting) >= l.queueLimit {
+		l.shed++
+		l.mu.Unlock()
+		return false
+	}
+	wt := &limiterWaiter{weight: weight, ready: make(chan struct{})}
+	l.waiting = append(l.waiting, wt)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case <-wt.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if wt.granted {
+		// A slot was handed over just as the wait ended.
+		return true
+	}
+	for i, other := range l.waiting {
+		if other == wt {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			break
+		}
+	}
+	l.shed++
+	return false
+}
+
+// heavierWaiting reports whether a request at least as heavy as weight is
+// already queued, so newcomers do not overtake it. Callers hold l.mu.
+func (l *limiter) heavierWaiting(weight int) bool {
+	for _, wt := range l.waiting {
+		if wt.weight >= weight {
+			return true
+		}
+	}
+	return false
+}
+
+// release frees a slot and hands free slots to the heaviest waiters that
+// may start, oldest first among equals.
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	for {
+		next := -1
+		for i, wt := range l.waiting {
+			if l.inFlight < l.room(wt.weight) && (next < 0 || wt.weight > l.waiting[next].weight) {
+				next = i
+			}
+		}
+		if next < 0 {
+			return
+		}
+		wt := l.waiting[next]
+		l.waiting = append(l.waiting[:next], l.waiting[next+1:]...)
+		wt.granted = true
+		l.inFlight++
+		close(wt.ready)
+	}
+}
+
+// priorityHandler runs next under requestLimiter, weighing each request by
+// the mux pattern it will be routed to.
+func priorityHandler(mux *http.ServeMux, next http.Handler) http.Handler {
+	if requestLimiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		weight := routeWeight(pattern)
+		if weight == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !requestLimiter.acquire(r.Context(), weight) {
+			if clientGone(r) {
+				return
+			}
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, "Server is busy; try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		defer requestLimiter.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminLimiterHandler serves GET /admin/limiter, the limiter's state and
+// the weight every route pattern resolves to.
+func adminLimiterHandler(mux *http.ServeMux) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		resp := map[string]any{
+			"enabled":       requestLimiter != nil,
+			"queue_timeout": queueTimeout.String(),
+			"route_weights": routeWeights,
+		}
+		if l := requestLimiter; l != nil {
+			l.mu.Lock()
+			resp["limit"] = l.limit
+			resp["in_flight"] = l.inFlight
+			resp["waiting"] = len(l.waiting)
+			resp["queue_limit"] = l.queueLimit
+			resp["shed"] = l.shed
+			l.mu.Unlock()
+		}
+		writeValue(w, r, http.StatusOK, resp)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: จำกัดจำนวน request พร้อมกันโดยให้ route สำคัญได้ก่อน
+
+	1. ตั้ง `CONCURRENCY_LIMIT=64` เพื่อให้ server ทำงานพร้อมกันได้ไม่เกิน 64 request (ไม่ตั้ง = ไม่จำกัด เหมือนเดิม)
+	2. แต่ละ route มีน้ำหนัก 0-10 request น้ำหนัก w จะเริ่มได้เมื่อมีงานค้างน้อยกว่า limit*w/10
+	   - export/import/sync น้ำหนัก 2 จึงใช้ได้ไม่เกิน 20% ของช่อง ช่องที่เหลือเป็นของ route อื่น
+	   - route `/admin/*` น้ำหนัก 10 ใช้ได้ทุกช่อง จึงยังเข้าหน้า admin ได้แม้ export กำลังรุมอยู่
+	   - น้ำหนัก 0 ไม่ผ่าน limiter เลย ใช้กับ stream ที่เปิดค้างนาน (`/events`, `/ws/courses`, `/admin/logs/stream`)
+	3. request ที่ยังเริ่มไม่ได้จะรอคิว (ตัวหนักกว่าได้ก่อน) ไม่เกิน `CONCURRENCY_QUEUE_TIMEOUT` แล้วตอบ 503 พร้อม `Retry-After`
+	   - คิวรอได้ไม่เกิน `CONCURRENCY_QUEUE_LIMIT` (ค่าเริ่มต้นเท่า limit) เกินนั้นตอบ 503 ทันที เพราะทุกตัวที่รอกิน memory (goroutine + request)
+	4. ปรับน้ำหนักด้วย `ROUTE_WEIGHTS` และดูสถานะที่ `GET /admin/limiter`
+*/
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// defaultPerPage is used when a client asks for a page without a size.
+const defaultPerPage = 20
+
+// link is a single hypermedia control. Method is omitted for plain GETs.
+type link struct {
+	Href   string `json:"href"`
+	Method string `json:"method,omitempty"`
+}
+
+// courseResource is the course representation sent to clients: the course
+// fields plus the links a client can follow from it.
+type courseResource struct {
+	course
+	Pricing *effectivePrice `json:"_pricing,omitempty"`
+	Links   map[string]link `json:"_links"`
+}
+
+func newCourseResource(c course) courseResource {
+	self := fmt.Sprintf("/courses/%d", c.CourseId)
+	return courseResource{
+		course: c,
+		Links: map[string]link{
+			"self":       {Href: self},
+			"update":     {Href: self, Method: http.MethodPut},
+			"delete":     {Href: self, Method: http.MethodDelete},
+			"collection": {Href: "/courses"},
+		},
+	}
+}
+
+func newCourseResources(courses []course) []courseResource {
+	resources := make([]courseResource, len(courses))
+	for i, c := range courses {
+		resources[i] = newCourseResource(c)
+	}
+	return resources
+}
+
+// paginate returns the page of courses selected by the page and per_page
+// query parameters, and sets a Link header (RFC 8288) with first, prev,
+// next and last relations. Without either parameter all courses are
+// returned so existing clients see no change.
+func paginate(w http.ResponseWriter, r *http.Request, courses []course) ([]course, error) {
+	q := r.URL.Query()
+	if !q.Has("page") && !q.Has("per_page") {
+		return courses, nil
+	}
+	page, perPage := 1, defaultPerPage
+	var err error
+	if v := q.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return nil, fmt.Errorf("invalid page %q", v)
+		}
+	}
+	if v := q.Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 {
+			return nil, fmt.Errorf("invalid per_page %q", v)
+		}
+	}
+
+	lastPage := (len(courses) + perPage - 1) / perPage
+	if lastPage == 0 {
+		lastPage = 1
+	}
+	pageURL := func(p int) string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(p))
+		q.Set("per_page", strconv.Itoa(perPage))
+		return (&url.URL{Path: r.URL.Path, RawQuery: q.Encode()}).String()
+	}
+	links := []string{
+		fmt.Sprintf(`<%s>; rel="first"`, pageURL(1)),
+		fmt.Sprintf(`<%s>; rel="last"`, pageURL(lastPage)),
+	}
+	if page > 1 {
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(min(page-1, lastPage))))
+	}
+	if page < lastPage {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(page+1)))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(courses)))
+
+	start := min((page-1)*perPage, len(courses))
+	end := min(start+perPage, len(courses))
+	return courses[start:end], nil
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: HATEOAS (Hypermedia as the Engine of Application State)
+
+	1. ทุก course ที่ส่งกลับไปจะมี `_links` (self, update, delete, collection) บอก client ว่าทำอะไรต่อได้บ้างและต้องไปที่ URL ไหน
+	   - client ไม่ต้อง hardcode URL เอง ถ้าวันหนึ่งเราเปลี่ยนโครงสร้าง URL client ก็ยังทำงานได้
+	   - ใช้ struct embedding (`courseResource` ฝัง `course`) ทำให้ JSON ที่ได้มี field ของ course อยู่ระดับเดียวกับ `_links`
+	2. Pagination: `GET /courses?page=2&per_page=10` จะตัดข้อมูลเป็นหน้าๆ และใส่ header `Link` (first, prev, next, last) ตามมาตรฐาน RFC 8288
+	   - response ยังเป็น JSON array เหมือนเดิม client เก่าจึงไม่พัง
+*/
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The server logs with log/slog. LOG_LEVEL is the lowest level written,
+// debug, info (the default), warn or error, and LOG_FORMAT is text (the
+// default, key=value pairs) or json, one object per line for a log
+// collector. Every record also becomes an entry of the live stream at
+// /admin/logs/stream (logs.go), with its attributes.
+//
+// Code serving a request logs through requestLogger(r), which
+// requestLogHandler puts in the request's context with the request and
+// trace IDs attached, so every line a request causes can be found by
+// either. Background work logs through slog's default logger. Lines from
+// the standard log package, which is left to the net/http server's own
+// errors and to log.Fatal at startup, go through slog as well.
+
+type loggerContextKey struct{}
+
+// logLevel is the lowest level written. CONFIG_FILE (configfile.go) may
+// change it while the server runs.
+var logLevel slog.LevelVar
+
+// The logger is set up when package variables are, before any init
+// function can log.
+var _ = setupLogger()
+
+func setupLogger() bool {
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		level, err := parseLogLevel(v)
+		if err != nil {
+			log.Fatalf("Invalid LOG_LEVEL %q: %v", v, err)
+		}
+		logLevel.Set(level)
+	}
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var h slog.Handler
+	switch v := os.Getenv("LOG_FORMAT"); v {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		log.Fatalf("Invalid LOG_FORMAT %q: use text or json", v)
+	}
+	slog.SetDefault(slog.New(streamHandler{next: h}))
+	log.SetFlags(0)
+	log.SetOutput(logStreamWriter{})
+	return true
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, errors.New("use debug, info, warn or error")
+	}
+	return level, nil
+}
+
+// requestLogger is the logger for code serving r.
+func requestLogger(r *http.Request) *slog.Logger {
+	if l, ok := r.Context().Value(loggerContextKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+func withLogger(r *http.Request, l *slog.Logger) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loggerContextKey{}, l))
+}
+
+// streamHandler copies every record it handles to the live stream before
+// passing it on.
+type streamHandler struct {
+	next   slog.Handler
+	attrs  []slog.Attr // from With, keys prefixed with their groups
+	prefix string      // the groups from WithGroup, each followed by "."
+}
+
+func (h streamHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h streamHandler) Handle(ctx context.Context, rec slog.Record) error {
+	e := logEntry{Time: rec.Time.UTC(), Level: logLevelName(rec.Level), Message: rec.Message}
+	add := func(a slog.Attr) {
+		switch v := a.Value.Resolve(); {
+		case a.Key == "request_id":
+			e.RequestID = v.String()
+		case a.Key == "trace_id":
+			e.TraceID = v.String()
+		case v.Kind() == slog.KindGroup:
+			for _, g := range v.Group() {
+				e.addAttr(a.Key+"."+g.Key, g.Value.Resolve())
+			}
+		default:
+			e.addAttr(a.Key, v)
+		}
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		a.Key = h.prefix + a.Key
+		add(a)
+		return true
+	})
+	appLog.add(e)
+	return h.next.Handle(ctx, rec)
+}
+
+func (h streamHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefixed := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		prefixed[i] = slog.Attr{Key: h.prefix + a.Key, Value: a.Value}
+	}
+	return streamHandler{next: h.next.WithAttrs(attrs), attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], prefixed...), prefix: h.prefix}
+}
+
+func (h streamHandler) WithGroup(name string) slog.Handler {
+	return streamHandler{next: h.next.WithGroup(name), attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+// addAttr keeps an attribute of a record in e. Errors and other values
+// without a JSON form of their own are kept as text.
+func (e *logEntry) addAttr(key string, v slog.Value) {
+	if e.Attrs == nil {
+		e.Attrs = map[string]any{}
+	}
+	switch v.Kind() {
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			e.Attrs[key] = err.Error()
+			return
+		}
+		e.Attrs[key] = v.Any()
+	case slog.KindDuration, slog.KindTime:
+		e.Attrs[key] = v.String()
+	default:
+		e.Attrs[key] = v.Any()
+	}
+}
+
+func logLevelName(l slog.Level) string {
+	switch {
+	case l < slog.LevelInfo:
+		return logDebug
+	case l < slog.LevelWarn:
+		return logInfo
+	case l < slog.LevelError:
+		return logWarn
+	}
+	return logError
+}
+
+// logStreamWriter is the standard logger's output. The server only leaves
+// log.Fatal and net/http's own errors to it, so its lines are errors.
+type logStreamWriter struct{}
+
+func (logStreamWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		slog.Error(line)
+	}
+	return len(p), nil
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: เปลี่ยน log ทั้ง server เป็น `log/slog` แบบมีโครงสร้าง เลือก level และรูปแบบได้ และผูก logger กับ request
+
+	1. `LOG_LEVEL` = debug / info (ค่าเริ่มต้น) / warn / error, `LOG_FORMAT` = text (key=value) หรือ json (บรรทัดละ object สำหรับ log collector)
+	2. โค้ดที่ตอบ request ใช้ `requestLogger(r)` ซึ่งแนบ `request_id` และ `trace_id` มาให้แล้ว ค้น log ของ request เดียวได้ครบ
+	   - งานเบื้องหลังใช้ logger default ของ slog
+	3. ทุก record ยังเข้า live stream `/admin/logs/stream` พร้อม attribute
+	   - บรรทัดจาก package `log` เดิม (error ของ net/http, `log.Fatal` ตอน start) ก็วิ่งผ่าน slog เป็น level error
+*/
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operators without shell access can watch the application log live at
+// /admin/logs/stream. Two kinds of structured entries feed it: a request
+// entry for every HTTP request (method, route, status, duration, request
+// ID), and every record logged through slog (logger.go).
+
+const requestIDHeader = "X-Request-ID"
+
+// statusClientClosedRequest is logged for requests whose client left
+// before any response was written; nginx uses the same code.
+const statusClientClosedRequest = 499
+
+// Request outcomes. A client that disconnects is neither a success nor a
+// server error, so it gets its own.
+const (
+	outcomeOK         = "ok"
+	outcomeError      = "error"
+	outcomeClientGone = "client_gone"
+)
+
+const (
+	logDebug = "debug"
+	logInfo  = "info"
+	logWarn  = "warn"
+	logError = "error"
+)
+
+var logLevels = map[string]int{logDebug: -1, logInfo: 0, logWarn: 1, logError: 2}
+
+type logEntry struct {
+	Time       time.Time `json:"time"`
+	Level      string    `json:"level"`
+	Message    string    `json:"message"`
+	RequestID  string    `json:"request_id,omitempty"`
+	TraceID    string    `json:"trace_id,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Route      string    `json:"route,omitempty"` // the matched pattern, e.g. "/courses/{id}"
+	Path       string    `json:"path,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	Outcome    string    `json:"outcome,omitempty"`
+	// Attrs are the attributes of a slog record (logger.go).
+	Attrs map[string]any `json:"attrs,omitempty"`
+}
+
+// logStream keeps the most recent entries for context and fans new ones
+// out to followers. Like courseHub, it drops a follower that falls behind
+// rather than slowing down the code that logs.
+type logStream struct {
+	mu     sync.Mutex
+	recent []logEntry
+	subs   map[chan logEntry]struct{}
+}
+
+const (
+	logStreamRecent = 500
+	logStreamBuffer = 256
+)
+
+var appLog = &logStream{subs: make(map[chan logEntry]struct{})}
+
+func (s *logStream) add(e logEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent = append(s.recent, e)
+	if n := len(s.recent) - logStreamRecent; n > 0 {
+		s.recent = slices.Delete(s.recent, 0, n)
+	}
+	for ch := range s.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// follow returns the recent entries and a channel of the ones after them.
+func (s *logStream) follow() ([]logEntry, chan logEntry) {
+	ch := make(chan logEntry, logStreamBuffer)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[ch] = struct{}{}
+	return slices.Clone(s.recent), ch
+}
+
+func (s *logStream) unfollow(ch chan logEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[ch]; ok {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestLogHandler gives every request an ID, echoed in X-Request-ID, and
+// a trace (tracing.go), and records a request entry, an access log line
+// (accesslog.go) and its metrics (metrics.go) when it finishes. A well-formed X-Request-ID from the
+// client or a load balancer is kept so IDs match across hops. The route is
+// looked up in mux, as the handlers in between may pass on a copy of r.
+func requestLogHandler(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = randomHex(8)
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id))
+		tc := startTrace(r)
+		r = withTrace(r, tc)
+		r = withLogger(r, slog.With("request_id", id, "trace_id", tc.TraceID))
+		w.Header().Set(traceIDHeader, tc.TraceID)
+		start := time.Now()
+		sw := &statusRecorder{ResponseWriter: w}
+		requestsInFlight.Add(1)
+		next.ServeHTTP(sw, r)
+		requestsInFlight.Add(-1)
+		_, route := mux.Handler(r)
+
+		status, gone := sw.status, sw.clientGone || clientGone(r)
+		switch {
+		case status == 0 && headerHasToken(r.Header, "Connection", "upgrade"):
+			status = http.StatusSwitchingProtocols // hijacked
+		case status == 0 && gone:
+			status = statusClientClosedRequest
+		case status == 0:
+			status = http.StatusOK
+		}
+		level, outcome := logInfo, outcomeOK
+		switch {
+		case gone:
+			outcome = outcomeClientGone
+		case status >= 500:
+			level, outcome = logError, outcomeError
+		case status >= 400:
+			level = logWarn
+		}
+		recordSLO(route, status, outcome, start)
+		recordRequestMetrics(r.Method, metricsRoute(r, route), status, time.Since(start))
+		recordRequestSpan(r, route, status, start)
+		appLog.add(logEntry{
+			Time:       start.UTC(),
+			Level:      level,
+			Message:    fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, status),
+			RequestID:  id,
+			TraceID:    tc.TraceID,
+			Method:     r.Method,
+			Route:      route,
+			Path:       r.URL.Path,
+			Status:     status,
+			DurationMS: time.Since(start).Milliseconds(),
+			Outcome:    outcome,
+		})
+		writeAccessLog(r, id, status, sw.bytes, start)
+	})
+}
+
+type requestIDContextKey struct{}
+
+// requestID returns the ID requestLogHandler gave r, "" outside it.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// clientGone reports whether the client of r has disconnected. Long
+// handlers check it to stop work nobody will receive.
+func clientGone(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// markClientGone records that a handler saw its client disconnect in a way
+// the request context may not show yet, such as an upload cut short.
+func markClientGone(w http.ResponseWriter) {
+	for {
+		switch v := w.(type) {
+		case *statusRecorder:
+			v.clientGone = true
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
+// statusRecorder remembers the status a handler sent.
+type statusRecorder struct {
+	http.ResponseWriter
+	status     int
+	bytes      int64 // of the body, as written by the handler
+	clientGone bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Flush is here for handlers that type-assert http.Flusher.
+func (s *statusRecorder) Flush() {
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// logFilter selects entries for a follower.
+type logFilter struct {
+	minLevel  int
+	route     string
+	pathPre   string
+	requestID string
+	traceID   string
+}
+
+func (f logFilter) match(e logEntry) bool {
+	return logLevels[e.Level] >= f.minLevel &&
+		(f.route == "" || e.Route == f.route) &&
+		(f.pathPre == "" || strings.HasPrefix(e.Path, f.pathPre)) &&
+		(f.requestID == "" || e.RequestID == f.requestID) &&
+		(f.traceID == "" || e.TraceID == f.traceID)
+}
+
+// adminLogStreamHandler serves GET /admin/logs/stream as Server-Sent
+// Events, one "log" event per entry. Filters: ?level=warn (that level and
+// above), ?route=/courses/{id}, ?path=/courses prefix, ?request_id= and
+// ?trace_id=.
+// ?tail=N (default 50) first replays up to N recent matching entries.
+func adminLogStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	f := logFilter{route: q.Get("route"), pathPre: q.Get("path"), requestID: q.Get("request_id"), traceID: q.Get("trace_id")}
+	if lv := q.Get("level"); lv != "" {
+		n, ok := logLevels[strings.ToLower(lv)]
+		if !ok {
+			writeError(w, r, "Invalid level; use debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+		f.minLevel = n
+	}
+	tail := 50
+	if v := q.Get("tail"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > logStreamRecent {
+			writeError(w, r, fmt.Sprintf("Invalid tail; use 0 to %d", logStreamRecent), http.StatusBadRequest)
+			return
+		}
+		tail = n
+	}
+
+	recent, ch := appLog.follow()
+	defer appLog.unfollow(ch)
+	recent = slices.DeleteFunc(recent, func(e logEntry) bool { return !f.match(e) })
+	recent = recent[max(0, len(recent)-tail):]
+
+	rc := http.NewResponseController(w)
+	keepStreamOpen(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	send := func(e logEntry) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "event: log\ndata: %s\n\n", data)
+		return err
+	}
+	for _, e := range recent {
+		if send(e) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				fmt.Fprint(w, "event: dropped\ndata: {}\n\n")
+				return
+			}
+			if !f.match(e) {
+				continue
+			}
+			if send(e) != nil || rc.Flush() != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ดู Log แบบ Real-time ผ่าน HTTP (`/admin/logs/stream`)
+
+	1. ทุก request ได้ request ID (header `X-Request-ID` ถ้า client/load balancer ส่งมาจะใช้ค่านั้นต่อ) และถูกบันทึกเป็น entry แบบมีโครงสร้าง
+	   - มี method, route (pattern เช่น `/courses/{id}`), path, status, เวลาที่ใช้ และ level (5xx = error, 4xx = warn)
+	2. ทุก record ที่ log ผ่าน slog ยังออก stderr และถูกเก็บเป็น entry พร้อม attribute ด้วย
+	3. operator เปิด `GET /admin/logs/stream?request_id=abc` (Server-Sent Events) เพื่อตามดู request นั้นสด ๆ ตอนเกิดปัญหา ไม่ต้อง ssh เข้าเครื่อง
+	   - กรองได้ด้วย `level`, `route`, `path`, `request_id` และ `tail` ส่ง entry ล่าสุดให้ก่อน (เก็บไว้ 500 รายการ)
+	4. ผู้ติดตามที่อ่านไม่ทันจะถูกตัด (ได้ event `dropped`) เพื่อไม่ให้การเขียน log ช้าลง
+*/
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Course metadata holds deployment-specific fields such as cohort, campus
+// or an internal SKU. Values are scalars only (string, number, boolean) so
+// every wire format can carry them and they stay usable as filters.
+//
+// What keys are allowed is configured per deployment with METADATA_FIELDS,
+// e.g. "cohort:string,campus:string,internal_sku:string,credits:number".
+// Without it any well-formed key is accepted. A tenant can set its own
+// with metadata_fields in TENANTS_FILE.
+
+const (
+	maxMetadataKeys        = 32
+	maxMetadataValueLength = 256
+)
+
+var metadataKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// Metadata value types a rule can require.
+const (
+	metadataString  = "string"
+	metadataNumber  = "number"
+	metadataBoolean = "boolean"
+)
+
+// metadataRules maps each allowed key to its type. A nil map allows any key.
+var metadataRules map[string]string
+
+func init() {
+	rules, err := parseMetadataRules(os.Getenv("METADATA_FIELDS"))
+	if err != nil {
+		log.Fatalf("Invalid METADATA_FIELDS: %v", err)
+	}
+	metadataRules = rules
+}
+
+// tenantMetadataRules returns the rules for the courses of t, nil being the
+// main site.
+func tenantMetadataRules(t *tenant) map[string]string {
+	if t != nil && t.metadataRules != nil {
+		return t.metadataRules
+	}
+	return metadataRules
+}
+
+func parseMetadataRules(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	rules := map[string]string{}
+	for _, field := range strings.Split(s, ",") {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		key, typ, ok := strings.Cut(field, ":")
+		key, typ = strings.TrimSpace(key), strings.ToLower(strings.TrimSpace(typ))
+		if !ok || !metadataKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		switch typ {
+		case metadataString, metadataNumber, metadataBoolean:
+		default:
+			return nil, fmt.Errorf("unknown type %q for %s", typ, key)
+		}
+		rules[key] = typ
+	}
+	return rules, nil
+}
+
+// metadataType returns the type name of a decoded metadata value, or "" if
+// it is not a scalar.
+func metadataType(v any) string {
+	switch v.(type) {
+	case string:
+		return metadataString
+	case float64, int, int64:
+		return metadataNumber
+	case bool:
+		return metadataBoolean
+	}
+	return ""
+}
+
+// validateMetadata checks m against rules, as returned by
+// tenantMetadataRules.
+func validateMetadata(m map[string]any, rules map[string]string) error {
+	if len(m) > maxMetadataKeys {
+		return fmt.Errorf("metadata has more than %d keys", maxMetadataKeys)
+	}
+	// Sorted so the same bad input always reports the same key.
+	keys := slices.Sorted(maps.Keys(m))
+	for _, k := range keys {
+		v := m[k]
+		typ := metadataType(v)
+		switch {
+		case !metadataKeyPattern.MatchString(k):
+			return fmt.Errorf("invalid metadata key %q", k)
+		case typ == "":
+			return fmt.Errorf("metadata %s must be a string, number or boolean", k)
+		case typ == metadataString && len(v.(string)) > maxMetadataValueLength:
+			return fmt.Errorf("metadata %s is longer than %d characters", k, maxMetadataValueLength)
+		}
+		if rules == nil {
+			continue
+		}
+		want, ok := rules[k]
+		if !ok {
+			return fmt.Errorf("metadata key %q is not allowed; allowed keys: %s", k, strings.Join(allowedMetadataKeys(rules), ", "))
+		}
+		if typ != want {
+			return fmt.Errorf("metadata %s must be a %s", k, want)
+		}
+	}
+	return nil
+}
+
+func allowedMetadataKeys(rules map[string]string) []string {
+	return slices.Sorted(maps.Keys(rules))
+}
+
+// compactMetadata drops keys set to null, which is how a PATCH removes a
+// metadata key (as in JSON Merge Patch), and returns nil for an empty map.
+func compactMetadata(m map[string]any) map[string]any {
+	maps.DeleteFunc(m, func(_ string, v any) bool { return v == nil })
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// cloneCourse returns a copy of c that shares no maps or slices with it, so
+// decoding a PATCH onto the copy cannot change the stored course.
+func cloneCourse(c course) course {
+	c.PriceBook = slices.Clone(c.PriceBook)
+	c.Metadata = maps.Clone(c.Metadata)
+	return c
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Custom Metadata บน course
+
+	1. `metadata` คือ map ของ field เพิ่มเติมที่แต่ละ deployment ต้องการ เช่น `{"cohort": "2026-A", "campus": "BKK"}`
+	   - ค่าต้องเป็น string, number หรือ boolean เท่านั้น (ไม่ซ้อน object) เพื่อให้ทุกรูปแบบข้อมูลส่งได้และนำไปกรองได้
+	2. กำหนดกฎได้ด้วย env `METADATA_FIELDS="cohort:string,credits:number"` ถ้าตั้งไว้ key อื่นหรือชนิดผิดจะถูกปฏิเสธด้วย 400
+	   - tenant ตั้งกฎของตัวเองได้ด้วย `metadata_fields` ใน `TENANTS_FILE` ใช้กับคอร์สของ tenant นั้นและการกรอง/เรียงบน domain ของมัน ถ้าไม่ตั้งใช้ `METADATA_FIELDS`
+	3. PATCH จะ merge key: ส่งเฉพาะ key ที่ต้องการเปลี่ยน และส่ง `null` เพื่อลบ key นั้น (แบบ JSON Merge Patch)
+	4. `cloneCourse` คัดลอก map/slice ก่อน decode PATCH เพราะ `json.Unmarshal` เขียนลง map/slice เดิม ไม่งั้นข้อมูลที่เก็บไว้จะถูกแก้ก่อนผ่าน validation
+*/
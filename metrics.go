@@ -0,0 +1,173 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GET /metrics is for Prometheus to scrape, in its text exposition
+// format:
+//
+//   - http_requests_total, requests answered, by route, method and status;
+//   - http_request_duration_seconds, a histogram of the time they took,
+//     with the same labels;
+//   - http_requests_in_flight, requests being served now;
+//   - courses, the courses in the catalog, private ones included;
+//   - the connection metrics of connections.go and the consistency
+//     check's of consistency.go.
+//
+// Routes are mux patterns, so /courses/1 and /courses/2 are both
+// /courses/{id}, and requests no route matched share route "". The health
+// probes, answered before the mux (health.go), are /healthz and /readyz.
+// Methods
+// outside the standard ones are counted as "other", so neither label can
+// be made to grow without bound. The numbers are the requestLogHandler
+// sees, the same the error budgets (slo.go) are built from, and they start
+// again at zero with the process, as Prometheus counters may. Background
+// jobs have their own metrics at /admin/jobs/metrics.
+//
+// /metrics is not behind the admin gate, since scrapers rarely hold a
+// session; keep it from the outside with IP_ACCESS_FILE or at the load
+// balancer.
+
+// latencyBuckets are the upper bounds of the duration histogram, in
+// seconds: Prometheus' default buckets.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// requestSeries is the labels of one request series.
+type requestSeries struct {
+	route  string
+	method string
+	status int
+}
+
+type requestSeriesStats struct {
+	count uint64
+	// buckets[i] counts the requests that took at most latencyBuckets[i];
+	// they are cumulative, as the exposition format wants them.
+	buckets []uint64
+	sum     float64 // seconds
+}
+
+var (
+	// requestMetricsMu protects requestMetrics.
+	requestMetricsMu sync.Mutex
+	requestMetrics   = make(map[requestSeries]*requestSeriesStats)
+	requestsInFlight atomic.Int64
+)
+
+// metricMethods are the methods counted under their own name.
+var metricMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace,
+}
+
+// metricsRoute is the route label of r, which the mux matched to route.
+func metricsRoute(r *http.Request, route string) string {
+	if route == "" && (r.URL.Path == "/healthz" || r.URL.Path == "/readyz") {
+		return r.URL.Path
+	}
+	return route
+}
+
+// recordRequestMetrics counts a request for route answered with status
+// that took d.
+func recordRequestMetrics(method, route string, status int, d time.Duration) {
+	if !slices.Contains(metricMethods, method) {
+		method = "other"
+	}
+	key := requestSeries{route: routePath(route), method: method, status: status}
+	seconds := d.Seconds()
+	requestMetricsMu.Lock()
+	defer requestMetricsMu.Unlock()
+	s := requestMetrics[key]
+	if s == nil {
+		s = &requestSeriesStats{buckets: make([]uint64, len(latencyBuckets))}
+		requestMetrics[key] = s
+	}
+	s.count++
+	s.sum += seconds
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			s.buckets[i]++
+		}
+	}
+}
+
+// metricsHandler serves GET /metrics.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var b strings.Builder
+	writeRequestMetrics(&b)
+	writeConnectionMetrics(&b)
+	writeConsistencyMetrics(&b)
+	courseMu.RLock()
+	courses := len(CourseList)
+	courseMu.RUnlock()
+	fmt.Fprintf(&b, "# HELP courses Courses in the catalog, private ones included.\n# TYPE courses gauge\ncourses %d\n", courses)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodGet {
+		w.Write([]byte(b.String()))
+	}
+}
+
+func writeRequestMetrics(b *strings.Builder) {
+	requestMetricsMu.Lock()
+	defer requestMetricsMu.Unlock()
+	series := slices.SortedFunc(maps.Keys(requestMetrics), func(a, b requestSeries) int {
+		return cmp.Or(cmp.Compare(a.route, b.route), cmp.Compare(a.method, b.method), cmp.Compare(a.status, b.status))
+	})
+	labels := func(s requestSeries) string {
+		return fmt.Sprintf("route=%q,method=%q,status=\"%d\"", s.route, s.method, s.status)
+	}
+	fmt.Fprint(b, "# HELP http_requests_total Requests answered, by route, method and status.\n# TYPE http_requests_total counter\n")
+	for _, s := range series {
+		fmt.Fprintf(b, "http_requests_total{%s} %d\n", labels(s), requestMetrics[s].count)
+	}
+	fmt.Fprint(b, "# HELP http_request_duration_seconds Time taken to answer requests.\n# TYPE http_request_duration_seconds histogram\n")
+	for _, s := range series {
+		stats := requestMetrics[s]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(b, "http_request_duration_seconds_bucket{%s,le=%q} %d\n", labels(s), strconv.FormatFloat(le, 'g', -1, 64), stats.buckets[i])
+		}
+		fmt.Fprintf(b, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(s), stats.count)
+		fmt.Fprintf(b, "http_request_duration_seconds_sum{%s} %s\n", labels(s), strconv.FormatFloat(stats.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "http_request_duration_seconds_count{%s} %d\n", labels(s), stats.count)
+	}
+	fmt.Fprintf(b, "# HELP http_requests_in_flight Requests being served now.\n# TYPE http_requests_in_flight gauge\nhttp_requests_in_flight %d\n", requestsInFlight.Load())
+}
+
+// wantsPrometheus reports whether r is a Prometheus scrape, which asks for
+// the text exposition format or OpenMetrics.
+func wantsPrometheus(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/openmetrics-text") || strings.Contains(accept, "version=0.0.4")
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: `GET /metrics` ให้ Prometheus มาดึงตัวเลขของ server ในรูปแบบ text exposition
+
+	1. metric ที่มี
+	   - `http_requests_total` นับ request ตาม route, method และ status
+	   - `http_request_duration_seconds` histogram ของเวลาที่ใช้ (bucket มาตรฐานของ Prometheus) label เดียวกัน
+	   - `http_requests_in_flight` จำนวน request ที่กำลังทำอยู่ และ `courses` จำนวน course ทั้งหมด
+	2. route เป็น pattern ของ mux (`/courses/{id}`) และ method แปลก ๆ รวมเป็น `other` จำนวน series จึงไม่โตไม่สิ้นสุด
+	3. เก็บที่ `requestLogHandler` ตัวเลขเดียวกับที่ error budget (slo.go) ใช้
+	4. ไม่อยู่หลัง gate ของ `/admin` ให้กันจากภายนอกด้วย `IP_ACCESS_FILE` หรือที่ load balancer
+	5. `/count` (CounterHandler) ตอบเป็นรูปแบบ Prometheus เมื่อ scraper ขอ (`wantsPrometheus`)
+*/
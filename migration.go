@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dual-write mode copies every course write to a second instance, such as
+// a build on a new storage backend, while this one stays the source of
+// truth. With -dual-write=<URL>, each change is queued and a single worker
+// sends the course's current state to the secondary's migration endpoint,
+// PUT or DELETE /admin/migration/courses/{id}, which keeps this
+// instance's IDs. Sending the current state rather than the change means a
+// retried or reordered send can only ever bring the secondary up to date.
+//
+// A conflict is a secondary that did not hold the version this instance
+// last sent it: someone wrote to it directly, or an earlier send was lost.
+// Conflicts are logged and kept for /admin/migration; the write is applied
+// anyway, since this instance wins.
+//
+// Courses from before dual-write was turned on are copied by a backfill
+// job (POST /admin/migration/backfill) in batches of BACKFILL_BATCH_SIZE
+// (default 100), pausing BACKFILL_BATCH_DELAY (default 100ms) between
+// batches to keep the load down. DUAL_WRITE_AUTHORIZATION, if set, is
+// sent as the Authorization header to the secondary.
+
+const (
+	previousETagHeader = "X-Previous-ETag"
+	dualWriteQueue     = 1024
+	maxMigrationLog    = 100
+)
+
+var (
+	backfillBatchSize  = 100
+	backfillBatchDelay = 100 * time.Millisecond
+	dualWriteAuth      = os.Getenv("DUAL_WRITE_AUTHORIZATION")
+)
+
+func init() {
+	if v := os.Getenv("BACKFILL_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid BACKFILL_BATCH_SIZE %q: must be a positive number", v)
+		}
+		backfillBatchSize = n
+	}
+	if v := os.Getenv("BACKFILL_BATCH_DELAY"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid BACKFILL_BATCH_DELAY %q: must be a duration", v)
+		}
+		backfillBatchDelay = d
+	}
+}
+
+type migrationConflict struct {
+	At       time.Time `json:"at"`
+	CourseID int       `json:"course_id"`
+	Source   string    `json:"source"` // "dual-write" or "backfill"
+	Reason   string    `json:"reason"`
+}
+
+type backfillJob struct {
+	State      string     `json:"state"` // "running", "succeeded" or "failed"
+	Total      int        `json:"total"`
+	Copied     int        `json:"copied"`
+	Failed     int        `json:"failed"`
+	Batches    int        `json:"batches"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// queuedCopy is a course waiting to be copied.
+type queuedCopy struct {
+	id  int
+	job *trackedJob
+}
+
+// dualWriter sends courses to the secondary.
+type dualWriter struct {
+	target *url.URL
+	client *http.Client
+	queue  chan queuedCopy
+
+	// sendMu serializes sends, so the worker and a backfill never race on
+	// one course and sent stays accurate.
+	sendMu sync.Mutex
+	sent   map[int]string // course ID -> ETag last copied; "" for deleted
+
+	mu        sync.Mutex
+	synced    int64
+	failed    int64
+	dropped   int64 // changes not queued because the queue was full
+	conflicts []migrationConflict
+	backfill  *backfillJob
+}
+
+// activeDualWriter is nil unless -dual-write is set.
+var activeDualWriter *dualWriter
+
+func newDualWriter(target string) (*dualWriter, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("want an absolute http or https URL")
+	}
+	d := &dualWriter{
+		target: u,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan queuedCopy, dualWriteQueue),
+		sent:   make(map[int]string),
+	}
+	go d.run()
+	return d, nil
+}
+
+// enqueueDualWrite queues course id for copying. It is called from
+// recordChange with courseMu held, so it must not block.
+func enqueueDualWrite(id int) {
+	d := activeDualWriter
+	if d == nil {
+		return
+	}
+	j := trackJob(jobDualWrite, strconv.Itoa(id))
+	select {
+	case d.queue <- queuedCopy{id, j}:
+	default:
+		j.done(errors.New("queue full"))
+		d.mu.Lock()
+		d.dropped++
+		d.mu.Unlock()
+		d.conflict(id, "dual-write", "queue full; change not copied, run a backfill")
+	}
+}
+
+func (d *dualWriter) run() {
+	for q := range d.queue {
+		q.job.attempt()
+		q.job.done(d.sync(q.id, "dual-write"))
+	}
+}
+
+// sync copies the current state of course id to the secondary.
+func (d *dualWriter) sync(id int, source string) error {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	courseMu.RLock()
+	var c *course
+	if i := findCourseIndex(id); i >= 0 {
+		cc := cloneCourse(CourseList[i])
+		c = &cc
+	}
+	courseMu.RUnlock()
+
+	previous, err := d.send(id, c)
+	d.mu.Lock()
+	if err != nil {
+		d.failed++
+	} else {
+		d.synced++
+	}
+	d.mu.Unlock()
+	if err != nil {
+		slog.Error("Dual-write failed", "course_id", id, "err", err)
+		d.conflict(id, source, "not copied: "+err.Error())
+		return err
+	}
+
+	want, known := d.sent[id]
+	switch {
+	case known && previous != want:
+		d.conflict(id, source, fmt.Sprintf("secondary held %s, expected %s", etagOrNone(previous), etagOrNone(want)))
+	case !known && source == "backfill" && previous != "" && c != nil && previous != courseETag(*c):
+		d.conflict(id, source, fmt.Sprintf("secondary already held a different version %s", previous))
+	}
+	if c != nil {
+		d.sent[id] = courseETag(*c)
+	} else {
+		d.sent[id] = ""
+	}
+	return nil
+}
+
+func etagOrNone(etag string) string {
+	if etag == "" {
+		return "nothing"
+	}
+	return etag
+}
+
+// send PUTs c, or DELETEs course id if c is nil, and returns the ETag of
+// what the secondary held before.
+func (d *dualWriter) send(id int, c *course) (string, error) {
+	u := d.target.JoinPath("/admin/migration/courses", strconv.Itoa(id)).String()
+	method, body := http.MethodDelete, []byte(nil)
+	if c != nil {
+		method = http.MethodPut
+		b, err := json.Marshal(c)
+		if err != nil {
+			return "", err
+		}
+		body = b
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaTypeJSON)
+	if dualWriteAuth != "" {
+		req.Header.Set("Authorization", dualWriteAuth)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound && c == nil:
+		return "", nil // already gone
+	case resp.StatusCode >= 300:
+		return "", fmt.Errorf("%s %s answered %s", method, u, resp.Status)
+	}
+	return resp.Header.Get(previousETagHeader), nil
+}
+
+func (d *dualWriter) conflict(id int, source, reason string) {
+	slog.Warn("Migration conflict", "course_id", id, "source", source, "reason", reason)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conflicts = append(d.conflicts, migrationConflict{At: time.Now().UTC(), CourseID: id, Source: source, Reason: reason})
+	if n := len(d.conflicts) - maxMigrationLog; n > 0 {
+		d.conflicts = slices.Delete(d.conflicts, 0, n)
+	}
+}
+
+var errBackfillRunning = errors.New("a backfill is already running")
+
+// startBackfill copies every course to the secondary in the background.
+func (d *dualWriter) startBackfill() (backfillJob, error) {
+	courseMu.RLock()
+	ids := make([]int, len(CourseList))
+	for i, c := range CourseList {
+		ids[i] = c.CourseId
+	}
+	courseMu.RUnlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.backfill != nil && d.backfill.State == "running" {
+		return *d.backfill, errBackfillRunning
+	}
+	job := &backfillJob{State: "running", Total: len(ids), StartedAt: time.Now().UTC()}
+	d.backfill = job
+	go d.runBackfill(job, ids)
+	return *job, nil
+}
+
+func (d *dualWriter) runBackfill(job *backfillJob, ids []int) {
+	slog.Info("Backfill started", "courses", len(ids), "batch_size", backfillBatchSize)
+	for batch := range slices.Chunk(ids, backfillBatchSize) {
+		copied, failed := 0, 0
+		for _, id := range batch {
+			// Courses deleted since the backfill started are copied as
+			// deletions, which is what the secondary should end up with.
+			if d.sync(id, "backfill") != nil {
+				failed++
+			} else {
+				copied++
+			}
+		}
+		d.mu.Lock()
+		job.Copied += copied
+		job.Failed += failed
+		job.Batches++
+		done := job.Copied + job.Failed
+		d.mu.Unlock()
+		slog.Info("Backfill progress", "done", done, "total", job.Total, "failed", job.Failed)
+		time.Sleep(backfillBatchDelay)
+	}
+	d.mu.Lock()
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	job.State = "succeeded"
+	if job.Failed > 0 {
+		job.State = "failed"
+	}
+	d.mu.Unlock()
+	slog.Info("Backfill finished", "state", job.State, "copied", job.Copied, "failed", job.Failed)
+}
+
+// adminMigrationHandler serves GET /admin/migration, the state of
+// dual-write and of the last backfill.
+func adminMigrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d := activeDualWriter
+	if d == nil {
+		writeValue(w, r, http.StatusOK, map[string]any{"enabled": false})
+		return
+	}
+	d.mu.Lock()
+	resp := map[string]any{
+		"enabled": true,
+		"target":  d.target.String(),
+		"queued":  len(d.queue),
+		"synced":  d.synced,
+		"failed":  d.failed,
+		"dropped": d.dropped,
+	}
+	conflicts := slices.Clone(d.conflicts)
+	slices.Reverse(conflicts) // newest first
+	resp["conflicts"] = conflicts
+	if d.backfill != nil {
+		resp["backfill"] = *d.backfill
+	}
+	d.mu.Unlock()
+	writeValue(w, r, http.StatusOK, resp)
+}
+
+// adminBackfillHandler serves POST /admin/migration/backfill, which starts
+// a backfill and answers 202 with its progress; poll /admin/migration for
+// the rest.
+func adminBackfillHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d := activeDualWriter
+	if d == nil {
+		writeError(w, r, "Dual-write is not enabled; start with -dual-write", http.StatusConflict)
+		return
+	}
+	job, err := d.startBackfill()
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Location", "/admin/migration")
+	writeValue(w, r, http.StatusAccepted, job)
+}
+
+// adminMigrationCourseHandler serves the receiving side: PUT and DELETE
+// /admin/migration/courses/{id} store or remove a course under the ID the
+// primary gave it, answering with the replaced version's ETag in
+// X-Previous-ETag.
+func adminMigrationCourseHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		var c course
+		if !decodeBody(w, r, &c) {
+			return
+		}
+		if c.CourseId != id {
+			writeError(w, r, "Course ID in the body does not match the URL", http.StatusBadRequest)
+			return
+		}
+		previous, err := putCourse(c)
+		if err != nil {
+			writeCourseServiceError(w, r, err)
+			return
+		}
+		w.Header().Set(previousETagHeader, previous)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		courseMu.RLock()
+		previous := ""
+		if i := findCourseIndex(id); i >= 0 {
+			previous = courseETag(CourseList[i])
+		}
+		courseMu.RUnlock()
+		if err := deleteCourse(systemPrincipal, id, previous); err != nil {
+			writeCourseServiceError(w, r, err)
+			return
+		}
+		w.Header().Set(previousETagHeader, previous)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Dual-write และ backfill สำหรับย้าย storage โดยไม่มี downtime
+
+	1. รันด้วย `-dual-write=http://new-backend:8080` ทุกครั้งที่ course ถูกสร้าง/แก้/ลบ จะถูกส่งต่อไปยัง instance ใหม่ด้วย
+	   - ส่งผ่าน `PUT`/`DELETE /admin/migration/courses/{id}` ซึ่งเก็บ ID เดิมไว้ (ต่างจาก `POST /courses` ที่สร้าง ID ใหม่)
+	   - ส่ง "สถานะปัจจุบัน" ของ course เสมอ ส่งซ้ำหรือสลับลำดับก็ไม่ทำให้ข้อมูลถอยหลัง
+	   - ทำใน worker ตัวเดียวเบื้องหลัง request ของผู้ใช้ไม่ต้องรอ instance ใหม่
+	2. conflict = ปลายทางไม่ได้ถือ version ที่เราส่งไปล่าสุด (มีคนเขียนตรง หรือการส่งครั้งก่อนหาย) จะถูก log และแสดงใน `/admin/migration` แต่ข้อมูลฝั่งนี้ยังชนะเสมอ
+	3. ข้อมูลเก่าก่อนเปิด dual-write ใช้ `POST /admin/migration/backfill` คัดลอกเป็นชุด (`BACKFILL_BATCH_SIZE`, `BACKFILL_BATCH_DELAY`) ดูความคืบหน้าที่ `GET /admin/migration`
+*/
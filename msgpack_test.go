@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalMsgpack(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   []byte
+		want any
+	}{
+		{"fixmap", []byte{0x81, 0xa1, 'a', 0x01}, map[string]any{"a": float64(1)}},
+		{"fixarray", []byte{0x93, 0xc3, 0xc0, 0xa1, 'x'}, []any{true, nil, "x"}},
+		{"negative fixint", []byte{0xff}, float64(-1)},
+		{"int16", []byte{0xd1, 0xff, 0x38}, float64(-200)},
+		{"uint32", []byte{0xce, 0x00, 0x01, 0x00, 0x00}, float64(65536)},
+		{"float64", []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5},
+		{"str8", []byte{0xd9, 0x02, 'h', 'i'}, "hi"},
+		{"array16", []byte{0xdc, 0x00, 0x01, 0xc2}, []any{false}},
+		{"map16", []byte{0xde, 0x00, 0x01, 0xa1, 'k', 0xc0}, map[string]any{"k": nil}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got any
+			if err := unmarshalMsgpack(tt.in, &got); err != nil {
+				t.Fatalf("unmarshalMsgpack(% x): %v", tt.in, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unmarshalMsgpack(% x) = %#v, want %#v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalMsgpackMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   []byte
+		err  string
+	}{
+		{"empty", nil, "truncated"},
+		{"short string", []byte{0xa3, 'a'}, "truncated"},
+		{"short array", []byte{0x92, 0x01}, "truncated"},
+		{"short int", []byte{0xcd, 0x01}, "truncated"},
+		{"huge array", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, "truncated"},
+		{"huge map", []byte{0xdf, 0xff, 0xff, 0xff, 0xff}, "truncated"},
+		{"huge string", []byte{0xdb, 0xff, 0xff, 0xff, 0xff}, "truncated"},
+		{"number key", []byte{0x81, 0x01, 0x01}, "keys must be strings"},
+		{"bin", []byte{0xc4, 0x01, 0x00}, "unsupported type 0xc4"},
+		{"never used", []byte{0xc1}, "unsupported type 0xc1"},
+		{"trailing data", []byte{0x01, 0x02}, "trailing data"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got any
+			err := unmarshalMsgpack(tt.in, &got)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("unmarshalMsgpack(% x) = %v, want an error containing %q", tt.in, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMarshalMsgpackRoundTrip(t *testing.T) {
+	in := map[string]any{"name": "Go", "price": float64(100), "neg": float64(-70000), "half": 0.5, "tags": []any{"a", true, nil}}
+	data, err := marshalMsgpack(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got any
+	if err := unmarshalMsgpack(data, &got); err != nil {
+		t.Fatalf("unmarshalMsgpack(% x): %v", data, err)
+	}
+	if !reflect.DeepEqual(got, in) {
+		t.Errorf("round trip of % x = %#v, want %#v", data, got, in)
+	}
+}
+
+func FuzzUnmarshalMsgpack(f *testing.F) {
+	for _, b := range [][]byte{{0x81, 0xa1, 'a', 0x01}, {0x93, 0xc3, 0xc0, 0xa1, 'x'}, {0xdd, 0xff, 0xff, 0xff, 0xff}, {0xd3, 0x80}} {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var v any
+		unmarshalMsgpack(b, &v)
+	})
+}
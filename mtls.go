@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Internal services can call the server with a client certificate instead
+// of a token. TLS_CLIENT_CA_FILE is a PEM bundle of the CAs that issue
+// them; the HTTPS listener then asks for a certificate and verifies it
+// against those CAs in the handshake. With TLS_CLIENT_AUTH=require (the
+// default) a connection without a valid certificate is refused, and the
+// plain listener answers only health checks and requests from the machine
+// itself, so nothing can go around the check. TLS_CLIENT_AUTH=optional
+// verifies a certificate when one is sent and lets browsers in without.
+//
+// TLS_CLIENT_PRINCIPALS is a JSON file mapping certificate subjects to
+// roles, as API keys have:
+//
+//	[{"subject": "spiffe://internal/lms-sync", "role": "admin"},
+//	 {"subject": "CN=grading,O=Acme", "role": "instructor", "instructor": "Dr. Lee"}]
+//
+// A subject matches the certificate's distinguished name, its common name,
+// or one of its URI or DNS names, which covers SPIFFE IDs. A verified
+// certificate that maps to nothing authenticates nothing, exactly like a
+// request without credentials. Once any subject is mapped, writes need
+// credentials (see authRequired).
+
+const (
+	clientAuthRequire  = "require"
+	clientAuthOptional = "optional"
+)
+
+var (
+	clientCAs        *x509.CertPool
+	clientAuthMode   string
+	clientPrincipals = map[string]clientPrincipal{} // by subject
+)
+
+// clientPrincipal is what a certificate subject may do.
+type clientPrincipal struct {
+	Subject    string `json:"subject"`
+	Role       string `json:"role"`
+	Instructor string `json:"instructor,omitempty"`
+}
+
+func init() {
+	if f := os.Getenv("TLS_CLIENT_CA_FILE"); f != "" {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			log.Fatalf("Cannot read TLS_CLIENT_CA_FILE: %v", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			log.Fatalf("Invalid TLS_CLIENT_CA_FILE %s: no PEM certificates", f)
+		}
+		if !tlsEnabled() {
+			log.Fatal("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE/TLS_KEY_FILE, TLS_CERT_DIR or ACME_CACHE_DIR")
+		}
+		clientAuthMode = clientAuthRequire
+	}
+	switch v := os.Getenv("TLS_CLIENT_AUTH"); v {
+	case "":
+	case clientAuthRequire, clientAuthOptional:
+		if clientCAs == nil {
+			log.Fatal("TLS_CLIENT_AUTH needs TLS_CLIENT_CA_FILE")
+		}
+		clientAuthMode = v
+	default:
+		log.Fatalf("Invalid TLS_CLIENT_AUTH %q: use require or optional", v)
+	}
+	if f := os.Getenv("TLS_CLIENT_PRINCIPALS"); f != "" {
+		if clientCAs == nil {
+			log.Fatal("TLS_CLIENT_PRINCIPALS needs TLS_CLIENT_CA_FILE")
+		}
+		data, err := os.ReadFile(f)
+		if err != nil {
+			log.Fatalf("Cannot read TLS_CLIENT_PRINCIPALS: %v", err)
+		}
+		var list []clientPrincipal
+		if err := json.Unmarshal(data, &list); err != nil {
+			log.Fatalf("Invalid TLS_CLIENT_PRINCIPALS %s: %v", f, err)
+		}
+		for _, p := range list {
+			if p.Subject == "" {
+				log.Fatalf("Invalid TLS_CLIENT_PRINCIPALS %s: subject is required", f)
+			}
+			if msg := checkRole(p.Role, p.Instructor); msg != "" {
+				log.Fatalf("Invalid TLS_CLIENT_PRINCIPALS %s: %s: %s", f, p.Subject, msg)
+			}
+			clientPrincipals[p.Subject] = p
+		}
+	}
+}
+
+// clientCertsInUse reports whether any certificate subject is mapped to a
+// role.
+func clientCertsInUse() bool {
+	return len(clientPrincipals) > 0
+}
+
+// tlsClientAuth is the HTTPS listener's client certificate policy.
+func tlsClientAuth() tls.ClientAuthType {
+	switch clientAuthMode {
+	case clientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	case clientAuthOptional:
+		return tls.VerifyClientCertIfGiven
+	}
+	return tls.NoClientCert
+}
+
+// requestClientCert returns the principal r's verified client certificate
+// maps to.
+func requestClientCert(r *http.Request) (clientPrincipal, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(clientPrincipals) == 0 {
+		return clientPrincipal{}, false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	names := []string{leaf.Subject.String(), leaf.Subject.CommonName}
+	for _, u := range leaf.URIs {
+		names = append(names, u.String())
+	}
+	names = append(names, leaf.DNSNames...)
+	for _, name := range names {
+		if p, ok := clientPrincipals[name]; ok && name != "" {
+			return p, true
+		}
+	}
+	return clientPrincipal{}, false
+}
+
+func (p clientPrincipal) principal() principal {
+	return principal{Subject: "cert:" + p.Subject, Role: p.Role, Instructor: p.Instructor}
+}
+
+// clientCertRequiredHandler stands in front of the plain listener when
+// HTTPS requires client certificates, refusing what would otherwise skip
+// the check.
+func clientCertRequiredHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || clientIP(r).IsLoopback() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		writeError(w, r, "Forbidden: a client certificate is required; use HTTPS on "+strings.TrimPrefix(tlsAddr, ":"), http.StatusForbidden)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: โหมด mTLS ให้ service ภายในยืนยันตัวด้วย client certificate แทน token (zero-trust)
+
+	1. `TLS_CLIENT_CA_FILE` (PEM ของ CA ที่ออก cert ให้ client) เปิดการขอและตรวจ cert ตอน handshake ของ HTTPS
+	   - `TLS_CLIENT_AUTH=require` (ค่าเริ่มต้น) ไม่มี cert ที่ถูกต้อง = ต่อไม่ได้เลย และ port HTTP ธรรมดาตอบ 403 ยกเว้น health check กับ request จากเครื่องตัวเอง กันการอ้อม
+	   - `TLS_CLIENT_AUTH=optional` ตรวจเฉพาะเมื่อ client ส่ง cert มา browser ทั่วไปยังเข้าได้
+	2. `TLS_CLIENT_PRINCIPALS` ไฟล์ JSON จับคู่ subject ของ cert กับ role (แบบเดียวกับ API key)
+	   - เทียบได้ทั้ง DN เต็ม, CN, URI SAN (เช่น SPIFFE ID) และ DNS SAN
+	   - cert ที่ผ่านการตรวจแต่ไม่มีในไฟล์ ถือว่าไม่มี credential
+	3. cert ที่ map เป็น admin เข้า route `/admin` ได้ด้วย และ principal ที่ได้ใช้ชื่อ `cert:<subject>` ใน audit
+*/
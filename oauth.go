@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// People sign in to the admin UI with Google or GitHub. /auth/login sends
+// the browser to the provider with the authorization code flow (with PKCE
+// and, for Google, an OIDC nonce); /auth/callback exchanges the code, finds
+// out who signed in, and, if they are listed in OAUTH_ADMINS, starts an
+// admin session (sessions.go).
+//
+// A provider is on when its OAUTH_<NAME>_CLIENT_ID and
+// OAUTH_<NAME>_CLIENT_SECRET are set. OAUTH_ADMINS lists who may sign in:
+// verified e-mail addresses for Google and github:<login> for GitHub.
+// OAUTH_REDIRECT_URL is the callback registered with the providers; by
+// default it is derived from the request, which is only right when nothing
+// in front of the server rewrites the host.
+//
+// The Google ID token comes straight from Google's token endpoint over
+// TLS, which OIDC allows in place of checking its signature, so no keys
+// are fetched. GitHub has no ID token; its user API says who signed in.
+
+const (
+	oauthStateCookie = "oauth_state"
+	oauthLoginTTL    = 10 * time.Minute
+)
+
+type oauthProvider struct {
+	name         string
+	clientID     string
+	clientSecret string
+	authURL      string
+	tokenURL     string
+	scopes       string
+	// identify returns who signed in, given the token response.
+	identify func(p *oauthProvider, tok oauthTokenResponse, nonce string) (string, error)
+}
+
+var oauthProviders = []*oauthProvider{
+	{
+		name:         "google",
+		clientID:     os.Getenv("OAUTH_GOOGLE_CLIENT_ID"),
+		clientSecret: os.Getenv("OAUTH_GOOGLE_CLIENT_SECRET"),
+		authURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+		tokenURL:     "https://oauth2.googleapis.com/token",
+		scopes:       "openid email",
+		identify:     identifyGoogle,
+	},
+	{
+		name:         "github",
+		clientID:     os.Getenv("OAUTH_GITHUB_CLIENT_ID"),
+		clientSecret: os.Getenv("OAUTH_GITHUB_CLIENT_SECRET"),
+		authURL:      "https://github.com/login/oauth/authorize",
+		tokenURL:     "https://github.com/login/oauth/access_token",
+		scopes:       "read:user",
+		identify:     identifyGitHub,
+	},
+}
+
+var (
+	oauthAdmins      = splitList(os.Getenv("OAUTH_ADMINS"))
+	oauthRedirectURL = os.Getenv("OAUTH_REDIRECT_URL")
+	oauthClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+func splitList(s string) []string {
+	var out []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func init() {
+	for _, p := range oauthProviders {
+		if (p.clientID == "") != (p.clientSecret == "") {
+			log.Fatalf("Set both OAUTH_%[1]s_CLIENT_ID and OAUTH_%[1]s_CLIENT_SECRET, or neither", strings.ToUpper(p.name))
+		}
+	}
+	if oauthEnabled() && len(oauthAdmins) == 0 {
+		log.Fatal("OAuth login needs OAUTH_ADMINS, or anyone with an account could sign in")
+	}
+}
+
+func enabledOAuthProviders() []*oauthProvider {
+	var ps []*oauthProvider
+	for _, p := range oauthProviders {
+		if p.clientID != "" {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+func oauthEnabled() bool {
+	return len(enabledOAuthProviders()) > 0
+}
+
+func findOAuthProvider(name string) *oauthProvider {
+	for _, p := range enabledOAuthProviders() {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// pendingLogin is a login between /auth/login and /auth/callback.
+type pendingLogin struct {
+	provider string
+	verifier string // PKCE code verifier
+	nonce    string
+	next     string
+	expires  time.Time
+}
+
+var (
+	pendingLoginMu sync.Mutex
+	pendingLogins  = make(map[string]pendingLogin) // by state
+)
+
+// localRedirect returns next if it is a path on this server, so the login
+// cannot be used to send people elsewhere.
+func localRedirect(next string) string {
+	// Browsers drop tabs and newlines and read \ as /, so /%09/evil.example
+	// or /\evil.example would leave the site.
+	unsafe := func(r rune) bool { return r < 0x20 || r == 0x7f || r == '\\' }
+	if strings.ContainsFunc(next, unsafe) {
+		return "/admin/"
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil || !strings.HasPrefix(u.Path, "/") ||
+		strings.HasPrefix(u.Path, "//") || strings.ContainsFunc(u.Path, unsafe) {
+		return "/admin/"
+	}
+	return next
+}
+
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func callbackURL(r *http.Request) string {
+	if oauthRedirectURL != "" {
+		return oauthRedirectURL
+	}
+	scheme := "http"
+	if secureRequest(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/auth/callback"
+}
+
+// authLoginHandler serves GET /auth/login?provider=google|github&next=/path.
+// Without a provider it uses the only one configured, or offers a choice.
+func authLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	providers := enabledOAuthProviders()
+	if len(providers) == 0 {
+		writeError(w, r, "Login is not configured", http.StatusNotFound)
+		return
+	}
+	next := localRedirect(r.URL.Query().Get("next"))
+	name := r.URL.Query().Get("provider")
+	if name == "" && len(providers) == 1 {
+		name = providers[0].name
+	}
+	if name == "" {
+		var names []string
+		for _, p := range providers {
+			names = append(names, p.name)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := executeTemplate(w, r, "login.html", map[string]any{"Providers": names, "Next": next}); err != nil {
+			requestLogger(r).Error("Error rendering login page", "err", err)
+			writeError(w, r, "Cannot render login page", http.StatusInternalServerError)
+		}
+		return
+	}
+	p := findOAuthProvider(name)
+	if p == nil {
+		writeError(w, r, "Unknown login provider "+name, http.StatusBadRequest)
+		return
+	}
+
+	state := randomHex(16)
+	login := pendingLogin{provider: p.name, verifier: randomHex(32), nonce: randomHex(16), next: next, expires: time.Now().Add(oauthLoginTTL)}
+	pendingLoginMu.Lock()
+	for s, l := range pendingLogins {
+		if time.Now().After(l.expires) {
+			delete(pendingLogins, s)
+		}
+	}
+	pendingLogins[state] = login
+	pendingLoginMu.Unlock()
+
+	// The state cookie ties the callback to this browser, so nobody can
+	// sign someone else in with their own account.
+	http.SetCookie(w, &http.Cookie{
+		Name: oauthStateCookie, Value: state, Path: "/auth/", MaxAge: int(oauthLoginTTL.Seconds()),
+		HttpOnly: true, Secure: secureRequest(r), SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(login.verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.clientID},
+		"redirect_uri":          {callbackURL(r)},
+		"scope":                 {p.scopes},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	if p.name == "google" {
+		q.Set("nonce", login.nonce)
+	}
+	http.Redirect(w, r, p.authURL+"?"+q.Encode(), http.StatusFound)
+}
+
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (p *oauthProvider) exchange(r *http.Request, code, verifier string) (oauthTokenResponse, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {callbackURL(r)},
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", mediaTypeJSON)
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+	defer resp.Body.Close()
+	var tok oauthTokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return oauthTokenResponse{}, fmt.Errorf("token endpoint answered %s", resp.Status)
+	}
+	if tok.Error != "" {
+		return oauthTokenResponse{}, fmt.Errorf("%s: %s", tok.Error, tok.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || tok.AccessToken == "" {
+		return oauthTokenResponse{}, fmt.Errorf("token endpoint answered %s", resp.Status)
+	}
+	return tok, nil
+}
+
+func identifyGoogle(p *oauthProvider, tok oauthTokenResponse, nonce string) (string, error) {
+	parts := strings.Split(tok.IDToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("no ID token in the token response")
+	}
+	var claims struct {
+		Issuer        string `json:"iss"`
+		Audience      string `json:"aud"`
+		Expires       int64  `json:"exp"`
+		Nonce         string `json:"nonce"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("invalid ID token: %w", err)
+	}
+	switch {
+	case claims.Issuer != "https://accounts.google.com" && claims.Issuer != "accounts.google.com":
+		return "", errors.New("ID token is from another issuer")
+	case claims.Audience != p.clientID:
+		return "", errors.New("ID token is for another client")
+	case time.Now().After(time.Unix(claims.Expires, 0).Add(jwtLeeway)):
+		return "", errors.New("ID token has expired")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return "", errors.New("ID token nonce does not match")
+	case claims.Email == "" || !claims.EmailVerified:
+		return "", errors.New("Google account has no verified e-mail address")
+	}
+	return strings.ToLower(claims.Email), nil
+}
+
+const githubUserURL = "https://api.github.com/user"
+
+func identifyGitHub(p *oauthProvider, tok oauthTokenResponse, _ string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, githubUserURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub user API answered %s", resp.Status)
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&user); err != nil || user.Login == "" {
+		return "", errors.New("GitHub user API gave no login")
+	}
+	return "github:" + strings.ToLower(user.Login), nil
+}
+
+func oauthAdmin(identity string) bool {
+	return slices.ContainsFunc(oauthAdmins, func(a string) bool { return strings.EqualFold(a, identity) })
+}
+
+// authCallbackHandler serves GET /auth/callback, where the provider sends
+// the browser back with a code.
+func authCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	state := q.Get("state")
+	pendingLoginMu.Lock()
+	login, ok := pendingLogins[state]
+	delete(pendingLogins, state)
+	pendingLoginMu.Unlock()
+	cookie, err := r.Cookie(oauthStateCookie)
+	if !ok || time.Now().After(login.expires) || err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		writeError(w, r, "Login expired or was started elsewhere; try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/auth/", MaxAge: -1})
+	if e := q.Get("error"); e != "" {
+		writeError(w, r, "Login was not completed: "+e, http.StatusForbidden)
+		return
+	}
+	p := findOAuthProvider(login.provider)
+	if p == nil || q.Get("code") == "" {
+		writeError(w, r, "Invalid login callback", http.StatusBadRequest)
+		return
+	}
+	tok, err := p.exchange(r, q.Get("code"), login.verifier)
+	var identity string
+	if err == nil {
+		identity, err = p.identify(p, tok, login.nonce)
+	}
+	if err != nil {
+		requestLogger(r).Warn("Login failed", "provider", p.name, "err", err)
+		writeError(w, r, "Login with "+p.name+" failed", http.StatusBadGateway)
+		return
+	}
+	if !oauthAdmin(identity) {
+		requestLogger(r).Warn("Login refused: not in OAUTH_ADMINS", "provider", p.name, "identity", identity)
+		writeError(w, r, "Forbidden: "+identity+" is not an admin", http.StatusForbidden)
+		return
+	}
+
+	recordSecurityEvent(r, identity, securityEventSignIn, p.name)
+	startSession(w, r, principal{Subject: identity, Role: roleAdmin}, p.name)
+	http.Redirect(w, r, login.next, http.StatusFound)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ให้คนเข้าหน้า admin ด้วยบัญชี Google หรือ GitHub (OAuth2 / OIDC)
+
+	1. `GET /auth/login` พา browser ไปหน้า login ของ provider (authorization code + PKCE, Google มี nonce ของ OIDC ด้วย)
+	   - state เก็บฝั่ง server และผูกกับ browser ด้วย cookie `oauth_state` กันการ login แทนคนอื่น
+	   - `next` รับเฉพาะ path บน server นี้ กันการใช้หน้า login ส่งคนไปเว็บอื่น (parse ด้วย url.Parse ต้องไม่มี scheme/host และห้ามมี control character หรือ backslash)
+	2. `GET /auth/callback` แลก code เป็น token แล้วหาว่าใครเข้ามา
+	   - Google: อ่าน ID token ที่ได้ตรงจาก token endpoint ผ่าน TLS ตรวจ iss/aud/exp/nonce และ e-mail ที่ยืนยันแล้ว
+	   - GitHub: ไม่มี ID token จึงถาม `api.github.com/user` ได้เป็น `github:<login>`
+	3. ต้องอยู่ใน `OAUTH_ADMINS` เท่านั้น แล้วเริ่ม session ของเราเองที่เก็บฝั่ง server (`sessions.go`) ด้วยบทบาท admin
+	4. ด่าน `/admin` รับ session นี้ได้เหมือน Basic auth
+*/
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestLocalRedirect(t *testing.T) {
+	for _, tt := range []struct{ in, want string }{
+		{"/admin/courses?page=2#top", "/admin/courses?page=2#top"},
+		{"/", "/"},
+		{"", "/admin/"},
+		{"admin", "/admin/"},
+		{"https://evil.example/", "/admin/"},
+		{"//evil.example", "/admin/"},
+		{"/\\evil.example", "/admin/"},
+		{"/\t/evil.example", "/admin/"},
+		{"/\n/evil.example", "/admin/"},
+		{"/%09/evil.example", "/admin/"},
+		{"/%2F/evil.example", "/admin/"},
+		{"/%5Cevil.example", "/admin/"},
+		{"/\x7f/evil.example", "/admin/"},
+		{"javascript:alert(1)", "/admin/"},
+	} {
+		if got := localRedirect(tt.in); got != tt.want {
+			t.Errorf("localRedirect(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
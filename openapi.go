@@ -0,0 +1,664 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The OpenAPI 3 document at /openapi.json describes the course, enrollment
+// and counter endpoints. The paths are written out below next to the rules
+// they document; the schemas are generated from the Go types the handlers
+// encode and the media types from the codec registry, so adding a course
+// field or a wire format updates the document by itself. `server
+// validate-spec` (speccheck.go) catches the paths falling behind.
+
+const openAPIVersion = "3.0.3"
+
+// jsonSchemaFor derives a schema from t's JSON encoding, registering named
+// structs in components as $refs.
+func jsonSchemaFor(t reflect.Type, components map[string]any) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case reflect.TypeFor[time.Time]():
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeFor[any]():
+		return map[string]any{}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchemaFor(t.Elem(), components)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchemaFor(t.Elem(), components)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			props, required := map[string]any{}, []string{}
+			addStructFields(t, components, props, &required)
+			return objectSchema(props, required)
+		}
+		name := openAPIName(t)
+		if _, ok := components[name]; !ok {
+			components[name] = nil // placeholder, in case the type refers to itself
+			props, required := map[string]any{}, []string{}
+			addStructFields(t, components, props, &required)
+			components[name] = objectSchema(props, required)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+func objectSchema(props map[string]any, required []string) map[string]any {
+	schema := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addStructFields adds t's JSON fields to props, flattening embedded
+// structs the way encoding/json does.
+func addStructFields(t reflect.Type, components map[string]any, props map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			addStructFields(f.Type, components, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = jsonSchemaFor(f.Type, components)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// openAPIName turns a Go type name into a schema name: course -> Course.
+func openAPIName(t reflect.Type) string {
+	n := t.Name()
+	return strings.ToUpper(n[:1]) + n[1:]
+}
+
+// openAPIContent lists schema under every media type the codecs serve.
+// Course-only codecs are left out of responses that are not courses.
+func openAPIContent(schema map[string]any, coursesOnly bool) map[string]any {
+	content := map[string]any{}
+	for _, cd := range codecs {
+		if !coursesOnly && cd.encodeValue == nil {
+			continue
+		}
+		content[cd.mediaType] = map[string]any{"schema": schema}
+	}
+	return content
+}
+
+func buildOpenAPI() map[string]any {
+	components := map[string]any{}
+	ref := func(v any) map[string]any { return jsonSchemaFor(reflect.TypeOf(v), components) }
+	ref(course{}) // registers Course
+	// Request bodies leave out the ID, which the server assigns, and may
+	// leave out any other field: PATCH sends only what changes.
+	inputProps := maps.Clone(components["Course"].(map[string]any)["properties"].(map[string]any))
+	delete(inputProps, "id")
+	components["CourseInput"] = objectSchema(inputProps, nil)
+	inputSchema := map[string]any{"$ref": "#/components/schemas/CourseInput"}
+	resourceSchema := ref(courseResource{})
+	enrollmentSchema := ref(enrollment{})
+	changesSchema := ref(struct {
+		Changes   []courseChange `json:"changes"`
+		NextSince int64          `json:"next_since"`
+	}{})
+
+	text := func(desc string) map[string]any {
+		return map[string]any{"description": desc, "content": map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}}
+	}
+	query := func(name, desc string, schema map[string]any) map[string]any {
+		return map[string]any{"name": name, "in": "query", "description": desc, "schema": schema}
+	}
+	header := func(name, desc string) map[string]any {
+		return map[string]any{"name": name, "in": "header", "description": desc, "schema": map[string]any{"type": "string"}}
+	}
+	idParam := map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "integer"}}
+	studentParam := map[string]any{"name": "student", "in": "path", "required": true, "schema": map[string]any{"type": "string"}}
+	value := func(desc string, schema map[string]any) map[string]any {
+		return map[string]any{"description": desc, "content": openAPIContent(schema, false)}
+	}
+	str := map[string]any{"type": "string"}
+	integer := map[string]any{"type": "integer", "minimum": 1}
+	etag := map[string]any{"ETag": map[string]any{"description": "Tag to send as If-Match", "schema": str}}
+	courseBody := map[string]any{"required": true, "content": openAPIContent(inputSchema, true)}
+	courseResponse := func(desc string) map[string]any {
+		return map[string]any{"description": desc, "headers": etag, "content": openAPIContent(resourceSchema, true)}
+	}
+	ifMatch := header("If-Match", "Only apply the change if the course still has this ETag")
+	bearer := []any{map[string]any{"bearerAuth": []any{}}, map[string]any{"apiKey": []any{}}}
+	unauthorized := text("Missing or invalid credentials, once JWTs or API keys are set up")
+
+	paths := map[string]any{
+		"/courses": map[string]any{
+			"get": map[string]any{
+				"summary":     "List public courses",
+				"operationId": "listCourses",
+				"parameters": []any{
+					query("page", "Page number; enables pagination with a Link header", integer),
+					query("per_page", "Page size (default 20)", integer),
+					query("currency", "Add _pricing in this ISO 4217 currency", str),
+					query("sort", "Comma-separated fields to sort by: id, name, price or meta.<key>; prefix - for descending", str),
+					map[string]any{"name": "meta", "in": "query", "style": "deepObject", "explode": true,
+						"description": "Exact-match filters on metadata, written meta.<key>=<value>",
+						"schema":      map[string]any{"type": "object", "additionalProperties": str}},
+				},
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The courses", "content": openAPIContent(map[string]any{"type": "array", "items": resourceSchema}, true)},
+					"400": text("Invalid query parameter"),
+				},
+			},
+			"post": map[string]any{
+				"summary":     "Create a course",
+				"operationId": "createCourse",
+				"security":    bearer,
+				"requestBody": courseBody,
+				"responses": map[string]any{
+					"201": courseResponse("The created course"),
+					"400": text("Invalid course"),
+					"401": unauthorized,
+					"403": text("Students and API keys without courses:write may not create courses; instructors only their own"),
+				},
+			},
+		},
+		"/courses/{id}": map[string]any{
+			"parameters": []any{idParam},
+			"get": map[string]any{
+				"summary":     "Get a course",
+				"operationId": "getCourse",
+				"parameters": []any{
+					query("currency", "Add _pricing in this ISO 4217 currency", str),
+					query("invite", "Invite code for a private course", str),
+					header(inviteCodeHeader, "Invite code for a private course"),
+					header(userEmailHeader, "Email of the viewer, for private course allowlists"),
+				},
+				"responses": map[string]any{
+					"200": courseResponse("The course"),
+					"400": text("Invalid course ID or currency"),
+					"404": text("No such course, or a private course the viewer may not see"),
+				},
+			},
+			"put": map[string]any{
+				"summary":     "Replace a course",
+				"operationId": "replaceCourse",
+				"security":    bearer,
+				"parameters":  []any{ifMatch},
+				"requestBody": courseBody,
+				"responses": map[string]any{
+					"200": courseResponse("The updated course"),
+					"400": text("Invalid course"),
+					"404": text("Course not found"),
+					"412": text("Course was modified by someone else"),
+					"401": unauthorized,
+					"403": text("Only admins, and instructors for their own courses, may edit"),
+				},
+			},
+			"patch": map[string]any{
+				"summary":     "Update some fields of a course",
+				"description": "Fields left out keep their value. A metadata key set to null is removed.",
+				"operationId": "updateCourse",
+				"security":    bearer,
+				"parameters":  []any{ifMatch},
+				"requestBody": courseBody,
+				"responses": map[string]any{
+					"200": courseResponse("The updated course"),
+					"400": text("Invalid course"),
+					"404": text("Course not found"),
+					"412": text("Course was modified by someone else"),
+					"401": unauthorized,
+					"403": text("Only admins, and instructors for their own courses, may edit"),
+				},
+			},
+			"delete": map[string]any{
+				"summary":     "Delete a course",
+				"operationId": "deleteCourse",
+				"security":    bearer,
+				"parameters":  []any{ifMatch},
+				"responses": map[string]any{
+					"204": map[string]any{"description": "Deleted"},
+					"400": text("Invalid course ID"),
+					"404": text("Course not found"),
+					"412": text("Course was modified by someone else"),
+					"401": unauthorized,
+					"403": text("Only admins may delete courses"),
+				},
+			},
+		},
+		"/courses/changes": map[string]any{
+			"get": map[string]any{
+				"summary":     "Courses changed since a sequence number",
+				"operationId": "listCourseChanges",
+				"parameters": []any{
+					query("since", "next_since from the previous call; 0 for everything", map[string]any{"type": "integer", "minimum": 0}),
+					query("invite", "Invite code for a private course", str),
+					header(inviteCodeHeader, "Invite code for a private course"),
+					header(userEmailHeader, "Email of the viewer, for private course allowlists"),
+				},
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The changes", "content": openAPIContent(changesSchema, false)},
+					"400": text("Invalid since"),
+				},
+			},
+		},
+		"/courses/compare": map[string]any{
+			"get": map[string]any{
+				"summary":     "Compare courses side by side",
+				"description": "duration_hours, level, rating and curriculum come from the metadata keys of those names. differences names the fields that are not the same for every course.",
+				"operationId": "compareCourses",
+				"parameters": []any{
+					query("ids", "2 to 10 comma-separated course IDs, in the order to show them", str),
+					query("currency", "Show prices in this ISO 4217 currency", str),
+					query("invite", "Invite code for a private course", str),
+					header(inviteCodeHeader, "Invite code for a private course"),
+					header(userEmailHeader, "Email of the viewer, for private course allowlists"),
+				},
+				"responses": map[string]any{
+					"200": value("The courses side by side", ref(courseComparison{})),
+					"400": text("Invalid ids or currency"),
+					"404": text("A course does not exist, or is private and the viewer may not see it"),
+				},
+			},
+		},
+		"/courses/sync": map[string]any{
+			"get": map[string]any{
+				"summary":     "Stream the whole catalog, resumably",
+				"description": "Frames of a 4-byte big-endian length and JSON: {type: course|checkpoint|end, course, cursor}.",
+				"operationId": "syncCourses",
+				"parameters": []any{
+					query("cursor", "cursor of the last checkpoint received, to resume after it", str),
+					query("checkpoint_every", "Courses between checkpoint frames (default 100)", integer),
+					query("invite", "Invite code for a private course", str),
+					header(inviteCodeHeader, "Invite code for a private course"),
+					header(userEmailHeader, "Email of the viewer, for private course allowlists"),
+				},
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The frames", "content": map[string]any{mediaTypeCourseSync: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}},
+					"400": text("Invalid cursor or checkpoint_every"),
+				},
+			},
+		},
+		"/courses/import": map[string]any{
+			"post": map[string]any{
+				"summary":     "Import many courses in the background",
+				"description": "A JSON array of courses, or CSV with a header row naming some of name, price, instructor, seats, access_days and private. Poll the import at its Location.",
+				"operationId": "importCourses",
+				"security":    bearer,
+				"requestBody": map[string]any{"required": true, "content": map[string]any{
+					mediaTypeJSON: map[string]any{"schema": map[string]any{"type": "array", "items": inputSchema}},
+					"text/csv":    map[string]any{"schema": str},
+				}},
+				"responses": map[string]any{
+					"202": value("The import, queued", ref(courseImport{})),
+					"400": text("The file is not a JSON array or valid CSV, or has no courses"),
+					"401": unauthorized,
+					"403": text("API keys without courses:write may not import"),
+					"413": text("The file is over the route's body limit"),
+					"503": text("Too many imports are waiting; see Retry-After"),
+				},
+			},
+		},
+		"/imports/{id}": map[string]any{
+			"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": str}},
+			"get": map[string]any{
+				"summary":     "Progress and row errors of an import",
+				"operationId": "getImport",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": value("The import", ref(courseImport{})),
+					"401": unauthorized,
+					"403": text("API keys without courses:write may not see imports"),
+					"404": text("No such import of the caller's"),
+				},
+			},
+			"delete": map[string]any{
+				"summary":     "Cancel an import; courses already created stay",
+				"operationId": "cancelImport",
+				"security":    bearer,
+				"responses": map[string]any{
+					"202": value("The import, cancelling", ref(courseImport{})),
+					"401": unauthorized,
+					"403": text("API keys without courses:write may not cancel imports"),
+					"404": text("No such import of the caller's"),
+					"409": text("The import has already finished"),
+				},
+			},
+		},
+		"/exports": map[string]any{
+			"post": map[string]any{
+				"summary":     "Export the catalog to a file in the background",
+				"description": "Takes the filters GET /courses takes. Poll the export at its Location, or register a webhook for the export event, then fetch its download_url.",
+				"operationId": "createExport",
+				"security":    bearer,
+				"parameters": []any{
+					query("format", "json (default) or csv; either is gzipped", str),
+					query("sort", "Comma-separated fields to sort by: id, name, price or meta.<key>; prefix - for descending", str),
+					map[string]any{"name": "meta", "in": "query", "style": "deepObject", "explode": true,
+						"description": "Exact-match filters on metadata, written meta.<key>=<value>",
+						"schema":      map[string]any{"type": "object", "additionalProperties": str}},
+				},
+				"responses": map[string]any{
+					"202": value("The export, queued", ref(courseExport{})),
+					"400": text("Invalid format or query parameter"),
+					"401": unauthorized,
+					"403": text("API keys without courses:write may not export"),
+					"503": text("Too many exports are waiting; see Retry-After"),
+				},
+			},
+		},
+		"/exports/{id}": map[string]any{
+			"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": str}},
+			"get": map[string]any{
+				"summary":     "Progress of an export, and a fresh download link once it is ready",
+				"operationId": "getExport",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": value("The export", ref(courseExport{})),
+					"401": unauthorized,
+					"403": text("API keys without courses:write may not see exports"),
+					"404": text("No such export of the caller's"),
+				},
+			},
+			"delete": map[string]any{
+				"summary":     "Cancel an export and delete its file",
+				"operationId": "deleteExport",
+				"security":    bearer,
+				"responses": map[string]any{
+					"204": map[string]any{"description": "Deleted"},
+					"401": unauthorized,
+					"403": text("API keys without courses:write may not delete exports"),
+					"404": text("No such export of the caller's"),
+				},
+			},
+		},
+		"/exports/{id}/download": map[string]any{
+			"parameters": []any{map[string]any{"name": "id", "in": "path", "required": true, "schema": str}},
+			"get": map[string]any{
+				"summary":     "Download an export's file with its signed link",
+				"description": "The link from download_url is the only credential needed. Range requests resume an interrupted download.",
+				"operationId": "downloadExport",
+				"parameters": []any{
+					query("expires", "From download_url", integer),
+					query("signature", "From download_url", str),
+				},
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The gzipped file", "content": map[string]any{"application/gzip": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}},
+					"206": map[string]any{"description": "The requested range of the file"},
+					"403": text("The link is invalid or has expired"),
+					"404": text("No such export, or its file has expired"),
+				},
+			},
+			"head": map[string]any{
+				"summary":     "Size and validators of an export's file, for a download manager",
+				"operationId": "headExport",
+				"parameters": []any{
+					query("expires", "From download_url", integer),
+					query("signature", "From download_url", str),
+				},
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The file's headers"},
+					"403": text("The link is invalid or has expired"),
+					"404": text("No such export, or its file has expired"),
+				},
+			},
+		},
+		"/courses/{id}/enrollments": map[string]any{
+			"parameters": []any{idParam},
+			"post": map[string]any{
+				"summary":     "Enroll a student",
+				"description": "The student gets a seat if one is free and is waitlisted otherwise. Students enroll themselves; admins and the course's owners may enroll anyone.",
+				"operationId": "enrollStudent",
+				"security":    bearer,
+				"parameters": []any{
+					query("invite", "Invite code for a private course", str),
+					header(inviteCodeHeader, "Invite code for a private course"),
+				},
+				"requestBody": map[string]any{"required": true, "content": openAPIContent(ref(struct {
+					Student    string `json:"student"`
+					InviteCode string `json:"invite_code,omitempty"`
+				}{}), false)},
+				"responses": map[string]any{
+					"201": value("The enrollment, enrolled or waitlisted", enrollmentSchema),
+					"400": text("Invalid course ID or missing student"),
+					"401": unauthorized,
+					"403": text("The course is private and the invite code is missing or wrong, or the caller may not enroll this student"),
+					"404": text("Course not found"),
+					"409": text("Student is already enrolled or waitlisted"),
+				},
+			},
+		},
+		"/courses/{id}/enrollments/{student}": map[string]any{
+			"parameters": []any{idParam, studentParam},
+			"delete": map[string]any{
+				"summary":     "Withdraw a student",
+				"description": "For the student, or the course's admins and owners. A freed seat goes to the first student on the waitlist.",
+				"operationId": "withdrawStudent",
+				"security":    bearer,
+				"responses": map[string]any{
+					"204": map[string]any{"description": "Withdrawn"},
+					"400": text("Invalid course ID"),
+					"401": unauthorized,
+					"403": text("The caller may not withdraw this student"),
+					"404": text("Enrollment not found"),
+				},
+			},
+		},
+		"/courses/{id}/enrollments/{student}/access": map[string]any{
+			"parameters": []any{idParam, studentParam},
+			"get": map[string]any{
+				"summary":     "Check whether a student may open the course now",
+				"description": "For the student, and the course's admins and owners.",
+				"operationId": "checkAccess",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": value("The student has access", ref(courseAccess{})),
+					"400": text("Invalid course ID"),
+					"401": unauthorized,
+					"403": text("Access expired, the student is waitlisted, or the caller may not check this student"),
+					"404": text("Enrollment not found"),
+				},
+			},
+		},
+		"/courses/{id}/enrollments/{student}/renew": map[string]any{
+			"parameters": []any{idParam, studentParam},
+			"post": map[string]any{
+				"summary":     "Renew a student's access for another window",
+				"description": "For admins and the course's owners.",
+				"operationId": "renewAccess",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": value("The renewed enrollment", enrollmentSchema),
+					"400": text("Invalid course ID"),
+					"401": unauthorized,
+					"403": text("The credentials lack courses:write, or the caller is neither an admin nor the course's owner"),
+					"404": text("Enrollment not found"),
+					"409": text("The enrollment is waitlisted or has lifetime access"),
+				},
+			},
+		},
+		"/courses/{id}/availability": map[string]any{
+			"parameters": []any{idParam},
+			"get": map[string]any{
+				"summary":     "Seats left in a course",
+				"operationId": "getAvailability",
+				"parameters": []any{
+					query("invite", "Invite code for a private course", str),
+					header(inviteCodeHeader, "Invite code for a private course"),
+					header(userEmailHeader, "Email of the viewer, for private course allowlists"),
+				},
+				"responses": map[string]any{
+					"200": value("Seat counts, cacheable for ttl_seconds unless the course is private", ref(availability{})),
+					"400": text("Invalid course ID"),
+					"404": text("Course not found, or private and not visible to the caller"),
+				},
+			},
+		},
+		"/students/{student}/enrollments": map[string]any{
+			"parameters": []any{studentParam},
+			"get": map[string]any{
+				"summary":     "A student's courses and how long access lasts",
+				"description": "For the student and admins.",
+				"operationId": "listStudentEnrollments",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": value("The student's enrollments", map[string]any{"type": "array", "items": ref(dashboardEntry{})}),
+					"401": unauthorized,
+					"403": text("The caller is neither the student nor an admin"),
+				},
+			},
+		},
+		"/students/{student}/notification-preferences": map[string]any{
+			"parameters": []any{studentParam},
+			"get": map[string]any{
+				"summary":     "How often a student is emailed",
+				"description": "For the student and admins.",
+				"operationId": "getNotificationPreferences",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": value("The student's preferences", ref(notificationPreferences{})),
+					"401": unauthorized,
+					"403": text("The caller is neither the student nor an admin"),
+				},
+			},
+			"put": map[string]any{
+				"summary":     "Choose between immediate emails and an hourly or daily digest",
+				"description": "For the student and admins.",
+				"operationId": "setNotificationPreferences",
+				"security":    bearer,
+				"requestBody": map[string]any{"required": true, "content": openAPIContent(ref(notificationPreferences{}), false)},
+				"responses": map[string]any{
+					"200": value("The new preferences", ref(notificationPreferences{})),
+					"400": text("digest is not immediate, hourly or daily"),
+					"401": unauthorized,
+					"403": text("The caller is neither the student nor an admin"),
+				},
+			},
+		},
+		"/me/security-events": map[string]any{
+			"get": map[string]any{
+				"summary":     "The caller's last sign-ins, failed sign-ins and refresh token reuses, with the alerts they raised",
+				"operationId": "listMySecurityEvents",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": value("The caller's security events, newest first", ref(securityEventList{})),
+					"401": text("Not signed in"),
+				},
+			},
+		},
+		"/.well-known/compact-json": map[string]any{
+			"get": map[string]any{
+				"summary":     "The field aliases of the compact JSON profile",
+				"operationId": "getCompactJSONProfile",
+				"responses": map[string]any{
+					"200": value("The profile's aliases", ref(compactProfileDoc{})),
+				},
+			},
+		},
+		"/me/features": map[string]any{
+			"get": map[string]any{
+				"summary":     "The feature gates switched on for the caller, and who the caller was taken to be",
+				"operationId": "listMyFeatures",
+				"responses": map[string]any{
+					"200": value("The caller's consumers and enabled gates", ref(myFeatures{})),
+				},
+			},
+		},
+		"/status": map[string]any{
+			"get": map[string]any{
+				"summary":     "Component health, uptime and incident notes",
+				"operationId": "getStatus",
+				"responses": map[string]any{
+					"200": map[string]any{"description": "The status page; browsers asking for text/html get it as HTML", "content": openAPIContent(ref(statusPage{}), false)},
+					"500": text("The HTML page could not be rendered"),
+				},
+			},
+		},
+		"/count": map[string]any{
+			"get": map[string]any{
+				"summary":     "Count calls to this endpoint",
+				"operationId": "count",
+				"responses":   map[string]any{"200": text("How many times the endpoint was called")},
+			},
+		},
+	}
+
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":   "Course API",
+			"version": "1.0.0",
+		},
+		"servers": []any{map[string]any{"url": "/"}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKey":     map[string]any{"type": "apiKey", "in": "header", "name": apiKeyHeader, "description": "Needs the " + scopeCoursesWrite + " scope for writes"},
+			},
+		},
+	}
+}
+
+// openAPIDocument is built once; nothing it is made from changes at run
+// time.
+var openAPIDocument = sync.OnceValue(func() []byte {
+	doc, err := json.MarshalIndent(buildOpenAPI(), "", "  ")
+	if err != nil {
+		log.Fatalf("Error building OpenAPI document: %v", err)
+	}
+	return doc
+})
+
+// openAPIHandler serves GET /openapi.json.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", mediaTypeJSON)
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(openAPIDocument())
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: เอกสาร OpenAPI 3 (`/openapi.json`)
+
+	1. อธิบาย endpoint ของ course (`/courses`, `/courses/{id}`, `/courses/changes`, `/courses/sync`), การลงทะเบียนเรียน (enrollments, access, renew, availability) และ `/count` ให้เครื่องมืออย่าง openapi-generator สร้าง SDK ได้
+	2. ส่วน schema สร้างจาก struct ของ Go ด้วย reflection (อ่าน json tag) เช่น `course`, `courseResource`
+	   - เพิ่ม field ใน struct แล้วเอกสารอัปเดตเอง ไม่ต้องจำไปแก้สองที่
+	   - field ที่ไม่มี `omitempty` ถือว่า required
+	3. รายชื่อ media type (JSON, XML, YAML, ...) มาจาก `codecs` ชุดเดียวกับที่ server ใช้จริง
+	4. ส่วน path / parameter / status code เขียนเองในโค้ด ถ้าเปลี่ยนพฤติกรรมของ handler ต้องแก้ที่นี่ด้วย
+*/
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With OPENAPI_VALIDATION set, requests to the operations in the OpenAPI
+// document are checked against it before they reach a handler: the path
+// and query parameters, required parameters, the request Content-Type and,
+// for JSON, the body against its schema. Unknown query parameters count
+// too. Each mismatch is logged, so handler and document drift shows up in
+// staging before clients hit it.
+//
+//	OPENAPI_VALIDATION=report  log mismatches and let the request through
+//	OPENAPI_VALIDATION=strict  also reject the request with 400
+//
+// OPENAPI_VALIDATION_SKIP lists operationIds, comma-separated, that are
+// not checked, for a route whose document is known to lag behind.
+// Requests to paths or methods the document does not describe are left
+// to the handlers.
+
+const (
+	validationOff    = "off"
+	validationReport = "report"
+	validationStrict = "strict"
+)
+
+var (
+	openAPIValidation     = validationOff
+	openAPIValidationSkip []string
+)
+
+func init() {
+	if s := os.Getenv("OPENAPI_VALIDATION"); s != "" {
+		if s != validationOff && s != validationReport && s != validationStrict {
+			log.Fatalf("Invalid OPENAPI_VALIDATION %q: use off, report or strict", s)
+		}
+		openAPIValidation = s
+	}
+	for _, id := range strings.Split(os.Getenv("OPENAPI_VALIDATION_SKIP"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			openAPIValidationSkip = append(openAPIValidationSkip, id)
+		}
+	}
+}
+
+type requestValidator struct {
+	paths      map[string]any
+	components map[string]any
+	skip       map[string]bool
+}
+
+// newRequestValidator reads the served OpenAPI document back, so it
+// checks what clients are told.
+func newRequestValidator() (*requestValidator, error) {
+	var doc struct {
+		Paths      map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]any `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPIDocument(), &doc); err != nil {
+		return nil, err
+	}
+	v := &requestValidator{paths: doc.Paths, components: doc.Components.Schemas, skip: map[string]bool{}}
+	known := map[string]bool{}
+	for _, item := range doc.Paths {
+		for _, op := range item.(map[string]any) {
+			if op, ok := op.(map[string]any); ok {
+				if id, ok := op["operationId"].(string); ok {
+					known[id] = true
+				}
+			}
+		}
+	}
+	for _, id := range openAPIValidationSkip {
+		if !known[id] {
+			return nil, fmt.Errorf("OPENAPI_VALIDATION_SKIP: no operation %q", id)
+		}
+		v.skip[id] = true
+	}
+	return v, nil
+}
+
+// route returns the path item whose template matches path, and its path
+// parameters. A literal segment wins over a parameter, so /courses/changes
+// is not /courses/{id}.
+func (v *requestValidator) route(path string) (map[string]any, map[string]string) {
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	var best map[string]any
+	var bestParams map[string]string
+	for tmpl, item := range v.paths {
+		tsegs := strings.Split(strings.Trim(tmpl, "/"), "/")
+		if len(tsegs) != len(segs) {
+			continue
+		}
+		params := map[string]string{}
+		for i, t := range tsegs {
+			if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+				params[t[1:len(t)-1]] = segs[i]
+			} else if t != segs[i] {
+				params = nil
+				break
+			}
+		}
+		if params != nil && (best == nil || len(params) < len(bestParams)) {
+			best, bestParams = item.(map[string]any), params
+		}
+	}
+	return best, bestParams
+}
+
+// check returns the operationId of r's operation, or "" if the document
+// has none, and how r departs from it.
+func (v *requestValidator) check(r *http.Request, body []byte) (string, []string) {
+	item, pathParams := v.route(r.URL.Path)
+	if item == nil {
+		return "", nil
+	}
+	method := strings.ToLower(r.Method)
+	if method == "head" {
+		method = "get"
+	}
+	op, ok := item[method].(map[string]any)
+	if !ok {
+		return "", nil
+	}
+	id, _ := op["operationId"].(string)
+	if v.skip[id] {
+		return "", nil
+	}
+
+	var problems []string
+	params := map[string]map[string]any{} // by in + name; the operation's override the path's
+	for _, list := range []any{item["parameters"], op["parameters"]} {
+		list, _ := list.([]any)
+		for _, p := range list {
+			p := p.(map[string]any)
+			params[p["in"].(string)+" "+p["name"].(string)] = p
+		}
+	}
+	query := r.URL.Query()
+	for key, p := range params {
+		in, name, _ := strings.Cut(key, " ")
+		schema, _ := p["schema"].(map[string]any)
+		var value string
+		var present bool
+		switch in {
+		case "path":
+			value, present = pathParams[name]
+		case "query":
+			if p["style"] == "deepObject" {
+				for k := range query {
+					if strings.HasPrefix(k, name+".") || strings.HasPrefix(k, name+"[") {
+						present = true
+					}
+				}
+				continue
+			}
+			if vs, ok := query[name]; ok {
+				value, present = vs[0], true
+			}
+		case "header":
+			value = r.Header.Get(name)
+			present = value != ""
+		default:
+			continue
+		}
+		if !present {
+			if p["required"] == true {
+				problems = append(problems, fmt.Sprintf("%s parameter %s is required", in, name))
+			}
+			continue
+		}
+		if msg := checkParam(value, schema); msg != "" {
+			problems = append(problems, fmt.Sprintf("%s parameter %s: %s", in, name, msg))
+		}
+	}
+	for k := range query {
+		if _, ok := params["query "+k]; ok {
+			continue
+		}
+		deep := false
+		if name, _, ok := strings.Cut(strings.ReplaceAll(k, "[", "."), "."); ok {
+			p, found := params["query "+name]
+			deep = found && p["style"] == "deepObject"
+		}
+		if !deep {
+			problems = append(problems, fmt.Sprintf("unknown query parameter %s", k))
+		}
+	}
+
+	rb, _ := op["requestBody"].(map[string]any)
+	switch {
+	case rb == nil:
+		if len(body) > 0 {
+			problems = append(problems, "the operation takes no request body")
+		}
+	case len(body) == 0:
+		if rb["required"] == true {
+			problems = append(problems, "request body is required")
+		}
+	default:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "" {
+			mediaType = mediaTypeJSON // what decodeBody assumes
+		}
+		content, _ := rb["content"].(map[string]any)
+		media, ok := content[mediaType].(map[string]any)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("request body type %s is not one of those documented", mediaType))
+			break
+		}
+		if mediaType != mediaTypeJSON {
+			break // other formats map to the same types, so JSON covers them
+		}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var value any
+		if err := dec.Decode(&value); err != nil {
+			problems = append(problems, "request body is not valid JSON")
+			break
+		}
+		schema, _ := media["schema"].(map[string]any)
+		v.checkValue(value, schema, "body", &problems)
+	}
+	return id, problems
+}
+
+// checkParam checks a parameter's string value against its schema.
+func checkParam(value string, schema map[string]any) string {
+	var n float64
+	switch schema["type"] {
+	case "integer":
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "expected an integer"
+		}
+		n = float64(i)
+	case "number":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "expected a number"
+		}
+		n = f
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "expected true or false"
+		}
+		return ""
+	default:
+		return ""
+	}
+	if min, ok := schema["minimum"].(float64); ok && n < min {
+		return fmt.Sprintf("must be at least %v", min)
+	}
+	return ""
+}
+
+// checkValue checks a decoded JSON value against schema, the subset of
+// JSON Schema that buildOpenAPI writes, and adds what does not match to
+// problems.
+func (v *requestValidator) checkValue(value any, schema map[string]any, at string, problems *[]string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		schema, _ = v.components[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]any)
+	}
+	typ, _ := schema["type"].(string)
+	if typ == "" || value == nil && schema["nullable"] == true {
+		return
+	}
+	mismatch := func(want string) {
+		*problems = append(*problems, fmt.Sprintf("%s: expected %s", at, want))
+	}
+	switch typ {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			mismatch("an object")
+			return
+		}
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				*problems = append(*problems, fmt.Sprintf("%s.%s is required", at, name))
+			}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		extra, _ := schema["additionalProperties"].(map[string]any)
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			if p, ok := props[k].(map[string]any); ok {
+				v.checkValue(obj[k], p, at+"."+k, problems)
+			} else if extra != nil {
+				v.checkValue(obj[k], extra, at+"."+k, problems)
+			}
+		}
+	case "array":
+		list, ok := value.([]any)
+		if !ok {
+			mismatch("an array")
+			return
+		}
+		items, _ := schema["items"].(map[string]any)
+		for i, item := range list {
+			v.checkValue(item, items, fmt.Sprintf("%s[%d]", at, i), problems)
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			mismatch("a string")
+		} else if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				mismatch("an RFC 3339 date-time")
+			}
+		}
+	case "integer":
+		if n, ok := value.(json.Number); !ok {
+			mismatch("an integer")
+		} else if _, err := n.Int64(); err != nil {
+			mismatch("an integer")
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			mismatch("a number")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			mismatch("a boolean")
+		}
+	}
+}
+
+// handler checks each request against the document before next sees it.
+func (v *requestValidator) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Body != nil {
+			var err error
+			if body, err = io.ReadAll(r.Body); err != nil {
+				writeBodyError(w, r, err)
+				return
+			}
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		id, problems := v.check(r, body)
+		if len(problems) > 0 {
+			requestLogger(r).Warn("Request does not match the OpenAPI document", "method", r.Method, "path", r.URL.Path, "operation", id, "problems", problems)
+			if openAPIValidation == validationStrict {
+				writeError(w, r, "Request does not match the API description: "+strings.Join(problems, "; "), http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ตรวจ request ที่เข้ามากับเอกสาร OpenAPI ตอนรันจริง จับจุดที่ handler กับเอกสารไม่ตรงกันก่อนถึงมือ client
+
+	1. เปิดด้วย `OPENAPI_VALIDATION`
+	   - `report`: log สิ่งที่ไม่ตรงแล้วปล่อย request ผ่าน
+	   - `strict` (สำหรับ staging): log แล้วตอบ 400 พร้อมรายการปัญหา
+	2. สิ่งที่ตรวจ: parameter ใน path/query (ชนิด, ค่าต่ำสุด, ที่ required), query ที่เอกสารไม่รู้จัก, `Content-Type` ของ body และ body แบบ JSON เทียบกับ schema
+	   - ใช้เอกสารตัวเดียวกับที่ `/openapi.json` ส่งให้ client จึงตรวจตามสิ่งที่บอก client ไว้จริง
+	3. ปิดการตรวจเป็นราย route ด้วย `OPENAPI_VALIDATION_SKIP=updateCourse,count` (ใส่ operationId; ชื่อที่ไม่มีจริงทำให้ server ไม่ start)
+	4. path หรือ method ที่เอกสารไม่ได้อธิบาย ปล่อยให้ handler จัดการตามปกติ
+*/
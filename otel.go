@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// With an OTLP endpoint configured the server records OpenTelemetry spans
+// and exports them to a collector over OTLP/HTTP (JSON encoding), so it
+// shows up in distributed traces next to its callers and the services it
+// calls. It records:
+//
+//   - a server span for every HTTP and gRPC request, named after its route,
+//     the child of the caller's span when the request has a traceparent;
+//   - a span for every write through the course service (createCourse,
+//     updateCourse, deleteCourse), as the child of the request that made
+//     it. Reads go straight to the store and get no span of their own.
+//
+// The endpoint is the standard OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or
+// OTEL_EXPORTER_OTLP_ENDPOINT with /v1/traces added. OTEL_EXPORTER_OTLP_HEADERS
+// (key=value pairs, comma-separated) is sent with every export, for a
+// collector that wants an API key, and OTEL_SERVICE_NAME names the service.
+// Sampling is parent-based: a request joining a trace is recorded if its
+// caller sampled it, and a trace started here is sampled with the
+// probability OTEL_TRACES_SAMPLER_ARG (default 1).
+//
+// Spans are queued and sent in batches by one goroutine; when the
+// collector cannot keep up, spans beyond maxQueuedSpans are dropped and
+// counted rather than slowing requests down.
+
+const (
+	maxQueuedSpans     = 2048
+	otlpBatchSize      = 512
+	otlpExportInterval = 5 * time.Second
+	otlpScopeName      = "go-first-web-server"
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	spanStatusError = 2
+)
+
+var (
+	otlpTracesURL    string // "" when spans are not exported
+	otlpHeaders      = http.Header{}
+	otelServiceName  = "go-first-web-server"
+	otelSampleRatio  = 1.0
+	spanQueue        chan otlpSpan
+	droppedSpans     atomic.Int64
+	otlpExportClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+func init() {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint == "" && base != "" {
+		endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+	}
+	if endpoint == "" {
+		return
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Fatalf("Invalid OTLP endpoint %q: must be an http or https URL", endpoint)
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			value, err := url.QueryUnescape(strings.TrimSpace(value))
+			if !ok || strings.TrimSpace(key) == "" || err != nil {
+				log.Fatalf("Invalid OTEL_EXPORTER_OTLP_HEADERS: %q is not key=value", pair)
+			}
+			otlpHeaders.Add(strings.TrimSpace(key), value)
+		}
+	}
+	if v := os.Getenv("OTEL_SERVICE_NAME"); v != "" {
+		otelServiceName = v
+	}
+	if v := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f > 1 {
+			log.Fatalf("Invalid OTEL_TRACES_SAMPLER_ARG %q: must be a probability from 0 to 1", v)
+		}
+		otelSampleRatio = f
+	}
+	otlpTracesURL = endpoint
+	spanQueue = make(chan otlpSpan, maxQueuedSpans)
+}
+
+// sampleNewTrace decides whether a trace started here is recorded.
+func sampleNewTrace() bool {
+	return otlpTracesURL != "" && rand.Float64() < otelSampleRatio
+}
+
+// span is a span being recorded; nil when its trace is not, so callers
+// need not check.
+type span struct {
+	otlpSpan
+	start time.Time
+}
+
+// startSpan starts an internal span as a child of parent's span.
+func startSpan(parent traceContext, name string) *span {
+	if !parent.sampled() {
+		return nil
+	}
+	return &span{
+		otlpSpan: otlpSpan{TraceID: parent.TraceID, SpanID: randomHex(8), ParentSpanID: parent.SpanID, Name: name, Kind: spanKindInternal},
+		start:    time.Now(),
+	}
+}
+
+// set adds an attribute: a string, an int or a bool.
+func (s *span) set(key string, v any) {
+	if s == nil {
+		return
+	}
+	var value otlpValue
+	switch v := v.(type) {
+	case string:
+		value.StringValue = &v
+	case int:
+		n := strconv.Itoa(v)
+		value.IntValue = &n
+	case bool:
+		value.BoolValue = &v
+	}
+	s.Attributes = append(s.Attributes, otlpKeyValue{Key: key, Value: value})
+}
+
+// end finishes s, failed if *err is not nil, and queues it for export. It
+// takes a pointer so it can be deferred before the error is known.
+func (s *span) end(err *error) {
+	if s == nil {
+		return
+	}
+	if err != nil && *err != nil {
+		s.Status = &otlpStatus{Code: spanStatusError, Message: (*err).Error()}
+	}
+	s.StartTimeUnixNano = strconv.FormatInt(s.start.UnixNano(), 10)
+	s.EndTimeUnixNano = strconv.FormatInt(time.Now().UnixNano(), 10)
+	select {
+	case spanQueue <- s.otlpSpan:
+	default:
+		droppedSpans.Add(1)
+	}
+}
+
+// startServerSpan starts the span of a request this server answers under
+// tc, whose span ID is the request's own.
+func startServerSpan(tc traceContext, start time.Time) *span {
+	if !tc.sampled() {
+		return nil
+	}
+	return &span{
+		otlpSpan: otlpSpan{TraceID: tc.TraceID, SpanID: tc.SpanID, ParentSpanID: tc.Parent, Kind: spanKindServer},
+		start:    start,
+	}
+}
+
+// recordRequestSpan records the server span of r, a request for route
+// answered with status. Server errors fail the span; client errors do not.
+// Health checks and the server's own warm-up and probe requests are only
+// recorded as part of a caller's trace.
+func recordRequestSpan(r *http.Request, route string, status int, start time.Time) {
+	tc := requestTrace(r)
+	if tc.Parent == "" && isHealthCheck(r) {
+		return
+	}
+	s := startServerSpan(tc, start)
+	if s == nil {
+		return
+	}
+	s.Name = r.Method
+	if route := routePath(route); route != "" {
+		s.Name += " " + route
+		s.set("http.route", route)
+	}
+	s.set("http.request.method", r.Method)
+	s.set("url.path", r.URL.Path)
+	s.set("http.response.status_code", status)
+	s.set("network.protocol.version", strings.TrimPrefix(r.Proto, "HTTP/"))
+	if addr := clientIP(r); addr.IsValid() {
+		s.set("client.address", addr.String())
+	}
+	if ua := r.UserAgent(); ua != "" {
+		s.set("user_agent.original", ua)
+	}
+	s.set("http.request.id", requestID(r))
+	var err error
+	if status >= 500 {
+		err = errors.New(http.StatusText(status))
+	}
+	s.end(&err)
+}
+
+// recordGRPCSpan records the server span of the gRPC call r, which
+// failed with err if it is not nil.
+func recordGRPCSpan(r *http.Request, err error, start time.Time) {
+	s := startServerSpan(requestTrace(r), start)
+	if s == nil {
+		return
+	}
+	service, method, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	s.Name = service + "/" + method
+	s.set("rpc.system", "grpc")
+	s.set("rpc.service", service)
+	s.set("rpc.method", method)
+	code := grpcOK
+	var ge *grpcError
+	switch {
+	case errors.As(err, &ge):
+		code = ge.code
+	case err != nil:
+		code = grpcInternal
+	}
+	s.set("rpc.grpc.status_code", code)
+	if addr := clientIP(r); addr.IsValid() {
+		s.set("client.address", addr.String())
+	}
+	// As with HTTP, only the server's own failures fail the span.
+	if code != grpcInternal && code != grpcUnimplemented {
+		err = nil
+	}
+	s.end(&err)
+}
+
+// routePath is the path of a ServeMux pattern, which may start with a
+// method and a host.
+func routePath(pattern string) string {
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		pattern = path
+	}
+	if i := strings.Index(pattern, "/"); i > 0 {
+		pattern = pattern[i:]
+	}
+	return pattern
+}
+
+// runSpanExporter sends queued spans to the collector, a batch at a time.
+func runSpanExporter() {
+	ticker := time.NewTicker(otlpExportInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case s := <-spanQueue:
+			if batch = append(batch, s); len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if n := droppedSpans.Swap(0); n > 0 {
+				slog.Warn("Dropped spans; the collector is not keeping up", "spans", n)
+			}
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := exportSpans(batch); err != nil {
+			slog.Warn("Exporting spans failed", "spans", len(batch), "url", otlpTracesURL, "err", err)
+		}
+		batch = nil
+	}
+}
+
+func exportSpans(spans []otlpSpan) error {
+	service := otelServiceName
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpValue{StringValue: &service}}}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: otlpScopeName, Version: release},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, otlpTracesURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range otlpHeaders {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", mediaTypeJSON)
+	resp, err := otlpExportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector answered " + resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of ExportTraceServiceRequest. IDs are hex, and
+// 64-bit integers strings, as the encoding requires.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+/*
+	summary
+
+	หัวใจสำคัญ: บันทึก span แบบ OpenTelemetry แล้วส่งออกทาง OTLP/HTTP (JSON) ไปยัง collector โดยไม่ต้องพึ่ง SDK ภายนอก
+
+	1. ตั้ง `OTEL_EXPORTER_OTLP_ENDPOINT` (ต่อท้าย `/v1/traces` ให้) หรือ `OTEL_EXPORTER_OTLP_TRACES_ENDPOINT` (URL เต็ม) เพื่อเปิด
+	   - `OTEL_EXPORTER_OTLP_HEADERS` = header ที่ส่งไปด้วย เช่น API key, `OTEL_SERVICE_NAME` = ชื่อ service
+	2. span ที่บันทึก
+	   - server span ของทุก request HTTP และ gRPC ชื่อตาม route เป็นลูกของ span ผู้เรียกถ้ามี `traceparent`
+	   - span ของการเขียนผ่าน course service (create / update / delete) เป็นลูกของ request ส่วนการอ่านไม่มี span แยก
+	3. sampling แบบ parent-based: trace ที่ผู้เรียก sample ไว้ก็บันทึก trace ใหม่ใช้ความน่าจะเป็น `OTEL_TRACES_SAMPLER_ARG` (ค่าเริ่มต้น 1)
+	4. ส่งเป็น batch จาก goroutine เดียว คิวเต็มก็ทิ้ง span และนับไว้ ไม่ให้ request ช้าลง
+*/
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Orders are recorded by the payment integration (or an admin) through
+// /admin/orders; payouts are derived from them per instructor and month.
+
+const (
+	payoutPending  = "pending"
+	payoutApproved = "approved"
+	payoutPaid     = "paid"
+
+	// periodLayout is the payout period format, one calendar month in UTC.
+	periodLayout = "2006-01"
+)
+
+type order struct {
+	ID         int    `json:"id"`
+	CourseID   int    `json:"course_id"`
+	Instructor string `json:"instructor"`
+	// Student is who paid, if known; they get a receipt (emails.go).
+	Student    string     `json:"student,omitempty"`
+	Amount     int        `json:"amount"`
+	Currency   string     `json:"currency"`
+	PaidAt     time.Time  `json:"paid_at"`
+	RefundedAt *time.Time `json:"refunded_at,omitempty"`
+}
+
+// payout is the computed balance of one instructor for one period.
+type payout struct {
+	Instructor   string `json:"instructor"`
+	Period       string `json:"period"`
+	Gross        int    `json:"gross"`
+	Refunds      int    `json:"refunds"`
+	Net          int    `json:"net"`
+	SharePercent int    `json:"share_percent"`
+	// Clawback is withheld to make up for earlier periods that came out
+	// negative or were paid more than they finally earned.
+	Clawback   int        `json:"clawback"`
+	Payable    int        `json:"payable"`
+	Currency   string     `json:"currency"`
+	Status     string     `json:"status"`
+	ApprovedAt *time.Time `json:"approved_at,omitempty"`
+	PaidAt     *time.Time `json:"paid_at,omitempty"`
+}
+
+type payoutKey struct {
+	instructor string
+	period     string
+}
+
+// payoutState is what admins decided about a payout. Gross, refunds and net
+// are always recomputed from the orders.
+type payoutState struct {
+	status     string
+	approvedAt *time.Time
+	paidAt     *time.Time
+	// payable is frozen at approval so a late refund cannot silently change
+	// an amount someone already signed off.
+	payable int
+}
+
+var (
+	payoutMu     sync.Mutex
+	orders       []order
+	nextOrderID  = 1
+	payoutStates = make(map[payoutKey]*payoutState)
+	// revenueShares overrides defaultRevenueShare per instructor.
+	revenueShares       = make(map[string]int)
+	defaultRevenueShare = 70
+)
+
+func init() {
+	if v := os.Getenv("INSTRUCTOR_REVENUE_SHARE"); v != "" {
+		share, err := strconv.Atoi(v)
+		if err != nil || share < 0 || share > 100 {
+			log.Fatalf("Invalid INSTRUCTOR_REVENUE_SHARE %q: must be a percentage between 0 and 100", v)
+		}
+		defaultRevenueShare = share
+	}
+}
+
+func revenueShareFor(instructor string) int {
+	if share, ok := revenueShares[instructor]; ok {
+		return share
+	}
+	return defaultRevenueShare
+}
+
+func periodOf(t time.Time) string { return t.UTC().Format(periodLayout) }
+
+// computePayout sums paid orders minus refunds made in the period. A refund
+// counts in the period it happened, not the period of the original order,
+// so a period can come out negative; what it owes is clawed back from the
+// periods after it. Callers must hold payoutMu.
+func computePayout(instructor, period string) payout {
+	first := period
+	for _, o := range orders {
+		if o.Instructor == instructor && periodOf(o.PaidAt) < first {
+			first = periodOf(o.PaidAt)
+		}
+	}
+	owed := 0
+	end, _ := time.Parse(periodLayout, period)
+	for t, _ := time.Parse(periodLayout, first); t.Before(end); t = t.AddDate(0, 1, 0) {
+		_, owed = periodPayout(instructor, periodOf(t), owed)
+	}
+	p, _ := periodPayout(instructor, period, owed)
+	return p
+}
+
+// periodPayout is computePayout for one period, given the clawback owed by
+// the periods before it. It also returns what is still owed after it.
+func periodPayout(instructor, period string, clawback int) (payout, int) {
+	p := payout{Instructor: instructor, Period: period, Currency: defaultCurrency, Status: payoutPending, Clawback: clawback}
+	for _, o := range orders {
+		if o.Instructor != instructor {
+			continue
+		}
+		if periodOf(o.PaidAt) == period {
+			p.Gross += o.Amount
+		}
+		if o.RefundedAt != nil && periodOf(*o.RefundedAt) == period {
+			p.Refunds += o.Amount
+		}
+	}
+	p.Net = p.Gross - p.Refunds
+	p.SharePercent = revenueShareFor(instructor)
+	earned := p.Net*p.SharePercent/100 - clawback
+	p.Payable = max(earned, 0)
+	if st := payoutStates[payoutKey{instructor, period}]; st != nil {
+		p.Status, p.ApprovedAt, p.PaidAt, p.Payable = st.status, st.approvedAt, st.paidAt, st.payable
+	}
+	return p, max(p.Payable-earned, 0)
+}
+
+// adminOrdersHandler serves GET and POST /admin/orders. A new order defaults
+// to the course's current price and is attributed to its current instructor.
+func adminOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		payoutMu.Lock()
+		list := slices.Clone(orders)
+		payoutMu.Unlock()
+		writeValue(w, r, http.StatusOK, list)
+
+	case http.MethodPost:
+		var req struct {
+			CourseID int        `json:"course_id"`
+			Student  string     `json:"student"`
+			Amount   *int       `json:"amount"`
+			PaidAt   *time.Time `json:"paid_at"`
+		}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		courseMu.RLock()
+		i := findCourseIndex(req.CourseID)
+		var c course
+		if i >= 0 {
+			c = CourseList[i]
+		}
+		courseMu.RUnlock()
+		if i < 0 {
+			writeError(w, r, "Course not found", http.StatusNotFound)
+			return
+		}
+		o := order{CourseID: c.CourseId, Instructor: c.Instructor, Student: strings.TrimSpace(req.Student), Amount: c.CoursePrice, Currency: defaultCurrency, PaidAt: time.Now().UTC()}
+		if req.Amount != nil {
+			if *req.Amount < 0 {
+				writeError(w, r, "amount must not be negative", http.StatusBadRequest)
+				return
+			}
+			o.Amount = *req.Amount
+		}
+		if req.PaidAt != nil {
+			o.PaidAt = req.PaidAt.UTC()
+		}
+
+		payoutMu.Lock()
+		o.ID = nextOrderID
+		nextOrderID++
+		orders = append(orders, o)
+		payoutMu.Unlock()
+		if o.Student != "" {
+			queueEmail(c.Tenant, emailReceipt, o.Student, map[string]any{
+				"Student":    o.Student,
+				"OrderID":    o.ID,
+				"CourseID":   o.CourseID,
+				"CourseName": c.CourseName,
+				"Amount":     o.Amount,
+				"Currency":   o.Currency,
+				"PaidAt":     o.PaidAt,
+			})
+		}
+		writeValue(w, r, http.StatusCreated, o)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminOrderRefundHandler serves POST /admin/orders/{id}/refund.
+func adminOrderRefundHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	payoutMu.Lock()
+	defer payoutMu.Unlock()
+	i := slices.IndexFunc(orders, func(o order) bool { return o.ID == id })
+	if i < 0 {
+		writeError(w, r, "Order not found", http.StatusNotFound)
+		return
+	}
+	if orders[i].RefundedAt != nil {
+		writeError(w, r, "Order is already refunded", http.StatusConflict)
+		return
+	}
+	now := time.Now().UTC()
+	orders[i].RefundedAt = &now
+	writeValue(w, r, http.StatusOK, orders[i])
+}
+
+// adminRevenueShareHandler serves PUT /admin/instructors/{instructor}/revenue-share.
+func adminRevenueShareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Percent int `json:"percent"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	if req.Percent < 0 || req.Percent > 100 {
+		writeError(w, r, "percent must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	instructor := r.PathValue("instructor")
+	payoutMu.Lock()
+	revenueShares[instructor] = req.Percent
+	payoutMu.Unlock()
+	writeValue(w, r, http.StatusOK, map[string]any{"instructor": instructor, "percent": req.Percent})
+}
+
+// adminPayoutsHandler serves GET /admin/payouts?period=YYYY-MM, one payout
+// per instructor with activity in the period. It defaults to the current month.
+func adminPayoutsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = periodOf(time.Now())
+	}
+	if _, err := time.Parse(periodLayout, period); err != nil {
+		writeError(w, r, "period must look like 2006-01", http.StatusBadRequest)
+		return
+	}
+
+	payoutMu.Lock()
+	instructors := map[string]bool{}
+	for _, o := range orders {
+		if periodOf(o.PaidAt) == period || (o.RefundedAt != nil && periodOf(*o.RefundedAt) == period) {
+			instructors[o.Instructor] = true
+		}
+	}
+	payouts := []payout{}
+	for instructor := range instructors {
+		payouts = append(payouts, computePayout(instructor, period))
+	}
+	payoutMu.Unlock()
+
+	slices.SortFunc(payouts, func(a, b payout) int { return strings.Compare(a.Instructor, b.Instructor) })
+	writeValue(w, r, http.StatusOK, payouts)
+}
+
+// adminPayoutActionHandler serves POST /admin/payouts/{instructor}/{period}/{action}
+// where action is "approve" or "mark-paid". Payouts move strictly from
+// pending to approved to paid.
+func adminPayoutActionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := payoutKey{r.PathValue("instructor"), r.PathValue("period")}
+	if _, err := time.Parse(periodLayout, key.period); err != nil {
+		writeError(w, r, "period must look like 2006-01", http.StatusBadRequest)
+		return
+	}
+
+	payoutMu.Lock()
+	defer payoutMu.Unlock()
+	current := computePayout(key.instructor, key.period)
+	now := time.Now().UTC()
+	switch r.PathValue("action") {
+	case "approve":
+		if current.Status != payoutPending {
+			writeError(w, r, "Only pending payouts can be approved", http.StatusConflict)
+			return
+		}
+		payoutStates[key] = &payoutState{status: payoutApproved, approvedAt: &now, payable: current.Payable}
+	case "mark-paid":
+		st := payoutStates[key]
+		if st == nil || st.status != payoutApproved {
+			writeError(w, r, "Only approved payouts can be marked as paid", http.StatusConflict)
+			return
+		}
+		st.status, st.paidAt = payoutPaid, &now
+	default:
+		writeError(w, r, "Unknown payout action", http.StatusNotFound)
+		return
+	}
+	writeValue(w, r, http.StatusOK, computePayout(key.instructor, key.period))
+}
+
+// adminPayoutStatementHandler serves GET
+// /admin/payouts/{instructor}/{period}/statement as a CSV download listing
+// every order and refund that makes up the payout.
+func adminPayoutStatementHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instructor, period := r.PathValue("instructor"), r.PathValue("period")
+	if _, err := time.Parse(periodLayout, period); err != nil {
+		writeError(w, r, "period must look like 2006-01", http.StatusBadRequest)
+		return
+	}
+
+	payoutMu.Lock()
+	p := computePayout(instructor, period)
+	var rows [][]string
+	for _, o := range orders {
+		if o.Instructor != instructor {
+			continue
+		}
+		if periodOf(o.PaidAt) == period {
+			rows = append(rows, []string{o.PaidAt.Format(time.RFC3339), "sale", strconv.Itoa(o.ID), strconv.Itoa(o.CourseID), strconv.Itoa(o.Amount)})
+		}
+		if o.RefundedAt != nil && periodOf(*o.RefundedAt) == period {
+			rows = append(rows, []string{o.RefundedAt.Format(time.RFC3339), "refund", strconv.Itoa(o.ID), strconv.Itoa(o.CourseID), strconv.Itoa(-o.Amount)})
+		}
+	}
+	payoutMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": fmt.Sprintf("statement-%s-%s.csv", instructor, period),
+	}))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "type", "order_id", "course_id", "amount"})
+	cw.WriteAll(rows)
+	cw.Write([]string{})
+	cw.Write([]string{"gross", strconv.Itoa(p.Gross)})
+	cw.Write([]string{"refunds", strconv.Itoa(p.Refunds)})
+	cw.Write([]string{"net", strconv.Itoa(p.Net)})
+	cw.Write([]string{"share_percent", strconv.Itoa(p.SharePercent)})
+	cw.Write([]string{"clawback", strconv.Itoa(p.Clawback)})
+	cw.Write([]string{"payable", strconv.Itoa(p.Payable)})
+	cw.Write([]string{"status", p.Status})
+	cw.Flush()
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: การคำนวณส่วนแบ่งรายได้ของผู้สอน (Instructor Payouts)
+
+	1. ทุก order ถูกบันทึกพร้อมชื่อผู้สอน ณ เวลาที่ขาย (snapshot) ถ้าภายหลังเปลี่ยนผู้สอนของ course รายได้เก่าก็ยังเป็นของคนเดิม
+	2. ยอดที่ต้องจ่าย = (ยอดขายในเดือนนั้น - ยอด refund ที่เกิดในเดือนนั้น) x เปอร์เซ็นต์ส่วนแบ่ง
+	   - ค่าเริ่มต้นจาก `INSTRUCTOR_REVENUE_SHARE` (70%) และกำหนดรายคนได้ที่ `PUT /admin/instructors/{instructor}/revenue-share`
+	   - ถ้าเดือนไหนติดลบ (refund มากกว่ายอดขาย) หรือจ่ายไปมากกว่าที่ได้จริงเพราะ refund มาหลัง approve ส่วนที่เกินจะถูกหักจากเดือนถัดไปเป็น `clawback` ไม่ปัดทิ้งเป็นศูนย์
+	3. สถานะ payout: pending → approved → paid เมื่อ approve แล้วยอดจะถูกล็อกไว้ refund ที่มาทีหลังจะไม่เปลี่ยนยอดที่อนุมัติไปแล้ว
+	4. `GET /admin/payouts/{instructor}/{period}/statement` ส่งออก statement เป็นไฟล์ CSV
+*/
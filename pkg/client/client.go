@@ -0,0 +1,234 @@
+// Package client is a Go client for the course API. It wraps the REST
+// endpoints in typed methods, retries requests that are safe to retry and
+// reports failures as *APIError.
+//
+//	c := client.New("http://localhost:8080")
+//	courses, err := c.ListCourses(ctx, nil)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one server. Its fields may be changed before the first
+// call and must not be changed after.
+type Client struct {
+	// BaseURL is the server's root, e.g. "http://localhost:8080".
+	BaseURL string
+	// HTTPClient sends the requests; http.DefaultClient if nil.
+	HTTPClient *http.Client
+	// MaxRetries is how many times a failed request is sent again.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry; it doubles on each
+	// one after.
+	RetryBackoff time.Duration
+	// UserAgent is sent with every request when set.
+	UserAgent string
+	// Token is sent as a bearer token when set. Servers with JWTs
+	// configured need one for creating, changing and deleting courses.
+	Token string
+	// APIKey is sent as X-API-Key when set, as an alternative to Token.
+	APIKey string
+}
+
+// New returns a client for the server at baseURL with three retries.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimRight(baseURL, "/"),
+		MaxRetries:   3,
+		RetryBackoff: 200 * time.Millisecond,
+	}
+}
+
+// Errors an *APIError matches with errors.Is, by status.
+var (
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrForbidden          = errors.New("forbidden")
+	ErrNotFound           = errors.New("not found")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrInvalid            = errors.New("invalid request")
+	ErrUnavailable        = errors.New("server busy")
+)
+
+// APIError is a response with a 4xx or 5xx status.
+type APIError struct {
+	StatusCode int
+	Message    string // the server's error text
+	RequestID  string // X-Request-ID, for finding the request in the server log
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("course API: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrPreconditionFailed:
+		return e.StatusCode == http.StatusPreconditionFailed
+	case ErrInvalid:
+		return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity
+	case ErrUnavailable:
+		return e.StatusCode == http.StatusServiceUnavailable || e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// request is one call to the API.
+type request struct {
+	method  string
+	path    string
+	query   url.Values
+	header  http.Header
+	body    any // JSON-encoded when not nil
+	success int // expected status
+}
+
+// do sends req, retrying when that is safe, and decodes a JSON response
+// into out if it is not nil.
+func (c *Client) do(ctx context.Context, req request, out any) (http.Header, error) {
+	var body []byte
+	if req.body != nil {
+		b, err := json.Marshal(req.body)
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	u := c.BaseURL + req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	for attempt := 0; ; attempt++ {
+		hreq, err := http.NewRequestWithContext(ctx, req.method, u, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range req.header {
+			hreq.Header[k] = v
+		}
+		hreq.Header.Set("Accept", "application/json")
+		if body != nil {
+			hreq.Header.Set("Content-Type", "application/json")
+		}
+		if c.Token != "" {
+			hreq.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		if c.APIKey != "" {
+			hreq.Header.Set("X-API-Key", c.APIKey)
+		}
+		if c.UserAgent != "" {
+			hreq.Header.Set("User-Agent", c.UserAgent)
+		}
+
+		resp, err := c.httpClient().Do(hreq)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil || !idempotent(req.method) {
+				return nil, err
+			}
+		case resp.StatusCode == req.success:
+			defer resp.Body.Close()
+			if out != nil {
+				if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+					return nil, fmt.Errorf("course API: decoding %s %s: %w", req.method, req.path, err)
+				}
+			}
+			return resp.Header, nil
+		default:
+			apiErr := readAPIError(resp)
+			if !retryable(req.method, resp.StatusCode) {
+				return nil, apiErr
+			}
+			err = apiErr
+			wait = retryAfter(resp.Header)
+		}
+		if attempt >= c.MaxRetries {
+			return nil, err
+		}
+		if wait == 0 {
+			// Full jitter, so clients that failed together do not retry
+			// together.
+			wait = time.Duration(rand.Int64N(int64(c.RetryBackoff<<attempt) + 1))
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func idempotent(method string) bool {
+	return method != http.MethodPost && method != http.MethodPatch
+}
+
+// retryable reports whether a request that got status may be sent again.
+// 429 and 503 mean the server turned the request away before handling it,
+// so even a POST is safe to repeat.
+func retryable(method string, status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout, http.StatusInternalServerError:
+		return idempotent(method)
+	}
+	return false
+}
+
+func retryAfter(h http.Header) time.Duration {
+	secs, err := strconv.Atoi(h.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
+
+func readAPIError(resp *http.Response) *APIError {
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(msg)),
+		RequestID:  resp.Header.Get("X-Request-ID"),
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ส่วนรับส่ง HTTP ของ client SDK
+
+	1. `New(baseURL)` สร้าง `Client` ค่าเริ่มต้น retry 3 ครั้ง ปรับ `HTTPClient`, `MaxRetries`, `RetryBackoff` ได้ก่อนใช้งาน
+	2. ทุก method รับ `context.Context` ยกเลิกหรือกำหนด timeout ได้ตามปกติ
+	3. การ retry:
+	   - GET/PUT/DELETE ลองใหม่เมื่อ network error หรือได้ 500/502/503/504/429
+	   - POST/PATCH ลองใหม่เฉพาะ 429 และ 503 เพราะ server ปฏิเสธก่อนทำงาน (เช่นจาก concurrency limiter) จึงไม่สร้างข้อมูลซ้ำ
+	   - เคารพ header `Retry-After` ถ้าไม่มีจะรอแบบ exponential backoff + jitter
+	4. error จาก server เป็น `*APIError` (status, ข้อความ, request ID) ใช้ `errors.Is(err, client.ErrNotFound)` แยกกรณีได้
+*/
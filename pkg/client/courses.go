@@ -0,0 +1,165 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Course is a course as the API sends it.
+type Course struct {
+	ID         int            `json:"id"`
+	Name       string         `json:"name"`
+	Price      int            `json:"price"`
+	Instructor string         `json:"instructor"`
+	Seats      int            `json:"seats,omitempty"`
+	AccessDays int            `json:"access_days,omitempty"`
+	PriceBook  []PriceEntry   `json:"price_book,omitempty"`
+	Private    bool           `json:"private,omitempty"`
+	Metadata   map[string]any `json:"metadata,omitempty"`
+
+	// Pricing is set when a currency was asked for.
+	Pricing *Price `json:"_pricing,omitempty"`
+
+	// ETag identifies this version of the course. Courses from GetCourse,
+	// CreateCourse and the update methods carry it, and passing it back
+	// makes the update fail with ErrPreconditionFailed if the course has
+	// changed since.
+	ETag string `json:"-"`
+}
+
+type PriceEntry struct {
+	Currency string `json:"currency"`
+	Amount   int    `json:"amount"`
+}
+
+type Price struct {
+	Currency        string   `json:"currency"`
+	Amount          int      `json:"amount"`
+	Source          string   `json:"source"`
+	ResolutionOrder []string `json:"resolution_order"`
+}
+
+// ListOptions narrows ListCourses. The zero value lists every public
+// course.
+type ListOptions struct {
+	Page     int               // 1-based; 0 for no pagination
+	PerPage  int               // 0 for the server's default
+	Sort     string            // e.g. "-price,name" or "meta.campus"
+	Meta     map[string]string // exact-match metadata filters
+	Currency string            // adds Pricing in this currency
+}
+
+func (o *ListOptions) values() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+	if o.Page > 0 {
+		q.Set("page", strconv.Itoa(o.Page))
+	}
+	if o.PerPage > 0 {
+		q.Set("per_page", strconv.Itoa(o.PerPage))
+	}
+	if o.Sort != "" {
+		q.Set("sort", o.Sort)
+	}
+	for k, v := range o.Meta {
+		q.Set("meta."+k, v)
+	}
+	if o.Currency != "" {
+		q.Set("currency", o.Currency)
+	}
+	return q
+}
+
+// ListCourses returns the public courses matching opts, which may be nil.
+func (c *Client) ListCourses(ctx context.Context, opts *ListOptions) ([]Course, error) {
+	var courses []Course
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/courses", query: opts.values(), success: http.StatusOK}, &courses)
+	return courses, err
+}
+
+// GetCourse returns course id.
+func (c *Client) GetCourse(ctx context.Context, id int) (*Course, error) {
+	return c.courseRequest(ctx, request{method: http.MethodGet, path: coursePath(id), success: http.StatusOK})
+}
+
+// CreateCourse adds a course; the server assigns its ID.
+func (c *Client) CreateCourse(ctx context.Context, course Course) (*Course, error) {
+	return c.courseRequest(ctx, request{method: http.MethodPost, path: "/courses", body: course, success: http.StatusCreated})
+}
+
+// ReplaceCourse overwrites course.ID with course. A non-empty course.ETag
+// is sent as If-Match.
+func (c *Client) ReplaceCourse(ctx context.Context, course Course) (*Course, error) {
+	return c.courseRequest(ctx, request{method: http.MethodPut, path: coursePath(course.ID), header: ifMatch(course.ETag), body: course, success: http.StatusOK})
+}
+
+// UpdateCourse changes only the given fields of course id, e.g.
+// map[string]any{"price": 120}. A metadata key set to nil is removed.
+// A non-empty etag is sent as If-Match.
+func (c *Client) UpdateCourse(ctx context.Context, id int, etag string, fields map[string]any) (*Course, error) {
+	return c.courseRequest(ctx, request{method: http.MethodPatch, path: coursePath(id), header: ifMatch(etag), body: fields, success: http.StatusOK})
+}
+
+// DeleteCourse removes course id. A non-empty etag is sent as If-Match.
+func (c *Client) DeleteCourse(ctx context.Context, id int, etag string) error {
+	_, err := c.do(ctx, request{method: http.MethodDelete, path: coursePath(id), header: ifMatch(etag), success: http.StatusNoContent}, nil)
+	return err
+}
+
+// Change is one entry of CourseChanges. Course is nil for deletions.
+type Change struct {
+	Seq    int64   `json:"seq"`
+	Op     string  `json:"op"` // "created", "updated" or "deleted"
+	ID     int     `json:"id"`
+	Course *Course `json:"course,omitempty"`
+}
+
+// CourseChanges returns what changed after since, and the since to pass
+// next time. Start with 0.
+func (c *Client) CourseChanges(ctx context.Context, since int64) ([]Change, int64, error) {
+	var resp struct {
+		Changes   []Change `json:"changes"`
+		NextSince int64    `json:"next_since"`
+	}
+	q := url.Values{"since": {strconv.FormatInt(since, 10)}}
+	if _, err := c.do(ctx, request{method: http.MethodGet, path: "/courses/changes", query: q, success: http.StatusOK}, &resp); err != nil {
+		return nil, since, err
+	}
+	return resp.Changes, resp.NextSince, nil
+}
+
+func (c *Client) courseRequest(ctx context.Context, req request) (*Course, error) {
+	var course Course
+	h, err := c.do(ctx, req, &course)
+	if err != nil {
+		return nil, err
+	}
+	course.ETag = h.Get("ETag")
+	return &course, nil
+}
+
+func coursePath(id int) string {
+	return "/courses/" + strconv.Itoa(id)
+}
+
+func ifMatch(etag string) http.Header {
+	if etag == "" {
+		return nil
+	}
+	return http.Header{"If-Match": {etag}}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: method สำหรับ course ใน client SDK
+
+	1. มี method ครบตาม REST API: `ListCourses`, `GetCourse`, `CreateCourse`, `ReplaceCourse` (PUT), `UpdateCourse` (PATCH), `DeleteCourse`, `CourseChanges`
+	2. `ListOptions` รวม pagination, sort, filter metadata และสกุลเงินไว้ที่เดียว ส่ง `nil` ได้ถ้าต้องการทั้งหมด
+	3. `Course.ETag` ถูกเติมจาก header `ETag` อัตโนมัติ ส่ง course เดิมกลับไปแก้ไขก็จะส่ง `If-Match` ให้เอง กันการเขียนทับงานของคนอื่น
+	4. `CourseChanges(ctx, since)` คืน `next_since` ไว้ใช้ดึงรอบต่อไปแบบ incremental sync
+*/
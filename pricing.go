@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultCurrency is the currency of course.CoursePrice.
+const defaultCurrency = "THB"
+
+// Price sources, in the order they are tried when resolving a price.
+const (
+	priceSourceBook       = "price_book"
+	priceSourceConversion = "conversion"
+	priceSourceDefault    = "default"
+)
+
+var priceResolutionOrder = []string{priceSourceBook, priceSourceConversion, priceSourceDefault}
+
+// priceEntry is an admin-managed price for one currency. Entries in a
+// course's price book always win over automatic conversion.
+type priceEntry struct {
+	Currency string `json:"currency" xml:"currency,attr"`
+	Amount   int    `json:"amount" xml:",chardata"`
+}
+
+// effectivePrice is the price a client is shown for a requested currency,
+// with where it came from.
+type effectivePrice struct {
+	Currency        string   `json:"currency" xml:"currency"`
+	Amount          int      `json:"amount" xml:"amount"`
+	Source          string   `json:"source" xml:"source"`
+	ResolutionOrder []string `json:"resolution_order" xml:"resolution_order>source"`
+}
+
+// exchangeRates maps a currency to how much of it one defaultCurrency buys.
+// It is read from EXCHANGE_RATES, e.g. "USD=0.028,EUR=0.026".
+var exchangeRates = map[string]float64{}
+
+func init() {
+	rates, err := parseExchangeRates(os.Getenv("EXCHANGE_RATES"))
+	if err != nil {
+		log.Fatalf("Invalid EXCHANGE_RATES: %v", err)
+	}
+	exchangeRates = rates
+}
+
+func parseExchangeRates(s string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		code, value, ok := strings.Cut(pair, "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if !ok || !validCurrency(code) {
+			return nil, fmt.Errorf("invalid entry %q", pair)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate for %s", code)
+		}
+		rates[code] = rate
+	}
+	return rates, nil
+}
+
+// validCurrency reports whether code looks like an ISO 4217 code.
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// validatePriceBook rejects malformed or duplicate price book entries.
+func validatePriceBook(book []priceEntry) error {
+	seen := map[string]bool{}
+	for _, e := range book {
+		if !validCurrency(e.Currency) {
+			return fmt.Errorf("invalid currency %q in price_book", e.Currency)
+		}
+		if e.Amount < 0 {
+			return fmt.Errorf("negative amount for %s in price_book", e.Currency)
+		}
+		if seen[e.Currency] {
+			return fmt.Errorf("duplicate currency %s in price_book", e.Currency)
+		}
+		seen[e.Currency] = true
+	}
+	return nil
+}
+
+// resolvePrice returns the price of c in currency: the price book entry if
+// there is one, otherwise a conversion of the default price if a rate is
+// configured, otherwise the default price in the default currency.
+func resolvePrice(c course, currency string) effectivePrice {
+	p := effectivePrice{ResolutionOrder: priceResolutionOrder}
+	for _, e := range c.PriceBook {
+		if e.Currency == currency {
+			p.Currency, p.Amount, p.Source = currency, e.Amount, priceSourceBook
+			return p
+		}
+	}
+	if rate, ok := exchangeRates[currency]; ok && currency != defaultCurrency {
+		p.Currency, p.Source = currency, priceSourceConversion
+		p.Amount = int(math.Round(float64(c.CoursePrice) * rate))
+		return p
+	}
+	p.Currency, p.Amount, p.Source = defaultCurrency, c.CoursePrice, priceSourceDefault
+	return p
+}
+
+// requestedCurrency returns the ?currency= query parameter, upper-cased.
+func requestedCurrency(r *http.Request) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(r.URL.Query().Get("currency")))
+	if code != "" && !validCurrency(code) {
+		return "", fmt.Errorf("invalid currency %q", code)
+	}
+	return code, nil
+}
+
+// pricingFor returns the effective price to attach to c for this request,
+// or nil when the client did not ask for a currency.
+func pricingFor(r *http.Request, c course) *effectivePrice {
+	code, err := requestedCurrency(r)
+	if err != nil || code == "" {
+		return nil
+	}
+	p := resolvePrice(c, code)
+	return &p
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ราคาหลายสกุลเงิน (Price Books)
+
+	1. `price` ของ course เป็นราคาในสกุลเงินหลัก (`THB`) ส่วน `price_book` เก็บราคาที่ admin กำหนดเองรายสกุลเงิน เช่น `[{"currency":"USD","amount":30}]`
+	2. เมื่อ client ส่ง `?currency=USD` จะได้ `_pricing` ที่บอกราคาจริงและที่มา โดยเลือกตามลำดับ:
+	   - price_book: มีราคาที่ตั้งไว้สำหรับสกุลเงินนั้น ใช้ค่านี้ก่อนเสมอ
+	   - conversion: ไม่มีใน price book แต่มีอัตราแลกเปลี่ยนใน `EXCHANGE_RATES` แปลงจากราคาหลัก
+	   - default: ไม่มีทั้งสองอย่าง ตอบราคาหลักเป็น THB
+	3. ลำดับนี้ถูกส่งกลับไปใน `resolution_order` ด้วย เพื่อให้ client รู้ว่าราคามาจากไหน
+*/
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health checks say the process is up, not that a course can be created.
+// With PROBE_INTERVAL set, the origin runs a canary every interval: it
+// creates a course, reads it back and deletes it, each through the whole
+// middleware chain as a client's request would go. The course is in
+// probeTenantID, a tenant with no domains whose courses the main site does
+// not show, and the probe's writes are kept out of the change feed, so
+// webhooks, live feeds, dual-write and partners never see them.
+//
+// Each run is a tracked job of type jobProbe, which puts its outcome and
+// latency in /admin/jobs/metrics; the metrics also have the latency of
+// each step of the last run. GET /admin/probe reports the last run, and
+// the status page shows the probe as a component.
+
+// probeTenantID cannot collide with a tenant from TENANTS_FILE, whose IDs
+// must match tenantIDPattern.
+const (
+	probeTenantID  = "_probe"
+	probeUserAgent = "go-first-web-server-probe"
+)
+
+// probeSteps are the steps of a run, in order.
+var probeSteps = []string{"create", "read", "delete"}
+
+var probeInterval time.Duration
+
+func init() {
+	v := os.Getenv("PROBE_INTERVAL")
+	if v == "" {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < time.Second {
+		log.Fatalf("Invalid PROBE_INTERVAL %q: must be a duration of at least 1s", v)
+	}
+	probeInterval = d
+	tenantsByID[probeTenantID] = &tenant{ID: probeTenantID, Name: "Synthetic probe"}
+}
+
+// probeRun is the outcome of one run.
+type probeRun struct {
+	At                  time.Time        `json:"at"`
+	OK                  bool             `json:"ok"`
+	Error               string           `json:"error,omitempty"`
+	Step                string           `json:"step,omitempty"` // the one that failed
+	LatencyMS           int64            `json:"latency_ms"`
+	StepLatencyMS       map[string]int64 `json:"step_latency_ms"`
+	ConsecutiveFailures int              `json:"consecutive_failures"`
+
+	steps map[string]time.Duration // for the metrics, which want better than milliseconds
+}
+
+var (
+	probeMu   sync.Mutex
+	lastProbe *probeRun
+)
+
+type probeContextKey struct{}
+
+// isProbeRequest reports whether r is one of the probe's own. Only the
+// probe can put the key in a request's context.
+func isProbeRequest(r *http.Request) bool {
+	return r.Context().Value(probeContextKey{}) != nil
+}
+
+// probePrincipal is who the probe writes as.
+var probePrincipal = principal{Subject: "probe", Role: roleAdmin, probe: true}
+
+// runProbes runs the probe against handler every interval.
+func runProbes(handler http.Handler, interval time.Duration) {
+	for {
+		runProbe(handler, time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// runProbe runs the probe once as a tracked job and records the outcome.
+func runProbe(handler http.Handler, now time.Time) {
+	j := trackJob(jobProbe, now.UTC().Format(time.RFC3339))
+	j.attempt()
+	run := &probeRun{At: now.UTC(), StepLatencyMS: map[string]int64{}, steps: map[string]time.Duration{}}
+	step, err := probeCatalog(handler, run)
+	j.done(err)
+	run.LatencyMS = time.Since(now).Milliseconds()
+
+	probeMu.Lock()
+	defer probeMu.Unlock()
+	if err != nil {
+		run.Error, run.Step = err.Error(), step
+		if lastProbe != nil {
+			run.ConsecutiveFailures = lastProbe.ConsecutiveFailures
+		}
+		run.ConsecutiveFailures++
+		slog.Error("Synthetic probe failed", "step", step, "err", err)
+	} else {
+		run.OK = true
+		if lastProbe != nil && !lastProbe.OK {
+			slog.Info("Synthetic probe passes again")
+		}
+	}
+	lastProbe = run
+}
+
+// probeCatalog creates, reads and deletes a course, returning the step that
+// failed, if one did. A course that was created is deleted even when
+// reading it fails.
+func probeCatalog(handler http.Handler, run *probeRun) (string, error) {
+	name := "Synthetic probe " + randomHex(4)
+	res := probeRequest(handler, run, "create", http.MethodPost, "/courses", `{"name": "`+name+`", "price": 0, "instructor": "probe"}`)
+	if res.Code != http.StatusCreated {
+		return "create", probeStatusError(res)
+	}
+	var created course
+	if err := json.Unmarshal(res.Body.Bytes(), &created); err != nil {
+		return "create", fmt.Errorf("invalid response: %v", err)
+	}
+	target := "/courses/" + strconv.Itoa(created.CourseId)
+
+	step, err := "", error(nil)
+	res = probeRequest(handler, run, "read", http.MethodGet, target, "")
+	var read course
+	switch {
+	case res.Code != http.StatusOK:
+		step, err = "read", probeStatusError(res)
+	case json.Unmarshal(res.Body.Bytes(), &read) != nil || read.CourseName != name:
+		step, err = "read", errors.New("the course read back differs from the one created")
+	}
+
+	res = probeRequest(handler, run, "delete", http.MethodDelete, target, "")
+	if res.Code != http.StatusNoContent && err == nil {
+		step, err = "delete", probeStatusError(res)
+	}
+	return step, err
+}
+
+// probeRequest sends handler one of the probe's requests, timing it as
+// step.
+func probeRequest(handler http.Handler, run *probeRun, step, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.RemoteAddr = "127.0.0.1:0"
+	r.Header.Set("User-Agent", probeUserAgent)
+	r.Header.Set("Cache-Control", "no-cache")
+	if body != "" {
+		r.Header.Set("Content-Type", mediaTypeJSON)
+	}
+	ctx := context.WithValue(r.Context(), probeContextKey{}, true)
+	ctx = context.WithValue(ctx, tenantContextKey{}, tenantsByID[probeTenantID])
+	res := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(res, r.WithContext(ctx))
+	run.steps[step] = time.Since(start)
+	run.StepLatencyMS[step] = run.steps[step].Milliseconds()
+	return res
+}
+
+func probeStatusError(res *httptest.ResponseRecorder) error {
+	msg := strings.TrimSpace(res.Body.String())
+	if len(msg) > 200 {
+		msg = msg[:200]
+	}
+	return fmt.Errorf("status %d: %s", res.Code, msg)
+}
+
+// checkProbeStatus is the probe's status page component: degraded after a
+// failed run, an outage after three in a row.
+func checkProbeStatus() (string, string) {
+	probeMu.Lock()
+	defer probeMu.Unlock()
+	switch {
+	case lastProbe == nil:
+		return "", ""
+	case lastProbe.OK:
+		return statusOperational, ""
+	case lastProbe.ConsecutiveFailures >= 3:
+		return statusOutage, "creating, reading and deleting a course fails"
+	}
+	return statusDegraded, "the last canary run failed at " + lastProbe.Step
+}
+
+// writeProbeMetrics adds the probe's last run to the job metrics.
+func writeProbeMetrics(b *strings.Builder) {
+	probeMu.Lock()
+	defer probeMu.Unlock()
+	if lastProbe == nil {
+		return
+	}
+	ok := 0
+	if lastProbe.OK {
+		ok = 1
+	}
+	fmt.Fprintf(b, "# HELP probe_success Whether the last synthetic probe passed.\n# TYPE probe_success gauge\nprobe_success %d\n", ok)
+	fmt.Fprint(b, "# HELP probe_step_latency_seconds Latency of each step of the last synthetic probe.\n# TYPE probe_step_latency_seconds gauge\n")
+	for _, step := range probeSteps {
+		if d, ok := lastProbe.steps[step]; ok {
+			fmt.Fprintf(b, "probe_step_latency_seconds{step=%q} %s\n", step, strconv.FormatFloat(d.Seconds(), 'g', -1, 64))
+		}
+	}
+}
+
+// adminProbeHandler serves GET /admin/probe, the last run.
+func adminProbeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if probeInterval == 0 {
+		writeError(w, r, "The probe is not enabled; set PROBE_INTERVAL", http.StatusNotFound)
+		return
+	}
+	probeMu.Lock()
+	defer probeMu.Unlock()
+	if lastProbe == nil {
+		writeError(w, r, "The probe has not run yet", http.StatusNotFound)
+		return
+	}
+	writeValue(w, r, http.StatusOK, lastProbe)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: probe สังเคราะห์ที่ลองสร้าง อ่าน และลบ course จริงเป็นรอบๆ จับปัญหาที่ health check ธรรมดามองไม่เห็น
+
+	1. ตั้ง `PROBE_INTERVAL` (เช่น `1m`) แล้ว origin ยิง request เข้า middleware ทั้งสายเหมือน client จริง: POST → GET → DELETE
+	   - course อยู่ใน tenant ซ่อน `_probe` ที่ไม่มี domain และหน้า main site ไม่แสดง
+	   - การเขียนของ probe ไม่เข้า change feed จึงไม่มี webhook, live event หรือ dual-write ออกไป
+	   - อ่านไม่ผ่านก็ยังลบ course ที่สร้างไว้ให้
+	2. แต่ละรอบเป็น job ชนิด `synthetic-probe` ผลและ latency จึงอยู่ใน `/admin/jobs/metrics` พร้อม `probe_success` และ latency รายขั้น
+	3. `GET /admin/probe` ดูผลรอบล่าสุด หน้า `/status` มี component `probe` (ล้ม 1 รอบ = degraded, 3 รอบติด = outage)
+*/
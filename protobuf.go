@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// This is a hand-written codec for the messages in course.proto. It only
+// needs varint and length-delimited fields, which keeps it small; unknown
+// fields are skipped on decode so newer clients can talk to older servers.
+
+const mediaTypeProtobuf = "application/x-protobuf"
+
+// Errors stay plain text: course.proto has no error message.
+var protobufCodec = &codec{
+	mediaType:   mediaTypeProtobuf,
+	contentType: mediaTypeProtobuf,
+	encodeCourse: func(r *http.Request, c course) ([]byte, error) {
+		return marshalCourseProto(c), nil
+	},
+	encodeCourses: func(r *http.Request, courses []course) ([]byte, error) {
+		return marshalCourseListProto(courses), nil
+	},
+	decodeCourse: unmarshalCourseProto,
+}
+
+// Protobuf wire types.
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireBytes  = 2
+	wireI32    = 5
+)
+
+// Field numbers from course.proto.
+const (
+	pbCourseID         = 1
+	pbCourseName       = 2
+	pbCoursePrice      = 3
+	pbCourseInstructor = 4
+	pbCourseSeats      = 5
+	pbCoursePriceBook  = 6
+	pbCourseAccessDays = 7
+	pbCoursePrivate    = 8
+	pbCourseMetadata   = 9
+	pbCourseTenant     = 10
+	pbCourseOwner      = 11
+
+	pbPriceEntryCurrency = 1
+	pbPriceEntryAmount   = 2
+
+	pbCourseListCourses = 1
+)
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendVarintField(b []byte, field int, v int64) []byte {
+	b = appendTag(b, field, wireVarint)
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func marshalPriceEntryProto(e priceEntry) []byte {
+	var b []byte
+	b = appendBytesField(b, pbPriceEntryCurrency, []byte(e.Currency))
+	return appendVarintField(b, pbPriceEntryAmount, int64(e.Amount))
+}
+
+func marshalCourseProto(c course) []byte {
+	var b []byte
+	b = appendVarintField(b, pbCourseID, int64(c.CourseId))
+	b = appendBytesField(b, pbCourseName, []byte(c.CourseName))
+	b = appendVarintField(b, pbCoursePrice, int64(c.CoursePrice))
+	b = appendBytesField(b, pbCourseInstructor, []byte(c.Instructor))
+	b = appendVarintField(b, pbCourseSeats, int64(c.Seats))
+	for _, e := range c.PriceBook {
+		b = appendBytesField(b, pbCoursePriceBook, marshalPriceEntryProto(e))
+	}
+	b = appendVarintField(b, pbCourseAccessDays, int64(c.AccessDays))
+	if c.Private {
+		b = appendVarintField(b, pbCoursePrivate, 1)
+	}
+	if len(c.Metadata) > 0 {
+		// Metadata only holds scalars, which always marshal.
+		m, _ := json.Marshal(c.Metadata)
+		b = appendBytesField(b, pbCourseMetadata, m)
+	}
+	if c.Tenant != "" {
+		b = appendBytesField(b, pbCourseTenant, []byte(c.Tenant))
+	}
+	if c.Owner != "" {
+		b = appendBytesField(b, pbCourseOwner, []byte(c.Owner))
+	}
+	return b
+}
+
+func marshalCourseListProto(courses []course) []byte {
+	var b []byte
+	for _, c := range courses {
+		b = appendBytesField(b, pbCourseListCourses, marshalCourseProto(c))
+	}
+	return b
+}
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// protoField is one decoded field. For varints, value holds the number; for
+// length-delimited fields, data holds the payload.
+type protoField struct {
+	number   int
+	wireType int
+	value    uint64
+	data     []byte
+}
+
+// eachProtoField calls fn for every field in b, in wire order.
+func eachProtoField(b []byte, fn func(protoField) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		f := protoField{number: int(tag >> 3), wireType: int(tag & 7)}
+		switch f.wireType {
+		case wireVarint:
+			f.value, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return errProtoTruncated
+			}
+			f.data = b[n : n+int(size)]
+			b = b[n+int(size):]
+		case wireI64:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			b = b[8:]
+		case wireI32:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			b = b[4:]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", f.wireType)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expectWireType(f protoField, wireType int) error {
+	if f.wireType != wireType {
+		return fmt.Errorf("protobuf: field %d has wire type %d, want %d", f.number, f.wireType, wireType)
+	}
+	return nil
+}
+
+func unmarshalPriceEntryProto(b []byte) (priceEntry, error) {
+	var e priceEntry
+	err := eachProtoField(b, func(f protoField) error {
+		switch f.number {
+		case pbPriceEntryCurrency:
+			if err := expectWireType(f, wireBytes); err != nil {
+				return err
+			}
+			e.Currency = string(f.data)
+		case pbPriceEntryAmount:
+			if err := expectWireType(f, wireVarint); err != nil {
+				return err
+			}
+			e.Amount = int(int64(f.value))
+		}
+		return nil
+	})
+	return e, err
+}
+
+// unmarshalCourseProto decodes a Course message onto dst. Fields absent from
+// the message keep their current value, which gives PATCH its meaning; a
+// price_book in the message replaces the existing one.
+func unmarshalCourseProto(b []byte, dst *course) error {
+	var book []priceEntry
+	sawBook := false
+	err := eachProtoField(b, func(f protoField) error {
+		switch f.number {
+		case pbCourseID, pbCoursePrice, pbCourseSeats, pbCourseAccessDays:
+			if err := expectWireType(f, wireVarint); err != nil {
+				return err
+			}
+			v := int(int64(f.value))
+			switch f.number {
+			case pbCourseID:
+				dst.CourseId = v
+			case pbCoursePrice:
+				dst.CoursePrice = v
+			case pbCourseSeats:
+				dst.Seats = v
+			case pbCourseAccessDays:
+				dst.AccessDays = v
+			}
+		case pbCoursePrivate:
+			if err := expectWireType(f, wireVarint); err != nil {
+				return err
+			}
+			dst.Private = f.value != 0
+		case pbCourseMetadata:
+			if err := expectWireType(f, wireBytes); err != nil {
+				return err
+			}
+			// Decoding onto the existing map merges keys, like a JSON PATCH.
+			if err := json.Unmarshal(f.data, &dst.Metadata); err != nil {
+				return fmt.Errorf("protobuf: metadata_json: %v", err)
+			}
+			dst.Metadata = compactMetadata(dst.Metadata)
+		case pbCourseName, pbCourseInstructor, pbCourseTenant, pbCourseOwner:
+			if err := expectWireType(f, wireBytes); err != nil {
+				return err
+			}
+			v := string(f.data)
+			switch f.number {
+			case pbCourseName:
+				dst.CourseName = v
+			case pbCourseInstructor:
+				dst.Instructor = v
+			case pbCourseTenant:
+				dst.Tenant = v
+			case pbCourseOwner:
+				dst.Owner = v
+			}
+		case pbCoursePriceBook:
+			if err := expectWireType(f, wireBytes); err != nil {
+				return err
+			}
+			e, err := unmarshalPriceEntryProto(f.data)
+			if err != nil {
+				return err
+			}
+			book = append(book, e)
+			sawBook = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if sawBook {
+		dst.PriceBook = book
+	}
+	return nil
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Protocol Buffers แบบไม่ใช้ code generator
+
+	1. `course.proto` คือสัญญา (schema) ระหว่าง server กับ client ภายในที่ต้องการความเร็วสูง ส่ง `Accept: application/x-protobuf` เพื่อรับข้อมูลแบบ binary
+	2. เนื่องจากยังไม่มี go.mod ให้ดึง `google.golang.org/protobuf` จึงเขียน encoder/decoder เองตาม wire format ของ protobuf:
+	   - ทุก field = tag (field number << 3 | wire type) แบบ varint ตามด้วยค่า
+	   - ตัวเลขใช้ varint, string/ข้อความซ้อน (PriceEntry) ใช้ length-delimited
+	3. field ที่ไม่รู้จักจะถูกข้ามไป ทำให้เพิ่ม field ใหม่ใน .proto ได้โดย client เก่าไม่พัง (ห้ามนำ field number เดิมกลับมาใช้ใหม่)
+	4. field ใน `Course` ต้องตรงกับ struct `course` เสมอ รวม `tenant` (10) และ `owner` (11)
+*/
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCourseProtoRoundTrip(t *testing.T) {
+	in := course{
+		CourseId:    7,
+		CourseName:  "Go",
+		CoursePrice: 100,
+		Instructor:  "Ann",
+		Seats:       20,
+		AccessDays:  30,
+		PriceBook:   []priceEntry{{Currency: "USD", Amount: 3}, {Currency: "EUR", Amount: -1}},
+		Private:     true,
+		Tenant:      "acme",
+		Owner:       "ann",
+		Metadata:    map[string]any{"cohort": "A", "credits": float64(3), "online": true},
+	}
+	var got course
+	if err := unmarshalCourseProto(marshalCourseProto(in), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, in) {
+		t.Errorf("round trip = %#v, want %#v", got, in)
+	}
+}
+
+func TestUnmarshalCourseProtoMerges(t *testing.T) {
+	c := course{CourseId: 1, CourseName: "Go", CoursePrice: 100, PriceBook: []priceEntry{{Currency: "USD", Amount: 3}}, Metadata: map[string]any{"a": "x", "b": "y"}}
+	// name = "Rust", metadata_json = {"a":null}
+	msg := []byte{0x12, 4, 'R', 'u', 's', 't', 0x4a, 10}
+	msg = append(msg, `{"a":null}`...)
+	if err := unmarshalCourseProto(msg, &c); err != nil {
+		t.Fatal(err)
+	}
+	want := course{CourseId: 1, CourseName: "Rust", CoursePrice: 100, PriceBook: []priceEntry{{Currency: "USD", Amount: 3}}, Metadata: map[string]any{"b": "y"}}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("merged = %#v, want %#v", c, want)
+	}
+}
+
+func TestUnmarshalCourseProtoSkipsUnknownFields(t *testing.T) {
+	// Field 99 as a varint, then fixed64 and fixed32 fields, then id = 3.
+	msg := []byte{0x98, 0x06, 0x01, 0x61, 1, 2, 3, 4, 5, 6, 7, 8, 0x6d, 1, 2, 3, 4, 0x08, 0x03}
+	var c course
+	if err := unmarshalCourseProto(msg, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.CourseId != 3 {
+		t.Errorf("id = %d, want 3", c.CourseId)
+	}
+}
+
+func TestUnmarshalCourseProtoMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   []byte
+		err  string
+	}{
+		{"short tag", []byte{0x80}, "truncated"},
+		{"short varint", []byte{0x08, 0x80}, "truncated"},
+		{"short bytes", []byte{0x12, 0x05, 'a'}, "truncated"},
+		{"huge length", []byte{0x12, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, "truncated"},
+		{"short fixed64", []byte{0x61, 1, 2}, "truncated"},
+		{"short fixed32", []byte{0x6d, 1}, "truncated"},
+		{"group", []byte{0x0b}, "unsupported wire type 3"},
+		{"name as varint", []byte{0x10, 0x01}, "want 2"},
+		{"id as bytes", []byte{0x0a, 0x00}, "want 0"},
+		{"private as bytes", []byte{0x42, 0x00}, "want 0"},
+		{"bad metadata", []byte{0x4a, 0x01, '{'}, "metadata_json"},
+		{"metadata not an object", []byte{0x4a, 0x01, '1'}, "metadata_json"},
+		{"bad price entry", []byte{0x32, 0x02, 0x08, 0x01}, "want 2"},
+		{"short price entry", []byte{0x32, 0x01, 0x12}, "truncated"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var c course
+			err := unmarshalCourseProto(tt.in, &c)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("unmarshalCourseProto(% x) = %v, want an error containing %q", tt.in, err, tt.err)
+			}
+		})
+	}
+}
+
+func FuzzUnmarshalCourseProto(f *testing.F) {
+	f.Add(marshalCourseProto(course{CourseId: 1, CourseName: "Go", PriceBook: []priceEntry{{Currency: "USD", Amount: 1}}, Metadata: map[string]any{"a": "b"}}))
+	f.Add([]byte{0x12, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var c course
+		unmarshalCourseProto(b, &c)
+	})
+}
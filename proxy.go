@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// catalogCacheControl is sent on the read-only catalog endpoints so a CDN,
+// or another instance running in proxy mode, knows how long it may reuse
+// the response and for how long it may serve it stale while refreshing.
+const catalogCacheControl = "public, max-age=5, stale-while-revalidate=30"
+
+// cachedResponse is a complete response captured from the origin.
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	maxAge  time.Duration
+	swr     time.Duration
+	noStore bool
+}
+
+func (c *cachedResponse) age(now time.Time) time.Duration { return now.Sub(c.stored) }
+func (c *cachedResponse) fresh(now time.Time) bool        { return c.age(now) < c.maxAge }
+func (c *cachedResponse) usableStale(now time.Time) bool  { return c.age(now) < c.maxAge+c.swr }
+
+// inflightFetch lets identical concurrent requests wait on a single origin
+// fetch instead of each hitting the origin.
+type inflightFetch struct {
+	done chan struct{}
+	resp *cachedResponse
+}
+
+// cachingProxy sits in front of an origin handler (a reverse proxy to another
+// instance, or this server's own mux) and caches GET responses for the
+// catalog endpoints according to the origin's Cache-Control header.
+type cachingProxy struct {
+	origin http.Handler
+
+	mu       sync.Mutex
+	entries  map[string]*cachedResponse
+	inflight map[string]*inflightFetch
+}
+
+func newCachingProxy(origin http.Handler) *cachingProxy {
+	return &cachingProxy{
+		origin:   origin,
+		entries:  make(map[string]*cachedResponse),
+		inflight: make(map[string]*inflightFetch),
+	}
+}
+
+// activeCatalogCache is nil unless -cache or -upstream is set.
+var activeCatalogCache *cachingProxy
+
+// newUpstreamProxy returns a caching proxy fronting another instance.
+func newUpstreamProxy(upstream string) (*cachingProxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	rp := httputil.NewSingleHostReverseProxy(u)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		director(r)
+		r.Host = u.Host
+		setTraceHeaders(r.Header, requestTrace(r))
+	}
+	return newCachingProxy(rp), nil
+}
+
+// isCatalogRead reports whether the request is a read of the public catalog.
+func isCatalogRead(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.URL.Path == "/courses/sync" {
+		// A long-lived stream, not something to buffer and replay.
+		return false
+	}
+	if carriesCredentials(r) || r.Header.Get(inviteCodeHeader) != "" || r.Header.Get(userEmailHeader) != "" {
+		// Roles, field permissions, invites and allowlists may show the
+		// requester more than the public sees, and the cache does not key
+		// on who asks.
+		return false
+	}
+	return r.URL.Path == "/courses" || strings.HasPrefix(r.URL.Path, "/courses/")
+}
+
+// carriesCredentials reports whether r has any of the credentials
+// requestPrincipal looks at, valid or not.
+func carriesCredentials(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" || r.Header.Get(apiKeyHeader) != "" {
+		return true
+	}
+	if _, err := r.Cookie(sessionCookie); err == nil {
+		return true
+	}
+	return r.TLS != nil && len(r.TLS.PeerCertificates) > 0
+}
+
+func cacheKey(r *http.Request) string {
+	// Tenants' domains see different catalogs at the same URL.
+	return r.Host + "\x00" + r.URL.RequestURI() + "\x00" + r.Header.Get("Accept") + "\x00" + r.Header.Get("Accept-Encoding")
+}
+
+func (p *cachingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isCatalogRead(r) {
+		// Anything that may change the catalog goes straight to the origin
+		// and drops what we have cached, so the next read sees the change.
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+			p.purge()
+		}
+		p.origin.ServeHTTP(w, r)
+		return
+	}
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		p.write(w, r, p.fetch(r), "BYPASS")
+		return
+	}
+
+	key := cacheKey(r)
+	now := time.Now()
+
+	p.mu.Lock()
+	entry := p.entries[key]
+	p.mu.Unlock()
+
+	switch {
+	case entry != nil && entry.fresh(now):
+		p.write(w, r, entry, "HIT")
+	case entry != nil && entry.usableStale(now):
+		// stale-while-revalidate: answer now, refresh in the background.
+		go p.fetchCoalesced(key, r.Clone(context.Background()))
+		p.write(w, r, entry, "STALE")
+	default:
+		p.write(w, r, p.fetchCoalesced(key, r), "MISS")
+	}
+}
+
+// fetchCoalesced fetches key from the origin, sharing one fetch between all
+// callers that ask for the same key at the same time. A response the origin
+// marked no-store or private was meant for one caller, so the others fetch
+// their own.
+func (p *cachingProxy) fetchCoalesced(key string, r *http.Request) *cachedResponse {
+	p.mu.Lock()
+	if f, ok := p.inflight[key]; ok {
+		p.mu.Unlock()
+		<-f.done
+		if f.resp.noStore {
+			return p.fetch(r)
+		}
+		return f.resp
+	}
+	f := &inflightFetch{done: make(chan struct{})}
+	p.inflight[key] = f
+	p.mu.Unlock()
+
+	f.resp = p.fetch(r)
+
+	p.mu.Lock()
+	delete(p.inflight, key)
+	if f.resp.status == http.StatusOK && !f.resp.noStore && f.resp.maxAge+f.resp.swr > 0 {
+		p.entries[key] = f.resp
+	}
+	p.mu.Unlock()
+	close(f.done)
+	return f.resp
+}
+
+// fetch runs the request against the origin and captures the response.
+func (p *cachingProxy) fetch(r *http.Request) *cachedResponse {
+	// Always fetch with GET so a HEAD request can warm the cache for GETs.
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	buf := &responseBuffer{header: make(http.Header), status: http.StatusOK}
+	p.origin.ServeHTTP(buf, req)
+
+	resp := &cachedResponse{
+		status: buf.status,
+		header: buf.header,
+		body:   buf.body.Bytes(),
+		stored: time.Now(),
+	}
+	resp.maxAge, resp.swr, resp.noStore = parseCacheControl(buf.header.Get("Cache-Control"))
+	return resp
+}
+
+func (p *cachingProxy) write(w http.ResponseWriter, r *http.Request, c *cachedResponse, state string) {
+	for k, v := range c.header {
+		// A cached response was fetched for another request; these
+		// identify this one and are already set.
+		if k == http.CanonicalHeaderKey(requestIDHeader) || k == http.CanonicalHeaderKey(traceIDHeader) {
+			continue
+		}
+		w.Header()[k] = v
+	}
+	w.Header().Set("Age", strconv.Itoa(int(c.age(time.Now()).Seconds())))
+	w.Header().Set("X-Cache", state)
+	w.WriteHeader(c.status)
+	if r.Method != http.MethodHead {
+		w.Write(c.body)
+	}
+}
+
+// purge drops every cached response and returns how many there were.
+func (p *cachingProxy) purge() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.entries)
+	p.entries = make(map[string]*cachedResponse)
+	return n
+}
+
+// storedBefore returns how many responses are cached and the URLs of
+// those cached before t, dropping them if drop is set.
+func (p *cachingProxy) storedBefore(t time.Time, drop bool) (int, []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	total := len(p.entries)
+	var stale []string
+	for key, c := range p.entries {
+		if c.stored.Before(t) {
+			host, rest, _ := strings.Cut(key, "\x00")
+			uri, _, _ := strings.Cut(rest, "\x00")
+			stale = append(stale, host+uri)
+			if drop {
+				delete(p.entries, key)
+			}
+		}
+	}
+	slices.Sort(stale)
+	return total, stale
+}
+
+// parseCacheControl extracts the directives the proxy cares about. Private
+// and no-store responses are never cached; s-maxage wins over max-age since
+// this is a shared cache.
+func parseCacheControl(v string) (maxAge, swr time.Duration, noStore bool) {
+	sMaxAge := time.Duration(-1)
+	for _, directive := range strings.Split(v, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		seconds, _ := strconv.Atoi(strings.Trim(value, `"`))
+		switch strings.ToLower(name) {
+		case "no-store", "private", "no-cache":
+			noStore = true
+		case "max-age":
+			maxAge = time.Duration(seconds) * time.Second
+		case "s-maxage":
+			sMaxAge = time.Duration(seconds) * time.Second
+		case "stale-while-revalidate":
+			swr = time.Duration(seconds) * time.Second
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	return maxAge, swr, noStore
+}
+
+// responseBuffer is an in-memory http.ResponseWriter used to capture the
+// origin's response before storing it.
+type responseBuffer struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header { return b.header }
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.wroteHeader {
+		return
+	}
+	b.status = status
+	b.wroteHeader = true
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(p)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Caching Proxy สำหรับ endpoint ที่อ่านอย่างเดียว (GET /courses, GET /courses/{id})
+
+	1. เคารพ Cache-Control จาก upstream: ใช้ `max-age`/`s-maxage` กำหนดอายุ และไม่เก็บ response ที่เป็น `no-store` หรือ `private`
+	2. Request Coalescing: ถ้ามีหลาย request ที่เหมือนกันเข้ามาพร้อมกัน จะยิงไปที่ origin เพียงครั้งเดียว ที่เหลือรอผลเดียวกัน (`inflight`) ยกเว้น response ที่เป็น `no-store` หรือ `private` ซึ่งแต่ละคนต้องยิงเอง
+	3. stale-while-revalidate: ถ้า cache หมดอายุแต่ยังอยู่ในช่วงที่อนุญาต จะตอบข้อมูลเก่าทันทีแล้ว refresh อยู่เบื้องหลัง
+	4. request ที่มี credential, invite code หรือ X-User-Email จะไม่ผ่าน cache เพราะอาจเห็นมากกว่าคนทั่วไป
+	5. request ที่แก้ไขข้อมูล (POST/PUT/PATCH/DELETE) จะส่งผ่านไปที่ origin และล้าง cache ทิ้ง
+*/
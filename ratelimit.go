@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RATE_LIMIT caps how often one client may call the routes in
+// RATE_LIMIT_ROUTES (default "POST /courses"), so a single address cannot
+// flood the catalog with new courses. It is written as a count per
+// second, minute or hour, such as 10/m, and unset turns the limiter off.
+// Each client has a token bucket that holds RATE_LIMIT_BURST tokens
+// (default the count in RATE_LIMIT) and refills at the rate; a request
+// takes a token, and a request that finds none is answered 429 with
+// Retry-After saying when the next one is due.
+//
+// Clients are told apart by IP address, IPv6 ones by their /64, since one
+// host usually has the whole prefix. Behind a load balancer every request
+// comes from it, so TRUSTED_PROXIES lists the CIDRs of the proxies whose
+// X-Forwarded-For is believed; the client is the last address in it that
+// is not one of them.
+//
+// The three RATE_LIMIT settings may also come from CONFIG_FILE, and change
+// when it is reloaded; every client's bucket then starts full again.
+
+var defaultRateLimitRoutes = "POST /courses"
+
+// rateLimitSettings are the limiter and the routes it guards, replaced
+// together when CONFIG_FILE (configfile.go) changes them.
+type rateLimitSettings struct {
+	// limiter is nil when RATE_LIMIT is unset.
+	limiter *ipRateLimiter
+	routes  map[string]bool // "METHOD pattern"
+}
+
+var (
+	rateLimits     atomic.Pointer[rateLimitSettings]
+	trustedProxies []netip.Prefix
+)
+
+func init() {
+	for _, s := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES entry %q: %v", s, err)
+		}
+		trustedProxies = append(trustedProxies, p)
+	}
+	limits, err := newRateLimits(configSetting("RATE_LIMIT"), configSetting("RATE_LIMIT_BURST"), configSetting("RATE_LIMIT_ROUTES"))
+	if err != nil {
+		log.Fatalf("Invalid %v", err)
+	}
+	rateLimits.Store(limits)
+}
+
+// newRateLimits returns the settings of RATE_LIMIT, RATE_LIMIT_BURST and
+// RATE_LIMIT_ROUTES as given, each checked.
+func newRateLimits(spec, burstSpec, routes string) (*rateLimitSettings, error) {
+	if routes == "" {
+		routes = defaultRateLimitRoutes
+	}
+	limits := &rateLimitSettings{routes: map[string]bool{}}
+	for _, route := range strings.Split(routes, ",") {
+		method, pattern, ok := strings.Cut(strings.TrimSpace(route), " ")
+		if !ok || method == "" || !strings.HasPrefix(strings.TrimSpace(pattern), "/") {
+			return nil, fmt.Errorf("RATE_LIMIT_ROUTES entry %q: want METHOD /pattern", route)
+		}
+		limits.routes[strings.ToUpper(method)+" "+strings.TrimSpace(pattern)] = true
+	}
+	if spec == "" {
+		return limits, nil
+	}
+	count, perSecond, err := parseRate(spec)
+	if err != nil {
+		return nil, fmt.Errorf("RATE_LIMIT %q: %v", spec, err)
+	}
+	burst := count
+	if burstSpec != "" {
+		if burst, err = strconv.Atoi(burstSpec); err != nil || burst < 1 {
+			return nil, fmt.Errorf("RATE_LIMIT_BURST %q: must be a positive integer", burstSpec)
+		}
+	}
+	limits.limiter = &ipRateLimiter{rate: perSecond, burst: float64(burst), buckets: make(map[string]*tokenBucket)}
+	return limits, nil
+}
+
+// parseRate parses "10/m" into 10 and the rate per second.
+func parseRate(s string) (int, float64, error) {
+	n, unit, ok := strings.Cut(s, "/")
+	count, err := strconv.Atoi(n)
+	if !ok || err != nil || count < 1 {
+		return 0, 0, fmt.Errorf("want a positive count per s, m or h, like 10/m")
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if per == 0 {
+		return 0, 0, fmt.Errorf("unit must be s, m or h")
+	}
+	return count, float64(count) / per.Seconds(), nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type ipRateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket // by client
+	lastSweep time.Time
+}
+
+// take spends one of client's tokens. If it has none it returns how long
+// until the next one.
+func (l *ipRateLimiter) take(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// A bucket that has refilled is the same as none, so drop those now
+	// and then to keep one-off clients from piling up.
+	if now.Sub(l.lastSweep) > time.Minute {
+		full := time.Duration(l.burst / l.rate * float64(time.Second))
+		for k, b := range l.buckets {
+			if now.Sub(b.last) >= full {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// clientIP returns the address r comes from, following X-Forwarded-For
+// through TRUSTED_PROXIES.
+func clientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && trustedProxy(addr); i-- {
+		prev, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = prev.Unmap()
+	}
+	return addr
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimitKey is the bucket a client address counts against.
+func rateLimitKey(addr netip.Addr) string {
+	if addr.Is6() {
+		p, _ := addr.Prefix(64)
+		return p.String()
+	}
+	return addr.String()
+}
+
+// rateLimitHandler runs next under the rate limiter for the routes in
+// RATE_LIMIT_ROUTES, found by the mux pattern a request will be routed to.
+func rateLimitHandler(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := rateLimits.Load()
+		if limits.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_, pattern := mux.Handler(r)
+		if !limits.routes[r.Method+" "+pattern] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := rateLimitKey(clientIP(r))
+		if ok, wait := limits.limiter.take(client, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, "Too many requests; try again later", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: จำกัดความถี่ของ request ต่อ IP (token bucket) กันคนยิง `POST /courses` รัวๆ
+
+	1. เปิดด้วย `RATE_LIMIT=10/m` (จำนวนต่อ s/m/h) ใช้กับ route ใน `RATE_LIMIT_ROUTES` (ค่าเริ่มต้น `POST /courses`)
+	2. แต่ละ client มีถังเก็บ token ได้ `RATE_LIMIT_BURST` ใบ (ค่าเริ่มต้นเท่าจำนวนใน `RATE_LIMIT`) เติมคืนตามอัตรา
+	   - request หนึ่งใช้หนึ่งใบ ถังว่างได้ 429 พร้อม `Retry-After` (วินาทีจนกว่าจะมี token ใบถัดไป)
+	   - ถังที่เติมจนเต็มแล้วถูกลบทิ้งเป็นระยะ ไม่ให้ map โตไม่หยุด
+	3. แยก client ด้วย IP; IPv6 นับทั้ง /64 เพราะเครื่องเดียวมักได้ทั้ง prefix
+	4. อยู่หลัง load balancer ให้ตั้ง `TRUSTED_PROXIES` (CIDR) จึงจะเชื่อ `X-Forwarded-For` ของ proxy เหล่านั้น
+*/
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Once credentials are set up, every course write is made by a principal
+// with one of three roles, and the course service checks it:
+//
+//   - admins may create, edit and delete any course;
+//   - instructors may create courses and edit the ones they own, but not
+//     hand a course to someone else or delete one;
+//   - students are read-only.
+//
+// A course's owner is the subject of whoever created it, kept in its
+// owner field; an instructor also owns the courses whose instructor is
+// them, so courses from before owners were recorded stay editable. Only
+// admins may name or change an owner. OWNERSHIP_DISCLOSURE decides what
+// someone editing a course they do not own is told: forbidden (the
+// default) answers 403, not_found answers 404 as if the course did not
+// exist, so instructors cannot learn which IDs are taken.
+//
+// A JWT names its role in the "role" claim, or "roles" with the most
+// privileged one winning; tokens without either get JWT_DEFAULT_ROLE
+// (default student). An instructor is matched to courses by the "name"
+// claim. API keys are given a role when created, admin by default.
+// Sessions have the role of the credentials they were started with, and
+// those from the admin login are admins.
+
+const (
+	roleAdmin      = "admin"
+	roleInstructor = "instructor"
+	roleStudent    = "student"
+)
+
+// roles is ordered from most to least privileged.
+var roles = []string{roleAdmin, roleInstructor, roleStudent}
+
+// OWNERSHIP_DISCLOSURE values.
+const (
+	disclosureForbidden = "forbidden"
+	disclosureNotFound  = "not_found"
+)
+
+var (
+	jwtDefaultRole      = roleStudent
+	ownershipDisclosure = disclosureForbidden
+)
+
+func init() {
+	if v := os.Getenv("JWT_DEFAULT_ROLE"); v != "" {
+		if !slices.Contains(roles, v) {
+			log.Fatalf("Invalid JWT_DEFAULT_ROLE %q: use %s", v, strings.Join(roles, ", "))
+		}
+		jwtDefaultRole = v
+	}
+	switch v := os.Getenv("OWNERSHIP_DISCLOSURE"); v {
+	case "":
+	case disclosureForbidden, disclosureNotFound:
+		ownershipDisclosure = v
+	default:
+		log.Fatalf("Invalid OWNERSHIP_DISCLOSURE %q: use forbidden or not_found", v)
+	}
+}
+
+// principal is who a write is made by.
+type principal struct {
+	Subject string
+	Role    string // "" for a request without credentials
+	// Instructor is the course instructor an instructor acts as.
+	Instructor string
+	// Actor is the admin impersonating Subject (impersonation.go), ""
+	// when nobody is.
+	Actor string
+	// trace is the trace of the request the write is made in; the webhook
+	// deliveries it causes join it.
+	trace traceContext
+	// probe marks the synthetic probe (probe.go), whose writes stay out of
+	// the change feed.
+	probe bool
+	// audit is the request the write is made in, for its audit entry
+	// (audit.go); nil outside HTTP.
+	audit *auditScope
+	// tenant is the tenant whose domain the request came in on
+	// (tenants.go), nil for the main site.
+	tenant *tenant
+}
+
+// systemPrincipal makes writes that are not checked by role: every write
+// while no credentials are set up, and the admin routes (import,
+// migration), which have their own gate.
+var systemPrincipal = principal{Subject: "system", Role: roleAdmin}
+
+// requestPrincipal returns who r was authenticated as, in r's trace.
+func requestPrincipal(r *http.Request) principal {
+	p := authenticatedPrincipal(r)
+	p.trace = requestTrace(r)
+	p.audit = requestAuditScope(r)
+	p.tenant = requestTenant(r)
+	return p
+}
+
+func authenticatedPrincipal(r *http.Request) principal {
+	if isProbeRequest(r) {
+		return probePrincipal
+	}
+	if !authRequired() {
+		return systemPrincipal
+	}
+	if c, ok := requestClaims(r); ok {
+		return claimsPrincipal(c)
+	}
+	if k, ok := requestAPIKey(r); ok {
+		return principal{Subject: "api-key:" + strconv.Itoa(k.ID), Role: k.Role, Instructor: k.Instructor}
+	}
+	if c, ok := requestClientCert(r); ok {
+		return c.principal()
+	}
+	if s, ok := requestSession(r); ok {
+		return s.principal()
+	}
+	return principal{}
+}
+
+func claimsPrincipal(c jwtClaims) principal {
+	var claimed []string
+	if v, ok := c.Raw["role"].(string); ok {
+		claimed = append(claimed, v)
+	}
+	if list, ok := c.Raw["roles"].([]any); ok {
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				claimed = append(claimed, s)
+			}
+		}
+	}
+	p := principal{Subject: c.Subject, Role: jwtDefaultRole}
+	for _, role := range roles {
+		if slices.Contains(claimed, role) {
+			p.Role = role
+			break
+		}
+	}
+	p.Instructor, _ = c.Raw["name"].(string)
+	_, p.Actor = impersonationOf(c)
+	return p
+}
+
+// checkRole returns what is wrong with giving role, and for instructors
+// the instructor name, to a key or user, or "" if nothing is.
+func checkRole(role, instructor string) string {
+	switch {
+	case !slices.Contains(roles, role):
+		return "Unknown role " + strconv.Quote(role) + "; use " + strings.Join(roles, ", ")
+	case role == roleInstructor && instructor == "":
+		return "instructor is required for the instructor role"
+	case role != roleInstructor && instructor != "":
+		return "instructor is only for the instructor role"
+	}
+	return ""
+}
+
+// forbiddenError is a write the principal's role does not allow.
+type forbiddenError struct {
+	msg string
+	// notOwner marks a course the principal does not own, which
+	// OWNERSHIP_DISCLOSURE may turn into not found.
+	notOwner bool
+}
+
+func (e *forbiddenError) Error() string { return e.msg }
+
+// disclose applies OWNERSHIP_DISCLOSURE to an error from a policy check.
+func disclose(err error) error {
+	var forbidden *forbiddenError
+	if ownershipDisclosure == disclosureNotFound && errors.As(err, &forbidden) && forbidden.notOwner {
+		return errCourseNotFound
+	}
+	return err
+}
+
+func (p principal) readOnly() error {
+	if p.Role == "" {
+		return &forbiddenError{msg: "credentials are required to change courses"}
+	}
+	return &forbiddenError{msg: p.Role + "s cannot change courses"}
+}
+
+// teaches reports whether p is the instructor of c.
+func (p principal) teaches(c course) bool {
+	name := strings.TrimSpace(p.Instructor)
+	return name != "" && strings.EqualFold(name, strings.TrimSpace(c.Instructor))
+}
+
+// owns reports whether c is p's: p created it or teaches it.
+func (p principal) owns(c course) bool {
+	return (c.Owner != "" && c.Owner == p.Subject) || p.teaches(c)
+}
+
+// mayManageEnrollments reports why p may not act on the enrollments of
+// students of c other than p: admins and c's owners may.
+func (p principal) mayManageEnrollments(c course) error {
+	switch {
+	case p.Role == roleAdmin || p.owns(c):
+		return nil
+	case p.Role == "":
+		return &forbiddenError{msg: "credentials are required to manage enrollments"}
+	}
+	return &forbiddenError{msg: "only admins and the course's instructor can manage other students' enrollments"}
+}
+
+func (p principal) mayCreate(c course) error {
+	switch {
+	case p.Role == roleAdmin:
+		return nil
+	case p.Role != roleInstructor:
+		return p.readOnly()
+	case !p.teaches(c):
+		return &forbiddenError{msg: "instructors can only create their own courses"}
+	case c.Owner != "" && c.Owner != p.Subject:
+		return &forbiddenError{msg: "only admins can choose a course's owner"}
+	}
+	return nil
+}
+
+// mayEdit checks a change from current to updated, so an instructor can
+// neither edit someone else's course nor give their own away. Called with
+// current twice, it checks only that p may edit current at all.
+func (p principal) mayEdit(current, updated course) error {
+	switch {
+	case p.Role == roleAdmin:
+		return nil
+	case p.Role != roleInstructor:
+		return p.readOnly()
+	case !p.owns(current):
+		return &forbiddenError{msg: "instructors can only edit their own courses", notOwner: true}
+	case !strings.EqualFold(strings.TrimSpace(current.Instructor), strings.TrimSpace(updated.Instructor)) && !p.teaches(updated):
+		return &forbiddenError{msg: "instructors cannot hand a course to another instructor"}
+	case updated.Owner != current.Owner:
+		return &forbiddenError{msg: "only admins can change a course's owner"}
+	}
+	return nil
+}
+
+func (p principal) mayDelete() error {
+	if p.Role != roleAdmin {
+		return &forbiddenError{msg: "only admins can delete courses"}
+	}
+	return nil
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: กำหนดสิทธิ์ตามบทบาท (RBAC) ให้ทุกคนที่เขียนข้อมูล course
+
+	1. บทบาทมีสามแบบ
+	   - admin: สร้าง/แก้/ลบ course ใดก็ได้
+	   - instructor: สร้าง course และแก้เฉพาะ course ที่ตัวเองเป็นเจ้าของ (สร้างเอง หรือเป็นผู้สอน) ลบไม่ได้ และยก course ให้คนอื่นไม่ได้
+	   - student: อ่านอย่างเดียว
+	2. ที่มาของบทบาท
+	   - JWT: claim `role` หรือ `roles` (เลือกสิทธิ์สูงสุด) ไม่มีก็ใช้ `JWT_DEFAULT_ROLE` (ค่าเริ่มต้น student) ชื่อผู้สอนมาจาก claim `name`
+	   - API key: กำหนด `role` ตอนสร้าง (ค่าเริ่มต้น admin) / session จากหน้า login เป็น admin
+	3. ตรวจที่ service layer (`createCourse`, `updateCourse`, `deleteCourse`) REST, GraphQL และ gRPC จึงใช้กฎเดียวกัน ผิดกฎได้ 403 / PERMISSION_DENIED
+	4. ถ้ายังไม่ได้ตั้ง JWT หรือ API key ทุกคนเขียนได้เหมือนเดิม (`systemPrincipal`)
+	5. course มี `owner` = subject ของผู้สร้าง เปลี่ยนได้เฉพาะ admin
+	   - `OWNERSHIP_DISCLOSURE=forbidden` (ค่าเริ่มต้น) แก้ course ของคนอื่นได้ 403, `not_found` ได้ 404 เหมือนไม่มี course นั้น จะได้เดา ID ไม่ได้
+*/
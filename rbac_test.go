@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	var (
+		admin      = principal{Subject: "root", Role: roleAdmin}
+		teacher    = principal{Subject: "ann", Role: roleInstructor, Instructor: "Ann"}
+		creator    = principal{Subject: "carl", Role: roleInstructor, Instructor: "Carl"}
+		other      = principal{Subject: "dan", Role: roleInstructor, Instructor: "Dan"}
+		student    = principal{Subject: "bob", Role: roleStudent}
+		anonymous  = principal{}
+		current    = course{CourseId: 1, CourseName: "Go", Instructor: "Ann", Owner: "carl"}
+		with       = func(edit func(*course)) *course { c := current; edit(&c); return &c }
+		renamed    = with(func(c *course) { c.CourseName = "Go 2" })
+		handedOver = with(func(c *course) { c.Instructor = "Dan" })
+		reowned    = with(func(c *course) { c.Owner = "ann" })
+	)
+	for _, tt := range []struct {
+		name             string
+		who              principal
+		action           string
+		current, updated *course
+		err              string // "" when allowed
+		notOwner         bool
+	}{
+		{"admin creates", admin, actionCreate, nil, &course{Instructor: "Dan", Owner: "dan"}, "", false},
+		{"instructor creates their own", teacher, actionCreate, nil, &course{Instructor: " ann "}, "", false},
+		{"instructor creates for another", teacher, actionCreate, nil, &course{Instructor: "Dan"}, "only create their own", false},
+		{"instructor names an owner", teacher, actionCreate, nil, &course{Instructor: "Ann", Owner: "dan"}, "choose a course's owner", false},
+		{"student creates", student, actionCreate, nil, &course{Instructor: "Bob"}, "students cannot change courses", false},
+		{"anonymous creates", anonymous, actionCreate, nil, &course{}, "credentials are required", false},
+		{"system creates", systemPrincipal, actionCreate, nil, &course{}, "", false},
+
+		{"admin edits", admin, actionUpdate, &current, reowned, "", false},
+		{"instructor edits a course they teach", teacher, actionUpdate, &current, renamed, "", false},
+		{"instructor edits a course they created", creator, actionUpdate, &current, renamed, "", false},
+		{"instructor edits another's course", other, actionUpdate, &current, renamed, "only edit their own", true},
+		{"instructor may edit at all", teacher, actionUpdate, &current, nil, "", false},
+		{"instructor may not edit at all", other, actionUpdate, &current, nil, "only edit their own", true},
+		{"instructor hands a course over", teacher, actionUpdate, &current, handedOver, "hand a course", false},
+		{"instructor changes the owner", teacher, actionUpdate, &current, reowned, "change a course's owner", false},
+		{"student edits", student, actionUpdate, &current, renamed, "students cannot change courses", false},
+		{"anonymous edits", anonymous, actionUpdate, &current, renamed, "credentials are required", false},
+
+		{"admin deletes", admin, actionDelete, &current, nil, "", false},
+		{"instructor deletes their own", teacher, actionDelete, &current, nil, "only admins can delete", false},
+		{"student deletes", student, actionDelete, &current, nil, "only admins can delete", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authorize(tt.who, tt.action, tt.current, tt.updated)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("authorize = %v, want nil", err)
+				}
+				return
+			}
+			var forbidden *forbiddenError
+			if !errors.As(err, &forbidden) || !strings.Contains(forbidden.msg, tt.err) || forbidden.notOwner != tt.notOwner {
+				t.Errorf("authorize = %#v, want a forbiddenError containing %q with notOwner %v", err, tt.err, tt.notOwner)
+			}
+		})
+	}
+}
+
+func TestDisclose(t *testing.T) {
+	old := ownershipDisclosure
+	t.Cleanup(func() { ownershipDisclosure = old })
+	notOwner := &forbiddenError{msg: "instructors can only edit their own courses", notOwner: true}
+	readOnly := &forbiddenError{msg: "students cannot change courses"}
+
+	ownershipDisclosure = disclosureForbidden
+	if err := disclose(notOwner); err != notOwner {
+		t.Errorf("forbidden: disclose(not owner) = %v, want it unchanged", err)
+	}
+	ownershipDisclosure = disclosureNotFound
+	if err := disclose(notOwner); !errors.Is(err, errCourseNotFound) {
+		t.Errorf("not_found: disclose(not owner) = %v, want %v", err, errCourseNotFound)
+	}
+	if err := disclose(readOnly); err != readOnly {
+		t.Errorf("not_found: disclose(read only) = %v, want it unchanged", err)
+	}
+}
+
+func TestMayManageEnrollments(t *testing.T) {
+	c := course{CourseId: 1, Instructor: "Ann", Owner: "carl"}
+	for _, tt := range []struct {
+		name string
+		who  principal
+		ok   bool
+	}{
+		{"admin", principal{Subject: "root", Role: roleAdmin}, true},
+		{"teacher", principal{Subject: "ann", Role: roleInstructor, Instructor: "ANN"}, true},
+		{"creator", principal{Subject: "carl", Role: roleInstructor}, true},
+		{"other instructor", principal{Subject: "dan", Role: roleInstructor, Instructor: "Dan"}, false},
+		{"instructor without a name", principal{Subject: "eve", Role: roleInstructor}, false},
+		{"student", principal{Subject: "bob", Role: roleStudent}, false},
+		{"anonymous", principal{}, false},
+	} {
+		if err := tt.who.mayManageEnrollments(c); (err == nil) != tt.ok {
+			t.Errorf("%s: mayManageEnrollments = %v, want allowed %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestMayChangeFields(t *testing.T) {
+	old := fieldRules
+	t.Cleanup(func() { fieldRules = old })
+	fieldRules = map[string]fieldRule{
+		"price":         {Field: "price", EditableBy: []string{roleAdmin, roleInstructor}},
+		"seats":         {Field: "seats", EditableBy: []string{roleAdmin}},
+		"metadata.cost": {Field: "metadata.cost", VisibleTo: []string{roleAdmin}},
+		"private":       {Field: "private", EditableBy: []string{}},
+	}
+	admin := principal{Subject: "root", Role: roleAdmin}
+	instructor := principal{Subject: "ann", Role: roleInstructor, Instructor: "Ann"}
+	student := principal{Subject: "bob", Role: roleStudent}
+
+	current := course{CourseId: 1, CourseName: "Go", CoursePrice: 100, Seats: 10, Metadata: map[string]any{"cost": 40.0, "level": "intro"}}
+	with := func(edit func(*course)) course {
+		c := current
+		c.Metadata = map[string]any{"cost": 40.0, "level": "intro"}
+		edit(&c)
+		return c
+	}
+	for _, tt := range []struct {
+		name             string
+		who              principal
+		current, updated course
+		err              string // "" when allowed
+	}{
+		{"unruled field", instructor, current, with(func(c *course) { c.CourseName = "Go 2" }), ""},
+		{"unruled metadata key", student, current, with(func(c *course) { c.Metadata["level"] = "advanced" }), ""},
+		{"nothing changes", student, current, with(func(*course) {}), ""},
+		{"instructor sets price", instructor, current, with(func(c *course) { c.CoursePrice = 120 }), ""},
+		{"student sets price", student, current, with(func(c *course) { c.CoursePrice = 120 }), "students cannot update price"},
+		{"admin sets seats", admin, current, with(func(c *course) { c.Seats = 20 }), ""},
+		{"instructor sets seats", instructor, current, with(func(c *course) { c.Seats = 20 }), "instructors cannot update seats"},
+		{"admin sets hidden metadata", admin, current, with(func(c *course) { c.Metadata["cost"] = 50.0 }), ""},
+		{"instructor sets hidden metadata", instructor, current, with(func(c *course) { c.Metadata["cost"] = 50.0 }), "instructors cannot update metadata.cost"},
+		{"instructor drops hidden metadata", instructor, current, with(func(c *course) { delete(c.Metadata, "cost") }), "metadata.cost"},
+		{"read-only for everyone", admin, current, with(func(c *course) { c.Private = true }), "admins cannot update private"},
+		{"new course with seats", instructor, course{}, course{CourseName: "Go", Seats: 5}, "instructors cannot update seats"},
+		{"new course without ruled fields", student, course{}, course{CourseName: "Go"}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.who.mayChangeFields(tt.current, tt.updated, "update")
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("mayChangeFields = %v, want nil", err)
+				}
+				return
+			}
+			var forbidden *forbiddenError
+			if !errors.As(err, &forbidden) || !strings.Contains(forbidden.msg, tt.err) {
+				t.Errorf("mayChangeFields = %v, want a forbiddenError containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const mediaTypeJSON = "application/json"
+
+// codec is one wire format. Handlers never encode or decode bodies
+// themselves; they call writeCourse, writeCourses, writeValue, writeError,
+// unmarshalCourse and decodeBody, which pick the codec from the request.
+//
+// Formats with a natural generic mapping (JSON, YAML, MessagePack) set
+// encodeValue/decodeValue and so serve every endpoint. Course-specific
+// formats (JSON:API, XML, protobuf) only set the course functions; other
+// endpoints answer those clients in JSON.
+type codec struct {
+	mediaType   string
+	contentType string // Content-Type header value, with charset if any
+
+	encodeCourse  func(r *http.Request, c course) ([]byte, error)
+	encodeCourses func(r *http.Request, courses []course) ([]byte, error)
+	decodeCourse  func(body []byte, dst *course) error
+
+	// encodeError returns an error document naming the request's ID; nil
+	// means plain text.
+	encodeError func(status int, message, requestID string) ([]byte, error)
+
+	encodeValue func(v any) ([]byte, error)
+	decodeValue func(body []byte, v any) error
+}
+
+var jsonCodec = &codec{
+	mediaType:   mediaTypeJSON,
+	contentType: mediaTypeJSON,
+	encodeCourse: func(r *http.Request, c course) ([]byte, error) {
+		return json.Marshal(newRequestCourseResource(r, c))
+	},
+	encodeCourses: func(r *http.Request, courses []course) ([]byte, error) {
+		return json.Marshal(newRequestCourseResources(r, courses))
+	},
+	decodeCourse: func(body []byte, dst *course) error { return json.Unmarshal(body, dst) },
+	encodeValue:  json.Marshal,
+	decodeValue:  json.Unmarshal,
+}
+
+// codecs are the supported formats. The first is the default when the
+// client expresses no preference.
+var codecs = []*codec{jsonCodec, jsonAPICodec, xmlCodec, yamlCodec, protobufCodec, msgpackCodec}
+
+// mediaTypeAliases maps alternative names clients send to the one we use.
+var mediaTypeAliases = map[string]string{
+	"text/xml":           mediaTypeXML,
+	"application/x-yaml": mediaTypeYAML,
+	"text/yaml":          mediaTypeYAML,
+	"text/x-yaml":        mediaTypeYAML,
+
+	"application/protobuf":            mediaTypeProtobuf,
+	"application/vnd.google.protobuf": mediaTypeProtobuf,
+
+	"application/x-msgpack":   mediaTypeMsgpack,
+	"application/vnd.msgpack": mediaTypeMsgpack,
+}
+
+func codecFor(mediaType string) *codec {
+	if alias, ok := mediaTypeAliases[mediaType]; ok {
+		mediaType = alias
+	}
+	for _, c := range codecs {
+		if c.mediaType == mediaType {
+			return c
+		}
+	}
+	return nil
+}
+
+// negotiate returns the media type responseCodec picks.
+func negotiate(r *http.Request) string {
+	return responseCodec(r).mediaType
+}
+
+// responseCodec picks the response format from the Accept header, honoring
+// q-values and falling back to JSON when nothing acceptable is offered.
+// JSON with the compact profile gets compactCodec (compact.go).
+func responseCodec(r *http.Request) *codec {
+	type candidate struct {
+		codec  *codec
+		q      float64
+		params map[string]string
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if c := codecFor(mediaType); c != nil && q > 0 {
+			candidates = append(candidates, candidate{c, q, params})
+		}
+	}
+	// Stable, so equal q-values keep the client's order.
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		}
+		return 0
+	})
+	if len(candidates) > 0 {
+		if profile, ok := compactProfile(candidates[0].params); ok && candidates[0].codec == jsonCodec {
+			return compactCodec(profile)
+		}
+		return candidates[0].codec
+	}
+	return codecs[0]
+}
+
+// requestCodec returns the codec for the request body. Requests without a
+// Content-Type, or with one we do not know, are read as JSON as they
+// always have been.
+func requestCodec(r *http.Request) *codec {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if c := codecFor(mediaType); c != nil {
+		return c
+	}
+	return jsonCodec
+}
+
+// valueCodec is the codec used for payloads other than courses.
+func valueCodec(r *http.Request) *codec {
+	if c := responseCodec(r); c.encodeValue != nil {
+		return c
+	}
+	return jsonCodec
+}
+
+// wantsJSONAPI reports whether the client asked for JSON:API documents.
+func wantsJSONAPI(r *http.Request) bool {
+	return negotiate(r) == mediaTypeJSONAPI
+}
+
+func writeBody(w http.ResponseWriter, status int, c *codec, body []byte, err error) {
+	if err != nil {
+		slog.Error("Error marshaling response", "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", c.contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// newRequestCourseResource is newCourseResource plus anything the request
+// asked to be added, such as pricing in a specific currency.
+func newRequestCourseResource(r *http.Request, c course) courseResource {
+	res := newCourseResource(c)
+	res.Pricing = pricingFor(r, c)
+	return res
+}
+
+func newRequestCourseResources(r *http.Request, courses []course) []courseResource {
+	resources := make([]courseResource, len(courses))
+	for i, c := range courses {
+		resources[i] = newRequestCourseResource(r, c)
+	}
+	return resources
+}
+
+// writeCourse writes a single course in the format the client negotiated,
+// as the requester may see it.
+func writeCourse(w http.ResponseWriter, r *http.Request, status int, c course) {
+	w.Header().Add("Vary", "Accept")
+	who := viewer(w, r)
+	cd := responseCodec(r)
+	body, err := cd.encodeCourse(r, courseView(who, c))
+	writeBody(w, status, cd, body, err)
+}
+
+// writeCourses writes a list of courses in the format the client
+// negotiated, as the requester may see them.
+func writeCourses(w http.ResponseWriter, r *http.Request, courses []course) {
+	w.Header().Add("Vary", "Accept")
+	who := viewer(w, r)
+	cd := responseCodec(r)
+	body, err := cd.encodeCourses(r, coursesView(who, courses))
+	writeBody(w, http.StatusOK, cd, body, err)
+}
+
+// viewer is who courses written to r are mapped for. A response with
+// fields the public does not see is kept out of shared caches.
+func viewer(w http.ResponseWriter, r *http.Request) principal {
+	who := requestPrincipal(r)
+	if who.seesHiddenFields() {
+		w.Header().Set("Cache-Control", privateCacheControl)
+	}
+	return who
+}
+
+// writeValue writes any other payload in the negotiated format when that
+// format can represent arbitrary values, and as JSON otherwise.
+func writeValue(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Add("Vary", "Accept")
+	cd := valueCodec(r)
+	body, err := cd.encodeValue(v)
+	writeBody(w, status, cd, body, err)
+}
+
+// writeError reports an error to the client as an error document in the
+// negotiated format, or as the plain text body http.Error produces for the
+// default format and formats without one. Either names the request's ID,
+// so a client reporting the error can quote it.
+func writeError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	cd := responseCodec(r)
+	id := requestID(r)
+	if cd.encodeError == nil {
+		if id != "" {
+			message += "\nRequest ID: " + id
+		}
+		http.Error(w, message, status)
+		return
+	}
+	body, err := cd.encodeError(status, message, id)
+	writeBody(w, status, cd, body, err)
+}
+
+// unmarshalCourse decodes a request body onto dst in the format named by
+// its Content-Type. Fields missing from the body keep the value dst
+// already has.
+func unmarshalCourse(r *http.Request, body []byte, dst *course) error {
+	return requestCodec(r).decodeCourse(body, dst)
+}
+
+// invalidCourseBody is the message for a course body unmarshalCourse could
+// not decode, naming the format it was read as.
+func invalidCourseBody(r *http.Request) string {
+	if cd := requestCodec(r); cd != jsonCodec {
+		return "Invalid request body (" + cd.mediaType + ")"
+	}
+	return "Invalid JSON format"
+}
+
+// decodeBody reads the request body into v using the request's format. It
+// writes the error response itself and reports whether decoding succeeded.
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	cd := requestCodec(r)
+	if cd.decodeValue == nil {
+		writeError(w, r, "Unsupported request body format", http.StatusUnsupportedMediaType)
+		return false
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return false
+	}
+	defer r.Body.Close()
+	if err := cd.decodeValue(body, v); err != nil {
+		writeError(w, r, "Invalid request body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Content Negotiation และ Codec Layer
+
+	1. client เลือกรูปแบบ response ได้เองผ่าน `Accept` และบอกรูปแบบของ body ที่ส่งมาผ่าน `Content-Type`
+	   - รองรับ JSON (ค่าเริ่มต้น), JSON:API, XML, YAML, Protocol Buffers และ MessagePack
+	   - `responseCodec` เคารพค่า q (`Accept: application/xml;q=0.9, application/json`) และถ้าไม่มีรูปแบบที่รองรับจะตอบเป็น JSON
+	2. แต่ละรูปแบบคือ `codec` หนึ่งตัวที่รวมฟังก์ชัน encode/decode ไว้ด้วยกัน handler จึงไม่ต้องมี `switch` แยกตามรูปแบบเอง
+	   - เพิ่มรูปแบบใหม่ = สร้าง codec ใหม่แล้วใส่ใน `codecs` โดยไม่ต้องแก้ handler เลย
+	3. รูปแบบที่รองรับข้อมูลทั่วไป (JSON, YAML, MessagePack) ใช้ได้กับทุก endpoint ผ่าน `writeValue`/`decodeBody`
+	   ส่วนรูปแบบเฉพาะ course (JSON:API, XML, protobuf) endpoint อื่นจะตอบเป็น JSON แทน
+*/
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The runbook endpoints do the routine on-call fixes over HTTP instead of
+// on a shell:
+//
+//	POST /admin/runbook/flush-caches         drop the catalog cache, rebuild the metadata index
+//	POST /admin/runbook/rotate-signing-keys  {"webhook_id": 3} or {} for every webhook
+//	POST /admin/runbook/rotate-jwt-keys      {"drop": true} to drop the current key at once
+//	POST /admin/runbook/redeliver-webhooks   {"webhook_id": 3, "delivery_ids": ["..."]}
+//	POST /admin/runbook/requeue-dead-letters {"kind": "webhook"} or {} for every dead letter
+//	POST /admin/runbook/snapshot             write the store to SNAPSHOT_DIR
+//
+// They sit under /admin, so its credentials are needed, and on top of that
+// the caller must be an admin by rbac.go's rules. Every run, whether it
+// worked or not, is logged and kept in an audit trail that
+// GET /admin/runbook returns with the list of actions.
+
+const maxRunbookAudit = 200
+
+var snapshotDir = os.Getenv("SNAPSHOT_DIR")
+
+// runbookError is an action failing for a reason the caller can act on;
+// other errors are the server's fault.
+type runbookError struct {
+	status int
+	msg    string
+}
+
+func (e *runbookError) Error() string { return e.msg }
+
+type runbookAction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	run func(params json.RawMessage) (any, error)
+	// secret actions return secrets, which are answered but not audited.
+	secret bool
+}
+
+var runbookActions = []runbookAction{
+	{Name: "flush-caches", Description: "Drop the cached catalog responses and rebuild the metadata search index", run: flushCaches},
+	{Name: "rotate-signing-keys", Description: "Give webhooks new signing secrets", run: rotateSigningKeys, secret: true},
+	{Name: "rotate-jwt-keys", Description: "Rotate the managed JWT signing keys now", run: rotateJWTKeysAction},
+	{Name: "redeliver-webhooks", Description: "Send webhook deliveries again, whatever their status", run: redeliverWebhooks},
+	{Name: "requeue-dead-letters", Description: "Run every dead-lettered job again", run: requeueAllDeadLetters},
+	{Name: "snapshot", Description: "Write every course, enrollment and order to a file in SNAPSHOT_DIR", run: snapshotStore},
+}
+
+type runbookAuditEntry struct {
+	ID     int             `json:"id"`
+	Action string          `json:"action"`
+	By     string          `json:"by"`
+	At     time.Time       `json:"at"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result any             `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+var (
+	// runbookMu protects runbookAudit, newest last.
+	runbookMu        sync.Mutex
+	runbookAudit     []runbookAuditEntry
+	nextRunbookAudit = 1
+)
+
+// operatorPrincipal returns who is calling an admin route. The admin gate
+// has already let r through, so a session or the admin Basic credentials
+// make an admin; with the gate off it is whoever r's other credentials
+// say.
+func operatorPrincipal(r *http.Request) principal {
+	if s, ok := requestSession(r); ok {
+		return s.principal()
+	}
+	if user, password, ok := r.BasicAuth(); ok && adminUsername != "" && checkAdminCredentials(user, password) {
+		return principal{Subject: "admin:" + user, Role: roleAdmin}
+	}
+	return requestPrincipal(r)
+}
+
+// adminRunbookHandler serves GET /admin/runbook: the actions, and the
+// audit trail newest first.
+func adminRunbookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	runbookMu.Lock()
+	audit := slices.Clone(runbookAudit)
+	runbookMu.Unlock()
+	slices.Reverse(audit)
+	writeValue(w, r, http.StatusOK, map[string]any{"actions": runbookActions, "audit": audit})
+}
+
+// adminRunbookActionHandler serves POST /admin/runbook/{action}. The body,
+// if any, holds the action's parameters.
+func adminRunbookActionHandler(w http.ResponseWriter, r *http.Request) {
+	i := slices.IndexFunc(runbookActions, func(a runbookAction) bool { return a.Name == r.PathValue("action") })
+	if i < 0 {
+		writeError(w, r, "Unknown runbook action", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	action := runbookActions[i]
+	who := operatorPrincipal(r)
+	if who.Role != roleAdmin {
+		requestLogger(r).Warn("Runbook refused", "action", action.Name, "subject", who.Subject, "role", who.Role)
+		writeError(w, r, "Forbidden: only admins can run runbook actions", http.StatusForbidden)
+		return
+	}
+	var params json.RawMessage
+	if r.ContentLength != 0 && !decodeBody(w, r, &params) {
+		return
+	}
+
+	result, err := action.run(params)
+	entry := runbookAuditEntry{Action: action.Name, By: who.Subject, At: time.Now().UTC(), Params: params}
+	if err != nil {
+		entry.Error = err.Error()
+	} else if !action.secret {
+		entry.Result = result
+	}
+	runbookMu.Lock()
+	entry.ID = nextRunbookAudit
+	nextRunbookAudit++
+	runbookAudit = append(runbookAudit, entry)
+	if n := len(runbookAudit) - maxRunbookAudit; n > 0 {
+		runbookAudit = slices.Delete(runbookAudit, 0, n)
+	}
+	runbookMu.Unlock()
+
+	if err != nil {
+		requestLogger(r).Error("Runbook failed", "action", action.Name, "subject", who.Subject, "err", err)
+		var re *runbookError
+		if errors.As(err, &re) {
+			writeError(w, r, re.msg, re.status)
+		} else {
+			writeError(w, r, "Runbook action failed", http.StatusInternalServerError)
+		}
+		return
+	}
+	requestLogger(r).Info("Runbook run", "action", action.Name, "subject", who.Subject)
+	entry.Result = result
+	writeValue(w, r, http.StatusOK, entry)
+}
+
+// decodeRunbookParams reads params into v. No params leaves v as it is.
+func decodeRunbookParams(params json.RawMessage, v any) error {
+	if len(params) == 0 || string(params) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &runbookError{http.StatusBadRequest, "Invalid parameters: " + err.Error()}
+	}
+	return nil
+}
+
+func flushCaches(json.RawMessage) (any, error) {
+	result := map[string]any{}
+	if c := activeCatalogCache; c != nil {
+		result["catalog_responses"] = c.purge()
+	}
+	courseMu.Lock()
+	clear(metadataIndex)
+	clear(indexedMetadata)
+	for _, c := range CourseList {
+		reindexMetadata(c.CourseId)
+	}
+	result["indexed_courses"] = len(indexedMetadata)
+	courseMu.Unlock()
+	return result, nil
+}
+
+// runbookWebhooks returns the webhook with the given ID, or every webhook
+// for 0. It is called with webhookMu held.
+func runbookWebhooks(id int) ([]*webhook, error) {
+	if id == 0 {
+		return webhooks, nil
+	}
+	h := findWebhook(id)
+	if h == nil {
+		return nil, &runbookError{http.StatusNotFound, fmt.Sprintf("Webhook %d not found", id)}
+	}
+	return []*webhook{h}, nil
+}
+
+// rotateSigningKeys replaces webhook secrets. The keys this server signs
+// JWTs with have rotate-jwt-keys.
+func rotateSigningKeys(params json.RawMessage) (any, error) {
+	var req struct {
+		WebhookID int `json:"webhook_id"`
+	}
+	if err := decodeRunbookParams(params, &req); err != nil {
+		return nil, err
+	}
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	hooks, err := runbookWebhooks(req.WebhookID)
+	if err != nil {
+		return nil, err
+	}
+	type rotated struct {
+		WebhookID int    `json:"webhook_id"`
+		Secret    string `json:"secret"`
+	}
+	list := []rotated{}
+	for _, h := range hooks {
+		list = append(list, rotated{h.ID, h.rotateSecret()})
+	}
+	return list, nil
+}
+
+type requeuedDeliveries struct {
+	WebhookID  int      `json:"webhook_id"`
+	Deliveries []string `json:"deliveries"`
+}
+
+func redeliverWebhooks(params json.RawMessage) (any, error) {
+	var req struct {
+		WebhookID   int      `json:"webhook_id"`
+		DeliveryIDs []string `json:"delivery_ids"`
+	}
+	if err := decodeRunbookParams(params, &req); err != nil {
+		return nil, err
+	}
+	if req.WebhookID == 0 || len(req.DeliveryIDs) == 0 {
+		return nil, &runbookError{http.StatusBadRequest, "webhook_id and delivery_ids are required"}
+	}
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	h := findWebhook(req.WebhookID)
+	if h == nil {
+		return nil, &runbookError{http.StatusNotFound, fmt.Sprintf("Webhook %d not found", req.WebhookID)}
+	}
+	// Check them all before sending any, so a bad ID sends nothing.
+	var due []*webhookDelivery
+	for _, id := range req.DeliveryIDs {
+		i := slices.IndexFunc(h.deliveries, func(d *webhookDelivery) bool { return d.ID == id })
+		switch {
+		case i < 0:
+			return nil, &runbookError{http.StatusNotFound, fmt.Sprintf("Delivery %s not found", id)}
+		case h.deliveries[i].Status == "pending":
+			return nil, &runbookError{http.StatusConflict, fmt.Sprintf("Delivery %s is still being sent", id)}
+		}
+		if !slices.Contains(due, h.deliveries[i]) {
+			due = append(due, h.deliveries[i])
+		}
+	}
+	done := requeuedDeliveries{WebhookID: h.ID, Deliveries: []string{}}
+	for _, d := range due {
+		h.redeliver(d)
+		done.Deliveries = append(done.Deliveries, d.ID)
+	}
+	return done, nil
+}
+
+// requeueAllDeadLetters requeues the dead-letter store (deadletters.go),
+// or only the dead letters of one kind.
+func requeueAllDeadLetters(params json.RawMessage) (any, error) {
+	var req struct {
+		Kind string `json:"kind"`
+	}
+	if err := decodeRunbookParams(params, &req); err != nil {
+		return nil, err
+	}
+	requeued, failed := requeueDeadLetters(selectDeadLetters(nil, req.Kind))
+	return map[string]any{"requeued": requeued, "failed": failed}, nil
+}
+
+type storeSnapshot struct {
+	TakenAt time.Time                      `json:"taken_at"`
+	Tables  map[string][]map[string]string `json:"tables"`
+}
+
+// snapshotStore writes every exported table to
+// SNAPSHOT_DIR/snapshot-<time>.json. Like the export files, it is renamed
+// into place once complete.
+func snapshotStore(json.RawMessage) (any, error) {
+	if snapshotDir == "" {
+		return nil, &runbookError{http.StatusConflict, "Snapshots are not enabled; set SNAPSHOT_DIR"}
+	}
+	snap := storeSnapshot{TakenAt: time.Now().UTC(), Tables: map[string][]map[string]string{}}
+	counts := map[string]int{}
+	for _, t := range exportTables {
+		rows := []map[string]string{}
+		for _, row := range t.snapshot() {
+			m := make(map[string]string, len(t.columns))
+			for i, col := range t.columns {
+				m[col] = row[i]
+			}
+			rows = append(rows, m)
+		}
+		snap.Tables[t.name] = rows
+		counts[t.name] = len(rows)
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(snapshotDir, 0o755); err != nil {
+		return nil, err
+	}
+	name := "snapshot-" + snap.TakenAt.Format("20060102T150405Z") + ".json"
+	tmp, err := os.CreateTemp(snapshotDir, ".snapshot-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(snapshotDir, name)); err != nil {
+		return nil, err
+	}
+	return map[string]any{"file": name, "bytes": len(data), "rows": counts}, nil
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: endpoint สำหรับงาน on-call ที่ทำบ่อย ไม่ต้องเข้า shell ของเครื่อง
+
+	1. `POST /admin/runbook/{action}` มีหกอย่าง
+	   - `flush-caches`: ล้าง cache ของ catalog (`-cache`/`-upstream`) และสร้าง index ของ metadata ใหม่
+	   - `rotate-signing-keys`: เปลี่ยน secret ที่ใช้เซ็น webhook (ทีละตัวหรือทั้งหมด) secret ใหม่ตอบกลับครั้งเดียว ไม่เก็บใน audit
+	   - `rotate-jwt-keys`: หมุน key ที่ใช้เซ็น JWT ทันที (signingkeys.go) `{"drop": true}` ทิ้ง key ปัจจุบันเลยเมื่อรั่ว
+	   - `redeliver-webhooks`: ส่ง delivery ที่ระบุซ้ำ ไม่ว่าสถานะเดิมจะเป็นอะไร (ยกเว้นที่กำลังส่งอยู่)
+	   - `requeue-dead-letters`: รันทุกงานใน dead-letter store ใหม่ (`deadletters.go`) เลือกเฉพาะ `kind` ได้
+	   - `snapshot`: เขียน course, enrollment และ order ทั้งหมดเป็นไฟล์ JSON ใน `SNAPSHOT_DIR`
+	2. ต้องผ่าน gate ของ `/admin` และต้องเป็น role admin (`operatorPrincipal`) ไม่งั้นได้ 403
+	3. ทุกครั้งที่สั่ง ทั้งสำเร็จและล้มเหลว ถูก log และเก็บใน audit trail (200 รายการล่าสุด) ดูได้ที่ `GET /admin/runbook`
+*/
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Catalog queries can filter and sort on custom metadata:
+//
+//	GET /courses?meta.campus=BKK&meta.cohort=2026-A&sort=-meta.credits
+//
+// Filters are exact matches, ANDed together; a repeated parameter
+// (meta.campus=BKK&meta.campus=CNX) matches any of its values. Filters are
+// answered from metadataIndex, which recordChange keeps up to date, so they
+// do not scan every course's metadata.
+
+const metaParamPrefix = "meta."
+
+// metadataIndex maps key -> value -> IDs of the courses with that value.
+// indexedMetadata remembers what each course contributed so an update can
+// take its old entries out. Both are protected by courseMu.
+var (
+	metadataIndex   = make(map[string]map[string]map[int]bool)
+	indexedMetadata = make(map[int]map[string]string)
+)
+
+// metadataIndexValue is the form values take in the index and in query
+// strings: numbers without trailing zeros, booleans as true/false.
+func metadataIndexValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// reindexMetadata replaces the index entries of course id with those of its
+// current state. Callers must hold courseMu for writing.
+func reindexMetadata(id int) {
+	for k, v := range indexedMetadata[id] {
+		ids := metadataIndex[k][v]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(metadataIndex[k], v)
+		}
+		if len(metadataIndex[k]) == 0 {
+			delete(metadataIndex, k)
+		}
+	}
+	delete(indexedMetadata, id)
+
+	i := findCourseIndex(id)
+	if i < 0 || len(CourseList[i].Metadata) == 0 {
+		return
+	}
+	entries := make(map[string]string, len(CourseList[i].Metadata))
+	for k, raw := range CourseList[i].Metadata {
+		v := metadataIndexValue(raw)
+		entries[k] = v
+		if metadataIndex[k] == nil {
+			metadataIndex[k] = make(map[string]map[int]bool)
+		}
+		if metadataIndex[k][v] == nil {
+			metadataIndex[k][v] = make(map[int]bool)
+		}
+		metadataIndex[k][v][id] = true
+	}
+	indexedMetadata[id] = entries
+}
+
+// metadataFilters returns the meta.* query parameters as key -> accepted
+// values, checking the keys against rules.
+func metadataFilters(q url.Values, rules map[string]string) (map[string][]string, error) {
+	filters := map[string][]string{}
+	for param, values := range q {
+		key, ok := strings.CutPrefix(param, metaParamPrefix)
+		if !ok {
+			continue
+		}
+		if err := checkMetadataQueryKey(key, rules); err != nil {
+			return nil, err
+		}
+		filters[key] = values
+	}
+	return filters, nil
+}
+
+func checkMetadataQueryKey(key string, rules map[string]string) error {
+	if !metadataKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid metadata key %q", key)
+	}
+	if _, ok := rules[key]; rules != nil && !ok {
+		return fmt.Errorf("metadata key %q is not allowed; allowed keys: %s", key, strings.Join(allowedMetadataKeys(rules), ", "))
+	}
+	return nil
+}
+
+// filterByMetadata keeps the courses matching every filter, in their
+// original order. Callers must hold courseMu.
+func filterByMetadata(courses []course, filters map[string][]string) []course {
+	if len(filters) == 0 {
+		return courses
+	}
+	return slices.DeleteFunc(courses, func(c course) bool {
+		for key, values := range filters {
+			if !slices.ContainsFunc(values, func(v string) bool { return metadataIndex[key][v][c.CourseId] }) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// courseSortKey is one field of ?sort=, e.g. "-price" or "meta.credits".
+type courseSortKey struct {
+	field string // "id", "name", "price" or a metadata key
+	meta  bool
+	desc  bool
+}
+
+func parseCourseSort(s string, rules map[string]string) ([]courseSortKey, error) {
+	var keys []courseSortKey
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var k courseSortKey
+		part, k.desc = strings.CutPrefix(part, "-")
+		if key, ok := strings.CutPrefix(part, metaParamPrefix); ok {
+			if err := checkMetadataQueryKey(key, rules); err != nil {
+				return nil, err
+			}
+			k.field, k.meta = key, true
+		} else {
+			switch part {
+			case "id", "name", "price":
+				k.field = part
+			default:
+				return nil, fmt.Errorf("cannot sort by %q", part)
+			}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// compareMetadata orders metadata values: numbers numerically, strings
+// lexically, booleans false first; values of different types by type.
+func compareMetadata(a, b any) int {
+	ta, tb := metadataType(a), metadataType(b)
+	if ta != tb {
+		return cmp.Compare(ta, tb)
+	}
+	switch a := a.(type) {
+	case float64:
+		return cmp.Compare(a, b.(float64))
+	case string:
+		return cmp.Compare(a, b.(string))
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case !a:
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// sortCourses sorts courses in place by keys. Courses without a metadata
+// key go last whatever the direction, so a descending sort still starts
+// with real values; ties keep catalog order.
+func sortCourses(courses []course, keys []courseSortKey) {
+	if len(keys) == 0 {
+		return
+	}
+	slices.SortStableFunc(courses, func(a, b course) int {
+		for _, k := range keys {
+			var c int
+			switch {
+			case !k.meta && k.field == "id":
+				c = cmp.Compare(a.CourseId, b.CourseId)
+			case !k.meta && k.field == "name":
+				c = cmp.Compare(strings.ToLower(a.CourseName), strings.ToLower(b.CourseName))
+			case !k.meta && k.field == "price":
+				c = cmp.Compare(a.CoursePrice, b.CoursePrice)
+			default:
+				va, okA := a.Metadata[k.field]
+				vb, okB := b.Metadata[k.field]
+				switch {
+				case !okA && !okB:
+					continue
+				case !okA:
+					return 1
+				case !okB:
+					return -1
+				}
+				c = compareMetadata(va, vb)
+			}
+			if k.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ค้นหาและเรียงลำดับด้วย Metadata
+
+	1. กรองด้วย `?meta.<key>=<value>` เช่น `GET /courses?meta.campus=BKK` หลาย key = ต้องตรงทุกข้อ (AND) ส่ง key เดิมซ้ำ = ตรงค่าใดก็ได้ (OR)
+	2. เรียงด้วย `?sort=` เช่น `sort=-meta.credits,name` (`-` = มากไปน้อย) course ที่ไม่มี key นั้นจะอยู่ท้ายเสมอ
+	3. ใช้ index ในหน่วยความจำ (key → value → ชุดของ course id) แทนการไล่ดูทุก course
+	   - index ถูกอัปเดตใน `recordChange` ซึ่งทุกการแก้ไขต้องผ่าน จึงไม่มีทางที่ index จะไม่ตรงกับข้อมูลจริง
+	4. ตัวเลขถูกเก็บใน index แบบไม่มีศูนย์ท้าย ทำให้ `?meta.credits=3` ตรงกับค่า 3 ที่เป็นตัวเลข
+*/
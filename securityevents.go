@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sign-ins are kept as security events, per subject, and three patterns in
+// them raise an alert:
+//
+//   - new_country, a sign-in from a country the subject has not signed in
+//     from before (the first country seen raises nothing);
+//   - repeated_failures, SECURITY_FAILURE_THRESHOLD (default 5) failed
+//     sign-ins within SECURITY_FAILURE_WINDOW (default 15m), alerted once
+//     per window;
+//   - token_reuse, a refresh token used again after it was rotated, which
+//     also revokes its token family (tokens.go).
+//
+// Sign-ins are Basic credentials at /auth/session and /auth/token, and
+// Google or GitHub logins. Failures are only kept for names that exist, the
+// admin account or a user, so guessing names grows nothing. There is no
+// GeoIP database here: the country is read from SECURITY_COUNTRY_HEADER,
+// such as CF-IPCountry or CloudFront-Viewer-Country, as set by the CDN in
+// front, and only on requests that come through TRUSTED_PROXIES.
+//
+// Alerts are logged and, like SLO alerts, posted to SECURITY_SLACK_WEBHOOK
+// as a Slack message and to SECURITY_ALERT_WEBHOOK as JSON. Signed-in
+// callers read their own last events at GET /me/security-events. Events
+// are kept in memory, the last securityHistoryLimit per subject, and start
+// again with the process.
+
+const (
+	securityHistoryLimit = 100
+
+	securityEventSignIn          = "sign_in"
+	securityEventSignInFailed    = "sign_in_failed"
+	securityEventRefreshReused   = "refresh_token_reused"
+	securityAlertNewCountry      = "new_country"
+	securityAlertRepeatedFailure = "repeated_failures"
+	securityAlertTokenReuse      = "token_reuse"
+)
+
+var (
+	securityCountryHeader = os.Getenv("SECURITY_COUNTRY_HEADER")
+	securityFailures      = 5
+	securityFailureWindow = 15 * time.Minute
+	securitySlackURL      = os.Getenv("SECURITY_SLACK_WEBHOOK")
+	securityWebhookURL    = os.Getenv("SECURITY_ALERT_WEBHOOK")
+)
+
+func init() {
+	if v := os.Getenv("SECURITY_FAILURE_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid SECURITY_FAILURE_THRESHOLD %q: must be a positive integer", v)
+		}
+		securityFailures = n
+	}
+	if v := os.Getenv("SECURITY_FAILURE_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid SECURITY_FAILURE_WINDOW %q: must be a positive duration", v)
+		}
+		securityFailureWindow = d
+	}
+}
+
+// securityEvent is one sign-in, failed sign-in or token reuse.
+type securityEvent struct {
+	Type      string    `json:"type"`
+	Via       string    `json:"via,omitempty"` // basic, google, github
+	At        time.Time `json:"at"`
+	IP        string    `json:"ip,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Alert     string    `json:"alert,omitempty"` // the alert the event raised, if any
+}
+
+// securityEventList is the body of GET /me/security-events.
+type securityEventList struct {
+	Subject string          `json:"subject"`
+	Events  []securityEvent `json:"events"` // newest first
+}
+
+// securityAlert is the body POSTed to SECURITY_ALERT_WEBHOOK.
+type securityAlert struct {
+	Alert   string        `json:"alert"`
+	Subject string        `json:"subject"`
+	Detail  string        `json:"detail"`
+	Event   securityEvent `json:"event"`
+}
+
+type securityHistory struct {
+	events    []securityEvent // oldest first
+	countries map[string]bool // signed in from
+	failures  []time.Time     // within securityFailureWindow
+	alertedAt time.Time       // last repeated_failures alert
+}
+
+var (
+	// securityMu protects securityHistories.
+	securityMu        sync.Mutex
+	securityHistories = make(map[string]*securityHistory)
+)
+
+// recordSecurityEvent keeps an event of type kind for subject from r and
+// sends the alert it raises, if any.
+func recordSecurityEvent(r *http.Request, subject, kind, via string) {
+	e := securityEvent{Type: kind, Via: via, At: time.Now().UTC(), Country: requestCountry(r), UserAgent: r.UserAgent()}
+	if ip := clientIP(r); ip.IsValid() {
+		e.IP = ip.String()
+	}
+
+	securityMu.Lock()
+	h := securityHistories[subject]
+	if h == nil {
+		h = &securityHistory{countries: map[string]bool{}}
+		securityHistories[subject] = h
+	}
+	var detail string
+	switch kind {
+	case securityEventSignIn:
+		if e.Country != "" {
+			if len(h.countries) > 0 && !h.countries[e.Country] {
+				e.Alert = securityAlertNewCountry
+				detail = fmt.Sprintf("sign-in from %s; before only from %s", e.Country, strings.Join(slices.Sorted(maps.Keys(h.countries)), ", "))
+			}
+			h.countries[e.Country] = true
+		}
+		h.failures = nil
+	case securityEventSignInFailed:
+		h.failures = slices.DeleteFunc(h.failures, func(t time.Time) bool { return e.At.Sub(t) >= securityFailureWindow })
+		h.failures = append(h.failures, e.At)
+		if len(h.failures) >= securityFailures && e.At.Sub(h.alertedAt) >= securityFailureWindow {
+			e.Alert = securityAlertRepeatedFailure
+			detail = fmt.Sprintf("%d failed sign-ins within %v", len(h.failures), securityFailureWindow)
+			h.alertedAt = e.At
+		}
+	case securityEventRefreshReused:
+		e.Alert = securityAlertTokenReuse
+		detail = "a refresh token was used again after rotation; its token family was revoked"
+	}
+	h.events = append(h.events, e)
+	if n := len(h.events) - securityHistoryLimit; n > 0 {
+		h.events = slices.Delete(h.events, 0, n)
+	}
+	securityMu.Unlock()
+
+	if e.Alert != "" {
+		go notifySecurity(securityAlert{Alert: e.Alert, Subject: subject, Detail: detail, Event: e})
+	}
+}
+
+// notifySecurity sends an alert; a var so deployments can add channels.
+var notifySecurity = func(a securityAlert) {
+	slog.Warn("Security alert", "alert", a.Alert, "subject", a.Subject, "detail", a.Detail,
+		"ip", a.Event.IP, "country", a.Event.Country)
+	if securitySlackURL != "" {
+		from := a.Event.IP
+		if a.Event.Country != "" {
+			from += " (" + a.Event.Country + ")"
+		}
+		text := fmt.Sprintf(":warning: Security alert %s for `%s`: %s, from %s", a.Alert, a.Subject, a.Detail, from)
+		postAlert("Security", securitySlackURL, map[string]string{"text": text})
+	}
+	if securityWebhookURL != "" {
+		postAlert("Security", securityWebhookURL, a)
+	}
+}
+
+// requestCountry returns the country code the CDN put in
+// SECURITY_COUNTRY_HEADER, or "" when r did not come from a trusted proxy.
+func requestCountry(r *http.Request) string {
+	if securityCountryHeader == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !trustedProxy(peer.Unmap()) {
+		return ""
+	}
+	c := strings.ToUpper(strings.TrimSpace(r.Header.Get(securityCountryHeader)))
+	if len(c) != 2 {
+		return ""
+	}
+	return c
+}
+
+// failedSignInSubject returns the subject a failed sign-in as name counts
+// against, or "" if there is no such account.
+func failedSignInSubject(name string) string {
+	if adminUsername != "" && subtle.ConstantTimeCompare([]byte(name), []byte(adminUsername)) == 1 {
+		return "admin:" + name
+	}
+	userMu.Lock()
+	defer userMu.Unlock()
+	if u := users[strings.ToLower(name)]; u != nil {
+		return u.principal().Subject
+	}
+	return ""
+}
+
+// meSecurityEventsHandler serves GET /me/security-events.
+func meSecurityEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	who := requestPrincipal(r)
+	if s, ok := requestSession(r); ok && who.Subject == systemPrincipal.Subject {
+		// Google and GitHub logins need no other credentials set up.
+		who = s.principal()
+	}
+	if who.Subject == "" || who.Subject == systemPrincipal.Subject || who.probe {
+		writeError(w, r, "Unauthorized: sign in to see your security events", http.StatusUnauthorized)
+		return
+	}
+	list := securityEventList{Subject: who.Subject, Events: []securityEvent{}}
+	securityMu.Lock()
+	if h := securityHistories[who.Subject]; h != nil {
+		list.Events = append(list.Events, h.events...)
+	}
+	securityMu.Unlock()
+	slices.Reverse(list.Events)
+	w.Header().Set("Cache-Control", "no-store")
+	writeValue(w, r, http.StatusOK, list)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: จับพฤติกรรมการ login ที่น่าสงสัยแล้วแจ้งเตือน พร้อมให้ผู้ใช้ดูประวัติของตัวเอง
+
+	1. เก็บ security event ต่อ subject: login สำเร็จ, login ไม่สำเร็จ และ refresh token ถูกใช้ซ้ำ
+	   - login คือ Basic ที่ `/auth/session` กับ `/auth/token` และ login ด้วย Google/GitHub
+	   - login ผิดเก็บเฉพาะชื่อที่มีอยู่จริง (admin หรือ user) เดาชื่อมั่ว ๆ จึงไม่ทำให้หน่วยความจำโต
+	2. alert สามแบบ
+	   - `new_country` login จากประเทศที่ไม่เคยเห็นของ subject นั้น (ประเทศแรกไม่นับ)
+	   - `repeated_failures` login ผิดครบ `SECURITY_FAILURE_THRESHOLD` ครั้ง (5) ใน `SECURITY_FAILURE_WINDOW` (15m) แจ้งครั้งเดียวต่อช่วง
+	   - `token_reuse` refresh token ที่หมุนไปแล้วถูกใช้อีก (token family โดน revoke ด้วย)
+	3. ไม่มีฐานข้อมูล GeoIP: อ่านรหัสประเทศจาก header ที่ CDN ใส่ (`SECURITY_COUNTRY_HEADER` เช่น `CF-IPCountry`) เชื่อเฉพาะ request ที่มาจาก `TRUSTED_PROXIES`
+	4. แจ้งเตือนทาง log, `SECURITY_SLACK_WEBHOOK` และ `SECURITY_ALERT_WEBHOOK` แบบเดียวกับ alert ของ SLO (ใช้ `postAlert` ร่วมกัน)
+	5. `GET /me/security-events` คืน event ล่าสุดของผู้เรียกเอง ใหม่สุดก่อน เก็บในหน่วยความจำ 100 รายการต่อ subject
+*/
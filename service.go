@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The course service holds the rules every way of changing a course must
+// follow: validation, ID assignment, If-Match checks, the policy engine's
+// decision (policy.go, with the role rules of rbac.go by default) and
+// field permissions (fieldperms.go), seat promotion and change recording.
+// REST, gRPC and GraphQL decode their own requests and map the errors
+// below to their own status codes; none of them touches CourseList for
+// writes directly. Each write is a span of the trace of the
+// request that made it (otel.go), and an entry of the audit log
+// (audit.go).
+
+var (
+	errCourseNotFound = errors.New("course not found")
+	errCourseModified = errors.New("course was modified by someone else")
+)
+
+// invalidCourseError is a course the rules reject.
+type invalidCourseError struct{ msg string }
+
+func (e *invalidCourseError) Error() string { return e.msg }
+
+func invalidCoursef(format string, args ...any) error {
+	return &invalidCourseError{msg: fmt.Sprintf(format, args...)}
+}
+
+// checkCourse normalizes c and checks it against the price book and
+// metadata rules.
+func checkCourse(c *course) error {
+	if err := validatePriceBook(c.PriceBook); err != nil {
+		return &invalidCourseError{msg: err.Error()}
+	}
+	if c.Tenant != "" && tenantsByID[c.Tenant] == nil {
+		return invalidCoursef("unknown tenant %q", c.Tenant)
+	}
+	c.Metadata = compactMetadata(c.Metadata)
+	if err := validateMetadata(c.Metadata, tenantMetadataRules(tenantsByID[c.Tenant])); err != nil {
+		return &invalidCourseError{msg: err.Error()}
+	}
+	return nil
+}
+
+// createCourse stores c under a new ID on behalf of who and returns it as
+// stored. An instructor's course without an instructor is theirs, and a
+// course without an owner is owned by who.
+func createCourse(who principal, c course) (_ course, err error) {
+	sp := startSpan(who.trace, "createCourse")
+	defer sp.end(&err)
+	if err := checkCourse(&c); err != nil {
+		return course{}, err
+	}
+	// The client should not be able to set the ID.
+	if c.CourseId != 0 {
+		return course{}, invalidCoursef("course ID is auto-generated and should not be provided")
+	}
+	if who.Role == roleInstructor && strings.TrimSpace(c.Instructor) == "" {
+		c.Instructor = who.Instructor
+	}
+	if c.Owner == "" && who.Subject != systemPrincipal.Subject && !who.probe {
+		c.Owner = who.Subject
+	}
+	if err := authorize(who, actionCreate, nil, &c); err != nil {
+		return course{}, err
+	}
+	if err := who.mayChangeFields(course{}, c, "set"); err != nil {
+		return course{}, err
+	}
+	courseMu.Lock()
+	defer courseMu.Unlock()
+	c.CourseId = getNextId()
+	sp.set("course.id", c.CourseId)
+	CourseList = append(CourseList, c)
+	if !who.probe {
+		recordChange(c.CourseId, false, who.trace)
+	}
+	recordAudit(who, "create", courseAuditResource(c.CourseId), nil, c)
+	return c, nil
+}
+
+// updateCourse changes course id on behalf of who by letting apply edit a
+// copy of it, then stores the copy if it passes the rules. ifMatch is an
+// If-Match header value; "" skips the check. Errors from apply are
+// returned unchanged.
+func updateCourse(who principal, id int, ifMatch string, apply func(*course) error) (_ course, err error) {
+	sp := startSpan(who.trace, "updateCourse")
+	sp.set("course.id", id)
+	defer sp.end(&err)
+	courseMu.Lock()
+	defer courseMu.Unlock()
+	i := findCourseIndex(id)
+	if i < 0 {
+		return course{}, errCourseNotFound
+	}
+	// Before If-Match, so a stale ETag does not tell someone the course
+	// exists when OWNERSHIP_DISCLOSURE says it should not.
+	if err := authorize(who, actionUpdate, &CourseList[i], nil); err != nil {
+		return course{}, disclose(err)
+	}
+	if !ifMatchSatisfied(ifMatch, courseETag(CourseList[i])) {
+		return course{}, errCourseModified
+	}
+	// A clone, so apply cannot reach the stored course's maps and slices.
+	updated := cloneCourse(CourseList[i])
+	if err := apply(&updated); err != nil {
+		return course{}, err
+	}
+	keepHiddenFields(who, CourseList[i], &updated)
+	if updated.Owner == "" {
+		// Left out, as by a PUT of the course without it.
+		updated.Owner = CourseList[i].Owner
+	}
+	if err := checkCourse(&updated); err != nil {
+		return course{}, err
+	}
+	if updated.CourseId != 0 && updated.CourseId != id {
+		return course{}, invalidCoursef("course ID cannot be changed")
+	}
+	updated.CourseId = id
+	if err := authorize(who, actionUpdate, &CourseList[i], &updated); err != nil {
+		return course{}, disclose(err)
+	}
+	if err := who.mayChangeFields(CourseList[i], updated, "change"); err != nil {
+		return course{}, err
+	}
+	before := CourseList[i]
+	CourseList[i] = updated
+	if roster := enrollments[id]; roster != nil {
+		roster.promote(updated)
+	}
+	if !who.probe {
+		recordChange(id, false, who.trace)
+	}
+	recordAudit(who, "update", courseAuditResource(id), before, updated)
+	return updated, nil
+}
+
+// putCourse stores c under its own ID, replacing the course with that ID
+// if there is one. It is for copying courses from another instance, which
+// must keep their IDs; clients create courses with createCourse. It
+// returns the ETag of the course it replaced, or "" if there was none.
+func putCourse(c course) (string, error) {
+	if c.CourseId <= 0 {
+		return "", invalidCoursef("course ID must be positive")
+	}
+	if err := checkCourse(&c); err != nil {
+		return "", err
+	}
+	courseMu.Lock()
+	defer courseMu.Unlock()
+	previous := ""
+	if i := findCourseIndex(c.CourseId); i >= 0 {
+		previous = courseETag(CourseList[i])
+		CourseList[i] = c
+		if roster := enrollments[c.CourseId]; roster != nil {
+			roster.promote(c)
+		}
+	} else {
+		CourseList = append(CourseList, c)
+	}
+	recordChange(c.CourseId, false, traceContext{})
+	return previous, nil
+}
+
+// deleteCourse removes course id along with its roster and invites, on
+// behalf of who.
+func deleteCourse(who principal, id int, ifMatch string) (err error) {
+	sp := startSpan(who.trace, "deleteCourse")
+	sp.set("course.id", id)
+	defer sp.end(&err)
+	courseMu.Lock()
+	defer courseMu.Unlock()
+	i := findCourseIndex(id)
+	if i < 0 {
+		return errCourseNotFound
+	}
+	// Before If-Match, as in updateCourse.
+	if err := authorize(who, actionDelete, &CourseList[i], nil); err != nil {
+		return disclose(err)
+	}
+	if !ifMatchSatisfied(ifMatch, courseETag(CourseList[i])) {
+		return errCourseModified
+	}
+	before := CourseList[i]
+	CourseList = append(CourseList[:i], CourseList[i+1:]...)
+	delete(enrollments, id)
+	delete(courseInvites, id)
+	if !who.probe {
+		recordChange(id, true, who.trace)
+	}
+	recordAudit(who, "delete", courseAuditResource(id), before, nil)
+	return nil
+}
+
+// courseAuditResource names course id in the audit log.
+func courseAuditResource(id int) string {
+	return "/courses/" + strconv.Itoa(id)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Service Layer รวมกฎของการแก้ไข course ไว้ที่เดียว
+
+	1. ก่อนหน้านี้ REST, gRPC และ GraphQL ต่างเขียน validate / ตรวจ ID / promote / recordChange ซ้ำกันเอง ถ้าเพิ่มกฎใหม่ต้องแก้สามที่
+	2. ตอนนี้ทุกทางเรียก `createCourse`, `updateCourse`, `deleteCourse` ที่นี่
+	   - handler ทำแค่แปลง request เป็น course และแปลง error เป็น status ของตัวเอง (REST 404/412/400, gRPC NOT_FOUND/INVALID_ARGUMENT)
+	3. `updateCourse` รับฟังก์ชัน `apply` ให้แต่ละ transport แก้สำเนาของ course ตามแบบของตัวเอง (PUT แทนทั้งหมด, PATCH merge, GraphQL input)
+	4. แต่ละการเรียกบันทึก span ของ OpenTelemetry (otel.go) เป็นลูกของ request ที่เรียก ถ้าเปิดส่ง span ไว้
+	5. error มีห้าแบบ: `errCourseNotFound`, `errCourseModified` (If-Match ไม่ตรง), `invalidCourseError` (ผิดกฎ), `forbiddenError` (policy ไม่อนุญาต ดู rbac.go, policy.go) และ `errPolicyUnavailable` (ถาม policy engine ไม่ได้)
+*/
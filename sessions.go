@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Browser sessions let the HTML admin pages work without passing tokens
+// around. A session is created by the admin login (oauth.go) or by
+// POST /auth/session with the admin Basic credentials or a JWT, and lives
+// in a server-side store; the browser only holds a random token in a
+// secure, HttpOnly, SameSite=Lax cookie. Only a hash of that token is
+// kept.
+//
+// A session ends SESSION_IDLE_TIMEOUT (default 30m) after its last use,
+// and SESSION_TTL (default 12h) after it was created however active it
+// is. Each request renews the idle timeout, and the cookie is re-sent
+// with the new expiry at most once a minute. Logging out, or an admin
+// revoking the session at /admin/sessions, ends it at once.
+//
+// A session stands in for the credentials it was created with, course
+// writes included. Because the browser sends the cookie on its own, an
+// unsafe request with it must also carry the session's CSRF token
+// (csrf.go).
+
+const (
+	sessionCookie      = "session"
+	sessionRenewPeriod = time.Minute
+)
+
+var (
+	sessionTTL         = 12 * time.Hour
+	sessionIdleTimeout = 30 * time.Minute
+)
+
+func init() {
+	for _, v := range []struct {
+		env string
+		d   *time.Duration
+	}{{"SESSION_TTL", &sessionTTL}, {"SESSION_IDLE_TIMEOUT", &sessionIdleTimeout}} {
+		if s := os.Getenv(v.env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				log.Fatalf("Invalid %s %q: must be a positive duration", v.env, s)
+			}
+			*v.d = d
+		}
+	}
+}
+
+type session struct {
+	ID         string    `json:"id"` // public, for listing and revoking; not the cookie token
+	Subject    string    `json:"subject"`
+	Role       string    `json:"role"`
+	Instructor string    `json:"instructor,omitempty"`
+	Via        string    `json:"via"` // how it was created: "google", "github", "basic" or "jwt"
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`           // the earlier of the idle and absolute expiry
+	CSRFToken  string    `json:"csrf_token,omitempty"` // only shown to the session's own browser
+
+	absoluteExpiry time.Time
+	renewedAt      time.Time // when the cookie was last sent
+}
+
+func (s *session) principal() principal {
+	return principal{Subject: s.Subject, Role: s.Role, Instructor: s.Instructor}
+}
+
+func (s *session) touch(now time.Time) {
+	s.LastSeenAt = now
+	s.ExpiresAt = now.Add(sessionIdleTimeout)
+	if s.ExpiresAt.After(s.absoluteExpiry) {
+		s.ExpiresAt = s.absoluteExpiry
+	}
+}
+
+var (
+	// sessionMu protects sessions, which is keyed by the hash of the
+	// cookie token.
+	sessionMu sync.Mutex
+	sessions  = make(map[string]*session)
+)
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession creates a session for p and sets its cookie on w. Any
+// session r already had is ended, so a token planted before login is
+// worthless after it.
+func startSession(w http.ResponseWriter, r *http.Request, p principal, via string) session {
+	endSession(r)
+	now := time.Now().UTC()
+	token := randomHex(32)
+	s := &session{
+		ID: randomHex(8), Subject: p.Subject, Role: p.Role, Instructor: p.Instructor, Via: via,
+		CreatedAt: now, CSRFToken: randomHex(32), absoluteExpiry: now.Add(sessionTTL), renewedAt: now,
+	}
+	s.touch(now)
+	sessionMu.Lock()
+	for k, old := range sessions {
+		if now.After(old.ExpiresAt) {
+			delete(sessions, k)
+		}
+	}
+	sessions[hashSessionToken(token)] = s
+	view := *s
+	sessionMu.Unlock()
+	setSessionCookie(w, r, token, view.ExpiresAt)
+	requestLogger(r).Info("Session started", "session", s.ID, "subject", s.Subject, "role", s.Role, "via", via)
+	return view
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookie, Value: token, Path: "/", Expires: expires,
+		HttpOnly: true, Secure: secureRequest(r), SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+}
+
+// endSession removes the session of r's cookie, if any.
+func endSession(r *http.Request) bool {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return false
+	}
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	key := hashSessionToken(c.Value)
+	_, ok := sessions[key]
+	delete(sessions, key)
+	return ok
+}
+
+// endSessionsOf ends every session of subject.
+func endSessionsOf(subject string) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	for k, s := range sessions {
+		if s.Subject == subject {
+			delete(sessions, k)
+		}
+	}
+}
+
+type sessionContextKey struct{}
+
+// requestSession returns the session r's cookie belongs to, if any.
+func requestSession(r *http.Request) (session, bool) {
+	s, ok := r.Context().Value(sessionContextKey{}).(session)
+	return s, ok
+}
+
+// sessionHandler looks up the session cookie of each request, renews it
+// and puts the session in the request context. An unknown or expired
+// cookie is cleared and the request goes on without a session.
+func sessionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(sessionCookie)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now().UTC()
+		key := hashSessionToken(c.Value)
+		sessionMu.Lock()
+		s, ok := sessions[key]
+		if ok && now.After(s.ExpiresAt) {
+			delete(sessions, key)
+			ok = false
+		}
+		var view session
+		renew := false
+		if ok {
+			s.touch(now)
+			if renew = now.Sub(s.renewedAt) >= sessionRenewPeriod; renew {
+				s.renewedAt = now
+			}
+			view = *s
+		}
+		sessionMu.Unlock()
+
+		if !ok {
+			clearSessionCookie(w)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if renew {
+			setSessionCookie(w, r, c.Value, view.ExpiresAt)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, view)))
+	})
+}
+
+// authSessionHandler serves /auth/session. GET returns the current
+// session. POST starts one from the request's other credentials, Basic
+// credentials of the admin or a user (credentials.go) or a bearer JWT; API
+// keys are for machines and get none. DELETE logs out.
+func authSessionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s, ok := requestSession(r)
+		if !ok {
+			writeError(w, r, "No session", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeValue(w, r, http.StatusOK, s)
+
+	case http.MethodPost:
+		var p principal
+		var via string
+		if who, ok := passwordPrincipal(r); ok {
+			p, via = who, "basic"
+		} else if _, ok := requestClaims(r); ok {
+			p, via = requestPrincipal(r), "jwt"
+			if p.Actor != "" {
+				writeError(w, r, "Forbidden: an impersonation token cannot start a session", http.StatusForbidden)
+				return
+			}
+			if isClientToken(r) {
+				writeError(w, r, "Forbidden: a client token cannot start a session", http.StatusForbidden)
+				return
+			}
+		} else {
+			basicChallenge(w)
+			writeError(w, r, "Unauthorized: send a username and password or a bearer token", http.StatusUnauthorized)
+			return
+		}
+		s := startSession(w, r, p, via)
+		w.Header().Set("Cache-Control", "no-store")
+		writeValue(w, r, http.StatusCreated, s)
+
+	case http.MethodDelete:
+		endSession(r)
+		clearSessionCookie(w)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminSessionsHandler serves GET /admin/sessions, the live sessions with
+// the most recently used first.
+func adminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	sessionMu.Lock()
+	list := []session{}
+	for _, s := range sessions {
+		if now.Before(s.ExpiresAt) {
+			v := *s
+			v.CSRFToken = ""
+			list = append(list, v)
+		}
+	}
+	sessionMu.Unlock()
+	slices.SortFunc(list, func(a, b session) int { return b.LastSeenAt.Compare(a.LastSeenAt) })
+	writeValue(w, r, http.StatusOK, list)
+}
+
+// adminSessionHandler serves DELETE /admin/sessions/{id}, which revokes a
+// session.
+func adminSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	sessionMu.Lock()
+	found := false
+	for k, s := range sessions {
+		if s.ID == id {
+			delete(sessions, k)
+			found = true
+		}
+	}
+	sessionMu.Unlock()
+	if !found {
+		writeError(w, r, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: session แบบ cookie เก็บฝั่ง server หน้า admin ไม่ต้องส่ง token เอง
+
+	1. browser ถือแค่ token สุ่มใน cookie `session` (Secure, HttpOnly, SameSite=Lax) ฝั่ง server เก็บ hash ของ token กับข้อมูลผู้ใช้ (subject, role)
+	   - สร้างจากการ login Google/GitHub หรือ `POST /auth/session` ด้วย Basic auth ของ admin หรือ JWT (API key ไม่ได้ เพราะเป็นของเครื่อง)
+	   - login ใหม่จะลบ session เดิมของ browser นั้นก่อน กัน session fixation
+	2. หมดอายุสองชั้น: ไม่ใช้งานเกิน `SESSION_IDLE_TIMEOUT` (30 นาที) หรือครบ `SESSION_TTL` (12 ชั่วโมง) นับจากสร้าง
+	   - ทุก request ต่ออายุ idle ให้อัตโนมัติ และส่ง cookie ใหม่อย่างมากนาทีละครั้ง
+	3. logout (`DELETE /auth/session`) หรือ admin เพิกถอนที่ `DELETE /admin/sessions/{id}` มีผลทันที ต่างจาก JWT ที่ใช้ได้จนหมดอายุ
+	4. request ที่เขียนข้อมูลด้วย cookie ต้องแนบ `csrf_token` ของ session มาด้วย (ดู csrf.go) กัน CSRF
+*/
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Shadow mode validates a new storage backend with real traffic before
+// cutover. With -shadow=<URL>, catalog reads are answered from this
+// server as usual and, afterwards, the same request is sent to the shadow
+// instance (the build running on the new backend) and the two responses
+// are compared in the background. The client never waits for the shadow
+// or sees its answer. Divergences are counted per route and the latest
+// are kept with the first field that differs, at GET /admin/shadow.
+//
+// SHADOW_SAMPLE_RATE (0 to 1, default 1) mirrors only a share of reads.
+// When the comparison queue is full, reads are not mirrored rather than
+// slowing down the primary.
+
+// shadowRequestHeader marks mirrored requests. They are never mirrored
+// again, so a shadow that points back at an instance in shadow mode cannot
+// start a loop.
+const shadowRequestHeader = "X-Shadow-Request"
+
+const (
+	shadowWorkers        = 4
+	shadowQueue          = 256
+	shadowMaxBody        = 1 << 20
+	shadowTimeout        = 5 * time.Second
+	maxShadowDivergences = 50
+)
+
+var shadowSampleRate = 1.0
+
+func init() {
+	if v := os.Getenv("SHADOW_SAMPLE_RATE"); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			log.Fatalf("Invalid SHADOW_SAMPLE_RATE %q: must be between 0 and 1", v)
+		}
+		shadowSampleRate = rate
+	}
+}
+
+// shadowRead is one read to replay against the shadow, with the primary's
+// answer.
+type shadowRead struct {
+	route  string
+	target string // path and query
+	header http.Header
+	status int
+	body   []byte
+}
+
+type shadowRouteStats struct {
+	Compared int64 `json:"compared"`
+	Matched  int64 `json:"matched"`
+	Diverged int64 `json:"diverged"`
+	Errors   int64 `json:"errors"` // the shadow could not be reached or answered garbage
+}
+
+type shadowDivergence struct {
+	At            time.Time `json:"at"`
+	Route         string    `json:"route"`
+	Target        string    `json:"target"`
+	PrimaryStatus int       `json:"primary_status"`
+	ShadowStatus  int       `json:"shadow_status"`
+	Diff          string    `json:"diff"`
+}
+
+// shadowMirror sends reads to the shadow instance and keeps the results.
+type shadowMirror struct {
+	target *url.URL
+	client *http.Client
+	queue  chan shadowRead
+
+	mu          sync.Mutex
+	routes      map[string]*shadowRouteStats
+	divergences []shadowDivergence // newest last
+	skipped     int64              // not mirrored because the queue was full
+}
+
+// activeShadow is nil unless -shadow is set.
+var activeShadow *shadowMirror
+
+func newShadowMirror(target string) (*shadowMirror, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("want an absolute http or https URL")
+	}
+	m := &shadowMirror{
+		target: u,
+		client: &http.Client{Timeout: shadowTimeout},
+		queue:  make(chan shadowRead, shadowQueue),
+		routes: make(map[string]*shadowRouteStats),
+	}
+	for range shadowWorkers {
+		go m.run()
+	}
+	return m, nil
+}
+
+func (m *shadowMirror) run() {
+	for read := range m.queue {
+		m.compare(read)
+	}
+}
+
+func (m *shadowMirror) compare(read shadowRead) {
+	req, err := http.NewRequest(http.MethodGet, m.target.String()+read.target, nil)
+	if err != nil {
+		m.record(read, 0, "", err)
+		return
+	}
+	req.Header = read.header
+	resp, err := m.client.Do(req)
+	if err != nil {
+		m.record(read, 0, "", err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, shadowMaxBody))
+	if err != nil {
+		m.record(read, resp.StatusCode, "", err)
+		return
+	}
+	diff := ""
+	if resp.StatusCode != read.status {
+		diff = fmt.Sprintf("status %d != %d", read.status, resp.StatusCode)
+	} else {
+		diff = diffBodies(read.body, body)
+	}
+	m.record(read, resp.StatusCode, diff, nil)
+}
+
+func (m *shadowMirror) record(read shadowRead, shadowStatus int, diff string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.routes[read.route]
+	if st == nil {
+		st = &shadowRouteStats{}
+		m.routes[read.route] = st
+	}
+	switch {
+	case err != nil:
+		st.Errors++
+		diff = "shadow error: " + err.Error()
+	case diff == "":
+		st.Compared++
+		st.Matched++
+		return
+	default:
+		st.Compared++
+		st.Diverged++
+	}
+	m.divergences = append(m.divergences, shadowDivergence{
+		At:            time.Now().UTC(),
+		Route:         read.route,
+		Target:        read.target,
+		PrimaryStatus: read.status,
+		ShadowStatus:  shadowStatus,
+		Diff:          diff,
+	})
+	if n := len(m.divergences) - maxShadowDivergences; n > 0 {
+		m.divergences = slices.Delete(m.divergences, 0, n)
+	}
+}
+
+// diffBodies describes the first difference between two responses, or
+// returns "" if they are the same. JSON is compared by value, so key
+// order and whitespace do not count.
+func diffBodies(primary, shadow []byte) string {
+	var a, b any
+	if json.Unmarshal(primary, &a) != nil || json.Unmarshal(shadow, &b) != nil {
+		if bytes.Equal(primary, shadow) {
+			return ""
+		}
+		return fmt.Sprintf("bodies differ (%d and %d bytes)", len(primary), len(shadow))
+	}
+	return diffJSON("$", a, b)
+}
+
+func diffJSON(path string, a, b any) string {
+	switch av := a.(type) {
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := slices.Sorted(maps.Keys(av))
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		for _, k := range keys {
+			if d := diffJSON(path+"."+k, av[k], bv[k]); d != "" {
+				return d
+			}
+		}
+		return ""
+	case []any:
+		bv, ok := b.([]any)
+		if !ok {
+			break
+		}
+		if len(av) != len(bv) {
+			return fmt.Sprintf("%s: %d items != %d items", path, len(av), len(bv))
+		}
+		for i := range av {
+			if d := diffJSON(fmt.Sprintf("%s[%d]", path, i), av[i], bv[i]); d != "" {
+				return d
+			}
+		}
+		return ""
+	}
+	if reflect.DeepEqual(a, b) {
+		return ""
+	}
+	pa, _ := json.Marshal(a)
+	pb, _ := json.Marshal(b)
+	return fmt.Sprintf("%s: %s != %s", path, pa, pb)
+}
+
+// shadowRecorder copies what the primary handler writes.
+type shadowRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (s *shadowRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *shadowRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if s.body.Len()+len(p) > shadowMaxBody {
+		s.overflow = true
+	} else {
+		s.body.Write(p)
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *shadowRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// shadowHandler mirrors sampled catalog reads served by next. It wraps the
+// mux from inside compressHandler, so it sees bodies before compression.
+func shadowHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := activeShadow
+		if m == nil || !isCatalogRead(r) || r.Method != http.MethodGet || r.Header.Get(shadowRequestHeader) != "" || rand.Float64() >= shadowSampleRate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &shadowRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.overflow || clientGone(r) {
+			return
+		}
+		h := r.Header.Clone()
+		h.Del("Accept-Encoding") // compare what the handler wrote, uncompressed
+		h.Del("If-None-Match")
+		h.Del("If-Modified-Since")
+		h.Set(shadowRequestHeader, "1")
+		setTraceHeaders(h, requestTrace(r))
+		read := shadowRead{route: r.Pattern, target: r.URL.RequestURI(), header: h, status: rec.status, body: rec.body.Bytes()}
+		if read.status == 0 {
+			read.status = http.StatusOK
+		}
+		select {
+		case m.queue <- read:
+		default:
+			m.mu.Lock()
+			m.skipped++
+			m.mu.Unlock()
+		}
+	})
+}
+
+// adminShadowHandler serves GET /admin/shadow.
+func adminShadowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m := activeShadow
+	if m == nil {
+		writeValue(w, r, http.StatusOK, map[string]any{"enabled": false})
+		return
+	}
+	m.mu.Lock()
+	routes := map[string]shadowRouteStats{}
+	var total shadowRouteStats
+	for route, st := range m.routes {
+		routes[route] = *st
+		total.Compared += st.Compared
+		total.Matched += st.Matched
+		total.Diverged += st.Diverged
+		total.Errors += st.Errors
+	}
+	recent := slices.Clone(m.divergences)
+	skipped := m.skipped
+	m.mu.Unlock()
+	slices.Reverse(recent) // newest first
+
+	matchRate := 0.0
+	if total.Compared > 0 {
+		matchRate = float64(total.Matched) / float64(total.Compared)
+	}
+	writeValue(w, r, http.StatusOK, map[string]any{
+		"enabled":            true,
+		"target":             m.target.String(),
+		"sample_rate":        shadowSampleRate,
+		"total":              total,
+		"match_rate":         matchRate,
+		"skipped":            skipped,
+		"routes":             routes,
+		"recent_divergences": recent,
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Shadow traffic ตรวจ backend ใหม่ด้วย traffic จริงก่อนย้ายข้อมูล
+
+	1. รันด้วย `-shadow=http://new-backend:8080` แล้ว request อ่าน catalog จะถูกตอบจาก server นี้ตามปกติ
+	   - หลังตอบเสร็จ ส่ง request เดียวกันไปที่ instance ใหม่ (เช่น build ที่ใช้ Postgres) แล้วเทียบผลใน goroutine เบื้องหลัง
+	   - client ไม่ต้องรอ และไม่เห็นคำตอบจาก shadow เลย
+	2. เทียบ status และ body แบบ JSON (ไม่สนลำดับ key/ช่องว่าง) แล้วบอกจุดแรกที่ต่าง เช่น `$[1].price: 200 != 210`
+	3. ดูสถิติต่อ route (ตรงกัน/ต่างกัน/error) และรายการที่ต่างล่าสุดที่ `GET /admin/shadow`
+	4. `SHADOW_SAMPLE_RATE` ส่งแค่บางส่วน ถ้าคิวเต็มจะข้ามไป (นับใน `skipped`) ไม่ให้ server หลักช้าลง
+*/
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// With JWT_SIGNING_KEYS_FILE set, the tokens this server issues, access
+// tokens (tokens.go) and impersonation tokens, are signed with RS256 keys
+// it manages instead of JWT_HMAC_SECRET. Each token names its key in the
+// kid header, and other services verify them with the public keys at
+// GET /.well-known/jwks.json. A key is in one of three states:
+//
+//	next     published and accepted, but not yet signing, so verifiers
+//	         that cache the key set have it before the first token does
+//	current  signs new tokens; there is exactly one
+//	retired  accepted and published for JWT_KEY_GRACE (default 24h) more
+//
+// A key-rotation job (jobs.go) runs every JWT_KEY_ROTATION_INTERVAL
+// (default 720h). It retires current, makes next current and generates a
+// new next. Retired keys are dropped once their grace ends, which must be
+// at least as long as the longest-lived token, ACCESS_TOKEN_TTL or
+// IMPERSONATION_TTL, so that no token outlives its key. GET /admin/keys
+// lists the keys. The runbook's rotate-jwt-keys rotates now; with
+// {"drop": true} the old current key is dropped outright instead of
+// retired, for one that has leaked, and every token it signed stops
+// working.
+//
+// The file holds the private keys, so it is written with mode 0600. It is
+// read again when it changes, so instances that share it pick up each
+// other's rotations within signingKeyCheckInterval. Until they do, they
+// still accept the new current key, which was their next.
+
+const (
+	signingKeyBits          = 2048
+	signingKeyCheckInterval = time.Minute
+
+	keyNext    = "next"
+	keyCurrent = "current"
+	keyRetired = "retired"
+)
+
+var (
+	signingKeysFile    = os.Getenv("JWT_SIGNING_KEYS_FILE")
+	signingKeyRotation = 30 * 24 * time.Hour
+	signingKeyGrace    = 24 * time.Hour
+)
+
+func init() {
+	for _, v := range []struct {
+		env string
+		d   *time.Duration
+		min time.Duration
+	}{{"JWT_KEY_ROTATION_INTERVAL", &signingKeyRotation, time.Minute}, {"JWT_KEY_GRACE", &signingKeyGrace, 0}} {
+		if s := os.Getenv(v.env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= v.min {
+				log.Fatalf("Invalid %s %q: must be a duration longer than %v", v.env, s, v.min)
+			}
+			*v.d = d
+		}
+	}
+}
+
+// signingKey is a key's metadata, as GET /admin/keys shows it.
+type signingKey struct {
+	ID          string     `json:"kid"`
+	State       string     `json:"state"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatedAt *time.Time `json:"activated_at,omitempty"` // became current
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"` // its grace ends
+
+	key *rsa.PrivateKey
+}
+
+// storedSigningKey is a key as saved in signingKeysFile.
+type storedSigningKey struct {
+	signingKey
+	PrivateKey string `json:"private_key"` // PKCS #8, PEM
+}
+
+var (
+	// signingKeyMu protects signingKeys, oldest first, and
+	// signingKeysModTime, the file's as last read or written.
+	signingKeyMu       sync.Mutex
+	signingKeys        []*signingKey
+	signingKeysModTime time.Time
+)
+
+func signingKeysEnabled() bool {
+	return signingKeysFile != ""
+}
+
+// tokenSigningEnabled reports whether the server can issue tokens.
+func tokenSigningEnabled() bool {
+	return len(jwtHMACSecret) > 0 || signingKeysEnabled()
+}
+
+// loadSigningKeys reads signingKeysFile, creating the keys it lacks.
+func loadSigningKeys() error {
+	now := time.Now()
+	if longest := max(accessTokenTTL, impersonationTTL, clientTokenTTL); signingKeyGrace < longest {
+		return fmt.Errorf("JWT_KEY_GRACE %v is shorter than tokens last (%v)", signingKeyGrace, longest)
+	}
+	signingKeyMu.Lock()
+	defer signingKeyMu.Unlock()
+	if _, err := readSigningKeys(); err != nil {
+		return err
+	}
+	if keyInState(keyCurrent) == nil {
+		return rotateJWTKeys(now, false)
+	}
+	if keyInState(keyNext) == nil {
+		k, err := newSigningKey(now)
+		if err != nil {
+			return err
+		}
+		signingKeys = append(signingKeys, k)
+		return saveSigningKeys()
+	}
+	return nil
+}
+
+// readSigningKeys replaces signingKeys with the file's if it changed since
+// it was last read, reporting whether it did. Callers must hold
+// signingKeyMu.
+func readSigningKeys() (bool, error) {
+	info, err := os.Stat(signingKeysFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(signingKeysModTime) {
+		return false, nil
+	}
+	data, err := os.ReadFile(signingKeysFile)
+	if err != nil {
+		return false, err
+	}
+	var stored []storedSigningKey
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return false, err
+	}
+	keys := make([]*signingKey, 0, len(stored))
+	for _, sk := range stored {
+		block, _ := pem.Decode([]byte(sk.PrivateKey))
+		if block == nil {
+			return false, fmt.Errorf("key %s holds no PEM block", sk.ID)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return false, fmt.Errorf("key %s: %v", sk.ID, err)
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return false, fmt.Errorf("key %s is not an RSA key", sk.ID)
+		}
+		k := sk.signingKey
+		k.key = rsaKey
+		keys = append(keys, &k)
+	}
+	signingKeys, signingKeysModTime = keys, info.ModTime()
+	return true, nil
+}
+
+// saveSigningKeys writes signingKeys to signingKeysFile, renaming the new
+// file into place. Callers must hold signingKeyMu.
+func saveSigningKeys() error {
+	stored := make([]storedSigningKey, 0, len(signingKeys))
+	for _, k := range signingKeys {
+		der, err := x509.MarshalPKCS8PrivateKey(k.key)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, storedSigningKey{*k, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))})
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := signingKeysFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, signingKeysFile); err != nil {
+		return err
+	}
+	if info, err := os.Stat(signingKeysFile); err == nil {
+		signingKeysModTime = info.ModTime()
+	}
+	return nil
+}
+
+func newSigningKey(now time.Time) (*signingKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return &signingKey{ID: randomHex(8), State: keyNext, CreatedAt: now.UTC(), key: key}, nil
+}
+
+// keyInState returns the newest key in state, or nil. Callers must hold
+// signingKeyMu.
+func keyInState(state string) *signingKey {
+	for _, k := range slices.Backward(signingKeys) {
+		if k.State == state {
+			return k
+		}
+	}
+	return nil
+}
+
+// rotateJWTKeys retires the current key, or drops it, makes next
+// current and generates a new next. Callers must hold signingKeyMu.
+func rotateJWTKeys(now time.Time, drop bool) error {
+	now = now.UTC()
+	promote := keyInState(keyNext)
+	if promote == nil {
+		k, err := newSigningKey(now)
+		if err != nil {
+			return err
+		}
+		signingKeys = append(signingKeys, k)
+		promote = k
+	}
+	next, err := newSigningKey(now)
+	if err != nil {
+		return err
+	}
+	if old := keyInState(keyCurrent); old != nil && drop {
+		signingKeys = slices.DeleteFunc(signingKeys, func(k *signingKey) bool { return k == old })
+	} else if old != nil {
+		expires := now.Add(signingKeyGrace)
+		old.State, old.RetiredAt, old.ExpiresAt = keyRetired, &now, &expires
+	}
+	promote.State, promote.ActivatedAt = keyCurrent, &now
+	signingKeys = append(signingKeys, next)
+	slog.Info("Rotated signing keys", "current", promote.ID, "next", next.ID, "dropped_old", drop)
+	return saveSigningKeys()
+}
+
+// pruneSigningKeys drops retired keys whose grace has ended. Callers must
+// hold signingKeyMu.
+func pruneSigningKeys(now time.Time) error {
+	n := len(signingKeys)
+	signingKeys = slices.DeleteFunc(signingKeys, func(k *signingKey) bool {
+		return k.State == keyRetired && !now.Before(*k.ExpiresAt)
+	})
+	if len(signingKeys) == n {
+		return nil
+	}
+	return saveSigningKeys()
+}
+
+// runKeyRotations rereads the keys every interval, and rotates them as a
+// tracked job when the current key is due.
+func runKeyRotations(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		now := time.Now()
+		signingKeyMu.Lock()
+		if _, err := readSigningKeys(); err != nil {
+			slog.Error("Error reading signing keys", "file", signingKeysFile, "err", err)
+		}
+		if err := pruneSigningKeys(now); err != nil {
+			slog.Error("Error saving signing keys", "file", signingKeysFile, "err", err)
+		}
+		cur := keyInState(keyCurrent)
+		due := cur == nil || !now.Before(cur.ActivatedAt.Add(signingKeyRotation))
+		signingKeyMu.Unlock()
+		if due {
+			rotateJWTKeysJob(now, false)
+		}
+	}
+}
+
+// rotateJWTKeysJob rotates the keys as a tracked job.
+func rotateJWTKeysJob(now time.Time, drop bool) error {
+	j := trackJob(jobKeyRotation, now.UTC().Format(time.RFC3339))
+	j.attempt()
+	signingKeyMu.Lock()
+	err := rotateJWTKeys(now, drop)
+	signingKeyMu.Unlock()
+	if err != nil {
+		slog.Error("Signing key rotation failed", "err", err)
+	}
+	j.done(err)
+	return err
+}
+
+// currentSigningKey returns the key that signs new tokens.
+func currentSigningKey() (*signingKey, error) {
+	signingKeyMu.Lock()
+	defer signingKeyMu.Unlock()
+	if k := keyInState(keyCurrent); k != nil {
+		return k, nil
+	}
+	return nil, errors.New("no current signing key")
+}
+
+// sign returns the RS256 signature of signed, a JWT's header and claims.
+func (k *signingKey) sign(signed string) (string, error) {
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, h[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verificationKey returns the public key with ID kid, if it is still
+// accepted at now.
+func verificationKey(kid string, now time.Time) *rsa.PublicKey {
+	signingKeyMu.Lock()
+	defer signingKeyMu.Unlock()
+	for _, k := range signingKeys {
+		if k.ID == kid && (k.State != keyRetired || now.Before(*k.ExpiresAt)) {
+			return &k.key.PublicKey
+		}
+	}
+	return nil
+}
+
+// jsonWebKey is an RSA public key in a JWK Set (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwksHandler serves GET /.well-known/jwks.json: every key that is
+// accepted, next and retired ones included.
+func jwksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !signingKeysEnabled() {
+		writeError(w, r, "No signing keys; set JWT_SIGNING_KEYS_FILE", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{Keys: []jsonWebKey{}}
+	signingKeyMu.Lock()
+	for _, k := range slices.Backward(signingKeys) {
+		if k.State == keyRetired && !now.Before(*k.ExpiresAt) {
+			continue
+		}
+		pub := k.key.PublicKey
+		set.Keys = append(set.Keys, jsonWebKey{
+			Kty: "RSA", Use: "sig", Alg: "RS256", Kid: k.ID,
+			N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	signingKeyMu.Unlock()
+	// Short enough that a verifier has next well before it signs.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	json.NewEncoder(w).Encode(set)
+}
+
+// adminKeysHandler serves GET /admin/keys.
+func adminKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !signingKeysEnabled() {
+		writeValue(w, r, http.StatusOK, map[string]any{"enabled": false})
+		return
+	}
+	writeValue(w, r, http.StatusOK, signingKeysView())
+}
+
+// rotateJWTKeysAction is the runbook's rotate-jwt-keys. {"drop": true}
+// drops the current key instead of retiring it.
+func rotateJWTKeysAction(params json.RawMessage) (any, error) {
+	var req struct {
+		Drop bool `json:"drop"`
+	}
+	if err := decodeRunbookParams(params, &req); err != nil {
+		return nil, err
+	}
+	if !signingKeysEnabled() {
+		return nil, &runbookError{http.StatusConflict, "Signing keys are not enabled; set JWT_SIGNING_KEYS_FILE"}
+	}
+	if err := rotateJWTKeysJob(time.Now(), req.Drop); err != nil {
+		return nil, err
+	}
+	return signingKeysView(), nil
+}
+
+func signingKeysView() map[string]any {
+	signingKeyMu.Lock()
+	defer signingKeyMu.Unlock()
+	keys := make([]signingKey, 0, len(signingKeys))
+	for _, k := range slices.Backward(signingKeys) {
+		keys = append(keys, *k)
+	}
+	view := map[string]any{
+		"enabled":           true,
+		"rotation_interval": signingKeyRotation.String(),
+		"grace":             signingKeyGrace.String(),
+		"keys":              keys,
+	}
+	if cur := keyInState(keyCurrent); cur != nil {
+		view["next_rotation"] = cur.ActivatedAt.Add(signingKeyRotation)
+	}
+	return view
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ให้ server จัดการ key สำหรับเซ็น JWT เอง หมุน key ตามรอบ และเปิด JWKS ให้ service อื่นตรวจ token ได้
+
+	1. ตั้ง `JWT_SIGNING_KEYS_FILE` แล้ว access token และ impersonation token จะเซ็นด้วย RS256 แทน `JWT_HMAC_SECRET` พร้อม `kid` ใน header
+	2. key มีสามสถานะ
+	   - `next` เผยแพร่แล้วแต่ยังไม่ใช้เซ็น ให้ verifier ที่ cache key set ไว้ได้ key ก่อน token แรกจะมาถึง
+	   - `current` ใช้เซ็น token ใหม่ มีตัวเดียว
+	   - `retired` ไม่เซ็นแล้วแต่ยังรับและเผยแพร่ต่อ `JWT_KEY_GRACE` (24h) ต้องไม่สั้นกว่าอายุ token ที่ยาวที่สุด
+	3. job `key-rotation` (jobs.go) หมุนทุก `JWT_KEY_ROTATION_INTERVAL` (720h): current → retired, next → current แล้วสร้าง next ใหม่; retired ที่หมด grace ถูกลบ
+	4. `GET /.well-known/jwks.json` คืน public key ทุกตัวที่ยังรับอยู่, `GET /admin/keys` ดูสถานะ, runbook `rotate-jwt-keys` หมุนทันที (`{"drop": true}` ทิ้ง key เดิมเลยกรณีรั่ว)
+	5. ไฟล์เก็บ private key (mode 0600) และถูกอ่านใหม่เมื่อเปลี่ยน instance ที่ใช้ไฟล์ร่วมกันจึงเห็นการหมุนของกันและกัน
+*/
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error budgets for deployments without a monitoring stack. Each route has
+// an availability objective, e.g. 99.9% of requests not failing with a 5xx
+// over SLO_WINDOW. The error budget is the 0.1% that may fail; the burn
+// rate is how fast it is being spent, 1 meaning exactly on budget.
+//
+// An alert fires when the burn rate is above sloBurnThreshold over both the
+// last 5 minutes and the last hour (the short window makes it resolve
+// quickly, the long one keeps a brief spike from paging anyone), and is
+// sent to SLO_SLACK_WEBHOOK and/or SLO_ALERT_WEBHOOK.
+//
+// SLO_OBJECTIVES configures the routes by mux pattern, with * for every
+// other route: "*=99.5,/courses=99.9,/courses/{id}=99.9". The default is
+// "*=99.5".
+
+const (
+	sloShortWindow   = 5 * time.Minute
+	sloLongWindow    = time.Hour
+	sloBurnThreshold = 14.4 // spends a 30-day budget in about 2 days
+	sloEvalInterval  = time.Minute
+)
+
+var (
+	sloObjectives map[string]float64 // route pattern or "*" -> percent
+	sloWindow     = 24 * time.Hour
+	sloSlackURL   = os.Getenv("SLO_SLACK_WEBHOOK")
+	sloWebhookURL = os.Getenv("SLO_ALERT_WEBHOOK")
+)
+
+func init() {
+	spec := os.Getenv("SLO_OBJECTIVES")
+	if spec == "" {
+		spec = "*=99.5"
+	}
+	objectives, err := parseSLOObjectives(spec)
+	if err != nil {
+		log.Fatalf("Invalid SLO_OBJECTIVES: %v", err)
+	}
+	sloObjectives = objectives
+	if v := os.Getenv("SLO_WINDOW"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < sloLongWindow {
+			log.Fatalf("Invalid SLO_WINDOW %q: must be a duration of at least %v", v, sloLongWindow)
+		}
+		sloWindow = d
+	}
+}
+
+func parseSLOObjectives(s string) (map[string]float64, error) {
+	objectives := map[string]float64{}
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		route, pct, ok := strings.Cut(part, "=")
+		route = strings.TrimSpace(route)
+		p, err := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+		if !ok || route == "" || err != nil || p <= 0 || p >= 100 {
+			return nil, fmt.Errorf("invalid objective %q; want route=percent below 100", part)
+		}
+		objectives[route] = p
+	}
+	return objectives, nil
+}
+
+// sloObjective returns the objective for route, if it has one.
+func sloObjective(route string) (float64, bool) {
+	if p, ok := sloObjectives[route]; ok {
+		return p, true
+	}
+	p, ok := sloObjectives["*"]
+	return p, ok
+}
+
+// sloBucket counts one minute of requests.
+type sloBucket struct {
+	minute     int64 // Unix minute the counts belong to
+	total      int64
+	errors     int64
+	clientGone int64
+}
+
+// routeSLO is the request history of one route over sloWindow, one bucket
+// per minute in a ring.
+type routeSLO struct {
+	buckets  []sloBucket
+	alerting bool
+}
+
+var (
+	sloMu     sync.Mutex
+	sloRoutes = make(map[string]*routeSLO)
+)
+
+// recordSLO counts a finished request for route. Requests no route matched
+// are not counted; they say nothing about the service. Nor do requests
+// whose client disconnected count against the budget; they are tallied on
+// their own.
+func recordSLO(route string, status int, outcome string, at time.Time) {
+	if route == "" {
+		return
+	}
+	if _, ok := sloObjective(route); !ok {
+		return
+	}
+	minute := at.Unix() / 60
+	sloMu.Lock()
+	defer sloMu.Unlock()
+	rs := sloRoutes[route]
+	if rs == nil {
+		rs = &routeSLO{buckets: make([]sloBucket, int(sloWindow/time.Minute))}
+		sloRoutes[route] = rs
+	}
+	b := &rs.buckets[minute%int64(len(rs.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	if outcome == outcomeClientGone {
+		b.clientGone++
+		return
+	}
+	b.total++
+	if status >= 500 {
+		b.errors++
+	}
+}
+
+// counts sums the buckets within window before now.
+func (rs *routeSLO) counts(now time.Time, window time.Duration) (total, errors, clientGone int64) {
+	newest := now.Unix() / 60
+	oldest := newest - int64(window/time.Minute) + 1
+	for _, b := range rs.buckets {
+		if b.minute >= oldest && b.minute <= newest {
+			total += b.total
+			errors += b.errors
+			clientGone += b.clientGone
+		}
+	}
+	return total, errors, clientGone
+}
+
+// burnRate is the error rate relative to what the objective allows.
+func burnRate(total, errors int64, objective float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return (float64(errors) / float64(total)) / (1 - objective/100)
+}
+
+type sloStatus struct {
+	Route           string  `json:"route"`
+	Objective       float64 `json:"objective"`
+	Window          string  `json:"window"`
+	Requests        int64   `json:"requests"`
+	Errors          int64   `json:"errors"`
+	ClientGone      int64   `json:"client_gone"` // not counted in requests
+	ErrorRate       float64 `json:"error_rate"`
+	BudgetRemaining float64 `json:"budget_remaining"` // fraction of the budget left; negative when overspent
+	BurnRate5m      float64 `json:"burn_rate_5m"`
+	BurnRate1h      float64 `json:"burn_rate_1h"`
+	Alerting        bool    `json:"alerting"`
+}
+
+// status reports rs. Callers must hold sloMu.
+func (rs *routeSLO) status(route string, now time.Time) sloStatus {
+	objective, _ := sloObjective(route)
+	st := sloStatus{Route: route, Objective: objective, Window: sloWindow.String(), Alerting: rs.alerting, BudgetRemaining: 1}
+	st.Requests, st.Errors, st.ClientGone = rs.counts(now, sloWindow)
+	if st.Requests > 0 {
+		st.ErrorRate = float64(st.Errors) / float64(st.Requests)
+		st.BudgetRemaining = 1 - burnRate(st.Requests, st.Errors, objective)
+	}
+	total, errors, _ := rs.counts(now, sloShortWindow)
+	st.BurnRate5m = burnRate(total, errors, objective)
+	total, errors, _ = rs.counts(now, sloLongWindow)
+	st.BurnRate1h = burnRate(total, errors, objective)
+	return st
+}
+
+// sloAlert is the body POSTed to SLO_ALERT_WEBHOOK.
+type sloAlert struct {
+	State  string    `json:"state"` // "firing" or "resolved"
+	Status sloStatus `json:"status"`
+	At     time.Time `json:"at"`
+}
+
+// notifySLO sends an alert; a var so deployments can add channels.
+var notifySLO = func(a sloAlert) {
+	slog.Warn("SLO alert", "state", a.State, "route", a.Status.Route, "burn_rate_5m", a.Status.BurnRate5m,
+		"burn_rate_1h", a.Status.BurnRate1h, "budget_remaining", a.Status.BudgetRemaining)
+	if sloSlackURL != "" {
+		emoji := ":rotating_light:"
+		if a.State == "resolved" {
+			emoji = ":white_check_mark:"
+		}
+		text := fmt.Sprintf("%s SLO %s: `%s` (objective %.2f%%) burn rate %.1f over 5m, %.1f over 1h; %.0f%% of the %s budget left",
+			emoji, a.State, a.Status.Route, a.Status.Objective, a.Status.BurnRate5m, a.Status.BurnRate1h, a.Status.BudgetRemaining*100, a.Status.Window)
+		postAlert("SLO", sloSlackURL, map[string]string{"text": text})
+	}
+	if sloWebhookURL != "" {
+		postAlert("SLO", sloWebhookURL, a)
+	}
+}
+
+// postAlert POSTs body as JSON to url, logging what fails; kind names the
+// alert in those logs.
+func postAlert(kind, url string, body any) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		slog.Error("Error marshaling "+kind+" alert", "err", err)
+		return
+	}
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		slog.Error(kind+" alert delivery failed", "url", url, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Error(kind+" alert delivery failed", "url", url, "status", resp.Status)
+	}
+}
+
+// evaluateSLOs fires or resolves alerts for every route.
+func evaluateSLOs(now time.Time) {
+	var alerts []sloAlert
+	sloMu.Lock()
+	for route, rs := range sloRoutes {
+		st := rs.status(route, now)
+		firing := st.BurnRate5m > sloBurnThreshold && st.BurnRate1h > sloBurnThreshold
+		if firing == rs.alerting {
+			continue
+		}
+		rs.alerting = firing
+		st.Alerting = firing
+		a := sloAlert{State: "resolved", Status: st, At: now.UTC()}
+		if firing {
+			a.State = "firing"
+		}
+		alerts = append(alerts, a)
+	}
+	sloMu.Unlock()
+	// Sent outside the lock: a slow receiver must not hold up requests.
+	for _, a := range alerts {
+		notifySLO(a)
+	}
+}
+
+func runSLOEvaluator(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		evaluateSLOs(now)
+	}
+}
+
+// adminSLOHandler serves GET /admin/slo, the budget of every route that has
+// had traffic, worst first.
+func adminSLOHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	sloMu.Lock()
+	statuses := []sloStatus{}
+	for _, route := range slices.Sorted(maps.Keys(sloRoutes)) {
+		statuses = append(statuses, sloRoutes[route].status(route, now))
+	}
+	sloMu.Unlock()
+	slices.SortStableFunc(statuses, func(a, b sloStatus) int {
+		switch {
+		case a.BudgetRemaining < b.BudgetRemaining:
+			return -1
+		case a.BudgetRemaining > b.BudgetRemaining:
+			return 1
+		}
+		return 0
+	})
+	writeValue(w, r, http.StatusOK, map[string]any{
+		"burn_rate_threshold": sloBurnThreshold,
+		"routes":              statuses,
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Error Budget และการแจ้งเตือนในตัว server
+
+	1. แต่ละ route มีเป้าหมาย (SLO) เช่น 99.9% ของ request ต้องไม่ตอบ 5xx ตั้งด้วย env `SLO_OBJECTIVES="*=99.5,/courses=99.9"`
+	   - error budget = ส่วนที่ยอมให้พังได้ (0.1%) ส่วน burn rate = ใช้ budget เร็วแค่ไหน (1 = พอดีเป้า)
+	2. นับ request เป็นช่องละ 1 นาที เก็บย้อนหลังตาม `SLO_WINDOW` (ค่าเริ่มต้น 24h)
+	3. ทุกนาทีตรวจ burn rate ช่วง 5 นาทีและ 1 ชั่วโมง ถ้าเกิน 14.4 ทั้งคู่จะแจ้งเตือน และแจ้งอีกครั้งเมื่อกลับมาปกติ
+	   - ส่งไป Slack (`SLO_SLACK_WEBHOOK`) และ/หรือ webhook ทั่วไป (`SLO_ALERT_WEBHOOK`)
+	4. ดูสถานะปัจจุบันได้ที่ `GET /admin/slo` (route ที่ budget เหลือน้อยสุดอยู่บนสุด)
+*/
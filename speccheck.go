@@ -0,0 +1,670 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// `server validate-spec` checks that the OpenAPI document still describes
+// what the server does. It reads the Go source of the working directory,
+// so run it from the repository root, and fails listing every mismatch:
+//
+//   - a route registered in main that the document does not describe, or
+//     a documented path that is not registered;
+//   - a method a handler serves that is not documented, or the other way
+//     round;
+//   - a status code a handler writes that its operation does not list;
+//   - a query parameter a handler reads that is not documented;
+//   - a field of a request or response body type that the schema lacks,
+//     or a schema property the type does not have.
+//
+// Handlers are read statically: a handler serves the methods of its
+// `if r.Method != ...` guard or `switch r.Method` cases, and writes the
+// status codes and reads the query parameters found in it and in the
+// package functions it calls. Routes that are outside the document on
+// purpose are listed in specExempt.
+
+// specExempt lists the routes the document leaves out and why. A pattern
+// ending in / covers every route under it.
+var specExempt = map[string]string{
+	"/admin/":                "operator API, described in the README",
+	"/auth/":                 "sign-in for browsers and token clients, described in the README",
+	"/docs":                  "the API explorer",
+	"/docs/":                 "the API explorer",
+	"/openapi.json":          "the document itself",
+	"/graphql":               "GraphQL has its own schema at /graphql/schema",
+	"/graphql/schema":        "GraphQL has its own schema",
+	"/events":                "a server-sent event stream, which OpenAPI 3.0 cannot describe",
+	"/ws/courses":            "a WebSocket, which OpenAPI 3.0 cannot describe",
+	"/theme/logo":            "an image for the HTML pages",
+	"/metrics":               "Prometheus exposition format, described in the README",
+	"/.well-known/jwks.json": "the signing keys as a JWK Set, described in the README",
+	"/debug/vars":            "expvar's JSON, described in the README",
+	"/debug/pprof/":          "Go runtime profiles, described in the README",
+	"/email/":                "the mail provider's webhook and the unsubscribe page, described in the README",
+}
+
+// specGenericStatuses are written by shared helpers on any route and are
+// not expected in every operation.
+var specGenericStatuses = map[int]bool{
+	http.StatusMethodNotAllowed:      true,
+	http.StatusNotAcceptable:         true, // content negotiation
+	http.StatusUnsupportedMediaType:  true, // decodeBody
+	http.StatusRequestEntityTooLarge: true, // writeBodyError
+	http.StatusInternalServerError:   true,
+}
+
+// specErrorMappers turn an error into a response. Which codes they write
+// depends on the error, not on the route, so their codes are not counted.
+var specErrorMappers = map[string]bool{"writeCourseServiceError": true}
+
+func exemptFromSpec(pattern string) bool {
+	for p := range specExempt {
+		if pattern == p || strings.HasSuffix(p, "/") && strings.HasPrefix(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// specSource is the parsed package.
+type specSource struct {
+	funcs   map[string]*ast.FuncDecl   // package functions by name
+	methods map[string]*ast.FuncDecl   // "Type.Method"
+	structs map[string]*ast.StructType // named struct types
+}
+
+func parseSpecSource(dir string) (*specSource, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	src := &specSource{funcs: map[string]*ast.FuncDecl{}, methods: map[string]*ast.FuncDecl{}, structs: map[string]*ast.StructType{}}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, parser.SkipObjectResolution)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil {
+					src.funcs[d.Name.Name] = d
+				} else if t := receiverType(d.Recv.List[0].Type); t != "" {
+					src.methods[t+"."+d.Name.Name] = d
+				}
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					if ts, ok := spec.(*ast.TypeSpec); ok {
+						if st, ok := ts.Type.(*ast.StructType); ok {
+							src.structs[ts.Name.Name] = st
+						}
+					}
+				}
+			}
+		}
+	}
+	if src.funcs["main"] == nil {
+		return nil, fmt.Errorf("no func main in %s; run validate-spec from the repository root", dir)
+	}
+	return src, nil
+}
+
+func receiverType(e ast.Expr) string {
+	if star, ok := e.(*ast.StarExpr); ok {
+		e = star.X
+	}
+	if id, ok := e.(*ast.Ident); ok {
+		return id.Name
+	}
+	return ""
+}
+
+// routes returns the handler of every pattern registered on mux in main.
+func (src *specSource) routes() map[string]*ast.FuncDecl {
+	routes := map[string]*ast.FuncDecl{}
+	ast.Inspect(src.funcs["main"], func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Handle" && sel.Sel.Name != "HandleFunc" || !isIdent(sel.X, "mux") {
+			return true
+		}
+		if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			pattern, _ := strconv.Unquote(lit.Value)
+			routes[pattern] = src.handlerFunc(call.Args[1])
+		}
+		return true
+	})
+	return routes
+}
+
+// handlerFunc finds the function that serves e: a handler function, the
+// innermost one wrapped by calls like requireCourseWriteAuth(h), or
+// ServeHTTP of a &T{} literal.
+func (src *specSource) handlerFunc(e ast.Expr) *ast.FuncDecl {
+	switch e := e.(type) {
+	case *ast.Ident:
+		return src.funcs[e.Name]
+	case *ast.CallExpr:
+		for _, arg := range slices.Backward(e.Args) {
+			if fn := src.handlerFunc(arg); fn != nil {
+				return fn
+			}
+		}
+	case *ast.UnaryExpr:
+		return src.handlerFunc(e.X)
+	case *ast.CompositeLit:
+		if id, ok := e.Type.(*ast.Ident); ok {
+			return src.methods[id.Name+".ServeHTTP"]
+		}
+	}
+	return nil
+}
+
+func isIdent(e ast.Expr, name string) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == name
+}
+
+// isRequestMethod reports whether e is r.Method.
+func isRequestMethod(e ast.Expr) bool {
+	sel, ok := e.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "Method"
+}
+
+// httpMethod returns "GET" for http.MethodGet.
+func httpMethod(e ast.Expr) string {
+	if sel, ok := e.(*ast.SelectorExpr); ok && isIdent(sel.X, "http") {
+		if m, ok := strings.CutPrefix(sel.Sel.Name, "Method"); ok {
+			return strings.ToUpper(m)
+		}
+	}
+	return ""
+}
+
+// statusCodes maps the name of each http.Status constant to its code.
+var statusCodes = func() map[string]int {
+	codes := map[string]int{"StatusNonAuthoritativeInfo": 203, "StatusTeapot": 418}
+	for c := 100; c < 600; c++ {
+		if text := http.StatusText(c); text != "" {
+			name := strings.NewReplacer(" ", "", "-", "", "'", "").Replace(text)
+			codes["Status"+name] = c
+		}
+	}
+	return codes
+}()
+
+// handlerFacts is what one operation of a handler does.
+type handlerFacts struct {
+	codes     map[int]bool
+	query     map[string]bool
+	body      []string         // JSON fields of the decoded request body, nil if none found
+	responses map[int][]string // JSON fields written per status
+	seen      map[*ast.FuncDecl]bool
+}
+
+func newHandlerFacts() *handlerFacts {
+	return &handlerFacts{codes: map[int]bool{}, query: map[string]bool{}, responses: map[int][]string{}, seen: map[*ast.FuncDecl]bool{}}
+}
+
+// operations splits fn by method. The key "" means fn does not say which
+// methods it serves.
+func (src *specSource) operations(fn *ast.FuncDecl) map[string]*handlerFacts {
+	var common []ast.Stmt
+	var guard []string
+	cases := map[string][]ast.Stmt{}
+	for _, stmt := range fn.Body.List {
+		switch s := stmt.(type) {
+		case *ast.IfStmt:
+			if methods := methodGuard(s.Cond); methods != nil {
+				guard = methods
+				continue
+			}
+		case *ast.SwitchStmt:
+			if s.Tag != nil && isRequestMethod(s.Tag) {
+				for _, cc := range s.Body.List {
+					cc := cc.(*ast.CaseClause)
+					for _, e := range cc.List {
+						if m := httpMethod(e); m != "" {
+							cases[m] = cc.Body
+						}
+					}
+				}
+				continue
+			}
+		}
+		common = append(common, stmt)
+	}
+	ops := map[string]*handlerFacts{}
+	collect := func(stmts ...[]ast.Stmt) *handlerFacts {
+		f := newHandlerFacts()
+		f.seen[fn] = true
+		for _, list := range stmts {
+			for _, s := range list {
+				src.collect(s, fn, f)
+			}
+		}
+		return f
+	}
+	switch {
+	case len(cases) > 0:
+		for m, body := range cases {
+			ops[m] = collect(common, body)
+		}
+	case guard != nil:
+		for _, m := range guard {
+			ops[m] = collect(common)
+		}
+	default:
+		ops[""] = collect(common)
+	}
+	return ops
+}
+
+// methodGuard returns the methods of `r.Method != A && r.Method != B`.
+func methodGuard(e ast.Expr) []string {
+	b, ok := e.(*ast.BinaryExpr)
+	if !ok {
+		return nil
+	}
+	switch b.Op {
+	case token.LAND:
+		left, right := methodGuard(b.X), methodGuard(b.Y)
+		if left == nil || right == nil {
+			return nil
+		}
+		return append(left, right...)
+	case token.NEQ:
+		if m := httpMethod(b.Y); isRequestMethod(b.X) && m != "" {
+			return []string{m}
+		}
+	}
+	return nil
+}
+
+// collect adds what n does to f, following calls to package functions.
+// fn is the function n is in, for looking up variables.
+func (src *specSource) collect(n ast.Node, fn *ast.FuncDecl, f *handlerFacts) {
+	queryVars := map[string]bool{}
+	ast.Inspect(fn, func(n ast.Node) bool {
+		if as, ok := n.(*ast.AssignStmt); ok && len(as.Lhs) == 1 && len(as.Rhs) == 1 && isQueryCall(as.Rhs[0]) {
+			if id, ok := as.Lhs[0].(*ast.Ident); ok {
+				queryVars[id.Name] = true
+			}
+		}
+		return true
+	})
+	compared := map[ast.Expr]bool{} // a status one is compared with, not written
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.BinaryExpr:
+			compared[n.X], compared[n.Y] = true, true
+		case *ast.SelectorExpr:
+			if isIdent(n.X, "http") && !compared[n] {
+				if c, ok := statusCodes[n.Sel.Name]; ok {
+					f.codes[c] = true
+				}
+			}
+		case *ast.CallExpr:
+			if sel, ok := n.Fun.(*ast.SelectorExpr); ok && (sel.Sel.Name == "Get" || sel.Sel.Name == "Has") && len(n.Args) == 1 {
+				if id, ok := sel.X.(*ast.Ident); ok && queryVars[id.Name] || isQueryCall(sel.X) {
+					if lit, ok := n.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+						k, _ := strconv.Unquote(lit.Value)
+						f.query[k] = true
+					}
+				}
+			}
+			id, ok := n.Fun.(*ast.Ident)
+			if !ok {
+				break
+			}
+			switch {
+			case specErrorMappers[id.Name]:
+				return false
+			case id.Name == "decodeBody" && len(n.Args) == 3:
+				if fields, ok := src.valueFields(n.Args[2], fn); ok {
+					f.body = fields
+				}
+			case id.Name == "writeValue" && len(n.Args) == 4:
+				if sel, ok := n.Args[2].(*ast.SelectorExpr); ok && isIdent(sel.X, "http") {
+					if fields, ok := src.valueFields(n.Args[3], fn); ok {
+						f.responses[statusCodes[sel.Sel.Name]] = fields
+					}
+				}
+			}
+			if callee := src.funcs[id.Name]; callee != nil && !f.seen[callee] {
+				f.seen[callee] = true
+				src.collect(callee.Body, callee, f)
+			}
+		}
+		return true
+	})
+}
+
+// isQueryCall reports whether e is r.URL.Query().
+func isQueryCall(e ast.Expr) bool {
+	call, ok := e.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	return ok && sel.Sel.Name == "Query" && len(call.Args) == 0
+}
+
+// valueFields returns the JSON fields of the value e, when its type can be
+// told from the source: a struct or map literal, or a variable declared
+// in fn with a struct type or assigned one.
+func (src *specSource) valueFields(e ast.Expr, fn *ast.FuncDecl) ([]string, bool) {
+	if u, ok := e.(*ast.UnaryExpr); ok && u.Op == token.AND {
+		e = u.X
+	}
+	switch e := e.(type) {
+	case *ast.CompositeLit:
+		switch t := e.Type.(type) {
+		case *ast.Ident:
+			return src.typeFields(t)
+		case *ast.StructType:
+			return src.typeFields(t)
+		case *ast.MapType:
+			var keys []string
+			for _, elt := range e.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					if lit, ok := kv.Key.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+						k, _ := strconv.Unquote(lit.Value)
+						keys = append(keys, k)
+					}
+				}
+			}
+			return keys, true
+		}
+	case *ast.Ident:
+		var fields []string
+		found := false
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.ValueSpec:
+				for _, name := range n.Names {
+					if name.Name == e.Name && n.Type != nil {
+						fields, found = src.typeFields(n.Type)
+					}
+				}
+			case *ast.AssignStmt:
+				for i, lhs := range n.Lhs {
+					if isIdent(lhs, e.Name) && i < len(n.Rhs) && n.Tok == token.DEFINE {
+						if lit, ok := n.Rhs[i].(*ast.CompositeLit); ok {
+							fields, found = src.valueFields(lit, fn)
+						}
+					}
+				}
+			}
+			return !found
+		})
+		return fields, found
+	}
+	return nil, false
+}
+
+// typeFields returns the JSON fields of a struct type, flattening embedded
+// structs like encoding/json.
+func (src *specSource) typeFields(t ast.Expr) ([]string, bool) {
+	var st *ast.StructType
+	switch t := t.(type) {
+	case *ast.Ident:
+		st = src.structs[t.Name]
+	case *ast.StructType:
+		st = t
+	}
+	if st == nil {
+		return nil, false
+	}
+	var fields []string
+	for _, field := range st.Fields.List {
+		tag := ""
+		if field.Tag != nil {
+			raw, _ := strconv.Unquote(field.Tag.Value)
+			tag = reflect.StructTag(raw).Get("json")
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if tag == "-" {
+			continue
+		}
+		if len(field.Names) == 0 {
+			if name == "" {
+				embedded, _ := src.typeFields(field.Type)
+				fields = append(fields, embedded...)
+			} else {
+				fields = append(fields, name)
+			}
+			continue
+		}
+		for _, n := range field.Names {
+			if !n.IsExported() {
+				continue
+			}
+			if name != "" {
+				fields = append(fields, name)
+			} else {
+				fields = append(fields, n.Name)
+			}
+		}
+	}
+	return fields, true
+}
+
+// specDoc is the part of the OpenAPI document validate-spec reads.
+type specDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]map[string]any `json:"schemas"`
+	} `json:"components"`
+}
+
+type specOperation struct {
+	Parameters  []specParam `json:"parameters"`
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema map[string]any `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema map[string]any `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+}
+
+type specParam struct {
+	Name string `json:"name"`
+	In   string `json:"in"`
+}
+
+// properties returns the property names of an object schema, following
+// $ref, or false for any other schema.
+func (d *specDoc) properties(schema map[string]any) ([]string, bool) {
+	if ref, ok := schema["$ref"].(string); ok {
+		schema = d.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")]
+	}
+	props, ok := schema["properties"].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	return names, true
+}
+
+// compareFields reports fields missing from either side.
+func compareFields(what string, goFields, docFields []string) []string {
+	var problems []string
+	for _, f := range goFields {
+		if !slices.Contains(docFields, f) {
+			problems = append(problems, fmt.Sprintf("%s field %s is not in the schema", what, f))
+		}
+	}
+	for _, f := range docFields {
+		if !slices.Contains(goFields, f) {
+			problems = append(problems, fmt.Sprintf("%s schema property %s is not in the Go type", what, f))
+		}
+	}
+	return problems
+}
+
+// checkSpec compares the document with the source in dir.
+func checkSpec(dir string) ([]string, error) {
+	src, err := parseSpecSource(dir)
+	if err != nil {
+		return nil, err
+	}
+	var doc specDoc
+	if err := json.Unmarshal(openAPIDocument(), &doc); err != nil {
+		return nil, err
+	}
+	routes := src.routes()
+	var problems []string
+	for tmpl := range doc.Paths {
+		if _, ok := routes[tmpl]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: documented but not registered", tmpl))
+		}
+	}
+	for pattern, fn := range routes {
+		if exemptFromSpec(pattern) {
+			continue
+		}
+		item, ok := doc.Paths[pattern]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: registered but not documented", pattern))
+			continue
+		}
+		if fn == nil {
+			problems = append(problems, fmt.Sprintf("%s: cannot find the handler function", pattern))
+			continue
+		}
+		var shared []specParam
+		json.Unmarshal(item["parameters"], &shared)
+		ops := src.operations(fn)
+		for method, raw := range item {
+			if method == "parameters" {
+				continue
+			}
+			m := strings.ToUpper(method)
+			facts := ops[m]
+			if facts == nil {
+				facts = ops[""]
+			}
+			if facts == nil {
+				problems = append(problems, fmt.Sprintf("%s %s: documented but the handler does not serve it", m, pattern))
+				continue
+			}
+			var op specOperation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("%s %s: %v", m, pattern, err)
+			}
+			problems = append(problems, checkOperation(&doc, m+" "+pattern, &op, shared, facts)...)
+		}
+		for m := range ops {
+			if _, ok := item[strings.ToLower(m)]; m != "" && !ok {
+				problems = append(problems, fmt.Sprintf("%s %s: served but not documented", m, pattern))
+			}
+		}
+	}
+	slices.Sort(problems)
+	return problems, nil
+}
+
+func checkOperation(doc *specDoc, name string, op *specOperation, shared []specParam, facts *handlerFacts) []string {
+	var problems []string
+	add := func(format string, args ...any) {
+		problems = append(problems, name+": "+fmt.Sprintf(format, args...))
+	}
+	for c := range facts.codes {
+		if _, ok := op.Responses[strconv.Itoa(c)]; !ok && !specGenericStatuses[c] {
+			add("writes %d, which is not documented", c)
+		}
+	}
+	documented := map[string]bool{}
+	for _, p := range append(shared, op.Parameters...) {
+		if p.In == "query" {
+			documented[p.Name] = true
+		}
+	}
+	for k := range facts.query {
+		if !documented[k] {
+			add("reads query parameter %s, which is not documented", k)
+		}
+	}
+	if facts.body != nil && op.RequestBody != nil {
+		if media, ok := op.RequestBody.Content[mediaTypeJSON]; ok {
+			if props, ok := doc.properties(media.Schema); ok {
+				for _, p := range compareFields("request body", facts.body, props) {
+					add("%s", p)
+				}
+			}
+		}
+	}
+	for c, fields := range facts.responses {
+		resp, ok := op.Responses[strconv.Itoa(c)]
+		if !ok {
+			continue // reported above
+		}
+		if media, ok := resp.Content[mediaTypeJSON]; ok {
+			if props, ok := doc.properties(media.Schema); ok {
+				for _, p := range compareFields(fmt.Sprintf("%d response", c), fields, props) {
+					add("%s", p)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// runValidateSpec serves `server validate-spec`, exiting 1 on any
+// mismatch.
+func runValidateSpec() {
+	problems, err := checkSpec(".")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "validate-spec:", err)
+		os.Exit(2)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "validate-spec: %d mismatches between the OpenAPI document and the handlers\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Println("OpenAPI document matches the routes and handlers")
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: `server validate-spec` ตรวจว่าเอกสาร OpenAPI ยังตรงกับ router และ handler (ต้องรันที่ root ของ repo เพราะอ่าน source)
+
+	1. อ่าน source ด้วย `go/ast` หา route ที่ `main` ลงทะเบียนกับ `mux` แล้วตาม handler ไปจนเจอฟังก์ชันจริง (แกะ wrapper อย่าง `requireCourseWriteAuth` ออก)
+	2. ตรวจแล้ว fail (exit 1) เมื่อ:
+	   - route มีแต่ไม่อยู่ในเอกสาร หรือเอกสารมี path ที่ไม่ได้ลงทะเบียน (route ที่ตั้งใจไม่ใส่ อยู่ใน `specExempt` พร้อมเหตุผล)
+	   - method ที่ handler รับ (ดูจาก `if r.Method != ...` หรือ `switch r.Method`) ไม่ตรงกับเอกสาร
+	   - status code ที่ handler เขียน (รวมฟังก์ชันที่มันเรียก) ไม่มีในเอกสาร; code กลางอย่าง 405/406/415/500 ไม่นับ
+	   - query parameter ที่ handler อ่านแต่เอกสารไม่มี
+	   - field ของ body ที่ `decodeBody` อ่านหรือที่ `writeValue` เขียน ไม่ตรงกับ property ของ schema
+	3. เป็นการวิเคราะห์แบบ static จึงตาม type ได้เท่าที่เห็นใน source (literal หรือตัวแปรที่ประกาศ type ไว้)
+*/
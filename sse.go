@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /events carries the same course changes as /ws/courses as Server-Sent
+// Events, which browsers consume with a plain EventSource and reconnect by
+// themselves. Each event's id is the change's sequence number, so a
+// reconnecting client's Last-Event-ID says exactly where to resume.
+
+const (
+	sseHeartbeatInterval = 30 * time.Second
+	sseRetry             = 3 * time.Second
+)
+
+// lastEventID returns the sequence a client resumes after: the
+// Last-Event-ID header EventSource sends on reconnect, or ?lastEventId= for
+// clients that cannot set headers. -1 means a fresh connection.
+func lastEventID(r *http.Request) (int64, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("lastEventId")
+	}
+	if v = strings.TrimSpace(v); v == "" {
+		return -1, nil
+	}
+	seq, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, fmt.Errorf("invalid Last-Event-ID %q", v)
+	}
+	return seq, nil
+}
+
+// writeSSE writes one event. JSON has no raw newlines, so data fits on one
+// line.
+func writeSSE(w http.ResponseWriter, ev courseChange) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Op, data)
+	return err
+}
+
+// eventsHandler serves GET /events. Events are named after the change op
+// ("created", "updated", "deleted") and hold a /courses/changes entry;
+// ?course=1,2 narrows the stream. A resuming client first gets what it
+// missed, one event per course with its latest state, then live events.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ids, err := parseCourseIDs(r.URL.Query().Get("course"))
+	if err != nil {
+		writeError(w, r, "Invalid course filter", http.StatusBadRequest)
+		return
+	}
+	since, err := lastEventID(r)
+	if err != nil {
+		writeError(w, r, "Invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+	rc := http.NewResponseController(w)
+	keepStreamOpen(w)
+	who := requestPrincipal(r)
+
+	// Subscribe before reading the backlog so nothing falls in between;
+	// live events the backlog already covered are skipped below.
+	sub := courseEvents.subscribe(ids, requestTenant(r))
+	defer courseEvents.unsubscribe(sub)
+	var backlog []courseChange
+	courseMu.RLock()
+	caughtUp := changeSeq
+	if since > changeSeq {
+		// The ID is from before a restart, when sequences began again at
+		// zero; everything here is news to the client.
+		since = 0
+	}
+	if since >= 0 {
+		for _, ch := range changesSince(since) {
+			if (sub.courses != nil && !sub.courses[ch.ID]) || !ch.ownedBy(sub.tenant) {
+				continue
+			}
+			if ch.Course != nil && ch.Course.Private {
+				var ok bool
+				if ch, ok = ch.hidden(); !ok {
+					continue
+				}
+			}
+			backlog = append(backlog, ch.viewedBy(who))
+		}
+	}
+	courseMu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep reverse proxies such as nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	for _, ch := range backlog {
+		if writeSSE(w, ch) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+	requestLogger(r).Info("SSE client connected", "remote_addr", r.RemoteAddr, "live", courseEvents.count(), "resumed", len(backlog))
+	defer requestLogger(r).Info("SSE client disconnected", "remote_addr", r.RemoteAddr)
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.events:
+			if !ok {
+				// Dropped for falling behind. Ending the response makes
+				// EventSource reconnect with Last-Event-ID and catch up.
+				return
+			}
+			if ev.Seq <= caughtUp {
+				continue
+			}
+			if writeSSE(w, ev.viewedBy(who)) != nil || rc.Flush() != nil {
+				return
+			}
+		case <-heartbeat.C:
+			// A comment line keeps idle connections from being timed out.
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Server-Sent Events (`/events`)
+
+	1. เป็นทางเลือกที่ง่ายกว่า WebSocket: ฝั่ง browser ใช้แค่ `new EventSource("/events")` เป็น HTTP ธรรมดาที่ server ส่งข้อมูลลงมาเรื่อย ๆ
+	2. แต่ละ event มี `id:` = sequence number ของการเปลี่ยนแปลง และ `event:` = created / updated / deleted
+	3. เมื่อหลุด browser จะต่อใหม่เองพร้อม header `Last-Event-ID` server จะส่งสิ่งที่พลาดไป (จาก `changesSince`) ก่อน แล้วจึงส่ง event สดต่อ
+	   - subscribe ก่อนอ่าน backlog แล้วข้าม event ที่ซ้ำ จึงไม่มี event ตกหล่นระหว่างสองขั้นตอนนี้
+	4. ส่ง comment `: ping` ทุก 30 วินาทีกัน proxy ตัด connection ที่เงียบ และใช้ `r.Context()` รู้ว่า client ปิดไปแล้ว
+*/
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /status is the public status page: how each component is doing now,
+// its uptime over the last day, week, month and quarter, and the incident
+// notes an admin has posted. Browsers get the page from
+// templates/status.html; anything else gets the same as JSON.
+//
+// A checker runs every STATUS_CHECK_INTERVAL (default 1m) and keeps one
+// bucket per component and hour for statusHistory. Uptime is the share of
+// checks that did not find an outage; degraded counts as up. The buckets
+// are a table like the catalog's (export.go), so warehouse exports and
+// store snapshots carry the history too.
+//
+//	api      5xx responses over the last 5 minutes, from the SLO counters
+//	catalog  the course store answers within a second
+//	jobs     webhook and email jobs are mostly succeeding
+//	email    SMTP_ADDR accepts connections, when it is set
+//	probe    the synthetic probe (probe.go) passes, when it runs
+
+const (
+	statusOperational = "operational"
+	statusDegraded    = "degraded"
+	statusOutage      = "outage"
+
+	statusHistory = 90 * 24 * time.Hour
+	// statusIncidentDays is how long a resolved incident stays on the page.
+	statusIncidentDays = 7
+)
+
+// incidentStatuses are the stages of an incident, in order.
+var incidentStatuses = []string{"investigating", "identified", "monitoring", "resolved"}
+
+// statusUptimeWindows are the uptime figures shown, by label.
+var statusUptimeWindows = []struct {
+	Label  string
+	window time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+	{"90d", statusHistory},
+}
+
+var statusCheckInterval = time.Minute
+
+func init() {
+	if v := os.Getenv("STATUS_CHECK_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Second {
+			log.Fatalf("Invalid STATUS_CHECK_INTERVAL %q: must be a duration of at least 1s", v)
+		}
+		statusCheckInterval = d
+	}
+}
+
+// statusCheck finds how a component is doing, and why if not well.
+type statusCheck struct {
+	name  string
+	check func() (status, detail string)
+}
+
+var statusChecks = []statusCheck{
+	{"api", checkAPIStatus},
+	{"catalog", checkCatalogStatus},
+	{"jobs", checkJobsStatus},
+	{"email", checkEmailStatus},
+	{"probe", checkProbeStatus},
+}
+
+// healthBucket counts one hour of checks of a component.
+type healthBucket struct {
+	hour     int64 // Unix hour the counts belong to
+	checks   int64
+	failures int64 // checks that found an outage
+}
+
+// componentHealth is the latest check of a component and its history, one
+// bucket per hour in a ring.
+type componentHealth struct {
+	Name      string            `json:"name"`
+	Status    string            `json:"status"`
+	Detail    string            `json:"detail,omitempty"`
+	CheckedAt time.Time         `json:"checked_at"`
+	LatencyMS int64             `json:"latency_ms"`
+	Uptime    map[string]string `json:"uptime"` // percent by window, "" before the first check
+
+	buckets []healthBucket
+}
+
+type incidentUpdate struct {
+	At     time.Time `json:"at"`
+	Status string    `json:"status"`
+	Note   string    `json:"note"`
+}
+
+// statusIncident is an incident note shown on the status page. Updates
+// are newest last.
+type statusIncident struct {
+	ID         int              `json:"id"`
+	Title      string           `json:"title"`
+	Status     string           `json:"status"`
+	Components []string         `json:"components"`
+	Updates    []incidentUpdate `json:"updates"`
+	CreatedAt  time.Time        `json:"created_at"`
+	ResolvedAt *time.Time       `json:"resolved_at,omitempty"`
+}
+
+type statusPage struct {
+	Status     string            `json:"status"` // the worst component's
+	Components []componentHealth `json:"components"`
+	Incidents  []statusIncident  `json:"incidents"`
+}
+
+var (
+	// statusMu protects componentHealths, incidents and nextIncidentID.
+	statusMu         sync.Mutex
+	componentHealths = map[string]*componentHealth{}
+	incidents        []*statusIncident
+	nextIncidentID   = 1
+)
+
+func checkAPIStatus() (string, string) {
+	now := time.Now()
+	var total, errors int64
+	sloMu.Lock()
+	for _, rs := range sloRoutes {
+		t, e, _ := rs.counts(now, sloShortWindow)
+		total += t
+		errors += e
+	}
+	sloMu.Unlock()
+	if total == 0 || errors == 0 {
+		return statusOperational, ""
+	}
+	rate := float64(errors) / float64(total)
+	detail := strconv.FormatFloat(rate*100, 'f', 1, 64) + "% of requests failed in the last 5 minutes"
+	switch {
+	case rate >= 0.5:
+		return statusOutage, detail
+	case rate >= 0.05:
+		return statusDegraded, detail
+	}
+	return statusOperational, ""
+}
+
+func checkCatalogStatus() (string, string) {
+	if !serverReady.Load() {
+		return statusDegraded, "warming up"
+	}
+	if !courseStoreAnswers(time.Second) {
+		return statusOutage, "the course store did not answer within 1s"
+	}
+	return statusOperational, ""
+}
+
+// courseStoreAnswers reports whether the course store can be read within
+// timeout, rather than being held by a long write.
+func courseStoreAnswers(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !courseMu.TryRLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	courseMu.RUnlock()
+	return true
+}
+
+func checkJobsStatus() (string, string) {
+	jobsMu.Lock()
+	stats := jobStatsSnapshot()
+	jobsMu.Unlock()
+	var failing []string
+	for _, s := range stats {
+		if (s.Type == jobWebhook || s.Type == jobEmail) && s.FailureRate >= 0.5 {
+			failing = append(failing, s.Type)
+		}
+	}
+	if len(failing) > 0 {
+		return statusDegraded, "most recent " + strings.Join(failing, " and ") + " jobs failed"
+	}
+	return statusOperational, ""
+}
+
+func checkEmailStatus() (string, string) {
+	if smtpAddr == "" {
+		return "", ""
+	}
+	conn, err := net.DialTimeout("tcp", smtpAddr, 5*time.Second)
+	if err != nil {
+		return statusOutage, "cannot reach the mail server"
+	}
+	conn.Close()
+	return statusOperational, ""
+}
+
+// runStatusChecks checks every component each interval.
+func runStatusChecks(interval time.Duration) {
+	for {
+		checkComponents(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// checkComponents runs the checks and records what they found at now. A
+// check that does not apply, such as email without SMTP_ADDR, says "".
+func checkComponents(now time.Time) {
+	for _, c := range statusChecks {
+		start := time.Now()
+		status, detail := c.check()
+		if status == "" {
+			continue
+		}
+		latency := time.Since(start)
+		hour := now.Unix() / 3600
+		statusMu.Lock()
+		h := componentHealths[c.name]
+		if h == nil {
+			h = &componentHealth{Name: c.name, buckets: make([]healthBucket, int(statusHistory/time.Hour))}
+			componentHealths[c.name] = h
+		}
+		if h.Status != status && detail != "" {
+			slog.Warn("Component status changed", "component", c.name, "status", status, "detail", detail)
+		} else if h.Status != status {
+			slog.Info("Component status changed", "component", c.name, "status", status)
+		}
+		h.Status, h.Detail, h.CheckedAt, h.LatencyMS = status, detail, now.UTC(), latency.Milliseconds()
+		b := &h.buckets[hour%int64(len(h.buckets))]
+		if b.hour != hour {
+			*b = healthBucket{hour: hour}
+		}
+		b.checks++
+		if status == statusOutage {
+			b.failures++
+		}
+		statusMu.Unlock()
+	}
+}
+
+// uptime is h's share of successful checks within window before now, as a
+// percentage, or "" without checks. Callers must hold statusMu.
+func (h *componentHealth) uptime(now time.Time, window time.Duration) string {
+	newest := now.Unix() / 3600
+	oldest := newest - int64(window/time.Hour) + 1
+	var checks, failures int64
+	for _, b := range h.buckets {
+		if b.hour >= oldest && b.hour <= newest {
+			checks += b.checks
+			failures += b.failures
+		}
+	}
+	if checks == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(100*float64(checks-failures)/float64(checks), 'f', 2, 64)
+}
+
+// currentStatus is the status page at now.
+func currentStatus(now time.Time) statusPage {
+	page := statusPage{Status: statusOperational, Components: []componentHealth{}, Incidents: []statusIncident{}}
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	for _, c := range statusChecks {
+		h := componentHealths[c.name]
+		if h == nil {
+			continue
+		}
+		view := *h
+		view.buckets = nil
+		view.Uptime = map[string]string{}
+		for _, w := range statusUptimeWindows {
+			view.Uptime[w.Label] = h.uptime(now, w.window)
+		}
+		page.Components = append(page.Components, view)
+		if statusRank(h.Status) > statusRank(page.Status) {
+			page.Status = h.Status
+		}
+	}
+	cutoff := now.AddDate(0, 0, -statusIncidentDays)
+	for _, in := range slices.Backward(incidents) {
+		if in.ResolvedAt == nil || in.ResolvedAt.After(cutoff) {
+			page.Incidents = append(page.Incidents, *in)
+		}
+	}
+	return page
+}
+
+func statusRank(status string) int {
+	return slices.Index([]string{statusOperational, statusDegraded, statusOutage}, status)
+}
+
+func exportHealthChecks() [][]string {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	var rows [][]string
+	for _, c := range statusChecks {
+		h := componentHealths[c.name]
+		if h == nil {
+			continue
+		}
+		for _, b := range h.buckets {
+			if b.checks > 0 {
+				rows = append(rows, []string{c.name, time.Unix(b.hour*3600, 0).UTC().Format(time.RFC3339), strconv.FormatInt(b.checks, 10), strconv.FormatInt(b.failures, 10)})
+			}
+		}
+	}
+	return rows
+}
+
+func exportIncidents() [][]string {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	rows := make([][]string, 0, len(incidents))
+	for _, in := range incidents {
+		rows = append(rows, []string{
+			strconv.Itoa(in.ID), in.Title, in.Status, strings.Join(in.Components, ","),
+			exportJSON(in.Updates), exportTime(&in.CreatedAt), exportTime(in.ResolvedAt),
+		})
+	}
+	return rows
+}
+
+// statusHandler serves GET /status, as HTML to browsers.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	page := currentStatus(time.Now())
+	w.Header().Set("Cache-Control", "no-cache")
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		writeValue(w, r, http.StatusOK, page)
+		return
+	}
+	b := defaultBrand
+	if t := requestTenant(r); t != nil {
+		b = emailBrand(t.ID)
+	}
+	var body bytes.Buffer
+	data := map[string]any{"Page": page, "Windows": statusUptimeWindows}
+	if err := renderTemplate(&body, b, "status.html", data); err != nil {
+		writeError(w, r, "Cannot render the page: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(body.Bytes())
+}
+
+// incidentRequest is the body of POST /admin/status/incidents and of an
+// update to one. Components must be ones the page shows.
+type incidentRequest struct {
+	Title      string   `json:"title"`
+	Status     string   `json:"status"`
+	Components []string `json:"components"`
+	Note       string   `json:"note"`
+}
+
+// check fills in req's default status and returns what is wrong with
+// it, or "" if nothing is.
+func (req *incidentRequest) check() string {
+	if req.Status == "" {
+		req.Status = incidentStatuses[0]
+	}
+	if !slices.Contains(incidentStatuses, req.Status) {
+		return "Unknown status " + strconv.Quote(req.Status) + "; use " + strings.Join(incidentStatuses, ", ")
+	}
+	for _, c := range req.Components {
+		if !slices.ContainsFunc(statusChecks, func(s statusCheck) bool { return s.name == c }) {
+			return "Unknown component " + strconv.Quote(c)
+		}
+	}
+	if strings.TrimSpace(req.Note) == "" {
+		return "note is required"
+	}
+	return ""
+}
+
+// adminIncidentsHandler serves GET and POST /admin/status/incidents. POST
+// opens an incident with its first note.
+func adminIncidentsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		statusMu.Lock()
+		list := []statusIncident{}
+		for _, in := range incidents {
+			list = append(list, *in)
+		}
+		statusMu.Unlock()
+		writeValue(w, r, http.StatusOK, list)
+
+	case http.MethodPost:
+		var req incidentRequest
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		if strings.TrimSpace(req.Title) == "" {
+			writeError(w, r, "title is required", http.StatusBadRequest)
+			return
+		}
+		if msg := req.check(); msg != "" {
+			writeError(w, r, msg, http.StatusBadRequest)
+			return
+		}
+		now := time.Now().UTC()
+		statusMu.Lock()
+		in := &statusIncident{
+			ID:         nextIncidentID,
+			Title:      strings.TrimSpace(req.Title),
+			Components: append([]string{}, req.Components...),
+			CreatedAt:  now,
+		}
+		nextIncidentID++
+		in.update(req, now)
+		incidents = append(incidents, in)
+		created := *in
+		statusMu.Unlock()
+		w.Header().Set("Location", "/admin/status/incidents/"+strconv.Itoa(created.ID))
+		writeValue(w, r, http.StatusCreated, created)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// update adds req's note to in at now. Callers must hold statusMu.
+func (in *statusIncident) update(req incidentRequest, now time.Time) {
+	in.Status = req.Status
+	in.Updates = append(in.Updates, incidentUpdate{At: now, Status: req.Status, Note: strings.TrimSpace(req.Note)})
+	if req.Status == "resolved" {
+		in.ResolvedAt = &now
+	} else {
+		in.ResolvedAt = nil
+	}
+}
+
+// adminIncidentHandler serves GET /admin/status/incidents/{id}, POST,
+// which adds a note and may move the incident on (or resolve it), and
+// DELETE, for an incident posted by mistake.
+func adminIncidentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid incident ID", http.StatusBadRequest)
+		return
+	}
+	var req incidentRequest
+	if r.Method == http.MethodPost && !decodeBody(w, r, &req) {
+		return
+	}
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	i := slices.IndexFunc(incidents, func(in *statusIncident) bool { return in.ID == id })
+	if i < 0 {
+		writeError(w, r, "Incident not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeValue(w, r, http.StatusOK, *incidents[i])
+	case http.MethodPost:
+		if req.Status == "" {
+			req.Status = incidents[i].Status
+		}
+		if msg := req.check(); msg != "" {
+			writeError(w, r, msg, http.StatusBadRequest)
+			return
+		}
+		if req.Components != nil {
+			incidents[i].Components = append([]string{}, req.Components...)
+		}
+		incidents[i].update(req, time.Now().UTC())
+		writeValue(w, r, http.StatusOK, *incidents[i])
+	case http.MethodDelete:
+		incidents = slices.Delete(incidents, i, i+1)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: หน้าสถานะสาธารณะ `GET /status` บอกผู้ใช้ว่าระบบเป็นอย่างไร โดยไม่ต้องถามทีม
+
+	1. ตรวจแต่ละส่วนทุก `STATUS_CHECK_INTERVAL` (ค่าเริ่มต้น 1 นาที): api (อัตรา 5xx 5 นาทีล่าสุด), catalog (store ตอบภายใน 1 วินาที), jobs (webhook/email ล้มเป็นส่วนใหญ่ไหม), email (ต่อ `SMTP_ADDR` ได้ไหม ถ้าตั้งไว้)
+	   - สถานะ: operational, degraded, outage สถานะรวมคือส่วนที่แย่ที่สุด
+	2. uptime 24h / 7d / 30d / 90d คิดจากผลตรวจที่เก็บเป็นก้อนรายชั่วโมง (degraded นับว่ายังใช้ได้)
+	   - ก้อนรายชั่วโมงและ incident เป็น table ใน export/snapshot เหมือนข้อมูล course
+	3. admin เขียน incident ได้ที่ `/admin/status/incidents` (เปิดพร้อม note แรก, POST ที่ `/{id}` เพิ่ม note/เปลี่ยนขั้น, DELETE ลบ)
+	   - หน้าแสดง incident ที่ยังไม่จบ และที่จบไม่เกิน 7 วัน
+	4. browser ได้หน้า HTML (`templates/status.html` ตามแบรนด์ของ tenant) ที่เหลือได้ JSON
+*/
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Emails are not sent to addresses on the suppression list. Addresses get
+// there three ways:
+//
+//   - the mail provider reports a hard bounce or a complaint, or
+//     softBounceLimit soft bounces within softBounceWindow, at
+//     POST /email/events;
+//   - the student follows the unsubscribe link in an email, which also
+//     goes in the List-Unsubscribe header for one-click unsubscribing
+//     (RFC 8058);
+//   - an admin adds them at POST /admin/email-suppressions.
+//
+// Bounces and complaints are about the address, so they stop every
+// tenant's emails ("tenant": "*"). Unsubscribing only stops the emails of
+// the tenant that sent the link. Admins list entries with
+// GET /admin/email-suppressions and lift them with DELETE
+// /admin/email-suppressions/{email}.
+//
+// Provider events are signed with EMAIL_EVENTS_SECRET like our own
+// webhooks are (webhooks.go), in the X-Email-Events-Signature header, and
+// the endpoint is off without the secret. Unsubscribe links are signed
+// with UNSUBSCRIBE_SECRET; without it a random key is used, and links
+// stop working when the server restarts. Links in the main site's
+// emails need PUBLIC_URL, the site's address, since an email has no
+// host to resolve a path against.
+
+const (
+	emailEventsSignatureHeader = "X-Email-Events-Signature"
+	emailEventsTolerance       = 5 * time.Minute
+	softBounceLimit            = 3
+	softBounceWindow           = 7 * 24 * time.Hour
+	// allTenants is the tenant of suppressions that stop every tenant's
+	// emails.
+	allTenants = "*"
+)
+
+// Suppression reasons.
+const (
+	suppressHardBounce  = "hard_bounce"
+	suppressSoftBounce  = "soft_bounce"
+	suppressComplaint   = "complaint"
+	suppressUnsubscribe = "unsubscribe"
+	suppressManual      = "manual"
+)
+
+var (
+	emailEventsSecret = os.Getenv("EMAIL_EVENTS_SECRET")
+	unsubscribeSecret = []byte(os.Getenv("UNSUBSCRIBE_SECRET"))
+	publicURL         = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+)
+
+func init() {
+	if len(unsubscribeSecret) == 0 {
+		unsubscribeSecret = make([]byte, 32)
+		rand.Read(unsubscribeSecret)
+	}
+	if publicURL != "" {
+		if u, err := url.Parse(publicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid PUBLIC_URL %q: want an http or https URL", publicURL)
+		}
+	}
+}
+
+type emailSuppression struct {
+	Email string `json:"email"`
+	// Tenant is the tenant whose emails are stopped: "" for the main site
+	// and "*" for all of them.
+	Tenant    string    `json:"tenant"`
+	Reason    string    `json:"reason"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	// suppressMu protects suppressions, by tenant and lower-cased address,
+	// and softBounces, the recent soft bounces of each address.
+	suppressMu   sync.Mutex
+	suppressions = map[string]*emailSuppression{}
+	softBounces  = map[string][]time.Time{}
+)
+
+func suppressionKey(tenantID, addr string) string {
+	return tenantID + "\x00" + strings.ToLower(addr)
+}
+
+// emailSuppressed reports whether emails of tenantID to addr are stopped.
+func emailSuppressed(tenantID, addr string) bool {
+	suppressMu.Lock()
+	defer suppressMu.Unlock()
+	return suppressions[suppressionKey(allTenants, addr)] != nil || suppressions[suppressionKey(tenantID, addr)] != nil
+}
+
+// suppress adds s unless its address is already suppressed for its
+// tenant. Callers must hold suppressMu.
+func suppress(s *emailSuppression) *emailSuppression {
+	key := suppressionKey(s.Tenant, s.Email)
+	if old := suppressions[key]; old != nil {
+		return old
+	}
+	s.CreatedAt = time.Now().UTC()
+	suppressions[key] = s
+	slog.Info("Suppressed emails", "email", s.Email, "tenant", s.Tenant, "reason", s.Reason)
+	return s
+}
+
+// unsubscribeToken signs tenantID and addr for the unsubscribe link.
+func unsubscribeToken(tenantID, addr string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(tenantID + "\x00" + addr))
+	mac := hmac.New(sha256.New, unsubscribeSecret)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseUnsubscribeToken returns the tenant and address token was made
+// for, or ok false if it was not made by this server.
+func parseUnsubscribeToken(token string) (tenantID, addr string, ok bool) {
+	payload, sig, found := strings.Cut(token, ".")
+	if !found {
+		return "", "", false
+	}
+	mac := hmac.New(sha256.New, unsubscribeSecret)
+	mac.Write([]byte(payload))
+	want := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return "", "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", false
+	}
+	tenantID, addr, found = strings.Cut(string(b), "\x00")
+	return tenantID, addr, found
+}
+
+// unsubscribeURL is the link that stops tenantID's emails to addr, or ""
+// if the main site has no PUBLIC_URL to link to.
+func unsubscribeURL(tenantID, addr string) string {
+	base := publicURL
+	if t := tenantsByID[tenantID]; t != nil {
+		base = "https://" + t.Domains[0]
+	}
+	if base == "" {
+		return ""
+	}
+	return base + "/email/unsubscribe?token=" + url.QueryEscape(unsubscribeToken(tenantID, addr))
+}
+
+// emailEvent is one event of POST /email/events. Other types, such as
+// deliveries, are accepted and ignored.
+type emailEvent struct {
+	Type       string `json:"type"` // bounce or complaint
+	Email      string `json:"email"`
+	BounceType string `json:"bounce_type,omitempty"` // hard or soft
+	Detail     string `json:"detail,omitempty"`
+}
+
+// emailEventsHandler serves POST /email/events, the mail provider's
+// bounce and complaint reports: a JSON array of emailEvent.
+func emailEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if emailEventsSecret == "" {
+		writeError(w, r, "Email events are not set up", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if !validEmailEventsSignature(r.Header.Get(emailEventsSignatureHeader), body) {
+		writeError(w, r, "Missing or invalid "+emailEventsSignatureHeader, http.StatusUnauthorized)
+		return
+	}
+	var events []emailEvent
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if !decodeBody(w, r, &events) {
+		return
+	}
+
+	now := time.Now()
+	suppressMu.Lock()
+	defer suppressMu.Unlock()
+	for _, ev := range events {
+		addr, err := mail.ParseAddress(ev.Email)
+		if err != nil {
+			continue
+		}
+		s := &emailSuppression{Email: addr.Address, Tenant: allTenants, Detail: ev.Detail}
+		switch {
+		case ev.Type == "complaint":
+			s.Reason = suppressComplaint
+		case ev.Type == "bounce" && ev.BounceType == "soft":
+			key := strings.ToLower(addr.Address)
+			recent := slices.DeleteFunc(softBounces[key], func(t time.Time) bool { return now.Sub(t) > softBounceWindow })
+			softBounces[key] = append(recent, now)
+			if len(softBounces[key]) < softBounceLimit {
+				continue
+			}
+			delete(softBounces, key)
+			s.Reason = suppressSoftBounce
+		case ev.Type == "bounce":
+			s.Reason = suppressHardBounce
+		default:
+			continue
+		}
+		suppress(s)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validEmailEventsSignature checks header, t=<unix seconds>,v1=<hex>, for
+// body and EMAIL_EVENTS_SECRET, refusing old or future timestamps so a
+// captured request cannot be replayed later.
+func validEmailEventsSignature(header string, body []byte) bool {
+	var ts string
+	for _, part := range strings.Split(header, ",") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(part), "t="); ok {
+			ts = v
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	t := time.Unix(sec, 0)
+	if d := time.Since(t); d > emailEventsTolerance || d < -emailEventsTolerance {
+		return false
+	}
+	return hmac.Equal([]byte(header), []byte(signWebhook(emailEventsSecret, t, body)))
+}
+
+// unsubscribeHandler serves /email/unsubscribe?token=. GET shows a page
+// asking to confirm, since mail scanners open links on their own; POST,
+// from that page or a mail client's one-click button, unsubscribes.
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	tenantID, addr, ok := parseUnsubscribeToken(token)
+	if !ok {
+		writeError(w, r, "Invalid unsubscribe link", http.StatusBadRequest)
+		return
+	}
+	data := map[string]any{"Email": addr, "Token": token}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		// A signed-in browser needs its CSRF token to post the form.
+		if s, ok := requestSession(r); ok {
+			data["CSRFToken"] = s.CSRFToken
+		}
+	case http.MethodPost:
+		suppressMu.Lock()
+		suppress(&emailSuppression{Email: addr, Tenant: tenantID, Reason: suppressUnsubscribe})
+		suppressMu.Unlock()
+		data["Done"] = true
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var page bytes.Buffer
+	if err := renderTemplate(&page, emailBrand(tenantID), "unsubscribe.html", data); err != nil {
+		writeError(w, r, "Cannot render the page: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer") // the URL holds the token
+	w.Write(page.Bytes())
+}
+
+// adminEmailSuppressionsHandler serves GET and POST
+// /admin/email-suppressions. GET filters by ?reason= and ?tenant=.
+func adminEmailSuppressionsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		suppressMu.Lock()
+		list := []*emailSuppression{}
+		for _, s := range suppressions {
+			if (q.Has("reason") && s.Reason != q.Get("reason")) || (q.Has("tenant") && s.Tenant != q.Get("tenant")) {
+				continue
+			}
+			list = append(list, s)
+		}
+		suppressMu.Unlock()
+		slices.SortFunc(list, func(a, b *emailSuppression) int { return b.CreatedAt.Compare(a.CreatedAt) })
+		writeValue(w, r, http.StatusOK, list)
+	case http.MethodPost:
+		var req struct {
+			Email  string  `json:"email"`
+			Tenant *string `json:"tenant"`
+			Detail string  `json:"detail"`
+		}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		addr, err := mail.ParseAddress(req.Email)
+		if err != nil {
+			writeError(w, r, "email must be an email address", http.StatusBadRequest)
+			return
+		}
+		tenantID := allTenants
+		if req.Tenant != nil {
+			tenantID = *req.Tenant
+		}
+		if tenantID != allTenants && tenantID != "" && tenantsByID[tenantID] == nil {
+			writeError(w, r, "Unknown tenant "+strconv.Quote(tenantID), http.StatusBadRequest)
+			return
+		}
+		suppressMu.Lock()
+		s := suppress(&emailSuppression{Email: addr.Address, Tenant: tenantID, Reason: suppressManual, Detail: req.Detail})
+		suppressMu.Unlock()
+		writeValue(w, r, http.StatusCreated, s)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminEmailSuppressionHandler serves DELETE
+// /admin/email-suppressions/{email}, which lifts every suppression of the
+// address, or with ?tenant= only that tenant's.
+func adminEmailSuppressionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := strings.ToLower(r.PathValue("email"))
+	q := r.URL.Query()
+	suppressMu.Lock()
+	defer suppressMu.Unlock()
+	removed := 0
+	for key, s := range suppressions {
+		if strings.ToLower(s.Email) == addr && (!q.Has("tenant") || s.Tenant == q.Get("tenant")) {
+			delete(suppressions, key)
+			removed++
+		}
+	}
+	delete(softBounces, addr)
+	if removed == 0 {
+		writeError(w, r, "Address is not suppressed", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ไม่ส่งอีเมลซ้ำไปยังที่อยู่ที่ bounce, ร้องเรียน หรือขอเลิกรับ (suppression list) รักษาชื่อเสียงของโดเมนผู้ส่ง
+
+	1. ผู้ให้บริการอีเมลแจ้งเหตุการณ์ที่ `POST /email/events` (JSON array ของ `{type, email, bounce_type, detail}`) ลงชื่อด้วย `EMAIL_EVENTS_SECRET` แบบเดียวกับ webhook ขาออกของเรา
+	   - hard bounce หรือ complaint = ระงับทันที ทุก tenant (`"tenant": "*"`)
+	   - soft bounce ครบ 3 ครั้งใน 7 วัน จึงระงับ (กล่องเต็มชั่วคราวไม่ควรโดนตัดทันที)
+	2. ทุกอีเมลมีลิงก์เลิกรับ (token ลงชื่อด้วย `UNSUBSCRIBE_SECRET`) และ header `List-Unsubscribe` สำหรับปุ่ม one-click ของโปรแกรมอีเมล
+	   - GET แสดงหน้ายืนยันก่อน เพราะตัวสแกนลิงก์ในอีเมลเปิดลิงก์เองได้ POST จึงเลิกรับจริง
+	   - เลิกรับเฉพาะอีเมลของ tenant ที่ส่งลิงก์นั้น; อีเมลเว็บหลักต้องตั้ง `PUBLIC_URL` ถึงจะมีลิงก์
+	3. admin จัดการรายการผ่าน `GET`/`POST /admin/email-suppressions` และ `DELETE /admin/email-suppressions/{email}`
+*/
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	mediaTypeCourseSync = "application/vnd.courses-sync"
+
+	// defaultCheckpointEvery is how many course frames are sent between
+	// checkpoint frames when the client does not ask for a specific value.
+	defaultCheckpointEvery = 100
+)
+
+// syncFrame is one frame of the sync stream. On the wire each frame is a
+// 4-byte big-endian length followed by that many bytes of JSON.
+type syncFrame struct {
+	Type   string  `json:"type"` // "course", "checkpoint" or "end"
+	Course *course `json:"course,omitempty"`
+	Cursor string  `json:"cursor,omitempty"`
+}
+
+// encodeSyncCursor returns the opaque cursor for resuming after lastID.
+func encodeSyncCursor(lastID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("id:" + strconv.Itoa(lastID)))
+}
+
+func decodeSyncCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("invalid cursor")
+	}
+	v, ok := strings.CutPrefix(string(raw), "id:")
+	if !ok {
+		return 0, errors.New("invalid cursor")
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.New("invalid cursor")
+	}
+	return id, nil
+}
+
+// writeSyncFrame writes f, with compact names (compact.go) if compact.
+func writeSyncFrame(w http.ResponseWriter, f syncFrame, compact bool) error {
+	payload, err := json.Marshal(f)
+	if compact {
+		payload, err = compactJSON(payload, err)
+	}
+	if err != nil {
+		return err
+	}
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(len(payload)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+// courseSyncHandler streams the whole catalog, ordered by ID, for clients
+// that keep a local replica. Every few courses it emits a checkpoint frame
+// with a cursor; a client whose connection drops can call
+// GET /courses/sync?cursor=<last checkpoint> to continue from there.
+func courseSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	after := 0
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		id, err := decodeSyncCursor(c)
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		after = id
+	}
+	every := defaultCheckpointEvery
+	if v := r.URL.Query().Get("checkpoint_every"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, r, "Invalid checkpoint_every", http.StatusBadRequest)
+			return
+		}
+		every = n
+	}
+
+	// Take a snapshot so a slow client does not hold the lock. It holds the
+	// courses the caller may see, as GET /courses/{id} would show them.
+	courseMu.RLock()
+	snapshot := slices.DeleteFunc(slices.Clone(CourseList), func(c course) bool { return !canViewCourse(r, c) })
+	courseMu.RUnlock()
+	slices.SortFunc(snapshot, func(a, b course) int { return a.CourseId - b.CourseId })
+
+	who := requestPrincipal(r)
+	keepStreamOpen(w)
+	profile, compact := acceptsCompact(r, mediaTypeCourseSync)
+	if compact {
+		w.Header().Set("Content-Type", mime.FormatMediaType(mediaTypeCourseSync, map[string]string{"profile": profile}))
+	} else {
+		w.Header().Set("Content-Type", mediaTypeCourseSync)
+	}
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Cache-Control", "no-store")
+	flusher, _ := w.(http.Flusher)
+
+	lastID, sent := after, 0
+	for i := range snapshot {
+		c := courseView(who, snapshot[i])
+		if c.CourseId <= after {
+			continue
+		}
+		if clientGone(r) {
+			return
+		}
+		if err := writeSyncFrame(w, syncFrame{Type: "course", Course: &c}, compact); err != nil {
+			return
+		}
+		lastID = c.CourseId
+		sent++
+		if sent%every == 0 {
+			if err := writeSyncFrame(w, syncFrame{Type: "checkpoint", Cursor: encodeSyncCursor(lastID)}, compact); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	writeSyncFrame(w, syncFrame{Type: "end", Cursor: encodeSyncCursor(lastID)}, compact)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: การ stream ข้อมูลจำนวนมากแบบ resume ได้ (GET /courses/sync)
+
+	1. Length-prefixed framing: ทุก frame เริ่มด้วยความยาว 4 byte (big-endian) ตามด้วย JSON ทำให้ client อ่านทีละ frame ได้โดยไม่ต้องรอ response จบ
+	2. Checkpoint cursor: ทุกๆ `checkpoint_every` course จะส่ง frame `checkpoint` ที่มี cursor และ `Flush()` ออกไปทันที
+	   - ถ้าการเชื่อมต่อหลุด client เรียก `GET /courses/sync?cursor=...` ด้วย cursor ล่าสุดที่ได้รับ เพื่อทำต่อจากจุดนั้นได้เลย
+	   - cursor เป็นค่า opaque (base64) client ไม่ควรพยายามแปลความหมายเอง
+	3. ใช้ snapshot ของ `CourseList` เพื่อไม่ให้ถือ lock ไว้นานระหว่างที่ส่งข้อมูลให้ client ที่ช้า
+*/
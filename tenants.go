@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Tenants let an organization serve its own catalog on its own domain,
+// such as courses.acme.com. They are listed in TENANTS_FILE, a JSON array:
+//
+//	[{"id": "acme", "domains": ["courses.acme.com"], "name": "Acme Academy",
+//	  "logo_url": "https://acme.com/logo.svg", "color": "#d7263d"}]
+//
+// A request is the tenant's when its Host is one of the tenant's domains.
+// The catalog routes then only show and change courses whose tenant field
+// is the tenant's ID, and new courses get it. Any other host is the main
+// site, which sees every course and is where an admin moves a course to a
+// tenant. The HTML pages show the tenant's name, logo and color.
+//
+// Tenant domains are served certificates from TLS_CERT_DIR; see tls.go.
+
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+type tenant struct {
+	ID      string   `json:"id"`
+	Domains []string `json:"domains"`
+	// Branding for the HTML pages.
+	Name    string `json:"name"`
+	LogoURL string `json:"logo_url,omitempty"`
+	Color   string `json:"color,omitempty"`
+	// MetadataFields replaces METADATA_FIELDS for the tenant's courses, in
+	// the same syntax (metadata.go).
+	MetadataFields string `json:"metadata_fields,omitempty"`
+	metadataRules  map[string]string
+}
+
+// brand is what the HTML templates get as .Brand. templates/brand.html
+// turns it into the page style, header and footer.
+type brand struct {
+	Name       string
+	LogoURL    string
+	Color      string
+	Background string
+	Text       string
+	Footer     string
+}
+
+// defaultBrand is the main site's.
+var defaultBrand = brand{Name: "Courses", Color: "#1f6feb", Background: "#ffffff", Text: "#1f2328"}
+
+var (
+	tenantsByDomain = map[string]*tenant{}
+	tenantsByID     = map[string]*tenant{}
+)
+
+func init() {
+	if name := os.Getenv("TENANTS_FILE"); name != "" {
+		list, err := loadTenants(name)
+		if err != nil {
+			log.Fatalf("Invalid TENANTS_FILE: %v", err)
+		}
+		for _, t := range list {
+			tenantsByID[t.ID] = t
+			for _, d := range t.Domains {
+				tenantsByDomain[d] = t
+				tlsDomains[d] = true
+			}
+		}
+	}
+}
+
+func loadTenants(name string) ([]*tenant, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var list []*tenant
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	ids, domains := map[string]bool{}, map[string]bool{}
+	for _, t := range list {
+		if !tenantIDPattern.MatchString(t.ID) || ids[t.ID] {
+			return nil, fmt.Errorf("tenant ID %q must be unique lower-case letters, digits and dashes", t.ID)
+		}
+		ids[t.ID] = true
+		if len(t.Domains) == 0 {
+			return nil, fmt.Errorf("tenant %s has no domains", t.ID)
+		}
+		for i, d := range t.Domains {
+			d = normalizeHost(d)
+			if d == "" || strings.ContainsAny(d, "/:*") || domains[d] {
+				return nil, fmt.Errorf("tenant %s: domain %q is invalid or taken", t.ID, t.Domains[i])
+			}
+			domains[d] = true
+			t.Domains[i] = d
+		}
+		if t.Name == "" {
+			t.Name = t.ID
+		}
+		if t.metadataRules, err = parseMetadataRules(t.MetadataFields); err != nil {
+			return nil, fmt.Errorf("tenant %s: metadata_fields: %v", t.ID, err)
+		}
+	}
+	return list, nil
+}
+
+// normalizeHost lower-cases a host name and drops its port and any
+// trailing dot.
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+type tenantContextKey struct{}
+
+// requestTenant returns the tenant r was sent to, or nil on the main site.
+func requestTenant(r *http.Request) *tenant {
+	t, _ := r.Context().Value(tenantContextKey{}).(*tenant)
+	return t
+}
+
+// tenantHandler puts the tenant of each request's Host in its context.
+func tenantHandler(next http.Handler) http.Handler {
+	if len(tenantsByDomain) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if t := tenantsByDomain[normalizeHost(r.Host)]; t != nil {
+			r = r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, t))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tenantOwns reports whether c belongs to the catalog r sees: the
+// tenant's courses on its domains, every course but the probe's
+// (probe.go) on the main site.
+func tenantOwns(r *http.Request, c course) bool {
+	return catalogOwns(requestTenant(r), c)
+}
+
+// catalogOwns is tenantOwns for work that outlives its request, such as an
+// export job (exportjobs.go); t is nil for the main site.
+func catalogOwns(t *tenant, c course) bool {
+	if t == nil {
+		return c.Tenant != probeTenantID
+	}
+	return c.Tenant == t.ID
+}
+
+// tenantCourses returns the courses of courses that r's tenant owns,
+// filtering in place.
+func tenantCourses(r *http.Request, courses []course) []course {
+	kept := courses[:0]
+	for _, c := range courses {
+		if tenantOwns(r, c) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// requestBrand returns the branding of r's tenant, with its published
+// theme (theme.go), or the main site's.
+func requestBrand(r *http.Request) brand {
+	t := requestTenant(r)
+	if t == nil {
+		return defaultBrand
+	}
+	themeMu.Lock()
+	defer themeMu.Unlock()
+	var published *theme
+	if tt := tenantThemes[t.ID]; tt != nil {
+		published = tt.Published
+	}
+	return t.brand(published, "/theme/logo")
+}
+
+// brand returns t's branding: its TENANTS_FILE values, overridden by th
+// where th sets them. An uploaded logo is served at logoPath. Callers must
+// hold themeMu.
+func (t *tenant) brand(th *theme, logoPath string) brand {
+	b := brand{Name: t.Name, LogoURL: t.LogoURL, Color: t.Color,
+		Background: defaultBrand.Background, Text: defaultBrand.Text}
+	if b.Color == "" {
+		b.Color = defaultBrand.Color
+	}
+	if th == nil {
+		return b
+	}
+	override := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	override(&b.Color, th.PrimaryColor)
+	override(&b.Background, th.BackgroundColor)
+	override(&b.Text, th.TextColor)
+	override(&b.Footer, th.FooterText)
+	if th.Logo != nil {
+		// The hash in the URL lets browsers cache a logo until it changes.
+		b.LogoURL = logoPath + "?v=" + th.Logo.SHA256[:12]
+	}
+	return b
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ให้แต่ละ tenant (องค์กร) ใช้ domain ของตัวเอง เช่น `courses.acme.com` เปิด catalog ของตัวเองพร้อมโลโก้และสี
+
+	1. รายชื่อ tenant อยู่ใน `TENANTS_FILE` (JSON array): `id`, `domains`, `name`, `logo_url`, `color` และ `metadata_fields` (กฎ metadata ของ tenant ดู metadata.go)
+	2. ดู tenant จาก `Host` header
+	   - domain ของ tenant → เห็นและแก้ได้เฉพาะคอร์สที่ field `tenant` ตรงกัน คอร์สใหม่ได้ `tenant` อัตโนมัติ
+	   - host อื่น → ไซต์หลัก เห็นทุกคอร์ส และเป็นที่ที่ admin ย้ายคอร์สเข้า tenant
+	3. template HTML ได้ `.Brand` (ชื่อ, โลโก้, สี, footer) ตาม tenant และ theme ที่ publish แล้ว (theme.go)
+	4. domain ของ tenant ได้ cert จาก `TLS_CERT_DIR` ตาม SNI อัตโนมัติ (ดู tls.go)
+*/
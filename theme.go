@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// A tenant's theme restyles its pages beyond the TENANTS_FILE branding: an
+// uploaded logo, the primary, background and text colors, and a footer
+// line. Admins edit a draft, look at it rendered, and publish it; visitors
+// only ever see the published theme.
+//
+//	GET  /admin/tenants/{id}/theme            the published theme and the draft
+//	PUT  /admin/tenants/{id}/theme            replace the draft's colors and footer
+//	PUT  /admin/tenants/{id}/theme/logo       upload the draft's logo (PNG, JPEG, GIF or WebP)
+//	GET  /admin/tenants/{id}/theme/preview    the sign-in page with the draft applied
+//	POST /admin/tenants/{id}/theme/publish    make the draft the published theme
+//
+// The published logo is served to the tenant's domains at /theme/logo.
+
+const maxThemeFooterLength = 280
+
+var themeColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// themeLogoTypes are the logo formats accepted. SVG is left out because
+// it can carry script.
+var themeLogoTypes = map[string]bool{"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true}
+
+type theme struct {
+	PrimaryColor    string     `json:"primary_color,omitempty"`
+	BackgroundColor string     `json:"background_color,omitempty"`
+	TextColor       string     `json:"text_color,omitempty"`
+	FooterText      string     `json:"footer_text,omitempty"`
+	Logo            *themeLogo `json:"logo,omitempty"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+type themeLogo struct {
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+
+	data []byte
+}
+
+// tenantTheme is a tenant's theme settings. Published is nil until the
+// first publish.
+type tenantTheme struct {
+	Published   *theme     `json:"published"`
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	Draft       *theme     `json:"draft"`
+}
+
+var (
+	// themeMu protects tenantThemes and the themes in it.
+	themeMu      sync.Mutex
+	tenantThemes = map[string]*tenantTheme{}
+)
+
+// themeOf returns the theme settings of tenant id, starting them if
+// needed. Callers must hold themeMu.
+func themeOf(id string) *tenantTheme {
+	tt := tenantThemes[id]
+	if tt == nil {
+		tt = &tenantTheme{Draft: &theme{}}
+		tenantThemes[id] = tt
+	}
+	return tt
+}
+
+// adminTenant returns the tenant named by the {id} path value, or writes
+// 404.
+func adminTenant(w http.ResponseWriter, r *http.Request) *tenant {
+	t := tenantsByID[r.PathValue("id")]
+	if t == nil {
+		writeError(w, r, "Tenant not found", http.StatusNotFound)
+	}
+	return t
+}
+
+// adminThemeHandler serves GET and PUT /admin/tenants/{id}/theme.
+func adminThemeHandler(w http.ResponseWriter, r *http.Request) {
+	t := adminTenant(w, r)
+	if t == nil {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		themeMu.Lock()
+		defer themeMu.Unlock()
+		writeValue(w, r, http.StatusOK, themeOf(t.ID))
+	case http.MethodPut:
+		var req struct {
+			PrimaryColor    string `json:"primary_color"`
+			BackgroundColor string `json:"background_color"`
+			TextColor       string `json:"text_color"`
+			FooterText      string `json:"footer_text"`
+		}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		for _, c := range []string{req.PrimaryColor, req.BackgroundColor, req.TextColor} {
+			if c != "" && !themeColorPattern.MatchString(c) {
+				writeError(w, r, "colors must look like #1f6feb or #fff", http.StatusBadRequest)
+				return
+			}
+		}
+		if utf8.RuneCountInString(req.FooterText) > maxThemeFooterLength {
+			writeError(w, r, "footer_text must be at most "+strconv.Itoa(maxThemeFooterLength)+" characters", http.StatusBadRequest)
+			return
+		}
+		themeMu.Lock()
+		defer themeMu.Unlock()
+		tt := themeOf(t.ID)
+		tt.Draft = &theme{
+			PrimaryColor:    req.PrimaryColor,
+			BackgroundColor: req.BackgroundColor,
+			TextColor:       req.TextColor,
+			FooterText:      req.FooterText,
+			Logo:            tt.Draft.Logo,
+			UpdatedAt:       time.Now().UTC(),
+		}
+		writeValue(w, r, http.StatusOK, tt)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminThemeLogoHandler serves /admin/tenants/{id}/theme/logo: GET returns
+// the draft's logo, PUT replaces it with the request body and DELETE
+// removes it.
+func adminThemeLogoHandler(w http.ResponseWriter, r *http.Request) {
+	t := adminTenant(w, r)
+	if t == nil {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		themeMu.Lock()
+		logo := themeOf(t.ID).Draft.Logo
+		themeMu.Unlock()
+		serveThemeLogo(w, r, logo)
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, r, err)
+			return
+		}
+		// Trust the bytes, not the client's Content-Type.
+		contentType := http.DetectContentType(data)
+		if !themeLogoTypes[contentType] {
+			writeError(w, r, "Logo must be a PNG, JPEG, GIF or WebP image", http.StatusUnsupportedMediaType)
+			return
+		}
+		sum := sha256.Sum256(data)
+		logo := &themeLogo{ContentType: contentType, Size: len(data), SHA256: hex.EncodeToString(sum[:]), data: data}
+		themeMu.Lock()
+		defer themeMu.Unlock()
+		tt := themeOf(t.ID)
+		draft := *tt.Draft
+		draft.Logo, draft.UpdatedAt = logo, time.Now().UTC()
+		tt.Draft = &draft
+		writeValue(w, r, http.StatusOK, logo)
+	case http.MethodDelete:
+		themeMu.Lock()
+		defer themeMu.Unlock()
+		tt := themeOf(t.ID)
+		draft := *tt.Draft
+		draft.Logo, draft.UpdatedAt = nil, time.Now().UTC()
+		tt.Draft = &draft
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminThemePreviewHandler serves GET /admin/tenants/{id}/theme/preview,
+// the sign-in page as the tenant's visitors would see it once the draft is
+// published.
+func adminThemePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	t := adminTenant(w, r)
+	if t == nil {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	themeMu.Lock()
+	b := t.brand(themeOf(t.ID).Draft, "/admin/tenants/"+t.ID+"/theme/logo")
+	themeMu.Unlock()
+	var page bytes.Buffer
+	data := map[string]any{"Providers": []string{"google", "github"}, "Next": "/", "Preview": true}
+	if err := renderTemplate(&page, b, "login.html", data); err != nil {
+		writeError(w, r, "Cannot render the preview: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(page.Bytes())
+}
+
+// adminThemePublishHandler serves POST /admin/tenants/{id}/theme/publish.
+func adminThemePublishHandler(w http.ResponseWriter, r *http.Request) {
+	t := adminTenant(w, r)
+	if t == nil {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	themeMu.Lock()
+	defer themeMu.Unlock()
+	tt := themeOf(t.ID)
+	published := *tt.Draft
+	now := time.Now().UTC()
+	tt.Published, tt.PublishedAt = &published, &now
+	writeValue(w, r, http.StatusOK, tt)
+}
+
+// themeLogoHandler serves GET /theme/logo, the published logo of the
+// request's tenant.
+func themeLogoHandler(w http.ResponseWriter, r *http.Request) {
+	var logo *themeLogo
+	if t := requestTenant(r); t != nil {
+		themeMu.Lock()
+		if tt := tenantThemes[t.ID]; tt != nil && tt.Published != nil {
+			logo = tt.Published.Logo
+		}
+		themeMu.Unlock()
+	}
+	if logo != nil && r.URL.Query().Get("v") != "" {
+		// The URL changes with the logo, so it never goes stale.
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	serveThemeLogo(w, r, logo)
+}
+
+func serveThemeLogo(w http.ResponseWriter, r *http.Request, logo *themeLogo) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if logo == nil {
+		writeError(w, r, "No logo", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", logo.ContentType)
+	w.Header().Set("ETag", `"`+logo.SHA256+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(logo.data))
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: ให้แต่ละ tenant แต่งหน้าตาเว็บเอง (white-label) โดยแก้เป็น draft ดูตัวอย่างก่อน แล้วค่อย publish
+
+	1. theme มีโลโก้ (อัปโหลด), สีหลัก/พื้นหลัง/ตัวอักษร และข้อความ footer ทับค่าใน `TENANTS_FILE`
+	2. admin แก้ draft
+	   - `PUT /admin/tenants/{id}/theme` ตั้งสี (`#rgb`/`#rrggbb`) และ footer (ไม่เกิน 280 ตัวอักษร)
+	   - `PUT /admin/tenants/{id}/theme/logo` ส่งไฟล์รูปเป็น body (PNG/JPEG/GIF/WebP ตรวจจากเนื้อไฟล์ ไม่รับ SVG เพราะแฝง script ได้)
+	3. `GET /admin/tenants/{id}/theme/preview` แสดงหน้า sign-in ด้วย draft ให้ดูก่อน
+	4. `POST /admin/tenants/{id}/theme/publish` ทำให้ draft เป็นตัวจริง ผู้เข้าชม domain ของ tenant เห็นเฉพาะ theme ที่ publish แล้ว
+	5. โลโก้ที่ publish แล้วเสิร์ฟที่ `/theme/logo?v=<hash>` cache ได้ตลอดเพราะ URL เปลี่ยนตามไฟล์
+*/
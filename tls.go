@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server serves HTTPS itself, on TLS_ADDR (default :8443) next to the
+// plain listener, once it has a certificate:
+//
+//	TLS_CERT_FILE, TLS_KEY_FILE  a PEM certificate and key, for any host name
+//	TLS_CERT_DIR                 <domain>.crt and <domain>.key per host name
+//
+// With both, a handshake whose SNI name has files in TLS_CERT_DIR gets
+// those and any other the pair. TLS_CERT_DIR answers only the tenants'
+// domains and TLS_DOMAINS, for the main site, so a stray hostname cannot
+// make the server look for files. Certificates are issued outside the
+// server, by an ACME client such as certbot, and a renewed file is picked
+// up on the next handshake. With ACME_CACHE_DIR the server orders those
+// names' certificates itself (acme.go) when TLS_CERT_DIR has none.
+//
+// Connections need TLS 1.2 or later (TLS_MIN_VERSION=1.3 to raise it), and
+// TLS 1.2 only offers forward-secret AEAD cipher suites. HTTPS_REDIRECT=true
+// turns the plain listener into a redirect to HTTPS, except for health
+// checks and requests from the machine itself, such as the warm-up.
+
+var (
+	tlsAddr     = ":8443"
+	tlsCertFile = os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile  = os.Getenv("TLS_KEY_FILE")
+	tlsCertDir  = os.Getenv("TLS_CERT_DIR")
+	// tlsDomains are the host names TLS_CERT_DIR is looked in for.
+	tlsDomains    = map[string]bool{}
+	tlsMinVersion = uint16(tls.VersionTLS12)
+	httpsRedirect bool
+)
+
+// tlsCipherSuites are the TLS 1.2 suites offered; TLS 1.3 has its own,
+// which are all fine.
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+func init() {
+	if s := os.Getenv("TLS_ADDR"); s != "" {
+		tlsAddr = s
+	}
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if tlsCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile); err != nil {
+			log.Fatalf("Invalid TLS_CERT_FILE/TLS_KEY_FILE: %v", err)
+		}
+	}
+	for _, d := range strings.Split(os.Getenv("TLS_DOMAINS"), ",") {
+		if d = normalizeHost(d); d != "" {
+			tlsDomains[d] = true
+		}
+	}
+	switch v := os.Getenv("TLS_MIN_VERSION"); v {
+	case "", "1.2":
+	case "1.3":
+		tlsMinVersion = tls.VersionTLS13
+	default:
+		log.Fatalf("Invalid TLS_MIN_VERSION %q: use 1.2 or 1.3", v)
+	}
+	httpsRedirect = os.Getenv("HTTPS_REDIRECT") == "true"
+	if httpsRedirect && !tlsEnabled() {
+		log.Fatal("HTTPS_REDIRECT needs TLS_CERT_FILE/TLS_KEY_FILE, TLS_CERT_DIR or ACME_CACHE_DIR")
+	}
+	if acme != nil && len(tlsDomains) == 0 {
+		log.Fatal("ACME_CACHE_DIR needs TLS_DOMAINS or tenant domains to order certificates for")
+	}
+}
+
+// tlsEnabled reports whether the server has certificates to serve HTTPS.
+func tlsEnabled() bool {
+	return tlsCertFile != "" || tlsCertDir != "" || acme != nil
+}
+
+// certStore loads certificates as handshakes ask for them, and loads one
+// again when its file changes.
+type certStore struct {
+	mu    sync.Mutex
+	certs map[string]*storedCert // by certificate file
+}
+
+type storedCert struct {
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (s *certStore) load(certFile, keyFile string) (*tls.Certificate, error) {
+	fi, err := os.Stat(certFile)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.certs[certFile]; c != nil && c.modTime.Equal(fi.ModTime()) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		slog.Error("Cannot load the certificate", "file", certFile, "err", err)
+		return nil, err
+	}
+	s.certs[certFile] = &storedCert{cert: &cert, modTime: fi.ModTime()}
+	return &cert, nil
+}
+
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := normalizeHost(hello.ServerName)
+	if tlsDomains[name] {
+		if tlsCertDir != "" {
+			certFile := filepath.Join(tlsCertDir, name+".crt")
+			if _, err := os.Stat(certFile); err == nil || (tlsCertFile == "" && acme == nil) {
+				return s.load(certFile, filepath.Join(tlsCertDir, name+".key"))
+			}
+		}
+		if acme != nil {
+			return acme.certificate(name)
+		}
+	}
+	if tlsCertFile != "" {
+		return s.load(tlsCertFile, tlsKeyFile)
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
+
+// newTLSServer returns the HTTPS server on TLS_ADDR.
+func newTLSServer(handler http.Handler) *http.Server {
+	store := &certStore{certs: map[string]*storedCert{}}
+	return withServerLimits(&http.Server{
+		Addr:      tlsAddr,
+		Handler:   handler,
+		Protocols: tlsProtocols(),
+		TLSConfig: &tls.Config{
+			GetCertificate: store.getCertificate,
+			MinVersion:     tlsMinVersion,
+			CipherSuites:   tlsCipherSuites,
+			ClientCAs:      clientCAs,
+			ClientAuth:     tlsClientAuth(),
+		},
+	})
+}
+
+// httpsRedirectHandler sends plain HTTP requests to the same URL on
+// TLS_ADDR with 308, which keeps the method and body, and passes the rest
+// to next.
+func httpsRedirectHandler(next http.Handler) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || clientIP(r).IsLoopback() || secureRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host := strings.Trim(normalizeHost(r.Host), "[]")
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: server เปิด HTTPS เองได้ ไม่ต้องมี reverse proxy ข้างหน้า
+
+	1. ตั้ง `TLS_CERT_FILE` + `TLS_KEY_FILE` (PEM) หรือ `TLS_CERT_DIR` (ไฟล์ `<domain>.crt`/`.key` ตามชื่อ host) แล้ว server เปิด HTTPS ที่ `TLS_ADDR` (ค่าเริ่มต้น `:8443`) คู่กับ port HTTP เดิม
+	   - มีทั้งสองแบบ: ชื่อที่มีไฟล์ใน `TLS_CERT_DIR` ใช้ไฟล์นั้น ชื่ออื่นใช้คู่ `TLS_CERT_FILE`
+	   - `TLS_CERT_DIR` ดูเฉพาะ domain ของ tenant และ `TLS_DOMAINS` (allowlist)
+	   - cert ต่ออายุโดย ACME client ภายนอก ไฟล์ใหม่ถูกโหลดใน handshake ถัดไปเอง หรือให้ server ขอเองด้วย `ACME_CACHE_DIR` (acme.go)
+	2. ค่าเริ่มต้นที่ปลอดภัย: TLS 1.2 ขึ้นไป (`TLS_MIN_VERSION=1.3` ได้) และ TLS 1.2 ใช้แค่ cipher แบบ ECDHE + AEAD
+	3. `HTTPS_REDIRECT=true` ให้ port HTTP ตอบ 308 ไป https (308 คง method/body ไว้)
+	   - ยกเว้น `/healthz`, `/readyz` และ request จากเครื่องตัวเอง (เช่น warm-up)
+*/
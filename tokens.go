@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// API clients that should stay signed in trade credentials for a pair of
+// tokens: a short-lived access token, a JWT that jwtHandler accepts like
+// any other, and an opaque refresh token that buys the next pair.
+//
+//	POST /auth/token    with Basic credentials (credentials.go) or a session,
+//	                    or a client credentials grant (clients.go)
+//	POST /auth/refresh  {"refresh_token": "..."}
+//	POST /auth/revoke   {"refresh_token": "..."}
+//
+// Every refresh token works once. Refreshing returns a new one and marks
+// the old one used, and all the tokens that descend from one sign-in form
+// a family. Only a sign-in starts one: a bearer token, even one of ours,
+// cannot, or a leaked 15-minute access token would buy 30 days. Presenting
+// a used token means it has leaked, since the real
+// client already has its successor, so the whole family is revoked and
+// whoever holds it has to sign in again. Access tokens are not tracked;
+// they stay valid until they expire, ACCESS_TOKEN_TTL (default 15m) after
+// they were issued. A refresh token expires REFRESH_TOKEN_TTL (default
+// 720h) after it was issued.
+//
+// Access tokens are signed with the managed keys of JWT_SIGNING_KEYS_FILE
+// (signingkeys.go) or else with JWT_HMAC_SECRET, so these endpoints need
+// one of them set.
+
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+func init() {
+	for _, v := range []struct {
+		env string
+		d   *time.Duration
+	}{{"ACCESS_TOKEN_TTL", &accessTokenTTL}, {"REFRESH_TOKEN_TTL", &refreshTokenTTL}} {
+		if s := os.Getenv(v.env); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				log.Fatalf("Invalid %s %q: must be a positive duration", v.env, s)
+			}
+			*v.d = d
+		}
+	}
+}
+
+type refreshToken struct {
+	family    string
+	who       principal
+	expiresAt time.Time
+	used      bool
+}
+
+var (
+	// refreshMu protects refreshTokens, which is keyed by the hash of the
+	// token, like sessions.
+	refreshMu     sync.Mutex
+	refreshTokens = make(map[string]*refreshToken)
+)
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"` // seconds
+	RefreshToken string `json:"refresh_token"`
+}
+
+// signAccessToken returns an access token for who, with the claims
+// claimsPrincipal reads back.
+func signAccessToken(who principal, now time.Time) (string, error) {
+	claims := map[string]any{
+		"sub":  who.Subject,
+		"role": who.Role,
+		"iat":  now.Unix(),
+		"exp":  now.Add(accessTokenTTL).Unix(),
+		"jti":  randomHex(8),
+	}
+	if who.Instructor != "" {
+		claims["name"] = who.Instructor
+	}
+	return signClaims(claims)
+}
+
+// signClaims signs claims with the current managed key, or with
+// JWT_HMAC_SECRET without them, adding JWT_ISSUER and JWT_AUDIENCE so that
+// jwtHandler accepts the token.
+func signClaims(claims map[string]any) (string, error) {
+	if jwtIssuer != "" {
+		claims["iss"] = jwtIssuer
+	}
+	if jwtAudience != "" {
+		claims["aud"] = jwtAudience
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	if signingKeysEnabled() {
+		k, err := currentSigningKey()
+		if err != nil {
+			return "", err
+		}
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": k.ID})
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		sig, err := k.sign(signed)
+		if err != nil {
+			return "", err
+		}
+		return signed + "." + sig, nil
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, jwtHMACSecret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// issueTokens returns a new token pair for who in family, dropping
+// expired refresh tokens on the way. Callers must hold refreshMu, so a
+// family cannot gain a token while it is being revoked.
+func issueTokens(who principal, family string) (tokenResponse, error) {
+	now := time.Now()
+	access, err := signAccessToken(who, now)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	refresh := randomHex(32)
+	for k, t := range refreshTokens {
+		if now.After(t.expiresAt) {
+			delete(refreshTokens, k)
+		}
+	}
+	refreshTokens[hashSessionToken(refresh)] = &refreshToken{family: family, who: who, expiresAt: now.Add(refreshTokenTTL)}
+	return tokenResponse{AccessToken: access, TokenType: "Bearer", ExpiresIn: int(accessTokenTTL.Seconds()), RefreshToken: refresh}, nil
+}
+
+// revokeTokensOf drops every refresh token issued to subject.
+func revokeTokensOf(subject string) {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	for k, t := range refreshTokens {
+		if t.who.Subject == subject {
+			delete(refreshTokens, k)
+		}
+	}
+}
+
+// revokeTokenFamily drops every refresh token of family. Callers must
+// hold refreshMu.
+func revokeTokenFamily(family string) {
+	for k, t := range refreshTokens {
+		if t.family == family {
+			delete(refreshTokens, k)
+		}
+	}
+}
+
+func writeTokens(w http.ResponseWriter, r *http.Request, resp tokenResponse, err error) {
+	if err != nil {
+		requestLogger(r).Error("Error issuing tokens", "err", err)
+		writeError(w, r, "Cannot issue tokens", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeValue(w, r, http.StatusOK, resp)
+}
+
+func requireTokenSigning(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !tokenSigningEnabled() {
+		writeError(w, r, "Tokens are not enabled; set JWT_SIGNING_KEYS_FILE or JWT_HMAC_SECRET", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// authTokenHandler serves POST /auth/token, which starts a token family
+// for the request's password or session. Like sessions, API keys get none,
+// and neither do bearer tokens.
+func authTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireTokenSigning(w, r) {
+		return
+	}
+	if r.PostFormValue("grant_type") != "" {
+		clientCredentialsGrant(w, r)
+		return
+	}
+	who, ok := passwordPrincipal(r)
+	if s, hasSession := requestSession(r); !ok && hasSession {
+		who, ok = s.principal(), true
+	}
+	if _, hasClaims := requestClaims(r); !ok && hasClaims {
+		writeError(w, r, "Forbidden: a bearer token cannot be exchanged for other tokens; sign in with a username and password or a session", http.StatusForbidden)
+		return
+	}
+	if !ok {
+		basicChallenge(w)
+		writeError(w, r, "Unauthorized: send a username and password or a session", http.StatusUnauthorized)
+		return
+	}
+	family := randomHex(8)
+	requestLogger(r).Info("Token family started", "family", family, "subject", who.Subject, "role", who.Role)
+	refreshMu.Lock()
+	resp, err := issueTokens(who, family)
+	refreshMu.Unlock()
+	writeTokens(w, r, resp, err)
+}
+
+// authRefreshHandler serves POST /auth/refresh.
+func authRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireTokenSigning(w, r) {
+		return
+	}
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	now := time.Now()
+	refreshMu.Lock()
+	t, ok := refreshTokens[hashSessionToken(req.RefreshToken)]
+	switch {
+	case !ok || now.After(t.expiresAt):
+		refreshMu.Unlock()
+		writeError(w, r, "Unauthorized: invalid or expired refresh token", http.StatusUnauthorized)
+		return
+	case t.used:
+		revokeTokenFamily(t.family)
+		refreshMu.Unlock()
+		requestLogger(r).Warn("Refresh token reused; revoked its token family", "family", t.family, "subject", t.who.Subject)
+		recordSecurityEvent(r, t.who.Subject, securityEventRefreshReused, "")
+		writeError(w, r, "Unauthorized: refresh token already used; sign in again", http.StatusUnauthorized)
+		return
+	}
+	t.used = true
+	resp, err := issueTokens(t.who, t.family)
+	refreshMu.Unlock()
+	writeTokens(w, r, resp, err)
+}
+
+// authRevokeHandler serves POST /auth/revoke, which signs a client out by
+// revoking the family of its refresh token. An unknown token is not an
+// error (RFC 7009).
+func authRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireTokenSigning(w, r) {
+		return
+	}
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	refreshMu.Lock()
+	if t, ok := refreshTokens[hashSessionToken(req.RefreshToken)]; ok {
+		revokeTokenFamily(t.family)
+		requestLogger(r).Info("Token family revoked", "family", t.family, "subject", t.who.Subject)
+	}
+	refreshMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: access token อายุสั้น + refresh token แบบหมุนเวียน ให้ client อยู่ในระบบได้นานโดยไม่ต้องถือ credential อายุยาว
+
+	1. `POST /auth/token` แลก Basic auth หรือ session (รวม login ผ่าน Google/GitHub) เป็นคู่ token
+	   - แลกด้วย JWT ไม่ได้ ไม่งั้น access token ที่หลุด (อายุ 15 นาที) จะกลายเป็น refresh token อายุ 30 วัน
+	   - access token เป็น JWT (HS256 เซ็นด้วย `JWT_HMAC_SECRET`) มี `role`/`name` ทำให้ RBAC ใช้ได้ทันที อายุ `ACCESS_TOKEN_TTL` (15 นาที)
+	   - refresh token เป็นค่าสุ่ม เก็บแค่ hash อายุ `REFRESH_TOKEN_TTL` (30 วัน)
+	2. `POST /auth/refresh` ใช้ refresh token ได้ครั้งเดียว ได้คู่ใหม่กลับไป (rotation)
+	3. ถ้ามีคนเอา refresh token ที่ใช้ไปแล้วมาใช้อีก แปลว่าหลุด: เพิกถอนทั้ง family (ทุก token ที่สืบมาจากการ login ครั้งเดียวกัน)
+	4. `POST /auth/revoke` คือ logout ของ client เพิกถอนทั้ง family เช่นกัน; access token ที่ออกไปแล้วใช้ได้จนหมดอายุ (จึงต้องสั้น)
+*/
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	oldSecret := jwtHMACSecret
+	jwtHMACSecret = []byte("sekrit")
+	t.Cleanup(func() { jwtHMACSecret = oldSecret })
+
+	signIn := func(family string) string {
+		refreshMu.Lock()
+		defer refreshMu.Unlock()
+		resp, err := issueTokens(principal{Subject: "ann", Role: "editor"}, family)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.RefreshToken
+	}
+	refresh := func(token string) (int, string) {
+		body, _ := json.Marshal(map[string]string{"refresh_token": token})
+		r := httptest.NewRequest(http.MethodPost, "/auth/refresh", strings.NewReader(string(body)))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		authRefreshHandler(w, r)
+		var resp tokenResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.RefreshToken
+	}
+
+	first := signIn("family-a")
+	other := signIn("family-b")
+	code, second := refresh(first)
+	if code != http.StatusOK || second == "" {
+		t.Fatalf("first refresh = %d, want 200 and a new refresh token", code)
+	}
+	code, third := refresh(second)
+	if code != http.StatusOK || third == "" {
+		t.Fatalf("second refresh = %d, want 200 and a new refresh token", code)
+	}
+
+	// Someone replays the rotated-out first token.
+	if code, _ := refresh(first); code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token = %d, want 401", code)
+	}
+	if code, _ := refresh(third); code != http.StatusUnauthorized {
+		t.Errorf("latest token of the revoked family = %d, want 401", code)
+	}
+	if code, _ := refresh(second); code != http.StatusUnauthorized {
+		t.Errorf("used token of the revoked family = %d, want 401", code)
+	}
+	if code, _ := refresh(other); code != http.StatusOK {
+		t.Errorf("token of another family = %d, want 200", code)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Requests take part in W3C Trace Context
+// (https://www.w3.org/TR/trace-context/), so a partner debugging a call
+// that crosses into this server and back out has one ID to quote. A
+// request with a valid traceparent header joins the caller's trace; any
+// other starts a new one. Either way the trace ID is echoed in the
+// X-Trace-ID response header and kept in the request's log entry, which
+// works for partners without a tracing backend of their own.
+//
+// The calls the server makes for a request carry traceparent with the
+// request's span as their parent, and the caller's tracestate as it was:
+// webhook deliveries for the changes the request made, requests proxied
+// to -upstream, shadow reads and questions to OPA (policy.go). Unless
+// spans are exported (otel.go) the server records none itself, so the
+// sampled flag is only ever set on a trace it starts when they are, and
+// the trace is sampled.
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+	traceIDHeader     = "X-Trace-ID"
+	// maxTracestateLength is what the specification asks every
+	// participant to pass on; a longer tracestate is dropped.
+	maxTracestateLength = 512
+)
+
+// traceparentPattern is version, trace ID, parent ID and flags. Later
+// versions may add fields after the flags.
+var traceparentPattern = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+// traceContext is a request's place in its trace. The zero value is no
+// trace, for work no request asked for.
+type traceContext struct {
+	TraceID string // 32 hex digits
+	SpanID  string // this server's span for the request, 16 hex digits
+	Parent  string // the caller's span, "" if the trace started here
+	Flags   string // 2 hex digits; 01 is sampled
+	State   string // the caller's tracestate
+}
+
+type traceContextKey struct{}
+
+// startTrace returns r's trace context, joining the trace of its
+// traceparent header if that is valid.
+func startTrace(r *http.Request) traceContext {
+	tc := traceContext{TraceID: randomHex(16), SpanID: randomHex(8), Flags: "00"}
+	if sampleNewTrace() {
+		tc.Flags = "01"
+	}
+	m := traceparentPattern.FindStringSubmatch(strings.TrimSpace(r.Header.Get(traceparentHeader)))
+	if m == nil || m[1] == "ff" || (m[1] == "00" && m[5] != "") ||
+		m[2] == strings.Repeat("0", 32) || m[3] == strings.Repeat("0", 16) {
+		return tc
+	}
+	tc.TraceID, tc.Parent = m[2], m[3]
+	// Only the sampled flag is defined for version 00, which is what is
+	// sent on.
+	flags, _ := strconv.ParseUint(m[4], 16, 8)
+	tc.Flags = "0" + strconv.FormatUint(flags&1, 16)
+	if state := strings.Join(r.Header.Values(tracestateHeader), ","); len(state) <= maxTracestateLength {
+		tc.State = state
+	}
+	return tc
+}
+
+// sampled reports whether tc's spans are recorded.
+func (tc traceContext) sampled() bool {
+	return tc.Flags == "01" && otlpTracesURL != ""
+}
+
+// withTrace returns r with tc in its context.
+func withTrace(r *http.Request, tc traceContext) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), traceContextKey{}, tc))
+}
+
+// requestTrace returns r's trace context, or the zero value outside
+// requestLogHandler.
+func requestTrace(r *http.Request) traceContext {
+	tc, _ := r.Context().Value(traceContextKey{}).(traceContext)
+	return tc
+}
+
+// setTraceHeaders makes h, the header of an outbound request, part of
+// tc's trace, replacing whatever trace headers it held.
+func setTraceHeaders(h http.Header, tc traceContext) {
+	h.Del(traceparentHeader)
+	h.Del(tracestateHeader)
+	if tc.TraceID == "" {
+		return
+	}
+	h.Set(traceparentHeader, "00-"+tc.TraceID+"-"+tc.SpanID+"-"+tc.Flags)
+	if tc.State != "" {
+		h.Set(tracestateHeader, tc.State)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: รองรับ W3C Trace Context ให้ partner ไล่ปัญหาข้ามองค์กรได้ด้วย trace ID เดียวกัน แม้ไม่มีระบบ tracing ของตัวเอง
+
+	1. request ที่มี header `traceparent` ถูกต้อง จะเข้าร่วม trace เดิมของผู้เรียก ถ้าไม่มีหรือผิดรูปแบบ เริ่ม trace ใหม่
+	   - `tracestate` ส่งต่อตามเดิม (ยาวเกิน 512 ตัวอักษรทิ้ง ตามที่ spec แนะนำ)
+	2. ทุก response มี `X-Trace-ID` และ log entry ของ request มี `trace_id` ค้นได้ด้วย `?trace_id=`
+	3. call ขาออกที่เกิดจาก request นั้นแนบ `traceparent` โดยใช้ span ของเราเป็น parent
+	   - webhook ที่เกิดจากการแก้ course, request ที่ proxy ไป `-upstream`, shadow read และการถาม OPA
+	4. ถ้าไม่ได้ตั้งให้ส่ง span ออก (otel.go) server ไม่บันทึก span เอง และไม่เปิด flag sampled ใน trace ที่เริ่มเอง
+	   - ถ้าตั้งไว้ trace ใหม่ที่ถูก sample จะได้ flag `01` ส่วน trace ที่เข้าร่วมใช้ flag ของผู้เรียก (parent-based)
+*/
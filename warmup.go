@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// After a deploy the first requests pay for building the OpenAPI document,
+// filling the catalog cache and, behind -upstream, dialing the origin. The
+// server therefore starts listening, sends itself a set of warm-up reads
+// through the full middleware chain, and only then reports ready on
+// /readyz, so a load balancer keeps traffic on the old instances until
+// then. /healthz answers as soon as the process listens.
+//
+// The reads are defaultWarmUpRequests plus, with WARMUP_REQUESTS, a file
+// of request targets, one per line ("GET /courses?page=1" or just the
+// target); # starts a comment. GET /admin/warmup/requests lists the recent
+// successful reads from the request log in that format, which is an easy
+// way to record a sample of real traffic for the next deploy.
+// WARMUP_TIMEOUT (default 30s) bounds the whole phase: when it runs out
+// the server becomes ready anyway rather than never taking traffic.
+
+var defaultWarmUpRequests = []string{"/courses", "/courses/changes?since=0", "/openapi.json", "/docs/"}
+
+// warmUpVariants are the Accept and Accept-Encoding pairs each read is
+// sent with. The catalog cache keys on both, so priming one variant would
+// not help clients sending another.
+var warmUpVariants = func() [][2]string {
+	var v [][2]string
+	for _, accept := range []string{"", "*/*", mediaTypeJSON} {
+		for _, enc := range []string{"", "gzip"} {
+			v = append(v, [2]string{accept, enc})
+		}
+	}
+	return v
+}()
+
+const (
+	warmUpUserAgent   = "go-first-web-server-warmup"
+	warmUpConcurrency = 4
+)
+
+var (
+	serverReady   atomic.Bool
+	warmUpTimeout = 30 * time.Second
+	warmUpFile    = os.Getenv("WARMUP_REQUESTS")
+)
+
+func init() {
+	if v := os.Getenv("WARMUP_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid WARMUP_TIMEOUT %q: must be a duration", v)
+		}
+		warmUpTimeout = d
+	}
+}
+
+// readWarmUpRequests reads a WARMUP_REQUESTS file. Only reads are kept;
+// replaying a write on every start would change the catalog.
+func readWarmUpRequests(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var targets []string
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case len(fields) == 1 && strings.HasPrefix(fields[0], "/"):
+			targets = append(targets, fields[0])
+		case len(fields) == 2 && fields[0] == http.MethodGet && strings.HasPrefix(fields[1], "/"):
+			targets = append(targets, fields[1])
+		default:
+			slog.Warn("Warm-up: skipping a line; want a GET request target", "line", n, "file", path)
+		}
+	}
+	return targets, sc.Err()
+}
+
+// warmUp sends the warm-up reads to the server at base and then marks it
+// ready.
+func warmUp(base string) {
+	start := time.Now()
+	defer func() {
+		serverReady.Store(true)
+		slog.Info("Warm-up finished; ready for traffic", "duration", time.Since(start).Round(time.Millisecond))
+	}()
+
+	openAPIDocument()
+
+	targets := slices.Clone(defaultWarmUpRequests)
+	if warmUpFile != "" {
+		recorded, err := readWarmUpRequests(warmUpFile)
+		if err != nil {
+			slog.Error("Error reading WARMUP_REQUESTS", "err", err)
+		}
+		targets = append(targets, recorded...)
+	}
+
+	deadline := time.Now().Add(warmUpTimeout)
+	client := &http.Client{Timeout: warmUpTimeout, Transport: &http.Transport{DisableCompression: true}}
+	var failed atomic.Int64
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for range warmUpConcurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range work {
+				for _, v := range warmUpVariants {
+					if !warmUpRequest(client, base+target, v) {
+						failed.Add(1)
+					}
+				}
+			}
+		}()
+	}
+	for _, target := range targets {
+		if time.Now().After(deadline) {
+			slog.Warn("Warm-up timed out; skipping the rest", "timeout", warmUpTimeout)
+			break
+		}
+		work <- target
+	}
+	close(work)
+	wg.Wait()
+	if n := failed.Load(); n > 0 {
+		slog.Warn("Warm-up requests failed", "failed", n, "total", len(warmUpVariants)*len(targets))
+	}
+}
+
+func warmUpRequest(client *http.Client, url string, variant [2]string) bool {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("User-Agent", warmUpUserAgent)
+	if variant[0] != "" {
+		req.Header.Set("Accept", variant[0])
+	}
+	if variant[1] != "" {
+		req.Header.Set("Accept-Encoding", variant[1])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode < 400
+}
+
+// adminWarmUpRequestsHandler serves GET /admin/warmup/requests: the paths
+// of recent successful GET requests, most frequent first, in the
+// WARMUP_REQUESTS format. ?limit=N (default 100) caps the list.
+func adminWarmUpRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, r, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	recent, ch := appLog.follow()
+	appLog.unfollow(ch)
+	hits := map[string]int{}
+	for _, e := range recent {
+		if e.Method == http.MethodGet && e.Status >= 200 && e.Status < 300 && !strings.HasPrefix(e.Path, "/admin/") {
+			hits[e.Path]++
+		}
+	}
+	paths := make([]string, 0, len(hits))
+	for p := range hits {
+		paths = append(paths, p)
+	}
+	slices.SortFunc(paths, func(a, b string) int {
+		if hits[a] != hits[b] {
+			return hits[b] - hits[a]
+		}
+		return strings.Compare(a, b)
+	})
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "# %d most requested paths of the last %d log entries\n", min(limit, len(paths)), len(recent))
+	for _, p := range paths[:min(limit, len(paths))] {
+		fmt.Fprintf(w, "GET %s\n", p)
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: อุ่นเครื่อง server ก่อนรับ traffic จริง (warm-up)
+
+	1. server เปิด port แล้วยิง request อ่านข้อมูลใส่ตัวเอง (`/courses`, `/openapi.json`, ...) ผ่าน middleware ครบทุกชั้น
+	   - สร้างเอกสาร OpenAPI, เติม cache ของ catalog (`-cache`) และเปิด connection ไป upstream (`-upstream`) ไว้ล่วงหน้า
+	2. `/readyz` ตอบ 503 ระหว่าง warm-up และ 200 เมื่อเสร็จ ให้ load balancer ส่ง traffic มาหลังพร้อมแล้วเท่านั้น ส่วน `/healthz` ตอบ 200 ทันทีที่ process ทำงาน
+	3. เพิ่ม request ที่บันทึกไว้ได้ด้วยไฟล์ `WARMUP_REQUESTS` (เฉพาะ GET) ดึงตัวอย่างจาก traffic จริงได้ที่ `GET /admin/warmup/requests`
+	4. `WARMUP_TIMEOUT` (ค่าเริ่มต้น 30s) กันไม่ให้ warm-up ค้างจน server ไม่พร้อมตลอดไป
+*/
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhooks POST every course mutation to URLs registered by admins. Each
+// request is signed with the webhook's secret:
+//
+//	X-Webhook-Signature: t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+//
+// so receivers can check both origin and freshness. Failed deliveries are
+// retried with exponential backoff; every attempt is kept for
+// /admin/webhooks/{id}/deliveries, and a delivery that fails for good is
+// dead-lettered (deadletters.go).
+
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+
+	webhookMaxAttempts   = 6
+	webhookTimeout       = 10 * time.Second
+	maxWebhookDeliveries = 100 // kept per webhook, newest last
+)
+
+// webhookBackoff is the wait before retry n (1-based): 1s, 2s, 4s, ...
+var webhookBackoff = func(n int) time.Duration { return time.Second << (n - 1) }
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+type webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"` // ops to send, and "export"; empty means every op
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	deliveries []*webhookDelivery
+}
+
+type webhookDelivery struct {
+	ID            string           `json:"id"`
+	Event         string           `json:"event"`
+	Seq           int64            `json:"seq"`
+	CourseID      int              `json:"course_id"`
+	Status        string           `json:"status"` // "pending", "succeeded" or "failed"
+	Attempts      []webhookAttempt `json:"attempts"`
+	NextAttemptAt *time.Time       `json:"next_attempt_at,omitempty"`
+	// TraceID is the trace of the request that made the change.
+	TraceID string `json:"trace_id,omitempty"`
+
+	body      []byte // the payload, kept for redelivery
+	webhookID int
+	trace     traceContext
+}
+
+type webhookAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+type webhookPayload struct {
+	ID         string        `json:"id"`
+	Event      string        `json:"event"`
+	Seq        int64         `json:"seq"`
+	CourseID   int           `json:"course_id"`
+	Course     *course       `json:"course,omitempty"`
+	Export     *courseExport `json:"export,omitempty"` // for export.ready and export.failed (exportjobs.go)
+	OccurredAt time.Time     `json:"occurred_at"`
+}
+
+var (
+	// webhookMu protects webhooks and their deliveries. recordChange takes
+	// it while holding courseMu, so it must never be held while acquiring
+	// courseMu.
+	webhookMu     sync.Mutex
+	webhooks      []*webhook
+	nextWebhookID = 1
+)
+
+func findWebhook(id int) *webhook {
+	for _, h := range webhooks {
+		if h.ID == id {
+			return h
+		}
+	}
+	return nil
+}
+
+// view is how a webhook is listed: without its secret.
+func (h *webhook) view() webhook {
+	v := *h
+	v.Secret = ""
+	return v
+}
+
+func signWebhook(secret string, t time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", t.Unix())
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", t.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// dispatchWebhooks queues ev for every webhook that wants it. It is called
+// from recordChange with courseMu held; deliveries run on their own
+// goroutines.
+func dispatchWebhooks(ev courseChange) {
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	for _, h := range webhooks {
+		if len(h.Events) > 0 && !slices.Contains(h.Events, ev.Op) {
+			continue
+		}
+		queueWebhookDelivery(h, webhookPayload{
+			ID:         randomHex(12),
+			Event:      "course." + ev.Op,
+			Seq:        ev.Seq,
+			CourseID:   ev.ID,
+			Course:     ev.Course,
+			OccurredAt: time.Now().UTC(),
+		}, ev.trace)
+	}
+}
+
+// dispatchExportWebhooks sends event, export.ready or export.failed, to the
+// webhooks that asked for "export". An empty events list means every
+// course op, not exports. trace is that of the request for the export.
+func dispatchExportWebhooks(event string, ex courseExport, trace traceContext) {
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	for _, h := range webhooks {
+		if !slices.Contains(h.Events, "export") {
+			continue
+		}
+		queueWebhookDelivery(h, webhookPayload{
+			ID:         randomHex(12),
+			Event:      event,
+			Export:     &ex,
+			OccurredAt: time.Now().UTC(),
+		}, trace)
+	}
+}
+
+// queueWebhookDelivery records a delivery of p to h and starts it. Callers
+// must hold webhookMu.
+func queueWebhookDelivery(h *webhook, p webhookPayload, trace traceContext) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		slog.Error("Error marshaling webhook payload", "err", err)
+		return
+	}
+	d := &webhookDelivery{ID: p.ID, Event: p.Event, Seq: p.Seq, CourseID: p.CourseID, Status: "pending", Attempts: []webhookAttempt{}, TraceID: trace.TraceID, body: body, webhookID: h.ID, trace: trace}
+	h.deliveries = append(h.deliveries, d)
+	if n := len(h.deliveries) - maxWebhookDeliveries; n > 0 {
+		h.deliveries = slices.Delete(h.deliveries, 0, n)
+	}
+	go deliverWebhook(h.URL, h.Secret, d, body)
+}
+
+// deliverWebhook POSTs body until the receiver answers 2xx, it rejects the
+// payload outright, or the attempts run out.
+func deliverWebhook(target, secret string, d *webhookDelivery, body []byte) {
+	j := trackJob(jobWebhook, d.ID)
+	for n := 1; ; n++ {
+		j.attempt()
+		start := time.Now()
+		attempt := webhookAttempt{At: start.UTC()}
+		retry := true
+		req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(webhookEventHeader, d.Event)
+			req.Header.Set(webhookDeliveryHeader, d.ID)
+			req.Header.Set(webhookSignatureHeader, signWebhook(secret, start, body))
+			setTraceHeaders(req.Header, d.trace)
+			var resp *http.Response
+			resp, err = webhookClient.Do(req)
+			if err == nil {
+				io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+				resp.Body.Close()
+				attempt.StatusCode = resp.StatusCode
+				// Other 4xx mean the receiver will never take this payload.
+				retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+			}
+		}
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		attempt.DurationMS = time.Since(start).Milliseconds()
+		ok := err == nil && attempt.StatusCode >= 200 && attempt.StatusCode < 300
+
+		webhookMu.Lock()
+		d.Attempts = append(d.Attempts, attempt)
+		d.NextAttemptAt = nil
+		switch {
+		case ok:
+			d.Status = "succeeded"
+		case !retry || n == webhookMaxAttempts:
+			d.Status = "failed"
+		default:
+			next := time.Now().Add(webhookBackoff(n)).UTC()
+			d.NextAttemptAt = &next
+		}
+		status := d.Status
+		var dl *deadLetter
+		if status == "failed" {
+			dl = d.deadLetter()
+		}
+		webhookMu.Unlock()
+
+		switch status {
+		case "succeeded":
+			j.done(nil)
+			return
+		case "failed":
+			j.done(errors.New(dl.Error))
+			slog.Error("Webhook delivery failed for good", "delivery", d.ID, "url", target, "attempts", n)
+			addDeadLetter(dl)
+			return
+		}
+		j.retrying(errors.New(attemptError(attempt)))
+		time.Sleep(webhookBackoff(n))
+	}
+}
+
+// redeliver sends d again with h's current secret, its earlier attempts
+// kept, and takes it out of the dead-letter store. It is called with
+// webhookMu held, and d must not be pending.
+func (h *webhook) redeliver(d *webhookDelivery) {
+	d.Status = "pending"
+	d.NextAttemptAt = nil
+	discardDeadLetterJob(jobWebhook, d.ID)
+	go deliverWebhook(h.URL, h.Secret, d, d.body)
+}
+
+// attemptError describes why a failed attempt failed.
+func attemptError(a webhookAttempt) string {
+	if a.Error != "" {
+		return a.Error
+	}
+	return "HTTP " + strconv.Itoa(a.StatusCode)
+}
+
+// deadLetter records d, which has failed for good. Requeueing it
+// redelivers d to its webhook if that still exists. It is called with
+// webhookMu held.
+func (d *webhookDelivery) deadLetter() *deadLetter {
+	dl := &deadLetter{Kind: jobWebhook, Job: d.ID, Payload: d.body, Attempts: []deadLetterAttempt{}}
+	for _, a := range d.Attempts {
+		dl.Attempts = append(dl.Attempts, deadLetterAttempt{At: a.At, Error: attemptError(a)})
+	}
+	dl.Error = dl.Attempts[len(dl.Attempts)-1].Error
+	dl.retry = func() error {
+		webhookMu.Lock()
+		defer webhookMu.Unlock()
+		h := findWebhook(d.webhookID)
+		switch {
+		case h == nil:
+			return fmt.Errorf("webhook %d no longer exists", d.webhookID)
+		case d.Status == "pending":
+			return errors.New("delivery is already being sent")
+		}
+		// It may have aged out of the deliveries kept for h.
+		if !slices.Contains(h.deliveries, d) {
+			h.deliveries = append(h.deliveries, d)
+			if n := len(h.deliveries) - maxWebhookDeliveries; n > 0 {
+				h.deliveries = slices.Delete(h.deliveries, 0, n)
+			}
+		}
+		h.redeliver(d)
+		return nil
+	}
+	return dl
+}
+
+// rotateSecret gives h a new signing secret and returns it. Retries
+// already scheduled go on with the old one. It is called with webhookMu
+// held.
+func (h *webhook) rotateSecret() string {
+	h.Secret = randomHex(32)
+	return h.Secret
+}
+
+// adminWebhooksHandler serves GET and POST /admin/webhooks. POST registers
+// {"url": ..., "events": ["created", ...]} and is the only response that
+// includes the signing secret.
+func adminWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		webhookMu.Lock()
+		list := []webhook{}
+		for _, h := range webhooks {
+			list = append(list, h.view())
+		}
+		webhookMu.Unlock()
+		writeValue(w, r, http.StatusOK, list)
+
+	case http.MethodPost:
+		var req struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeError(w, r, "url must be an absolute http or https URL", http.StatusBadRequest)
+			return
+		}
+		events := []string{}
+		for _, e := range req.Events {
+			switch e {
+			case "created", "updated", "deleted", "export":
+			default:
+				writeError(w, r, "Unknown event "+strconv.Quote(e)+"; use created, updated, deleted or export", http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(events, e) {
+				events = append(events, e)
+			}
+		}
+
+		webhookMu.Lock()
+		h := &webhook{ID: nextWebhookID, URL: u.String(), Events: events, Secret: randomHex(32), CreatedAt: time.Now().UTC()}
+		nextWebhookID++
+		webhooks = append(webhooks, h)
+		created := *h
+		webhookMu.Unlock()
+
+		w.Header().Set("Location", "/admin/webhooks/"+strconv.Itoa(h.ID))
+		writeValue(w, r, http.StatusCreated, created)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminWebhookHandler serves GET and DELETE /admin/webhooks/{id}. Deleting
+// a webhook stops new deliveries; retries already scheduled still run.
+func adminWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	h := findWebhook(id)
+	if h == nil {
+		writeError(w, r, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeValue(w, r, http.StatusOK, h.view())
+	case http.MethodDelete:
+		webhooks = slices.DeleteFunc(webhooks, func(x *webhook) bool { return x == h })
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// adminWebhookDeliveriesHandler serves GET /admin/webhooks/{id}/deliveries,
+// the most recent deliveries with every attempt, newest first.
+func adminWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	webhookMu.Lock()
+	h := findWebhook(id)
+	deliveries := []webhookDelivery{}
+	if h != nil {
+		for _, d := range slices.Backward(h.deliveries) {
+			c := *d
+			c.Attempts = slices.Clone(d.Attempts)
+			deliveries = append(deliveries, c)
+		}
+	}
+	webhookMu.Unlock()
+	if h == nil {
+		writeError(w, r, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	writeValue(w, r, http.StatusOK, deliveries)
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: Outgoing Webhooks
+
+	1. admin ลงทะเบียน URL ที่ `POST /admin/webhooks` (เลือก event ได้: created / updated / deleted) จะได้ `secret` กลับมาครั้งเดียว
+	2. ทุกครั้งที่ course เปลี่ยน server จะ `POST` JSON ไปยัง URL นั้น พร้อม header
+	   - `X-Webhook-Signature: t=<เวลา>,v1=<HMAC-SHA256>` ให้ผู้รับตรวจว่ามาจากเราจริงและไม่ใช่ของเก่า
+	   - `X-Webhook-Event`, `X-Webhook-Delivery` (ใช้กันรับซ้ำ)
+	3. ถ้าส่งไม่สำเร็จ (error หรือ 5xx/408/429) จะลองใหม่แบบ exponential backoff (1s, 2s, 4s, ...) สูงสุด 6 ครั้ง
+	4. ดูประวัติการส่งทุกครั้งได้ที่ `GET /admin/webhooks/{id}/deliveries`
+	5. webhook ไม่ได้ใช้ hub เดียวกับ WebSocket เพราะ hub ตัด subscriber ที่ช้าทิ้ง แต่ webhook ต้องไม่พลาด event
+*/
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This is a minimal WebSocket server (RFC 6455) for pushing course changes
+// to dashboards. Written against net/http's Hijacker because the standard
+// library has no WebSocket package. The feed is one-way: the server sends
+// text messages, and client data messages are read and ignored.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// Close status codes used by this server.
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+	wsCloseTryAgainLater = 1013
+)
+
+const (
+	wsPingInterval  = 30 * time.Second
+	wsReadTimeout   = 2 * wsPingInterval // a pong must arrive in between
+	wsWriteTimeout  = 10 * time.Second
+	wsMaxFrameBytes = 64 << 10
+)
+
+var (
+	errWSProtocol = errors.New("websocket: protocol error")
+	errWSTooBig   = errors.New("websocket: frame too big")
+)
+
+// headerHasToken reports whether a comma-separated header contains token,
+// case-insensitively ("Connection: keep-alive, Upgrade").
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeWSFrame writes one unfragmented, unmasked frame, as servers must.
+func writeWSFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = binary.BigEndian.AppendUint16(append(header, 126), uint16(n))
+	default:
+		header = binary.BigEndian.AppendUint64(append(header, 127), uint64(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// readWSFrame reads one frame from a client. Client frames must be masked.
+func readWSFrame(r *bufio.Reader) (opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	fin, opcode, masked := head[0]&0x80 != 0, head[0]&0x0F, head[1]&0x80 != 0
+	if head[0]&0x70 != 0 || !masked {
+		// No extensions were negotiated, so reserved bits must be clear.
+		return 0, nil, errWSProtocol
+	}
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsOpClose && (!fin || size > 125) {
+		return 0, nil, errWSProtocol
+	}
+	if size > wsMaxFrameBytes {
+		return opcode, nil, errWSTooBig
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// parseCourseIDs parses the ?course=1,2 filter of the live feeds.
+func parseCourseIDs(v string) ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid course filter %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// coursesWebSocketHandler serves /ws/courses. Each course change is sent as
+// a text message holding the same JSON object as an entry of
+// /courses/changes; ?course=1,2 limits the feed to those courses. A client
+// that falls too far behind is disconnected with status 1013 and should
+// catch up from /courses/changes?since=<last seq> after reconnecting.
+func coursesWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		writeError(w, r, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, r, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		writeError(w, r, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	ids, err := parseCourseIDs(r.URL.Query().Get("course"))
+	if err != nil {
+		writeError(w, r, "Invalid course filter", http.StatusBadRequest)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		requestLogger(r).Error("WebSocket hijack failed", "err", err)
+		writeError(w, r, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	// The server's deadlines stay on a hijacked connection.
+	conn.SetDeadline(time.Time{})
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	sub := courseEvents.subscribe(ids, requestTenant(r))
+	defer courseEvents.unsubscribe(sub)
+	requestLogger(r).Info("WebSocket client connected", "remote_addr", conn.RemoteAddr().String(), "live", courseEvents.count())
+	serveWebSocket(conn, brw.Reader, sub, requestPrincipal(r))
+	requestLogger(r).Info("WebSocket client disconnected", "remote_addr", conn.RemoteAddr().String())
+}
+
+// serveWebSocket runs the connection until either side closes it. Only this
+// goroutine writes to conn; the reader hands it pongs and close replies.
+// Courses in events are sent as who may see them.
+func serveWebSocket(conn net.Conn, r *bufio.Reader, sub *hubSubscriber, who principal) {
+	control := make(chan [2][]byte, 4) // {opcode, payload}
+	// The reader never blocks on the writer, which may already be gone.
+	queue := func(opcode byte, payload []byte) {
+		select {
+		case control <- [2][]byte{{opcode}, payload}:
+		default:
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+			opcode, payload, err := readWSFrame(r)
+			switch {
+			case errors.Is(err, errWSProtocol):
+				queue(wsOpClose, closePayload(wsCloseProtocolError, "protocol error"))
+				return
+			case errors.Is(err, errWSTooBig):
+				queue(wsOpClose, closePayload(wsCloseTooBig, "message too big"))
+				return
+			case err != nil:
+				return
+			}
+			switch opcode {
+			case wsOpPing:
+				queue(wsOpPong, payload)
+			case wsOpClose:
+				queue(wsOpClose, closePayload(wsCloseNormal, ""))
+				return
+			case wsOpText, wsOpBinary, wsOpContinuation, wsOpPong:
+				// Nothing to do: the feed takes no input.
+			default:
+				queue(wsOpClose, closePayload(wsCloseProtocolError, "unknown opcode"))
+				return
+			}
+		}
+	}()
+
+	write := func(opcode byte, payload []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return writeWSFrame(conn, opcode, payload)
+	}
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.events:
+			if !ok {
+				write(wsOpClose, closePayload(wsCloseTryAgainLater, "too far behind; resync from /courses/changes"))
+				return
+			}
+			msg, err := json.Marshal(ev.viewedBy(who))
+			if err != nil {
+				slog.Error("Error marshaling course event", "err", err)
+				continue
+			}
+			if write(wsOpText, msg) != nil {
+				return
+			}
+		case c := <-control:
+			if write(c[0][0], c[1]) != nil || c[0][0] == wsOpClose {
+				return
+			}
+		case <-ping.C:
+			if write(wsOpPing, nil) != nil {
+				return
+			}
+		case <-done:
+			// Send any close reply the reader queued before it stopped.
+			select {
+			case c := <-control:
+				write(c[0][0], c[1])
+			default:
+			}
+			return
+		}
+	}
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: WebSocket (`/ws/courses`) เขียนเองตาม RFC 6455
+
+	1. handshake: client ส่ง `Upgrade: websocket` พร้อม `Sec-WebSocket-Key` server ตอบ `101 Switching Protocols`
+	   และ `Sec-WebSocket-Accept` = base64(sha1(key + GUID)) จากนั้นใช้ `Hijack` เอา TCP connection มาคุยกันเองเป็น frame
+	2. ทุก course ที่ถูกสร้าง/แก้ไข/ลบ จะถูกส่งเป็นข้อความ JSON ทันที dashboard จึงไม่ต้อง poll `GET /courses`
+	   - `?course=1,2` รับเฉพาะ course ที่สนใจ
+	3. server ส่ง ping ทุก 30 วินาทีเพื่อตรวจว่า client ยังอยู่ และมี goroutine เดียวที่เขียนลง connection (ป้องกัน frame ปนกัน)
+	4. frame จาก client ต้องถูก mask เสมอ ถ้าผิดกฎจะปิดด้วย code 1002 ส่วน client ที่ตามไม่ทันจะถูกปิดด้วย 1013 ให้ต่อใหม่แล้วตามจาก `/courses/changes`
+*/
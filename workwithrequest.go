@@ -1,22 +1,83 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type course struct {
-	CourseId    int    `json:"id"`
-	CourseName  string `json:"name"`
-	CoursePrice int    `json:"price"`
-	Instructor  string `json:"instructor"`
+	CourseId    int    `json:"id" xml:"id"`
+	CourseName  string `json:"name" xml:"name"`
+	CoursePrice int    `json:"price" xml:"price"`
+	Instructor  string `json:"instructor" xml:"instructor"`
+	// Seats is the enrollment capacity; 0 means unlimited.
+	Seats int `json:"seats,omitempty" xml:"seats,omitempty"`
+	// AccessDays is how long a student keeps access after getting a seat;
+	// 0 means lifetime access. See access.go.
+	AccessDays int `json:"access_days,omitempty" xml:"access_days,omitempty"`
+	// PriceBook holds explicit prices in other currencies; see pricing.go.
+	PriceBook []priceEntry `json:"price_book,omitempty" xml:"price_book>price,omitempty"`
+	// Private hides the course from the catalog; see invites.go.
+	Private bool `json:"private,omitempty" xml:"private,omitempty"`
+	// Tenant is the ID of the tenant whose catalog the course is in, ""
+	// for the main site's only; see tenants.go.
+	Tenant string `json:"tenant,omitempty" xml:"tenant,omitempty"`
+	// Owner is the subject of whoever created the course; see rbac.go.
+	Owner string `json:"owner,omitempty" xml:"owner,omitempty"`
+	// Metadata holds deployment-specific fields; see metadata.go. XML
+	// carries it through xmlCourse, since encoding/xml has no maps.
+	Metadata map[string]any `json:"metadata,omitempty" xml:"-"`
 }
 
-var CourseList []course
+var (
+	CourseList []course
+	// courseMu protects CourseList. Conditional writes (If-Match) must check
+	// the current ETag and apply the change under the same lock, otherwise two
+	// editors could both pass the check and overwrite each other.
+	courseMu sync.RWMutex
+)
 
-func init() {
+// loadCatalog loads the catalog from the course file of STORE=file
+// (config.go) or, without one, from the seed file or the seed below. main
+// calls it once the flags are parsed, since they can change all three.
+func loadCatalog() {
+	if storeType == storeFile {
+		loaded, err := loadCourseFile()
+		if err != nil {
+			log.Fatalf("Invalid STORE_DSN file %s: %v", courseFile, err)
+		}
+		if loaded {
+			if seedFile != "" {
+				slog.Info("Not seeding; the course file already exists", "file", courseFile, "seed", seedFile)
+			}
+			recordLoadedCourses()
+			return
+		}
+	}
+	if seedFile != "" {
+		courses, err := readCourses(seedFile)
+		if err != nil {
+			log.Fatalf("Invalid %s file %s: %v", seedName, seedFile, err)
+		}
+		CourseList = courses
+		recordLoadedCourses()
+		return
+	}
 	CoursesJson := `[
 		{
 			"id": 1,
@@ -42,6 +103,23 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	recordLoadedCourses()
+}
+
+// recordLoadedCourses records the courses loaded at start as created and,
+// with STORE=file, writes them out, which also checks the file can be
+// written before the server listens.
+func recordLoadedCourses() {
+	seededCourses = len(CourseList)
+	for _, c := range CourseList {
+		recordChange(c.CourseId, false, traceContext{})
+	}
+	if storeType == storeFile {
+		if err := writeCourseFile(); err != nil {
+			log.Fatalf("Invalid STORE_DSN file %s: %v", courseFile, err)
+		}
+		courseFileReady = true
+	}
 }
 
 func getNextId() int {
@@ -54,61 +132,497 @@ func getNextId() int {
 	return highestId + 1
 }
 
+// courseETag returns a strong entity tag derived from the JSON representation
+// of the course, so any change to any field produces a new tag.
+func courseETag(c course) string {
+	b, _ := json.Marshal(c)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// ifMatchSatisfied reports whether the If-Match header value allows a write
+// to a resource whose current tag is etag. An absent header is allowed so
+// existing clients keep working; "*" matches any existing resource.
+func ifMatchSatisfied(header, etag string) bool {
+	if header == "" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		// If-Match uses strong comparison, so weak tags never match.
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// findCourseIndex returns the index of the course with the given id in
+// CourseList, or -1. Callers must hold courseMu.
+func findCourseIndex(id int) int {
+	for i, c := range CourseList {
+		if c.CourseId == id {
+			return i
+		}
+	}
+	return -1
+}
+
 func courseHandler(w http.ResponseWriter, r *http.Request) {
-	// Concurrency Note: This handler is not thread-safe because it modifies the global
-	// CourseList slice. In a real-world application, a mutex (sync.Mutex) should be
-	// used to protect access to CourseList, similar to the handler.go example.
 	switch r.Method {
 	case http.MethodGet:
-		courseJson, err := json.Marshal(CourseList)
+		if _, err := requestedCurrency(r); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rules := tenantMetadataRules(requestTenant(r))
+		filters, err := metadataFilters(r.URL.Query(), rules)
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sortKeys, err := parseCourseSort(r.URL.Query().Get("sort"), rules)
 		if err != nil {
-			log.Printf("Error marshaling courses: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			writeError(w, r, err.Error(), http.StatusBadRequest)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(courseJson)
+		if err := requestPrincipal(r).checkQueryFields(filters, sortKeys); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		courseMu.RLock()
+		// publicCourses returns a copy, so filtering and sorting it in place
+		// leaves CourseList alone.
+		matched := filterByMetadata(tenantCourses(r, publicCourses(CourseList)), filters)
+		sortCourses(matched, sortKeys)
+		courses, err := paginate(w, r, matched)
+		if err != nil {
+			courseMu.RUnlock()
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		courses = append([]course(nil), courses...)
+		courseMu.RUnlock()
+		w.Header().Set("Cache-Control", catalogCacheControl)
+		writeCourses(w, r, courses)
 
 	case http.MethodPost:
 		var newCourse course
 		// Use io.ReadAll instead of the deprecated ioutil.ReadAll (since Go 1.16)
 		bodyBytes, err := io.ReadAll(r.Body)
 		if err != nil {
-			http.Error(w, "Cannot read request body", http.StatusBadRequest)
+			writeBodyError(w, r, err)
 			return
 		}
 		defer r.Body.Close()
 
-		err = json.Unmarshal(bodyBytes, &newCourse)
+		err = unmarshalCourse(r, bodyBytes, &newCourse)
 		if err != nil {
-			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			writeError(w, r, invalidCourseBody(r), http.StatusBadRequest)
 			return
 		}
+		if t := requestTenant(r); t != nil {
+			newCourse.Tenant = t.ID
+		}
 
-		// The client should not be able to set the ID.
-		// We can enforce this by checking if an ID was provided.
-		if newCourse.CourseId != 0 {
-			http.Error(w, "Course ID is auto-generated and should not be provided.", http.StatusBadRequest)
+		newCourse, err = createCourse(requestPrincipal(r), newCourse)
+		if err != nil {
+			writeCourseServiceError(w, r, err)
 			return
 		}
 
-		newCourse.CourseId = getNextId()
-		CourseList = append(CourseList, newCourse)
-
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
+		w.Header().Set("ETag", courseETag(newCourse))
 		// It's a good practice to return the created resource in the response body.
-		json.NewEncoder(w).Encode(newCourse)
+		writeCourse(w, r, http.StatusCreated, newCourse)
 
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeCourseServiceError writes the REST response for an error from the
+// course service.
+func writeCourseServiceError(w http.ResponseWriter, r *http.Request, err error) {
+	var invalid *invalidCourseError
+	var forbidden *forbiddenError
+	switch {
+	case errors.Is(err, errCourseNotFound):
+		writeError(w, r, "Course not found", http.StatusNotFound)
+	case errors.As(err, &forbidden):
+		writeError(w, r, "Forbidden: "+forbidden.msg, http.StatusForbidden)
+	case errors.Is(err, errCourseModified):
+		writeError(w, r, "Course was modified by someone else", http.StatusPreconditionFailed)
+	case errors.As(err, &invalid):
+		writeError(w, r, invalid.msg, http.StatusBadRequest)
+	case errors.Is(err, errPolicyUnavailable):
+		writeError(w, r, "Authorization policy is unavailable; try again later", http.StatusServiceUnavailable)
+	default:
+		requestLogger(r).Error("Course service error", "err", err)
+		writeError(w, r, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// courseItemHandler serves a single course at /courses/{id}. Every response
+// carries an ETag, and PUT/PATCH/DELETE honor If-Match so a client editing a
+// stale copy gets 412 Precondition Failed instead of overwriting newer data.
+func courseItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, r, "Invalid course ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, err := requestedCurrency(r); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		courseMu.RLock()
+		i := findCourseIndex(id)
+		var c course
+		if i >= 0 {
+			c = CourseList[i]
+		}
+		// Private courses look missing to anyone without access.
+		visible := i >= 0 && canViewCourse(r, c)
+		courseMu.RUnlock()
+		if !visible {
+			writeError(w, r, "Course not found", http.StatusNotFound)
+			return
+		}
+		if c.Private {
+			w.Header().Set("Cache-Control", privateCacheControl)
+		} else {
+			w.Header().Set("Cache-Control", catalogCacheControl)
+		}
+		w.Header().Set("ETag", courseETag(c))
+		writeCourse(w, r, http.StatusOK, c)
+
+	case http.MethodPut, http.MethodPatch:
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, r, err)
+			return
+		}
+		defer r.Body.Close()
+
+		updated, err := updateCourse(requestPrincipal(r), id, r.Header.Get("If-Match"), func(c *course) error {
+			// A tenant's domain cannot see other catalogs' courses, nor move
+			// its own out.
+			if !tenantOwns(r, *c) {
+				return errCourseNotFound
+			}
+			owner := c.Tenant
+			// PUT replaces the whole course, PATCH only the fields present in
+			// the body, which is what unmarshaling onto the existing value
+			// gives us.
+			if r.Method == http.MethodPut {
+				*c = course{}
+			}
+			if err := unmarshalCourse(r, bodyBytes, c); err != nil {
+				return invalidCoursef("%s", invalidCourseBody(r))
+			}
+			if requestTenant(r) != nil {
+				c.Tenant = owner
+			}
+			return nil
+		})
+		if err != nil {
+			writeCourseServiceError(w, r, err)
+			return
+		}
+
+		w.Header().Set("ETag", courseETag(updated))
+		writeCourse(w, r, http.StatusOK, updated)
+
+	case http.MethodDelete:
+		courseMu.RLock()
+		i := findCourseIndex(id)
+		foreign := i >= 0 && !tenantOwns(r, CourseList[i])
+		courseMu.RUnlock()
+		if foreign {
+			writeError(w, r, "Course not found", http.StatusNotFound)
+			return
+		}
+		if err := deleteCourse(requestPrincipal(r), id, r.Header.Get("If-Match")); err != nil {
+			writeCourseServiceError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
 func main() {
-	http.HandleFunc("/courses", courseHandler)
-	http.ListenAndServe(":8080", nil)
-	log.Println("Server is running on http://localhost:8080")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dev":
+			runDevServer(os.Args[2:])
+			return
+		case "validate-spec":
+			runValidateSpec()
+			return
+		}
+	}
+	upstream := flag.String("upstream", "", "run as a caching proxy in front of another instance at this URL")
+	cacheCatalog := flag.Bool("cache", false, "cache catalog reads in front of this server's own handlers")
+	grpcAddr := flag.String("grpc", ":9090", "serve the gRPC CourseService on this address; empty to disable")
+	shadow := flag.String("shadow", "", "mirror catalog reads to the instance at this URL and compare the answers")
+	dualWrite := flag.String("dual-write", "", "copy every course write to the instance at this URL")
+	flag.BoolVar(&devMode, "dev", false, "serve templates and static assets from disk, re-read on every request")
+	serverFlags := defineServerFlags()
+	flag.Parse()
+	configureServer(serverFlags)
+	if *grpcAddr != "" && sharesPort(*grpcAddr, listenAddress()) {
+		log.Fatalf("-grpc %s and the plain HTTP address %s are the same; move one with -grpc or -addr", *grpcAddr, listenAddress())
+	}
+	loadCatalog()
+	if devMode {
+		for _, dir := range []string{"templates", "static", "docs"} {
+			if _, err := os.Stat(dir); err != nil {
+				log.Fatalf("Dev mode reads assets from the source tree; run it there: %v", err)
+			}
+		}
+		slog.Info("Dev mode: serving templates/, static/ and docs/ from disk")
+		go watchAssets(context.Background())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/courses", requireCourseWriteAuth(courseHandler))
+	mux.HandleFunc("/courses/{id}", requireCourseWriteAuth(courseItemHandler))
+	mux.HandleFunc("/courses/sync", courseSyncHandler)
+	mux.HandleFunc("/courses/import", requireCourseWriteAuth(courseImportHandler))
+	mux.HandleFunc("/imports/{id}", importHandler)
+	mux.HandleFunc("/exports", requireCourseWriteAuth(exportsHandler))
+	mux.HandleFunc("/exports/{id}", exportHandler)
+	mux.HandleFunc("/exports/{id}/download", exportDownloadHandler)
+	mux.HandleFunc("/courses/changes", courseChangesHandler)
+	mux.HandleFunc("/courses/compare", courseCompareHandler)
+	mux.HandleFunc("/courses/{id}/enrollments", courseEnrollmentsHandler)
+	mux.HandleFunc("/courses/{id}/enrollments/{student}", courseEnrollmentHandler)
+	mux.HandleFunc("/courses/{id}/enrollments/{student}/access", courseAccessHandler)
+	mux.HandleFunc("/courses/{id}/enrollments/{student}/renew", requireCourseWriteAuth(courseRenewHandler))
+	mux.HandleFunc("/courses/{id}/availability", courseAvailabilityHandler)
+	mux.HandleFunc("/students/{student}/enrollments", studentEnrollmentsHandler)
+	mux.HandleFunc("/students/{student}/notification-preferences", studentNotificationPreferencesHandler)
+	mux.HandleFunc("/me/security-events", meSecurityEventsHandler)
+	mux.HandleFunc("/me/features", meFeaturesHandler)
+	mux.HandleFunc("/ws/courses", coursesWebSocketHandler)
+	mux.HandleFunc("/events", eventsHandler)
+	mux.HandleFunc("/graphql", graphQLHandler)
+	mux.HandleFunc("/graphql/schema", graphQLSchemaHandler)
+	mux.Handle("/count", &CounterHandler{})
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/.well-known/jwks.json", jwksHandler)
+	mux.HandleFunc("/.well-known/compact-json", compactProfileHandler)
+	mux.HandleFunc("/openapi.json", openAPIHandler)
+	mux.Handle("/docs/", docsHandler())
+	mux.Handle("/docs", http.RedirectHandler("/docs/", http.StatusMovedPermanently))
+	mux.Handle("/admin/", http.StripPrefix("/admin", staticHandler()))
+	mux.HandleFunc("/auth/login", authLoginHandler)
+	mux.HandleFunc("/auth/callback", authCallbackHandler)
+	mux.HandleFunc("/auth/session", authSessionHandler)
+	mux.HandleFunc("/auth/token", authTokenHandler)
+	mux.HandleFunc("/auth/refresh", authRefreshHandler)
+	mux.HandleFunc("/auth/revoke", authRevokeHandler)
+	mux.HandleFunc("/auth/impersonation", authImpersonationHandler)
+	mux.HandleFunc("/admin/courses/import", adminCourseImportHandler)
+	mux.HandleFunc("/admin/courses/{id}/export", adminCourseExportHandler)
+	mux.HandleFunc("/admin/courses/{id}/invites", adminInvitesHandler)
+	mux.HandleFunc("/admin/courses/{id}/invites/{code}", adminInviteHandler)
+	mux.HandleFunc("/admin/courses/{id}/allowlist", adminAllowlistHandler)
+	mux.HandleFunc("/admin/api-keys", adminAPIKeysHandler)
+	mux.HandleFunc("/admin/api-keys/{id}", adminAPIKeyHandler)
+	mux.HandleFunc("/admin/clients", adminClientsHandler)
+	mux.HandleFunc("/admin/clients/{id}", adminClientHandler)
+	mux.HandleFunc("/admin/clients/{id}/secret", adminClientSecretHandler)
+	mux.HandleFunc("/admin/users", adminUsersHandler)
+	mux.HandleFunc("/admin/users/{username}", adminUserHandler)
+	mux.HandleFunc("/admin/users/{username}/password", adminUserPasswordHandler)
+	mux.HandleFunc("/admin/sessions", adminSessionsHandler)
+	mux.HandleFunc("/admin/sessions/{id}", adminSessionHandler)
+	mux.HandleFunc("/admin/impersonations", adminImpersonationsHandler)
+	mux.HandleFunc("/admin/impersonations/{id}", adminImpersonationHandler)
+	mux.HandleFunc("/admin/keys", adminKeysHandler)
+	mux.HandleFunc("/admin/webhooks", adminWebhooksHandler)
+	mux.HandleFunc("/admin/webhooks/{id}", adminWebhookHandler)
+	mux.HandleFunc("/admin/webhooks/{id}/deliveries", adminWebhookDeliveriesHandler)
+	mux.HandleFunc("/admin/audit", adminAuditHandler)
+	mux.HandleFunc("/admin/consistency", adminConsistencyHandler)
+	mux.HandleFunc("/admin/features", adminFeaturesHandler)
+	mux.HandleFunc("/admin/features/{gate}", adminFeatureHandler)
+	mux.HandleFunc("/admin/jobs", adminJobsHandler)
+	mux.HandleFunc("/admin/jobs/metrics", adminJobMetricsHandler)
+	mux.HandleFunc("/admin/dead-letters", adminDeadLettersHandler)
+	mux.HandleFunc("/admin/dead-letters/requeue", adminDeadLettersBulkHandler)
+	mux.HandleFunc("/admin/dead-letters/discard", adminDeadLettersBulkHandler)
+	mux.HandleFunc("/admin/dead-letters/{id}", adminDeadLetterHandler)
+	mux.HandleFunc("/admin/dead-letters/{id}/requeue", adminDeadLetterRequeueHandler)
+	mux.HandleFunc("/admin/logs/stream", adminLogStreamHandler)
+	mux.HandleFunc("/admin/slo", adminSLOHandler)
+	mux.HandleFunc("/admin/limiter", adminLimiterHandler(mux))
+	mux.HandleFunc("/admin/shadow", adminShadowHandler)
+	mux.HandleFunc("/admin/migration", adminMigrationHandler)
+	mux.HandleFunc("/admin/migration/backfill", adminBackfillHandler)
+	mux.HandleFunc("/admin/migration/courses/{id}", adminMigrationCourseHandler)
+	mux.HandleFunc("/admin/warmup/requests", adminWarmUpRequestsHandler)
+	mux.HandleFunc("/admin/exports", adminExportsHandler)
+	mux.HandleFunc("/admin/query", adminQueryHandler)
+	mux.HandleFunc("/admin/runbook", adminRunbookHandler)
+	mux.HandleFunc("/admin/runbook/{action}", adminRunbookActionHandler)
+	mux.HandleFunc("/admin/orders", adminOrdersHandler)
+	mux.HandleFunc("/admin/orders/{id}/refund", adminOrderRefundHandler)
+	mux.HandleFunc("/admin/instructors/{instructor}/revenue-share", adminRevenueShareHandler)
+	mux.HandleFunc("/admin/payouts", adminPayoutsHandler)
+	mux.HandleFunc("/admin/payouts/{instructor}/{period}/statement", adminPayoutStatementHandler)
+	mux.HandleFunc("/admin/payouts/{instructor}/{period}/{action}", adminPayoutActionHandler)
+	mux.HandleFunc("/admin/tenants/{id}/theme", adminThemeHandler)
+	mux.HandleFunc("/admin/tenants/{id}/theme/logo", adminThemeLogoHandler)
+	mux.HandleFunc("/admin/tenants/{id}/theme/preview", adminThemePreviewHandler)
+	mux.HandleFunc("/admin/tenants/{id}/theme/publish", adminThemePublishHandler)
+	mux.HandleFunc("/admin/tenants/{id}/email-templates", adminEmailTemplatesHandler)
+	mux.HandleFunc("/admin/tenants/{id}/email-templates/{kind}", adminEmailTemplateHandler)
+	mux.HandleFunc("/admin/tenants/{id}/email-templates/{kind}/versions/{version}", adminEmailTemplateVersionHandler)
+	mux.HandleFunc("/admin/tenants/{id}/email-templates/{kind}/versions/{version}/restore", adminEmailTemplateRestoreHandler)
+	mux.HandleFunc("/admin/tenants/{id}/email-templates/{kind}/test", adminEmailTemplateTestHandler)
+	mux.HandleFunc("/admin/email-suppressions", adminEmailSuppressionsHandler)
+	mux.HandleFunc("/admin/email-suppressions/{email}", adminEmailSuppressionHandler)
+	mux.HandleFunc("/admin/probe", adminProbeHandler)
+	mux.HandleFunc("/admin/status/incidents", adminIncidentsHandler)
+	mux.HandleFunc("/admin/status/incidents/{id}", adminIncidentHandler)
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/theme/logo", themeLogoHandler)
+	mux.HandleFunc("/email/events", emailEventsHandler)
+	mux.HandleFunc("/email/unsubscribe", unsubscribeHandler)
+	mux.Handle("/debug/vars", debugGate(expvar.Handler()))
+	if pprofEnabled {
+		registerPprof(mux)
+		slog.Info("Serving profiles at /debug/pprof/ to admins")
+	}
+
+	if *shadow != "" {
+		m, err := newShadowMirror(*shadow)
+		if err != nil {
+			log.Fatalf("Invalid shadow URL: %v", err)
+		}
+		activeShadow = m
+		slog.Info("Mirroring catalog reads", "url", *shadow)
+	}
+	if *dualWrite != "" {
+		d, err := newDualWriter(*dualWrite)
+		if err != nil {
+			log.Fatalf("Invalid dual-write URL: %v", err)
+		}
+		activeDualWriter = d
+		slog.Info("Copying course writes", "url", *dualWrite)
+	}
+
+	var api http.Handler = mux
+	if openAPIValidation != validationOff {
+		v, err := newRequestValidator()
+		if err != nil {
+			log.Fatalf("Invalid OpenAPI validation setup: %v", err)
+		}
+		api = v.handler(mux)
+		slog.Info("Validating requests against the OpenAPI document", "mode", openAPIValidation)
+	}
+	var handler http.Handler = compressHandler(shadowHandler(api))
+	switch {
+	case *upstream != "":
+		proxy, err := newUpstreamProxy(*upstream)
+		if err != nil {
+			log.Fatalf("Invalid upstream URL: %v", err)
+		}
+		handler = proxy
+		activeCatalogCache = proxy
+		slog.Info("Proxying and caching catalog reads", "upstream", *upstream)
+	case *cacheCatalog:
+		activeCatalogCache = newCachingProxy(handler)
+		handler = activeCatalogCache
+	}
+	handler = requestLogHandler(mux, ipAccessHandler(securityHeadersHandler(recoverHandler(tenantHandler(corsHandler(healthHandler(sessionHandler(csrfHandler(adminAuthHandler(jwtHandler(apiKeyHandler(auditHandler(rateLimitHandler(mux, bodyLimitHandler(mux, priorityHandler(mux, handler))))))))))))))))
+	if devMode {
+		handler = liveReloadHandler(handler)
+	}
+	go runSLOEvaluator(sloEvalInterval)
+	if signingKeysEnabled() {
+		if err := loadSigningKeys(); err != nil {
+			log.Fatalf("Invalid JWT_SIGNING_KEYS_FILE: %v", err)
+		}
+		go runKeyRotations(signingKeyCheckInterval)
+	}
+	if ipAccessFile != "" {
+		go watchIPAccessFile(ipAccessCheckInterval)
+	}
+	if configFile != "" {
+		go watchConfigFile(configCheckInterval)
+	}
+	if otlpTracesURL != "" {
+		go runSpanExporter()
+		slog.Info("Exporting spans", "url", otlpTracesURL, "sample_ratio", otelSampleRatio)
+	}
+	// A proxy does not own any data, so only the origin checks its data,
+	// reminds, exports, imports and serves gRPC.
+	if *upstream == "" {
+		consistencyEnabled = true
+		startConsistencyCheck("startup")
+		go runExpiryReminders(expiryReminderInterval)
+		go runDigests(digestCheckInterval)
+		go runStatusChecks(statusCheckInterval)
+		go runImports()
+		if err := os.MkdirAll(exportArtifactDir, 0o755); err != nil {
+			log.Fatalf("Invalid EXPORT_ARTIFACT_DIR: %v", err)
+		}
+		go runExportJobs()
+		go runExportSweeper(exportSweepInterval)
+		if probeInterval > 0 {
+			go runProbes(handler, probeInterval)
+		}
+		if exportDir != "" {
+			e, err := newWarehouseExporter(exportDir)
+			if err != nil {
+				log.Fatalf("Invalid EXPORT_DIR: %v", err)
+			}
+			activeExporter = e
+			go runWarehouseExports(e, exportInterval)
+		}
+		if *grpcAddr != "" {
+			go func() {
+				slog.Info("gRPC CourseService is running", "addr", *grpcAddr)
+				log.Fatal(newGRPCServer(*grpcAddr).ListenAndServe())
+			}()
+		}
+	}
+
+	// Listen before warming up so the warm-up requests have somewhere to
+	// go; /readyz reports ready once they are done.
+	ln, err := net.Listen("tcp", listenAddress())
+	if err != nil {
+		log.Fatal(err)
+	}
+	go warmUp(fmt.Sprintf("http://127.0.0.1:%d", ln.Addr().(*net.TCPAddr).Port))
+	plain := handler
+	if tlsEnabled() {
+		go func() {
+			slog.Info("Serving HTTPS", "addr", tlsAddr)
+			log.Fatal(newTLSServer(handler).ListenAndServeTLS("", ""))
+		}()
+		if httpsRedirect {
+			plain = httpsRedirectHandler(handler)
+		}
+		if clientAuthMode == clientAuthRequire {
+			plain = clientCertRequiredHandler(plain)
+		}
+		if acme != nil {
+			plain = acmeChallengeHandler(plain)
+			go runACMERenewals(acmeRenewInterval)
+		}
+	}
+	slog.Info("Server is running", "addr", ln.Addr().String(), "store", storeType)
+	log.Fatal(withServerLimits(&http.Server{Handler: plain, Protocols: plainProtocols()}).Serve(ln))
 }
 
 /*
@@ -141,5 +655,11 @@ func main() {
 	5. การจัดการ State (In-Memory Database):
 	   - ในตัวอย่างนี้ เราใช้ Global Variable (`CourseList`) เพื่อจำลองการเก็บข้อมูลในหน่วยความจำ (In-memory)
 	   - `init()` function จะถูกเรียกทำงานเพียงครั้งเดียวก่อน `main()` เหมาะสำหรับการเตรียมข้อมูลเริ่มต้น
-	   - **ข้อควรระวัง:** การใช้ Global Variable ในลักษณะนี้ **ไม่ปลอดภัยสำหรับการทำงานพร้อมกัน (Not Concurrency-Safe)** หากมีหลาย request เข้ามาแก้ไข `CourseList` พร้อมกัน อาจเกิด Race Condition ได้ ควรใช้ Mutex (`sync.Mutex`) เพื่อป้องกันปัญหานี้ (เหมือนในตัวอย่าง `handler.go`)
+	   - **ข้อควรระวัง:** การใช้ Global Variable ในลักษณะนี้ **ไม่ปลอดภัยสำหรับการทำงานพร้อมกัน (Not Concurrency-Safe)** หากมีหลาย request เข้ามาแก้ไข `CourseList` พร้อมกัน อาจเกิด Race Condition ได้ จึงใช้ `sync.RWMutex` (`courseMu`) ป้องกันไว้ (เหมือนในตัวอย่าง `handler.go`)
+
+	6. Conditional Writes ด้วย ETag และ If-Match:
+	   - ทุก response ของ `/courses/{id}` จะมี header `ETag` ซึ่งคำนวณจากข้อมูลของ course
+	   - client ที่ต้องการแก้ไข (PUT/PATCH/DELETE) ส่ง `If-Match: <etag>` ที่ได้มาล่าสุดกลับมา
+	   - ถ้ามีคนอื่นแก้ไขไปก่อนแล้ว ETag จะไม่ตรงกัน server จะตอบ `412 Precondition Failed` แทนการเขียนทับข้อมูลของคนอื่นแบบเงียบๆ
+	   - การตรวจ ETag และการเขียนข้อมูลต้องทำภายใต้ lock เดียวกัน ไม่เช่นนั้นสอง request อาจผ่านการตรวจพร้อมกันได้
 */
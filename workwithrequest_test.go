@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// addTestTenant adds the tenant acme on acme.test. Like those of
+// TENANTS_FILE, it stays for the rest of the run: emails sent in the
+// background look tenants up after a test ends.
+var addTestTenant = sync.OnceFunc(func() {
+	acme := &tenant{ID: "acme", Domains: []string{"acme.test"}, Name: "Acme"}
+	tenantsByDomain[acme.Domains[0]] = acme
+	tenantsByID[acme.ID] = acme
+})
+
+// newTestServer serves some of main's routes, registered as main registers
+// them, behind the middleware that decides who a request is from and which
+// tenant it is for. It starts from catalog with JWT_HMAC_SECRET set and the
+// tenant of addTestTenant, and puts the other globals it changes back once
+// t ends.
+func newTestServer(t *testing.T, catalog []course) http.Handler {
+	t.Helper()
+	addTestTenant()
+	oldSecret := jwtHMACSecret
+	jwtHMACSecret = []byte("sekrit")
+	courseMu.Lock()
+	oldCourses, oldEnrollments, oldInvites := CourseList, enrollments, courseInvites
+	CourseList, enrollments, courseInvites = catalog, map[int]*courseEnrollments{}, map[int]*courseAccessList{}
+	courseMu.Unlock()
+	digestMu.Lock()
+	oldPrefs := notificationPrefs
+	notificationPrefs = map[string]string{}
+	digestMu.Unlock()
+	// Emails sent in the background may still be reading these.
+	t.Cleanup(func() {
+		jwtHMACSecret = oldSecret
+		courseMu.Lock()
+		CourseList, enrollments, courseInvites = oldCourses, oldEnrollments, oldInvites
+		courseMu.Unlock()
+		digestMu.Lock()
+		notificationPrefs = oldPrefs
+		digestMu.Unlock()
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/courses", requireCourseWriteAuth(courseHandler))
+	mux.HandleFunc("/courses/{id}", requireCourseWriteAuth(courseItemHandler))
+	mux.HandleFunc("/courses/{id}/enrollments", courseEnrollmentsHandler)
+	mux.HandleFunc("/courses/{id}/enrollments/{student}", courseEnrollmentHandler)
+	mux.HandleFunc("/courses/{id}/availability", courseAvailabilityHandler)
+	mux.HandleFunc("/students/{student}/enrollments", studentEnrollmentsHandler)
+	mux.HandleFunc("/students/{student}/notification-preferences", studentNotificationPreferencesHandler)
+	mux.HandleFunc("/graphql", graphQLHandler)
+	return tenantHandler(sessionHandler(csrfHandler(jwtHandler(apiKeyHandler(mux)))))
+}
+
+// testToken returns a bearer token for subject with role, signed with the
+// secret newTestServer sets.
+func testToken(t *testing.T, subject, role string) string {
+	t.Helper()
+	claims := map[string]any{"sub": subject, "role": role, "exp": time.Now().Add(time.Hour).Unix()}
+	return testJWT(t, map[string]any{"alg": "HS256"}, claims, hs256(jwtHMACSecret))
+}
+
+// serve sends a request for target on host, with token as its bearer token
+// unless it is "", and returns the response.
+func serve(h http.Handler, method, host, target, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "http://"+host+target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
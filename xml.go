@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+const mediaTypeXML = "application/xml"
+
+var xmlCodec = &codec{
+	mediaType:   mediaTypeXML,
+	contentType: mediaTypeXML + "; charset=utf-8",
+	encodeCourse: func(r *http.Request, c course) ([]byte, error) {
+		return marshalXMLDocument(newXMLCourse(r, c))
+	},
+	encodeCourses: func(r *http.Request, courses []course) ([]byte, error) {
+		list := xmlCourseList{Courses: make([]xmlCourse, len(courses))}
+		for i, c := range courses {
+			list.Courses[i] = newXMLCourse(r, c)
+		}
+		return marshalXMLDocument(list)
+	},
+	decodeCourse: func(body []byte, dst *course) error { return xml.Unmarshal(body, dst) },
+	encodeError: func(status int, message, requestID string) ([]byte, error) {
+		return marshalXMLDocument(xmlError{Status: status, RequestID: requestID, Message: message})
+	},
+}
+
+// xmlLink is the XML form of a link; encoding/xml cannot marshal maps.
+type xmlLink struct {
+	Rel    string `xml:"rel,attr"`
+	Href   string `xml:"href,attr"`
+	Method string `xml:"method,attr,omitempty"`
+}
+
+type xmlCourse struct {
+	XMLName xml.Name `xml:"course"`
+	course
+	Metadata []xmlMetadata   `xml:"metadata>field,omitempty"`
+	Pricing  *effectivePrice `xml:"pricing,omitempty"`
+	Links    []xmlLink       `xml:"link"`
+}
+
+// xmlMetadata is one course metadata entry, <field key="campus">BKK</field>.
+type xmlMetadata struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlCourseList struct {
+	XMLName xml.Name    `xml:"courses"`
+	Courses []xmlCourse `xml:"course"`
+}
+
+type xmlError struct {
+	XMLName   xml.Name `xml:"error"`
+	Status    int      `xml:"status"`
+	RequestID string   `xml:"request_id,omitempty"`
+	Message   string   `xml:"message"`
+}
+
+func newXMLCourse(r *http.Request, c course) xmlCourse {
+	res := newCourseResource(c)
+	x := xmlCourse{course: c, Pricing: pricingFor(r, c)}
+	for _, k := range slices.Sorted(maps.Keys(c.Metadata)) {
+		x.Metadata = append(x.Metadata, xmlMetadata{Key: k, Value: fmt.Sprint(c.Metadata[k])})
+	}
+	for _, rel := range []string{"self", "update", "delete", "collection"} {
+		l := res.Links[rel]
+		x.Links = append(x.Links, xmlLink{Rel: rel, Href: l.Href, Method: l.Method})
+	}
+	return x
+}
+
+func marshalXMLDocument(v any) ([]byte, error) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: XML สำหรับระบบเก่า (legacy integrations)
+
+	1. ใช้ struct tag `xml:"..."` บน `course` ชุดเดียวกับ `json:"..."` ได้ผลเป็น `<course>` / `<courses>`
+	2. `encoding/xml` marshal map ไม่ได้ links จึงถูกแปลงเป็น `<link rel="..." href="..."/>` แทน
+*/
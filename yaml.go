@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The standard library has no YAML package, so this file implements the
+// block-style subset our tools exchange: nested mappings and sequences of
+// plain or quoted scalars, with comments. Flow collections ({a: 1}, [1, 2]),
+// anchors, tags and multi-line scalars are rejected.
+//
+// Values go through encoding/json on the way in and out, so the same json
+// struct tags control field names for both formats.
+
+const mediaTypeYAML = "application/yaml"
+
+var yamlCodec = &codec{
+	mediaType:   mediaTypeYAML,
+	contentType: mediaTypeYAML + "; charset=utf-8",
+	encodeCourse: func(r *http.Request, c course) ([]byte, error) {
+		return marshalYAML(newRequestCourseResource(r, c))
+	},
+	encodeCourses: func(r *http.Request, courses []course) ([]byte, error) {
+		return marshalYAML(newRequestCourseResources(r, courses))
+	},
+	decodeCourse: func(body []byte, dst *course) error { return unmarshalYAML(body, dst) },
+	encodeError: func(status int, message, requestID string) ([]byte, error) {
+		return marshalYAML(map[string]any{"status": status, "error": message, "request_id": requestID})
+	},
+	encodeValue: marshalYAML,
+	decodeValue: unmarshalYAML,
+}
+
+// marshalYAML encodes v as block-style YAML.
+func marshalYAML(v any) ([]byte, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic any
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writeYAMLNode(&buf, generic, 0)
+	return buf.Bytes(), nil
+}
+
+func writeYAMLNode(buf *bytes.Buffer, v any, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch v := v.(type) {
+	case map[string]any:
+		if len(v) == 0 {
+			buf.WriteString(pad + "{}\n")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			writeYAMLEntry(buf, pad+yamlScalar(k)+":", v[k], indent)
+		}
+	case []any:
+		if len(v) == 0 {
+			buf.WriteString(pad + "[]\n")
+			return
+		}
+		for _, item := range v {
+			writeYAMLEntry(buf, pad+"-", item, indent)
+		}
+	default:
+		buf.WriteString(pad + yamlScalar(v) + "\n")
+	}
+}
+
+func writeYAMLEntry(buf *bytes.Buffer, prefix string, v any, indent int) {
+	switch child := v.(type) {
+	case map[string]any:
+		if len(child) > 0 && strings.HasSuffix(prefix, "-") {
+			// Compact form: the first key goes on the dash line. The dash and
+			// its space take exactly the width of one indentation level.
+			var item bytes.Buffer
+			writeYAMLNode(&item, child, indent+1)
+			buf.WriteString(prefix + " ")
+			buf.Write(item.Bytes()[len(prefix)+1:])
+			return
+		}
+		if len(child) > 0 {
+			buf.WriteString(prefix + "\n")
+			writeYAMLNode(buf, child, indent+1)
+			return
+		}
+		buf.WriteString(prefix + " {}\n")
+	case []any:
+		if len(child) > 0 {
+			buf.WriteString(prefix + "\n")
+			writeYAMLNode(buf, child, indent+1)
+			return
+		}
+		buf.WriteString(prefix + " []\n")
+	default:
+		buf.WriteString(prefix + " " + yamlScalar(child) + "\n")
+	}
+}
+
+func yamlScalar(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	case string:
+		if v == "" || yamlNeedsQuotes(v) {
+			return strconv.Quote(v)
+		}
+		return v
+	}
+	return strconv.Quote(fmt.Sprint(v))
+}
+
+// yamlNeedsQuotes reports whether a plain scalar would be read back as
+// something other than the same string.
+func yamlNeedsQuotes(s string) bool {
+	if _, ok := parseYAMLPlain(s).(string); !ok {
+		return true
+	}
+	if strings.TrimSpace(s) != s || strings.ContainsAny(s, "\n\t\"'#{}[],&*!|>%@`") || strings.Contains(s, ": ") {
+		return true
+	}
+	return strings.HasPrefix(s, "- ") || strings.HasPrefix(s, "?") || strings.HasSuffix(s, ":")
+}
+
+// unmarshalYAML decodes YAML into v using v's json struct tags.
+func unmarshalYAML(data []byte, v any) error {
+	lines, err := yamlLines(data)
+	if err != nil {
+		return err
+	}
+	var generic any
+	if len(lines) > 0 {
+		p := &yamlParser{lines: lines}
+		if generic, err = p.parseNode(lines[0].indent); err != nil {
+			return err
+		}
+		if p.pos < len(lines) {
+			return fmt.Errorf("yaml: line %d: unexpected indentation", lines[p.pos].number)
+		}
+	}
+	j, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// yamlLines strips comments and blank lines and records indentation.
+func yamlLines(data []byte) ([]yamlLine, error) {
+	var lines []yamlLine
+	for n, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		if strings.HasPrefix(raw, "---") || strings.HasPrefix(raw, "...") {
+			continue
+		}
+		text := stripYAMLComment(raw)
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.TrimSpace(trimmed) == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("yaml: line %d: tabs are not allowed for indentation", n+1)
+		}
+		lines = append(lines, yamlLine{number: n + 1, indent: len(text) - len(trimmed), text: strings.TrimRight(trimmed, " ")})
+	}
+	return lines, nil
+}
+
+// stripYAMLComment removes a trailing "# comment" that is not inside quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) parseNode(indent int) (any, error) {
+	if strings.HasPrefix(p.lines[p.pos].text, "-") && (len(p.lines[p.pos].text) == 1 || p.lines[p.pos].text[1] == ' ') {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseSequence(indent int) (any, error) {
+	seq := []any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("yaml: line %d: expected a sequence item", line.number)
+		}
+		if line.text != "-" && !strings.HasPrefix(line.text, "- ") {
+			// The next key of a mapping whose value was this sequence.
+			break
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		switch {
+		case rest == "":
+			// The item is the nested block on the following lines.
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				seq = append(seq, nil)
+				continue
+			}
+			item, err := p.parseNode(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, item)
+		case isYAMLMappingEntry(rest):
+			// "- key: value" starts a mapping indented to where key begins.
+			childIndent := indent + len(line.text) - len(rest)
+			p.lines[p.pos] = yamlLine{number: line.number, indent: childIndent, text: rest}
+			item, err := p.parseMapping(childIndent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, item)
+		default:
+			v, err := parseYAMLScalar(rest, line.number)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			p.pos++
+		}
+	}
+	return seq, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("yaml: line %d: unexpected indentation", line.number)
+		}
+		key, value, ok := splitYAMLEntry(line.text)
+		if !ok {
+			return nil, fmt.Errorf("yaml: line %d: expected \"key: value\"", line.number)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("yaml: line %d: empty key", line.number)
+		}
+		k, err := parseYAMLScalar(key, line.number)
+		if err != nil {
+			return nil, err
+		}
+		name := fmt.Sprint(k)
+		if _, dup := m[name]; dup {
+			return nil, fmt.Errorf("yaml: line %d: duplicate key %q", line.number, name)
+		}
+		p.pos++
+		if value != "" {
+			if m[name], err = parseYAMLScalar(value, line.number); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// A sequence may sit at the same indentation as its key.
+		if p.pos < len(p.lines) && (p.lines[p.pos].indent > indent ||
+			(p.lines[p.pos].indent == indent && strings.HasPrefix(p.lines[p.pos].text, "- "))) {
+			if m[name], err = p.parseNode(p.lines[p.pos].indent); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		m[name] = nil
+	}
+	return m, nil
+}
+
+func isYAMLMappingEntry(s string) bool {
+	_, _, ok := splitYAMLEntry(s)
+	return ok
+}
+
+// splitYAMLEntry splits "key: value" at the first colon outside quotes that
+// is followed by a space or the end of the line.
+func splitYAMLEntry(s string) (key, value string, ok bool) {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ':' && (i+1 == len(s) || s[i+1] == ' '):
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+func parseYAMLScalar(s string, line int) (any, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case s == "{}":
+		return map[string]any{}, nil
+	case s == "[]":
+		return []any{}, nil
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("yaml: line %d: invalid double-quoted string", line)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("yaml: line %d: invalid single-quoted string", line)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.ContainsAny(s[:1], "{[&*!|>"):
+		return nil, fmt.Errorf("yaml: line %d: unsupported YAML syntax %q", line, s)
+	}
+	return parseYAMLPlain(s), nil
+}
+
+// parseYAMLPlain resolves an unquoted scalar using the YAML 1.2 core schema.
+func parseYAMLPlain(s string) any {
+	switch s {
+	case "null", "Null", "NULL", "~", "":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return json.Number(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "xXpP_") && s != "Inf" && s != "NaN" {
+		return json.Number(s)
+	}
+	return s
+}
+
+/*
+	summary
+
+	หัวใจสำคัญ: รองรับ YAML โดยไม่พึ่ง library ภายนอก
+
+	1. standard library ของ Go ไม่มี package YAML ไฟล์นี้จึงเขียน parser/encoder สำหรับ YAML แบบ block (mapping, sequence, scalar, comment) เท่าที่เครื่องมือของเราใช้
+	2. ทริค: แปลงข้อมูลผ่าน `encoding/json` ทั้งขาเข้าและขาออก ทำให้ใช้ struct tag `json:"..."` ชุดเดียวกันได้ ไม่ต้องเพิ่ม tag `yaml:"..."`
+	3. string ที่หน้าตาเหมือนตัวเลขหรือ boolean (เช่น "123", "true") จะถูกใส่เครื่องหมายคำพูดตอน encode เพื่อให้อ่านกลับมาได้เป็น string เหมือนเดิม
+*/
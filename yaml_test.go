@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalYAML(t *testing.T) {
+	for _, tt := range []struct {
+		name, in string
+		want     any
+	}{
+		{"empty", "", nil},
+		{"mapping", "name: Go\nprice: 100\n", map[string]any{"name": "Go", "price": float64(100)}},
+		{"empty value", "name:\n", map[string]any{"name": nil}},
+		{"quoted", "name: \"a: b\"\nother: 'it''s'\n", map[string]any{"name": "a: b", "other": "it's"}},
+		{"sequence", "- 1\n- two\n-\n", []any{float64(1), "two", nil}},
+		{"nested", "tags:\n- a\n- b\nmeta:\n  level: 3\n", map[string]any{"tags": []any{"a", "b"}, "meta": map[string]any{"level": float64(3)}}},
+		{"comments", "# head\nname: Go # tail\n", map[string]any{"name": "Go"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got any
+			if err := unmarshalYAML([]byte(tt.in), &got); err != nil {
+				t.Fatalf("unmarshalYAML(%q): %v", tt.in, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unmarshalYAML(%q) = %#v, want %#v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalYAMLMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		name, in, err string
+	}{
+		{"empty key", ": x\n", "empty key"},
+		{"empty key in sequence", "- a\n- : :\n  [\n", "empty key"},
+		{"flow mapping", "a: {b: c}\n", "unsupported"},
+		{"flow sequence", "a: [1, 2]\n", "unsupported"},
+		{"anchor", "a: &x 1\n", "unsupported"},
+		{"tab indent", "a:\n\tb: c\n", "tabs"},
+		{"bad indent", "a: 1\n  b: 2\n", "indentation"},
+		{"duplicate key", "a: 1\na: 2\n", "duplicate"},
+		{"no colon", "a: 1\nb\n", "key: value"},
+		{"bad double quote", "a: \"x\n", "double-quoted"},
+		{"bad single quote", "a: 'x\n", "single-quoted"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var got any
+			err := unmarshalYAML([]byte(tt.in), &got)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("unmarshalYAML(%q) = %v, want an error containing %q", tt.in, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMarshalYAMLRoundTrip(t *testing.T) {
+	in := map[string]any{"name": "Go", "price": float64(100), "code": "123", "on": "true", "tags": []any{"a", "b"}}
+	data, err := marshalYAML(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got any
+	if err := unmarshalYAML(data, &got); err != nil {
+		t.Fatalf("unmarshalYAML(%q): %v", data, err)
+	}
+	if !reflect.DeepEqual(got, in) {
+		t.Errorf("round trip of %q = %#v, want %#v", data, got, in)
+	}
+}
+
+func FuzzUnmarshalYAML(f *testing.F) {
+	for _, s := range []string{"a: 1\n", "- a\n- : :\n  [\n", "a:\n- b\n- c: d\n  e: f\n", "? x\n"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		var v any
+		unmarshalYAML([]byte(s), &v)
+	})
+}